@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/service"
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/idtoken"
+)
+
+// roleKey holds the caller's role in the gin context.
+const roleKey = "role"
+
+// Auth checks X-API-Key, or an OIDC bearer token, and sets the caller's role. The admin
+// key (API_KEY) has access to everything; keys of access.api_keys and OIDC identities
+// access all tenants with their role; a tenant key attaches its tenant to the request
+// context, confining the request to that tenant, with the tenant's role. Without any
+// key or OIDC audience the API is open, to admins. /health is always open, and Pub/Sub
+// push requests and Cloud Storage events authenticate with their OIDC token.
+func Auth(adminKey string, tenants map[string]config.Tenant, access config.Access) gin.HandlerFunc {
+	type keyOwner struct {
+		key    string
+		tenant string
+		role   string
+	}
+	var owners []keyOwner
+	for k, role := range access.APIKeys {
+		owners = append(owners, keyOwner{key: k, role: role})
+	}
+	for name, t := range tenants {
+		for _, k := range t.APIKeys {
+			role := t.KeyRoles[k]
+			if role == "" {
+				role = t.Role
+			}
+			if role == "" {
+				role = config.RoleAdmin
+			}
+			owners = append(owners, keyOwner{key: k, tenant: name, role: role})
+		}
+	}
+	oidc := access.OIDC
+	if oidc.GroupsClaim == "" {
+		oidc.GroupsClaim = "groups"
+	}
+	open := adminKey == "" && len(owners) == 0 && oidc.Audience == ""
+	return func(c *gin.Context) {
+		if c.Request.URL.Path == "/health" || c.Request.URL.Path == PubSubPushPath || c.Request.URL.Path == ObjectEventsPath || open {
+			c.Set(roleKey, config.RoleAdmin)
+			c.Next()
+			return
+		}
+		got := c.GetHeader("X-API-Key")
+		if got != "" && adminKey != "" && subtle.ConstantTimeCompare([]byte(got), []byte(adminKey)) == 1 {
+			c.Request = c.Request.WithContext(service.WithAPIKeyID(c.Request.Context(), service.KeyID(got)))
+			c.Set(roleKey, config.RoleAdmin)
+			c.Next()
+			return
+		}
+		for _, o := range owners {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(o.key)) == 1 {
+				ctx := c.Request.Context()
+				if o.tenant != "" {
+					ctx = service.WithTenant(ctx, o.tenant, tenants[o.tenant])
+				}
+				ctx = service.WithAPIKeyID(ctx, service.KeyID(got))
+				c.Request = c.Request.WithContext(ctx)
+				c.Set(roleKey, o.role)
+				c.Next()
+				return
+			}
+		}
+		if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && got == "" && oidc.Audience != "" {
+			if role := oidcRole(c.Request.Context(), oidc, token, idtoken.Validate); role != "" {
+				c.Set(roleKey, role)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+// oidcRole validates an ID token and returns the highest role of its verified email and
+// groups, or "" when the token is invalid or grants no role.
+func oidcRole(ctx context.Context, oidc config.OIDCAccess, token string, validate func(ctx context.Context, token, audience string) (*idtoken.Payload, error)) string {
+	payload, err := validate(ctx, token, oidc.Audience)
+	if err != nil {
+		slog.WarnContext(ctx, "Rejected ID token", "error", err)
+		return ""
+	}
+	var identities []string
+	if email, _ := payload.Claims["email"].(string); email != "" {
+		if verified, _ := payload.Claims["email_verified"].(bool); verified {
+			identities = append(identities, strings.ToLower(email))
+		}
+	}
+	switch groups := payload.Claims[oidc.GroupsClaim].(type) {
+	case string:
+		identities = append(identities, groups)
+	case []any:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identities = append(identities, s)
+			}
+		}
+	}
+	role := ""
+	for who, r := range oidc.Roles {
+		for _, id := range identities {
+			if strings.EqualFold(who, id) && config.RoleRank(r) > config.RoleRank(role) {
+				role = r
+			}
+		}
+	}
+	if role == "" {
+		slog.WarnContext(ctx, "ID token grants no role", "subject", payload.Subject, "identities", identities)
+	}
+	return role
+}
+
+// Role returns the role Auth set for the caller.
+func Role(c *gin.Context) string {
+	return c.GetString(roleKey)
+}
+
+// RequireRole rejects callers below role with 403.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.RoleRank(Role(c)) < config.RoleRank(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden: requires role " + role})
+			return
+		}
+		c.Next()
+	}
+}
+
+// WhoAmIHandler returns the caller's role and tenant, so clients can offer only what the
+// caller may do.
+func WhoAmIHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"role": Role(c), "tenant": service.TenantName(c.Request.Context())})
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bq-exporter/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/idtoken"
+)
+
+func TestOIDCRole(t *testing.T) {
+	oidc := config.OIDCAccess{
+		Audience:    "https://exporter.example",
+		GroupsClaim: "groups",
+		Roles: map[string]string{
+			"alice@example.com":     config.RoleViewer,
+			"exporters@example.com": config.RoleOperator,
+			"admins":                config.RoleAdmin,
+		},
+	}
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string
+	}{
+		{"verified email", map[string]any{"email": "alice@example.com", "email_verified": true}, config.RoleViewer},
+		{"email case", map[string]any{"email": "Alice@Example.com", "email_verified": true}, config.RoleViewer},
+		{"unverified email", map[string]any{"email": "alice@example.com", "email_verified": false}, ""},
+		{"email without verification", map[string]any{"email": "alice@example.com"}, ""},
+		{"group", map[string]any{"groups": []any{"other", "exporters@example.com"}}, config.RoleOperator},
+		{"single group", map[string]any{"groups": "admins"}, config.RoleAdmin},
+		{"highest role wins", map[string]any{"email": "alice@example.com", "email_verified": true, "groups": []any{"admins", "exporters@example.com"}}, config.RoleAdmin},
+		{"unverified email keeps groups", map[string]any{"email": "alice@example.com", "groups": []any{"exporters@example.com"}}, config.RoleOperator},
+		{"no role", map[string]any{"email": "bob@example.com", "email_verified": true, "groups": []any{"other"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validate := func(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
+				return &idtoken.Payload{Audience: audience, Claims: tt.claims}, nil
+			}
+			if got := oidcRole(context.Background(), oidc, "token", validate); got != tt.want {
+				t.Errorf("oidcRole() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("groups claim", func(t *testing.T) {
+		oidc := oidc
+		oidc.GroupsClaim = "roles"
+		validate := func(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
+			return &idtoken.Payload{Claims: map[string]any{"groups": "admins", "roles": []any{"exporters@example.com"}}}, nil
+		}
+		if got := oidcRole(context.Background(), oidc, "token", validate); got != config.RoleOperator {
+			t.Errorf("oidcRole() = %q, want the role of the configured claim", got)
+		}
+	})
+	t.Run("invalid token", func(t *testing.T) {
+		validate := func(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
+			return nil, errors.New("token expired")
+		}
+		if got := oidcRole(context.Background(), oidc, "token", validate); got != "" {
+			t.Errorf("oidcRole() = %q, want no role", got)
+		}
+	})
+}
+
+func TestAuthRoles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tenants := map[string]config.Tenant{
+		"site-a": {APIKeys: []string{"key-a", "key-a-viewer"}, Role: config.RoleOperator, KeyRoles: map[string]string{"key-a-viewer": config.RoleViewer}},
+		"site-b": {APIKeys: []string{"key-b"}},
+	}
+	access := config.Access{APIKeys: map[string]string{"key-ops": config.RoleOperator}}
+	r := gin.New()
+	r.Use(Auth("key-admin", tenants, access))
+	r.GET("/api/whoami", WhoAmIHandler())
+	r.POST("/api/export", RequireRole(config.RoleOperator), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.POST("/api/pipelines", RequireRole(config.RoleAdmin), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	tests := []struct {
+		name       string
+		key        string
+		wantRole   string
+		wantTenant string
+		// wantExport and wantPipelines are the statuses of an operator and an admin route
+		wantExport, wantPipelines int
+	}{
+		{"admin key", "key-admin", config.RoleAdmin, "", http.StatusNoContent, http.StatusNoContent},
+		{"access key", "key-ops", config.RoleOperator, "", http.StatusNoContent, http.StatusForbidden},
+		// Tenant keys are confined to their tenant, with its role
+		{"tenant key", "key-a", config.RoleOperator, "site-a", http.StatusNoContent, http.StatusForbidden},
+		{"tenant key role", "key-a-viewer", config.RoleViewer, "site-a", http.StatusForbidden, http.StatusForbidden},
+		{"tenant default role", "key-b", config.RoleAdmin, "site-b", http.StatusNoContent, http.StatusNoContent},
+		{"unknown key", "key-c", "", "", http.StatusUnauthorized, http.StatusUnauthorized},
+		{"no key", "", "", "", http.StatusUnauthorized, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			do := func(method, path string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, path, nil)
+				if tt.key != "" {
+					req.Header.Set("X-API-Key", tt.key)
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				return w
+			}
+			if w := do(http.MethodGet, "/api/whoami"); tt.wantRole != "" {
+				var got struct{ Role, Tenant string }
+				json.Unmarshal(w.Body.Bytes(), &got)
+				if got.Role != tt.wantRole || got.Tenant != tt.wantTenant {
+					t.Errorf("whoami = %s, want role %q of tenant %q", w.Body, tt.wantRole, tt.wantTenant)
+				}
+			} else if w.Code != http.StatusUnauthorized {
+				t.Errorf("whoami status = %d, want 401", w.Code)
+			}
+			if w := do(http.MethodPost, "/api/export"); w.Code != tt.wantExport {
+				t.Errorf("export status = %d, want %d", w.Code, tt.wantExport)
+			}
+			if w := do(http.MethodPost, "/api/pipelines"); w.Code != tt.wantPipelines {
+				t.Errorf("pipelines status = %d, want %d", w.Code, tt.wantPipelines)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"bq-exporter/service"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchRequest runs several export requests, each of them an /api/export request body.
+type BatchRequest struct {
+	Exports []ExportRequest `json:"exports"`
+	// Parallelism is how many exports run at a time (default 1)
+	Parallelism int `json:"parallelism"`
+}
+
+// BatchResponse reports every export of a batch.
+type BatchResponse struct {
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	service.BatchResult
+}
+
+// BatchHandler runs a batch of exports. Invalid exports reject the whole batch before any
+// runs; otherwise it answers 200 when every export succeeded and 207 when some failed,
+// each export reporting its own status and whether it committed.
+func BatchHandler(exporter *service.Exporter, limits Limits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Exports) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "exports is required"})
+			return
+		}
+		exports := make([]service.BatchExport, len(req.Exports))
+		for i, x := range req.Exports {
+			switch {
+			case x.Query == "" && x.Pipeline == "" && x.ChangesTable == "":
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("exports[%d]: either query, changes_table or pipeline is required", i)})
+				return
+			case x.Query != "" && x.Pipeline != "":
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("exports[%d]: query and pipeline are mutually exclusive", i)})
+				return
+			}
+			if err := config.ValidateRequestAssertions(x.Assertions); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("exports[%d]: %v", i, err)})
+				return
+			}
+			if err := limits.checkRequestQuery(c.Request.Context(), exporter, x); err != nil {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("exports[%d]: %v", i, err)})
+				return
+			}
+			if x.LogicalDate == "" {
+				x.LogicalDate = c.GetHeader("X-CloudScheduler-ScheduleTime")
+			}
+			exports[i] = service.BatchExport{Pipeline: x.Pipeline, Parameters: x.Parameters, Params: x.Params()}
+		}
+
+		slog.InfoContext(c.Request.Context(), "Received batch export request", "exports", len(exports), "parallelism", max(req.Parallelism, 1))
+		res := exporter.Batch(c.Request.Context(), exports, req.Parallelism)
+		resp := BatchResponse{Message: "OK", RequestID: logging.RequestID(c.Request.Context()), BatchResult: res}
+		status := http.StatusOK
+		if res.Failed > 0 {
+			resp.Message = fmt.Sprintf("%d of %d exports failed", res.Failed, len(res.Items))
+			status = http.StatusMultiStatus
+		}
+		c.JSON(status, resp)
+	}
+}
@@ -0,0 +1,15 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BreakersHandler returns the circuit breakers of the destinations visible to the caller.
+func BreakersHandler(exporter *service.Exporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"breakers": exporter.Breakers(c.Request.Context())})
+	}
+}
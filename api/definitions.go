@@ -0,0 +1,51 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefinitionsHandler returns the pipelines visible to the caller as a YAML document,
+// to keep in Git and apply with ApplyDefinitionsHandler.
+func DefinitionsHandler(store *service.PipelineStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := service.MarshalDefinitions(store.Definitions(c.Request.Context()))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "application/yaml; charset=utf-8", data)
+	}
+}
+
+// ApplyDefinitionsHandler applies a YAML or JSON definitions document: ?prune=true also
+// deletes the pipelines it leaves out, ?dry_run=true only reports the changes.
+func ApplyDefinitionsHandler(store *service.PipelineStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		d, err := service.ParseDefinitions(data)
+		var changes service.DefinitionsChanges
+		if err == nil {
+			changes, err = store.Apply(c.Request.Context(), d, c.Query("prune") == "true", c.Query("dry_run") == "true")
+		}
+		if err != nil {
+			status, ok := requestErrorStatus(err)
+			if !ok {
+				status = http.StatusBadRequest
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		slog.InfoContext(c.Request.Context(), "Definitions applied", "created", changes.Created, "updated", changes.Updated,
+			"deleted", changes.Deleted, "dry_run", changes.DryRun)
+		c.JSON(http.StatusOK, changes)
+	}
+}
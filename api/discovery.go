@@ -0,0 +1,43 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListDiscoveriesHandler returns the discoveries visible to the caller, with the
+// pipelines they proposed that await approval.
+func ListDiscoveriesHandler(d *service.Discoverer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"discoveries": d.List(c.Request.Context())})
+	}
+}
+
+// ScanDiscoveryHandler scans a discovery's dataset now.
+func ScanDiscoveryHandler(d *service.Discoverer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res, err := d.Scan(c.Request.Context(), c.Param("name"))
+		if err != nil {
+			scheduleError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// ApprovePipelineHandler approves a pipeline proposed by a discovery, so it runs.
+func ApprovePipelineHandler(d *service.Discoverer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		p, err := d.Approve(c.Request.Context(), name)
+		if err != nil {
+			scheduleError(c, err)
+			return
+		}
+		slog.InfoContext(c.Request.Context(), "Pipeline approved", "pipeline", name)
+		c.JSON(http.StatusOK, PipelineResponse{Name: name, Pipeline: p})
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bq-exporter/logging"
+	"bq-exporter/service"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Trailers of a download, sent after the streamed rows.
+const (
+	downloadRowsTrailer      = "X-Download-Rows"
+	downloadTruncatedTrailer = "X-Download-Truncated"
+	downloadErrorTrailer     = "X-Download-Error"
+)
+
+// DownloadRequest streams a query result into the response, as query string parameters
+// (GET) or a JSON body (POST).
+type DownloadRequest struct {
+	Query         string `form:"query" json:"query"`
+	QueryLocation string `form:"query_location" json:"query_location"`
+	SnapshotTime  string `form:"snapshot_time" json:"snapshot_time"`
+	// Format is csv (default) or ndjson
+	Format       string `form:"format" json:"format"`
+	CSVHeader    string `form:"csv_header" json:"csv_header"`
+	CSVDelimiter string `form:"csv_delimiter" json:"csv_delimiter"`
+	// Limit caps the rows below DOWNLOAD_MAX_ROWS
+	Limit int64 `form:"limit" json:"limit"`
+	// Name is the file name offered to the client, without extension (default export)
+	Name                      string `form:"name" json:"name"`
+	ImpersonateServiceAccount string `form:"impersonate_service_account" json:"impersonate_service_account"`
+	Priority                  string `form:"priority" json:"priority"`
+}
+
+// downloadResponse streams a download into the HTTP response.
+type downloadResponse struct {
+	c           *gin.Context
+	contentType string
+	filename    string
+	began       bool
+}
+
+func (d *downloadResponse) Write(p []byte) (int, error) { return d.c.Writer.Write(p) }
+func (d *downloadResponse) Flush()                      { d.c.Writer.Flush() }
+
+// Begin sends the headers; the body is chunked, with the outcome in trailers.
+func (d *downloadResponse) Begin() {
+	d.began = true
+	h := d.c.Writer.Header()
+	h.Set("Content-Type", d.contentType)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": d.filename}))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Trailer", downloadRowsTrailer+", "+downloadTruncatedTrailer+", "+downloadErrorTrailer)
+	d.c.Status(http.StatusOK)
+	d.c.Writer.WriteHeaderNow()
+}
+
+// DownloadHandler streams the result of a query as CSV or NDJSON, for ad-hoc extracts
+// too small to land in Cloud Storage. Errors before the first row answer like
+// /api/export; once streaming, the X-Download-Rows, X-Download-Truncated and
+// X-Download-Error trailers report the outcome.
+func DownloadHandler(exporter *service.Exporter, limits Limits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req DownloadRequest
+		var err error
+		if c.Request.Method == http.MethodGet {
+			err = c.ShouldBindQuery(&req)
+		} else {
+			err = c.ShouldBindJSON(&req)
+		}
+		if err != nil {
+			c.JSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if req.Query == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+			return
+		}
+		if err := limits.checkQuery(req.Query); err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		req.Format = cmp.Or(req.Format, service.DownloadCSV)
+		stream := &downloadResponse{c: c, contentType: "text/csv; charset=utf-8", filename: cmp.Or(req.Name, "export") + "." + req.Format}
+		if req.Format == service.DownloadNDJSON {
+			stream.contentType = "application/x-ndjson"
+		}
+
+		slog.InfoContext(c.Request.Context(), "Received download request", logging.RequestAttrs("format", req.Format, "query", req.Query, "limit", req.Limit)...)
+		res, err := exporter.Download(c.Request.Context(), service.ExportParams{
+			Name:                      req.Name,
+			Query:                     req.Query,
+			QueryLocation:             req.QueryLocation,
+			SnapshotTime:              req.SnapshotTime,
+			Format:                    req.Format,
+			CSVHeader:                 req.CSVHeader,
+			CSVDelimiter:              req.CSVDelimiter,
+			Limit:                     req.Limit,
+			ImpersonateServiceAccount: req.ImpersonateServiceAccount,
+			Priority:                  req.Priority,
+		}, stream)
+		if !stream.began {
+			status, ok := requestErrorStatus(err)
+			switch {
+			case ok:
+			case service.FailureClass(err) == service.FailureConfig:
+				status = http.StatusBadRequest
+			default:
+				status = http.StatusInternalServerError
+			}
+			slog.WarnContext(c.Request.Context(), "Download failed", "error", err)
+			c.JSON(status, gin.H{"error": fmt.Sprint(err), "request_id": logging.RequestID(c.Request.Context())})
+			return
+		}
+		h := c.Writer.Header()
+		h.Set(downloadRowsTrailer, strconv.FormatInt(res.Rows, 10))
+		h.Set(downloadTruncatedTrailer, strconv.FormatBool(res.Truncated))
+		if err != nil {
+			// The status is sent; the client only learns of the failure from the trailer
+			slog.ErrorContext(c.Request.Context(), "Download failed while streaming", "rows", res.Rows, "error", err)
+			h.Set(downloadErrorTrailer, err.Error())
+		}
+	}
+}
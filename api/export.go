@@ -1,69 +1,506 @@
 package api
 
 import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
 	"bq-exporter/service"
+	"errors"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
 type ExportRequest struct {
-	Query         string `json:"query" binding:"required"`
+	Name          string `json:"name"`
+	Query         string `json:"query"`
 	Output        string `json:"output"`
 	Filename      string `json:"filename"`
-	QueryLocation string `json:"query_location" binding:"required"`
-	UseTimestamp  bool   `json:"use_timestamp"`
-	Table         string `json:"table"`
-	Database      string `json:"database"`
-	CreateDDL     string `json:"create_ddl"`
+	QueryLocation string `json:"query_location"`
+	// SnapshotTime reads the query's tables as of an RFC 3339 timestamp, or "now" for
+	// the start of the run (FOR SYSTEM_TIME AS OF).
+	SnapshotTime string `json:"snapshot_time"`
+	UseTimestamp *bool  `json:"use_timestamp"`
+	Table        string `json:"table"`
+	Database     string `json:"database"`
+	CreateDDL    string `json:"create_ddl"`
+
+	// ImpersonateServiceAccount runs the BigQuery side of the export as this service
+	// account.
+	ImpersonateServiceAccount string `json:"impersonate_service_account"`
+	// LineageColumns appends _export_job_id, _exported_at and _source_query_hash to
+	// every exported row.
+	LineageColumns bool `json:"lineage_columns"`
+	// Labels (e.g. owner, pipeline, refreshed_at) and Description are attached to the
+	// destination after the load: BigQuery table labels and description, the StarRocks
+	// table comment or the metadata of the files. Values may contain {pipeline}, {name},
+	// {refreshed_at} and {run_id}.
+	Labels      map[string]string `json:"labels"`
+	Description string            `json:"description"`
+	// Transforms transform the rows in flight, in order: rename, cast, mask or a custom
+	// transformer compiled into the service (STARROCKS and GCS_PARQUET_WRITE).
+	Transforms []config.Transform `json:"transforms"`
+	// ComputedColumns are appended to every row, computed by CEL expressions over the
+	// columns left by the transforms.
+	ComputedColumns []config.ComputedColumn `json:"computed_columns"`
+
+	// Format is parquet (default), csv, fhir or redcap. CSV files start with a csv_header
+	// row (names, the default; typed, name:TYPE cells; or none), after a UTF-8 BOM with
+	// csv_bom, and separate fields with csv_delimiter (default ","; "tab" for tabs).
+	// SchemaFile writes the BigQuery JSON schema of the result next to the files. FHIR
+	// and REDCap files are shaped by the configured fhir_mapping and redcap_mapping.
+	Format        string `json:"format"`
+	CSVHeader     string `json:"csv_header"`
+	CSVDelimiter  string `json:"csv_delimiter"`
+	CSVBOM        bool   `json:"csv_bom"`
+	SchemaFile    bool   `json:"schema_file"`
+	FHIRMapping   string `json:"fhir_mapping"`
+	REDCapMapping string `json:"redcap_mapping"`
+	// ResolveSingleFile returns the name of the file in gcs_path, instead of the pattern,
+	// when the export wrote a single file.
+	ResolveSingleFile bool `json:"resolve_single_file"`
+
+	// RowGroupRows and MaxFileRows size the Parquet files of the GCS_PARQUET_WRITE
+	// driver: rows per row group (default 100000) and, if set, rows per file.
+	RowGroupRows int   `json:"row_group_rows"`
+	MaxFileRows  int64 `json:"max_file_rows"`
+	// ParquetTimestamp (micros, millis or int96), ParquetDecimal (decimal, decimal38 or
+	// string) and ParquetString (string or large_string) choose the Parquet types of
+	// GCS_PARQUET_WRITE files for consumers that cannot read the defaults.
+	ParquetTimestamp string `json:"parquet_timestamp"`
+	ParquetDecimal   string `json:"parquet_decimal"`
+	ParquetString    string `json:"parquet_string"`
+
+	// RedisType shapes the keys of the REDIS driver: hash (default), a hash per row, or
+	// set, a set of the values of the one non-key column per key. RedisTTL (e.g. "25h")
+	// expires the keys written.
+	RedisType string `json:"redis_type"`
+	RedisTTL  string `json:"redis_ttl"`
+
+	ReplicationNum int    `json:"replication_num"`
+	LoadStrategy   string `json:"load_strategy"`
+	// ColumnNames is the StarRocks column name policy: quote (default), sanitize or
+	// strict. ColumnCase spells destination names as is (preserve, the default), lower
+	// or upper. Renamed columns are reported in column_mapping.
+	ColumnNames string `json:"column_names"`
+	ColumnCase  string `json:"column_case"`
+	// StringType is the type of created string columns: varchar (default, VARCHAR(1024)),
+	// string (STRING) or auto (sized from the longest value).
+	StringType string `json:"string_type"`
+	// Verify counts the destination rows after the load (on the StarRocks read endpoint
+	// when configured) and fails the export if the count does not fit the load.
+	Verify bool `json:"verify"`
+	// AllowSchemaChanges false fails the export instead of changing the destination's
+	// schema: adding columns, creating the table or replacing it with another schema.
+	AllowSchemaChanges *bool `json:"allow_schema_changes"`
+
+	DeleteColumn string   `json:"delete_column"`
+	DeleteValues []string `json:"delete_values"`
+
+	WriteMode           string   `json:"write_mode"`
+	KeyColumns          []string `json:"key_columns"`
+	DestinationLocation string   `json:"destination_location"`
+
+	DiffSnapshot string `json:"diff_snapshot"`
+	ChangesTable string `json:"changes_table"`
+	ChangesMode  string `json:"changes_mode"`
+
+	// DedupColumns keeps one row per key of these columns before writing: the first or
+	// latest (dedup_keep, default latest) by dedup_order_by.
+	DedupColumns []string `json:"dedup_columns"`
+	DedupOrderBy string   `json:"dedup_order_by"`
+	DedupKeep    string   `json:"dedup_keep"`
+
+	// DeidProfile de-identifies the result with the named deid_profiles entry.
+	DeidProfile string `json:"deid_profile"`
+
+	// Assertions are checked against the destination after the load.
+	Assertions []config.Assertion `json:"assertions"`
+
+	// ChunkColumn splits the export into one export per day, week or month (chunk_by,
+	// default month) of the chunk_column dates from chunk_start to chunk_end (exclusive),
+	// run one after the other.
+	ChunkColumn string `json:"chunk_column"`
+	ChunkBy     string `json:"chunk_by"`
+	ChunkStart  string `json:"chunk_start"`
+	ChunkEnd    string `json:"chunk_end"`
+
+	// Pipeline runs a named pipeline instead of Query; the other fields override its
+	// destination and Parameters its query parameters.
+	Pipeline   string            `json:"pipeline"`
+	Parameters map[string]string `json:"parameters"`
+
+	// Priority is interactive, normal (default) or batch; it orders exports waiting for
+	// a slot when MAX_CONCURRENT_EXPORTS is reached.
+	Priority string `json:"priority"`
+
+	// Debug returns the executed statements (DDL, EXPORT DATA, batch shapes) in the
+	// response, also when the export fails.
+	Debug bool `json:"debug"`
+
+	// Limit and SamplePercent export part of the result, for test runs into staging
+	// destinations: a random sample_percent of the rows, then at most limit of them.
+	Limit         int64   `json:"limit"`
+	SamplePercent float64 `json:"sample_percent"`
+
+	// LogicalDate is the date (or RFC 3339 time) the run exports, defaulting to the
+	// X-CloudScheduler-ScheduleTime header. A retry of a run of the same logical date
+	// that succeeded within DUPLICATE_RUN_WINDOW returns its result instead of
+	// exporting again; one still running is rejected with 409.
+	LogicalDate string `json:"logical_date"`
+}
+
+// Params converts the request into driver parameters.
+func (r ExportRequest) Params() service.ExportParams {
+	return service.ExportParams{
+		Name:          r.Name,
+		Priority:      r.Priority,
+		Debug:         r.Debug,
+		LogicalDate:   r.LogicalDate,
+		Limit:         r.Limit,
+		SamplePercent: r.SamplePercent,
+		Query:         r.Query,
+		Output:        r.Output,
+		Filename:      r.Filename,
+		QueryLocation: r.QueryLocation,
+		SnapshotTime:  r.SnapshotTime,
+		UseTimestamp:  r.UseTimestamp,
+		Table:         r.Table,
+		Database:      r.Database,
+		CreateDDL:     r.CreateDDL,
+
+		ImpersonateServiceAccount: r.ImpersonateServiceAccount,
+		LineageColumns:            r.LineageColumns,
+		Labels:                    r.Labels,
+		Description:               r.Description,
+		Transforms:                r.Transforms,
+		ComputedColumns:           r.ComputedColumns,
+
+		Format:            r.Format,
+		CSVHeader:         r.CSVHeader,
+		CSVDelimiter:      r.CSVDelimiter,
+		CSVBOM:            r.CSVBOM,
+		SchemaFile:        r.SchemaFile,
+		FHIRMapping:       r.FHIRMapping,
+		REDCapMapping:     r.REDCapMapping,
+		ResolveSingleFile: r.ResolveSingleFile,
+		RowGroupRows:      r.RowGroupRows,
+		MaxFileRows:       r.MaxFileRows,
+		ParquetTimestamp:  r.ParquetTimestamp,
+		ParquetDecimal:    r.ParquetDecimal,
+		ParquetString:     r.ParquetString,
+		RedisType:         r.RedisType,
+		RedisTTL:          r.RedisTTL,
+
+		ReplicationNum: r.ReplicationNum,
+		LoadStrategy:   r.LoadStrategy,
+		ColumnNames:    r.ColumnNames,
+		ColumnCase:     r.ColumnCase,
+		StringType:     r.StringType,
+		Verify:         r.Verify,
+
+		AllowSchemaChanges: r.AllowSchemaChanges,
+
+		DeleteColumn: r.DeleteColumn,
+		DeleteValues: r.DeleteValues,
+
+		WriteMode:           r.WriteMode,
+		KeyColumns:          r.KeyColumns,
+		DestinationLocation: r.DestinationLocation,
+
+		DiffSnapshot: r.DiffSnapshot,
+		ChangesTable: r.ChangesTable,
+		ChangesMode:  r.ChangesMode,
+
+		DedupColumns: r.DedupColumns,
+		DedupOrderBy: r.DedupOrderBy,
+		DedupKeep:    r.DedupKeep,
+
+		DeidProfile: r.DeidProfile,
+		Assertions:  r.Assertions,
+
+		ChunkColumn: r.ChunkColumn,
+		ChunkBy:     r.ChunkBy,
+		ChunkStart:  r.ChunkStart,
+		ChunkEnd:    r.ChunkEnd,
+	}
 }
 
 type ExportResponse struct {
-	Message string `json:"message"`
-	GCSPath string `json:"gcs_path,omitempty"`
-	Table   string `json:"starrocks_table,omitempty"`
-	Rows    int64  `json:"rows_loaded,omitempty"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	GCSPath   string `json:"gcs_path,omitempty"`
+	Table     string `json:"starrocks_table,omitempty"`
+	DestTable string `json:"destination_table,omitempty"`
+	Rows      int64  `json:"rows_loaded,omitempty"`
+	// DuplicateOf is the job whose result answered this identical run of its logical date
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+
+	RowsDeleted    int64 `json:"rows_deleted,omitempty"`
+	BytesProcessed int64 `json:"bytes_processed,omitempty"`
+	// FilesWritten and BytesWritten count the exported files and their size, when known
+	FilesWritten int64 `json:"files_written,omitempty"`
+	BytesWritten int64 `json:"bytes_written,omitempty"`
+	// DestinationRows is the row count of the table after a verified load
+	DestinationRows int64 `json:"destination_rows,omitempty"`
+
+	BigQueryJob *BigQueryJob `json:"bigquery_job,omitempty"`
+
+	// ColumnMapping lists the result columns loaded under another name
+	ColumnMapping map[string]string `json:"column_mapping,omitempty"`
+
+	// Tables reports every table of a dataset sync pipeline
+	Tables []service.SnapshotTable `json:"tables,omitempty"`
+	// Chunks reports every date range of a chunked export
+	Chunks []service.ExportChunk `json:"chunks,omitempty"`
+
+	// Deidentification reports the de-identification profile applied to the result
+	Deidentification *service.DeidAudit `json:"deidentification,omitempty"`
+
+	// Assertions report the checks of the destination after the load
+	Assertions []service.AssertionResult `json:"assertions,omitempty"`
+	// QualityReport summarizes the assertions, with where the report was stored
+	QualityReport *service.QualityReport `json:"validation_report,omitempty"`
+
+	Statements []service.Statement `json:"statements,omitempty"`
+	// Warnings report the steps that failed after the export committed
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// BigQueryJob identifies the BigQuery job behind an export, with a link to it in the console.
+type BigQueryJob struct {
+	ID         string `json:"id"`
+	Location   string `json:"location"`
+	ConsoleURL string `json:"console_url"`
+}
+
+func bigQueryJob(job service.QueryJob) *BigQueryJob {
+	if job.ID == "" {
+		return nil
+	}
+	return &BigQueryJob{ID: job.ID, Location: job.Location, ConsoleURL: job.ConsoleURL()}
 }
 
-func ExportHandler(bqService *service.BigQueryService, driver service.ExportDriver) gin.HandlerFunc {
+func ExportHandler(exporter *service.Exporter, limits Limits) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req ExportRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			slog.WarnContext(c.Request.Context(), "Invalid request body", "error", err)
+			c.JSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		switch {
+		case req.Query == "" && req.Pipeline == "" && req.ChangesTable == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "either query, changes_table or pipeline is required"})
+			return
+		case req.Query != "" && req.Pipeline != "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "query and pipeline are mutually exclusive"})
+			return
+		}
+		if err := config.ValidateRequestAssertions(req.Assertions); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if err := limits.checkRequestQuery(c.Request.Context(), exporter, req); err != nil {
+			slog.WarnContext(c.Request.Context(), "Query too large", "error", err)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if req.LogicalDate == "" {
+			// Cloud Scheduler retries carry the schedule time of the attempt they retry
+			req.LogicalDate = c.GetHeader("X-CloudScheduler-ScheduleTime")
+		}
 
-		slog.InfoContext(c.Request.Context(), "Received export request",
+		slog.InfoContext(c.Request.Context(), "Received export request", logging.RequestAttrs(
+			"pipeline", req.Pipeline,
+			"name", req.Name,
 			"query", req.Query,
 			"output", req.Output,
 			"filename", req.Filename,
 			"location", req.QueryLocation,
 			"use_timestamp", req.UseTimestamp,
-		)
-
-		params := service.ExportParams{
-			Query:         req.Query,
-			Output:        req.Output,
-			Filename:      req.Filename,
-			QueryLocation: req.QueryLocation,
-			UseTimestamp:  req.UseTimestamp,
-			Table:         req.Table,
-			Database:      req.Database,
-			CreateDDL:     req.CreateDDL,
-		}
-		res, err := driver.Execute(c.Request.Context(), bqService, params)
+		)...)
+
+		// The caller waits for the response: BigQuery quota errors answer 429, not a wait
+		ctx := service.WithSynchronous(c.Request.Context())
+		var res service.ExportResult
+		var err error
+		if req.Pipeline != "" {
+			res, err = exporter.RunPipeline(ctx, req.Pipeline, req.Params(), req.Parameters)
+		} else {
+			res, err = exporter.Run(ctx, req.Params())
+		}
+		writeExportResult(c, exporter, res, err)
+	}
+}
+
+// PlanRequest is an export request with plan-only options.
+type PlanRequest struct {
+	ExportRequest
+	// CountRows counts the result rows to estimate batches; unlike the rest of the plan
+	// it runs (and bills) a query.
+	CountRows bool `json:"count_rows"`
+}
+
+// PlanHandler reports what an export request would do without running it.
+func PlanHandler(exporter *service.Exporter, limits Limits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req PlanRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		switch {
+		case req.Query == "" && req.Pipeline == "" && req.ChangesTable == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "either query, changes_table or pipeline is required"})
+			return
+		case req.Query != "" && req.Pipeline != "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "query and pipeline are mutually exclusive"})
+			return
+		}
+		if err := config.ValidateRequestAssertions(req.Assertions); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := limits.checkRequestQuery(c.Request.Context(), exporter, req.ExportRequest); err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+
+		var plan *service.ExportPlan
+		var err error
+		if req.Pipeline != "" {
+			plan, err = exporter.PlanPipeline(c.Request.Context(), req.Pipeline, req.Params(), req.Parameters, req.CountRows)
+		} else {
+			plan, err = exporter.Plan(c.Request.Context(), req.Params(), req.CountRows)
+		}
 		if err != nil {
-			slog.ErrorContext(c.Request.Context(), "Export failed", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process export: " + err.Error()})
+			status, ok := requestErrorStatus(err)
+			if !ok {
+				// The plan only fails on the request: its query or destination settings
+				status = http.StatusBadRequest
+			}
+			slog.WarnContext(c.Request.Context(), "Export plan failed", "error", err)
+			c.JSON(status, gin.H{"error": err.Error(), "request_id": logging.RequestID(c.Request.Context())})
 			return
 		}
-		c.JSON(http.StatusOK, ExportResponse{
-			Message: "OK",
-			GCSPath: res.GCSPath,
-			Table:   res.Table,
-			Rows:    res.Rows,
-		})
+		c.JSON(http.StatusOK, plan)
+	}
+}
+
+// writeExportResult renders the outcome of an export run.
+func writeExportResult(c *gin.Context, exporter *service.Exporter, res service.ExportResult, err error) {
+	if status, ok := requestErrorStatus(err); ok {
+		slog.WarnContext(c.Request.Context(), "Export rejected", "error", err)
+		setRetryAfter(c, err)
+		c.JSON(status, gin.H{"error": err.Error(), "request_id": logging.RequestID(c.Request.Context())})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Export failed", "error", err, "job_id", res.Job.ID)
+		body := gin.H{
+			"error":      "Failed to process export: " + err.Error(),
+			"request_id": logging.RequestID(c.Request.Context()),
+		}
+		var jobErr *service.JobError
+		if job := bigQueryJob(res.Job); job != nil {
+			body["bigquery_job"] = job
+		} else if errors.As(err, &jobErr) {
+			body["bigquery_job"] = bigQueryJob(jobErr.Job)
+		}
+		if len(res.Statements) > 0 {
+			body["statements"] = res.Statements
+		}
+		if len(res.Assertions) > 0 {
+			body["assertions"] = res.Assertions
+		}
+		if res.QualityReport != nil {
+			body["validation_report"] = res.QualityReport
+		}
+		status := http.StatusInternalServerError
+		if len(res.Tables) > 0 {
+			body["tables"] = res.Tables
+			// A sync that committed some tables partially succeeded; retry the others
+			for _, t := range res.Tables {
+				if t.Committed {
+					status = http.StatusMultiStatus
+				}
+			}
+		}
+		if len(res.Chunks) > 0 {
+			body["chunks"] = res.Chunks
+			// Chunks before the failed one are exported; resume from it
+			if res.Chunks[0].Status == service.JobSucceeded {
+				status = http.StatusMultiStatus
+			}
+		}
+		c.JSON(status, body)
+		return
+	}
+	resp := ExportResponse{
+		Message:   "OK",
+		RequestID: logging.RequestID(c.Request.Context()),
+		GCSPath:   res.GCSPath,
+		Rows:      res.Rows,
+
+		DuplicateOf: res.DuplicateOf,
+
+		RowsDeleted:    res.RowsDeleted,
+		BytesProcessed: res.BytesProcessed,
+		FilesWritten:   res.Files,
+		BytesWritten:   res.BytesWritten,
+		BigQueryJob:    bigQueryJob(res.Job),
+		ColumnMapping:  res.ColumnMapping,
+		Tables:         res.Tables,
+		Chunks:         res.Chunks,
+		Statements:     res.Statements,
+		Warnings:       res.Warnings,
+
+		Deidentification: res.Deidentification,
+		Assertions:       res.Assertions,
+		QualityReport:    res.QualityReport,
+
+		DestinationRows: res.DestinationRows,
+	}
+	if exporter.Driver.Name() == "STARROCKS" {
+		resp.Table = res.Table
+	} else {
+		resp.DestTable = res.Table
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// setRetryAfter tells the caller of an export rejected on exhausted BigQuery quotas when
+// to send it again.
+func setRetryAfter(c *gin.Context, err error) {
+	var ra *service.RetryAfterError
+	if errors.As(err, &ra) {
+		c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(ra.RetryAfter.Seconds())), 1)))
+	}
+}
+
+// requestErrorStatus maps errors caused by the request rather than the export itself to
+// their HTTP status.
+func requestErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, service.ErrPipelineNotFound):
+		return http.StatusNotFound, true
+	case errors.Is(err, service.ErrPipelineParameters), errors.Is(err, service.ErrBucketUnusable):
+		return http.StatusBadRequest, true
+	case errors.Is(err, service.ErrForbidden):
+		return http.StatusForbidden, true
+	case errors.Is(err, service.ErrQuotaExceeded):
+		return http.StatusTooManyRequests, true
+	case errors.Is(err, service.ErrJobNotFound), errors.Is(err, service.ErrScheduleNotFound), errors.Is(err, service.ErrDiscoveryNotFound),
+		errors.Is(err, service.ErrQualityReportNotFound):
+		return http.StatusNotFound, true
+	case errors.Is(err, service.ErrJobNotRetryable), errors.Is(err, service.ErrScheduleRunning), errors.Is(err, service.ErrDuplicateRun),
+		errors.Is(err, service.ErrDestinationLocked), errors.Is(err, service.ErrPipelinePending), errors.Is(err, service.ErrJobRowsUnavailable):
+		return http.StatusConflict, true
+	case errors.Is(err, service.ErrDestinationUnavailable):
+		return http.StatusServiceUnavailable, true
 	}
+	return 0, false
 }
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/service"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jobDriver exports through a BigQuery job, failing with err if set.
+type jobDriver struct {
+	job service.QueryJob
+	err error
+}
+
+func (d jobDriver) Name() string { return "GCS_PARQUET" }
+func (d jobDriver) Capabilities() service.DriverCapabilities {
+	return service.DriverCapabilities{Files: true, Folders: true}
+}
+func (d jobDriver) Execute(ctx context.Context, bq service.BigQueryClient, params service.ExportParams) (service.ExportResult, error) {
+	if d.err != nil {
+		return service.ExportResult{}, &service.JobError{Job: d.job, Err: d.err}
+	}
+	return service.ExportResult{GCSPath: params.Output + "export-*.parquet", Job: d.job}, nil
+}
+
+func TestExportResponseBigQueryJob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	job := service.QueryJob{ProjectID: "p", ID: "job_1", Location: "US"}
+	tests := []struct {
+		name   string
+		driver jobDriver
+		want   int
+	}{
+		{"succeeded", jobDriver{job: job}, http.StatusOK},
+		{"failed", jobDriver{job: job, err: errors.New("division by zero")}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := service.NewExporter(noBigQuery{}, tt.driver, &config.Config{})
+			r := gin.New()
+			r.POST("/api/export", ExportHandler(exporter, Limits{}))
+			req := httptest.NewRequest(http.MethodPost, "/api/export", strings.NewReader(`{"query":"SELECT 1","output":"gs://b/out/","query_location":"US"}`))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			var body struct {
+				BigQueryJob *BigQueryJob `json:"bigquery_job"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			want := BigQueryJob{ID: "job_1", Location: "US", ConsoleURL: job.ConsoleURL()}
+			if body.BigQueryJob == nil || *body.BigQueryJob != want {
+				t.Errorf("bigquery_job = %+v, want %+v", body.BigQueryJob, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FreshnessHandler returns the freshness SLO state of the pipelines visible to the caller.
+func FreshnessHandler(m *service.FreshnessMonitor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"pipelines": m.List(c.Request.Context())})
+	}
+}
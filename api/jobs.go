@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"cmp"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListJobsHandler returns the job history visible to the caller, newest first.
+func ListJobsHandler(jobs *service.JobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out := jobs.List(c.Request.Context())
+		if out == nil {
+			out = []service.JobRecord{}
+		}
+		c.JSON(http.StatusOK, gin.H{"jobs": out})
+	}
+}
+
+// GetJobHandler returns one job by its request ID.
+func GetJobHandler(jobs *service.JobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, ok := jobs.Get(c.Request.Context(), c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job not found: " + c.Param("id")})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// DiffJobHandler compares the resolved parameters of a job with those of the job named
+// by ?against=, or of the previous run of the same pipeline, name or destination.
+func DiffJobHandler(jobs *service.JobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		diff, err := jobs.Diff(c.Request.Context(), c.Param("id"), c.Query("against"))
+		if errors.Is(err, service.ErrJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, diff)
+	}
+}
+
+// RetryJobHandler re-runs a failed job with its original parameters; the response is
+// that of an export request.
+func RetryJobHandler(exporter *service.Exporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		slog.InfoContext(c.Request.Context(), "Received retry request", "retry_of", c.Param("id"))
+		res, err := exporter.Retry(service.WithSynchronous(c.Request.Context()), c.Param("id"))
+		writeExportResult(c, exporter, res, err)
+	}
+}
+
+// JobRowsHandler pages through the rows a succeeded job exported: ?page_token= is the
+// next_page_token of the previous page and ?page_size= the rows per page.
+func JobRowsHandler(exporter *service.Exporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		size := 0
+		if s := c.Query("page_size"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page_size: " + s})
+				return
+			}
+			size = n
+		}
+		page, err := exporter.JobRows(c.Request.Context(), c.Param("id"), c.Query("page_token"), size)
+		if err != nil {
+			status, ok := requestErrorStatus(err)
+			switch {
+			case ok:
+			case service.FailureClass(err) == service.FailureConfig:
+				status = http.StatusBadRequest
+			default:
+				status = http.StatusInternalServerError
+			}
+			slog.WarnContext(c.Request.Context(), "Failed to page job rows", "job_id", c.Param("id"), "error", err)
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, page)
+	}
+}
+
+// QualityReportHandler returns the validation report of a job's assertions, as JSON or
+// with ?format=html as a page.
+func QualityReportHandler(jobs *service.JobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report, err := jobs.QualityReport(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			status, _ := requestErrorStatus(err)
+			c.JSON(cmp.Or(status, http.StatusInternalServerError), gin.H{"error": err.Error()})
+			return
+		}
+		if c.Query("format") != "html" {
+			c.JSON(http.StatusOK, report)
+			return
+		}
+		page, err := service.RenderQualityReport(report)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	}
+}
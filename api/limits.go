@@ -0,0 +1,97 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMaxBodyBytes   = 2 << 20 // 2 MiB
+	defaultMaxQueryLength = 1 << 20 // BigQuery's own limit for a query text is 1 MB
+)
+
+// Limits guards the API against oversized input, e.g. a generator accidentally
+// inlining a million-element IN list into the query.
+type Limits struct {
+	MaxBodyBytes   int64
+	MaxQueryLength int
+}
+
+// LimitsFromEnv reads MAX_REQUEST_BODY_BYTES and MAX_QUERY_LENGTH, falling back to defaults.
+func LimitsFromEnv() Limits {
+	l := Limits{MaxBodyBytes: defaultMaxBodyBytes, MaxQueryLength: defaultMaxQueryLength}
+	if v := os.Getenv("MAX_REQUEST_BODY_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			l.MaxBodyBytes = n
+		} else {
+			slog.Warn("Ignoring invalid MAX_REQUEST_BODY_BYTES", "value", v)
+		}
+	}
+	if v := os.Getenv("MAX_QUERY_LENGTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			l.MaxQueryLength = n
+		} else {
+			slog.Warn("Ignoring invalid MAX_QUERY_LENGTH", "value", v)
+		}
+	}
+	return l
+}
+
+// BodyLimit caps request bodies at MaxBodyBytes. Reads past the limit fail with
+// *http.MaxBytesError, which handlers turn into a 413.
+func BodyLimit(l Limits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > l.MaxBodyBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("request body exceeds %d bytes", l.MaxBodyBytes),
+			})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, l.MaxBodyBytes)
+		c.Next()
+	}
+}
+
+// checkQuery rejects queries longer than MaxQueryLength.
+func (l Limits) checkQuery(query string) error {
+	if l.MaxQueryLength > 0 && len(query) > l.MaxQueryLength {
+		return fmt.Errorf("query is %d bytes, exceeds limit of %d bytes", len(query), l.MaxQueryLength)
+	}
+	return nil
+}
+
+// checkRequestQuery checks the query an export request runs: its query or, for a
+// pipeline, the pipeline's query rendered with the request's parameters, so parameters
+// cannot grow a query past the limit. Unknown pipelines and missing parameters are left
+// to the run to report.
+func (l Limits) checkRequestQuery(ctx context.Context, exporter *service.Exporter, req ExportRequest) error {
+	if req.Pipeline == "" {
+		return l.checkQuery(req.Query)
+	}
+	p, ok := exporter.Pipelines.Get(req.Pipeline)
+	if !ok || !service.PipelineVisible(ctx, p) {
+		return nil
+	}
+	query, err := p.RenderQuery(req.Parameters)
+	if err != nil {
+		return nil
+	}
+	return l.checkQuery(query)
+}
+
+// bindStatus maps a request binding error to its HTTP status.
+func bindStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
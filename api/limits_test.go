@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/service"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLimitsFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		body, query string
+		want        Limits
+	}{
+		{"defaults", "", "", Limits{MaxBodyBytes: defaultMaxBodyBytes, MaxQueryLength: defaultMaxQueryLength}},
+		{"set", "4096", "1024", Limits{MaxBodyBytes: 4096, MaxQueryLength: 1024}},
+		{"invalid ignored", "lots", "-1", Limits{MaxBodyBytes: defaultMaxBodyBytes, MaxQueryLength: defaultMaxQueryLength}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAX_REQUEST_BODY_BYTES", tt.body)
+			t.Setenv("MAX_QUERY_LENGTH", tt.query)
+			if got := LimitsFromEnv(); got != tt.want {
+				t.Errorf("LimitsFromEnv() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{Pipelines: map[string]config.Pipeline{
+		"visits": {Query: "SELECT * FROM ds.visits WHERE site = '{{site}}'", QueryLocation: "US"},
+	}}
+	exporter := service.NewExporter(noBigQuery{}, failingDriver{errors.New("boom")}, cfg)
+	limits := Limits{MaxBodyBytes: 256, MaxQueryLength: 64}
+	r := gin.New()
+	r.POST("/api/export", BodyLimit(limits), ExportHandler(exporter, limits))
+
+	long := "SELECT * FROM ds.visits WHERE id IN (" + strings.Repeat("1,", 20) + "1)"
+	tests := []struct {
+		name string
+		body string
+		// chunked sends the body without a Content-Length, so only the read is capped
+		chunked      bool
+		wantTooLarge bool
+	}{
+		{"within limits", `{"query":"SELECT 1","output":"gs://b/out/","query_location":"US"}`, false, false},
+		{"body too large", `{"query":"SELECT '` + strings.Repeat("x", 300) + `'"}`, false, true},
+		{"chunked body too large", `{"query":"SELECT '` + strings.Repeat("x", 300) + `'"}`, true, true},
+		{"query too long", `{"query":"` + long + `","output":"gs://b/out/"}`, false, true},
+		{"rendered pipeline query too long", `{"pipeline":"visits","parameters":{"site":"` + strings.Repeat("a", 40) + `"}}`, false, true},
+		{"rendered pipeline query within limit", `{"pipeline":"visits","parameters":{"site":"a"}}`, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(tt.body)
+			if tt.chunked {
+				body = io.MultiReader(body)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/export", body)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if tooLarge := w.Code == http.StatusRequestEntityTooLarge; tooLarge != tt.wantTooLarge {
+				t.Errorf("status = %d, want 413 = %v: %s", w.Code, tt.wantTooLarge, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricsHandler serves the metrics of the instance in the Prometheus text format. They
+// span every tenant, so tenant callers are refused.
+func MetricsHandler(m *service.Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, _, ok := service.TenantFrom(c.Request.Context()); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "metrics are not available to tenants"})
+			return
+		}
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		m.WriteTo(c.Writer)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PipelineResponse is one pipeline as returned by the pipeline endpoints.
+type PipelineResponse struct {
+	Name string `json:"name"`
+	config.Pipeline
+}
+
+// ListPipelinesHandler returns all pipelines.
+func ListPipelinesHandler(store *service.PipelineStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out := []PipelineResponse{}
+		for _, name := range store.Names() {
+			if p, ok := store.Get(name); ok && service.PipelineVisible(c.Request.Context(), p) {
+				out = append(out, PipelineResponse{Name: name, Pipeline: p})
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"pipelines": out})
+	}
+}
+
+// GetPipelineHandler returns one pipeline.
+func GetPipelineHandler(store *service.PipelineStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		p, ok := store.Get(name)
+		if !ok || !service.PipelineVisible(c.Request.Context(), p) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "pipeline not found: " + name})
+			return
+		}
+		c.JSON(http.StatusOK, PipelineResponse{Name: name, Pipeline: p})
+	}
+}
+
+// PutPipelineHandler creates or replaces a pipeline.
+func PutPipelineHandler(store *service.PipelineStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		var p config.Pipeline
+		if err := c.ShouldBindJSON(&p); err != nil {
+			c.JSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		// Tenants own the pipelines they create and cannot replace another tenant's
+		if tenant, _, ok := service.TenantFrom(c.Request.Context()); ok {
+			if existing, found := store.Get(name); found && existing.Tenant != tenant {
+				c.JSON(http.StatusConflict, gin.H{"error": "pipeline name already in use: " + name})
+				return
+			}
+			p.Tenant = tenant
+		}
+		if err := store.Put(name, p); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, PipelineResponse{Name: name, Pipeline: p})
+	}
+}
+
+// DeletePipelineHandler removes a pipeline.
+func DeletePipelineHandler(store *service.PipelineStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		if p, ok := store.Get(name); !ok || !service.PipelineVisible(c.Request.Context(), p) || !store.Delete(name) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "pipeline not found: " + name})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"bq-exporter/service"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/idtoken"
+)
+
+// PubSubPushPath receives Pub/Sub push messages. It is exempt from X-API-Key checks:
+// Pub/Sub authenticates with an OIDC token instead.
+const PubSubPushPath = "/api/pubsub/push"
+
+// PubSubPush verifies Pub/Sub push requests: an OIDC token for Audience, signed by
+// Google for one of the allowed service accounts. Each account runs its exports as the
+// admin, or confined to the tenant it maps to.
+type PubSubPush struct {
+	Audience string
+	// Accounts maps the allowed push service accounts to their tenant ("" for the admin)
+	Accounts map[string]string
+	Tenants  map[string]config.Tenant
+
+	// validate checks an ID token (idtoken.Validate)
+	validate func(ctx context.Context, token, audience string) (*idtoken.Payload, error)
+}
+
+// PubSubPushFromEnv reads PUBSUB_PUSH_AUDIENCE and PUBSUB_PUSH_SERVICE_ACCOUNTS (comma
+// separated emails, each optionally =tenant). It returns nil when push is not enabled.
+func PubSubPushFromEnv(tenants map[string]config.Tenant) (*PubSubPush, error) {
+	audience := os.Getenv("PUBSUB_PUSH_AUDIENCE")
+	accounts := os.Getenv("PUBSUB_PUSH_SERVICE_ACCOUNTS")
+	if audience == "" && accounts == "" {
+		return nil, nil
+	}
+	if audience == "" || accounts == "" {
+		return nil, errors.New("PUBSUB_PUSH_AUDIENCE and PUBSUB_PUSH_SERVICE_ACCOUNTS must be set together")
+	}
+	p := &PubSubPush{Audience: audience, Accounts: map[string]string{}, Tenants: tenants, validate: idtoken.Validate}
+	for _, entry := range strings.Split(accounts, ",") {
+		email, tenant, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if email == "" {
+			continue
+		}
+		if _, ok := tenants[tenant]; tenant != "" && !ok {
+			return nil, fmt.Errorf("PUBSUB_PUSH_SERVICE_ACCOUNTS: unknown tenant %q for %s", tenant, email)
+		}
+		p.Accounts[strings.ToLower(email)] = tenant
+	}
+	return p, nil
+}
+
+// pubSubPushRequest is the body of a Pub/Sub push request.
+type pubSubPushRequest struct {
+	Message struct {
+		// Data is the export request as JSON (base64 in the body)
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// authenticate checks the push request's token and returns the context to run its
+// export in.
+func (p *PubSubPush) authenticate(c *gin.Context) (context.Context, error) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	payload, err := p.validate(c.Request.Context(), token, p.Audience)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	tenant, allowed := p.Accounts[strings.ToLower(email)]
+	if !verified || !allowed {
+		return nil, fmt.Errorf("service account %q may not push exports", email)
+	}
+	// Pub/Sub redelivers the message on 429 rather than holding the push open
+	ctx := service.WithSynchronous(c.Request.Context())
+	if tenant != "" {
+		ctx = service.WithTenant(ctx, tenant, p.Tenants[tenant])
+	}
+	return ctx, nil
+}
+
+// PubSubPushHandler runs the export request carried by a Pub/Sub push message: its data
+// is an /api/export request body, or, for a Cloud Storage notification, the object whose
+// triggered pipelines it runs. A 2xx response acknowledges the message, so messages
+// that can never succeed (malformed, rejected or failing on their configuration or
+// data) are acknowledged and logged, while other failures are retried by Pub/Sub.
+// Without a logical_date, the publish time is the logical date, so redeliveries of a
+// message that was exported return the earlier result.
+func PubSubPushHandler(exporter *service.Exporter, triggers *service.ObjectTriggers, push *PubSubPush, limits Limits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, err := push.authenticate(c)
+		if err != nil {
+			slog.WarnContext(c.Request.Context(), "Rejected Pub/Sub push", "error", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var msg pubSubPushRequest
+		if err := c.ShouldBindJSON(&msg); err != nil {
+			pubSubDrop(c, msg, http.StatusBadRequest, fmt.Errorf("invalid push request: %w", err))
+			return
+		}
+		if attrs := msg.Message.Attributes; attrs["eventType"] != "" {
+			// A Cloud Storage notification; only new objects trigger pipelines
+			if attrs["eventType"] != "OBJECT_FINALIZE" {
+				c.JSON(http.StatusOK, gin.H{"message": "ignored " + attrs["eventType"], "runs": []service.TriggerRun{}})
+				return
+			}
+			ev := service.ObjectEvent{Bucket: attrs["bucketId"], Name: attrs["objectId"], Generation: attrs["objectGeneration"]}
+			ev.Time, _ = time.Parse(time.RFC3339, attrs["eventTime"])
+			runTriggers(c, ctx, triggers, ev)
+			return
+		}
+		var req ExportRequest
+		if err := json.Unmarshal(msg.Message.Data, &req); err != nil {
+			pubSubDrop(c, msg, http.StatusOK, fmt.Errorf("message data is not an export request: %w", err))
+			return
+		}
+		switch {
+		case req.Query == "" && req.Pipeline == "" && req.ChangesTable == "":
+			err = errors.New("either query, changes_table or pipeline is required")
+		case req.Query != "" && req.Pipeline != "":
+			err = errors.New("query and pipeline are mutually exclusive")
+		default:
+			if err = config.ValidateRequestAssertions(req.Assertions); err == nil {
+				err = limits.checkRequestQuery(ctx, exporter, req)
+			}
+		}
+		if err != nil {
+			pubSubDrop(c, msg, http.StatusOK, err)
+			return
+		}
+		if req.LogicalDate == "" {
+			req.LogicalDate = msg.Message.PublishTime
+		}
+
+		slog.InfoContext(ctx, "Received Pub/Sub export request",
+			"subscription", msg.Subscription,
+			"message_id", msg.Message.MessageID,
+			"pipeline", req.Pipeline,
+			"name", req.Name,
+		)
+		var res service.ExportResult
+		if req.Pipeline != "" {
+			res, err = exporter.RunPipeline(ctx, req.Pipeline, req.Params(), req.Parameters)
+		} else {
+			res, err = exporter.Run(ctx, req.Params())
+		}
+		if err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"message":      "OK",
+				"request_id":   logging.RequestID(c.Request.Context()),
+				"rows_loaded":  res.Rows,
+				"duplicate_of": res.DuplicateOf,
+			})
+			return
+		}
+		status, retry := redeliveryStatus(err)
+		if !retry {
+			pubSubDrop(c, msg, http.StatusOK, err)
+			return
+		}
+		slog.ErrorContext(ctx, "Pub/Sub export failed; the message will be redelivered", "message_id", msg.Message.MessageID, "error", err)
+		c.JSON(status, gin.H{"error": err.Error(), "request_id": logging.RequestID(c.Request.Context())})
+	}
+}
+
+// redeliveryStatus returns the status answering a failed pushed export, and whether it
+// asks for the message to be redelivered: unless the export can never succeed.
+func redeliveryStatus(err error) (int, bool) {
+	status, rejected := requestErrorStatus(err)
+	if rejected {
+		// In-progress duplicates, locked tables, exhausted quotas and destinations out of
+		// service may succeed later
+		return status, status == http.StatusConflict || status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+	}
+	class := service.FailureClass(err)
+	return http.StatusInternalServerError, class != service.FailureConfig && class != service.FailureData
+}
+
+// pubSubDrop acknowledges a message that can never be exported (unless status is not
+// 2xx), logging why.
+func pubSubDrop(c *gin.Context, msg pubSubPushRequest, status int, err error) {
+	slog.ErrorContext(c.Request.Context(), "Dropping Pub/Sub message", "subscription", msg.Subscription, "message_id", msg.Message.MessageID, "error", err)
+	c.JSON(status, gin.H{"error": err.Error(), "acknowledged": status < 300, "request_id": logging.RequestID(c.Request.Context())})
+}
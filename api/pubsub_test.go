@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/service"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/idtoken"
+)
+
+// fakeIDTokens validates tokens of the form "audience|email|verified".
+func fakeIDTokens(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
+	parts := strings.Split(token, "|")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	if parts[0] != audience {
+		return nil, fmt.Errorf("audience provided does not match aud claim in the JWT")
+	}
+	return &idtoken.Payload{Audience: parts[0], Claims: map[string]any{"email": parts[1], "email_verified": parts[2] == "true"}}, nil
+}
+
+// failingDriver fails every export with err.
+type failingDriver struct{ err error }
+
+func (d failingDriver) Name() string { return "GCS_PARQUET" }
+func (d failingDriver) Capabilities() service.DriverCapabilities {
+	return service.DriverCapabilities{Files: true, Folders: true}
+}
+func (d failingDriver) Execute(ctx context.Context, bq service.BigQueryClient, params service.ExportParams) (service.ExportResult, error) {
+	return service.ExportResult{}, d.err
+}
+
+// noBigQuery answers dry runs; the failing driver never gets to run a query.
+type noBigQuery struct{}
+
+func (noBigQuery) RunQuery(ctx context.Context, sqlQuery, location string) (service.QueryJob, error) {
+	return service.QueryJob{}, errors.New("unexpected query")
+}
+func (noBigQuery) ReadRows(ctx context.Context, sqlQuery, location string) (service.RowIterator, error) {
+	return nil, errors.New("unexpected query")
+}
+func (noBigQuery) DryRun(ctx context.Context, sqlQuery, location string) (service.DryRunResult, error) {
+	return service.DryRunResult{}, nil
+}
+
+func pushRequest(t *testing.T, token string, data any) *http.Request {
+	t.Helper()
+	raw, _ := json.Marshal(data)
+	var msg pubSubPushRequest
+	msg.Message.Data, msg.Message.MessageID, msg.Subscription = raw, "m-1", "projects/p/subscriptions/exports"
+	body, _ := json.Marshal(msg)
+	req := httptest.NewRequest(http.MethodPost, PubSubPushPath, strings.NewReader(string(body)))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestPubSubPushAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	push := &PubSubPush{
+		Audience: "https://exporter.example/api/pubsub/push",
+		Accounts: map[string]string{"push@p.iam.gserviceaccount.com": ""},
+		validate: fakeIDTokens,
+	}
+	r := gin.New()
+	r.POST(PubSubPushPath, PubSubPushHandler(nil, nil, push, Limits{}))
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"bad token", "not-a-jwt", http.StatusUnauthorized},
+		{"wrong audience", "https://other.example|push@p.iam.gserviceaccount.com|true", http.StatusUnauthorized},
+		{"unverified email", push.Audience + "|push@p.iam.gserviceaccount.com|false", http.StatusUnauthorized},
+		{"unknown account", push.Audience + "|other@p.iam.gserviceaccount.com|true", http.StatusUnauthorized},
+		// Authenticated: the message is then acknowledged as not an export request
+		{"allowed account", push.Audience + "|Push@p.iam.gserviceaccount.com|true", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, pushRequest(t, tt.token, "not an object"))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestPubSubPushRedelivery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	push := &PubSubPush{
+		Audience: "aud",
+		Accounts: map[string]string{"push@p.iam.gserviceaccount.com": ""},
+		validate: fakeIDTokens,
+	}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"transient", &googleapi.Error{Code: http.StatusServiceUnavailable}, http.StatusInternalServerError},
+		{"config", service.ConfigError(errors.New("no such table")), http.StatusOK},
+		{"data", service.DataError(errors.New("bad value")), http.StatusOK},
+		{"quota", fmt.Errorf("tenant over quota: %w", service.ErrQuotaExceeded), http.StatusTooManyRequests},
+		{"forbidden", service.ErrForbidden, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := service.NewExporter(noBigQuery{}, failingDriver{tt.err}, &config.Config{})
+			r := gin.New()
+			r.POST(PubSubPushPath, PubSubPushHandler(exporter, nil, push, Limits{}))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, pushRequest(t, "aud|push@p.iam.gserviceaccount.com|true", ExportRequest{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/"}))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestRedeliveryStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantRetry  bool
+	}{
+		{"duplicate in progress", service.ErrDuplicateRun, http.StatusConflict, true},
+		{"destination locked", service.ErrDestinationLocked, http.StatusConflict, true},
+		{"quota", service.ErrQuotaExceeded, http.StatusTooManyRequests, true},
+		{"destination unavailable", service.ErrDestinationUnavailable, http.StatusServiceUnavailable, true},
+		{"unknown pipeline", service.ErrPipelineNotFound, http.StatusNotFound, false},
+		{"forbidden", service.ErrForbidden, http.StatusForbidden, false},
+		{"pending approval", service.ErrPipelinePending, http.StatusConflict, true},
+		{"config", service.ConfigError(errors.New("invalid query")), http.StatusInternalServerError, false},
+		{"data", service.DataError(errors.New("bad cast")), http.StatusInternalServerError, false},
+		{"timeout", context.DeadlineExceeded, http.StatusInternalServerError, true},
+		{"unclassified", errors.New("boom"), http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, retry := redeliveryStatus(tt.err)
+			if status != tt.wantStatus || retry != tt.wantRetry {
+				t.Errorf("redeliveryStatus() = %d, %v, want %d, %v", status, retry, tt.wantStatus, tt.wantRetry)
+			}
+		})
+	}
+}
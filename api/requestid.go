@@ -0,0 +1,28 @@
+package api
+
+import (
+	"bq-exporter/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// RequestID assigns every request a correlation ID (reusing a well-formed incoming
+// X-Request-ID), stores it in the request context for logging, along with the request's
+// trace, and echoes it back in the response header.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		ctx := logging.WithRequestID(c.Request.Context(), id)
+		if t, ok := logging.ParseTrace(c.GetHeader("traceparent"), c.GetHeader("X-Cloud-Trace-Context")); ok {
+			ctx = logging.WithTrace(ctx, t)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
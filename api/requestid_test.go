@@ -0,0 +1,45 @@
+package api
+
+import (
+	"bq-exporter/logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var got string
+	r := gin.New()
+	r.Use(RequestID())
+	r.GET("/", func(c *gin.Context) { got = logging.RequestID(c.Request.Context()) })
+
+	tests := []struct {
+		name     string
+		incoming string
+		// reused reports whether the incoming ID is kept
+		reused bool
+	}{
+		{"none", "", false},
+		{"well-formed", "scheduler-visits_42", true},
+		{"malformed", "a b\r\nX-Injected: 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if !logging.ValidRequestID(got) || (got == tt.incoming) != tt.reused {
+				t.Errorf("request ID = %q for incoming %q, want reused = %v", got, tt.incoming, tt.reused)
+			}
+			if echoed := w.Header().Get(requestIDHeader); echoed != got {
+				t.Errorf("%s header = %q, want %q", requestIDHeader, echoed, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"bq-exporter/logging"
+	"bq-exporter/service"
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListSchedulesHandler returns the state of the pipeline schedules visible to the caller.
+func ListSchedulesHandler(sched *service.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"schedules": sched.List(c.Request.Context())})
+	}
+}
+
+// PauseScheduleHandler pauses a pipeline schedule.
+func PauseScheduleHandler(sched *service.Scheduler) gin.HandlerFunc {
+	return scheduleUpdateHandler("Schedule paused", sched.Pause)
+}
+
+// ResumeScheduleHandler resumes a paused pipeline schedule.
+func ResumeScheduleHandler(sched *service.Scheduler) gin.HandlerFunc {
+	return scheduleUpdateHandler("Schedule resumed", sched.Resume)
+}
+
+func scheduleUpdateHandler(msg string, update func(context.Context, string) (service.ScheduleState, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		st, err := update(c.Request.Context(), c.Param("name"))
+		if err != nil {
+			scheduleError(c, err)
+			return
+		}
+		slog.InfoContext(c.Request.Context(), msg, "pipeline", st.Pipeline)
+		c.JSON(http.StatusOK, st)
+	}
+}
+
+// TriggerScheduleHandler starts a run of a pipeline schedule now. The run continues in
+// the background; its outcome appears in the job history under the returned job ID.
+func TriggerScheduleHandler(sched *service.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jobID, err := sched.Trigger(c.Request.Context(), c.Param("name"))
+		if err != nil {
+			scheduleError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":    "Run started",
+			"request_id": logging.RequestID(c.Request.Context()),
+			"job_id":     jobID,
+		})
+	}
+}
+
+func scheduleError(c *gin.Context, err error) {
+	status, ok := requestErrorStatus(err)
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
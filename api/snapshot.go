@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bq-exporter/logging"
+	"bq-exporter/service"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SnapshotRequest exports the tables of a BigQuery dataset; the export request fields
+// are the destination settings every table shares.
+type SnapshotRequest struct {
+	ExportRequest
+	Dataset string   `json:"dataset"`
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	// Parallelism is how many tables export at a time (default 1)
+	Parallelism int `json:"parallelism"`
+}
+
+// SnapshotResponse reports every table of a snapshot.
+type SnapshotResponse struct {
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	service.SnapshotResult
+}
+
+// SnapshotHandler runs a dataset snapshot. It answers 200 when every table was
+// exported and 207 when some failed; the tables report their own status.
+func SnapshotHandler(exporter *service.Exporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req SnapshotRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		switch {
+		case req.Dataset == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "dataset is required"})
+			return
+		case req.Pipeline != "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "dataset and pipeline are mutually exclusive"})
+			return
+		}
+
+		slog.InfoContext(c.Request.Context(), "Received snapshot request",
+			"dataset", req.Dataset, "include", req.Include, "exclude", req.Exclude, "output", req.Output, "database", req.Database)
+		res, err := exporter.Snapshot(service.WithSynchronous(c.Request.Context()), service.SnapshotOptions{
+			Dataset:     req.Dataset,
+			Include:     req.Include,
+			Exclude:     req.Exclude,
+			Parallelism: req.Parallelism,
+		}, req.Params())
+		if err != nil {
+			status, ok := requestErrorStatus(err)
+			switch {
+			case ok:
+			case service.FailureClass(err) == service.FailureConfig:
+				status = http.StatusBadRequest
+			default:
+				status = http.StatusInternalServerError
+			}
+			slog.WarnContext(c.Request.Context(), "Snapshot failed", "dataset", req.Dataset, "error", err)
+			setRetryAfter(c, err)
+			c.JSON(status, gin.H{"error": err.Error(), "request_id": logging.RequestID(c.Request.Context())})
+			return
+		}
+		resp := SnapshotResponse{Message: "OK", RequestID: logging.RequestID(c.Request.Context()), SnapshotResult: res}
+		status := http.StatusOK
+		if res.Failed > 0 {
+			resp.Message = fmt.Sprintf("%d of %d tables failed", res.Failed, len(res.Tables))
+			status = http.StatusMultiStatus
+		}
+		c.JSON(status, resp)
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"bq-exporter/logging"
+	"bq-exporter/service"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ObjectEventsPath receives Cloud Storage object finalize events from Eventarc. Like
+// PubSubPushPath it is authenticated by an OIDC token instead of X-API-Key.
+const ObjectEventsPath = "/api/events/gcs"
+
+// storageObjectData is the body of an Eventarc Cloud Storage event (binary content mode).
+type storageObjectData struct {
+	Bucket     string    `json:"bucket"`
+	Name       string    `json:"name"`
+	Generation string    `json:"generation"`
+	Updated    time.Time `json:"updated"`
+}
+
+// ObjectTriggersHandler runs the pipelines triggered by an Eventarc Cloud Storage event
+// (google.cloud.storage.object.v1.finalized); other event types are acknowledged and
+// ignored. Like Pub/Sub, Eventarc redelivers events answered with an error.
+func ObjectTriggersHandler(triggers *service.ObjectTriggers, push *PubSubPush) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, err := push.authenticate(c)
+		if err != nil {
+			slog.WarnContext(c.Request.Context(), "Rejected Cloud Storage event", "error", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if typ := c.GetHeader("Ce-Type"); typ != "google.cloud.storage.object.v1.finalized" {
+			c.JSON(http.StatusOK, gin.H{"message": "ignored " + typ, "runs": []service.TriggerRun{}})
+			return
+		}
+		var obj storageObjectData
+		if err := c.ShouldBindJSON(&obj); err != nil || obj.Bucket == "" || obj.Name == "" {
+			if err == nil {
+				err = errors.New("bucket and name are required")
+			}
+			// Malformed events are never redelivered in a better shape
+			slog.ErrorContext(c.Request.Context(), "Dropping Cloud Storage event", "id", c.GetHeader("Ce-Id"), "error", err)
+			c.JSON(http.StatusOK, gin.H{"error": err.Error(), "acknowledged": true})
+			return
+		}
+		runTriggers(c, ctx, triggers, service.ObjectEvent{Bucket: obj.Bucket, Name: obj.Name, Generation: obj.Generation, Time: obj.Updated})
+	}
+}
+
+// runTriggers runs the pipelines of an object event and reports them. A run that failed
+// but may succeed later answers with its error status so the event is redelivered; the
+// runs that succeeded then return their earlier result.
+func runTriggers(c *gin.Context, ctx context.Context, triggers *service.ObjectTriggers, ev service.ObjectEvent) {
+	slog.InfoContext(ctx, "Received Cloud Storage object", "bucket", ev.Bucket, "object", ev.Name, "generation", ev.Generation)
+	runs := triggers.Handle(ctx, ev)
+	status := http.StatusOK
+	for _, r := range runs {
+		if r.Err() == nil {
+			continue
+		}
+		if s, retry := redeliveryStatus(r.Err()); retry && status == http.StatusOK {
+			status = s
+		}
+	}
+	c.JSON(status, gin.H{"request_id": logging.RequestID(c.Request.Context()), "runs": runs})
+}
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+var monthRe = regexp.MustCompile(`^\d{4}-\d{2}$`)
+
+// UsageHandler reports bytes processed and rows exported per API key and month, limited
+// to the caller's tenant. ?month=YYYY-MM selects one month.
+func UsageHandler(usage *service.UsageStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		month := c.Query("month")
+		if month != "" && !monthRe.MatchString(month) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "month must be formatted YYYY-MM"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"usage": usage.List(c.Request.Context(), month)})
+	}
+}
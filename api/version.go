@@ -0,0 +1,16 @@
+package api
+
+import (
+	"bq-exporter/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VersionHandler reports the build, drivers and configuration fingerprint of the instance,
+// to tell which build and configuration each instance of a deployment runs.
+func VersionHandler(info service.BuildInfo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, info)
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"bq-exporter/logging"
+	"bq-exporter/service"
+	"cmp"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WorkbookRequest exports one XLSX workbook with a sheet per query. A single query
+// may be given as query instead of sheets; the sheet is then named after name.
+type WorkbookRequest struct {
+	ExportRequest
+	Sheets []service.WorkbookSheet `json:"sheets"`
+}
+
+// WorkbookResponse reports the written workbook.
+type WorkbookResponse struct {
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	service.WorkbookResult
+}
+
+// WorkbookHandler runs a workbook export.
+func WorkbookHandler(exporter *service.Exporter, limits Limits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req WorkbookRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		switch {
+		case req.Pipeline != "" || req.ChangesTable != "" || req.DiffSnapshot != "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "workbooks export queries; pipeline, changes_table and diff_snapshot are not supported"})
+			return
+		case req.Query != "" && len(req.Sheets) > 0:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "query and sheets are mutually exclusive"})
+			return
+		case req.Query != "":
+			req.Sheets = []service.WorkbookSheet{{Name: cmp.Or(req.Name, "Sheet1"), Query: req.Query}}
+			req.Query = ""
+		}
+		for _, s := range req.Sheets {
+			if err := limits.checkQuery(s.Query); err != nil {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		slog.InfoContext(c.Request.Context(), "Received workbook request", logging.RequestAttrs("sheets", len(req.Sheets), "output", req.Output)...)
+		res, err := exporter.Workbook(c.Request.Context(), req.Sheets, req.Params())
+		if err != nil {
+			status, ok := requestErrorStatus(err)
+			switch {
+			case ok:
+			case service.FailureClass(err) == service.FailureConfig:
+				status = http.StatusBadRequest
+			case service.FailureClass(err) == service.FailureData:
+				status = http.StatusUnprocessableEntity
+			default:
+				status = http.StatusInternalServerError
+			}
+			slog.WarnContext(c.Request.Context(), "Workbook export failed", "error", err)
+			c.JSON(status, gin.H{"error": err.Error(), "request_id": logging.RequestID(c.Request.Context())})
+			return
+		}
+		c.JSON(http.StatusOK, WorkbookResponse{Message: "OK", RequestID: logging.RequestID(c.Request.Context()), WorkbookResult: res})
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Roles of API callers, each allowed what the previous one is.
+const (
+	// RoleViewer reads pipelines, the job history, schedules and usage.
+	RoleViewer = "viewer"
+	// RoleOperator also runs exports, downloads and retries, and pauses, resumes and
+	// triggers schedules.
+	RoleOperator = "operator"
+	// RoleAdmin also creates, replaces, deletes and approves pipelines.
+	RoleAdmin = "admin"
+)
+
+var roles = []string{RoleViewer, RoleOperator, RoleAdmin}
+
+// RoleRank orders roles: viewer < operator < admin. Unknown roles rank below viewer.
+func RoleRank(role string) int {
+	return slices.Index(roles, role)
+}
+
+// Access grants roles to callers other than the admin key (API_KEY), which is always
+// admin.
+type Access struct {
+	// APIKeys maps further API keys, with access to all tenants, to their role.
+	APIKeys map[string]string `yaml:"api_keys"`
+	// OIDC admits callers with a Google-signed ID token instead of an API key.
+	OIDC OIDCAccess `yaml:"oidc"`
+}
+
+// OIDCAccess maps the identities of ID tokens to roles, with access to all tenants.
+type OIDCAccess struct {
+	// Audience the tokens must be issued for; OIDC is disabled without it
+	Audience string `yaml:"audience"`
+	// GroupsClaim is the claim listing the caller's groups (default groups)
+	GroupsClaim string `yaml:"groups_claim"`
+	// Roles maps verified emails and groups to roles; a caller gets the highest role of
+	// its email and groups, and is rejected with none.
+	Roles map[string]string `yaml:"roles"`
+}
+
+// validateRole checks a role name; empty is allowed where a default applies.
+func validateRole(role string) error {
+	if role != "" && RoleRank(role) < 0 {
+		return fmt.Errorf("unknown role %q; expected %s", role, strings.Join(roles, ", "))
+	}
+	return nil
+}
+
+// validateAccess checks the roles of access and that its keys are not tenant keys.
+func validateAccess(a Access, tenants map[string]Tenant) error {
+	for k, role := range a.APIKeys {
+		if strings.TrimSpace(k) == "" {
+			return fmt.Errorf("access: empty api key")
+		}
+		if role == "" {
+			return fmt.Errorf("access: api key without a role")
+		}
+		if err := validateRole(role); err != nil {
+			return fmt.Errorf("access: api key: %w", err)
+		}
+		for name, t := range tenants {
+			if slices.Contains(t.APIKeys, k) {
+				return fmt.Errorf("access: an api key is also a key of tenant %q", name)
+			}
+		}
+	}
+	if a.OIDC.Audience == "" && len(a.OIDC.Roles) > 0 {
+		return fmt.Errorf("access: oidc roles need an audience")
+	}
+	for who, role := range a.OIDC.Roles {
+		if role == "" {
+			return fmt.Errorf("access: oidc %q without a role", who)
+		}
+		if err := validateRole(role); err != nil {
+			return fmt.Errorf("access: oidc %q: %w", who, err)
+		}
+	}
+	return nil
+}
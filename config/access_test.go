@@ -0,0 +1,41 @@
+package config
+
+import "testing"
+
+func TestValidateAccess(t *testing.T) {
+	tenants := map[string]Tenant{"a": {APIKeys: []string{"key-a1", "key-a2"}, Role: RoleOperator, KeyRoles: map[string]string{"key-a2": RoleViewer}}}
+	if err := validateTenants(tenants); err != nil {
+		t.Errorf("validateTenants() error = %v", err)
+	}
+	ok := Access{
+		APIKeys: map[string]string{"key-view": RoleViewer},
+		OIDC:    OIDCAccess{Audience: "https://exporter.example.com", Roles: map[string]string{"data-eng@example.com": RoleOperator}},
+	}
+	if err := validateAccess(ok, tenants); err != nil {
+		t.Errorf("validateAccess() error = %v", err)
+	}
+	for name, bad := range map[string]Access{
+		"unknown role": {APIKeys: map[string]string{"key-x": "owner"}},
+		"no role":      {APIKeys: map[string]string{"key-x": ""}},
+		"tenant key":   {APIKeys: map[string]string{"key-a1": RoleViewer}},
+		"no audience":  {OIDC: OIDCAccess{Roles: map[string]string{"ops@example.com": RoleAdmin}}},
+		"oidc role":    {OIDC: OIDCAccess{Audience: "aud", Roles: map[string]string{"ops@example.com": "root"}}},
+	} {
+		if err := validateAccess(bad, tenants); err == nil {
+			t.Errorf("%s: validateAccess() succeeded", name)
+		}
+	}
+	for name, bad := range map[string]Tenant{
+		"role":     {Role: "owner"},
+		"key role": {KeyRoles: map[string]string{"key-a1": "owner"}},
+		"key":      {KeyRoles: map[string]string{"key-b": RoleViewer}},
+	} {
+		bad.APIKeys = []string{"key-a1"}
+		if err := validateTenants(map[string]Tenant{"a": bad}); err == nil {
+			t.Errorf("%s: validateTenants() succeeded", name)
+		}
+	}
+	if RoleRank(RoleViewer) >= RoleRank(RoleOperator) || RoleRank(RoleOperator) >= RoleRank(RoleAdmin) || RoleRank("") >= 0 {
+		t.Errorf("roles are not ordered viewer < operator < admin")
+	}
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Expected values of Assertion.Max besides a literal.
+const (
+	AssertToday     = "today"
+	AssertYesterday = "yesterday"
+)
+
+// Assertion is a data quality check run against the destination after a load. It
+// checks one of: the row count (MinRows and/or MaxRows), that a column has no NULLs
+// (NotNull), the greatest value of Column (Max: today, yesterday, in UTC, or a literal)
+// or that every row satisfies Condition, a condition in the destination's SQL dialect.
+type Assertion struct {
+	// Name labels the assertion in results and errors (default: derived from the check)
+	Name string `yaml:"name" json:"name,omitempty"`
+
+	MinRows *int64 `yaml:"min_rows" json:"min_rows,omitempty"`
+	MaxRows *int64 `yaml:"max_rows" json:"max_rows,omitempty"`
+
+	NotNull string `yaml:"not_null" json:"not_null,omitempty"`
+
+	Column string `yaml:"column" json:"column,omitempty"`
+	Max    string `yaml:"max" json:"max,omitempty"`
+
+	Condition string `yaml:"condition" json:"condition,omitempty"`
+}
+
+// Label returns the assertion's name, or a description of its check.
+func (a Assertion) Label() string {
+	switch {
+	case a.Name != "":
+		return a.Name
+	case a.MinRows != nil && a.MaxRows != nil:
+		return fmt.Sprintf("rows between %d and %d", *a.MinRows, *a.MaxRows)
+	case a.MinRows != nil:
+		return fmt.Sprintf("at least %d rows", *a.MinRows)
+	case a.MaxRows != nil:
+		return fmt.Sprintf("at most %d rows", *a.MaxRows)
+	case a.NotNull != "":
+		return a.NotNull + " not null"
+	case a.Max != "":
+		return fmt.Sprintf("max(%s) = %s", a.Column, a.Max)
+	}
+	return a.Condition
+}
+
+// ValidateRequestAssertions checks assertions sent with a request. On top of
+// ValidateAssertions, their conditions cannot hold subqueries: an assertion runs with the
+// service's credentials, so only pipeline definitions may read other tables from one.
+func ValidateRequestAssertions(assertions []Assertion) error {
+	if err := ValidateAssertions(assertions); err != nil {
+		return err
+	}
+	for i, a := range assertions {
+		if slices.ContainsFunc(unquotedWords(a.Condition), func(w string) bool { return strings.EqualFold(w, "SELECT") }) {
+			return fmt.Errorf("assertion %d: condition: subqueries are only allowed in pipeline definitions", i+1)
+		}
+	}
+	return nil
+}
+
+// unquotedWords returns the words of a condition (see validateRowFilter) outside its
+// strings and backquoted names.
+func unquotedWords(f string) []string {
+	var words []string
+	var quote rune
+	start := -1
+	for i, r := range f + " " {
+		word := r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+			continue
+		case word:
+			if start < 0 {
+				start = i
+			}
+			continue
+		case start >= 0:
+			words = append(words, f[start:i])
+			start = -1
+		}
+		if r == '\'' || r == '"' || r == '`' {
+			quote = r
+		}
+	}
+	return words
+}
+
+// ValidateAssertions checks that every assertion makes exactly one check.
+func ValidateAssertions(assertions []Assertion) error {
+	for i, a := range assertions {
+		checks := 0
+		if a.MinRows != nil || a.MaxRows != nil {
+			checks++
+		}
+		if a.NotNull != "" {
+			checks++
+		}
+		if a.Max != "" || a.Column != "" {
+			checks++
+		}
+		if a.Condition != "" {
+			checks++
+		}
+		switch {
+		case checks != 1:
+			return fmt.Errorf("assertion %d: set one of min_rows/max_rows, not_null, column with max, or condition", i+1)
+		case a.MinRows != nil && *a.MinRows < 0, a.MaxRows != nil && *a.MaxRows < 0:
+			return fmt.Errorf("assertion %d: row counts must not be negative", i+1)
+		case a.MinRows != nil && a.MaxRows != nil && *a.MinRows > *a.MaxRows:
+			return fmt.Errorf("assertion %d: min_rows exceeds max_rows", i+1)
+		case (a.Column == "") != (a.Max == ""):
+			return fmt.Errorf("assertion %d: column and max go together", i+1)
+		case strings.ContainsAny(a.NotNull+a.Column, "`"):
+			return fmt.Errorf("assertion %d: invalid column name", i+1)
+		}
+		if a.Condition != "" {
+			if err := validateRowFilter(a.Condition); err != nil {
+				return fmt.Errorf("assertion %d: condition: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import "testing"
+
+func TestValidateAssertions(t *testing.T) {
+	one, two := int64(1), int64(2)
+	for _, tc := range []struct {
+		name    string
+		a       Assertion
+		wantErr bool
+	}{
+		{"row count", Assertion{MinRows: &one, MaxRows: &two}, false},
+		{"not null", Assertion{NotNull: "site"}, false},
+		{"max", Assertion{Column: "visit_date", Max: AssertYesterday}, false},
+		{"condition", Assertion{Condition: "age >= 0"}, false},
+		{"no check", Assertion{Name: "empty"}, true},
+		{"two checks", Assertion{NotNull: "site", Condition: "age >= 0"}, true},
+		{"min above max", Assertion{MinRows: &two, MaxRows: &one}, true},
+		{"max without column", Assertion{Max: AssertToday}, true},
+		{"quoted column", Assertion{NotNull: "a`b"}, true},
+		{"statement", Assertion{Condition: "1=1; DROP TABLE visits"}, true},
+	} {
+		if err := ValidateAssertions([]Assertion{tc.a}); (err != nil) != tc.wantErr {
+			t.Errorf("%s: ValidateAssertions() error = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+	if got := (Assertion{MinRows: &one}).Label(); got != "at least 1 rows" {
+		t.Errorf("Label() = %q", got)
+	}
+}
+
+func TestValidateRequestAssertions(t *testing.T) {
+	for _, c := range []string{"age >= 0", "EXTRACT(YEAR FROM visit_date) > 2000", "note != 'select'", "`select` IS NOT NULL"} {
+		if err := ValidateRequestAssertions([]Assertion{{Condition: c}}); err != nil {
+			t.Errorf("ValidateRequestAssertions(%q) error = %v", c, err)
+		}
+	}
+	for _, c := range []string{"EXISTS (SELECT 1 FROM other.patients)", "site IN (select site FROM ds.sites)", "age >= 0; x"} {
+		if err := ValidateRequestAssertions([]Assertion{{Condition: c}}); err == nil {
+			t.Errorf("ValidateRequestAssertions(%q) succeeded", c)
+		}
+	}
+	if err := ValidateAssertions([]Assertion{{Condition: "EXISTS (SELECT 1 FROM ds.sites)"}}); err != nil {
+		t.Errorf("ValidateAssertions() of a pipeline subquery error = %v", err)
+	}
+}
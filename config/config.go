@@ -0,0 +1,196 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the optional service configuration file (YAML or JSON) referenced by CONFIG_FILE.
+type Config struct {
+	// Defaults holds per-driver request defaults keyed by driver name
+	// (GCS_PARQUET, STARROCKS, BIGQUERY).
+	Defaults map[string]DestinationDefaults `yaml:"defaults"`
+	// Pipelines are named exports that can be triggered by name.
+	Pipelines map[string]Pipeline `yaml:"pipelines"`
+	// Tenants share the service with isolated keys, destinations, quotas and history.
+	Tenants map[string]Tenant `yaml:"tenants"`
+	// FHIRMappings are the named row-to-resource mappings of fhir exports.
+	FHIRMappings map[string]FHIRMapping `yaml:"fhir_mappings"`
+	// REDCapMappings are the named column-to-field mappings of redcap exports.
+	REDCapMappings map[string]REDCapMapping `yaml:"redcap_mappings"`
+	// DeidProfiles are the named de-identification profiles exports can apply.
+	DeidProfiles map[string]DeidProfile `yaml:"deid_profiles"`
+	// Discoveries propose pipelines for the new tables of BigQuery datasets.
+	Discoveries map[string]Discovery `yaml:"discoveries"`
+	// Access grants roles to API keys and OIDC identities.
+	Access Access `yaml:"access"`
+	// Environments rewrite destinations for the environment selected by ENVIRONMENT.
+	Environments map[string]Environment `yaml:"environments"`
+	// Naming is the naming policy of destination tables and files.
+	Naming NamingPolicy `yaml:"naming"`
+	// Features turn automatic schema changes, DDL and overwrites on or off.
+	Features Features `yaml:"features"`
+
+	// Environment is the selected environment (see UseEnvironment)
+	Environment string `yaml:"-"`
+}
+
+// DestinationDefaults are merged into requests for one driver: request values win, empty
+// request fields take the default. Filename and Table are templates where {name} is
+// replaced by the request's logical name.
+type DestinationDefaults struct {
+	QueryLocation string `yaml:"query_location"`
+	// LineageColumns appends provenance columns to every exported row
+	LineageColumns bool `yaml:"lineage_columns"`
+	// Labels are attached to every destination; labels of the request win per key
+	Labels map[string]string `yaml:"labels"`
+
+	// GCS_PARQUET
+	Output       string `yaml:"output"`
+	Filename     string `yaml:"filename"`
+	UseTimestamp *bool  `yaml:"use_timestamp"`
+
+	// STARROCKS / BIGQUERY
+	Database string `yaml:"database"`
+	Table    string `yaml:"table"`
+
+	// STARROCKS
+	ReplicationNum int    `yaml:"replication_num"`
+	LoadStrategy   string `yaml:"load_strategy"`
+	ColumnNames    string `yaml:"column_names"`
+	ColumnCase     string `yaml:"column_case"`
+	StringType     string `yaml:"string_type"`
+	Verify         bool   `yaml:"verify"`
+
+	// BIGQUERY
+	WriteMode           string `yaml:"write_mode"`
+	DestinationLocation string `yaml:"destination_location"`
+}
+
+// FromEnv loads the file named by CONFIG_FILE, or returns an empty config if it is unset,
+// in the environment named by ENVIRONMENT, with the features of DISABLED_FEATURES (comma
+// separated) turned off.
+func FromEnv() (*Config, error) {
+	cfg, err := Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.UseEnvironment(os.Getenv("ENVIRONMENT")); err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(os.Getenv("DISABLED_FEATURES"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if err := cfg.Features.Disable(name); err != nil {
+			return nil, fmt.Errorf("invalid DISABLED_FEATURES: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// Load reads a config file. An empty path yields an empty config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	for name, p := range cfg.Pipelines {
+		if err := ValidatePipeline(name, p); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		if _, ok := cfg.Tenants[p.Tenant]; p.Tenant != "" && !ok {
+			return nil, fmt.Errorf("invalid config file %s: pipeline %q: unknown tenant %q", path, name, p.Tenant)
+		}
+		if _, ok := cfg.FHIRMappings[p.Destination.FHIRMapping]; p.Destination.FHIRMapping != "" && !ok {
+			return nil, fmt.Errorf("invalid config file %s: pipeline %q: unknown fhir_mapping %q", path, name, p.Destination.FHIRMapping)
+		}
+		if _, ok := cfg.REDCapMappings[p.Destination.REDCapMapping]; p.Destination.REDCapMapping != "" && !ok {
+			return nil, fmt.Errorf("invalid config file %s: pipeline %q: unknown redcap_mapping %q", path, name, p.Destination.REDCapMapping)
+		}
+		if _, ok := cfg.DeidProfiles[p.DeidProfile]; p.DeidProfile != "" && !ok {
+			return nil, fmt.Errorf("invalid config file %s: pipeline %q: unknown deid_profile %q", path, name, p.DeidProfile)
+		}
+	}
+	if err := validateFHIRMappings(cfg.FHIRMappings); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := validateREDCapMappings(cfg.REDCapMappings); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := validateDeidProfiles(cfg.DeidProfiles); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := validateTenants(cfg.Tenants); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := validateEnvironments(cfg.Environments); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := validateAccess(cfg.Access, cfg.Tenants); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := validateDiscoveries(cfg.Discoveries, cfg.Tenants); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := validateNaming(cfg.Naming); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := validateFeatures(cfg.Features); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// DefaultsFor returns the defaults for a driver (zero value if none are configured).
+func (c *Config) DefaultsFor(driver string) DestinationDefaults {
+	if c == nil {
+		return DestinationDefaults{}
+	}
+	return c.Defaults[driver]
+}
+
+// Fingerprint identifies the configuration in effect, in the selected environment and with
+// DISABLED_FEATURES: two instances with the same fingerprint run the same configuration.
+// It is the first 12 hex digits of the SHA-256 of the configuration, which reveals nothing
+// of its secrets.
+func (c *Config) Fingerprint() string {
+	if c == nil {
+		c = &Config{}
+	}
+	data, err := yaml.Marshal(struct {
+		*Config          `yaml:",inline"`
+		Environment      string   `yaml:"environment,omitempty"`
+		DisabledFeatures []string `yaml:"disabled_features,omitempty"`
+	}{c, c.Environment, c.Features.disabled})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// RenderName substitutes {name} in a naming template. An empty template yields name itself.
+func RenderName(tmpl, name string) string {
+	if tmpl == "" {
+		return name
+	}
+	return strings.ReplaceAll(tmpl, "{name}", name)
+}
@@ -0,0 +1,18 @@
+package config
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	a := &Config{Defaults: map[string]DestinationDefaults{"STARROCKS": {Database: "mart"}, "BIGQUERY": {Database: "ds"}}}
+	b := &Config{Defaults: map[string]DestinationDefaults{"BIGQUERY": {Database: "ds"}, "STARROCKS": {Database: "mart"}}}
+	if a.Fingerprint() != b.Fingerprint() || len(a.Fingerprint()) != 12 {
+		t.Errorf("Fingerprint() = %q and %q, want the same 12 digits", a.Fingerprint(), b.Fingerprint())
+	}
+	b.Environment = "staging"
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Error("Fingerprint() is the same in another environment")
+	}
+	if (*Config)(nil).Fingerprint() != (&Config{}).Fingerprint() {
+		t.Error("Fingerprint() of a nil config differs from an empty one")
+	}
+}
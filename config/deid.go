@@ -0,0 +1,123 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// De-identification rules of DeidRule.Rule.
+const (
+	// DeidPseudonymize replaces values with their HMAC-SHA256 under the profile's HMAC
+	// secret, as hex. Pseudonyms cannot be reversed, only recomputed with the secret
+	DeidPseudonymize = "pseudonymize"
+	// DeidEncrypt replaces values with their deterministic encryption under the
+	// profile's keyset, as hex. Anyone with decrypt access to the KMS key can recover the
+	// values
+	DeidEncrypt = "encrypt"
+	// DeidGeneralize truncates dates and timestamps to the start of their Granularity
+	DeidGeneralize = "generalize"
+	// DeidSuppress sets the column to NULL, keeping it in the result
+	DeidSuppress = "suppress"
+	// DeidDrop removes the column from the result
+	DeidDrop = "drop"
+)
+
+// DeidProfile is a reusable de-identification profile applied to exports by name.
+type DeidProfile struct {
+	// HMACSecret is the Secret Manager secret version (projects/<p>/secrets/<s>, latest
+	// version unless /versions/<v> follows) holding the key of pseudonymize rules. It is
+	// read for every run and passed to BigQuery as query parameters, never in SQL.
+	HMACSecret string `yaml:"hmac_secret" json:"hmac_secret,omitempty"`
+	// KMSKey is the Cloud KMS key (gcp-kms://projects/.../cryptoKeys/...) wrapping
+	// WrappedKeyset, the base64 deterministic AEAD keyset of encrypt rules (see
+	// KEYS.NEW_WRAPPED_KEYSET). BigQuery unwraps the keyset inside the job, so the key
+	// never appears in SQL.
+	KMSKey        string `yaml:"kms_key" json:"kms_key,omitempty"`
+	WrappedKeyset string `yaml:"wrapped_keyset" json:"-"`
+	// Columns maps result columns to their rule; other columns pass through unchanged
+	Columns map[string]DeidRule `yaml:"columns" json:"columns"`
+	// QuasiIdentifiers are columns that could identify a person in combination (after
+	// their rules); exports warn when a combination occurs in fewer than K rows
+	QuasiIdentifiers []string `yaml:"quasi_identifiers" json:"quasi_identifiers,omitempty"`
+	K                int      `yaml:"k" json:"k,omitempty"`
+}
+
+// DeidRule is the rule of one column; Granularity (week, month or year) applies to
+// generalize rules.
+type DeidRule struct {
+	Rule        string `yaml:"rule" json:"rule"`
+	Granularity string `yaml:"granularity" json:"granularity,omitempty"`
+}
+
+func validateDeidProfiles(profiles map[string]DeidProfile) error {
+	for name, p := range profiles {
+		if !pipelineNameRe.MatchString(name) {
+			return fmt.Errorf("invalid de-identification profile name %q: use letters, digits, '_' or '-' (max 64)", name)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("de-identification profile %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (p DeidProfile) validate() error {
+	if len(p.Columns) == 0 {
+		return fmt.Errorf("no column rules")
+	}
+	if p.KMSKey != "" && !strings.HasPrefix(p.KMSKey, "gcp-kms://") {
+		return fmt.Errorf("kms_key must be a gcp-kms://projects/.../cryptoKeys/... URI, got %q", p.KMSKey)
+	}
+	if _, err := base64.StdEncoding.DecodeString(p.WrappedKeyset); err != nil {
+		return fmt.Errorf("wrapped_keyset must be base64: %w", err)
+	}
+	if (p.KMSKey == "") != (p.WrappedKeyset == "") {
+		return fmt.Errorf("kms_key and wrapped_keyset must be set together")
+	}
+	if p.HMACSecret != "" && (!strings.HasPrefix(p.HMACSecret, "projects/") || !strings.Contains(p.HMACSecret, "/secrets/")) {
+		return fmt.Errorf("hmac_secret must be a projects/<project>/secrets/<secret>[/versions/<version>] secret, got %q", p.HMACSecret)
+	}
+	for col, r := range p.Columns {
+		if !columnNameRe.MatchString(col) {
+			return fmt.Errorf("invalid column %q", col)
+		}
+		switch r.Rule {
+		case DeidPseudonymize:
+			if p.HMACSecret == "" {
+				return fmt.Errorf("column %s: pseudonymize needs the profile's hmac_secret", col)
+			}
+		case DeidEncrypt:
+			if p.KMSKey == "" {
+				return fmt.Errorf("column %s: encrypt needs the profile's kms_key and wrapped_keyset", col)
+			}
+		case DeidGeneralize:
+			switch r.Granularity {
+			case "week", "month", "year":
+			default:
+				return fmt.Errorf("column %s: generalize needs granularity week, month or year, got %q", col, r.Granularity)
+			}
+		case DeidSuppress, DeidDrop:
+		default:
+			return fmt.Errorf("column %s: unknown rule %q; expected %s, %s, %s, %s or %s", col, r.Rule, DeidPseudonymize, DeidEncrypt, DeidGeneralize, DeidSuppress, DeidDrop)
+		}
+		if r.Granularity != "" && r.Rule != DeidGeneralize {
+			return fmt.Errorf("column %s: granularity only applies to generalize", col)
+		}
+	}
+	if (len(p.QuasiIdentifiers) > 0) != (p.K > 0) {
+		return fmt.Errorf("quasi_identifiers and k must be set together")
+	}
+	if p.K == 1 || p.K < 0 {
+		return fmt.Errorf("k must be at least 2, got %d", p.K)
+	}
+	for _, c := range p.QuasiIdentifiers {
+		if !columnNameRe.MatchString(c) {
+			return fmt.Errorf("invalid quasi-identifier column %q", c)
+		}
+		if r := p.Columns[c]; r.Rule == DeidDrop || r.Rule == DeidSuppress {
+			return fmt.Errorf("quasi-identifier %s is removed by its %s rule", c, r.Rule)
+		}
+	}
+	return nil
+}
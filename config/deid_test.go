@@ -0,0 +1,44 @@
+package config
+
+import "testing"
+
+func TestValidateDeidProfiles(t *testing.T) {
+	ok := DeidProfile{
+		HMACSecret:    "projects/p/secrets/deid-share",
+		KMSKey:        "gcp-kms://projects/p/locations/us/keyRings/deid/cryptoKeys/share",
+		WrappedKeyset: "CiQAp9Dn",
+		Columns: map[string]DeidRule{
+			"patient_id": {Rule: DeidPseudonymize},
+			"visit_id":   {Rule: DeidEncrypt},
+			"birth_date": {Rule: DeidGeneralize, Granularity: "month"},
+			"name":       {Rule: DeidDrop},
+		},
+		QuasiIdentifiers: []string{"birth_date", "sex"},
+		K:                5,
+	}
+	if err := validateDeidProfiles(map[string]DeidProfile{"share": ok}); err != nil {
+		t.Errorf("validateDeidProfiles() error = %v", err)
+	}
+	for name, bad := range map[string]DeidProfile{
+		"no columns":        {},
+		"no secret":         {Columns: map[string]DeidRule{"id": {Rule: DeidPseudonymize}}},
+		"keyset for hmac":   {KMSKey: "gcp-kms://projects/p", WrappedKeyset: "CiQAp9Dn", Columns: map[string]DeidRule{"id": {Rule: DeidPseudonymize}}},
+		"secret name":       {HMACSecret: "deid-share", Columns: map[string]DeidRule{"id": {Rule: DeidPseudonymize}}},
+		"no keyset":         {HMACSecret: "projects/p/secrets/s", Columns: map[string]DeidRule{"id": {Rule: DeidEncrypt}}},
+		"key without kms":   {WrappedKeyset: "CiQAp9Dn", Columns: map[string]DeidRule{"id": {Rule: DeidEncrypt}}},
+		"kms uri":           {KMSKey: "projects/p/keys/k", WrappedKeyset: "CiQAp9Dn", Columns: map[string]DeidRule{"id": {Rule: DeidEncrypt}}},
+		"keyset encoding":   {KMSKey: "gcp-kms://projects/p", WrappedKeyset: "not base64!", Columns: map[string]DeidRule{"id": {Rule: DeidEncrypt}}},
+		"unknown rule":      {Columns: map[string]DeidRule{"id": {Rule: "mask"}}},
+		"no granularity":    {Columns: map[string]DeidRule{"dob": {Rule: DeidGeneralize}}},
+		"day granularity":   {Columns: map[string]DeidRule{"dob": {Rule: DeidGeneralize, Granularity: "day"}}},
+		"stray granularity": {Columns: map[string]DeidRule{"dob": {Rule: DeidSuppress, Granularity: "week"}}},
+		"column name":       {Columns: map[string]DeidRule{"a-b": {Rule: DeidDrop}}},
+		"k alone":           {Columns: map[string]DeidRule{"a": {Rule: DeidDrop}}, K: 5},
+		"k of 1":            {Columns: map[string]DeidRule{"a": {Rule: DeidDrop}}, QuasiIdentifiers: []string{"b"}, K: 1},
+		"dropped qi":        {Columns: map[string]DeidRule{"a": {Rule: DeidDrop}}, QuasiIdentifiers: []string{"a"}, K: 3},
+	} {
+		if err := validateDeidProfiles(map[string]DeidProfile{"p": bad}); err == nil {
+			t.Errorf("%s: validateDeidProfiles() succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultDiscoveryInterval is how often a discovery scans its dataset unless it sets an
+// interval.
+const DefaultDiscoveryInterval = time.Hour
+
+// Discovery watches a BigQuery dataset for new tables and proposes a pipeline for each
+// one from a template. Proposed pipelines are held for approval before they run.
+type Discovery struct {
+	// Dataset is the watched BigQuery dataset, "dataset" or "project.dataset"
+	Dataset       string `yaml:"dataset" json:"dataset"`
+	QueryLocation string `yaml:"query_location" json:"query_location,omitempty"`
+	// Include and Exclude are table name globs such as "form_*"
+	Include []string `yaml:"include" json:"include,omitempty"`
+	Exclude []string `yaml:"exclude" json:"exclude,omitempty"`
+	// Interval is the time between scans, a duration such as "6h" (default 1h)
+	Interval string `yaml:"interval" json:"interval,omitempty"`
+	// Tenant owns the discovery and the pipelines it proposes
+	Tenant string `yaml:"tenant" json:"tenant,omitempty"`
+	// Name is the name of the proposed pipelines (default "{table}")
+	Name string `yaml:"name" json:"name,omitempty"`
+	// Template is the proposed pipeline: {table} and {dataset} in its query and
+	// destination output, filename and table are replaced by the new table's. The query
+	// defaults to all the table's rows.
+	Template Pipeline `yaml:"template" json:"template"`
+}
+
+// ScanInterval returns the time between scans.
+func (d Discovery) ScanInterval() (time.Duration, error) {
+	if d.Interval == "" {
+		return DefaultDiscoveryInterval, nil
+	}
+	i, err := time.ParseDuration(d.Interval)
+	if err != nil || i < time.Minute {
+		return 0, fmt.Errorf("invalid interval %q: expected a duration of at least 1m such as \"6h\"", d.Interval)
+	}
+	return i, nil
+}
+
+// Selects reports whether the discovery proposes a pipeline for the table.
+func (d Discovery) Selects(table string) bool {
+	match := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, table); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(d.Include) == 0 || match(d.Include)) && !match(d.Exclude)
+}
+
+// Propose returns the name and definition of the pipeline proposed for table.
+func (d Discovery) Propose(table string) (string, Pipeline) {
+	fill := strings.NewReplacer("{table}", table, "{dataset}", d.Dataset).Replace
+	name := d.Name
+	if name == "" {
+		name = "{table}"
+	}
+	p := d.Template
+	if strings.TrimSpace(p.Query) == "" {
+		p.Query = "SELECT * FROM `{dataset}.{table}`"
+	}
+	p.Query = fill(p.Query)
+	if p.QueryLocation == "" {
+		p.QueryLocation = d.QueryLocation
+	}
+	p.Destination.Output = fill(p.Destination.Output)
+	p.Destination.Filename = fill(p.Destination.Filename)
+	p.Destination.Table = fill(p.Destination.Table)
+	p.Tenant = d.Tenant
+	return fill(name), p
+}
+
+func validateDiscoveries(discoveries map[string]Discovery, tenants map[string]Tenant) error {
+	for name, d := range discoveries {
+		if !pipelineNameRe.MatchString(name) {
+			return fmt.Errorf("invalid discovery name %q: use letters, digits, '_' or '-' (max 64)", name)
+		}
+		if d.Dataset == "" || strings.Count(d.Dataset, ".") > 1 || strings.ContainsAny(d.Dataset, "`; ") {
+			return fmt.Errorf("discovery %q: invalid dataset %q; expected dataset or project.dataset", name, d.Dataset)
+		}
+		for _, pattern := range append(append([]string(nil), d.Include...), d.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("discovery %q: invalid table pattern %q: %w", name, pattern, err)
+			}
+		}
+		if _, err := d.ScanInterval(); err != nil {
+			return fmt.Errorf("discovery %q: %w", name, err)
+		}
+		if _, ok := tenants[d.Tenant]; d.Tenant != "" && !ok {
+			return fmt.Errorf("discovery %q: unknown tenant %q", name, d.Tenant)
+		}
+		if d.Template.Sync != nil {
+			return fmt.Errorf("discovery %q: the template cannot sync a dataset", name)
+		}
+		if err := ValidatePipeline(d.Propose("new_table")); err != nil {
+			return fmt.Errorf("discovery %q: template: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package config
+
+import "testing"
+
+func TestValidateDiscoveries(t *testing.T) {
+	tenants := map[string]Tenant{"a": {APIKeys: []string{"key-a"}}}
+	ok := Discovery{Dataset: "proj.study", Include: []string{"form_*"}, Interval: "6h", Tenant: "a",
+		Template: Pipeline{Destination: Destination{Output: "gs://b/{table}/"}}}
+	if err := validateDiscoveries(map[string]Discovery{"study": ok}, tenants); err != nil {
+		t.Errorf("validateDiscoveries() error = %v", err)
+	}
+	for name, bad := range map[string]func(*Discovery){
+		"dataset":  func(d *Discovery) { d.Dataset = "a.b.c" },
+		"pattern":  func(d *Discovery) { d.Exclude = []string{"["} },
+		"interval": func(d *Discovery) { d.Interval = "10s" },
+		"tenant":   func(d *Discovery) { d.Tenant = "b" },
+		"name":     func(d *Discovery) { d.Name = "new {table}" },
+		"sync":     func(d *Discovery) { d.Template.Sync = &Sync{Dataset: "x"} },
+		"template": func(d *Discovery) { d.Template.Schedule = "every day" },
+	} {
+		d := ok
+		bad(&d)
+		if err := validateDiscoveries(map[string]Discovery{"study": d}, tenants); err == nil {
+			t.Errorf("%s: validateDiscoveries() succeeded", name)
+		}
+	}
+}
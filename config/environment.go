@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Environment maps the destinations of pipelines to those of one environment (such as
+// dev, staging or prod), so the same definitions can be promoted between services unchanged.
+type Environment struct {
+	// Outputs replace the GCS prefixes of outputs; the longest matching prefix wins
+	Outputs map[string]string `yaml:"outputs"`
+	// Databases replace StarRocks databases and BigQuery datasets, also when qualifying
+	// a table (dataset.table or project.dataset.table)
+	Databases map[string]string `yaml:"databases"`
+	// ServiceAccounts replace the service accounts exports impersonate
+	ServiceAccounts map[string]string `yaml:"service_accounts"`
+}
+
+// Output rewrites a GCS URI.
+func (e Environment) Output(uri string) string {
+	best := ""
+	for from := range e.Outputs {
+		if strings.HasPrefix(uri, from) && len(from) > len(best) {
+			best = from
+		}
+	}
+	if best == "" {
+		return uri
+	}
+	return e.Outputs[best] + strings.TrimPrefix(uri, best)
+}
+
+// Database rewrites a database or dataset.
+func (e Environment) Database(db string) string {
+	if to, ok := e.Databases[db]; ok {
+		return to
+	}
+	return db
+}
+
+// Table rewrites the dataset of a qualified table; unqualified tables are kept.
+func (e Environment) Table(table string) string {
+	i := strings.LastIndex(table, ".")
+	if i < 0 {
+		return table
+	}
+	qualifier := table[:i]
+	if to, ok := e.Databases[qualifier]; ok {
+		return to + table[i:]
+	}
+	// project.dataset: the dataset alone
+	if project, dataset, ok := strings.Cut(qualifier, "."); ok {
+		if to, ok := e.Databases[dataset]; ok {
+			return project + "." + to + table[i:]
+		}
+	}
+	return table
+}
+
+// ServiceAccount rewrites a service account email.
+func (e Environment) ServiceAccount(sa string) string {
+	if to, ok := e.ServiceAccounts[sa]; ok {
+		return to
+	}
+	return sa
+}
+
+// validateEnvironments checks the rewriting rules of the environments.
+func validateEnvironments(envs map[string]Environment) error {
+	for name, env := range envs {
+		if !pipelineNameRe.MatchString(name) {
+			return fmt.Errorf("invalid environment name %q: use letters, digits, '_' or '-' (max 64)", name)
+		}
+		for from, to := range env.Outputs {
+			if !strings.HasPrefix(from, "gs://") || !strings.HasPrefix(to, "gs://") {
+				return fmt.Errorf("environment %q: outputs must map gs:// prefixes, got %q: %q", name, from, to)
+			}
+		}
+		for from, to := range env.Databases {
+			if from == "" || to == "" || strings.ContainsAny(from+to, "`; ") {
+				return fmt.Errorf("environment %q: invalid database mapping %q: %q", name, from, to)
+			}
+		}
+		for from, to := range env.ServiceAccounts {
+			if !strings.Contains(from, "@") || !strings.Contains(to, "@") {
+				return fmt.Errorf("environment %q: invalid service account mapping %q: %q", name, from, to)
+			}
+		}
+	}
+	return nil
+}
+
+// UseEnvironment selects the environment the service runs in ("" for none): its rules
+// rewrite the destination defaults and the databases, output prefixes and service
+// accounts of the tenants now, and the destinations of pipeline runs (see
+// CurrentEnvironment).
+func (c *Config) UseEnvironment(name string) error {
+	if name == "" {
+		return nil
+	}
+	env, ok := c.Environments[name]
+	if !ok {
+		return fmt.Errorf("ENVIRONMENT %q is not one of the environments of the config file", name)
+	}
+	c.Environment = name
+	for driver, d := range c.Defaults {
+		d.Output, d.Database = env.Output(d.Output), env.Database(d.Database)
+		c.Defaults[driver] = d
+	}
+	for tenant, t := range c.Tenants {
+		t.Database, t.OutputPrefix = env.Database(t.Database), env.Output(t.OutputPrefix)
+		accounts := make([]string, len(t.ServiceAccounts))
+		for i, sa := range t.ServiceAccounts {
+			accounts[i] = env.ServiceAccount(sa)
+		}
+		t.ServiceAccounts = accounts
+		c.Tenants[tenant] = t
+	}
+	return nil
+}
+
+// CurrentEnvironment returns the rules of the selected environment (none, without one).
+func (c *Config) CurrentEnvironment() Environment {
+	if c == nil {
+		return Environment{}
+	}
+	return c.Environments[c.Environment]
+}
@@ -0,0 +1,60 @@
+package config
+
+import "testing"
+
+func TestEnvironment(t *testing.T) {
+	env := Environment{
+		Outputs:         map[string]string{"gs://exports/": "gs://exports-dev/", "gs://exports/study_a/": "gs://study-a-dev/"},
+		Databases:       map[string]string{"study_a": "study_a_dev", "prod-project.study_b": "dev-project.study_b"},
+		ServiceAccounts: map[string]string{"exporter@prod.iam.gserviceaccount.com": "exporter@dev.iam.gserviceaccount.com"},
+	}
+	for in, want := range map[string]string{
+		"gs://exports/visits/":       "gs://exports-dev/visits/",
+		"gs://exports/study_a/labs/": "gs://study-a-dev/labs/",
+		"gs://other/visits/":         "gs://other/visits/",
+		"gs://exportsx/visits/":      "gs://exportsx/visits/",
+	} {
+		if got := env.Output(in); got != want {
+			t.Errorf("Output(%s) = %s, want %s", in, got, want)
+		}
+	}
+	for in, want := range map[string]string{
+		"visits":                      "visits",
+		"study_a.visits":              "study_a_dev.visits",
+		"prod-project.study_a.visits": "prod-project.study_a_dev.visits",
+		"prod-project.study_b.visits": "dev-project.study_b.visits",
+		"study_c.visits":              "study_c.visits",
+	} {
+		if got := env.Table(in); got != want {
+			t.Errorf("Table(%s) = %s, want %s", in, got, want)
+		}
+	}
+	if got := env.Database("study_a"); got != "study_a_dev" {
+		t.Errorf("Database(study_a) = %s", got)
+	}
+
+	cfg := &Config{
+		Environments: map[string]Environment{"dev": env},
+		Defaults:     map[string]DestinationDefaults{"STARROCKS": {Database: "study_a"}},
+		Tenants: map[string]Tenant{"a": {APIKeys: []string{"k"}, Database: "study_a", OutputPrefix: "gs://exports/study_a/",
+			ServiceAccounts: []string{"exporter@prod.iam.gserviceaccount.com"}}},
+	}
+	if err := validateEnvironments(cfg.Environments); err != nil {
+		t.Fatalf("validateEnvironments() error = %v", err)
+	}
+	if err := cfg.UseEnvironment("prod"); err == nil {
+		t.Error("UseEnvironment(unknown) succeeded")
+	}
+	if err := cfg.UseEnvironment("dev"); err != nil {
+		t.Fatalf("UseEnvironment() error = %v", err)
+	}
+	tenant := cfg.Tenants["a"]
+	if cfg.Defaults["STARROCKS"].Database != "study_a_dev" || tenant.Database != "study_a_dev" || tenant.OutputPrefix != "gs://study-a-dev/" ||
+		tenant.ServiceAccounts[0] != "exporter@dev.iam.gserviceaccount.com" || cfg.Environment != "dev" {
+		t.Errorf("UseEnvironment() = %+v, %+v, want rewritten defaults and tenants", cfg.Defaults, tenant)
+	}
+
+	if err := validateEnvironments(map[string]Environment{"dev": {Outputs: map[string]string{"exports/": "gs://dev/"}}}); err == nil {
+		t.Error("validateEnvironments() accepted a non-GCS output prefix")
+	}
+}
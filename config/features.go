@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Features are the automatic behaviors that change destinations beyond loading rows. They
+// are all on unless turned off.
+const (
+	// FeatureSchemaEvolution adds the columns of a result its StarRocks table lacks.
+	FeatureSchemaEvolution = "schema_evolution"
+	// FeatureAutoDDL creates missing destination tables (and StarRocks databases) from
+	// generated DDL.
+	FeatureAutoDDL = "auto_ddl"
+	// FeatureOverwrite replaces the contents of destination tables: BigQuery write_mode
+	// replace and StarRocks load_strategy swap.
+	FeatureOverwrite = "overwrite"
+)
+
+// FeatureNames are the names of all features.
+var FeatureNames = []string{FeatureSchemaEvolution, FeatureAutoDDL, FeatureOverwrite}
+
+// Features turn features on or off for the whole deployment, and for the destinations
+// matching a pattern, so conservative deployments can rule out automatic ALTER TABLE
+// entirely. Unset features are on.
+type Features struct {
+	SchemaEvolution *bool `yaml:"schema_evolution"`
+	AutoDDL         *bool `yaml:"auto_ddl"`
+	Overwrite       *bool `yaml:"overwrite"`
+	// Destinations override the features for destinations matching a pattern (see
+	// path.Match): StarRocks "db.table", BigQuery "[project.]dataset.table" and the
+	// table or output of other drivers, such as "mart.*". A feature any matching pattern
+	// turns off is off.
+	Destinations map[string]Features `yaml:"destinations"`
+
+	// disabled are the features turned off everywhere (see Disable)
+	disabled []string
+}
+
+// Disable turns features off for all destinations, whatever the configuration says, as
+// DISABLED_FEATURES does.
+func (f *Features) Disable(names ...string) error {
+	for _, name := range names {
+		if !slices.Contains(FeatureNames, name) {
+			return fmt.Errorf("unknown feature %q; expected %s", name, strings.Join(FeatureNames, ", "))
+		}
+		if !slices.Contains(f.disabled, name) {
+			f.disabled = append(f.disabled, name)
+		}
+	}
+	return nil
+}
+
+// Disabled returns the features turned off for destination, in the order of FeatureNames.
+func (f Features) Disabled(destination string) []string {
+	var out []string
+	for _, name := range FeatureNames {
+		if !f.enabled(name, destination) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func (f Features) enabled(name, destination string) bool {
+	if slices.Contains(f.disabled, name) {
+		return false
+	}
+	on, matched := true, false
+	for pattern, d := range f.Destinations {
+		if ok, _ := path.Match(pattern, destination); !ok || destination == "" {
+			continue
+		}
+		if v := d.flag(name); v != nil {
+			matched = true
+			on = on && *v
+		}
+	}
+	if matched {
+		return on
+	}
+	if v := f.flag(name); v != nil {
+		return *v
+	}
+	return true
+}
+
+func (f Features) flag(name string) *bool {
+	switch name {
+	case FeatureSchemaEvolution:
+		return f.SchemaEvolution
+	case FeatureAutoDDL:
+		return f.AutoDDL
+	case FeatureOverwrite:
+		return f.Overwrite
+	}
+	return nil
+}
+
+func validateFeatures(f Features) error {
+	for pattern, d := range f.Destinations {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("features: invalid destination pattern %q: %w", pattern, err)
+		}
+		if len(d.Destinations) > 0 {
+			return fmt.Errorf("features: destination %q cannot have destinations", pattern)
+		}
+	}
+	return nil
+}
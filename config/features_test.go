@@ -0,0 +1,49 @@
+package config
+
+import (
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestFeaturesDisabled(t *testing.T) {
+	var f Features
+	if err := yaml.Unmarshal([]byte(`
+schema_evolution: false
+destinations:
+  "mart.*":
+    auto_ddl: false
+  "staging.*":
+    schema_evolution: true
+`), &f); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		destination string
+		want        []string
+	}{
+		{"raw.visits", []string{FeatureSchemaEvolution}},
+		{"mart.visits", []string{FeatureSchemaEvolution, FeatureAutoDDL}},
+		{"staging.visits", nil},
+		{"", []string{FeatureSchemaEvolution}},
+	} {
+		if got := f.Disabled(tt.destination); !slices.Equal(got, tt.want) {
+			t.Errorf("Disabled(%q) = %v, want %v", tt.destination, got, tt.want)
+		}
+	}
+
+	// Disable wins over the configuration
+	if err := f.Disable(FeatureOverwrite, FeatureSchemaEvolution); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Disabled("staging.visits"); !slices.Equal(got, []string{FeatureSchemaEvolution, FeatureOverwrite}) {
+		t.Errorf("Disabled() after Disable = %v", got)
+	}
+	if err := f.Disable("alter"); err == nil {
+		t.Error("Disable() of an unknown feature error = nil, want an error")
+	}
+	if err := validateFeatures(Features{Destinations: map[string]Features{"[mart": {}}}); err == nil {
+		t.Error("validateFeatures() of an invalid pattern error = nil, want an error")
+	}
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FHIRMapping maps query result rows to FHIR resources of one type for fhir exports.
+// Element paths are FHIR element paths with optional array indices, such as
+// "name[0].family" or "identifier[1].value".
+type FHIRMapping struct {
+	// ResourceType is the FHIR resource type of every row, e.g. Patient or Observation
+	ResourceType string `yaml:"resource_type" json:"resource_type"`
+	// Elements maps element paths to result columns. A value with {column} placeholders
+	// is a string template instead, such as "Patient/{patient_id}" for references.
+	Elements map[string]string `yaml:"elements" json:"elements"`
+	// Fixed sets element paths to the same value in every resource, e.g. an identifier
+	// system or a meta.profile
+	Fixed map[string]any `yaml:"fixed" json:"fixed,omitempty"`
+}
+
+// FHIRPathSegment is one element of a parsed element path; Index is -1 when the element
+// is not indexed.
+type FHIRPathSegment struct {
+	Name  string
+	Index int
+}
+
+var (
+	fhirResourceTypeRe = regexp.MustCompile(`^[A-Z][A-Za-z]{0,63}$`)
+	fhirSegmentRe      = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)(?:\[(\d{1,3})\])?$`)
+	columnNameRe       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	fhirPlaceholderRe  = regexp.MustCompile(`\{([^{}]*)\}`)
+)
+
+// ParseFHIRPath splits an element path into its segments.
+func ParseFHIRPath(path string) ([]FHIRPathSegment, error) {
+	var segs []FHIRPathSegment
+	for _, part := range strings.Split(path, ".") {
+		m := fhirSegmentRe.FindStringSubmatch(part)
+		if m == nil {
+			return nil, fmt.Errorf("invalid element path %q: expected names with optional [index], separated by '.'", path)
+		}
+		seg := FHIRPathSegment{Name: m[1], Index: -1}
+		if m[2] != "" {
+			seg.Index, _ = strconv.Atoi(m[2])
+		}
+		segs = append(segs, seg)
+	}
+	if segs[0].Name == "resourceType" {
+		return nil, fmt.Errorf("invalid element path %q: resourceType is set from resource_type", path)
+	}
+	return segs, nil
+}
+
+// TemplateColumns returns the columns of a {column} template, or nil when value is a
+// plain column name.
+func (m FHIRMapping) TemplateColumns(value string) []string {
+	var cols []string
+	for _, sub := range fhirPlaceholderRe.FindAllStringSubmatch(value, -1) {
+		cols = append(cols, sub[1])
+	}
+	return cols
+}
+
+// Columns returns the result columns the mapping reads, in no particular order.
+func (m FHIRMapping) Columns() []string {
+	var cols []string
+	for _, v := range m.Elements {
+		if tc := m.TemplateColumns(v); tc != nil {
+			cols = append(cols, tc...)
+		} else {
+			cols = append(cols, v)
+		}
+	}
+	return cols
+}
+
+func validateFHIRMappings(mappings map[string]FHIRMapping) error {
+	for name, m := range mappings {
+		if !pipelineNameRe.MatchString(name) {
+			return fmt.Errorf("invalid FHIR mapping name %q: use letters, digits, '_' or '-' (max 64)", name)
+		}
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("FHIR mapping %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (m FHIRMapping) validate() error {
+	if !fhirResourceTypeRe.MatchString(m.ResourceType) {
+		return fmt.Errorf("invalid resource_type %q: expected a FHIR resource type such as Patient", m.ResourceType)
+	}
+	if len(m.Elements) == 0 {
+		return fmt.Errorf("no elements mapped")
+	}
+	for path, v := range m.Elements {
+		if _, err := ParseFHIRPath(path); err != nil {
+			return err
+		}
+		cols := m.TemplateColumns(v)
+		if cols == nil {
+			cols = []string{v}
+		}
+		for _, c := range cols {
+			if !columnNameRe.MatchString(c) {
+				return fmt.Errorf("element %s: invalid column %q", path, c)
+			}
+		}
+	}
+	for path, v := range m.Fixed {
+		if _, err := ParseFHIRPath(path); err != nil {
+			return err
+		}
+		switch v.(type) {
+		case string, bool, int, float64:
+		default:
+			return fmt.Errorf("fixed element %s: value must be a string, number or boolean", path)
+		}
+	}
+	paths := make([]string, 0, len(m.Elements)+len(m.Fixed))
+	for path := range m.Elements {
+		paths = append(paths, path)
+	}
+	for path := range m.Fixed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for i, a := range paths {
+		for _, b := range paths[i+1:] {
+			if b == a || strings.HasPrefix(b, a+".") || strings.HasPrefix(b, a+"[") {
+				return fmt.Errorf("elements %s and %s overlap", a, b)
+			}
+		}
+	}
+	return nil
+}
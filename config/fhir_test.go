@@ -0,0 +1,39 @@
+package config
+
+import "testing"
+
+func TestParseFHIRPath(t *testing.T) {
+	segs, err := ParseFHIRPath("name[1].given")
+	if err != nil || len(segs) != 2 || segs[0] != (FHIRPathSegment{"name", 1}) || segs[1] != (FHIRPathSegment{"given", -1}) {
+		t.Errorf("ParseFHIRPath() = %v, %v", segs, err)
+	}
+	for _, bad := range []string{"", "name.", "name[x]", "name[0", "1name", "resourceType"} {
+		if _, err := ParseFHIRPath(bad); err == nil {
+			t.Errorf("ParseFHIRPath(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestValidateFHIRMappings(t *testing.T) {
+	ok := FHIRMapping{
+		ResourceType: "Observation",
+		Elements:     map[string]string{"id": "obs_id", "subject.reference": "Patient/{patient_id}", "valueQuantity.value": "result"},
+		Fixed:        map[string]any{"status": "final", "valueQuantity.unit": "mmol/L"},
+	}
+	if err := validateFHIRMappings(map[string]FHIRMapping{"observation": ok}); err != nil {
+		t.Errorf("validateFHIRMappings() error = %v", err)
+	}
+	for name, bad := range map[string]FHIRMapping{
+		"resource type":   {ResourceType: "patient", Elements: map[string]string{"id": "id"}},
+		"no elements":     {ResourceType: "Patient"},
+		"column":          {ResourceType: "Patient", Elements: map[string]string{"id": "patient-id"}},
+		"template column": {ResourceType: "Patient", Elements: map[string]string{"id": "P{}"}},
+		"overlap":         {ResourceType: "Patient", Elements: map[string]string{"name": "n", "name[0].family": "f"}},
+		"fixed overlap":   {ResourceType: "Patient", Elements: map[string]string{"gender": "g"}, Fixed: map[string]any{"gender": "unknown"}},
+		"fixed value":     {ResourceType: "Patient", Elements: map[string]string{"id": "id"}, Fixed: map[string]any{"meta": map[string]any{}}},
+	} {
+		if err := validateFHIRMappings(map[string]FHIRMapping{"m": bad}); err == nil {
+			t.Errorf("%s: validateFHIRMappings() succeeded", name)
+		}
+	}
+}
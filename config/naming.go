@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// NamingBlock rejects exports into destinations breaking the naming policy.
+	NamingBlock = "block"
+	// NamingWarn only logs a warning for them.
+	NamingWarn = "warn"
+)
+
+// NamingPolicy holds the organizational conventions of destination names. Each rule is a
+// regular expression the whole name must match, in which {name}, {pipeline} and {tenant}
+// stand for the export's logical name, pipeline and tenant, matched literally: with
+// tables "(stg|mart)_{name}", the export "visits" may only load stg_visits or mart_visits.
+// Empty rules allow any name.
+type NamingPolicy struct {
+	// Databases is the rule of StarRocks databases and BigQuery datasets
+	Databases string `yaml:"databases" json:"databases,omitempty"`
+	// Tables is the rule of StarRocks and BigQuery tables, without their database
+	Tables string `yaml:"tables" json:"tables,omitempty"`
+	// Files is the rule of exported file names, without their folder and extension
+	Files string `yaml:"files" json:"files,omitempty"`
+	// Enforcement is NamingBlock (default) or NamingWarn
+	Enforcement string `yaml:"enforcement" json:"enforcement,omitempty"`
+}
+
+// NamingVars are the values of the placeholders of naming rules.
+type NamingVars struct {
+	Name     string
+	Pipeline string
+	Tenant   string
+}
+
+// MatchName reports whether value follows rule, a rule of NamingPolicy filled in with
+// vars. An empty rule matches any value.
+func MatchName(rule, value string, vars NamingVars) (bool, error) {
+	if rule == "" {
+		return true, nil
+	}
+	re, err := compileNamingRule(rule, vars)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(value), nil
+}
+
+func compileNamingRule(rule string, vars NamingVars) (*regexp.Regexp, error) {
+	r := strings.NewReplacer(
+		"{name}", regexp.QuoteMeta(vars.Name),
+		"{pipeline}", regexp.QuoteMeta(vars.Pipeline),
+		"{tenant}", regexp.QuoteMeta(vars.Tenant),
+	)
+	return regexp.Compile("^(?:" + r.Replace(rule) + ")$")
+}
+
+func validateNaming(n NamingPolicy) error {
+	for field, rule := range map[string]string{"databases": n.Databases, "tables": n.Tables, "files": n.Files} {
+		if rule == "" {
+			continue
+		}
+		if _, err := compileNamingRule(rule, NamingVars{Name: "x", Pipeline: "x", Tenant: "x"}); err != nil {
+			return fmt.Errorf("naming: invalid %s rule %q: %w", field, rule, err)
+		}
+	}
+	switch n.Enforcement {
+	case "", NamingBlock, NamingWarn:
+	default:
+		return fmt.Errorf("naming: unknown enforcement %q; expected %s or %s", n.Enforcement, NamingBlock, NamingWarn)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package config
+
+import "testing"
+
+func TestMatchName(t *testing.T) {
+	vars := NamingVars{Name: "visits", Pipeline: "daily.visits", Tenant: "site_a"}
+	for _, tt := range []struct {
+		rule, value string
+		want        bool
+	}{
+		{"", "Anything", true},
+		{"(stg|mart)_{name}", "mart_visits", true},
+		{"(stg|mart)_{name}", "mart_visits_old", false},
+		{"[a-z_]+", "Visits", false},
+		{"{tenant}_[a-z]+", "site_a_wards", true},
+		{"{pipeline}", "dailyxvisits", false},
+	} {
+		got, err := MatchName(tt.rule, tt.value, vars)
+		if err != nil || got != tt.want {
+			t.Errorf("MatchName(%q, %q) = %v, %v, want %v", tt.rule, tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateNaming(t *testing.T) {
+	if err := validateNaming(NamingPolicy{Tables: "(stg|mart)_{name}", Enforcement: NamingWarn}); err != nil {
+		t.Errorf("validateNaming() error = %v", err)
+	}
+	if err := validateNaming(NamingPolicy{Files: "[a-z"}); err == nil {
+		t.Error("validateNaming() of an invalid rule error = nil, want an error")
+	}
+	if err := validateNaming(NamingPolicy{Enforcement: "audit"}); err == nil {
+		t.Error("validateNaming() of an unknown enforcement error = nil, want an error")
+	}
+}
@@ -0,0 +1,540 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pipeline couples a BigQuery SQL transform with destination settings, a schedule and
+// notifications so an export can be triggered by name. The query may contain
+// {{parameter}} placeholders, filled from Parameters and per-run overrides.
+type Pipeline struct {
+	Query         string `yaml:"query" json:"query"`
+	QueryLocation string `yaml:"query_location" json:"query_location,omitempty"`
+	// SnapshotTime reads the query's tables as of a point in time: an RFC 3339
+	// timestamp, or "now" for the start of the run
+	SnapshotTime string `yaml:"snapshot_time" json:"snapshot_time,omitempty"`
+
+	// ChangesTable sources the pipeline from the change history of a BigQuery table;
+	// Query is then optional and reads the history as table "changes"
+	ChangesTable string `yaml:"changes_table" json:"changes_table,omitempty"`
+	ChangesMode  string `yaml:"changes_mode" json:"changes_mode,omitempty"`
+
+	// DedupColumns keeps one result row per key: the first or latest (DedupKeep) by
+	// DedupOrderBy
+	DedupColumns []string `yaml:"dedup_columns" json:"dedup_columns,omitempty"`
+	DedupOrderBy string   `yaml:"dedup_order_by" json:"dedup_order_by,omitempty"`
+	DedupKeep    string   `yaml:"dedup_keep" json:"dedup_keep,omitempty"`
+
+	// DeidProfile names the deid_profiles entry de-identifying the result
+	DeidProfile string `yaml:"deid_profile" json:"deid_profile,omitempty"`
+
+	// Assertions are checked against the destination after every load
+	Assertions []Assertion `yaml:"assertions" json:"assertions,omitempty"`
+
+	// ChunkColumn and ChunkBy split runs given a chunk_start and chunk_end into one export
+	// per day, week or month (default) of the ChunkColumn dates
+	ChunkColumn string `yaml:"chunk_column" json:"chunk_column,omitempty"`
+	ChunkBy     string `yaml:"chunk_by" json:"chunk_by,omitempty"`
+
+	// Sync mirrors every selected table of a BigQuery dataset instead of running Query
+	Sync *Sync `yaml:"sync" json:"sync,omitempty"`
+
+	// Parameters are the default values of the query placeholders
+	Parameters  map[string]string `yaml:"parameters" json:"parameters,omitempty"`
+	Destination Destination       `yaml:"destination" json:"destination"`
+
+	// Schedule is a cron expression (see ParseSchedule) on which the internal scheduler
+	// runs the pipeline
+	Schedule string `yaml:"schedule" json:"schedule,omitempty"`
+	// Trigger runs the pipeline when a matching object lands in Cloud Storage
+	Trigger *Trigger `yaml:"trigger" json:"trigger,omitempty"`
+	// Priority is the priority of the pipeline's runs: interactive, normal or batch
+	Priority string `yaml:"priority" json:"priority,omitempty"`
+	Notify   Notify `yaml:"notify" json:"notify"`
+
+	// Freshness is the freshness SLO of the pipeline, a duration such as "24h": a run
+	// must succeed at least that often or the freshness monitor reports it stale
+	Freshness string `yaml:"freshness" json:"freshness,omitempty"`
+
+	// Tenant owns the pipeline; only its keys (and the admin key) can see and run it.
+	// Without a tenant only the admin key can use it.
+	Tenant string `yaml:"tenant" json:"tenant,omitempty"`
+
+	// PendingApproval holds a pipeline proposed by a discovery: it does not run until
+	// approved. Discovered records the table it was proposed for.
+	PendingApproval bool             `yaml:"pending_approval" json:"pending_approval,omitempty"`
+	Discovered      *DiscoveredTable `yaml:"discovered" json:"discovered,omitempty"`
+}
+
+// Destination holds the per-pipeline destination fields of an export request.
+type Destination struct {
+	Output       string `yaml:"output" json:"output,omitempty"`
+	Filename     string `yaml:"filename" json:"filename,omitempty"`
+	UseTimestamp *bool  `yaml:"use_timestamp" json:"use_timestamp,omitempty"`
+	// Format is parquet, csv, fhir or redcap; the csv_ options shape CSV files (see
+	// ExportParams), FHIRMapping and REDCapMapping name the fhir_mappings and
+	// redcap_mappings entries of fhir and redcap files
+	Format        string `yaml:"format" json:"format,omitempty"`
+	FHIRMapping   string `yaml:"fhir_mapping" json:"fhir_mapping,omitempty"`
+	REDCapMapping string `yaml:"redcap_mapping" json:"redcap_mapping,omitempty"`
+	CSVHeader     string `yaml:"csv_header" json:"csv_header,omitempty"`
+	CSVDelimiter  string `yaml:"csv_delimiter" json:"csv_delimiter,omitempty"`
+	CSVBOM        bool   `yaml:"csv_bom" json:"csv_bom,omitempty"`
+	SchemaFile    bool   `yaml:"schema_file" json:"schema_file,omitempty"`
+	// ResolveSingleFile reports the file written instead of the pattern when there is one
+	ResolveSingleFile bool `yaml:"resolve_single_file" json:"resolve_single_file,omitempty"`
+	// RowGroupRows and MaxFileRows size the files of the GCS_PARQUET_WRITE driver
+	RowGroupRows int   `yaml:"row_group_rows" json:"row_group_rows,omitempty"`
+	MaxFileRows  int64 `yaml:"max_file_rows" json:"max_file_rows,omitempty"`
+	// ParquetTimestamp, ParquetDecimal and ParquetString choose its Parquet types
+	ParquetTimestamp string `yaml:"parquet_timestamp" json:"parquet_timestamp,omitempty"`
+	ParquetDecimal   string `yaml:"parquet_decimal" json:"parquet_decimal,omitempty"`
+	ParquetString    string `yaml:"parquet_string" json:"parquet_string,omitempty"`
+	// RedisType (hash or set) and RedisTTL shape the keys of the REDIS driver
+	RedisType string `yaml:"redis_type" json:"redis_type,omitempty"`
+	RedisTTL  string `yaml:"redis_ttl" json:"redis_ttl,omitempty"`
+
+	Database       string `yaml:"database" json:"database,omitempty"`
+	Table          string `yaml:"table" json:"table,omitempty"`
+	CreateDDL      string `yaml:"create_ddl" json:"create_ddl,omitempty"`
+	ReplicationNum int    `yaml:"replication_num" json:"replication_num,omitempty"`
+	LoadStrategy   string `yaml:"load_strategy" json:"load_strategy,omitempty"`
+	// ColumnNames is the StarRocks column name policy: quote, sanitize or strict;
+	// ColumnCase the column case policy: preserve, lower or upper
+	ColumnNames string `yaml:"column_names" json:"column_names,omitempty"`
+	ColumnCase  string `yaml:"column_case" json:"column_case,omitempty"`
+	// StringType is the type of created StarRocks string columns: varchar, string or auto
+	StringType string `yaml:"string_type" json:"string_type,omitempty"`
+	// Verify checks the StarRocks row count after every load
+	Verify bool `yaml:"verify" json:"verify,omitempty"`
+	// AllowSchemaChanges false fails loads that would change the destination's schema
+	AllowSchemaChanges *bool `yaml:"allow_schema_changes" json:"allow_schema_changes,omitempty"`
+
+	// ImpersonateServiceAccount is the service account the pipeline reads BigQuery as
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account" json:"impersonate_service_account,omitempty"`
+	// LineageColumns appends provenance columns to every exported row
+	LineageColumns bool `yaml:"lineage_columns" json:"lineage_columns,omitempty"`
+	// Labels and Description are attached to the destination table or files
+	Labels      map[string]string `yaml:"labels" json:"labels,omitempty"`
+	Description string            `yaml:"description" json:"description,omitempty"`
+	// Transforms transform the rows in flight and ComputedColumns are appended to them
+	// (STARROCKS and GCS_PARQUET_WRITE)
+	Transforms      []Transform      `yaml:"transforms" json:"transforms,omitempty"`
+	ComputedColumns []ComputedColumn `yaml:"computed_columns" json:"computed_columns,omitempty"`
+
+	DeleteColumn string   `yaml:"delete_column" json:"delete_column,omitempty"`
+	DeleteValues []string `yaml:"delete_values" json:"delete_values,omitempty"`
+
+	WriteMode           string   `yaml:"write_mode" json:"write_mode,omitempty"`
+	KeyColumns          []string `yaml:"key_columns" json:"key_columns,omitempty"`
+	DestinationLocation string   `yaml:"destination_location" json:"destination_location,omitempty"`
+
+	DiffSnapshot string `yaml:"diff_snapshot" json:"diff_snapshot,omitempty"`
+}
+
+// Sync selects the tables of a dataset sync pipeline: each table is loaded into the
+// table of the same name in the destination database.
+type Sync struct {
+	// Dataset is the source BigQuery dataset, "dataset" or "project.dataset"
+	Dataset string `yaml:"dataset" json:"dataset"`
+	// Include and Exclude are table name globs such as "visit_*"
+	Include []string `yaml:"include" json:"include,omitempty"`
+	Exclude []string `yaml:"exclude" json:"exclude,omitempty"`
+	// Parallelism is how many tables load at a time (default 1)
+	Parallelism int `yaml:"parallelism" json:"parallelism,omitempty"`
+	// DependsOn lists the parent tables of a table: it loads after they loaded, and is
+	// skipped if one of them failed
+	DependsOn map[string][]string `yaml:"depends_on" json:"depends_on,omitempty"`
+	// DeferSwaps stages every table and swaps them all in, parents first, only once all
+	// of them loaded (StarRocks swap load strategy)
+	DeferSwaps bool `yaml:"defer_swaps" json:"defer_swaps,omitempty"`
+}
+
+// Trigger matches the Cloud Storage objects whose arrival runs a pipeline, such as the
+// _SUCCESS marker an upstream job writes last.
+type Trigger struct {
+	Bucket string `yaml:"bucket" json:"bucket"`
+	// Object is a glob of object names, e.g. "landing/visits/*/_SUCCESS" ('*' does not
+	// match '/')
+	Object string `yaml:"object" json:"object"`
+}
+
+// Matches reports whether the object bucket/name runs the pipeline.
+func (t *Trigger) Matches(bucket, name string) bool {
+	if t == nil || t.Bucket != bucket {
+		return false
+	}
+	ok, _ := path.Match(t.Object, name)
+	return ok
+}
+
+// DiscoveredTable is the table a discovery proposed a pipeline for.
+type DiscoveredTable struct {
+	Discovery string    `yaml:"discovery" json:"discovery"`
+	Dataset   string    `yaml:"dataset" json:"dataset"`
+	Table     string    `yaml:"table" json:"table"`
+	At        time.Time `yaml:"at" json:"at"`
+}
+
+// Notify configures webhooks called when a pipeline run finishes.
+type Notify struct {
+	Webhooks []string `yaml:"webhooks" json:"webhooks,omitempty"`
+	// On lists the outcomes that trigger a notification ("success", "failure",
+	// "stale"); empty means all of them.
+	On []string `yaml:"on" json:"on,omitempty"`
+	// Sample adds a few anonymized rows of the destination to completion notifications
+	Sample *NotifySample `yaml:"sample" json:"sample,omitempty"`
+}
+
+// Limits of NotifySample.Rows.
+const (
+	DefaultSampleRows = 5
+	MaxSampleRows     = 20
+)
+
+// NotifySample selects the rows of the destination shown with a run, for reviewers to
+// eyeball its shape: only Columns are included, and their values keep their shape but not
+// their characters, except in the Clear columns.
+type NotifySample struct {
+	// Rows is the number of rows (default 5, at most 20)
+	Rows    int      `yaml:"rows" json:"rows,omitempty"`
+	Columns []string `yaml:"columns" json:"columns"`
+	// Clear are the columns shown as they are, none by default
+	Clear []string `yaml:"clear" json:"clear,omitempty"`
+}
+
+// Validate checks the sample's size and columns.
+func (s NotifySample) Validate() error {
+	if s.Rows < 0 || s.Rows > MaxSampleRows {
+		return fmt.Errorf("sample rows must be between 1 and %d, or 0 for the default of %d", MaxSampleRows, DefaultSampleRows)
+	}
+	if len(s.Columns) == 0 {
+		return fmt.Errorf("sample needs columns")
+	}
+	for _, c := range s.Columns {
+		if c == "" || strings.Contains(c, "`") {
+			return fmt.Errorf("invalid sample column %q", c)
+		}
+	}
+	for _, c := range s.Clear {
+		if !slices.Contains(s.Columns, c) {
+			return fmt.Errorf("clear sample column %q is not in columns", c)
+		}
+	}
+	return nil
+}
+
+// Wants reports whether an outcome ("success", "failure", "stale" or "discovered") should
+// be notified.
+func (n Notify) Wants(outcome string) bool {
+	if len(n.On) == 0 {
+		return true
+	}
+	for _, o := range n.On {
+		if strings.EqualFold(o, outcome) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	pipelineNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	placeholderRe  = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// ValidatePipeline checks a pipeline definition and its name.
+func ValidatePipeline(name string, p Pipeline) error {
+	if !pipelineNameRe.MatchString(name) {
+		return fmt.Errorf("invalid pipeline name %q: use letters, digits, '_' or '-' (max 64)", name)
+	}
+	if p.Sync != nil {
+		if err := p.Sync.validate(p); err != nil {
+			return fmt.Errorf("pipeline %q: %w", name, err)
+		}
+	} else if strings.TrimSpace(p.Query) == "" && p.ChangesTable == "" {
+		return fmt.Errorf("pipeline %q: query, changes_table or sync is required", name)
+	}
+	if p.Schedule != "" {
+		if _, err := ParseSchedule(p.Schedule); err != nil {
+			return fmt.Errorf("pipeline %q: %w", name, err)
+		}
+	}
+	if err := ValidateAssertions(p.Assertions); err != nil {
+		return fmt.Errorf("pipeline %q: %w", name, err)
+	}
+	if t := p.Trigger; t != nil {
+		if t.Bucket == "" || t.Object == "" {
+			return fmt.Errorf("pipeline %q: trigger needs a bucket and an object pattern", name)
+		}
+		if _, err := path.Match(t.Object, ""); err != nil {
+			return fmt.Errorf("pipeline %q: invalid trigger object pattern %q: %w", name, t.Object, err)
+		}
+	}
+	if p.Freshness != "" {
+		if _, err := p.FreshnessSLO(); err != nil {
+			return fmt.Errorf("pipeline %q: %w", name, err)
+		}
+	}
+	switch strings.ToLower(p.Priority) {
+	case "", "interactive", "normal", "batch":
+	default:
+		return fmt.Errorf("pipeline %q: unknown priority %q; expected interactive, normal or batch", name, p.Priority)
+	}
+	switch p.Destination.ColumnNames {
+	case "", "quote", "sanitize", "strict":
+	default:
+		return fmt.Errorf("pipeline %q: unknown column_names %q; expected quote, sanitize or strict", name, p.Destination.ColumnNames)
+	}
+	switch p.Destination.ColumnCase {
+	case "", "preserve", "lower", "upper":
+	default:
+		return fmt.Errorf("pipeline %q: unknown column_case %q; expected preserve, lower or upper", name, p.Destination.ColumnCase)
+	}
+	switch p.Destination.StringType {
+	case "", "varchar", "string", "auto":
+	default:
+		return fmt.Errorf("pipeline %q: unknown string_type %q; expected varchar, string or auto", name, p.Destination.StringType)
+	}
+	if sa := p.Destination.ImpersonateServiceAccount; sa != "" && !strings.Contains(sa, "@") {
+		return fmt.Errorf("pipeline %q: impersonate_service_account %q must be a service account email", name, sa)
+	}
+	for _, o := range p.Notify.On {
+		switch strings.ToLower(o) {
+		case "success", "failure", "stale", "discovered":
+		default:
+			return fmt.Errorf("pipeline %q: unknown notify outcome %q; expected success, failure, stale or discovered", name, o)
+		}
+	}
+	for _, u := range p.Notify.Webhooks {
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			return fmt.Errorf("pipeline %q: webhook %q must be an http(s) URL", name, u)
+		}
+	}
+	switch p.ChunkBy {
+	case "", "day", "week", "month":
+	default:
+		return fmt.Errorf("pipeline %q: unknown chunk_by %q; expected day, week or month", name, p.ChunkBy)
+	}
+	if p.ChunkColumn != "" && (p.Sync != nil || p.ChangesTable != "") {
+		return fmt.Errorf("pipeline %q: chunk_column cannot be combined with sync or changes_table", name)
+	}
+	if p.Notify.Sample != nil {
+		if err := p.Notify.Sample.Validate(); err != nil {
+			return fmt.Errorf("pipeline %q: notify: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Sync) validate(p Pipeline) error {
+	switch {
+	case s.Dataset == "" || strings.Count(s.Dataset, ".") > 1:
+		return fmt.Errorf("sync.dataset %q must be dataset or project.dataset", s.Dataset)
+	case strings.TrimSpace(p.Query) != "" || p.ChangesTable != "" || p.Destination.DiffSnapshot != "":
+		return fmt.Errorf("sync cannot be combined with query, changes_table or diff_snapshot")
+	case p.Destination.Table != "" || p.Destination.CreateDDL != "":
+		return fmt.Errorf("sync names its tables after the source tables; table and create_ddl are not supported")
+	case s.Parallelism < 0:
+		return fmt.Errorf("sync.parallelism must not be negative")
+	}
+	for _, pattern := range append(append([]string(nil), s.Include...), s.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid sync table pattern %q: %w", pattern, err)
+		}
+	}
+	if s.DeferSwaps && p.Destination.LoadStrategy != "" && p.Destination.LoadStrategy != "swap" {
+		return fmt.Errorf("sync.defer_swaps needs the swap load strategy")
+	}
+	if cycle := dependencyCycle(s.DependsOn); cycle != nil {
+		return fmt.Errorf("sync.depends_on has a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// dependencyCycle returns a cycle of the dependency graph (child -> parents), or nil.
+func dependencyCycle(deps map[string][]string) []string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var stack []string
+	var visit func(string) []string
+	visit = func(t string) []string {
+		switch state[t] {
+		case visiting:
+			for i, s := range stack {
+				if s == t {
+					return append(append([]string(nil), stack[i:]...), t)
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[t] = visiting
+		stack = append(stack, t)
+		for _, parent := range deps[t] {
+			if c := visit(parent); c != nil {
+				return c
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[t] = visited
+		return nil
+	}
+	names := make([]string, 0, len(deps))
+	for t := range deps {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	for _, t := range names {
+		if c := visit(t); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// FreshnessSLO parses Freshness; 0 means the pipeline has no freshness SLO.
+func (p Pipeline) FreshnessSLO() (time.Duration, error) {
+	if p.Freshness == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(p.Freshness)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid freshness %q: expected a positive duration such as 24h", p.Freshness)
+	}
+	return d, nil
+}
+
+// RenderQuery fills the {{parameter}} placeholders of the pipeline query. Overrides win
+// over the pipeline's default parameters; a placeholder without a value is an error.
+// Values are escaped for the string literal a placeholder sits in, so they cannot end it;
+// placeholders elsewhere only take identifiers and numbers.
+func (p Pipeline) RenderQuery(overrides map[string]string) (string, error) {
+	var missing []string
+	var b strings.Builder
+	last := 0
+	for _, m := range placeholders(p.Query) {
+		key := p.Query[m.name[0]:m.name[1]]
+		v, ok := overrides[key]
+		if !ok {
+			v, ok = p.Parameters[key]
+		}
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		rendered, err := m.literal.render(v)
+		if err != nil {
+			return "", fmt.Errorf("query parameter %s: %w", key, err)
+		}
+		b.WriteString(p.Query[last:m.start])
+		b.WriteString(rendered)
+		last = m.end
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "", fmt.Errorf("missing value for query parameter(s): %s", strings.Join(missing, ", "))
+	}
+	b.WriteString(p.Query[last:])
+	return b.String(), nil
+}
+
+// placeholder is a {{parameter}} of a query and the literal it sits in.
+type placeholder struct {
+	start, end int
+	name       [2]int
+	literal    queryLiteral
+}
+
+// queryLiteral is where in a query a placeholder sits: in a string literal with the
+// delimiter quote (a single or double quote, or three of them), raw or not, in a
+// backquoted identifier (quote `) or, with no quote, in SQL or a comment.
+type queryLiteral struct {
+	quote string
+	raw   bool
+}
+
+// plainValueRe matches the values placeholders outside string literals take.
+var plainValueRe = regexp.MustCompile(`^[A-Za-z0-9_.]*$`)
+
+func (l queryLiteral) render(v string) (string, error) {
+	switch {
+	case l.quote == "":
+		if !plainValueRe.MatchString(v) {
+			return "", fmt.Errorf("%q can only be used inside a string literal; quote the placeholder", v)
+		}
+		return v, nil
+	case l.quote == "`":
+		if strings.ContainsAny(v, "`\\\n\r") {
+			return "", fmt.Errorf("%q cannot be used in a backquoted identifier", v)
+		}
+		return v, nil
+	case l.raw:
+		if strings.ContainsAny(v, l.quote[:1]+"\\\n\r") {
+			return "", fmt.Errorf("%q cannot be used in a raw string; remove its r prefix", v)
+		}
+		return v, nil
+	}
+	q := l.quote[:1]
+	return strings.NewReplacer(`\`, `\\`, q, `\`+q, "\n", `\n`, "\r", `\r`).Replace(v), nil
+}
+
+// placeholders returns the placeholders of query with the literal each sits in, skipping
+// string literals, backquoted identifiers and comments as BigQuery reads them.
+func placeholders(query string) []placeholder {
+	var out []placeholder
+	matches := placeholderRe.FindAllStringSubmatchIndex(query, -1)
+	var lit queryLiteral
+	comment := "" // the end of the comment i is in
+	for i := 0; i < len(query); {
+		if len(matches) > 0 && i == matches[0][0] {
+			m := matches[0]
+			out = append(out, placeholder{start: m[0], end: m[1], name: [2]int{m[2], m[3]}, literal: lit})
+			matches = matches[1:]
+			i = m[1]
+			continue
+		}
+		rest := query[i:]
+		switch {
+		case comment != "":
+			if strings.HasPrefix(rest, comment) {
+				comment = ""
+			}
+		case lit.quote != "":
+			if strings.HasPrefix(rest, lit.quote) {
+				i += len(lit.quote)
+				lit = queryLiteral{}
+				continue
+			}
+			if rest[0] == '\\' && len(rest) > 1 && !strings.HasPrefix(rest[1:], "{{") {
+				i++
+			}
+		case strings.HasPrefix(rest, "--"), rest[0] == '#':
+			comment = "\n"
+		case strings.HasPrefix(rest, "/*"):
+			comment = "*/"
+			i += 2
+			continue
+		case rest[0] == '`':
+			lit = queryLiteral{quote: "`"}
+		case rest[0] == '\'' || rest[0] == '"':
+			lit = queryLiteral{quote: rest[:1], raw: i > 0 && (query[i-1] == 'r' || query[i-1] == 'R')}
+			if triple := strings.Repeat(rest[:1], 3); strings.HasPrefix(rest, triple) {
+				lit.quote = triple
+			}
+			i += len(lit.quote)
+			continue
+		}
+		i++
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package config
+
+import "testing"
+
+func TestRenderQuery(t *testing.T) {
+	for _, tt := range []struct {
+		query, value, want string
+	}{
+		{"SELECT * FROM ds.t WHERE batch = '{{v}}'", "results/2026-10-14", "SELECT * FROM ds.t WHERE batch = 'results/2026-10-14'"},
+		// A value cannot end the string it sits in
+		{"SELECT * FROM ds.t WHERE batch = '{{v}}'", "x' OR TRUE OR '", `SELECT * FROM ds.t WHERE batch = 'x\' OR TRUE OR \''`},
+		{`SELECT "{{ v }}"`, "a\"b\\\nc", `SELECT "a\"b\\\nc"`},
+		{"SELECT '''{{v}}'''", "it's", `SELECT '''it\'s'''`},
+		{"SELECT * FROM ds.t_{{v}} LIMIT {{v}}", "2026", "SELECT * FROM ds.t_2026 LIMIT 2026"},
+		{"SELECT * FROM `ds.t_{{v}}`", "a-b", "SELECT * FROM `ds.t_a-b`"},
+		{"SELECT 'it''s', {{v}} -- '{{v}}'", "1", "SELECT 'it''s', 1 -- '1'"},
+	} {
+		got, err := Pipeline{Query: tt.query}.RenderQuery(map[string]string{"v": tt.value})
+		if err != nil || got != tt.want {
+			t.Errorf("RenderQuery(%q, %q) = %s, %v, want %s", tt.query, tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ query, value string }{
+		{"SELECT * FROM ds.t WHERE n = {{v}}", "1 OR TRUE"},
+		{"SELECT 1 -- {{v}}", "x\nDROP TABLE ds.t"},
+		{"SELECT * FROM `ds.{{v}}`", "t` UNION ALL SELECT * FROM `other.t"},
+		{"SELECT r'{{v}}'", "x' OR '"},
+	} {
+		if got, err := (Pipeline{Query: tt.query}).RenderQuery(map[string]string{"v": tt.value}); err == nil {
+			t.Errorf("RenderQuery(%q, %q) = %s, want an error", tt.query, tt.value, got)
+		}
+	}
+
+	p := Pipeline{Query: "SELECT '{{a}}', '{{b}}', '{{c}}'", Parameters: map[string]string{"a": "default", "b": "default"}}
+	if got, err := p.RenderQuery(map[string]string{"b": "override", "c": "x"}); err != nil || got != "SELECT 'default', 'override', 'x'" {
+		t.Errorf("RenderQuery() with defaults = %s, %v", got, err)
+	}
+	if _, err := p.RenderQuery(nil); err == nil || err.Error() != "missing value for query parameter(s): c" {
+		t.Errorf("RenderQuery() without c error = %v", err)
+	}
+}
+
+func TestNotifySampleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sample  NotifySample
+		wantErr bool
+	}{
+		{"default rows", NotifySample{Columns: []string{"site"}}, false},
+		{"clear column", NotifySample{Rows: 20, Columns: []string{"site", "name"}, Clear: []string{"site"}}, false},
+		{"too many rows", NotifySample{Rows: 21, Columns: []string{"site"}}, true},
+		{"negative rows", NotifySample{Rows: -1, Columns: []string{"site"}}, true},
+		{"no columns", NotifySample{}, true},
+		{"clear column not sampled", NotifySample{Columns: []string{"site"}, Clear: []string{"name"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.sample.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
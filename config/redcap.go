@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// REDCapMapping maps query result columns to the fields of a REDCap project for redcap
+// exports: a flat CSV import file with the record ID first, then the event and repeating
+// instrument columns of longitudinal projects, then the fields.
+type REDCapMapping struct {
+	// RecordID is the column holding the record ID; RecordIDField the project's record
+	// ID field (default record_id)
+	RecordID      string `yaml:"record_id" json:"record_id"`
+	RecordIDField string `yaml:"record_id_field" json:"record_id_field,omitempty"`
+	// Event fills redcap_event_name in longitudinal projects
+	Event *REDCapEvent `yaml:"event" json:"event,omitempty"`
+	// RepeatInstrument is the repeating instrument the rows belong to and RepeatInstance
+	// the column numbering them; a repeating event needs only RepeatInstance
+	RepeatInstrument string `yaml:"repeat_instrument" json:"repeat_instrument,omitempty"`
+	RepeatInstance   string `yaml:"repeat_instance" json:"repeat_instance,omitempty"`
+	// Fields maps REDCap field names to result columns
+	Fields map[string]string `yaml:"fields" json:"fields"`
+	// DatetimeSeconds writes datetimes with seconds, for datetime_seconds_ymd fields
+	DatetimeSeconds bool `yaml:"datetime_seconds" json:"datetime_seconds,omitempty"`
+}
+
+// REDCapEvent derives the unique event name of every row: the same Name for all rows, or
+// the Values entry of the row's Column value (such as a visit code).
+type REDCapEvent struct {
+	Name   string            `yaml:"name" json:"name,omitempty"`
+	Column string            `yaml:"column" json:"column,omitempty"`
+	Values map[string]string `yaml:"values" json:"values,omitempty"`
+}
+
+// REDCapRecordIDField is the default record ID field of REDCap projects.
+const REDCapRecordIDField = "record_id"
+
+// REDCap import columns besides the fields.
+const (
+	REDCapEventColumn            = "redcap_event_name"
+	REDCapRepeatInstrumentColumn = "redcap_repeat_instrument"
+	REDCapRepeatInstanceColumn   = "redcap_repeat_instance"
+)
+
+var redcapNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,99}$`)
+
+func validateREDCapMappings(mappings map[string]REDCapMapping) error {
+	for name, m := range mappings {
+		if !pipelineNameRe.MatchString(name) {
+			return fmt.Errorf("invalid REDCap mapping name %q: use letters, digits, '_' or '-' (max 64)", name)
+		}
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("REDCap mapping %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (m REDCapMapping) validate() error {
+	column := func(what, c string) error {
+		if !columnNameRe.MatchString(c) {
+			return fmt.Errorf("%s: invalid column %q", what, c)
+		}
+		return nil
+	}
+	if err := column("record_id", m.RecordID); err != nil {
+		return err
+	}
+	idField := m.RecordIDField
+	if idField == "" {
+		idField = REDCapRecordIDField
+	}
+	if !redcapNameRe.MatchString(idField) {
+		return fmt.Errorf("invalid record_id_field %q: REDCap names are lowercase letters, digits and '_'", idField)
+	}
+	if e := m.Event; e != nil {
+		switch {
+		case e.Name != "" && e.Column != "":
+			return fmt.Errorf("event: name and column are mutually exclusive")
+		case e.Name != "":
+			if !redcapNameRe.MatchString(e.Name) {
+				return fmt.Errorf("event: invalid unique event name %q", e.Name)
+			}
+		case e.Column != "":
+			if err := column("event", e.Column); err != nil {
+				return err
+			}
+			if len(e.Values) == 0 {
+				return fmt.Errorf("event: column %s needs values mapping its values to events", e.Column)
+			}
+			for v, event := range e.Values {
+				if !redcapNameRe.MatchString(event) {
+					return fmt.Errorf("event: invalid unique event name %q for %q", event, v)
+				}
+			}
+		default:
+			return fmt.Errorf("event needs a name or a column")
+		}
+	}
+	if m.RepeatInstrument != "" {
+		if !redcapNameRe.MatchString(m.RepeatInstrument) {
+			return fmt.Errorf("invalid repeat_instrument %q", m.RepeatInstrument)
+		}
+		if m.RepeatInstance == "" {
+			return fmt.Errorf("repeat_instrument needs repeat_instance")
+		}
+	}
+	if m.RepeatInstance != "" {
+		if err := column("repeat_instance", m.RepeatInstance); err != nil {
+			return err
+		}
+		if m.RepeatInstrument == "" && m.Event == nil {
+			return fmt.Errorf("repeat_instance needs repeat_instrument, or an event for repeating events")
+		}
+	}
+	if len(m.Fields) == 0 {
+		return fmt.Errorf("no fields mapped")
+	}
+	for field, c := range m.Fields {
+		switch {
+		case !redcapNameRe.MatchString(field):
+			return fmt.Errorf("invalid field name %q: REDCap names are lowercase letters, digits and '_'", field)
+		case field == idField || field == REDCapEventColumn || field == REDCapRepeatInstrumentColumn || field == REDCapRepeatInstanceColumn:
+			return fmt.Errorf("field %s is written by the export itself", field)
+		}
+		if err := column("field "+field, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package config
+
+import "testing"
+
+func TestValidateREDCapMappings(t *testing.T) {
+	ok := REDCapMapping{
+		RecordID:       "patient_id",
+		Event:          &REDCapEvent{Column: "visit", Values: map[string]string{"D0": "baseline_arm_1"}},
+		RepeatInstance: "visit_no",
+		Fields:         map[string]string{"age": "age_years"},
+	}
+	if err := validateREDCapMappings(map[string]REDCapMapping{"study_a": ok}); err != nil {
+		t.Errorf("validateREDCapMappings() error = %v", err)
+	}
+	for name, bad := range map[string]REDCapMapping{
+		"no record id":      {Fields: map[string]string{"age": "age"}},
+		"no fields":         {RecordID: "id"},
+		"field name":        {RecordID: "id", Fields: map[string]string{"Age": "age"}},
+		"reserved field":    {RecordID: "id", Fields: map[string]string{"record_id": "id"}},
+		"event both":        {RecordID: "id", Event: &REDCapEvent{Name: "a_arm_1", Column: "visit"}, Fields: map[string]string{"age": "age"}},
+		"event values":      {RecordID: "id", Event: &REDCapEvent{Column: "visit"}, Fields: map[string]string{"age": "age"}},
+		"instrument alone":  {RecordID: "id", RepeatInstrument: "labs", Fields: map[string]string{"age": "age"}},
+		"instance no event": {RecordID: "id", RepeatInstance: "n", Fields: map[string]string{"age": "age"}},
+	} {
+		if err := validateREDCapMappings(map[string]REDCapMapping{"m": bad}); err == nil {
+			t.Errorf("%s: validateREDCapMappings() succeeded", name)
+		}
+	}
+}
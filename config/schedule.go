@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five-field cron expression: minute, hour, day of month, month and
+// day of week. Fields accept *, numbers, ranges (a-b), steps (*/n, a-b/n), lists and
+// English month and weekday abbreviations; @hourly, @daily, @weekly, @monthly and
+// @yearly are shorthands. As in cron, a day matches if either the day of month or the
+// day of week matches when both are restricted.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var scheduleShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+var (
+	monthNames   = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ParseSchedule parses a cron expression.
+func ParseSchedule(expr string) (Schedule, error) {
+	spec := strings.TrimSpace(expr)
+	if v, ok := scheduleShorthands[strings.ToLower(spec)]; ok {
+		spec = v
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return Schedule{}, fmt.Errorf("invalid schedule %q: expected 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	var s Schedule
+	var err error
+	parse := func(i, lo, hi int, names []string) uint64 {
+		if err != nil {
+			return 0
+		}
+		var bits uint64
+		bits, err = parseScheduleField(fields[i], lo, hi, names)
+		if err != nil {
+			err = fmt.Errorf("invalid schedule %q: %w", expr, err)
+		}
+		return bits
+	}
+	s.minute = parse(0, 0, 59, nil)
+	s.hour = parse(1, 0, 23, nil)
+	s.dom = parse(2, 1, 31, nil)
+	s.month = parse(3, 1, 12, monthNames)
+	s.dow = parse(4, 0, 7, weekdayNames)
+	if err != nil {
+		return Schedule{}, err
+	}
+	// 7 is Sunday too
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseScheduleField(field string, lo, hi int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+		start, end := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = scheduleValue(a, lo, hi, names); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = scheduleValue(b, lo, hi, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = hi
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func scheduleValue(s string, lo, hi int, names []string) (int, error) {
+	for i, n := range names {
+		if n != "" && strings.EqualFold(s, n) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < lo || v > hi {
+		return 0, fmt.Errorf("value %q out of range %d-%d", s, lo, hi)
+	}
+	return v, nil
+}
+
+// Next returns the first matching minute strictly after t, in t's location, or the zero
+// time if there is none within five years (e.g. "0 0 31 2 *").
+func (s Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case s.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	domOK := s.dom&(1<<uint(t.Day())) != 0
+	dowOK := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2026, 1, 30, 10, 17, 30, 0, time.UTC) // a Friday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2026, 1, 30, 10, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2026, 1, 31, 2, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 1, 30, 11, 0, 0, 0, time.UTC)},
+		{"30 6 * * mon-fri", time.Date(2026, 2, 2, 6, 30, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 7", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)}, // Sunday or the 15th
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q) error = %v", tt.expr, err)
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Next(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *", "0 0 * foo *"} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q) error = nil", expr)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Tenant is one group sharing the service. Requests authenticated with one of its API
+// keys are confined to its destinations, quotas and job history.
+type Tenant struct {
+	APIKeys []string `yaml:"api_keys" json:"-"`
+
+	// Database is the StarRocks database / BigQuery dataset the tenant writes to; tables
+	// qualified with any other database are rejected.
+	Database string `yaml:"database" json:"database,omitempty"`
+	// OutputPrefix is the GCS prefix Parquet exports must be written under; it is also
+	// the default output.
+	OutputPrefix string `yaml:"output_prefix" json:"output_prefix,omitempty"`
+	// AllowCreateDDL permits user-provided create_ddl, which could target any database.
+	AllowCreateDDL bool `yaml:"allow_create_ddl" json:"allow_create_ddl,omitempty"`
+	// ServiceAccounts are the service accounts the tenant's exports may impersonate
+	ServiceAccounts []string `yaml:"service_accounts" json:"service_accounts,omitempty"`
+
+	// RowFilter is a BigQuery condition every row the tenant reads from a table must
+	// satisfy, such as site_id IN ('A1', 'A2'). KeyRowFilters narrow it further for single
+	// API keys.
+	RowFilter     string            `yaml:"row_filter" json:"row_filter,omitempty"`
+	KeyRowFilters map[string]string `yaml:"key_row_filters" json:"-"`
+
+	// Role is the role of the tenant's keys within the tenant (default admin), KeyRoles
+	// that of single API keys.
+	Role     string            `yaml:"role" json:"role,omitempty"`
+	KeyRoles map[string]string `yaml:"key_roles" json:"-"`
+
+	// MaxConcurrentExports limits exports running at the same time (0 = unlimited)
+	MaxConcurrentExports int `yaml:"max_concurrent_exports" json:"max_concurrent_exports,omitempty"`
+	// MaxBytesPerQuery rejects queries whose dry-run estimate exceeds it (0 = unlimited)
+	MaxBytesPerQuery int64 `yaml:"max_bytes_per_query" json:"max_bytes_per_query,omitempty"`
+
+	// Quota limits the tenant's monthly usage across all its keys, KeyQuota the usage of
+	// each of its keys.
+	Quota    Quota `yaml:"quota" json:"quota"`
+	KeyQuota Quota `yaml:"key_quota" json:"key_quota"`
+}
+
+const (
+	// QuotaBlock rejects exports once a monthly limit is reached.
+	QuotaBlock = "block"
+	// QuotaWarn only logs a warning when a monthly limit is reached.
+	QuotaWarn = "warn"
+)
+
+// Quota is a monthly usage limit (calendar month, UTC). Zero limits are unlimited.
+type Quota struct {
+	MonthlyBytes int64 `yaml:"monthly_bytes" json:"monthly_bytes,omitempty"`
+	MonthlyRows  int64 `yaml:"monthly_rows" json:"monthly_rows,omitempty"`
+	// Enforcement is QuotaBlock (default) or QuotaWarn
+	Enforcement string `yaml:"enforcement" json:"enforcement,omitempty"`
+}
+
+// Block reports whether reaching the quota rejects exports.
+func (q Quota) Block() bool {
+	return q.Enforcement != QuotaWarn
+}
+
+// validateTenants checks tenant names and that every API key belongs to one tenant.
+func validateTenants(tenants map[string]Tenant) error {
+	owner := map[string]string{}
+	for name, t := range tenants {
+		if !pipelineNameRe.MatchString(name) {
+			return fmt.Errorf("invalid tenant name %q: use letters, digits, '_' or '-' (max 64)", name)
+		}
+		if len(t.APIKeys) == 0 {
+			return fmt.Errorf("tenant %q: at least one api key is required", name)
+		}
+		for _, k := range t.APIKeys {
+			if strings.TrimSpace(k) == "" {
+				return fmt.Errorf("tenant %q: empty api key", name)
+			}
+			if other, ok := owner[k]; ok && other != name {
+				return fmt.Errorf("tenants %q and %q share an api key", other, name)
+			}
+			owner[k] = name
+		}
+		if strings.ContainsAny(t.Database, "`; ") || strings.HasPrefix(t.Database, ".") || strings.HasSuffix(t.Database, ".") {
+			return fmt.Errorf("tenant %q: invalid database %q", name, t.Database)
+		}
+		for _, q := range []Quota{t.Quota, t.KeyQuota} {
+			if q.Enforcement != "" && q.Enforcement != QuotaBlock && q.Enforcement != QuotaWarn {
+				return fmt.Errorf("tenant %q: unknown quota enforcement %q; expected block or warn", name, q.Enforcement)
+			}
+		}
+		for _, sa := range t.ServiceAccounts {
+			if !strings.Contains(sa, "@") {
+				return fmt.Errorf("tenant %q: invalid service account %q", name, sa)
+			}
+		}
+		if t.OutputPrefix != "" && !strings.HasPrefix(t.OutputPrefix, "gs://") {
+			return fmt.Errorf("tenant %q: output_prefix must be a gs:// URI", name)
+		}
+		if err := validateRowFilter(t.RowFilter); err != nil {
+			return fmt.Errorf("tenant %q: row_filter: %w", name, err)
+		}
+		if err := validateRole(t.Role); err != nil {
+			return fmt.Errorf("tenant %q: %w", name, err)
+		}
+		for k, role := range t.KeyRoles {
+			if !slices.Contains(t.APIKeys, k) {
+				return fmt.Errorf("tenant %q: key_roles names a key that is not one of its api keys", name)
+			}
+			if role == "" {
+				return fmt.Errorf("tenant %q: empty key role", name)
+			}
+			if err := validateRole(role); err != nil {
+				return fmt.Errorf("tenant %q: key role: %w", name, err)
+			}
+		}
+		for k, f := range t.KeyRowFilters {
+			if !slices.Contains(t.APIKeys, k) {
+				return fmt.Errorf("tenant %q: key_row_filters names a key that is not one of its api keys", name)
+			}
+			if strings.TrimSpace(f) == "" {
+				return fmt.Errorf("tenant %q: empty key row filter", name)
+			}
+			if err := validateRowFilter(f); err != nil {
+				return fmt.Errorf("tenant %q: key row filter: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRowFilter rejects row filters that could end the condition they are placed in:
+// statement separators, comments and unbalanced parentheses or quotes.
+func validateRowFilter(f string) error {
+	depth := 0
+	var quote rune
+	for i, r := range f {
+		switch {
+		case quote != 0:
+			if r == '\\' {
+				return fmt.Errorf("escapes are not supported in row filter strings")
+			}
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == ';':
+			return fmt.Errorf("';' is not allowed")
+		case r == '#', strings.HasPrefix(f[i:], "--"), strings.HasPrefix(f[i:], "/*"):
+			return fmt.Errorf("comments are not allowed")
+		case r == '(':
+			depth++
+		case r == ')':
+			if depth--; depth < 0 {
+				return fmt.Errorf("unbalanced parentheses")
+			}
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("unterminated quote")
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced parentheses")
+	}
+	return nil
+}
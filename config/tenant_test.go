@@ -0,0 +1,27 @@
+package config
+
+import "testing"
+
+func TestValidateTenantRowFilters(t *testing.T) {
+	ok := Tenant{
+		APIKeys:       []string{"key-a1", "key-a2"},
+		RowFilter:     "site_id IN ('A1', 'A2') AND note != 'x;y'",
+		KeyRowFilters: map[string]string{"key-a2": "site_id = 'A2'"},
+	}
+	if err := validateTenants(map[string]Tenant{"a": ok}); err != nil {
+		t.Errorf("validateTenants() error = %v", err)
+	}
+	for name, bad := range map[string]Tenant{
+		"separator":   {RowFilter: "TRUE; DROP TABLE x"},
+		"comment":     {RowFilter: "site_id = 'A1' -- all"},
+		"parentheses": {RowFilter: "site_id = 'A1') OR (TRUE"},
+		"quote":       {RowFilter: "site_id = 'A1"},
+		"unknown key": {KeyRowFilters: map[string]string{"key-b": "site_id = 'B'"}},
+		"empty":       {KeyRowFilters: map[string]string{"key-a1": " "}},
+	} {
+		bad.APIKeys = []string{"key-a1"}
+		if err := validateTenants(map[string]Tenant{"a": bad}); err == nil {
+			t.Errorf("%s: validateTenants() succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package config
+
+// Transform is one step of the in-flight transforms applied to the rows of an export as
+// they pass through the service, in the order listed.
+type Transform struct {
+	// Type is rename, cast, mask or the name of a registered custom transformer
+	Type string `yaml:"type" json:"type"`
+	// Columns maps result columns to the argument of the transform: their new name
+	// (rename), their type (cast) or the number of trailing characters left unmasked (mask)
+	Columns map[string]string `yaml:"columns" json:"columns,omitempty"`
+	// Options are the settings of custom transformers
+	Options map[string]string `yaml:"options" json:"options,omitempty"`
+}
+
+// ComputedColumn is a destination column computed from the other columns of every row
+// by a CEL expression.
+type ComputedColumn struct {
+	Name string `yaml:"name" json:"name"`
+	// Type is STRING, INT64, FLOAT64, BOOL, BYTES, DATE or TIMESTAMP; when empty it is
+	// taken from the expression
+	Type       string `yaml:"type" json:"type,omitempty"`
+	Expression string `yaml:"expression" json:"expression"`
+}
@@ -0,0 +1,163 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Trace is the Cloud Trace span a request belongs to.
+type Trace struct {
+	ID      string
+	SpanID  string
+	Sampled bool
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context carrying the trace of a request.
+func WithTrace(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// TraceFrom returns the trace stored in ctx, if any.
+func TraceFrom(ctx context.Context) (Trace, bool) {
+	t, ok := ctx.Value(traceKey{}).(Trace)
+	return t, ok
+}
+
+var (
+	// cloudTraceHeader is X-Cloud-Trace-Context: TRACE_ID/SPAN_ID;o=OPTIONS, with a
+	// decimal span ID (logged in hex, like those of traceparent)
+	cloudTraceHeader = regexp.MustCompile(`^([0-9a-fA-F]{32})(?:/([0-9]+))?(?:;o=([0-9]+))?$`)
+	// traceparentHeader is the W3C traceparent: VERSION-TRACE_ID-SPAN_ID-FLAGS
+	traceparentHeader = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+)
+
+// ParseTrace reads the trace of a request from its traceparent header, or else its
+// X-Cloud-Trace-Context header, which Cloud Run sets on every request.
+func ParseTrace(traceparent, cloudTrace string) (Trace, bool) {
+	if m := traceparentHeader.FindStringSubmatch(strings.TrimSpace(traceparent)); m != nil && strings.Trim(m[1], "0") != "" {
+		return Trace{ID: m[1], SpanID: m[2], Sampled: m[3] == "01"}, true
+	}
+	if m := cloudTraceHeader.FindStringSubmatch(strings.TrimSpace(cloudTrace)); m != nil {
+		t := Trace{ID: strings.ToLower(m[1]), Sampled: m[3] == "1"}
+		if span, err := strconv.ParseUint(m[2], 10, 64); err == nil && span != 0 {
+			t.SpanID = fmt.Sprintf("%016x", span)
+		}
+		return t, true
+	}
+	return Trace{}, false
+}
+
+var traceProject atomic.Pointer[string]
+
+// SetTraceProject sets the project of the traces that Cloud Logging records link to;
+// until it is set, they carry no trace.
+func SetTraceProject(project string) {
+	traceProject.Store(&project)
+}
+
+// Fields of the Cloud Logging structured log format.
+const (
+	cloudTraceField   = "logging.googleapis.com/trace"
+	cloudSpanField    = "logging.googleapis.com/spanId"
+	cloudSampledField = "logging.googleapis.com/trace_sampled"
+	cloudLabelsField  = "logging.googleapis.com/labels"
+)
+
+// cloudAttr renames the level and message of records to the severity and message fields
+// of Cloud Logging.
+func cloudAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		a.Key = "severity"
+		switch level, _ := a.Value.Any().(slog.Level); {
+		case level >= slog.LevelError:
+			a.Value = slog.StringValue("ERROR")
+		case level >= slog.LevelWarn:
+			a.Value = slog.StringValue("WARNING")
+		case level >= slog.LevelInfo:
+			a.Value = slog.StringValue("INFO")
+		default:
+			a.Value = slog.StringValue("DEBUG")
+		}
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+	return a
+}
+
+// cloudHandler adds the trace of the record's context and its request ID, as a label, in
+// the fields Cloud Logging reads them from, so the logs of a request are grouped with it
+// in Cloud Logging and Cloud Trace. Cloud Logging only reads these fields at the top
+// level, so the groups of WithGroup (and the attributes added inside them) are kept here
+// and nested into the record's attributes on Handle instead of being opened on Handler.
+type cloudHandler struct {
+	slog.Handler
+	groups []cloudGroup
+}
+
+// cloudGroup is a group opened by WithGroup with the attributes added inside it.
+type cloudGroup struct {
+	name  string
+	attrs []slog.Attr
+}
+
+func (h *cloudHandler) Handle(ctx context.Context, r slog.Record) error {
+	var fields []slog.Attr
+	if t, ok := TraceFrom(ctx); ok {
+		if project := traceProject.Load(); project != nil && *project != "" {
+			fields = append(fields, slog.String(cloudTraceField, "projects/"+*project+"/traces/"+t.ID))
+			if t.SpanID != "" {
+				fields = append(fields, slog.String(cloudSpanField, t.SpanID))
+			}
+			fields = append(fields, slog.Bool(cloudSampledField, t.Sampled))
+		}
+	}
+	if id := RequestID(ctx); id != "" {
+		fields = append(fields, slog.Any(cloudLabelsField, map[string]string{"request_id": id}))
+	}
+	if len(h.groups) == 0 {
+		r.AddAttrs(fields...)
+		return h.Handler.Handle(ctx, r)
+	}
+	var attrs []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	for i := len(h.groups) - 1; i >= 0; i-- {
+		g := h.groups[i]
+		attrs = []slog.Attr{slog.GroupAttrs(g.name, append(slices.Clip(g.attrs), attrs...)...)}
+	}
+	nr := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	nr.AddAttrs(attrs...)
+	nr.AddAttrs(fields...)
+	return h.Handler.Handle(ctx, nr)
+}
+
+func (h *cloudHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(h.groups) == 0 {
+		return &cloudHandler{Handler: h.Handler.WithAttrs(attrs)}
+	}
+	groups := slices.Clone(h.groups)
+	last := &groups[len(groups)-1]
+	last.attrs = append(slices.Clip(last.attrs), attrs...)
+	return &cloudHandler{Handler: h.Handler, groups: groups}
+}
+
+func (h *cloudHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &cloudHandler{Handler: h.Handler, groups: append(slices.Clip(h.groups), cloudGroup{name: name})}
+}
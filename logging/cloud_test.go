@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestParseTrace(t *testing.T) {
+	const id = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		traceparent string
+		cloudTrace  string
+		want        Trace
+		wantOK      bool
+	}{
+		{"traceparent sampled", "00-" + id + "-00f067aa0ba902b7-01", "", Trace{ID: id, SpanID: "00f067aa0ba902b7", Sampled: true}, true},
+		{"traceparent not sampled", "00-" + id + "-00f067aa0ba902b7-00", "", Trace{ID: id, SpanID: "00f067aa0ba902b7"}, true},
+		{"traceparent preferred", "00-" + id + "-00f067aa0ba902b7-01", "0af7651916cd43dd8448eb211c80319c/1;o=0", Trace{ID: id, SpanID: "00f067aa0ba902b7", Sampled: true}, true},
+		{"zero traceparent falls back", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", id + "/1;o=1", Trace{ID: id, SpanID: "0000000000000001", Sampled: true}, true},
+		{"malformed traceparent falls back", "00-" + id + "-xyz-01", id, Trace{ID: id}, true},
+		// The decimal span ID is logged in hex
+		{"cloud trace", "", id + "/12345678901234567890;o=1", Trace{ID: id, SpanID: "ab54a98ceb1f0ad2", Sampled: true}, true},
+		{"cloud trace not sampled", "", id + "/16;o=0", Trace{ID: id, SpanID: "0000000000000010"}, true},
+		{"cloud trace without options", "", id + "/16", Trace{ID: id, SpanID: "0000000000000010"}, true},
+		{"cloud trace without span", "", id + ";o=1", Trace{ID: id, Sampled: true}, true},
+		{"cloud trace zero span", "", id + "/0;o=1", Trace{ID: id, Sampled: true}, true},
+		{"cloud trace upper case", "", "4BF92F3577B34DA6A3CE929D0E0E4736/1;o=1", Trace{ID: id, SpanID: "0000000000000001", Sampled: true}, true},
+		{"none", "", "", Trace{}, false},
+		{"malformed cloud trace", "", "not-a-trace/1;o=1", Trace{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseTrace(tt.traceparent, tt.cloudTrace)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("ParseTrace() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCloudHandlerGroups(t *testing.T) {
+	SetTraceProject("p")
+	t.Cleanup(func() { traceProject.Store(nil) })
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(&buf, Options{Format: "cloud"}))
+	ctx := WithTrace(WithRequestID(context.Background(), "req-1"), Trace{ID: "abc", SpanID: "00f067aa0ba902b7", Sampled: true})
+
+	logger.With("service", "exporter").WithGroup("export").With("pipeline", "visits").WithGroup("gcs").
+		InfoContext(ctx, "Exported", "files", 2)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("log is not JSON: %v: %s", err, buf.Bytes())
+	}
+	if got[cloudTraceField] != "projects/p/traces/abc" || got[cloudSpanField] != "00f067aa0ba902b7" || got[cloudSampledField] != true {
+		t.Errorf("trace fields not at the top level: %s", buf.Bytes())
+	}
+	if labels, _ := got[cloudLabelsField].(map[string]any); labels["request_id"] != "req-1" {
+		t.Errorf("labels not at the top level: %s", buf.Bytes())
+	}
+	if got["severity"] != "INFO" || got["message"] != "Exported" || got["service"] != "exporter" {
+		t.Errorf("top-level fields = %s", buf.Bytes())
+	}
+	export, _ := got["export"].(map[string]any)
+	gcs, _ := export["gcs"].(map[string]any)
+	if export["pipeline"] != "visits" || gcs["files"] != float64(2) {
+		t.Errorf("grouped attributes = %s", buf.Bytes())
+	}
+	if _, ok := export[cloudTraceField]; ok {
+		t.Errorf("trace nested in the group: %s", buf.Bytes())
+	}
+}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"scheduler_visits-2026-10-14", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"", false},
+		{"with space", false},
+		{"line\nbreak", false},
+		{"a/b", false},
+	}
+	for _, tt := range tests {
+		if got := ValidRequestID(tt.id); got != tt.want {
+			t.Errorf("ValidRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	a, b := NewRequestID(), NewRequestID()
+	if len(a) != 32 || !ValidRequestID(a) {
+		t.Errorf("NewRequestID() = %q, want 32 hex characters", a)
+	}
+	if a == b {
+		t.Errorf("NewRequestID() returned %q twice", a)
+	}
+}
+
+func TestContextHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewContextHandler(slog.NewTextHandler(&buf, nil))).With("service", "exporter")
+
+	logger.InfoContext(WithRequestID(context.Background(), "req-1"), "Export started")
+	logger.InfoContext(context.Background(), "Startup")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2: %s", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], "service=exporter request_id=req-1") {
+		t.Errorf("line with a request ID = %s", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("line without a request ID = %s", lines[1])
+	}
+}
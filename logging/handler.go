@@ -0,0 +1,135 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Redacted replaces the values of redacted attributes.
+const Redacted = "[REDACTED]"
+
+// Redactor is a redaction hook: it returns a, or a with its value masked. groups are the
+// groups a is nested in, as for slog.HandlerOptions.ReplaceAttr.
+type Redactor func(groups []string, a slog.Attr) slog.Attr
+
+// Options configure the handler of NewHandler.
+type Options struct {
+	// Format is "json" (default), "cloud", JSON in the structured format of Cloud Logging
+	// (see cloudHandler), or "text"
+	Format string
+	// Level is the minimum level logged (default info)
+	Level slog.Level
+	// SampleDebug keeps one in SampleDebug debug records of each message, such as the
+	// per-batch records of loads; 0 or 1 keeps them all
+	SampleDebug int
+	// RedactKeys are attribute keys whose values are always replaced with Redacted
+	RedactKeys []string
+	// Redactors run on every attribute, after RedactKeys
+	Redactors []Redactor
+}
+
+// OptionsFromEnv reads LOG_FORMAT, LOG_LEVEL, LOG_SAMPLE_DEBUG and LOG_REDACT_KEYS (comma
+// separated). Invalid values are reported along with the options of the valid ones.
+func OptionsFromEnv() (Options, error) {
+	var o Options
+	var errs []string
+	switch f := strings.ToLower(os.Getenv("LOG_FORMAT")); f {
+	case "", "json", "cloud", "text":
+		o.Format = f
+	default:
+		errs = append(errs, fmt.Sprintf("invalid LOG_FORMAT %q; expected json, cloud or text", f))
+	}
+	if l := os.Getenv("LOG_LEVEL"); l != "" {
+		if err := o.Level.UnmarshalText([]byte(l)); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid LOG_LEVEL %q; expected debug, info, warn or error", l))
+		}
+	}
+	if s := os.Getenv("LOG_SAMPLE_DEBUG"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			errs = append(errs, fmt.Sprintf("invalid LOG_SAMPLE_DEBUG %q; expected a number of records", s))
+		}
+		o.SampleDebug = n
+	}
+	o.RedactKeys = splitList(os.Getenv("LOG_REDACT_KEYS"))
+	if len(errs) > 0 {
+		return o, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return o, nil
+}
+
+// NewHandler returns the handler of the service's logs on w, as configured by o.
+func NewHandler(w io.Writer, o Options) slog.Handler {
+	opts := &slog.HandlerOptions{Level: o.Level}
+	redactors := o.Redactors
+	if o.Format == "cloud" {
+		redactors = append([]Redactor{cloudAttr}, redactors...)
+	}
+	if len(o.RedactKeys) > 0 || len(redactors) > 0 {
+		opts.ReplaceAttr = redact(o.RedactKeys, redactors)
+	}
+	var h slog.Handler
+	switch o.Format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "cloud":
+		h = &cloudHandler{Handler: slog.NewJSONHandler(w, opts)}
+	default:
+		h = slog.NewJSONHandler(w, opts)
+	}
+	if o.SampleDebug > 1 {
+		h = &samplingHandler{Handler: h, every: uint64(o.SampleDebug), counts: &sync.Map{}}
+	}
+	return h
+}
+
+func redact(keys []string, redactors []Redactor) func([]string, slog.Attr) slog.Attr {
+	masked := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		masked[k] = true
+	}
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if masked[a.Key] {
+			a.Value = slog.StringValue(Redacted)
+		}
+		for _, r := range redactors {
+			a = r(groups, a)
+		}
+		return a
+	}
+}
+
+// samplingHandler keeps the first and then every every-th debug record of each message,
+// with the rate as sample_every; records of other levels all pass.
+type samplingHandler struct {
+	slog.Handler
+	every  uint64
+	counts *sync.Map // message -> *atomic.Uint64
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelInfo {
+		return h.Handler.Handle(ctx, r)
+	}
+	c, _ := h.counts.LoadOrStore(r.Message, new(atomic.Uint64))
+	if (c.(*atomic.Uint64).Add(1)-1)%h.every != 0 {
+		return nil
+	}
+	r.AddAttrs(slog.Uint64("sample_every", h.every))
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), every: h.every, counts: h.counts}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), every: h.every, counts: h.counts}
+}
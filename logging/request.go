@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// RequestFields selects the request fields that request logs (such as "Received export
+// request") carry, so that queries with inline literals or sensitive output paths need
+// not end up verbatim in the logs.
+type RequestFields struct {
+	// Allow lists the fields logged; empty logs them all
+	Allow []string
+	// Redact lists fields logged as Redacted
+	Redact []string
+	// MaskLiterals replaces the string and number literals of logged queries with ?
+	MaskLiterals bool
+}
+
+// RequestFieldsFromEnv reads LOG_REQUEST_FIELDS (the allow-list) and LOG_REQUEST_REDACT,
+// both comma separated, and LOG_REQUEST_MASK_LITERALS.
+func RequestFieldsFromEnv() RequestFields {
+	var f RequestFields
+	f.Allow = splitList(os.Getenv("LOG_REQUEST_FIELDS"))
+	f.Redact = splitList(os.Getenv("LOG_REQUEST_REDACT"))
+	f.MaskLiterals, _ = strconv.ParseBool(os.Getenv("LOG_REQUEST_MASK_LITERALS"))
+	return f
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+var requestFields atomic.Pointer[RequestFields]
+
+// SetRequestFields installs the request fields of RequestAttrs and RequestURLQuery; by
+// default all fields are logged verbatim.
+func SetRequestFields(f RequestFields) {
+	requestFields.Store(&f)
+}
+
+// queryField is the request field holding SQL; the sql of an executed statement
+// (statementField) is logged like it.
+const (
+	queryField     = "query"
+	statementField = "sql"
+)
+
+// sqlLiteral matches the quoted strings (also triple-quoted, raw and bytes), numbers and
+// backquoted identifiers of GoogleSQL; identifiers are kept. Triple-quoted strings come
+// first, as they may contain single quotes.
+var sqlLiteral = regexp.MustCompile("`[^`]*`|" +
+	`(?i:[rb]{0,2})'''(?s:(?:[^\\]|\\.)*?)'''|(?i:[rb]{0,2})"""(?s:(?:[^\\]|\\.)*?)"""|` +
+	`(?i:[rb]{0,2})'(?:[^'\\]|\\.)*'|(?i:[rb]{0,2})"(?:[^"\\]|\\.)*"|` +
+	`\b\d+(?:\.\d+)?(?:[eE][+-]?\d+)?\b`)
+
+// MaskLiterals replaces the literals of query with ?.
+func MaskLiterals(query string) string {
+	return sqlLiteral.ReplaceAllStringFunc(query, func(m string) string {
+		if strings.HasPrefix(m, "`") {
+			return m
+		}
+		return "?"
+	})
+}
+
+// field returns how the request field key is logged: dropped, or with value v replaced.
+func (f *RequestFields) field(key string, v any) (any, bool) {
+	if key == statementField {
+		key = queryField
+	}
+	if len(f.Allow) > 0 && !slices.Contains(f.Allow, key) {
+		return nil, false
+	}
+	if slices.Contains(f.Redact, key) {
+		return Redacted, true
+	}
+	if s, ok := v.(string); ok && key == queryField && f.MaskLiterals {
+		return MaskLiterals(s), true
+	}
+	return v, true
+}
+
+// RequestAttrs filters the key-value pairs of a request log (as passed to slog) with the
+// installed RequestFields.
+func RequestAttrs(args ...any) []any {
+	f := requestFields.Load()
+	if f == nil {
+		return args
+	}
+	out := make([]any, 0, len(args))
+	for i := 0; i+1 < len(args); i += 2 {
+		key, _ := args[i].(string)
+		if v, ok := f.field(key, args[i+1]); ok {
+			out = append(out, key, v)
+		}
+	}
+	return out
+}
+
+// RequestURLQuery filters the parameters of a raw URL query, such as the query of
+// GET /api/download, with the installed RequestFields.
+func RequestURLQuery(raw string) string {
+	f := requestFields.Load()
+	if f == nil || raw == "" {
+		return raw
+	}
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return Redacted
+	}
+	for key, vs := range values {
+		for i, v := range vs {
+			nv, ok := f.field(key, v)
+			if !ok {
+				delete(values, key)
+				break
+			}
+			vs[i], _ = nv.(string)
+		}
+	}
+	return values.Encode()
+}
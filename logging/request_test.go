@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// setRequestFields installs f for the duration of the test.
+func setRequestFields(t *testing.T, f RequestFields) {
+	t.Helper()
+	SetRequestFields(f)
+	t.Cleanup(func() { requestFields.Store(nil) })
+}
+
+func TestMaskLiterals(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"string", "SELECT * FROM t WHERE name = 'alice'", "SELECT * FROM t WHERE name = ?"},
+		{"double quoted", `SELECT * FROM t WHERE name = "alice"`, "SELECT * FROM t WHERE name = ?"},
+		{"escaped single quote", `SELECT 'it\'s' AS a, 'x'`, "SELECT ? AS a, ?"},
+		{"escaped double quote", `SELECT "a\"b" AS a, "c\\" AS b`, "SELECT ? AS a, ? AS b"},
+		{"raw", `SELECT r'\d+' AS a, R"\w" AS b`, "SELECT ? AS a, ? AS b"},
+		{"bytes", `SELECT b'abc' AS a, B"\x00" AS b, rb'\x' AS c, BR"y" AS d`, "SELECT ? AS a, ? AS b, ? AS c, ? AS d"},
+		{"triple quoted", "SELECT '''it's''' AS a, \"\"\"multi\n\"line\"\n\"\"\" AS b", "SELECT ? AS a, ? AS b"},
+		{"raw triple quoted", `SELECT r'''a'b''' AS a`, "SELECT ? AS a"},
+		{"numbers", "SELECT * FROM t WHERE id = 42 AND score > 1.5e3", "SELECT * FROM t WHERE id = ? AND score > ?"},
+		{"identifiers kept", "SELECT `it's`, `x y` FROM `p.d.t2` WHERE c1 = 'v'", "SELECT `it's`, `x y` FROM `p.d.t2` WHERE c1 = ?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaskLiterals(tt.query); got != tt.want {
+				t.Errorf("MaskLiterals() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestAttrs(t *testing.T) {
+	args := []any{"pipeline", "visits", "query", "SELECT 'secret'", "output", "gs://b/out/"}
+	tests := []struct {
+		name   string
+		fields *RequestFields
+		args   []any
+		want   []any
+	}{
+		{"not installed", nil, args, args},
+		{"no policy", &RequestFields{}, args, args},
+		{"allow-list", &RequestFields{Allow: []string{"pipeline", "query"}}, args, []any{"pipeline", "visits", "query", "SELECT 'secret'"}},
+		{"redact", &RequestFields{Redact: []string{"output"}}, args, []any{"pipeline", "visits", "query", "SELECT 'secret'", "output", Redacted}},
+		{"allow-list and redact", &RequestFields{Allow: []string{"pipeline", "output"}, Redact: []string{"output", "query"}}, args, []any{"pipeline", "visits", "output", Redacted}},
+		{"mask", &RequestFields{MaskLiterals: true}, args, []any{"pipeline", "visits", "query", "SELECT ?", "output", "gs://b/out/"}},
+		{"redact wins over mask", &RequestFields{Redact: []string{"query"}, MaskLiterals: true}, args, []any{"pipeline", "visits", "query", Redacted, "output", "gs://b/out/"}},
+		// The sql of executed statements follows the query policy
+		{"statement masked", &RequestFields{MaskLiterals: true}, []any{"sql", "DELETE FROM t WHERE id = 7"}, []any{"sql", "DELETE FROM t WHERE id = ?"}},
+		{"statement allowed as query", &RequestFields{Allow: []string{"query"}}, []any{"sql", "SELECT 1"}, []any{"sql", "SELECT 1"}},
+		{"statement redacted as query", &RequestFields{Redact: []string{"query"}}, []any{"sql", "SELECT 1"}, []any{"sql", Redacted}},
+		{"statement dropped", &RequestFields{Allow: []string{"pipeline"}}, []any{"sql", "SELECT 1"}, []any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.fields != nil {
+				setRequestFields(t, *tt.fields)
+			}
+			if got := RequestAttrs(tt.args...); !slices.Equal(got, tt.want) {
+				t.Errorf("RequestAttrs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestURLQuery(t *testing.T) {
+	raw := "name=visits&query=SELECT+%27secret%27&output=gs%3A%2F%2Fb%2Fout%2F"
+	tests := []struct {
+		name   string
+		fields *RequestFields
+		raw    string
+		want   url.Values
+	}{
+		{"not installed", nil, raw, url.Values{"name": {"visits"}, "query": {"SELECT 'secret'"}, "output": {"gs://b/out/"}}},
+		{"allow-list", &RequestFields{Allow: []string{"name"}}, raw, url.Values{"name": {"visits"}}},
+		{"allow-list and redact", &RequestFields{Allow: []string{"name", "output"}, Redact: []string{"output"}}, raw, url.Values{"name": {"visits"}, "output": {Redacted}}},
+		{"mask", &RequestFields{MaskLiterals: true}, raw, url.Values{"name": {"visits"}, "query": {"SELECT ?"}, "output": {"gs://b/out/"}}},
+		{"repeated", &RequestFields{Redact: []string{"name"}}, "name=a&name=b", url.Values{"name": {Redacted, Redacted}}},
+		{"empty", &RequestFields{Allow: []string{"name"}}, "", url.Values{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.fields != nil {
+				setRequestFields(t, *tt.fields)
+			}
+			got, err := url.ParseQuery(RequestURLQuery(tt.raw))
+			if err != nil {
+				t.Fatalf("RequestURLQuery() is not a URL query: %v", err)
+			}
+			if got.Encode() != tt.want.Encode() {
+				t.Errorf("RequestURLQuery() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unparsable", func(t *testing.T) {
+		setRequestFields(t, RequestFields{Allow: []string{"name"}})
+		if got := RequestURLQuery("name=%zz"); got != Redacted {
+			t.Errorf("RequestURLQuery() = %q, want %q", got, Redacted)
+		}
+	})
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"bq-exporter/api"
+	"bq-exporter/config"
+	"bq-exporter/logging"
 	"bq-exporter/service"
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -17,31 +24,121 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
 )
 
 func main() {
-	// Initialize structured logging (JSON format for Cloud Run)
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	// Load environment variables
+	envErr := godotenv.Load()
+
+	// Validate mode prints its report on stdout, so logs go to stderr there
+	validateMode := os.Getenv("RUN_MODE") == "validate" || (len(os.Args) > 1 && os.Args[1] == "validate")
+	logOut := os.Stdout
+	if validateMode {
+		logOut = os.Stderr
+	}
+
+	// Initialize structured logging (JSON format for Cloud Run, unless LOG_FORMAT says otherwise)
+	logOpts, logErr := logging.OptionsFromEnv()
+	logger := slog.New(logging.NewContextHandler(logging.NewHandler(logOut, logOpts)))
 	slog.SetDefault(logger)
 
-	// Load environment variables
-	if err := godotenv.Load(); err != nil {
+	// Job mode: execute once and exit (for Cloud Run Jobs). The result file and exit code
+	// tell the orchestrator why a run failed, including failures to start
+	jobMode := os.Getenv("RUN_MODE") == "job"
+	started := time.Now()
+	jobID := os.Getenv("CLOUD_RUN_EXECUTION")
+	if !logging.ValidRequestID(jobID) {
+		jobID = logging.NewRequestID()
+	}
+	resultFile := os.Getenv("JOB_RESULT_FILE")
+	req := api.ExportRequest{Pipeline: os.Getenv("JOB_PIPELINE")}
+	var shard service.TaskShard
+	// Results written to gs:// need the Cloud Storage client, created below
+	var gcsService *service.GCSService
+	ctx := context.Background()
+	finish := func(res service.ExportResult, err error) int {
+		r := service.NewJobResult(jobID, started, res, err)
+		r.Pipeline = req.Pipeline
+		if shard.Count > 0 {
+			r.TaskIndex, r.TaskCount = shard.Index, shard.Count
+		}
+		if resultFile != "" {
+			if werr := service.WriteJobResult(ctx, resultFile, r, gcsService); werr != nil {
+				slog.Error("Failed to write job result", "destination", resultFile, "error", werr)
+				if r.ExitCode == service.ExitOK {
+					r.ExitCode = service.ExitOther
+				}
+			}
+		}
+		return r.ExitCode
+	}
+	// fatal logs why the service cannot start and exits with the code of the failure
+	// class; in job mode the result file records it too
+	fatal := func(msg string, err error) {
+		slog.Error(msg, "error", err)
+		if jobMode {
+			os.Exit(finish(service.ExportResult{}, err))
+		}
+		os.Exit(service.ExitCode(err))
+	}
+
+	if logErr != nil {
+		fatal("Invalid logging configuration", service.ConfigError(logErr))
+	}
+	logging.SetRequestFields(logging.RequestFieldsFromEnv())
+
+	if envErr != nil {
 		slog.Info("No .env file found, using system environment variables")
 	}
 
-	ctx := context.Background()
+	// Timeouts and proxies of every outbound HTTP call, before any client is created
+	httpOpts, err := service.HTTPOptionsFromEnv()
+	if err != nil {
+		fatal("Invalid outbound HTTP configuration", err)
+	}
+	service.ConfigureHTTP(httpOpts)
+
+	// Validate mode: check configuration and connectivity, print a structured report and exit (for CI)
+	if validateMode {
+		report := service.ValidateConfig(ctx)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			slog.Error("Failed to write validation report", "error", err)
+			os.Exit(1)
+		}
+		if !report.OK {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Explicitly configured credentials (key JSON, Secret Manager or workload identity
+	// federation); nil means ADC
+	explicitCreds, err := service.CredentialsFromEnv(ctx)
+	if err != nil {
+		fatal("Failed to load credentials", err)
+	}
+	var clientOpts []option.ClientOption
+	if explicitCreds != nil {
+		clientOpts = append(clientOpts, option.WithCredentials(explicitCreds))
+	}
 
 	projectID := os.Getenv("GCP_PROJECT_ID")
+	if projectID == "" && explicitCreds != nil {
+		if projectID = explicitCreds.ProjectID; projectID == "" {
+			fatal("Missing project", service.ConfigError(errors.New("GCP_PROJECT_ID is required: the configured credentials carry no project")))
+		}
+	}
 	if projectID == "" {
 		slog.Info("GCP_PROJECT_ID not set, attempting to detect from credentials...")
 		creds, err := google.FindDefaultCredentials(ctx, bigquery.Scope)
 		if err != nil {
-			slog.Error("Failed to find default credentials", "error", err)
-			os.Exit(1)
+			fatal("Failed to find default credentials", service.ConfigError(err))
 		}
 		if creds.ProjectID == "" {
-			slog.Error("GCP_PROJECT_ID is not set and could not be detected from credentials")
-			os.Exit(1)
+			fatal("Missing project", service.ConfigError(errors.New("GCP_PROJECT_ID is not set and could not be detected from credentials")))
 		}
 		projectID = creds.ProjectID
 		slog.Info("Detected Project ID", "project_id", projectID)
@@ -53,75 +150,338 @@ func main() {
 			slog.Info("Credentials found", "type", "default")
 		}
 	}
+	// Request logs link to their traces in this project (with LOG_FORMAT=cloud)
+	logging.SetTraceProject(cmp.Or(os.Getenv("LOG_TRACE_PROJECT"), projectID))
 
 	// Debug: Check if we can reach Google APIs before creating BigQuery client
 	slog.Info("Testing network connectivity to Google APIs...")
-	netTransport := &http.Transport{}
-	netClient := &http.Client{Transport: netTransport, Timeout: 10 * time.Second}
-	_, err := netClient.Get("https://bigquery.googleapis.com/")
+	netClient := &http.Client{Timeout: 10 * time.Second}
+	_, err = netClient.Get("https://bigquery.googleapis.com/")
 	if err != nil {
 		slog.Error("Cannot reach BigQuery API - network issue detected", "error", err)
 	} else {
 		slog.Info("Network connectivity to BigQuery API OK")
 	}
 
+	// Load optional configuration file (destination defaults)
+	cfg, err := config.FromEnv()
+	if err != nil {
+		fatal("Failed to load configuration", service.ConfigError(err))
+	}
 	// Initialize BigQuery Service
-	bqService, err := service.NewBigQueryService(ctx, projectID)
+	bqService, err := service.NewBigQueryService(ctx, projectID, clientOpts...)
 	if err != nil {
-		slog.Error("Failed to initialize BigQuery service", "error", err)
-		os.Exit(1)
+		fatal("Failed to initialize BigQuery service", err)
 	}
 	defer bqService.Close()
 
+	// Cloud Storage serves the GCS and BigQuery drivers and workbook exports
+	gcsService, err = service.NewGCSService(ctx, clientOpts...)
+	if err != nil {
+		fatal("Failed to initialize Cloud Storage service", err)
+	}
+	gcsService.AutoCreate = service.BucketCreationFromEnv(projectID)
+
+	// Table locks and schedules span the instances sharing a coordinator
+	coordinator, err := service.NewCoordinatorFromEnv(ctx)
+	if err != nil {
+		fatal("Failed to initialize coordination", err)
+	}
+	defer coordinator.Close()
+
+	// Exports failing partway leave debris for the cleanups to remove, on the clients of
+	// their driver
+	instance := service.NewInstance(coordinator)
+	cleanups := service.NewCleanups(instance)
+	cleanups.GCS, cleanups.BQ = gcsService, bqService
+
 	// Initialize driver
 	var driver service.ExportDriver
-	if os.Getenv("EXPORT_DRIVER") == "STARROCKS" {
+	switch os.Getenv("EXPORT_DRIVER") {
+	case "STARROCKS":
 		srService, err := service.NewStarRocksServiceFromEnv()
 		if err != nil {
-			slog.Error("Failed to initialize StarRocks service", "error", err)
-			os.Exit(1)
+			fatal("Failed to initialize StarRocks service", err)
 		}
 		defer srService.Close()
-		driver = service.NewStarRocksDriver(srService)
-	} else {
-		driver = service.NewGCSDriver()
+		cleanups.StarRocks = srService
+		driver = service.NewStarRocksDriver(srService, coordinator)
+	case "BIGQUERY":
+		driver = service.NewBigQueryTableDriver(gcsService, service.ParseStagingBuckets(os.Getenv("GCS_STAGING_BUCKETS")))
+	case "REDIS":
+		redisDriver, err := service.NewRedisDriverFromEnv(ctx)
+		if err != nil {
+			fatal("Failed to initialize Redis driver", err)
+		}
+		defer redisDriver.Close()
+		driver = redisDriver
+	case "SPANNER":
+		spService, err := service.NewSpannerService(ctx, os.Getenv("SPANNER_DATABASE"), clientOpts...)
+		if err != nil {
+			fatal("Failed to initialize Spanner service", err)
+		}
+		defer spService.Close()
+		driver = service.NewSpannerDriver(spService)
+	case "FIRESTORE":
+		fsService, err := service.NewFirestoreService(ctx, cmp.Or(os.Getenv("FIRESTORE_PROJECT_ID"), projectID), os.Getenv("FIRESTORE_DATABASE"), clientOpts...)
+		if err != nil {
+			fatal("Failed to initialize Firestore service", err)
+		}
+		defer fsService.Close()
+		driver = service.NewFirestoreDriver(fsService)
+	case "HTTP_POST":
+		driver, err = service.NewHTTPPostDriverFromEnv()
+		if err != nil {
+			fatal("Failed to initialize HTTP POST driver", err)
+		}
+	case "GOOGLE_DRIVE":
+		driveService, err := service.NewDriveServiceFromEnv(ctx, clientOpts...)
+		if err != nil {
+			fatal("Failed to initialize Google Drive service", err)
+		}
+		driver = service.NewGoogleDriveDriver(driveService)
+	case "AZURE_BLOB":
+		blobService, err := service.NewAzureBlobServiceFromEnv()
+		if err != nil {
+			fatal("Failed to initialize Azure Blob Storage service", err)
+		}
+		driver = service.NewAzureBlobDriver(gcsService, blobService, service.ParseStagingBuckets(os.Getenv("GCS_STAGING_BUCKETS")))
+	case "SQLITE":
+		driver = service.NewSQLiteDriver(gcsService)
+	case "GCS_PARQUET_WRITE":
+		if err := bqService.EnableStorageRead(ctx, clientOpts...); err != nil {
+			slog.Warn("Reading results through the REST API", "error", err)
+		}
+		driver = service.NewParquetWriteDriver(gcsService)
+	default:
+		driver = service.NewGCSDriver(gcsService, service.ParseStagingBuckets(os.Getenv("GCS_STAGING_BUCKETS")))
 	}
+	// The build reports the driver built, GCS_PARQUET when EXPORT_DRIVER is unset
+	buildInfo := service.ReadBuildInfo(driver.Name(), cfg.Fingerprint(), cfg.Environment)
+	slog.Info("Build", "version", buildInfo.Version, "commit", buildInfo.Commit, "build_time", buildInfo.BuildTime,
+		"driver", buildInfo.Driver, "config_fingerprint", buildInfo.ConfigFingerprint)
 
-	// Job mode: execute once and exit (for Cloud Run Jobs)
-	if os.Getenv("RUN_MODE") == "job" {
-		req := api.ExportRequest{}
+	exporter := service.NewExporter(bqService, driver, cfg)
+	exporter.GCS = gcsService
+	exporter.ReadSecret = service.NewSecretReader(clientOpts...)
+	exporter.Coordinator = coordinator
+	if err := instance.Start(ctx); err != nil {
+		fatal("Failed to register the instance", service.TransientError(err))
+	}
+	defer instance.Close()
+	exporter.Instance, exporter.Cleanups = instance, cleanups
+	if exporter.OrphanPolicy, err = service.OrphanPolicyFromEnv(); err != nil {
+		fatal("Failed to configure orphaned job recovery", err)
+	}
+	exporter.Impersonator = service.NewImpersonator(projectID, clientOpts...)
+	exporter.Impersonator.StorageRead = driver.Name() == "GCS_PARQUET_WRITE"
+	defer exporter.Impersonator.Close()
+	if exporter.Usage, err = service.NewUsageStoreFromEnv(); err != nil {
+		fatal("Failed to load usage accounting", err)
+	}
+	if exporter.Jobs, err = service.NewJobStoreFromEnv(ctx); err != nil {
+		fatal("Failed to initialize the job store", err)
+	}
+	defer exporter.Jobs.Close()
+	exporter.Jobs.Instance = instance.ID
+	if exporter.Notifier, err = service.NewNotifierFromEnv(); err != nil {
+		fatal("Failed to configure webhook notifications", err)
+	}
+	if exporter.Lineage, err = service.NewLineageEmitterFromEnv(ctx, projectID, clientOpts...); err != nil {
+		fatal("Failed to configure lineage reporting", err)
+	}
+	// A job exits before the retries of requeued runs could finish
+	if jobMode {
+		exporter.OrphanPolicy = service.OrphanFail
+	}
+	// Debris and runs left behind by instances that stopped, this one's predecessor too
+	exporter.RecoverInBackground(ctx)
+
+	if jobMode {
 		req.Query = os.Getenv("JOB_QUERY")
 		req.QueryLocation = os.Getenv("JOB_QUERY_LOCATION")
+		req.SnapshotTime = os.Getenv("JOB_SNAPSHOT_TIME")
 		req.Table = os.Getenv("JOB_TABLE")
 		req.Database = os.Getenv("JOB_DATABASE")
 		req.Output = os.Getenv("JOB_OUTPUT")
 		req.Filename = os.Getenv("JOB_FILENAME")
+		req.Format = os.Getenv("JOB_FORMAT")
+		req.CSVHeader = os.Getenv("JOB_CSV_HEADER")
+		req.CSVDelimiter = os.Getenv("JOB_CSV_DELIMITER")
+		req.CSVBOM, _ = strconv.ParseBool(os.Getenv("JOB_CSV_BOM"))
+		req.SchemaFile, _ = strconv.ParseBool(os.Getenv("JOB_SCHEMA_FILE"))
+		req.ResolveSingleFile, _ = strconv.ParseBool(os.Getenv("JOB_RESOLVE_SINGLE_FILE"))
+		req.FHIRMapping = os.Getenv("JOB_FHIR_MAPPING")
+		req.REDCapMapping = os.Getenv("JOB_REDCAP_MAPPING")
+		req.RowGroupRows, _ = strconv.Atoi(os.Getenv("JOB_ROW_GROUP_ROWS"))
+		req.MaxFileRows, _ = strconv.ParseInt(os.Getenv("JOB_MAX_FILE_ROWS"), 10, 64)
+		req.ParquetTimestamp = os.Getenv("JOB_PARQUET_TIMESTAMP")
+		req.ParquetDecimal = os.Getenv("JOB_PARQUET_DECIMAL")
+		req.ParquetString = os.Getenv("JOB_PARQUET_STRING")
+		req.RedisType = os.Getenv("JOB_REDIS_TYPE")
+		req.RedisTTL = os.Getenv("JOB_REDIS_TTL")
 		req.CreateDDL = os.Getenv("JOB_CREATE_DDL")
-		ut := strings.ToLower(os.Getenv("JOB_USE_TIMESTAMP"))
-		req.UseTimestamp = ut == "true" || ut == "1" || ut == "yes"
-		if req.Query == "" || req.QueryLocation == "" {
-			slog.Error("JOB_QUERY or JOB_QUERY_LOCATION is empty")
-			os.Exit(1)
+		if v := os.Getenv("JOB_LABELS"); v != "" {
+			req.Labels = map[string]string{}
+			for _, kv := range strings.Split(v, ",") {
+				k, v, _ := strings.Cut(kv, "=")
+				req.Labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+		req.Description = os.Getenv("JOB_DESCRIPTION")
+		req.ImpersonateServiceAccount = os.Getenv("JOB_IMPERSONATE_SERVICE_ACCOUNT")
+		req.WriteMode = os.Getenv("JOB_WRITE_MODE")
+		if v := os.Getenv("JOB_KEY_COLUMNS"); v != "" {
+			for _, k := range strings.Split(v, ",") {
+				req.KeyColumns = append(req.KeyColumns, strings.TrimSpace(k))
+			}
+		}
+		req.DestinationLocation = os.Getenv("JOB_DESTINATION_LOCATION")
+		req.DiffSnapshot = os.Getenv("JOB_DIFF_SNAPSHOT")
+		req.ChangesTable = os.Getenv("JOB_CHANGES_TABLE")
+		req.ChangesMode = os.Getenv("JOB_CHANGES_MODE")
+		if v := os.Getenv("JOB_DEDUP_COLUMNS"); v != "" {
+			for _, k := range strings.Split(v, ",") {
+				req.DedupColumns = append(req.DedupColumns, strings.TrimSpace(k))
+			}
+		}
+		req.DedupOrderBy = os.Getenv("JOB_DEDUP_ORDER_BY")
+		req.DedupKeep = os.Getenv("JOB_DEDUP_KEEP")
+		req.DeidProfile = os.Getenv("JOB_DEID_PROFILE")
+		if ut := strings.ToLower(os.Getenv("JOB_USE_TIMESTAMP")); ut != "" {
+			useTimestamp := ut == "true" || ut == "1" || ut == "yes"
+			req.UseTimestamp = &useTimestamp
+		}
+		req.Name = os.Getenv("JOB_NAME")
+		if n, err := strconv.Atoi(os.Getenv("JOB_REPLICATION_NUM")); err == nil {
+			req.ReplicationNum = n
+		}
+		req.LoadStrategy = os.Getenv("JOB_LOAD_STRATEGY")
+		req.ColumnNames = os.Getenv("JOB_COLUMN_NAMES")
+		req.ColumnCase = os.Getenv("JOB_COLUMN_CASE")
+		req.StringType = os.Getenv("JOB_STRING_TYPE")
+		req.Verify, _ = strconv.ParseBool(os.Getenv("JOB_VERIFY"))
+		if v, err := strconv.ParseBool(os.Getenv("JOB_ALLOW_SCHEMA_CHANGES")); err == nil {
+			req.AllowSchemaChanges = &v
+		}
+		req.LineageColumns, _ = strconv.ParseBool(os.Getenv("JOB_LINEAGE_COLUMNS"))
+		req.DeleteColumn = os.Getenv("JOB_DELETE_COLUMN")
+		if v := os.Getenv("JOB_DELETE_VALUES"); v != "" {
+			for _, dv := range strings.Split(v, ",") {
+				req.DeleteValues = append(req.DeleteValues, strings.TrimSpace(dv))
+			}
+		}
+		req.Debug, _ = strconv.ParseBool(os.Getenv("JOB_DEBUG"))
+		req.Limit, _ = strconv.ParseInt(os.Getenv("JOB_LIMIT"), 10, 64)
+		req.SamplePercent, _ = strconv.ParseFloat(os.Getenv("JOB_SAMPLE_PERCENT"), 64)
+		if v := os.Getenv("JOB_TRANSFORMS"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Transforms); err != nil {
+				slog.Error("Invalid JOB_TRANSFORMS", "error", err)
+				os.Exit(finish(service.ExportResult{}, service.ConfigError(fmt.Errorf("invalid JOB_TRANSFORMS: %w", err))))
+			}
+		}
+		if v := os.Getenv("JOB_COMPUTED_COLUMNS"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.ComputedColumns); err != nil {
+				slog.Error("Invalid JOB_COMPUTED_COLUMNS", "error", err)
+				os.Exit(finish(service.ExportResult{}, service.ConfigError(fmt.Errorf("invalid JOB_COMPUTED_COLUMNS: %w", err))))
+			}
+		}
+		req.Parameters = service.ParseParameters(os.Getenv("JOB_PARAMETERS"))
+		if req.Query == "" && req.Pipeline == "" && req.ChangesTable == "" {
+			err := errors.New("JOB_QUERY, JOB_CHANGES_TABLE or JOB_PIPELINE is required")
+			slog.Error(err.Error())
+			os.Exit(finish(service.ExportResult{}, service.ConfigError(err)))
+		}
+		// SIGTERM (e.g. Cloud Run Job cancellation) cancels the BigQuery job and rolls back the load
+		jobCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		jobCtx = logging.WithRequestID(jobCtx, jobID)
+		if name := os.Getenv("JOB_TENANT"); name != "" {
+			t, ok := cfg.Tenants[name]
+			if !ok {
+				slog.Error("Unknown JOB_TENANT", "tenant", name)
+				os.Exit(finish(service.ExportResult{}, service.ConfigError(fmt.Errorf("unknown JOB_TENANT %q", name))))
+			}
+			jobCtx = service.WithTenant(jobCtx, name, t)
+		}
+		if shard, err = service.TaskShardFromEnv(); err != nil {
+			slog.Error("Invalid job sharding", "error", err)
+			os.Exit(finish(service.ExportResult{}, service.ConfigError(err)))
+		}
+		var res service.ExportResult
+		switch {
+		case shard.Enabled():
+			res, err = exporter.RunShard(jobCtx, shard, req.Pipeline, req.Params(), req.Parameters)
+		case req.Pipeline != "":
+			res, err = exporter.RunPipeline(jobCtx, req.Pipeline, req.Params(), req.Parameters)
+		default:
+			res, err = exporter.Run(jobCtx, req.Params())
+		}
+		// The job exits once done: deliver the lineage reported in the background first
+		exporter.Lineage.Wait(context.WithoutCancel(jobCtx))
+		for _, s := range res.Statements {
+			// The statement SQL is filtered like the query of a request
+			attrs := append([]any{"kind", s.Kind, "count", s.Count, "rows", s.Rows}, logging.RequestAttrs("sql", s.SQL)...)
+			slog.InfoContext(jobCtx, "Executed statement", attrs...)
 		}
-		params := service.ExportParams{
-			Query:         req.Query,
-			Output:        req.Output,
-			Filename:      req.Filename,
-			QueryLocation: req.QueryLocation,
-			UseTimestamp:  req.UseTimestamp,
-			Table:         req.Table,
-			Database:      req.Database,
-			CreateDDL:     req.CreateDDL,
-		}
-		res, err := driver.Execute(ctx, bqService, params)
 		if err != nil {
-			slog.Error("Job execution failed", "error", err)
-			os.Exit(1)
+			slog.ErrorContext(jobCtx, "Job execution failed", "error", err, "failure", service.FailureClass(err), "bigquery_job_url", res.Job.ConsoleURL())
+		} else {
+			slog.InfoContext(jobCtx, "Job execution completed", "gcs_path", res.GCSPath, "table", res.Table, "rows", res.Rows,
+				"rows_deleted", res.RowsDeleted, "column_mapping", res.ColumnMapping, "destination_rows", res.DestinationRows, "bigquery_job_id", res.Job.ID, "bigquery_job_url", res.Job.ConsoleURL())
+		}
+		if code := finish(res, err); code != service.ExitOK {
+			os.Exit(code)
 		}
-		slog.Info("Job execution completed", "gcs_path", res.GCSPath, "table", res.Table, "rows", res.Rows)
 		return
 	}
 
+	// Pre-flight: fail fast on broken credentials or unreachable destinations
+	if preflight, _ := strconv.ParseBool(os.Getenv("PREFLIGHT")); preflight {
+		pfCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		report := exporter.Preflight(pfCtx)
+		cancel()
+		for _, c := range report.Checks {
+			if c.Status == service.CheckFail {
+				slog.Error("Pre-flight check failed", "check", c.Name, "detail", c.Detail)
+			} else {
+				slog.Info("Pre-flight check", "check", c.Name, "status", c.Status, "detail", c.Detail)
+			}
+		}
+		if !report.OK {
+			os.Exit(1)
+		}
+	}
+
+	scheduler, err := service.NewSchedulerFromEnv(exporter, cfg.Tenants)
+	if err != nil {
+		slog.Error("Failed to initialize scheduler", "error", err)
+		os.Exit(1)
+	}
+	schedCtx, stopScheduler := context.WithCancel(ctx)
+	schedDone := make(chan struct{})
+	if enabled, _ := strconv.ParseBool(os.Getenv("SCHEDULER_ENABLED")); enabled {
+		go func() {
+			defer close(schedDone)
+			scheduler.Run(schedCtx)
+		}()
+	} else {
+		close(schedDone)
+	}
+	freshness := service.NewFreshnessMonitor(exporter)
+	if enabled, _ := strconv.ParseBool(os.Getenv("FRESHNESS_MONITOR_ENABLED")); enabled {
+		go freshness.Run(schedCtx)
+	}
+	discoverer := service.NewDiscoverer(exporter, cfg.Discoveries, cfg.Tenants)
+	if enabled, _ := strconv.ParseBool(os.Getenv("DISCOVERY_ENABLED")); enabled {
+		go discoverer.Run(schedCtx)
+	}
+	push, err := api.PubSubPushFromEnv(cfg.Tenants)
+	if err != nil {
+		slog.Error("Failed to configure Pub/Sub push", "error", err)
+		os.Exit(1)
+	}
+
 	// Initialize Gin
 	// Release mode is better for production performance
 	if os.Getenv("GIN_MODE") == "" {
@@ -129,21 +489,9 @@ func main() {
 	}
 	r := gin.New() // Use New() to skip default logger/recovery middleware for custom ones
 	r.Use(gin.Recovery())
+	r.Use(api.RequestID())
 
-	apiKey := os.Getenv("API_KEY")
-	if apiKey != "" {
-		r.Use(func(c *gin.Context) {
-			if c.Request.URL.Path == "/health" {
-				c.Next()
-				return
-			}
-			if c.GetHeader("X-API-Key") != apiKey {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-				return
-			}
-			c.Next()
-		})
-	}
+	r.Use(api.Auth(os.Getenv("API_KEY"), cfg.Tenants, cfg.Access))
 
 	// Custom logger middleware for Gin that uses slog
 	r.Use(func(c *gin.Context) {
@@ -165,7 +513,10 @@ func main() {
 			slog.String("client_ip", c.ClientIP()),
 		}
 		if raw != "" {
-			attrs = append(attrs, slog.String("query", raw))
+			attrs = append(attrs, slog.String("query", logging.RequestURLQuery(raw)))
+		}
+		if tenant := service.TenantName(c.Request.Context()); tenant != "" {
+			attrs = append(attrs, slog.String("tenant", tenant))
 		}
 
 		// Cloud Scheduler specific headers
@@ -177,24 +528,62 @@ func main() {
 		}
 
 		if status >= 500 {
-			slog.Error(msg, attrs...)
+			slog.ErrorContext(c.Request.Context(), msg, attrs...)
 		} else {
-			slog.Info(msg, attrs...)
+			slog.InfoContext(c.Request.Context(), msg, attrs...)
 		}
 	})
 
 	// CORS configuration
-	config := cors.DefaultConfig()
-	config.AllowAllOrigins = true
-	r.Use(cors.New(config))
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowAllOrigins = true
+	r.Use(cors.New(corsConfig))
 
 	// Health Check Endpoint (Vital for Cloud Run)
 	r.GET("/health", func(c *gin.Context) {
 		c.Status(http.StatusOK)
 	})
 
-	// Routes
-	r.POST("/api/export", api.ExportHandler(bqService, driver))
+	// Routes; any authenticated caller may read, operators run, admins define pipelines
+	limits := api.LimitsFromEnv()
+	operator, admin := api.RequireRole(config.RoleOperator), api.RequireRole(config.RoleAdmin)
+	r.GET("/api/whoami", api.WhoAmIHandler())
+	r.GET("/version", api.VersionHandler(buildInfo))
+	r.POST("/api/export", operator, api.BodyLimit(limits), api.ExportHandler(exporter, limits))
+	r.POST("/api/export/plan", operator, api.BodyLimit(limits), api.PlanHandler(exporter, limits))
+	r.POST("/api/export/snapshot", operator, api.BodyLimit(limits), api.SnapshotHandler(exporter))
+	r.POST("/api/export/batch", operator, api.BodyLimit(limits), api.BatchHandler(exporter, limits))
+	r.POST("/api/export/xlsx", operator, api.BodyLimit(limits), api.WorkbookHandler(exporter, limits))
+	r.GET("/api/download", operator, api.DownloadHandler(exporter, limits))
+	r.POST("/api/download", operator, api.BodyLimit(limits), api.DownloadHandler(exporter, limits))
+	r.GET("/api/pipelines", api.ListPipelinesHandler(exporter.Pipelines))
+	r.GET("/api/pipelines/:name", api.GetPipelineHandler(exporter.Pipelines))
+	r.PUT("/api/pipelines/:name", admin, api.BodyLimit(limits), api.PutPipelineHandler(exporter.Pipelines))
+	r.DELETE("/api/pipelines/:name", admin, api.DeletePipelineHandler(exporter.Pipelines))
+	r.GET("/api/definitions", api.DefinitionsHandler(exporter.Pipelines))
+	r.POST("/api/definitions/apply", admin, api.BodyLimit(limits), api.ApplyDefinitionsHandler(exporter.Pipelines))
+	r.POST("/api/pipelines/:name/approve", admin, api.ApprovePipelineHandler(discoverer))
+	r.GET("/api/jobs", api.ListJobsHandler(exporter.Jobs))
+	r.GET("/api/jobs/:id", api.GetJobHandler(exporter.Jobs))
+	r.GET("/api/jobs/:id/diff", api.DiffJobHandler(exporter.Jobs))
+	r.GET("/api/jobs/:id/rows", operator, api.JobRowsHandler(exporter))
+	r.GET("/api/jobs/:id/validation-report", api.QualityReportHandler(exporter.Jobs))
+	r.POST("/api/jobs/:id/retry", operator, api.RetryJobHandler(exporter))
+	r.GET("/api/usage", api.UsageHandler(exporter.Usage))
+	r.GET("/metrics", admin, api.MetricsHandler(exporter.Metrics))
+	r.GET("/api/breakers", api.BreakersHandler(exporter))
+	r.GET("/api/schedules", api.ListSchedulesHandler(scheduler))
+	r.POST("/api/schedules/:name/pause", operator, api.PauseScheduleHandler(scheduler))
+	r.POST("/api/schedules/:name/resume", operator, api.ResumeScheduleHandler(scheduler))
+	r.POST("/api/schedules/:name/trigger", operator, api.TriggerScheduleHandler(scheduler))
+	r.GET("/api/freshness", api.FreshnessHandler(freshness))
+	r.GET("/api/discoveries", api.ListDiscoveriesHandler(discoverer))
+	r.POST("/api/discoveries/:name/scan", operator, api.ScanDiscoveryHandler(discoverer))
+	if push != nil {
+		triggers := service.NewObjectTriggers(exporter, cfg.Tenants)
+		r.POST(api.PubSubPushPath, api.BodyLimit(limits), api.PubSubPushHandler(exporter, triggers, push, limits))
+		r.POST(api.ObjectEventsPath, api.BodyLimit(limits), api.ObjectTriggersHandler(triggers, push))
+	}
 
 	// Server setup with Graceful Shutdown
 	port := os.Getenv("PORT")
@@ -229,6 +618,14 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		slog.Error("Server forced to shutdown", "error", err)
 	}
+	// Scheduled runs in progress are cancelled, which rolls back their loads
+	stopScheduler()
+	select {
+	case <-schedDone:
+	case <-ctx.Done():
+		slog.Error("Scheduled runs did not stop in time")
+	}
+	exporter.Lineage.Wait(ctx)
 
 	slog.Info("Server exiting")
 }
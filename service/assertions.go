@@ -0,0 +1,264 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// ErrAssertionsFailed is returned for exports whose destination failed an assertion
+// after the load, which is not undone.
+var ErrAssertionsFailed = errors.New("assertions failed")
+
+// AssertionResult is the outcome of one assertion of an export.
+type AssertionResult struct {
+	Name string `json:"name"`
+	// Check is the kind of check: row_count, not_null, max or condition
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	// Observed is the value checked: the row count, the NULLs of the column, its greatest
+	// value or the rows failing the condition ("" for NULL)
+	Observed string `json:"observed"`
+	Expected string `json:"expected"`
+}
+
+// Checks of AssertionResult.
+const (
+	checkRowCount  = "row_count"
+	checkNotNull   = "not_null"
+	checkMax       = "max"
+	checkCondition = "condition"
+)
+
+// loadCommitted reports whether an export that returned err left its load in the
+// destination: it succeeded, or only failed its assertions.
+func loadCommitted(err error) bool {
+	return err == nil || errors.Is(err, ErrAssertionsFailed)
+}
+
+// destinationDialect builds the SQL of queries reading back the destination.
+type destinationDialect struct {
+	quote    func(column string) string
+	castText string // the text type of CAST
+}
+
+var (
+	bigQueryDestination  = destinationDialect{quote: quoteBigQueryColumn, castText: "STRING"}
+	starRocksDestination = destinationDialect{quote: quoteSRIdent, castText: "VARCHAR"}
+)
+
+// checkAssertionsSupported rejects assertions for destinations they cannot query.
+func checkAssertionsSupported(params ExportParams, driver string) error {
+	if len(params.Assertions) == 0 {
+		return nil
+	}
+	if err := config.ValidateAssertions(params.Assertions); err != nil {
+		return err
+	}
+	return checkDestinationReadable(params, driver, "assertions")
+}
+
+// checkDestinationReadable rejects reading back the destination of params, for what,
+// when its files cannot be loaded into BigQuery.
+func checkDestinationReadable(params ExportParams, driver, what string) error {
+	switch driverCapabilities(driver).Readback {
+	case ReadbackQuery:
+		return nil
+	case ReadbackNone:
+		return fmt.Errorf("%s are not supported for the %s driver", what, driver)
+	}
+	if _, ok := loadFilesScript("", params); !ok {
+		return fmt.Errorf("%s are not supported for %s files", what, params.Format)
+	}
+	return nil
+}
+
+// checkAssertions runs the assertions of params against the destination of res in one
+// query. It returns the results, and an ErrAssertionsFailed data error if any failed.
+func (e *Exporter) checkAssertions(ctx context.Context, bq BigQueryClient, params ExportParams, res ExportResult) ([]AssertionResult, error) {
+	rows, err := e.readDestination(ctx, bq, params, res, func(d destinationDialect, mapping map[string]string, table string) string {
+		return assertionQuery(params.Assertions, d, mapping, table)
+	})
+	if err == nil && len(rows) != 1 {
+		err = errors.New("the assertion query returned no row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check assertions: %w", err)
+	}
+	values := rows[0]
+	now := time.Now().UTC()
+	results := make([]AssertionResult, len(params.Assertions))
+	var failed []string
+	for i, a := range params.Assertions {
+		results[i] = evalAssertion(a, values[i], now)
+		if !results[i].Passed {
+			failed = append(failed, fmt.Sprintf("%s (observed %s, expected %s)", results[i].Name, cmp.Or(results[i].Observed, "NULL"), results[i].Expected))
+		}
+	}
+	if len(failed) > 0 {
+		slog.WarnContext(ctx, "Destination failed assertions", "table", res.Table, "gcs_path", res.GCSPath, "failed", failed)
+		return results, DataError(fmt.Errorf("%w: %s", ErrAssertionsFailed, strings.Join(failed, "; ")))
+	}
+	slog.InfoContext(ctx, "Destination passed assertions", "table", res.Table, "gcs_path", res.GCSPath, "assertions", len(results))
+	return results, nil
+}
+
+// readDestination reads back the destination of res, as text: the StarRocks or BigQuery
+// table, or the exported files loaded into BigQuery. build returns the query, in the
+// destination's dialect, selecting from table; mapping holds the StarRocks names of
+// renamed result columns.
+func (e *Exporter) readDestination(ctx context.Context, bq BigQueryClient, params ExportParams, res ExportResult,
+	build func(d destinationDialect, mapping map[string]string, table string) string) ([][]sql.NullString, error) {
+	switch e.Driver.Name() {
+	case "STARROCKS":
+		d, ok := e.Driver.(*StarRocksDriver)
+		if !ok {
+			return nil, fmt.Errorf("reading the destination needs the StarRocks service")
+		}
+		db, tbl := d.sr.parseDBTable(res.Table)
+		q := build(starRocksDestination, res.ColumnMapping, quoteSRIdent(db)+"."+quoteSRIdent(tbl))
+		recordStatement(ctx, StatementStarRocks, q)
+		return readStarRocksStrings(ctx, d.sr, q)
+	case "BIGQUERY":
+		q := build(bigQueryDestination, nil, quoteBigQueryTable(res.Table))
+		return readBigQueryStrings(ctx, bq, q, cmp.Or(params.DestinationLocation, params.QueryLocation))
+	}
+	load, ok := loadFilesScript(res.GCSPath, params)
+	if !ok || res.GCSPath == "" {
+		return nil, fmt.Errorf("%s files cannot be read back", params.Format)
+	}
+	return readBigQueryStrings(ctx, bq, load+"\n"+build(bigQueryDestination, nil, "_rows"), params.QueryLocation)
+}
+
+// readStarRocksStrings reads the rows of a StarRocks query as text.
+func readStarRocksStrings(ctx context.Context, sr *StarRocksService, q string) ([][]sql.NullString, error) {
+	rows, err := sr.reader().QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var out [][]sql.NullString
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		dest := make([]any, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		out = append(out, values)
+	}
+	return out, rows.Err()
+}
+
+// readBigQueryStrings reads the rows of a BigQuery query as text.
+func readBigQueryStrings(ctx context.Context, bq BigQueryClient, q, location string) ([][]sql.NullString, error) {
+	it, err := bq.ReadRows(ctx, q, location)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var out [][]sql.NullString
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		values := make([]sql.NullString, len(row))
+		for i, v := range row {
+			if v != nil {
+				values[i] = sql.NullString{String: fmt.Sprint(v), Valid: true}
+			}
+		}
+		out = append(out, values)
+	}
+}
+
+// assertionQuery selects the value each assertion checks from table, as one row.
+func assertionQuery(assertions []config.Assertion, d destinationDialect, mapping map[string]string, table string) string {
+	column := func(name string) string {
+		return d.quote(cmp.Or(mapping[name], name))
+	}
+	exprs := make([]string, len(assertions))
+	for i, a := range assertions {
+		switch {
+		case a.MinRows != nil || a.MaxRows != nil:
+			exprs[i] = "COUNT(*)"
+		case a.NotNull != "":
+			exprs[i] = fmt.Sprintf("SUM(CASE WHEN %s IS NULL THEN 1 ELSE 0 END)", column(a.NotNull))
+		case a.Max != "":
+			exprs[i] = fmt.Sprintf("CAST(MAX(%s) AS %s)", column(a.Column), d.castText)
+		default:
+			// Rows where the condition is NULL fail it too
+			exprs[i] = fmt.Sprintf("SUM(CASE WHEN (%s) THEN 0 ELSE 1 END)", a.Condition)
+		}
+		exprs[i] += fmt.Sprintf(" AS a%d", i)
+	}
+	return fmt.Sprintf("SELECT %s FROM %s", strings.Join(exprs, ", "), table)
+}
+
+// evalAssertion checks the value observed for an assertion.
+func evalAssertion(a config.Assertion, observed sql.NullString, now time.Time) AssertionResult {
+	r := AssertionResult{Name: a.Label(), Observed: observed.String}
+	n, _ := strconv.ParseInt(observed.String, 10, 64) // SUM over no rows is NULL
+	switch {
+	case a.MinRows != nil || a.MaxRows != nil:
+		r.Check = checkRowCount
+		var bounds []string
+		r.Passed = true
+		if a.MinRows != nil {
+			bounds = append(bounds, fmt.Sprintf(">= %d", *a.MinRows))
+			r.Passed = n >= *a.MinRows
+		}
+		if a.MaxRows != nil {
+			bounds = append(bounds, fmt.Sprintf("<= %d", *a.MaxRows))
+			r.Passed = r.Passed && n <= *a.MaxRows
+		}
+		r.Expected = strings.Join(bounds, " and ")
+	case a.Max != "":
+		r.Check = checkMax
+		want := a.Max
+		switch a.Max {
+		case config.AssertToday:
+			want = now.Format(time.DateOnly)
+		case config.AssertYesterday:
+			want = now.AddDate(0, 0, -1).Format(time.DateOnly)
+		}
+		r.Expected = want
+		if _, err := time.Parse(time.DateOnly, want); err == nil {
+			// Dates match the date of timestamps and datetimes
+			r.Passed = observed.Valid && strings.HasPrefix(observed.String, want)
+		} else {
+			r.Passed = observed.Valid && observed.String == want
+		}
+	default:
+		// Both count the failing rows
+		r.Check = checkCondition
+		if a.NotNull != "" {
+			r.Check = checkNotNull
+		}
+		r.Observed = strconv.FormatInt(n, 10)
+		r.Expected = "0"
+		r.Passed = n == 0
+	}
+	return r
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestCheckAssertions(t *testing.T) {
+	minRows := int64(2)
+	assertions := []config.Assertion{
+		{MinRows: &minRows},
+		{NotNull: "site"},
+		{Column: "visit_date", Max: config.AssertToday},
+		{Name: "positive", Condition: "id > 0"},
+	}
+	today := time.Now().UTC().Format(time.DateOnly)
+	bq := &fakeBigQuery{rows: [][]bigquery.Value{{int64(3), int64(0), today + " 08:00:00", nil}}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	ctx := logging.WithRequestID(context.Background(), "run-1")
+	res, err := e.Run(ctx, ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/", Assertions: assertions})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	q := bq.queries[len(bq.queries)-1]
+	if !strings.Contains(q, "LOAD DATA INTO TEMP TABLE _rows FROM FILES(format='PARQUET'") ||
+		!strings.Contains(q, "SELECT COUNT(*) AS a0, SUM(CASE WHEN `site` IS NULL THEN 1 ELSE 0 END) AS a1, CAST(MAX(`visit_date`) AS STRING) AS a2, SUM(CASE WHEN (id > 0) THEN 0 ELSE 1 END) AS a3 FROM _rows") {
+		t.Errorf("assertion query = %s, want the exported files loaded and checked", q)
+	}
+	if len(res.Assertions) != 4 || !res.Assertions[0].Passed || !res.Assertions[2].Passed || !res.Assertions[3].Passed || res.Assertions[3].Name != "positive" {
+		t.Errorf("Run() assertions = %+v, want all passed", res.Assertions)
+	}
+
+	bq.rows = [][]bigquery.Value{{int64(1), int64(4), "2001-01-01", int64(2)}}
+	res, err = e.Run(logging.WithRequestID(context.Background(), "run-2"), ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/", Assertions: assertions})
+	if !errors.Is(err, ErrAssertionsFailed) || FailureClass(err) != FailureData {
+		t.Fatalf("Run() error = %v, want a data error with ErrAssertionsFailed", err)
+	}
+	for _, r := range res.Assertions {
+		if r.Passed {
+			t.Errorf("Run() assertion %+v passed, want failed", r)
+		}
+	}
+	if rec, _ := e.Jobs.Get(ctx, "run-2"); rec.Status != JobFailed || len(rec.Assertions) != 4 || rec.Assertions[1].Observed != "4" {
+		t.Errorf("job record = %+v, want failed with the assertion results", rec)
+	}
+	if !loadCommitted(err) {
+		t.Error("loadCommitted() = false, want failed assertions to leave the load committed")
+	}
+
+	_, err = e.Run(logging.WithRequestID(context.Background(), "run-3"), ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/", Format: FormatFHIR, Assertions: assertions})
+	if FailureClass(err) != FailureConfig {
+		t.Errorf("Run(fhir) error = %v, want a config error", err)
+	}
+}
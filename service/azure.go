@@ -0,0 +1,216 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// azureBlobDriverName is the EXPORT_DRIVER value of AzureBlobDriver.
+const azureBlobDriverName = "AZURE_BLOB"
+
+// AzureBlobService writes blobs to the containers of one Azure Storage account.
+type AzureBlobService struct {
+	client *azblob.Client
+}
+
+// NewAzureBlobService returns a client of the Blob service at endpoint
+// (https://<account>.blob.core.windows.net/), authenticated with the SAS token sas or,
+// without one, with cred.
+func NewAzureBlobService(endpoint, sas string, cred azcore.TokenCredential) (*AzureBlobService, error) {
+	var (
+		client *azblob.Client
+		err    error
+	)
+	if sas != "" {
+		client, err = azblob.NewClientWithNoCredential(strings.TrimSuffix(endpoint, "/")+"/?"+strings.TrimPrefix(sas, "?"), nil)
+	} else {
+		client, err = azblob.NewClient(endpoint, cred, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob Storage client: %w", err)
+	}
+	return &AzureBlobService{client: client}, nil
+}
+
+// NewAzureBlobServiceFromEnv reads AZURE_STORAGE_ACCOUNT (or AZURE_STORAGE_ENDPOINT, for
+// other clouds) and authenticates with AZURE_STORAGE_SAS_TOKEN or, without it, the
+// managed identity of the host: the user-assigned one of AZURE_CLIENT_ID, if set.
+func NewAzureBlobServiceFromEnv() (*AzureBlobService, error) {
+	endpoint := os.Getenv("AZURE_STORAGE_ENDPOINT")
+	if endpoint == "" {
+		account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+		if account == "" {
+			return nil, ConfigError(fmt.Errorf("AZURE_STORAGE_ACCOUNT is required for the %s driver", azureBlobDriverName))
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", account)
+	}
+	sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	var cred azcore.TokenCredential
+	if sas == "" {
+		opts := &azidentity.ManagedIdentityCredentialOptions{}
+		if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+			opts.ID = azidentity.ClientID(id)
+		}
+		mi, err := azidentity.NewManagedIdentityCredential(opts)
+		if err != nil {
+			return nil, ConfigError(fmt.Errorf("failed to set up the Azure managed identity: %w", err))
+		}
+		cred = mi
+	}
+	a, err := NewAzureBlobService(endpoint, sas, cred)
+	return a, ConfigError(err)
+}
+
+// parseAzureURI splits "az://container/path/to/blob" into container and blob name.
+func parseAzureURI(uri string) (string, string, error) {
+	rest, ok := strings.CutPrefix(uri, "az://")
+	if !ok {
+		return "", "", fmt.Errorf("not an az:// URI: %q", uri)
+	}
+	container, name, _ := strings.Cut(rest, "/")
+	if container == "" {
+		return "", "", fmt.Errorf("missing container in %q", uri)
+	}
+	return container, name, nil
+}
+
+// CheckContainer fails with ErrBucketUnusable for a container that does not exist. Other
+// errors only log a warning: SAS tokens may allow writing blobs but not reading the
+// container.
+func (a *AzureBlobService) CheckContainer(ctx context.Context, container string) error {
+	_, err := a.client.ServiceClient().NewContainerClient(container).GetProperties(ctx, nil)
+	switch {
+	case err == nil:
+	case bloberror.HasCode(err, bloberror.ContainerNotFound):
+		return fmt.Errorf("%w: container az://%s does not exist", ErrBucketUnusable, container)
+	default:
+		slog.WarnContext(ctx, "Could not check Azure container", "container", container, "error", err)
+	}
+	return nil
+}
+
+// Upload writes the data read from r to the blob name of container and returns the
+// number of bytes written.
+func (a *AzureBlobService) Upload(ctx context.Context, container, name, contentType string, r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	_, err := a.client.UploadStream(ctx, container, name, cr, &azblob.UploadStreamOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	})
+	if err != nil {
+		return cr.n, fmt.Errorf("failed to write az://%s/%s: %w", container, name, err)
+	}
+	return cr.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// AzureBlobDriver delivers exports to Azure Blob Storage. EXPORT DATA, as for the GCS
+// driver (with every format option), writes the files under a per-run prefix of the
+// GCS staging bucket of the query location; they are then streamed to the container of
+// the az:// output and the staged copies deleted.
+type AzureBlobDriver struct {
+	gcs     *GCSService
+	blob    *AzureBlobService
+	staging StagingBuckets
+}
+
+// NewAzureBlobDriver returns an Azure Blob Storage driver staging in the staging buckets.
+func NewAzureBlobDriver(gcs *GCSService, blob *AzureBlobService, staging StagingBuckets) *AzureBlobDriver {
+	return &AzureBlobDriver{gcs: gcs, blob: blob, staging: staging}
+}
+
+func (d *AzureBlobDriver) Name() string {
+	return azureBlobDriverName
+}
+
+func (d *AzureBlobDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{Files: true, Folders: true}
+}
+
+func (d *AzureBlobDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	if d.gcs == nil || d.blob == nil {
+		return ExportResult{}, ConfigError(fmt.Errorf("the %s driver needs Cloud Storage and Azure Blob Storage clients", azureBlobDriverName))
+	}
+	stageBucket := d.staging.For(params.QueryLocation)
+	if stageBucket == "" {
+		return ExportResult{}, ConfigError(fmt.Errorf("the %s driver stages files in Cloud Storage; configure a staging bucket for %s in GCS_STAGING_BUCKETS",
+			azureBlobDriverName, cmp.Or(params.QueryLocation, "the query location")))
+	}
+	timestamp := time.Now().Format("20060102-150405")
+	useTimestamp := params.UseTimestamp != nil && *params.UseTimestamp
+	exportURI := buildExportURI(params.Output, params.Filename, timestamp, useTimestamp, exportExtension(params.Format))
+	container, pattern, err := parseAzureURI(exportURI)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if err := d.blob.CheckContainer(ctx, container); err != nil {
+		return ExportResult{}, err
+	}
+
+	// Apart from the GCS driver's own staging prefix, which it clears as it goes
+	prefix := runPrefix(ctx, "bq-exporter-azure")
+	staged := params
+	staged.Output = fmt.Sprintf("gs://%s/%s%s", stageBucket, prefix, pattern)
+	cleanup := registerCleanup(ctx, CleanupGCSPrefix, "gs://"+stageBucket+"/"+prefix, "")
+	defer func() {
+		if err := d.gcs.DeletePrefix(context.WithoutCancel(ctx), stageBucket, prefix); err != nil {
+			slog.WarnContext(ctx, "Failed to clean up staged export", "staging_uri", "gs://"+stageBucket+"/"+prefix, "error", err)
+			return
+		}
+		cleanup.done(ctx)
+	}()
+	slog.InfoContext(ctx, "Staging export for Azure Blob Storage", "export_uri", exportURI, "staging_uri", staged.Output)
+	res, err := NewGCSDriver(d.gcs, d.staging).Execute(ctx, bq, staged)
+	res.GCSPath = ""
+	if err != nil {
+		return res, err
+	}
+	objs, err := d.gcs.ListObjects(ctx, stageBucket, prefix)
+	if err != nil {
+		return res, err
+	}
+	// Schema files are delivered along with the files
+	res.BytesWritten = 0
+	for _, o := range objs {
+		name := strings.TrimPrefix(o.Name, prefix)
+		n, err := d.transfer(ctx, stageBucket, o.Name, container, name, cmp.Or(o.ContentType, "application/octet-stream"))
+		res.BytesWritten += n
+		if err != nil {
+			return res, err
+		}
+	}
+	res.GCSPath = exportURI
+	slog.InfoContext(ctx, "Delivered export to Azure Blob Storage", "export_uri", exportURI, "objects", len(objs), "bytes_written", res.BytesWritten)
+	return res, nil
+}
+
+// transfer streams the staged object src to the blob name of container.
+func (d *AzureBlobDriver) transfer(ctx context.Context, bucket, src, container, name, contentType string) (int64, error) {
+	r, err := d.gcs.OpenObject(ctx, bucket, src)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return d.blob.Upload(ctx, container, name, contentType, r)
+}
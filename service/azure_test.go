@@ -0,0 +1,112 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAzureBlob serves the Blob service calls of AzureBlobService for one container,
+// "deliveries".
+type fakeAzureBlob struct {
+	srv    *httptest.Server
+	mu     sync.Mutex
+	blocks map[string][]byte
+	blobs  map[string][]byte
+}
+
+func newFakeAzureBlob(t *testing.T) *fakeAzureBlob {
+	f := &fakeAzureBlob{blocks: map[string][]byte{}, blobs: map[string][]byte{}}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeAzureBlob) service(t *testing.T) *AzureBlobService {
+	a, err := NewAzureBlobService(f.srv.URL+"/", "sv=2024&sig=test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (f *fakeAzureBlob) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	container, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+	if container != "deliveries" {
+		w.Header().Set("x-ms-error-code", "ContainerNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodGet && q.Get("restype") == "container":
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		f.blocks[name+"/"+q.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		xml.Unmarshal(body, &list)
+		var data []byte
+		for _, id := range list.Latest {
+			data = append(data, f.blocks[name+"/"+id]...)
+		}
+		f.blobs[name] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		f.blobs[name] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.String(), http.StatusNotImplemented)
+	}
+}
+
+func TestAzureBlobDriver(t *testing.T) {
+	gcs := newFakeGCS(t)
+	az := newFakeAzureBlob(t)
+	d := NewAzureBlobDriver(gcs.service(t), az.service(t), StagingBuckets{"": "b"})
+	ctx := logging.WithRequestID(context.Background(), "run-1")
+	// EXPORT DATA, faked, writes nothing: the staged files are there beforehand
+	gcs.objects["bq-exporter-azure/run-1/out/visits-000000000000.csv"] = []byte("id\n1\n")
+	bq := &fakeBigQuery{schema: testParquetSchema}
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "az://deliveries/out/", Filename: "visits", Format: FormatCSV, SchemaFile: true}
+	res, err := d.Execute(ctx, bq, params)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	schema := az.blobs["out/visits.schema.json"]
+	if got := string(az.blobs["out/visits-000000000000.csv"]); got != "id\n1\n" || schema == nil {
+		t.Errorf("blobs = %q, want the file and its schema", az.blobs)
+	}
+	if res.GCSPath != "az://deliveries/out/visits-*.csv" || res.BytesWritten != int64(5+len(schema)) {
+		t.Errorf("Execute() = %s, %d bytes, want the az:// pattern and the bytes of both blobs", res.GCSPath, res.BytesWritten)
+	}
+	if export := bq.queries[len(bq.queries)-1]; !strings.Contains(export, "uri='gs://b/bq-exporter-azure/run-1/out/visits-*.csv'") {
+		t.Errorf("queries = %v, want EXPORT DATA to the staging bucket", bq.queries)
+	}
+	for name := range gcs.objects {
+		if strings.HasPrefix(name, "bq-exporter-azure/") {
+			t.Errorf("staged %s not deleted", name)
+		}
+	}
+
+	params.Output = "az://missing/out/"
+	if _, err := d.Execute(ctx, bq, params); !errors.Is(err, ErrBucketUnusable) {
+		t.Errorf("Execute() to a missing container error = %v, want ErrBucketUnusable", err)
+	}
+	params.Output, params.QueryLocation = "az://deliveries/out/", "EU"
+	if _, err := NewAzureBlobDriver(gcs.service(t), az.service(t), nil).Execute(ctx, bq, params); FailureClass(err) != FailureConfig {
+		t.Errorf("Execute() without a staging bucket error = %v, want a config error", err)
+	}
+}
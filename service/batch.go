@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// BatchExport is one export of a batch: a run of Pipeline with its Parameters and Params
+// as overrides, or an export of Params.
+type BatchExport struct {
+	Pipeline   string
+	Parameters map[string]string
+	Params     ExportParams
+}
+
+// BatchItem is the outcome of one export of a batch.
+type BatchItem struct {
+	Index    int    `json:"index"`
+	Name     string `json:"name,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+	// JobID is the export's run in the job history, to retry it on its own
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+	// Committed reports whether the destination holds the export; a failed dataset sync
+	// reports its committed tables in Tables
+	Committed   bool            `json:"committed"`
+	GCSPath     string          `json:"gcs_path,omitempty"`
+	Destination string          `json:"destination_table,omitempty"`
+	Rows        int64           `json:"rows_loaded"`
+	DuplicateOf string          `json:"duplicate_of,omitempty"`
+	Tables      []SnapshotTable `json:"tables,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	// FailureClass is the failure class of a failed export, and Retryable whether
+	// running it again may succeed (any class but config and data)
+	FailureClass string `json:"failure_class,omitempty"`
+	Retryable    bool   `json:"retryable,omitempty"`
+}
+
+// BatchResult lists the exports of a batch in request order.
+type BatchResult struct {
+	Items     []BatchItem `json:"items"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+}
+
+// Batch runs several exports for one request, each a separate export in the job history
+// (the request's ID suffixed with its position), up to parallelism at a time (default 1).
+// A failed export does not stop the others and does not undo those that committed, so
+// the caller retries only the failed ones.
+func (e *Exporter) Batch(ctx context.Context, exports []BatchExport, parallelism int) BatchResult {
+	out := BatchResult{Items: make([]BatchItem, len(exports))}
+	sem := make(chan struct{}, max(parallelism, 1))
+	var wg sync.WaitGroup
+	for i, x := range exports {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			out.Items[i] = e.batchExport(withChildRequestID(ctx, i+1), i, x)
+		}()
+	}
+	wg.Wait()
+	for _, item := range out.Items {
+		if item.Status == JobSucceeded {
+			out.Succeeded++
+		} else {
+			out.Failed++
+		}
+	}
+	slog.InfoContext(ctx, "Batch export completed", "exports", len(exports), "succeeded", out.Succeeded, "failed", out.Failed)
+	return out
+}
+
+// batchExport runs the export at index i of a batch.
+func (e *Exporter) batchExport(ctx context.Context, i int, x BatchExport) BatchItem {
+	var res ExportResult
+	var err error
+	if x.Pipeline != "" {
+		res, err = e.RunPipeline(ctx, x.Pipeline, x.Params, x.Parameters)
+	} else {
+		res, err = e.Run(ctx, x.Params)
+	}
+	item := BatchItem{Index: i, Name: x.Params.Name, Pipeline: x.Pipeline, JobID: logging.RequestID(ctx), Status: JobSucceeded,
+		Committed: loadCommitted(err), GCSPath: res.GCSPath, Destination: res.Table, Rows: res.Rows, DuplicateOf: res.DuplicateOf, Tables: res.Tables}
+	if err != nil {
+		class := FailureClass(err)
+		item.Status, item.Error, item.FailureClass = JobFailed, err.Error(), class
+		item.Retryable = class != FailureConfig && class != FailureData
+		slog.WarnContext(ctx, "Batch export failed", "index", i, "pipeline", x.Pipeline, "name", x.Params.Name, "error", err)
+	}
+	return item
+}
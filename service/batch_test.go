@@ -0,0 +1,37 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	e := NewExporter(&fakeBigQuery{}, NewGCSDriver(nil, nil), &config.Config{})
+	ctx := logging.WithRequestID(context.Background(), "batch")
+	res := e.Batch(ctx, []BatchExport{
+		{Params: ExportParams{Name: "visits", Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/visits/"}},
+		{Pipeline: "missing"},
+		{Params: ExportParams{Name: "labs", Query: "SELECT 2", QueryLocation: "US", Output: "gs://b/labs/"}},
+	}, 2)
+
+	if res.Succeeded != 2 || res.Failed != 1 || len(res.Items) != 3 {
+		t.Fatalf("Batch() = %+v, want 2 succeeded and 1 failed", res)
+	}
+	for i, item := range res.Items {
+		if want := "batch-" + strconv.Itoa(i+1); item.Index != i || item.JobID != want {
+			t.Errorf("item %d = %+v, want index %d and job %s", i, item, i, want)
+		}
+	}
+	if item := res.Items[0]; item.Status != JobSucceeded || !item.Committed || item.GCSPath == "" {
+		t.Errorf("item 0 = %+v, want committed", item)
+	}
+	if item := res.Items[1]; item.Status != JobFailed || item.Committed || item.FailureClass != FailureConfig || item.Retryable {
+		t.Errorf("item 1 = %+v, want a failed config error that is not retryable", item)
+	}
+	if rec, ok := e.Jobs.Get(ctx, "batch-3"); !ok || rec.Status != JobSucceeded {
+		t.Errorf("job batch-3 = %+v, %v, want succeeded after the failed export", rec, ok)
+	}
+}
@@ -1,26 +1,122 @@
 package service
 
 import (
+	"bq-exporter/logging"
 	"context"
 	"fmt"
 	"log/slog"
+	"net/url"
+	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
 )
 
+// BigQueryClient is the narrow set of BigQuery operations the drivers depend on.
+// BigQueryService is the production implementation; tests and alternative backends
+// (emulator, cache) can provide their own.
+type BigQueryClient interface {
+	// RunQuery executes a statement and waits for the job to complete.
+	RunQuery(ctx context.Context, sqlQuery, location string) (QueryJob, error)
+	// ReadRows executes a query and returns an iterator over the result rows.
+	ReadRows(ctx context.Context, sqlQuery, location string) (RowIterator, error)
+	// DryRun validates a query without running it.
+	DryRun(ctx context.Context, sqlQuery, location string) (DryRunResult, error)
+}
+
+// RowIterator iterates over query result rows. Schema may be empty until the first
+// call to Next has fetched a page.
+type RowIterator interface {
+	Next(dst *[]bigquery.Value) error
+	Schema() bigquery.Schema
+	// Job identifies the BigQuery job producing the rows.
+	Job() QueryJob
+	// Close releases the iterator; the underlying job is no longer cancelled with the context.
+	Close()
+}
+
+// DryRunResult reports what a query would do without running it. Location is the
+// location BigQuery would run the query in.
+type DryRunResult struct {
+	TotalBytesProcessed int64
+	Schema              bigquery.Schema
+	Location            string
+	// ReferencedTables are the tables the query reads, as project.dataset.table
+	ReferencedTables []string
+}
+
+// QueryJob identifies a BigQuery job and, once it has finished, carries its statistics.
+type QueryJob struct {
+	ProjectID string
+	ID        string
+	Location  string
+
+	BytesProcessed int64
+	// ExportedRows and ExportedFiles are the rows and files written by EXPORT DATA
+	ExportedRows  int64
+	ExportedFiles int64
+}
+
+// ConsoleURL links to the job in the BigQuery console.
+func (j QueryJob) ConsoleURL() string {
+	if j.ID == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://console.cloud.google.com/bigquery?project=%s&j=bq:%s:%s&page=queryresults",
+		url.QueryEscape(j.ProjectID), url.QueryEscape(j.Location), url.QueryEscape(j.ID))
+}
+
+// JobError is returned when a BigQuery job was submitted but failed, so callers can
+// point operators at the failing job.
+type JobError struct {
+	Job QueryJob
+	Err error
+}
+
+func (e *JobError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+func newQueryJob(job *bigquery.Job) QueryJob {
+	return QueryJob{ProjectID: job.ProjectID(), ID: job.ID(), Location: job.Location()}
+}
+
+// withStatistics copies the statistics of a finished job into j.
+func (j QueryJob) withStatistics(status *bigquery.JobStatus) QueryJob {
+	if status == nil || status.Statistics == nil {
+		return j
+	}
+	j.BytesProcessed = status.Statistics.TotalBytesProcessed
+	if qs, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok && qs.ExportDataStatistics != nil {
+		j.ExportedRows = qs.ExportDataStatistics.RowCount
+		j.ExportedFiles = qs.ExportDataStatistics.FileCount
+	}
+	return j
+}
+
 type BigQueryService struct {
 	client    *bigquery.Client
 	projectID string
 }
 
-func NewBigQueryService(ctx context.Context, projectID string) (*BigQueryService, error) {
+// NewBigQueryService creates the BigQuery client; opts carry explicitly configured
+// credentials, if any.
+func NewBigQueryService(ctx context.Context, projectID string, opts ...option.ClientOption) (*BigQueryService, error) {
 	slog.InfoContext(ctx, "Initializing BigQuery client", "project_id", projectID)
 
-	// Create BigQuery client with explicit HTTP client timeout
-	// This prevents hanging on network issues
-	client, err := bigquery.NewClient(ctx, projectID)
+	if host := os.Getenv("BIGQUERY_EMULATOR_HOST"); host != "" {
+		// Local emulator (integration tests): plain HTTP endpoint without credentials
+		slog.InfoContext(ctx, "Using BigQuery emulator", "endpoint", host)
+		opts = []option.ClientOption{option.WithEndpoint(host), option.WithoutAuthentication()}
+	}
+	client, err := bigquery.NewClient(ctx, projectID, opts...)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to create BigQuery client", "error", err)
 		return nil, err
@@ -36,87 +132,180 @@ func (s *BigQueryService) Close() error {
 	return s.client.Close()
 }
 
-func (s *BigQueryService) ExportQueryToParquet(ctx context.Context, sqlQuery, outputURI, filename, location string, useTimestamp bool) (string, error) {
-	// Generate timestamp for filename
-	timestamp := time.Now().Format("20060102-150405")
-
-	exportURI := outputURI
-
-	// Determine the base filename prefix
-	baseName := filename
-	if baseName == "" {
-		baseName = "export"
+// EnableStorageRead makes ReadRows fetch results through the BigQuery Storage Read API,
+// which streams large results faster than the REST API. Results the Storage Read API
+// cannot serve (e.g. without the bigquery.readsessions permissions) still come through
+// the REST API.
+func (s *BigQueryService) EnableStorageRead(ctx context.Context, opts ...option.ClientOption) error {
+	if err := s.client.EnableStorageReadClient(ctx, opts...); err != nil {
+		return fmt.Errorf("failed to create BigQuery Storage Read client: %w", err)
 	}
+	return nil
+}
 
-	// Logic for generating the final URI:
-	// 1. If it ends with "/", it's a folder. Append "{baseName}-{timestamp?-}*.parquet"
-	// 2. If it doesn't have an extension (.parquet) and no wildcard (*):
-	//    - Assume it's a folder path missing the slash. Append "/{baseName}-{timestamp?-}*.parquet"
-	// 3. If user provided a specific pattern (e.g. ".../my-file-*.parquet"), use it as is (ignoring filename/timestamp injection to respect strict overrides)
-
-	if strings.HasSuffix(outputURI, "/") {
-		if useTimestamp {
-			exportURI = fmt.Sprintf("%s%s-%s-*.parquet", outputURI, baseName, timestamp)
-		} else {
-			exportURI = fmt.Sprintf("%s%s-*.parquet", outputURI, baseName)
+// DryRun validates the query without executing it and returns the number of bytes it
+// would process, its result schema and its location. With an empty location, BigQuery
+// picks the location from the referenced datasets.
+func (s *BigQueryService) DryRun(ctx context.Context, sqlQuery, location string) (DryRunResult, error) {
+	q := s.newQuery(ctx, sqlQuery, location)
+	q.DryRun = true
+	job, err := q.Run(ctx)
+	if err != nil {
+		return DryRunResult{}, fmt.Errorf("dry-run failed: %w", err)
+	}
+	status := job.LastStatus()
+	if err := status.Err(); err != nil {
+		return DryRunResult{}, fmt.Errorf("dry-run failed: %w", err)
+	}
+	res := DryRunResult{Location: job.Location()}
+	var referenced []*bigquery.Table
+	if status.Statistics != nil {
+		res.TotalBytesProcessed = status.Statistics.TotalBytesProcessed
+		if qs, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+			res.Schema = qs.Schema
+			referenced = qs.ReferencedTables
 		}
-	} else if !strings.HasSuffix(outputURI, ".parquet") && !strings.Contains(outputURI, "*") {
-		// Treat as folder, append slash and filename pattern
-		if useTimestamp {
-			exportURI = fmt.Sprintf("%s/%s-%s-*.parquet", outputURI, baseName, timestamp)
-		} else {
-			exportURI = fmt.Sprintf("%s/%s-*.parquet", outputURI, baseName)
+	}
+	for _, t := range referenced {
+		res.ReferencedTables = append(res.ReferencedTables, t.ProjectID+"."+t.DatasetID+"."+t.TableID)
+	}
+	if res.Location == "" && len(referenced) > 0 {
+		// Fall back to the location of the first referenced dataset
+		t := referenced[0]
+		md, err := s.client.DatasetInProject(t.ProjectID, t.DatasetID).Metadata(ctx)
+		if err != nil {
+			return res, fmt.Errorf("failed to look up location of dataset %s.%s: %w", t.ProjectID, t.DatasetID, err)
 		}
+		res.Location = md.Location
 	}
+	return res, nil
+}
 
-	// NOTE: If outputURI contained a pattern (case 3), we use it exactly as provided.
-	// This supports "legacy" or explicit behavior where user wants full control.
-	// However, if they provided 'filename', they should likely stick to folder paths in 'output'.
-
-	slog.InfoContext(ctx, "Starting BigQuery export",
-		"output_uri", outputURI,
-		"filename", filename,
-		"export_uri", exportURI,
-		"timestamp", timestamp,
-		"use_timestamp", useTimestamp,
-	)
-
-	// Construct the EXPORT DATA statement
-	// We wrap the user query in parentheses to ensure syntax correctness
-	// overwrite=true ensures that if we are re-running a job with the exact same timestamp (unlikely)
-	// or if the user provided a fixed path, we overwrite.
-	exportSQL := fmt.Sprintf(`
-		EXPORT DATA OPTIONS(
-			uri='%s',
-			format='PARQUET',
-			overwrite=true
-		) AS
-		(%s)
-	`, exportURI, sqlQuery)
-
-	// Run the query
-	q := s.client.Query(exportSQL)
-	q.Location = location
+// RunQuery executes a statement (e.g. EXPORT DATA) and waits for it to complete.
+// If ctx is cancelled while the job is running, the BigQuery job is cancelled too.
+// While the job runs, the export of ctx shows activity (see touchWhileRunning).
+func (s *BigQueryService) RunQuery(ctx context.Context, sqlQuery, location string) (QueryJob, error) {
+	q := s.newQuery(ctx, sqlQuery, location)
 
 	// Execute the job
 	job, err := q.Run(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to start export job: %w", err)
+		return QueryJob{}, fmt.Errorf("failed to start query job: %w", err)
 	}
+	res := newQueryJob(job)
+	stop := context.AfterFunc(ctx, func() { cancelJob(ctx, job) })
+	defer stop()
 
-	slog.InfoContext(ctx, "Export job submitted", "job_id", job.ID())
+	slog.InfoContext(ctx, "Query job submitted", "job_id", res.ID)
 
-	// Wait for the job to complete
+	// Wait for the job to complete, which counts as activity while it runs
+	unwatch := touchWhileRunning(ctx, job.Status)
 	status, err := job.Wait(ctx)
+	unwatch()
 	if err != nil {
-		return "", fmt.Errorf("job failed during execution: %w", err)
+		return res, &JobError{Job: res, Err: fmt.Errorf("job failed during execution: %w", err)}
 	}
 
+	res = res.withStatistics(status)
 	if err := status.Err(); err != nil {
-		return "", fmt.Errorf("job completed with error: %w", err)
+		return res, &JobError{Job: res, Err: fmt.Errorf("job completed with error: %w", err)}
+	}
+
+	slog.InfoContext(ctx, "Query job completed successfully", "job_id", res.ID, "bytes_processed", res.BytesProcessed)
+	return res, nil
+}
+
+// ReadRows executes a query and returns an iterator over its result rows. Until the
+// iterator is closed, cancelling ctx cancels the BigQuery job and makes Next fail.
+func (s *BigQueryService) ReadRows(ctx context.Context, sqlQuery, location string) (RowIterator, error) {
+	q := s.newQuery(ctx, sqlQuery, location)
+	job, err := q.Run(ctx)
+	if err != nil {
+		return nil, err
 	}
+	slog.InfoContext(ctx, "Query job submitted", "job_id", job.ID())
+	stop := context.AfterFunc(ctx, func() { cancelJob(ctx, job) })
+	unwatch := touchWhileRunning(ctx, job.Status)
+	it, err := job.Read(ctx)
+	unwatch()
+	if err != nil {
+		stop()
+		return nil, &JobError{Job: newQueryJob(job), Err: err}
+	}
+	// Read waits for the query to finish; fetch its statistics for accounting
+	res := newQueryJob(job)
+	if status, err := job.Status(ctx); err == nil {
+		res = res.withStatistics(status)
+	}
+	return &bqRowIterator{it: it, job: res, stop: stop}, nil
+}
 
-	slog.InfoContext(ctx, "Export job completed successfully", "job_id", job.ID())
+// newQuery builds a query in the given location, labelled with the request's
+// correlation ID so the BigQuery job can be found from the logs and vice versa, with the
+// parameters of ctx it references.
+func (s *BigQueryService) newQuery(ctx context.Context, sqlQuery, location string) *bigquery.Query {
+	q := s.client.Query(sqlQuery)
+	q.Location = location
+	if id := logging.RequestID(ctx); id != "" {
+		q.Labels = map[string]string{"request_id": strings.ToLower(id)}
+	}
+	q.Parameters = queryParameters(ctx, sqlQuery)
+	return q
+}
 
-	return exportURI, nil
+type queryParametersCtxKey struct{}
+
+// withQueryParameters returns a copy of ctx whose queries get params, named parameters
+// carrying values that must not appear in SQL, such as keys.
+func withQueryParameters(ctx context.Context, params ...bigquery.QueryParameter) context.Context {
+	prev, _ := ctx.Value(queryParametersCtxKey{}).([]bigquery.QueryParameter)
+	return context.WithValue(ctx, queryParametersCtxKey{}, append(slices.Clone(prev), params...))
 }
+
+// queryParameters returns the parameters of ctx that sqlQuery references as @name.
+func queryParameters(ctx context.Context, sqlQuery string) []bigquery.QueryParameter {
+	params, _ := ctx.Value(queryParametersCtxKey{}).([]bigquery.QueryParameter)
+	var out []bigquery.QueryParameter
+	for _, p := range params {
+		if strings.Contains(sqlQuery, "@"+p.Name) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// cancelJob requests cancellation of a BigQuery job whose caller went away. It detaches
+// from the caller's cancellation (already done) but keeps its values for logging.
+func cancelJob(ctx context.Context, job *bigquery.Job) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	slog.WarnContext(ctx, "Context cancelled, cancelling BigQuery job", "job_id", job.ID())
+	if err := job.Cancel(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to cancel BigQuery job", "job_id", job.ID(), "error", err)
+	}
+}
+
+// bqRowIterator adapts *bigquery.RowIterator to RowIterator.
+type bqRowIterator struct {
+	it   *bigquery.RowIterator
+	job  QueryJob
+	stop func() bool
+}
+
+func (r *bqRowIterator) Next(dst *[]bigquery.Value) error {
+	return r.it.Next(dst)
+}
+
+func (r *bqRowIterator) Schema() bigquery.Schema {
+	return r.it.Schema
+}
+
+func (r *bqRowIterator) Job() QueryJob {
+	return r.job
+}
+
+func (r *bqRowIterator) Close() {
+	r.stop()
+}
+
+var _ BigQueryClient = (*BigQueryService)(nil)
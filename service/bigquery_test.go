@@ -0,0 +1,309 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+func TestQueryJobWithStatistics(t *testing.T) {
+	tests := []struct {
+		name   string
+		status *bigquery.JobStatus
+		want   QueryJob
+	}{
+		{"no status", nil, QueryJob{ID: "j"}},
+		{"no statistics", &bigquery.JobStatus{}, QueryJob{ID: "j"}},
+		{"query", &bigquery.JobStatus{Statistics: &bigquery.JobStatistics{
+			TotalBytesProcessed: 2048,
+			Details:             &bigquery.QueryStatistics{},
+		}}, QueryJob{ID: "j", BytesProcessed: 2048}},
+		{"export data", &bigquery.JobStatus{Statistics: &bigquery.JobStatistics{
+			TotalBytesProcessed: 4096,
+			Details:             &bigquery.QueryStatistics{ExportDataStatistics: &bigquery.ExportDataStatistics{FileCount: 3, RowCount: 1500}},
+		}}, QueryJob{ID: "j", BytesProcessed: 4096, ExportedRows: 1500, ExportedFiles: 3}},
+		{"load", &bigquery.JobStatus{Statistics: &bigquery.JobStatistics{
+			TotalBytesProcessed: 10,
+			Details:             &bigquery.LoadStatistics{OutputRows: 7},
+		}}, QueryJob{ID: "j", BytesProcessed: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (QueryJob{ID: "j"}).withStatistics(tt.status); got != tt.want {
+				t.Errorf("withStatistics() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeBigQueryAPI is an httptest server speaking the parts of the BigQuery REST API the
+// client uses to run a query: jobs.insert, jobs.get, jobs.getQueryResults and jobs.cancel.
+// Jobs run until done is set, and then fail if failure is set.
+type fakeBigQueryAPI struct {
+	*httptest.Server
+	location string
+	failure  string // the error message of failed jobs
+
+	mu        sync.Mutex
+	done      bool
+	inserted  []map[string]any // the submitted job configurations
+	cancelled chan string      // receives the IDs of cancelled jobs
+}
+
+func newFakeBigQueryAPI(t *testing.T) *fakeBigQueryAPI {
+	t.Helper()
+	f := &fakeBigQueryAPI{location: "EU", cancelled: make(chan string, 1)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeBigQueryAPI) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := "RUNNING"
+	if f.done {
+		state = "DONE"
+	}
+	job := map[string]any{
+		"jobReference": map[string]any{"projectId": "test-project", "jobId": "job_1", "location": f.location},
+		"configuration": map[string]any{"query": map[string]any{
+			"query":            "SELECT 1",
+			"destinationTable": map[string]any{"projectId": "test-project", "datasetId": "_anon", "tableId": "result"},
+		}},
+		"status":     map[string]any{"state": state},
+		"statistics": map[string]any{"totalBytesProcessed": "2048", "query": map[string]any{}},
+	}
+	if f.done && f.failure != "" {
+		job["status"] = map[string]any{"state": state, "errorResult": map[string]any{"reason": "invalidQuery", "message": f.failure}}
+	}
+	var resp any = job
+	switch path := r.URL.Path; {
+	case r.Method == http.MethodPost && path == "/projects/test-project/jobs":
+		var body struct {
+			Configuration map[string]any `json:"configuration"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.inserted = append(f.inserted, body.Configuration)
+	case r.Method == http.MethodPost && path == "/projects/test-project/jobs/job_1/cancel":
+		f.cancelled <- "job_1"
+		resp = map[string]any{"job": job}
+	case path == "/projects/test-project/jobs/job_1":
+	case path == "/projects/test-project/queries/job_1":
+		resp = map[string]any{
+			"jobReference": job["jobReference"],
+			"jobComplete":  f.done,
+			"schema":       map[string]any{"fields": []any{map[string]any{"name": "id", "type": "INTEGER"}}},
+			"rows":         []any{map[string]any{"f": []any{map[string]any{"v": "1"}}}},
+			"totalRows":    "1",
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// service returns a BigQueryService talking to the fake.
+func (f *fakeBigQueryAPI) service(t *testing.T) *BigQueryService {
+	t.Helper()
+	s, err := NewBigQueryService(context.Background(), "test-project", option.WithEndpoint(f.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// submitted waits for the first job to be inserted.
+func (f *fakeBigQueryAPI) submitted(t *testing.T) {
+	t.Helper()
+	for range 500 {
+		f.mu.Lock()
+		n := len(f.inserted)
+		f.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no job submitted")
+}
+
+func TestBigQueryServiceCancelsJob(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(ctx context.Context, s *BigQueryService) error
+	}{
+		{"run query", func(ctx context.Context, s *BigQueryService) error {
+			_, err := s.RunQuery(ctx, "EXPORT DATA AS SELECT 1", "EU")
+			return err
+		}},
+		{"read rows", func(ctx context.Context, s *BigQueryService) error {
+			_, err := s.ReadRows(ctx, "SELECT 1", "EU")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeBigQueryAPI(t)
+			s := api.service(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			errc := make(chan error, 1)
+			go func() { errc <- tt.run(ctx, s) }()
+			api.submitted(t)
+			cancel()
+			if err := <-errc; !errors.Is(err, context.Canceled) {
+				t.Errorf("error = %v, want context.Canceled", err)
+			}
+			select {
+			case id := <-api.cancelled:
+				if id != "job_1" {
+					t.Errorf("cancelled job %s, want job_1", id)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("the BigQuery job was not cancelled")
+			}
+		})
+	}
+}
+
+func TestBigQueryRowIteratorCloseKeepsJob(t *testing.T) {
+	api := newFakeBigQueryAPI(t)
+	api.done = true
+	s := api.service(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	it, err := s.ReadRows(ctx, "SELECT 1", "EU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil || len(row) != 1 || row[0] != int64(1) {
+		t.Fatalf("Next() = %v, %v, want [1]", row, err)
+	}
+	// Once the rows are read, the caller going away leaves the finished job alone
+	it.Close()
+	cancel()
+	select {
+	case <-api.cancelled:
+		t.Error("closed iterator still cancelled the job")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBigQueryServiceLabelsRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want map[string]any
+	}{
+		// Label values must be lower case
+		{"request ID", "Req-42_A", map[string]any{"request_id": "req-42_a"}},
+		{"no request ID", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeBigQueryAPI(t)
+			api.done = true
+			ctx := context.Background()
+			if tt.id != "" {
+				ctx = logging.WithRequestID(ctx, tt.id)
+			}
+			if _, err := api.service(t).RunQuery(ctx, "SELECT 1", "EU"); err != nil {
+				t.Fatal(err)
+			}
+			labels, _ := api.inserted[0]["labels"].(map[string]any)
+			if !maps.Equal(labels, tt.want) {
+				t.Errorf("job labels = %v, want %v", labels, tt.want)
+			}
+		})
+	}
+}
+
+// Parameters of the context go to the queries referencing them, keeping keys out of SQL.
+func TestBigQueryServiceQueryParameters(t *testing.T) {
+	api := newFakeBigQueryAPI(t)
+	api.done = true
+	ctx := withQueryParameters(context.Background(), bigquery.QueryParameter{Name: "deid_hmac_inner", Value: []byte{1, 2}})
+	for _, q := range []string{"SELECT SHA256(CONCAT(@deid_hmac_inner, b'x'))", "SELECT 1"} {
+		if _, err := api.service(t).RunQuery(ctx, q, "EU"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for _, job := range api.inserted {
+		query, _ := job["query"].(map[string]any)
+		params, _ := query["queryParameters"].([]any)
+		names := ""
+		for _, p := range params {
+			names += p.(map[string]any)["name"].(string)
+		}
+		got = append(got, names)
+	}
+	if !slices.Equal(got, []string{"deid_hmac_inner", ""}) {
+		t.Errorf("query parameters by job = %q", got)
+	}
+}
+
+func TestQueryJobConsoleURL(t *testing.T) {
+	tests := []struct {
+		name string
+		job  QueryJob
+		want string
+	}{
+		{"job", QueryJob{ProjectID: "p", ID: "job_1", Location: "asia-southeast2"},
+			"https://console.cloud.google.com/bigquery?project=p&j=bq:asia-southeast2:job_1&page=queryresults"},
+		{"escaped", QueryJob{ProjectID: "example.com:p", ID: "job 1", Location: "US"},
+			"https://console.cloud.google.com/bigquery?project=example.com%3Ap&j=bq:US:job+1&page=queryresults"},
+		{"no job", QueryJob{ProjectID: "p"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.job.ConsoleURL(); got != tt.want {
+				t.Errorf("ConsoleURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBigQueryServiceReportsJob(t *testing.T) {
+	api := newFakeBigQueryAPI(t)
+	api.done = true
+	s := api.service(t)
+	want := QueryJob{ProjectID: "test-project", ID: "job_1", Location: "EU", BytesProcessed: 2048}
+	if job, err := s.RunQuery(context.Background(), "SELECT 1", "EU"); err != nil || job != want {
+		t.Errorf("RunQuery() = %+v, %v, want %+v", job, err, want)
+	}
+	it, err := s.ReadRows(context.Background(), "SELECT 1", "EU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if job := it.Job(); job != want {
+		t.Errorf("ReadRows() job = %+v, want %+v", job, want)
+	}
+
+	// A failed job is reported with the error, to point operators at it
+	api.failure = "Unrecognized name: idd"
+	_, err = s.RunQuery(context.Background(), "SELECT idd", "EU")
+	var jobErr *JobError
+	if !errors.As(err, &jobErr) || jobErr.Job.ID != "job_1" || jobErr.Job.Location != "EU" {
+		t.Fatalf("RunQuery() error = %v, want a JobError for job_1", err)
+	}
+	if !strings.Contains(err.Error(), "Unrecognized name") {
+		t.Errorf("RunQuery() error = %v, want the job error", err)
+	}
+}
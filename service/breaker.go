@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDestinationUnavailable is returned for exports rejected while the circuit breaker of
+// their destination is open.
+var ErrDestinationUnavailable = errors.New("destination unavailable")
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breakerPoll is how often an export waiting for a half-open breaker checks whether the
+// trial export finished.
+const breakerPoll = 5 * time.Second
+
+// BreakerState is the status of the circuit breaker of one destination.
+type BreakerState struct {
+	Destination         string     `json:"destination"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	// RetryAt is when the next trial export may run, while the breaker is open
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// circuitBreakers stop exports into a destination that keeps failing, so an outage of
+// the StarRocks cluster or a bucket does not pile up exports that run their BigQuery
+// side only to fail on the load. After failures consecutive failed exports, the breaker
+// of the destination opens: for cooldown, new exports fail at once with
+// ErrDestinationUnavailable, or wait when wait is set. Then one trial export runs; its
+// success closes the breaker, its failure opens it again. Breakers are per instance.
+type circuitBreakers struct {
+	failures int
+	cooldown time.Duration
+	wait     bool
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breaker struct {
+	failures int
+	open     bool
+	trial    bool // a trial export runs
+	openedAt time.Time
+	retryAt  time.Time
+	lastErr  string
+	// tenants are the tenants whose exports reached the destination
+	tenants map[string]bool
+}
+
+// newCircuitBreakersFromEnv reads CIRCUIT_BREAKER_FAILURES (default 5, 0 disables the
+// breakers), CIRCUIT_BREAKER_COOLDOWN (default 1m) and CIRCUIT_BREAKER_MODE (fail,
+// the default, or wait).
+func newCircuitBreakersFromEnv() *circuitBreakers {
+	b := &circuitBreakers{failures: 5, cooldown: time.Minute, breakers: map[string]*breaker{}}
+	if n, err := strconv.Atoi(os.Getenv("CIRCUIT_BREAKER_FAILURES")); err == nil && n >= 0 {
+		b.failures = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("CIRCUIT_BREAKER_COOLDOWN")); err == nil && d > 0 {
+		b.cooldown = d
+	}
+	b.wait = strings.EqualFold(os.Getenv("CIRCUIT_BREAKER_MODE"), "wait")
+	return b
+}
+
+// breakerDestination returns the destination an export's breaker is keyed by: what the
+// driver keys it by, or the host of a URL output, such as a GCS bucket, or the driver,
+// such as the StarRocks cluster.
+func breakerDestination(driver ExportDriver, p ExportParams) string {
+	if k, ok := driver.(breakerKeyer); ok {
+		return k.breakerDestination(p)
+	}
+	if u, err := url.Parse(p.Output); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return strings.ToLower(driver.Name())
+}
+
+// breakerKeyer is implemented by drivers whose breakers are keyed by more than their
+// output, such as the dataset of BigQuery tables.
+type breakerKeyer interface {
+	breakerDestination(p ExportParams) string
+}
+
+// breakerTicket admits one export past a breaker.
+type breakerTicket struct {
+	b           *circuitBreakers
+	destination string
+	trial       bool
+	reported    bool
+}
+
+// admit lets an export into destination, failing with ErrDestinationUnavailable while
+// its breaker is open, or, in wait mode, waiting until it may run, calling wait with
+// when it may try again. The export reports its outcome on the ticket.
+func (b *circuitBreakers) admit(ctx context.Context, destination string, wait func(until time.Time, err error)) (*breakerTicket, error) {
+	if b == nil || b.failures == 0 {
+		return nil, nil
+	}
+	for {
+		trial, until, err := b.enter(ctx, destination)
+		if err == nil {
+			return &breakerTicket{b: b, destination: destination, trial: trial}, nil
+		}
+		if !b.wait {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "Waiting for the destination to recover", "destination", destination, "until", until)
+		wait(until, err)
+		if werr := waitUntil(ctx, until); werr != nil {
+			return nil, fmt.Errorf("%w (waiting after: %v)", werr, err)
+		}
+	}
+}
+
+// enter admits an export into destination, reporting whether it is the trial export of
+// an open breaker, or returns the error and when to try again while the breaker is open.
+func (b *circuitBreakers) enter(ctx context.Context, destination string) (bool, time.Time, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.breakers[destination]
+	if br == nil {
+		br = &breaker{tenants: map[string]bool{}}
+		b.breakers[destination] = br
+	}
+	if tenant, _, ok := TenantFrom(ctx); ok {
+		br.tenants[tenant] = true
+	}
+	now := time.Now()
+	switch {
+	case !br.open:
+		return false, time.Time{}, nil
+	case !br.trial && !now.Before(br.retryAt):
+		br.trial = true
+		slog.InfoContext(ctx, "Trying the destination again", "destination", destination)
+		return true, time.Time{}, nil
+	}
+	until := br.retryAt
+	if br.trial {
+		until = now.Add(breakerPoll)
+	}
+	return false, until, fmt.Errorf("%w: %s failed %d exports in a row, retry after %s (last error: %s)",
+		ErrDestinationUnavailable, destination, br.failures, until.UTC().Format(time.RFC3339), br.lastErr)
+}
+
+// report records the outcome of the admitted export: a success closes the breaker and a
+// destination failure counts towards opening it. Cancelled exports and errors not caused
+// by the destination (configuration, data, BigQuery quotas, locked tables) do not count.
+func (t *breakerTicket) report(ctx context.Context, err error) {
+	if t == nil || t.reported {
+		return
+	}
+	t.reported = true
+	b := t.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.breakers[t.destination]
+	if t.trial {
+		br.trial = false
+	}
+	switch {
+	case err == nil:
+		if br.open {
+			slog.InfoContext(ctx, "Destination recovered; circuit breaker closed", "destination", t.destination)
+		}
+		br.failures, br.open, br.lastErr = 0, false, ""
+	case ctx.Err() != nil || !breakerFailure(err):
+	default:
+		br.failures++
+		br.lastErr = err.Error()
+		if t.trial || (!br.open && br.failures >= b.failures) {
+			now := time.Now()
+			if !br.open {
+				br.openedAt = now
+			}
+			br.open, br.retryAt = true, now.Add(b.cooldown)
+			slog.WarnContext(ctx, "Destination keeps failing; circuit breaker opened", "destination", t.destination,
+				"consecutive_failures", br.failures, "retry_at", br.retryAt, "error", err)
+		}
+	}
+}
+
+// release frees the trial of an export that ends without reporting its outcome.
+func (t *breakerTicket) release() {
+	if t == nil || t.reported {
+		return
+	}
+	t.reported = true
+	if t.trial {
+		t.b.mu.Lock()
+		t.b.breakers[t.destination].trial = false
+		t.b.mu.Unlock()
+	}
+}
+
+// breakerFailure reports whether err counts as a failure of the destination.
+func breakerFailure(err error) bool {
+	switch FailureClass(err) {
+	case FailureConfig, FailureData:
+		return false
+	}
+	return !bigQueryQuotaError(err) && !errors.Is(err, ErrDestinationLocked) && !errors.Is(err, ErrDestinationUnavailable)
+}
+
+// List returns the breakers of the destinations, by destination. Tenant callers see the
+// destinations their exports reached, without the errors of the failed exports.
+func (b *circuitBreakers) List(ctx context.Context) []BreakerState {
+	out := []BreakerState{}
+	if b == nil {
+		return out
+	}
+	tenant, _, isTenant := TenantFrom(ctx)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for destination, br := range b.breakers {
+		if isTenant && !br.tenants[tenant] {
+			continue
+		}
+		st := BreakerState{Destination: destination, State: BreakerClosed, ConsecutiveFailures: br.failures}
+		if br.open {
+			opened, retry := br.openedAt, br.retryAt
+			st.State, st.OpenedAt, st.RetryAt = BreakerOpen, &opened, &retry
+			if br.trial || !time.Now().Before(retry) {
+				st.State = BreakerHalfOpen
+			}
+		}
+		if !isTenant {
+			st.LastError = br.lastErr
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Destination < out[j].Destination })
+	return out
+}
+
+// Breakers returns the circuit breakers of the exporter's destinations.
+func (e *Exporter) Breakers(ctx context.Context) []BreakerState {
+	return e.breakers.List(ctx)
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	bq := &fakeBigQuery{err: &googleapi.Error{Code: 503, Message: "backend unavailable"}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	e.breakers = &circuitBreakers{failures: 2, cooldown: 20 * time.Millisecond, breakers: map[string]*breaker{}}
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/"}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := e.Run(ctx, params); err == nil || errors.Is(err, ErrDestinationUnavailable) {
+			t.Fatalf("Run() #%d error = %v, want the destination error", i+1, err)
+		}
+	}
+	queries := len(bq.queries)
+	_, err := e.Run(ctx, params)
+	if !errors.Is(err, ErrDestinationUnavailable) || FailureClass(err) != FailureTransient {
+		t.Fatalf("Run() with an open breaker error = %v, want ErrDestinationUnavailable", err)
+	}
+	if len(bq.queries) != queries {
+		t.Errorf("Run() with an open breaker ran %d queries", len(bq.queries)-queries)
+	}
+	if st := e.Breakers(ctx); len(st) != 1 || st[0].Destination != "gs://b" || st[0].State != BreakerOpen || st[0].ConsecutiveFailures != 2 {
+		t.Errorf("Breakers() = %+v, want gs://b open after 2 failures", st)
+	}
+	// Other destinations are not affected
+	other := params
+	other.Output = "gs://other/out/"
+	if _, err := e.Run(ctx, other); errors.Is(err, ErrDestinationUnavailable) {
+		t.Errorf("Run() into another bucket error = %v", err)
+	}
+
+	// After the cooldown a failed trial opens the breaker again, a successful one closes it
+	time.Sleep(25 * time.Millisecond)
+	if _, err := e.Run(ctx, params); err == nil || errors.Is(err, ErrDestinationUnavailable) {
+		t.Fatalf("trial Run() error = %v, want the destination error", err)
+	}
+	if _, err := e.Run(ctx, params); !errors.Is(err, ErrDestinationUnavailable) {
+		t.Fatalf("Run() after a failed trial error = %v, want ErrDestinationUnavailable", err)
+	}
+	time.Sleep(25 * time.Millisecond)
+	bq.err = nil
+	if _, err := e.Run(ctx, params); err != nil {
+		t.Fatalf("trial Run() error = %v", err)
+	}
+	if st := e.Breakers(ctx); st[0].State != BreakerClosed || st[0].ConsecutiveFailures != 0 {
+		t.Errorf("Breakers() after a successful trial = %+v, want closed", st[0])
+	}
+
+	// Errors of the request do not count
+	if breakerFailure(ConfigError(errors.New("invalid output"))) {
+		t.Error("breakerFailure() of a config error = true")
+	}
+}
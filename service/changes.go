@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// ChangesModeChanges reads inserts, updates and deletes with the CHANGES table
+	// function; rows carry _CHANGE_TYPE and _CHANGE_TIMESTAMP.
+	ChangesModeChanges = "changes"
+	// ChangesModeAppends reads appended rows only with the APPENDS table function.
+	ChangesModeAppends = "appends"
+
+	// changesLag keeps the window end behind the present: CHANGES only accepts an end
+	// timestamp at least ten minutes in the past.
+	changesLag = 11 * time.Minute
+)
+
+// runChanges exports the change history of params.ChangesTable since the previous run.
+// The end of the last exported window is kept per export in the BigQuery table named by
+// WATERMARK_TABLE; the first run starts at the beginning of the time travel window. The
+// watermark only advances after the driver succeeded.
+func (e *Exporter) runChanges(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	source, err := resolveBigQueryTable(params.ChangesTable, "")
+	if err != nil || !strings.Contains(params.ChangesTable, ".") {
+		return ExportResult{}, ConfigError(fmt.Errorf("changes_table must be a BigQuery table in dataset.table or project.dataset.table format, got %q", params.ChangesTable))
+	}
+	mode := strings.ToLower(params.ChangesMode)
+	if mode == "" {
+		mode = ChangesModeChanges
+	}
+	if mode != ChangesModeChanges && mode != ChangesModeAppends {
+		return ExportResult{}, ConfigError(fmt.Errorf("unknown changes_mode %q; expected changes or appends", params.ChangesMode))
+	}
+	wmTable := os.Getenv("WATERMARK_TABLE")
+	if !strings.Contains(wmTable, ".") {
+		return ExportResult{}, ConfigError(fmt.Errorf("change history exports need WATERMARK_TABLE (dataset.table) to store their watermarks"))
+	}
+	if wmTable, err = resolveBigQueryTable(wmTable, ""); err != nil {
+		return ExportResult{}, err
+	}
+	key := watermarkKey(params, source)
+
+	if job, err := bq.RunQuery(ctx, buildWatermarkTableSQL(wmTable), params.QueryLocation); err != nil {
+		return ExportResult{Job: job}, fmt.Errorf("failed to create watermark table %s: %w", wmTable, err)
+	}
+	start, err := readWatermark(ctx, bq, wmTable, key, params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	end := time.Now().UTC().Add(-changesLag).Truncate(time.Second)
+	if start != nil && !end.After(*start) {
+		slog.InfoContext(ctx, "No new change history window yet", "source", source, "watermark", *start)
+		return ExportResult{}, nil
+	}
+
+	slog.InfoContext(ctx, "Exporting BigQuery change history", "source", source, "mode", mode, "key", key,
+		"start", start, "end", end)
+	changesParams := params
+	query, err := rowFilterQuery(params.Query, params)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if changesParams.Query, err = params.deid.deidentify(ctx, bq, dedupQuery(buildChangesQuery(mode, source, start, end, query, params.rowFilters, params.KeyColumns), params), params.QueryLocation); err != nil {
+		return ExportResult{}, err
+	}
+	if params.LineageColumns {
+		changesParams.Query = lineageQuery(ctx, changesParams.Query, params)
+	}
+	res, err := e.Driver.Execute(ctx, bq, changesParams)
+	if err != nil {
+		return res, err
+	}
+	if _, err := bq.RunQuery(ctx, buildWatermarkInsertSQL(wmTable, key, source, end), params.QueryLocation); err != nil {
+		return res, fmt.Errorf("changes were exported but the watermark could not be stored (the next run will re-send them): %w", err)
+	}
+	return res, nil
+}
+
+// watermarkKey identifies an incremental export: its logical name, or the source and
+// destination it connects.
+func watermarkKey(p ExportParams, source string) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	dest := p.Table
+	if p.Database != "" && !strings.Contains(dest, ".") {
+		dest = p.Database + "." + dest
+	}
+	if dest == "" {
+		dest = p.Output + p.Filename
+	}
+	return source + "->" + dest
+}
+
+func buildWatermarkTableSQL(table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (export_key STRING, source_table STRING, watermark TIMESTAMP, updated_at TIMESTAMP);", quoteBigQueryTable(table))
+}
+
+func buildWatermarkInsertSQL(table, key, source string, end time.Time) string {
+	return fmt.Sprintf("INSERT INTO %s (export_key, source_table, watermark, updated_at) VALUES (%s, %s, %s, CURRENT_TIMESTAMP());",
+		quoteBigQueryTable(table), quoteBigQueryString(key), quoteBigQueryString(source), bigQueryTimestamp(end))
+}
+
+// readWatermark returns the latest stored watermark for key, or nil before the first run.
+func readWatermark(ctx context.Context, bq BigQueryClient, table, key, location string) (*time.Time, error) {
+	q := fmt.Sprintf("SELECT watermark FROM %s WHERE export_key = %s ORDER BY updated_at DESC LIMIT 1", quoteBigQueryTable(table), quoteBigQueryString(key))
+	it, err := bq.ReadRows(ctx, q, location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watermark: %w", err)
+	}
+	defer it.Close()
+	var row []bigquery.Value
+	if err := it.Next(&row); err == iterator.Done {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read watermark: %w", err)
+	}
+	if len(row) == 0 || row[0] == nil {
+		return nil, nil
+	}
+	t, ok := row[0].(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("unexpected watermark value %v", row[0])
+	}
+	return &t, nil
+}
+
+// buildChangesQuery selects the change history of source in (start, end], keeping the
+// rows satisfying rowFilters, in the order of the changes. With keys, only the latest
+// change of every key is kept (a delete too), so a key changed several times in the
+// window is loaded once, in its final state. A user query, if given, runs on top of it
+// and refers to the history as the table "changes".
+func buildChangesQuery(mode, source string, start *time.Time, end time.Time, query string, rowFilters, keys []string) string {
+	startArg := "NULL"
+	if start != nil {
+		startArg = bigQueryTimestamp(*start)
+	}
+	fn := "CHANGES"
+	if mode == ChangesModeAppends {
+		fn = "APPENDS"
+	}
+	history := fmt.Sprintf("SELECT * FROM %s(TABLE %s, %s, %s)", fn, quoteBigQueryTable(source), startArg, bigQueryTimestamp(end))
+	switch {
+	case len(rowFilters) > 0:
+		history += " WHERE " + rowFilterCondition(rowFilters)
+	case len(keys) > 0:
+		// BigQuery only accepts QUALIFY along with WHERE, GROUP BY or HAVING
+		history += " WHERE TRUE"
+	}
+	if len(keys) > 0 {
+		cols := make([]string, len(keys))
+		for i, k := range keys {
+			cols[i] = quoteBigQueryColumn(k)
+		}
+		// A delete and a re-insert of a key in one statement share their timestamp; the
+		// insert wins
+		history += fmt.Sprintf(" QUALIFY ROW_NUMBER() OVER (PARTITION BY %s ORDER BY _CHANGE_TIMESTAMP DESC, _CHANGE_TYPE = 'DELETE') = 1",
+			strings.Join(cols, ", "))
+	}
+	if strings.TrimSpace(query) == "" {
+		return history + " ORDER BY _CHANGE_TIMESTAMP"
+	}
+	return fmt.Sprintf("WITH changes AS (%s)\n%s", history, query)
+}
+
+func bigQueryTimestamp(t time.Time) string {
+	return "TIMESTAMP '" + t.UTC().Format("2006-01-02 15:04:05.999999") + "+00'"
+}
+
+func quoteBigQueryString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`).Replace(s) + "'"
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestBuildChangesQuery(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)
+	got := buildChangesQuery(ChangesModeChanges, "ds.visits", &start, end, "", nil, nil)
+	want := "SELECT * FROM CHANGES(TABLE `ds.visits`, TIMESTAMP '2026-10-01 00:00:00+00', TIMESTAMP '2026-10-02 00:00:00+00') ORDER BY _CHANGE_TIMESTAMP"
+	if got != want {
+		t.Errorf("buildChangesQuery() = %q, want %q", got, want)
+	}
+	got = buildChangesQuery(ChangesModeAppends, "ds.visits", nil, end, "SELECT id FROM changes", nil, nil)
+	if !strings.HasPrefix(got, "WITH changes AS (SELECT * FROM APPENDS(TABLE `ds.visits`, NULL,") || !strings.HasSuffix(got, "\nSELECT id FROM changes") {
+		t.Errorf("buildChangesQuery() with user query = %q", got)
+	}
+	got = buildChangesQuery(ChangesModeChanges, "ds.visits", nil, end, "", []string{"site_id = 'A1'"}, nil)
+	if !strings.HasSuffix(got, ") WHERE (site_id = 'A1') ORDER BY _CHANGE_TIMESTAMP") {
+		t.Errorf("buildChangesQuery() with row filters = %q", got)
+	}
+
+	// The latest change of every key, deletes included
+	tests := []struct {
+		rowFilters []string
+		want       string
+	}{
+		{nil, ") WHERE TRUE QUALIFY ROW_NUMBER() OVER (PARTITION BY `site`, `id` ORDER BY _CHANGE_TIMESTAMP DESC, _CHANGE_TYPE = 'DELETE') = 1 ORDER BY _CHANGE_TIMESTAMP"},
+		{[]string{"site = 'A1'"}, ") WHERE (site = 'A1') QUALIFY ROW_NUMBER() OVER (PARTITION BY `site`, `id` ORDER BY _CHANGE_TIMESTAMP DESC, _CHANGE_TYPE = 'DELETE') = 1 ORDER BY _CHANGE_TIMESTAMP"},
+	}
+	for _, tt := range tests {
+		if got := buildChangesQuery(ChangesModeChanges, "ds.visits", nil, end, "", tt.rowFilters, []string{"site", "id"}); !strings.HasSuffix(got, tt.want) {
+			t.Errorf("buildChangesQuery(keys, %q) = %q, want suffix %q", tt.rowFilters, got, tt.want)
+		}
+	}
+}
+
+func TestRunChanges(t *testing.T) {
+	t.Setenv("WATERMARK_TABLE", "ops.watermarks")
+	start := time.Now().Add(-24 * time.Hour).UTC()
+	bq := &fakeBigQuery{rows: [][]bigquery.Value{{start}}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	_, err := e.Run(context.Background(), ExportParams{
+		Name:          "visits_changes",
+		QueryLocation: "US",
+		Output:        "gs://b/changes/",
+		ChangesTable:  "ds.visits",
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	// create watermark table, read watermark, export, store watermark
+	if len(bq.queries) != 4 {
+		t.Fatalf("queries = %d, want 4: %q", len(bq.queries), bq.queries)
+	}
+	if !strings.Contains(bq.queries[1], "WHERE export_key = 'visits_changes'") {
+		t.Errorf("watermark read = %s", bq.queries[1])
+	}
+	if !strings.Contains(bq.queries[2], "CHANGES(TABLE `ds.visits`, "+bigQueryTimestamp(start)) {
+		t.Errorf("export does not start at the stored watermark: %s", bq.queries[2])
+	}
+	if !strings.HasPrefix(bq.queries[3], "INSERT INTO `ops.watermarks`") {
+		t.Errorf("watermark insert = %s", bq.queries[3])
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Granularities of chunked exports.
+const (
+	ChunkDay   = "day"
+	ChunkWeek  = "week"
+	ChunkMonth = "month"
+)
+
+// maxChunks bounds the date ranges of a chunked export.
+const maxChunks = 1000
+
+// ChunkPending is the status of the chunks of a chunked export left after a failed one.
+const ChunkPending = "pending"
+
+// ExportChunk is the outcome of the export of one date range of a chunked export.
+type ExportChunk struct {
+	// Start and End bound the range: Start <= date < End
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Status string `json:"status"`
+	// JobID is the chunk's run in the job history, to retry it on its own
+	JobID          string `json:"job_id,omitempty"`
+	Rows           int64  `json:"rows"`
+	Files          int64  `json:"files_written,omitempty"`
+	BytesProcessed int64  `json:"bytes_processed,omitempty"`
+	GCSPath        string `json:"gcs_path,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// dateChunks splits [start, end) into day, week or month ranges. Months follow the
+// calendar; weeks count from start.
+func dateChunks(start, end, by string) ([][2]time.Time, error) {
+	from, err := time.Parse(time.DateOnly, start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk_start %q; expected YYYY-MM-DD", start)
+	}
+	to, err := time.Parse(time.DateOnly, end)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk_end %q; expected YYYY-MM-DD", end)
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("chunk_start %s must be before chunk_end %s", start, end)
+	}
+	next := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	switch cmp.Or(by, ChunkMonth) {
+	case ChunkDay:
+	case ChunkWeek:
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+	case ChunkMonth:
+		next = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC) }
+	default:
+		return nil, fmt.Errorf("unknown chunk_by %q; expected day, week or month", by)
+	}
+	var out [][2]time.Time
+	for t := from; t.Before(to); t = next(t) {
+		if len(out) == maxChunks {
+			return nil, fmt.Errorf("chunk_start to chunk_end spans more than %d chunks; use a coarser chunk_by", maxChunks)
+		}
+		end := next(t)
+		if end.After(to) {
+			end = to
+		}
+		out = append(out, [2]time.Time{t, end})
+	}
+	return out, nil
+}
+
+// runChunks exports the result of params one date range of ChunkColumn at a time, from
+// ChunkStart to ChunkEnd, each range a separate EXPORT DATA and run in the job history, so
+// no export hits BigQuery's result and file limits and a failed range can be resumed on
+// its own. Ranges run in order and stop at the first failure; all read the same point in
+// time. The result adds up their rows and lists every range in Chunks.
+func (e *Exporter) runChunks(ctx context.Context, params ExportParams) (ExportResult, error) {
+	if params.ChunkStart == "" || params.ChunkEnd == "" {
+		return ExportResult{}, ConfigError(fmt.Errorf("chunk_column needs chunk_start and chunk_end"))
+	}
+	if params.ShardCount > 1 || params.ShardLabel != "" {
+		return ExportResult{}, ConfigError(fmt.Errorf("chunked exports cannot be sharded"))
+	}
+	ranges, err := dateChunks(params.ChunkStart, params.ChunkEnd, params.ChunkBy)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if params, err = resolveSnapshotTime(params, time.Now()); err != nil {
+		return ExportResult{}, err
+	}
+	column := quoteBigQueryColumn(params.ChunkColumn)
+	// The chunks' recorded parameters carry their range, so a retry exports just that one
+	params.ChunkColumn, params.ChunkBy, params.ChunkStart, params.ChunkEnd = "", "", "", ""
+
+	slog.InfoContext(ctx, "Running chunked export", "column", column, "chunks", len(ranges))
+	total := ExportResult{Chunks: make([]ExportChunk, len(ranges))}
+	for i, r := range ranges {
+		total.Chunks[i] = ExportChunk{Start: r[0].Format(time.DateOnly), End: r[1].Format(time.DateOnly), Status: ChunkPending}
+	}
+	for i := range ranges {
+		c := &total.Chunks[i]
+		p := params
+		p.Query = fmt.Sprintf("SELECT * FROM (%s) WHERE CAST(%s AS DATE) >= DATE %s AND CAST(%s AS DATE) < DATE %s",
+			params.Query, column, quoteBigQueryString(c.Start), column, quoteBigQueryString(c.End))
+		p.ShardLabel = c.Start
+		chunkCtx := withChildRequestID(ctx, i+1)
+		res, err := e.Run(chunkCtx, p)
+		c.JobID, c.Rows, c.Files, c.BytesProcessed, c.GCSPath, c.Status = logging.RequestID(chunkCtx), res.Rows, res.Files, res.BytesProcessed, res.GCSPath, JobSucceeded
+		total.GCSPath, total.Table, total.Job = res.GCSPath, res.Table, res.Job
+		total.Rows += res.Rows
+		total.RowsDeleted += res.RowsDeleted
+		total.BytesProcessed += res.BytesProcessed
+		total.Files += res.Files
+		total.BytesWritten += res.BytesWritten
+		total.Statements = append(total.Statements, res.Statements...)
+		if err != nil {
+			c.Status, c.Error = JobFailed, err.Error()
+			return total, fmt.Errorf("chunk %s to %s: %w", c.Start, c.End, err)
+		}
+		slog.InfoContext(ctx, "Export chunk completed", "start", c.Start, "end", c.End, "rows", res.Rows)
+	}
+	return total, nil
+}
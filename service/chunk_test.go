@@ -0,0 +1,74 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDateChunks(t *testing.T) {
+	for _, tc := range []struct {
+		by, start, end string
+		want           []string
+	}{
+		{ChunkMonth, "2026-01-15", "2026-03-10", []string{"2026-01-15", "2026-02-01", "2026-03-01"}},
+		{ChunkWeek, "2026-01-01", "2026-01-20", []string{"2026-01-01", "2026-01-08", "2026-01-15"}},
+		{ChunkDay, "2026-02-27", "2026-03-02", []string{"2026-02-27", "2026-02-28", "2026-03-01"}},
+	} {
+		ranges, err := dateChunks(tc.start, tc.end, tc.by)
+		if err != nil {
+			t.Fatalf("dateChunks(%s) error = %v", tc.by, err)
+		}
+		var starts []string
+		for _, r := range ranges {
+			starts = append(starts, r[0].Format("2006-01-02"))
+		}
+		if strings.Join(starts, ",") != strings.Join(tc.want, ",") || ranges[len(ranges)-1][1].Format("2006-01-02") != tc.end {
+			t.Errorf("dateChunks(%s) = %v, want starts %v ending %s", tc.by, ranges, tc.want, tc.end)
+		}
+	}
+	for _, bad := range [][3]string{{"2026-02-01", "2026-01-01", ""}, {"2026-01", "2026-02-01", ""}, {"2026-01-01", "2026-02-01", "hour"}, {"2000-01-01", "2026-01-01", ChunkDay}} {
+		if _, err := dateChunks(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("dateChunks(%v) error = nil, want an error", bad)
+		}
+	}
+}
+
+func TestRunChunks(t *testing.T) {
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	ctx := logging.WithRequestID(context.Background(), "run-1")
+	res, err := e.Run(ctx, ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/", Filename: "visits",
+		ChunkColumn: "visit_date", ChunkStart: "2026-01-01", ChunkEnd: "2026-03-01"})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	var exports []string
+	for _, q := range bq.queries {
+		if strings.Contains(q, "EXPORT DATA") {
+			exports = append(exports, q)
+		}
+	}
+	if len(exports) != 2 || !strings.Contains(exports[1], "CAST(`visit_date` AS DATE) >= DATE '2026-02-01' AND CAST(`visit_date` AS DATE) < DATE '2026-03-01'") ||
+		!strings.Contains(exports[1], "visits-2026-02-01-") {
+		t.Fatalf("exports = %q, want one per month into its own files", exports)
+	}
+	if len(res.Chunks) != 2 || res.Chunks[1].JobID != "run-1-2" || res.Chunks[1].Status != JobSucceeded {
+		t.Errorf("Run() chunks = %+v, want two succeeded chunks", res.Chunks)
+	}
+	if rec, ok := e.Jobs.Get(ctx, "run-1-2"); !ok || rec.Params["chunk_column"] != nil || !strings.Contains(rec.Params["query"].(string), "'2026-02-01'") {
+		t.Errorf("chunk job = %+v, want the chunk's own range recorded", rec.Params)
+	}
+
+	// A failed chunk stops the others
+	_, err = e.Run(logging.WithRequestID(context.Background(), "run-2"), ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/visits-*.parquet",
+		ChunkColumn: "visit_date", ChunkStart: "2026-01-01", ChunkEnd: "2026-03-01"})
+	if FailureClass(err) != FailureConfig || !strings.Contains(err.Error(), "chunk 2026-01-01 to 2026-02-01") {
+		t.Errorf("Run(object pattern) error = %v, want the first chunk to fail on the pattern", err)
+	}
+	if _, err := e.Run(ctx, ExportParams{Query: "SELECT 1", Output: "gs://b/out/", ChunkColumn: "visit_date"}); FailureClass(err) != FailureConfig {
+		t.Errorf("Run(no range) error = %v, want a config error", err)
+	}
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Kinds of CleanupAction.
+const (
+	// CleanupStarRocksTable drops a StarRocks table, e.g. the staging table of a swap load
+	CleanupStarRocksTable = "starrocks_table"
+	// CleanupBigQueryTable drops a BigQuery table, e.g. the next snapshot of a diff
+	CleanupBigQueryTable = "bigquery_table"
+	// CleanupGCSPrefix deletes the objects under a gs:// prefix, e.g. staged files
+	CleanupGCSPrefix = "gcs_prefix"
+	// CleanupGCSObject deletes a gs:// object, e.g. a file of a failed export
+	CleanupGCSObject = "gcs_object"
+)
+
+const (
+	// cleanupKeyPrefix prefixes the keys of the pending cleanup actions of all
+	// instances, one per action, holding it as JSON
+	cleanupKeyPrefix = "cleanup:action:"
+	// cleanupTimeout bounds the cleanup actions of one run
+	cleanupTimeout = 2 * time.Minute
+)
+
+// CleanupAction removes the debris an export leaves when it fails partway: a staging
+// table, or the files it staged or wrote so far.
+type CleanupAction struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	// Location is the BigQuery location of CleanupBigQueryTable actions
+	Location string `json:"location,omitempty"`
+	// RunID is the run that registered the action, Instance the instance running it
+	RunID      string    `json:"run_id"`
+	Instance   string    `json:"instance"`
+	Registered time.Time `json:"registered"`
+}
+
+// Cleanups registers the cleanup actions of running exports with the coordinator before
+// the debris they remove is created. The actions still pending when an export fails are
+// run; those of an instance that crashed are run by the next instance to recover them
+// (see Recover), which needs a shared coordinator (COORDINATION_URL) to outlive the
+// instance.
+type Cleanups struct {
+	instance *Instance
+	coord    Coordinator
+	// StarRocks, GCS and BQ run the actions; actions without their client fail
+	StarRocks *StarRocksService
+	GCS       *GCSService
+	BQ        BigQueryClient
+}
+
+// NewCleanups returns the cleanup registry of instance, in its coordinator.
+func NewCleanups(instance *Instance) *Cleanups {
+	return &Cleanups{instance: instance, coord: instance.coord}
+}
+
+// remember stores a pending action under its own key, so registrations of concurrent
+// runs do not contend.
+func (c *Cleanups) remember(ctx context.Context, a CleanupAction) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return c.coord.Put(ctx, cleanupKeyPrefix+a.ID, data)
+}
+
+// pending returns the pending actions of all instances, in the order they registered.
+func (c *Cleanups) pending(ctx context.Context) ([]CleanupAction, error) {
+	values, err := c.coord.Scan(ctx, cleanupKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	actions := make([]CleanupAction, 0, len(values))
+	for key, data := range values {
+		var a CleanupAction
+		if err := json.Unmarshal(data, &a); err != nil {
+			slog.WarnContext(ctx, "Ignoring an invalid pending cleanup action", "key", key, "error", err)
+			continue
+		}
+		actions = append(actions, a)
+	}
+	slices.SortFunc(actions, func(a, b CleanupAction) int { return a.Registered.Compare(b.Registered) })
+	return actions, nil
+}
+
+func (c *Cleanups) forget(ctx context.Context, id string) error {
+	return c.coord.Delete(ctx, cleanupKeyPrefix+id)
+}
+
+// exec runs an action.
+func (c *Cleanups) exec(ctx context.Context, a CleanupAction) error {
+	switch a.Kind {
+	case CleanupStarRocksTable:
+		if c.StarRocks == nil {
+			return fmt.Errorf("dropping StarRocks table %s needs the StarRocks service", a.Target)
+		}
+		stmt := fmt.Sprintf("DROP TABLE IF EXISTS %s FORCE", a.Target)
+		recordStatement(ctx, StatementStarRocks, stmt)
+		_, err := c.StarRocks.db.ExecContext(ctx, stmt)
+		return err
+	case CleanupBigQueryTable:
+		if c.BQ == nil {
+			return fmt.Errorf("dropping BigQuery table %s needs a BigQuery client", a.Target)
+		}
+		_, err := c.BQ.RunQuery(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", quoteBigQueryTable(a.Target)), a.Location)
+		return err
+	case CleanupGCSPrefix, CleanupGCSObject:
+		if c.GCS == nil {
+			return fmt.Errorf("deleting %s needs a Cloud Storage client", a.Target)
+		}
+		bucket, name, err := parseGCSURI(a.Target)
+		if err != nil {
+			return err
+		}
+		if a.Kind == CleanupGCSObject {
+			return c.GCS.DeleteObject(ctx, bucket, name)
+		}
+		return c.GCS.DeletePrefix(ctx, bucket, name)
+	}
+	return fmt.Errorf("unknown cleanup action %q", a.Kind)
+}
+
+// Recover runs the pending actions of instances that stopped without running them, once
+// their lease has expired, and returns how many ran. Actions that fail stay pending.
+func (c *Cleanups) Recover(ctx context.Context) (int, error) {
+	actions, err := c.pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, a := range actions {
+		if stopped, err := c.instance.stopped(ctx, a.Instance); err != nil || !stopped {
+			continue
+		}
+		if err := c.exec(ctx, a); err != nil {
+			slog.WarnContext(ctx, "Failed to recover the cleanup of a crashed run", "run_id", a.RunID, "kind", a.Kind, "target", a.Target, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Cleaned up after a crashed run", "run_id", a.RunID, "kind", a.Kind, "target", a.Target)
+		if err := c.forget(ctx, a.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// cleanupScope holds the cleanup actions a run registered.
+type cleanupScope struct {
+	c       *Cleanups
+	mu      sync.Mutex
+	handles []*cleanupHandle
+}
+
+type cleanupCtxKey struct{}
+
+// withCleanups returns a copy of ctx in which a run registers its cleanup actions with c
+// (a nil c registers none), and the scope to finish when the run ends.
+func withCleanups(ctx context.Context, c *Cleanups) (context.Context, *cleanupScope) {
+	if c == nil {
+		return ctx, nil
+	}
+	s := &cleanupScope{c: c}
+	return context.WithValue(ctx, cleanupCtxKey{}, s), s
+}
+
+// finish runs the actions still pending when the run failed, and forgets them otherwise.
+func (s *cleanupScope) finish(ctx context.Context, failed bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	handles := s.handles
+	s.handles = nil
+	s.mu.Unlock()
+	if len(handles) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+	for _, h := range handles {
+		if failed {
+			if err := s.c.exec(ctx, h.action); err != nil {
+				slog.ErrorContext(ctx, "Failed to clean up after the failed export", "kind", h.action.Kind, "target", h.action.Target, "error", err)
+				continue
+			}
+			slog.InfoContext(ctx, "Cleaned up after the failed export", "kind", h.action.Kind, "target", h.action.Target)
+		}
+		h.done(ctx)
+	}
+}
+
+// cleanupHandle is a registered cleanup action.
+type cleanupHandle struct {
+	scope  *cleanupScope
+	action CleanupAction
+	once   sync.Once
+}
+
+// registerCleanup registers the action removing the debris of kind at target (see
+// CleanupAction) for the run of ctx, before the debris is created. It returns nil when
+// ctx registers no actions. A failure to register is logged: the action then still runs
+// if the run fails, but not after a crash.
+func registerCleanup(ctx context.Context, kind, target, location string) *cleanupHandle {
+	s, _ := ctx.Value(cleanupCtxKey{}).(*cleanupScope)
+	if s == nil {
+		return nil
+	}
+	h := &cleanupHandle{scope: s, action: CleanupAction{
+		ID:         logging.NewRequestID(),
+		Kind:       kind,
+		Target:     target,
+		Location:   location,
+		RunID:      logging.RequestID(ctx),
+		Instance:   s.c.instance.ID,
+		Registered: time.Now().UTC(),
+	}}
+	if err := s.c.remember(ctx, h.action); err != nil {
+		slog.WarnContext(ctx, "Failed to register a cleanup action", "kind", kind, "target", target, "error", err)
+	}
+	s.mu.Lock()
+	s.handles = append(s.handles, h)
+	s.mu.Unlock()
+	return h
+}
+
+// done forgets the action: its debris is gone, or now belongs to the destination.
+func (h *cleanupHandle) done(ctx context.Context) {
+	if h == nil {
+		return
+	}
+	h.detach()
+	h.once.Do(func() {
+		if err := h.scope.c.forget(context.WithoutCancel(ctx), h.action.ID); err != nil {
+			slog.WarnContext(ctx, "Failed to unregister a cleanup action", "kind", h.action.Kind, "target", h.action.Target, "error", err)
+		}
+	})
+}
+
+// detach takes the action out of its run, for debris that outlives the run, like the
+// staging tables of deferred swaps: it stays registered until done.
+func (h *cleanupHandle) detach() {
+	if h == nil {
+		return
+	}
+	s := h.scope
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handles = slices.DeleteFunc(s.handles, func(o *cleanupHandle) bool { return o == h })
+}
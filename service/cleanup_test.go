@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestCleanupsOfFailedRun(t *testing.T) {
+	gcs := newFakeGCS(t)
+	c := NewCleanups(NewInstance(newLocalCoordinator()))
+	c.GCS = gcs.service(t)
+	d := NewParquetWriteDriver(c.GCS)
+	params := ExportParams{Query: "SELECT 1", Output: "gs://b/out/", Filename: "visits", MaxFileRows: 1}
+	schema := bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}}
+
+	// The files written before the failing one are deleted
+	bad := &fakeBigQuery{schema: schema, rows: [][]bigquery.Value{{int64(1)}, {int64(2)}, {"three"}}}
+	ctx, scope := withCleanups(context.Background(), c)
+	if _, err := d.Execute(ctx, bad, params); err == nil {
+		t.Fatal("Execute() of an invalid row succeeded")
+	}
+	if len(gcs.objects) != 2 {
+		t.Fatalf("objects before cleanup = %v", gcs.names())
+	}
+	scope.finish(ctx, true)
+	if len(gcs.objects) != 0 {
+		t.Errorf("objects after cleanup = %v, want none", gcs.names())
+	}
+	if pending, _ := c.pending(ctx); len(pending) != 0 {
+		t.Errorf("pending actions after cleanup = %+v", pending)
+	}
+
+	// Those of a successful run stay
+	good := &fakeBigQuery{schema: schema, rows: [][]bigquery.Value{{int64(1)}, {int64(2)}}}
+	ctx, scope = withCleanups(context.Background(), c)
+	if _, err := d.Execute(ctx, good, params); err != nil {
+		t.Fatal(err)
+	}
+	scope.finish(ctx, false)
+	if want := []string{"out/visits-000000000000.parquet", "out/visits-000000000001.parquet"}; !slices.Equal(gcs.names(), want) {
+		t.Errorf("objects = %v, want %v", gcs.names(), want)
+	}
+	if pending, _ := c.pending(ctx); len(pending) != 0 {
+		t.Errorf("pending actions after success = %+v", pending)
+	}
+}
+
+func TestCleanupsRecover(t *testing.T) {
+	mr := miniredis.RunT(t)
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{}
+	ctx := context.Background()
+
+	instance := NewInstance(newTestRedisCoordinator(t, mr))
+	if err := instance.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	crashed := NewCleanups(instance)
+	runCtx, _ := withCleanups(ctx, crashed)
+	gcs.objects["stage/part-0.csv"] = []byte("1\n")
+	registerCleanup(runCtx, CleanupGCSPrefix, "gs://b/stage/", "")
+	registerCleanup(runCtx, CleanupBigQueryTable, "prj.ds.visits__next", "EU")
+	done := registerCleanup(runCtx, CleanupGCSObject, "gs://b/out/kept.csv", "")
+	done.done(runCtx)
+
+	other := NewCleanups(NewInstance(newTestRedisCoordinator(t, mr)))
+	other.GCS, other.BQ = gcs.service(t), bq
+	// The actions of a live instance are left alone
+	if n, err := other.Recover(ctx); n != 0 || err != nil {
+		t.Fatalf("Recover() of a live instance = %d, %v", n, err)
+	}
+	// The instance crashed: its lease expires without being renewed or freed
+	mr.FastForward(leaseTTL + time.Second)
+	if n, err := other.Recover(ctx); n != 2 || err != nil {
+		t.Fatalf("Recover() = %d, %v, want 2 actions", n, err)
+	}
+	if len(gcs.objects) != 0 {
+		t.Errorf("objects after recovery = %v", gcs.names())
+	}
+	if len(bq.queries) != 1 || bq.queries[0] != "DROP TABLE IF EXISTS `prj.ds.visits__next`;" {
+		t.Errorf("queries = %q", bq.queries)
+	}
+	if pending, _ := other.pending(ctx); len(pending) != 0 {
+		t.Errorf("pending actions after recovery = %+v", pending)
+	}
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"fmt"
+	"math/big"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// celNowVariable is the variable holding the start of the export in computed column
+// expressions, unless the result has a column of that name.
+const celNowVariable = "now"
+
+var (
+	celIdentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// celReserved are identifiers CEL does not allow as variable names
+	celReserved = map[string]bool{
+		"false": true, "in": true, "null": true, "true": true, "as": true, "break": true, "const": true,
+		"continue": true, "else": true, "for": true, "function": true, "if": true, "import": true,
+		"let": true, "loop": true, "package": true, "namespace": true, "return": true, "var": true,
+		"void": true, "while": true,
+	}
+)
+
+// computedColumnTypes are the types of computed columns by their names in requests.
+var computedColumnTypes = map[string]bigquery.FieldType{
+	"STRING":    bigquery.StringFieldType,
+	"INT64":     bigquery.IntegerFieldType,
+	"INTEGER":   bigquery.IntegerFieldType,
+	"FLOAT64":   bigquery.FloatFieldType,
+	"FLOAT":     bigquery.FloatFieldType,
+	"BOOL":      bigquery.BooleanFieldType,
+	"BOOLEAN":   bigquery.BooleanFieldType,
+	"BYTES":     bigquery.BytesFieldType,
+	"DATE":      bigquery.DateFieldType,
+	"TIMESTAMP": bigquery.TimestampFieldType,
+}
+
+// computeTransformer appends the computed columns of an export to every row. The
+// expressions are compiled against the schema of the rows, once it is known.
+type computeTransformer struct {
+	cols []config.ComputedColumn
+	now  time.Time
+	// per computed column, once compiled: its program, type and the input columns it uses
+	progs []cel.Program
+	types []bigquery.FieldType
+	uses  [][]int
+	in    bigquery.Schema
+}
+
+// newComputeTransformer checks the computed columns of an export and parses their
+// expressions; type checking needs the result schema and waits for Schema.
+func newComputeTransformer(cols []config.ComputedColumn, now time.Time) (*computeTransformer, error) {
+	env, err := cel.NewEnv()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, c := range cols {
+		if strings.TrimSpace(c.Name) == "" {
+			return nil, fmt.Errorf("computed column without a name")
+		}
+		if seen[strings.ToLower(c.Name)] {
+			return nil, fmt.Errorf("computed column %s is defined twice", c.Name)
+		}
+		seen[strings.ToLower(c.Name)] = true
+		if _, ok := computedColumnTypes[strings.ToUpper(c.Type)]; c.Type != "" && !ok {
+			return nil, fmt.Errorf("computed column %s: unknown type %q; expected STRING, INT64, FLOAT64, BOOL, BYTES, DATE or TIMESTAMP", c.Name, c.Type)
+		}
+		if strings.TrimSpace(c.Expression) == "" {
+			return nil, fmt.Errorf("computed column %s: empty expression", c.Name)
+		}
+		if _, iss := env.Parse(c.Expression); iss.Err() != nil {
+			return nil, fmt.Errorf("computed column %s: %w", c.Name, iss.Err())
+		}
+	}
+	return &computeTransformer{cols: cols, now: now}, nil
+}
+
+// celType is the CEL type of the values of a column, as passed by celValue.
+func celType(f *bigquery.FieldSchema) *cel.Type {
+	var t *cel.Type
+	switch f.Type {
+	case bigquery.StringFieldType, bigquery.GeographyFieldType, bigquery.JSONFieldType, bigquery.TimeFieldType, bigquery.IntervalFieldType:
+		t = cel.StringType
+	case bigquery.BytesFieldType:
+		t = cel.BytesType
+	case bigquery.IntegerFieldType:
+		t = cel.IntType
+	case bigquery.FloatFieldType, bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		t = cel.DoubleType
+	case bigquery.BooleanFieldType:
+		t = cel.BoolType
+	case bigquery.TimestampFieldType, bigquery.DateTimeFieldType, bigquery.DateFieldType:
+		t = cel.TimestampType
+	case bigquery.RecordFieldType:
+		t = cel.MapType(cel.StringType, cel.DynType)
+	default:
+		t = cel.DynType
+	}
+	if f.Repeated {
+		return cel.ListType(t)
+	}
+	return t
+}
+
+// celValue converts a BigQuery value of f into its CEL form: NUMERIC as a double, dates
+// and datetimes as timestamps at UTC, TIME as a string and records as maps.
+func celValue(f *bigquery.FieldSchema, v bigquery.Value, repeated bool) any {
+	if repeated {
+		vs, _ := v.([]bigquery.Value)
+		out := make([]any, len(vs))
+		for i, e := range vs {
+			out[i] = celValue(f, e, false)
+		}
+		return out
+	}
+	switch x := v.(type) {
+	case *big.Rat:
+		fl, _ := x.Float64()
+		return fl
+	case civil.Date:
+		return x.In(time.UTC)
+	case civil.DateTime:
+		return x.In(time.UTC)
+	case civil.Time:
+		return x.String()
+	case []bigquery.Value:
+		if f.Type != bigquery.RecordFieldType {
+			return x
+		}
+		m := make(map[string]any, len(f.Schema))
+		for i, sub := range f.Schema {
+			if i < len(x) {
+				m[sub.Name] = celValue(sub, x[i], sub.Repeated)
+			}
+		}
+		return m
+	}
+	return v
+}
+
+// celOutputTypes are the BigQuery types computed columns take from the CEL type of their
+// expression.
+var celOutputTypes = map[string]bigquery.FieldType{
+	cel.StringType.String():    bigquery.StringFieldType,
+	cel.IntType.String():       bigquery.IntegerFieldType,
+	cel.DoubleType.String():    bigquery.FloatFieldType,
+	cel.BoolType.String():      bigquery.BooleanFieldType,
+	cel.BytesType.String():     bigquery.BytesFieldType,
+	cel.TimestampType.String(): bigquery.TimestampFieldType,
+}
+
+func (c *computeTransformer) Schema(in bigquery.Schema) (bigquery.Schema, error) {
+	var opts []cel.EnvOption
+	for _, f := range in {
+		if celIdentRe.MatchString(f.Name) && !celReserved[f.Name] {
+			opts = append(opts, cel.Variable(f.Name, celType(f)))
+		}
+	}
+	if !slices.ContainsFunc(in, func(f *bigquery.FieldSchema) bool { return f.Name == celNowVariable }) {
+		opts = append(opts, cel.Variable(celNowVariable, cel.TimestampType))
+	}
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		return nil, err
+	}
+	out := slices.Clone(in)
+	c.in, c.progs, c.types, c.uses = in, nil, nil, nil
+	for _, col := range c.cols {
+		if slices.ContainsFunc(out, func(f *bigquery.FieldSchema) bool { return strings.EqualFold(f.Name, col.Name) }) {
+			return nil, fmt.Errorf("computed column %s: the result already has a column of that name", col.Name)
+		}
+		checked, iss := env.Compile(col.Expression)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("computed column %s: %w", col.Name, iss.Err())
+		}
+		typ, err := computedColumnType(col, checked.OutputType())
+		if err != nil {
+			return nil, err
+		}
+		prg, err := env.Program(checked)
+		if err != nil {
+			return nil, fmt.Errorf("computed column %s: %w", col.Name, err)
+		}
+		// A NULL in any column the expression uses makes the computed value NULL, as in SQL
+		var uses []int
+		for _, ref := range checked.NativeRep().ReferenceMap() {
+			if len(ref.OverloadIDs) > 0 {
+				continue
+			}
+			if i := slices.IndexFunc(in, func(f *bigquery.FieldSchema) bool { return f.Name == ref.Name }); i >= 0 && !slices.Contains(uses, i) {
+				uses = append(uses, i)
+			}
+		}
+		slices.Sort(uses)
+		c.progs, c.types, c.uses = append(c.progs, prg), append(c.types, typ), append(c.uses, uses)
+		out = append(out, &bigquery.FieldSchema{Name: col.Name, Type: typ})
+	}
+	return out, nil
+}
+
+// computedColumnType resolves the type of a computed column from its declared type and
+// the CEL type of its expression.
+func computedColumnType(col config.ComputedColumn, out *cel.Type) (bigquery.FieldType, error) {
+	inferred, known := celOutputTypes[out.String()]
+	if col.Type == "" {
+		if !known {
+			return "", fmt.Errorf("computed column %s: the expression returns %s; set the column's type", col.Name, out)
+		}
+		return inferred, nil
+	}
+	typ := computedColumnTypes[strings.ToUpper(col.Type)]
+	if out.IsExactType(cel.DynType) {
+		return typ, nil
+	}
+	// DATE columns take the date of a timestamp
+	if typ == inferred || (typ == bigquery.DateFieldType && inferred == bigquery.TimestampFieldType) {
+		return typ, nil
+	}
+	return "", fmt.Errorf("computed column %s: the expression returns %s, not %s", col.Name, out, col.Type)
+}
+
+func (c *computeTransformer) Transform(_ context.Context, rows [][]bigquery.Value) ([][]bigquery.Value, error) {
+	for r, row := range rows {
+		for j, prg := range c.progs {
+			v, err := c.eval(prg, c.uses[j], c.types[j], row)
+			if err != nil {
+				return nil, DataError(fmt.Errorf("computed column %s: %w", c.cols[j].Name, err))
+			}
+			row = append(row, v)
+		}
+		rows[r] = row
+	}
+	return rows, nil
+}
+
+func (c *computeTransformer) eval(prg cel.Program, uses []int, typ bigquery.FieldType, row []bigquery.Value) (bigquery.Value, error) {
+	vars := make(map[string]any, len(uses)+1)
+	for _, i := range uses {
+		if row[i] == nil {
+			return nil, nil
+		}
+		vars[c.in[i].Name] = celValue(c.in[i], row[i], c.in[i].Repeated)
+	}
+	vars[celNowVariable] = c.now
+	out, _, err := prg.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if out == types.NullValue {
+		return nil, nil
+	}
+	v, ok := out.Value(), false
+	switch typ {
+	case bigquery.StringFieldType:
+		_, ok = v.(string)
+	case bigquery.IntegerFieldType:
+		_, ok = v.(int64)
+	case bigquery.FloatFieldType:
+		if n, isInt := v.(int64); isInt {
+			v = float64(n)
+		}
+		_, ok = v.(float64)
+	case bigquery.BooleanFieldType:
+		_, ok = v.(bool)
+	case bigquery.BytesFieldType:
+		_, ok = v.([]byte)
+	case bigquery.TimestampFieldType, bigquery.DateFieldType:
+		var t time.Time
+		if t, ok = v.(time.Time); ok {
+			v = t.UTC()
+			if typ == bigquery.DateFieldType {
+				v = civil.DateOf(t.UTC())
+			}
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("the expression returned %s, not %s", out.Type().TypeName(), typ)
+	}
+	return v, nil
+}
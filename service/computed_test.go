@@ -0,0 +1,89 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+func TestComputedColumns(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "dob", Type: bigquery.DateFieldType},
+		{Name: "weight_kg", Type: bigquery.NumericFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+	}
+	year := time.Now().Year()
+	rows := [][]bigquery.Value{
+		{int64(1), civil.Date{Year: year - 10, Month: 1, Day: 1}, nil, []bigquery.Value{"icu"}},
+		{int64(2), civil.Date{Year: year - 40, Month: 1, Day: 1}, nil, []bigquery.Value{}},
+		{int64(3), nil, nil, nil},
+	}
+	c, err := newComputeTransformer([]config.ComputedColumn{
+		{Name: "age_band", Expression: `now.getFullYear() - dob.getFullYear() < 18 ? "child" : "adult"`},
+		{Name: "in_icu", Expression: `"icu" in tags`},
+		{Name: "born", Type: "DATE", Expression: `dob`},
+		{Name: "id_text", Type: "string", Expression: `"P-" + string(id)`},
+	}, time.Now())
+	if err != nil {
+		t.Fatalf("newComputeTransformer() error = %v", err)
+	}
+	out, err := c.Schema(schema)
+	if err != nil {
+		t.Fatalf("Schema() error = %v", err)
+	}
+	var cols []string
+	for _, f := range out[len(schema):] {
+		cols = append(cols, f.Name+":"+string(f.Type))
+	}
+	if got := strings.Join(cols, " "); got != "age_band:STRING in_icu:BOOLEAN born:DATE id_text:STRING" {
+		t.Errorf("computed columns = %s", got)
+	}
+	got, err := c.Transform(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("Transform() error = %v", err)
+	}
+	want := fmt.Sprintf("[[1 %d-01-01 <nil> [icu] child true %d-01-01 P-1] [2 %d-01-01 <nil> [] adult false %d-01-01 P-2] [3 <nil> <nil> <nil> <nil> <nil> <nil> P-3]]",
+		year-10, year-10, year-40, year-40)
+	if fmt.Sprint(got) != want {
+		t.Errorf("rows =\n%v\nwant\n%s", got, want)
+	}
+
+	for name, bad := range map[string]config.ComputedColumn{
+		"existing column": {Name: "ID", Expression: "1"},
+		"unknown column":  {Name: "x", Expression: "height_cm * 2"},
+		"type mismatch":   {Name: "x", Type: "INT64", Expression: "weight_kg * 2.0"},
+		"no type":         {Name: "x", Expression: "null"},
+	} {
+		c, err := newComputeTransformer([]config.ComputedColumn{bad}, time.Now())
+		if err != nil {
+			t.Fatalf("%s: newComputeTransformer() error = %v", name, err)
+		}
+		if _, err := c.Schema(schema); err == nil {
+			t.Errorf("%s: Schema() succeeded", name)
+		}
+	}
+	for name, bad := range map[string][]config.ComputedColumn{
+		"syntax":       {{Name: "x", Expression: "id +"}},
+		"unknown type": {{Name: "x", Type: "DATETIME", Expression: "dob"}},
+		"duplicate":    {{Name: "x", Expression: "1"}, {Name: "X", Expression: "2"}},
+	} {
+		if _, err := newComputeTransformer(bad, time.Now()); err == nil {
+			t.Errorf("%s: newComputeTransformer() succeeded", name)
+		}
+	}
+
+	c, _ = newComputeTransformer([]config.ComputedColumn{{Name: "ratio", Expression: "100 / id"}}, time.Now())
+	if _, err := c.Schema(schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Transform(context.Background(), [][]bigquery.Value{{int64(0), nil, nil, nil}}); FailureClass(err) != FailureData {
+		t.Errorf("Transform() of a division by zero error = %v, want a data error", err)
+	}
+}
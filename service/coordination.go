@@ -0,0 +1,322 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// leaseTTL is how long a lease outlives the instance holding it, when it stops renewing
+// it (it crashed or lost its connection); holders renew it every third of that.
+const leaseTTL = 30 * time.Second
+
+// Coordinator shares leases and state between the instances of the service, so table
+// locks and schedules hold across all of them. Leases expire unless renewed, so a lease
+// of a crashed instance is freed after its TTL.
+type Coordinator interface {
+	// TryLock takes the lease key for holder until ttl passes, unless another holder has
+	// it; it then returns false and that holder.
+	TryLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, string, error)
+	// Extend renews a lease of holder for ttl; false when holder no longer has it.
+	Extend(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// Unlock frees a lease of holder; it does nothing when another holder has it.
+	Unlock(ctx context.Context, key, holder string) error
+	// Holder returns the holder of the lease key, or "" when it is free.
+	Holder(ctx context.Context, key string) (string, error)
+	// Get returns the value stored under key, or nil; Put stores one, and Delete removes
+	// it.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+	// Scan returns the values stored under the keys starting with prefix, by key.
+	Scan(ctx context.Context, prefix string) (map[string][]byte, error)
+	Close() error
+}
+
+// NewCoordinatorFromEnv connects to the coordination backend of COORDINATION_URL
+// (redis:// or rediss://, with keys under COORDINATION_PREFIX, default "bq-exporter:").
+// Without it, leases and state are kept by this instance only.
+func NewCoordinatorFromEnv(ctx context.Context) (Coordinator, error) {
+	raw := os.Getenv("COORDINATION_URL")
+	if raw == "" {
+		return newLocalCoordinator(), nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, ConfigError(fmt.Errorf("invalid COORDINATION_URL: %w", err))
+	}
+	prefix := os.Getenv("COORDINATION_PREFIX")
+	if prefix == "" {
+		prefix = "bq-exporter:"
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		opts, err := redis.ParseURL(raw)
+		if err != nil {
+			return nil, ConfigError(fmt.Errorf("invalid COORDINATION_URL: %w", err))
+		}
+		c := newRedisCoordinator(redis.NewClient(opts), prefix)
+		if err := c.client.Ping(ctx).Err(); err != nil {
+			c.Close()
+			return nil, TransientError(fmt.Errorf("failed to connect to the coordination backend %s: %w", u.Host, err))
+		}
+		return c, nil
+	}
+	return nil, ConfigError(fmt.Errorf("unsupported COORDINATION_URL scheme %q; expected redis or rediss", u.Scheme))
+}
+
+// sharedCoordinator reports whether c coordinates several instances.
+func sharedCoordinator(c Coordinator) bool {
+	_, local := c.(*localCoordinator)
+	return c != nil && !local
+}
+
+// ErrLeaseLost is the cause of the context of work whose lease expired or was taken over.
+var ErrLeaseLost = errors.New("lease lost")
+
+// holdLease renews a lease taken by holder until the returned func frees it. The returned
+// context is ctx, cancelled with ErrLeaseLost once another holder has the lease or it
+// could not be renewed for ttl, so the work it guards stops before another instance
+// starts on it.
+func holdLease(ctx context.Context, c Coordinator, key, holder string, ttl time.Duration) (context.Context, func()) {
+	leaseCtx, cancel := context.WithCancelCause(ctx)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ok, err := c.Extend(context.WithoutCancel(ctx), key, holder, ttl)
+				switch {
+				case err == nil && ok:
+					renewed = time.Now()
+					continue
+				case err == nil:
+					slog.ErrorContext(ctx, "Lease taken over; stopping its work", "lease", key)
+					cancel(fmt.Errorf("%w: %s is held by another holder", ErrLeaseLost, key))
+					return
+				}
+				slog.ErrorContext(ctx, "Failed to renew lease", "lease", key, "error", err)
+				if time.Since(renewed) >= ttl {
+					cancel(fmt.Errorf("%w: %s could not be renewed for %s: %w", ErrLeaseLost, key, ttl, err))
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return leaseCtx, func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+			cancel(nil)
+			if err := c.Unlock(context.WithoutCancel(ctx), key, holder); err != nil {
+				slog.WarnContext(ctx, "Failed to release lease", "lease", key, "error", err)
+			}
+		})
+	}
+}
+
+// leaseHolder names the holder of leases taken for the export or run of ctx.
+func leaseHolder(ctx context.Context) string {
+	if id := logging.RequestID(ctx); id != "" {
+		return id
+	}
+	return logging.NewRequestID()
+}
+
+// localCoordinator keeps leases and state in memory.
+type localCoordinator struct {
+	mu     sync.Mutex
+	leases map[string]localLease
+	values map[string][]byte
+}
+
+type localLease struct {
+	holder  string
+	expires time.Time
+}
+
+func newLocalCoordinator() *localCoordinator {
+	return &localCoordinator{leases: map[string]localLease{}, values: map[string][]byte{}}
+}
+
+func (c *localCoordinator) TryLock(_ context.Context, key, holder string, ttl time.Duration) (bool, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if l, ok := c.leases[key]; ok && now.Before(l.expires) && l.holder != holder {
+		return false, l.holder, nil
+	}
+	c.leases[key] = localLease{holder: holder, expires: now.Add(ttl)}
+	return true, holder, nil
+}
+
+func (c *localCoordinator) Extend(_ context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.leases[key]
+	if !ok || l.holder != holder || time.Now().After(l.expires) {
+		return false, nil
+	}
+	c.leases[key] = localLease{holder: holder, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (c *localCoordinator) Unlock(_ context.Context, key, holder string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.leases[key]; ok && l.holder == holder {
+		delete(c.leases, key)
+	}
+	return nil
+}
+
+func (c *localCoordinator) Holder(_ context.Context, key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.leases[key]; ok && time.Now().Before(l.expires) {
+		return l.holder, nil
+	}
+	return "", nil
+}
+
+func (c *localCoordinator) Get(_ context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key], nil
+}
+
+func (c *localCoordinator) Put(_ context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	return nil
+}
+
+func (c *localCoordinator) Delete(_ context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+	return nil
+}
+
+func (c *localCoordinator) Scan(_ context.Context, prefix string) (map[string][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := map[string][]byte{}
+	for k, v := range c.values {
+		if strings.HasPrefix(k, prefix) {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+func (c *localCoordinator) Close() error { return nil }
+
+// redisCoordinator keeps leases and state in Redis: a lease is a key holding its holder,
+// expiring with the lease.
+type redisCoordinator struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisCoordinator(client *redis.Client, prefix string) *redisCoordinator {
+	return &redisCoordinator{client: client, prefix: prefix}
+}
+
+var (
+	// redisExtend and redisUnlock only touch a lease still held by the caller
+	redisExtend = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`)
+	redisUnlock = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+)
+
+func (c *redisCoordinator) TryLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, string, error) {
+	ok, err := c.client.SetNX(ctx, c.prefix+key, holder, ttl).Result()
+	if err != nil || ok {
+		return ok, holder, err
+	}
+	cur, err := c.Holder(ctx, key)
+	if err != nil {
+		return false, "", err
+	}
+	if cur == holder {
+		// Taken again by its holder: renew it
+		ok, err := c.Extend(ctx, key, holder, ttl)
+		return ok, holder, err
+	}
+	return false, cur, nil
+}
+
+func (c *redisCoordinator) Extend(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	n, err := redisExtend.Run(ctx, c.client, []string{c.prefix + key}, holder, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+func (c *redisCoordinator) Unlock(ctx context.Context, key, holder string) error {
+	return redisUnlock.Run(ctx, c.client, []string{c.prefix + key}, holder).Err()
+}
+
+func (c *redisCoordinator) Holder(ctx context.Context, key string) (string, error) {
+	v, err := c.client.Get(ctx, c.prefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return v, err
+}
+
+func (c *redisCoordinator) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (c *redisCoordinator) Put(ctx context.Context, key string, value []byte) error {
+	return c.client.Set(ctx, c.prefix+key, value, 0).Err()
+}
+
+func (c *redisCoordinator) Delete(ctx context.Context, key string) error {
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+// redisGlobChars are the characters of a SCAN pattern that match more than themselves.
+var redisGlobChars = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (c *redisCoordinator) Scan(ctx context.Context, prefix string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	iter := c.client.Scan(ctx, 0, redisGlobChars.Replace(c.prefix+prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		v, err := c.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			// Deleted since the scan saw it
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[strings.TrimPrefix(iter.Val(), c.prefix)] = v
+	}
+	return values, iter.Err()
+}
+
+func (c *redisCoordinator) Close() error {
+	return c.client.Close()
+}
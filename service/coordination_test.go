@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisCoordinator(t *testing.T, mr *miniredis.Miniredis) *redisCoordinator {
+	t.Helper()
+	c := newRedisCoordinator(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCoordinatorLeases(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	for name, c := range map[string]Coordinator{"local": newLocalCoordinator(), "redis": newTestRedisCoordinator(t, mr)} {
+		if ok, _, err := c.TryLock(ctx, "table:a", "job-1", time.Minute); !ok || err != nil {
+			t.Fatalf("%s: TryLock() = %v, %v", name, ok, err)
+		}
+		if ok, holder, _ := c.TryLock(ctx, "table:a", "job-2", time.Minute); ok || holder != "job-1" {
+			t.Errorf("%s: TryLock() of a held lease = %v, %q, want held by job-1", name, ok, holder)
+		}
+		if ok, _ := c.Extend(ctx, "table:a", "job-2", time.Minute); ok {
+			t.Errorf("%s: Extend() by another holder succeeded", name)
+		}
+		if err := c.Unlock(ctx, "table:a", "job-2"); err != nil {
+			t.Fatal(err)
+		}
+		if holder, _ := c.Holder(ctx, "table:a"); holder != "job-1" {
+			t.Errorf("%s: Holder() after another holder's Unlock() = %q, want job-1", name, holder)
+		}
+		if ok, _ := c.Extend(ctx, "table:a", "job-1", time.Minute); !ok {
+			t.Errorf("%s: Extend() by the holder failed", name)
+		}
+		c.Unlock(ctx, "table:a", "job-1")
+		if ok, _, _ := c.TryLock(ctx, "table:a", "job-2", time.Minute); !ok {
+			t.Errorf("%s: TryLock() after Unlock() failed", name)
+		}
+
+		if v, err := c.Get(ctx, "state"); v != nil || err != nil {
+			t.Errorf("%s: Get() of a missing value = %q, %v", name, v, err)
+		}
+		c.Put(ctx, "state", []byte("paused"))
+		if v, _ := c.Get(ctx, "state"); string(v) != "paused" {
+			t.Errorf("%s: Get() = %q", name, v)
+		}
+
+		c.Put(ctx, "cleanup:action:1", []byte("a"))
+		c.Put(ctx, "cleanup:action:2", []byte("b"))
+		c.Put(ctx, "cleanup:other", []byte("c"))
+		c.Delete(ctx, "cleanup:action:2")
+		if got, err := c.Scan(ctx, "cleanup:action:"); err != nil || len(got) != 1 || string(got["cleanup:action:1"]) != "a" {
+			t.Errorf("%s: Scan() = %q, %v, want the one remaining action", name, got, err)
+		}
+		if got, _ := c.Scan(ctx, "cleanup:*"); len(got) != 0 {
+			t.Errorf("%s: Scan() matched the prefix as a pattern: %q", name, got)
+		}
+	}
+
+	// Leases of a crashed holder expire
+	c := newTestRedisCoordinator(t, mr)
+	c.TryLock(ctx, "table:b", "job-1", leaseTTL)
+	mr.FastForward(leaseTTL + time.Second)
+	if ok, _, _ := c.TryLock(ctx, "table:b", "job-2", leaseTTL); !ok {
+		t.Error("TryLock() of an expired lease failed")
+	}
+}
+
+func TestHoldLeaseFencing(t *testing.T) {
+	ctx := context.Background()
+	c := newLocalCoordinator()
+	c.TryLock(ctx, "table:a", "job-1", 30*time.Millisecond)
+	leaseCtx, release := holdLease(ctx, c, "table:a", "job-1", 30*time.Millisecond)
+	defer release()
+	// Another holder takes the lease over, as after a pause longer than its TTL
+	c.Unlock(ctx, "table:a", "job-1")
+	c.TryLock(ctx, "table:a", "job-2", time.Minute)
+	select {
+	case <-leaseCtx.Done():
+		if cause := context.Cause(leaseCtx); !errors.Is(cause, ErrLeaseLost) {
+			t.Errorf("cause = %v, want ErrLeaseLost", cause)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the work of a lost lease was not cancelled")
+	}
+	release()
+	if holder, _ := c.Holder(ctx, "table:a"); holder != "job-2" {
+		t.Errorf("Holder() after releasing a lost lease = %q, want job-2", holder)
+	}
+}
+
+func TestSchedulerAcrossInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cfg := &config.Config{Pipelines: map[string]config.Pipeline{
+		"nightly": {
+			Query:         "SELECT 1",
+			QueryLocation: "US",
+			Destination:   config.Destination{Output: "gs://bucket/nightly/"},
+			Schedule:      "*/5 * * * *",
+		},
+	}}
+	ctx := context.Background()
+	at := func(h, m int) time.Time { return time.Date(2026, 3, 2, h, m, 0, 0, time.UTC) }
+	var instances []*Scheduler
+	for range 2 {
+		e := NewExporter(&fakeBigQuery{}, NewGCSDriver(nil, nil), cfg)
+		e.Coordinator = newTestRedisCoordinator(t, mr)
+		s, err := NewScheduler(e, nil, time.UTC, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, s)
+	}
+	runs := func() int {
+		n := 0
+		for _, s := range instances {
+			s.runs.Wait()
+			n += len(s.e.Jobs.List(ctx))
+		}
+		return n
+	}
+
+	for _, s := range instances {
+		s.tick(ctx, at(10, 2))
+	}
+	for _, s := range instances {
+		s.tick(ctx, at(10, 5))
+	}
+	if n := runs(); n != 1 {
+		t.Fatalf("runs of 10:05 on both instances = %d, want 1", n)
+	}
+	// The last run is shared
+	if st := instances[1].List(ctx)[0]; st.LastStatus != JobSucceeded || st.LastJobID == "" {
+		t.Errorf("state on the other instance = %+v, want the last run", st)
+	}
+
+	// A pause on one instance holds on the other
+	if _, err := instances[0].Pause(ctx, "nightly"); err != nil {
+		t.Fatal(err)
+	}
+	instances[1].tick(ctx, at(10, 10))
+	if n := runs(); n != 1 {
+		t.Errorf("runs while paused = %d, want 1", n)
+	}
+	if st := instances[1].List(ctx)[0]; !st.Paused {
+		t.Errorf("state on the other instance = %+v, want paused", st)
+	}
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// credentialScopes cover BigQuery and Cloud Storage.
+var credentialScopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+
+// CredentialsFromEnv returns the credentials configured explicitly, in this order: the
+// credential JSON in GOOGLE_CREDENTIALS_JSON, the Secret Manager secret version named by
+// GOOGLE_CREDENTIALS_SECRET (projects/<p>/secrets/<s>[/versions/<v>], latest by
+// default) read with the ambient credentials, or a workload identity federation
+// configuration built from GOOGLE_WIF_PROVIDER. It returns nil when none is set; clients
+// then use Application Default Credentials.
+func CredentialsFromEnv(ctx context.Context) (*google.Credentials, error) {
+	data := []byte(os.Getenv("GOOGLE_CREDENTIALS_JSON"))
+	source := "GOOGLE_CREDENTIALS_JSON"
+	if secret := os.Getenv("GOOGLE_CREDENTIALS_SECRET"); len(data) == 0 && secret != "" {
+		var err error
+		if data, err = accessSecret(ctx, secret); err != nil {
+			return nil, fmt.Errorf("failed to read GOOGLE_CREDENTIALS_SECRET: %w", err)
+		}
+		source = secret
+	}
+	if provider := os.Getenv("GOOGLE_WIF_PROVIDER"); len(data) == 0 && provider != "" {
+		var err error
+		if data, err = externalAccountConfig(provider, os.Getenv("GOOGLE_WIF_CREDENTIAL_SOURCE"), os.Getenv("GOOGLE_WIF_SERVICE_ACCOUNT")); err != nil {
+			return nil, ConfigError(err)
+		}
+		source = "GOOGLE_WIF_PROVIDER"
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return credentialsFromJSON(ctx, data, source)
+}
+
+// credentialsFromJSON parses a credential file, accepting only the credential types this
+// service is meant to run with.
+func credentialsFromJSON(ctx context.Context, data []byte, source string) (*google.Credentials, error) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, ConfigError(fmt.Errorf("%s is not valid credentials JSON: %w", source, err))
+	}
+	switch head.Type {
+	case "service_account", "external_account":
+	default:
+		return nil, ConfigError(fmt.Errorf("%s has unsupported credential type %q; expected service_account or external_account", source, head.Type))
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, credentialScopes...)
+	if err != nil {
+		return nil, ConfigError(fmt.Errorf("invalid credentials in %s: %w", source, err))
+	}
+	slog.InfoContext(ctx, "Using explicitly configured credentials", "source", source, "type", head.Type)
+	return creds, nil
+}
+
+// NewSecretReader returns a reader of Secret Manager secret versions using the
+// credentials of opts.
+func NewSecretReader(opts ...option.ClientOption) func(ctx context.Context, name string) ([]byte, error) {
+	return func(ctx context.Context, name string) ([]byte, error) {
+		return accessSecret(ctx, name, opts...)
+	}
+}
+
+// accessSecret reads the payload of a Secret Manager secret version.
+func accessSecret(ctx context.Context, name string, opts ...option.ClientOption) ([]byte, error) {
+	if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/secrets/") {
+		return nil, ConfigError(fmt.Errorf("secret %q must be projects/<project>/secrets/<secret>/versions/<version>", name))
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	svc, err := secretmanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Payload.Data)
+}
+
+// externalAccountConfig builds the external_account credential configuration of a
+// workload identity pool provider ("projects/<number>/locations/global/
+// workloadIdentityPools/<pool>/providers/<provider>"). source selects the subject token:
+// "file:<path>" or "url:<url>" for an OIDC token, or "aws" for AWS credentials from the
+// environment or instance metadata. Without a source, the EKS web identity token
+// (AWS_WEB_IDENTITY_TOKEN_FILE) is used. With serviceAccount, the federated identity
+// impersonates that service account; otherwise it needs direct resource access.
+func externalAccountConfig(provider, source, serviceAccount string) ([]byte, error) {
+	provider = strings.TrimPrefix(provider, "//iam.googleapis.com/")
+	if !strings.HasPrefix(provider, "projects/") || !strings.Contains(provider, "/workloadIdentityPools/") || !strings.Contains(provider, "/providers/") {
+		return nil, fmt.Errorf("GOOGLE_WIF_PROVIDER must be projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>, got %q", provider)
+	}
+	if source == "" {
+		if f := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); f != "" {
+			source = "file:" + f
+		} else {
+			return nil, fmt.Errorf("GOOGLE_WIF_CREDENTIAL_SOURCE is required (file:<path>, url:<url> or aws)")
+		}
+	}
+	cfg := map[string]any{
+		"type":               "external_account",
+		"audience":           "//iam.googleapis.com/" + provider,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          "https://sts.googleapis.com/v1/token",
+	}
+	switch kind, value, _ := strings.Cut(source, ":"); kind {
+	case "file":
+		cfg["credential_source"] = map[string]any{"file": value}
+	case "url":
+		cfg["credential_source"] = map[string]any{"url": value}
+	case "aws":
+		cfg["subject_token_type"] = "urn:ietf:params:aws:token-type:aws4_request"
+		cfg["credential_source"] = map[string]any{
+			"environment_id":                 "aws1",
+			"region_url":                     "http://169.254.169.254/latest/meta-data/placement/availability-zone",
+			"url":                            "http://169.254.169.254/latest/meta-data/iam/security-credentials",
+			"regional_cred_verification_url": "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15",
+		}
+	default:
+		return nil, fmt.Errorf("unknown GOOGLE_WIF_CREDENTIAL_SOURCE %q; expected file:<path>, url:<url> or aws", source)
+	}
+	if serviceAccount != "" {
+		cfg["service_account_impersonation_url"] = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + serviceAccount + ":generateAccessToken"
+	}
+	return json.Marshal(cfg)
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsFromEnv(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("GOOGLE_CREDENTIALS_JSON", "")
+	t.Setenv("GOOGLE_CREDENTIALS_SECRET", "")
+	t.Setenv("GOOGLE_WIF_PROVIDER", "")
+	if creds, err := CredentialsFromEnv(ctx); creds != nil || err != nil {
+		t.Fatalf("CredentialsFromEnv() without configuration = %v, %v; want nil, nil", creds, err)
+	}
+
+	t.Setenv("GOOGLE_CREDENTIALS_JSON", `{"type": "service_account", "project_id": "study-prj", "client_email": "exporter@study-prj.iam.gserviceaccount.com", "private_key": "unused", "token_uri": "https://oauth2.googleapis.com/token"}`)
+	creds, err := CredentialsFromEnv(ctx)
+	if err != nil {
+		t.Fatalf("CredentialsFromEnv() error = %v", err)
+	}
+	if creds.ProjectID != "study-prj" {
+		t.Errorf("ProjectID = %q, want study-prj", creds.ProjectID)
+	}
+
+	for _, bad := range []string{"not json", `{"type": "authorized_user"}`} {
+		t.Setenv("GOOGLE_CREDENTIALS_JSON", bad)
+		if _, err := CredentialsFromEnv(ctx); err == nil {
+			t.Errorf("CredentialsFromEnv(%q) error = nil", bad)
+		}
+	}
+
+	t.Setenv("GOOGLE_CREDENTIALS_JSON", "")
+	t.Setenv("GOOGLE_CREDENTIALS_SECRET", "my-secret")
+	if _, err := CredentialsFromEnv(ctx); err == nil {
+		t.Error("CredentialsFromEnv() with malformed secret name error = nil")
+	}
+}
+
+func TestExternalAccountConfig(t *testing.T) {
+	const provider = "projects/123/locations/global/workloadIdentityPools/eks/providers/cluster"
+	data, err := externalAccountConfig("//iam.googleapis.com/"+provider, "file:/var/run/token", "exporter@prj.iam.gserviceaccount.com")
+	if err != nil {
+		t.Fatalf("externalAccountConfig() error = %v", err)
+	}
+	var cfg struct {
+		Type             string            `json:"type"`
+		Audience         string            `json:"audience"`
+		SubjectTokenType string            `json:"subject_token_type"`
+		Impersonation    string            `json:"service_account_impersonation_url"`
+		Source           map[string]string `json:"credential_source"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Type != "external_account" || cfg.Audience != "//iam.googleapis.com/"+provider || cfg.Source["file"] != "/var/run/token" {
+		t.Errorf("config = %+v", cfg)
+	}
+	if !strings.HasSuffix(cfg.Impersonation, "/serviceAccounts/exporter@prj.iam.gserviceaccount.com:generateAccessToken") {
+		t.Errorf("service_account_impersonation_url = %q", cfg.Impersonation)
+	}
+
+	data, err = externalAccountConfig(provider, "aws", "")
+	if err != nil {
+		t.Fatalf("externalAccountConfig(aws) error = %v", err)
+	}
+	cfg.Impersonation = ""
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SubjectTokenType != "urn:ietf:params:aws:token-type:aws4_request" || cfg.Source["environment_id"] != "aws1" || cfg.Impersonation != "" {
+		t.Errorf("aws config = %+v", cfg)
+	}
+
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	for _, c := range [][2]string{{"pools/eks", "file:/t"}, {provider, ""}, {provider, "exec:/bin/token"}} {
+		if _, err := externalAccountConfig(c[0], c[1], ""); err == nil {
+			t.Errorf("externalAccountConfig(%q, %q) error = nil", c[0], c[1])
+		}
+	}
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "/eks/token")
+	if data, err := externalAccountConfig(provider, "", ""); err != nil || !strings.Contains(string(data), `"/eks/token"`) {
+		t.Errorf("externalAccountConfig() with EKS token = %s, %v", data, err)
+	}
+
+	t.Setenv("GOOGLE_CREDENTIALS_JSON", "")
+	t.Setenv("GOOGLE_CREDENTIALS_SECRET", "")
+	t.Setenv("GOOGLE_WIF_PROVIDER", provider)
+	t.Setenv("GOOGLE_WIF_CREDENTIAL_SOURCE", "file:/var/run/token")
+	t.Setenv("GOOGLE_WIF_SERVICE_ACCOUNT", "")
+	if creds, err := CredentialsFromEnv(context.Background()); err != nil || creds == nil {
+		t.Errorf("CredentialsFromEnv() with GOOGLE_WIF_PROVIDER = %v, %v", creds, err)
+	}
+}
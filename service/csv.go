@@ -0,0 +1,205 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// GCS export file formats (ExportParams.Format).
+const (
+	FormatParquet = "parquet"
+	FormatCSV     = "csv"
+)
+
+// CSV header rows (ExportParams.CSVHeader).
+const (
+	// CSVHeaderNames is a row of column names (the default)
+	CSVHeaderNames = "names"
+	// CSVHeaderTyped is a row of name:TYPE cells, e.g. visit_date:DATE
+	CSVHeaderTyped = "typed"
+	CSVHeaderNone  = "none"
+)
+
+// utf8BOM marks CSV files as UTF-8 for spreadsheet tools that assume a legacy encoding.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// checkFormat validates the file format options, which only the GCS driver supports.
+func checkFormat(p ExportParams, driver string) error {
+	csvOptions := p.CSVHeader != "" || p.CSVDelimiter != "" || p.CSVBOM
+	if driver == googleDriveDriverName {
+		if p.CSVBOM || p.SchemaFile || p.FHIRMapping != "" || p.REDCapMapping != "" {
+			return fmt.Errorf("the %s driver only takes format %s (with csv_header and csv_delimiter) or %s", driver, FormatCSV, FormatXLSX)
+		}
+		switch p.Format {
+		case "", FormatCSV:
+			return checkCSVOptions(p)
+		case FormatXLSX:
+			if csvOptions {
+				return fmt.Errorf("csv_header and csv_delimiter require format %s", FormatCSV)
+			}
+			return nil
+		}
+		return fmt.Errorf("invalid format %q for the %s driver; expected %s or %s", p.Format, driver, FormatCSV, FormatXLSX)
+	}
+	if driver == parquetWriteDriverName && p.Format == FormatParquet {
+		p.Format = ""
+	}
+	if (p.Format != "" || csvOptions || p.SchemaFile || p.FHIRMapping != "" || p.REDCapMapping != "") && driver != "GCS_PARQUET" && driver != azureBlobDriverName {
+		return fmt.Errorf("format, csv_header, csv_delimiter, csv_bom, schema_file, fhir_mapping and redcap_mapping are only supported by the GCS_PARQUET and %s drivers", azureBlobDriverName)
+	}
+	if csvOptions && p.Format != FormatCSV {
+		return fmt.Errorf("csv_header, csv_delimiter and csv_bom require format %s", FormatCSV)
+	}
+	if p.FHIRMapping != "" && p.Format != FormatFHIR {
+		return fmt.Errorf("fhir_mapping requires format %s", FormatFHIR)
+	}
+	if p.REDCapMapping != "" && p.Format != FormatREDCap {
+		return fmt.Errorf("redcap_mapping requires format %s", FormatREDCap)
+	}
+	switch p.Format {
+	case "", FormatParquet:
+		return nil
+	case FormatFHIR, FormatREDCap:
+		if p.SchemaFile {
+			return fmt.Errorf("schema_file is not supported with format %s", p.Format)
+		}
+		return nil
+	case FormatCSV:
+		return checkCSVOptions(p)
+	default:
+		return fmt.Errorf("invalid format %q; expected %s, %s, %s or %s", p.Format, FormatParquet, FormatCSV, FormatFHIR, FormatREDCap)
+	}
+}
+
+// checkCSVOptions validates csv_header and csv_delimiter.
+func checkCSVOptions(p ExportParams) error {
+	switch p.CSVHeader {
+	case "", CSVHeaderNames, CSVHeaderTyped, CSVHeaderNone:
+	default:
+		return fmt.Errorf("invalid csv_header %q; expected %s, %s or %s", p.CSVHeader, CSVHeaderNames, CSVHeaderTyped, CSVHeaderNone)
+	}
+	_, err := csvDelimiter(p.CSVDelimiter)
+	return err
+}
+
+// applyFormatMapping resolves the configured mapping of fhir and redcap exports.
+func (e *Exporter) applyFormatMapping(p ExportParams) (ExportParams, error) {
+	switch p.Format {
+	case FormatFHIR:
+		if p.FHIRMapping == "" {
+			return p, fmt.Errorf("format %s requires fhir_mapping", FormatFHIR)
+		}
+		m, ok := e.FHIRMappings[p.FHIRMapping]
+		if !ok {
+			return p, fmt.Errorf("unknown fhir_mapping %q", p.FHIRMapping)
+		}
+		p.fhir = &m
+	case FormatREDCap:
+		if p.REDCapMapping == "" {
+			return p, fmt.Errorf("format %s requires redcap_mapping", FormatREDCap)
+		}
+		m, ok := e.REDCapMappings[p.REDCapMapping]
+		if !ok {
+			return p, fmt.Errorf("unknown redcap_mapping %q", p.REDCapMapping)
+		}
+		p.redcap = &m
+	}
+	return p, nil
+}
+
+// csvDelimiter parses csv_delimiter: a single character, or "tab" (default ",").
+func csvDelimiter(v string) (rune, error) {
+	switch v {
+	case "":
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(v)
+	if size != len(v) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError || r > 0xFF {
+		return 0, fmt.Errorf("invalid csv_delimiter %q; expected a single Latin-1 character other than a quote or newline, or tab", v)
+	}
+	return r, nil
+}
+
+// exportExtension is the file extension of a GCS export format.
+func exportExtension(format string) string {
+	switch format {
+	case FormatCSV:
+		return ".csv"
+	case FormatFHIR:
+		return ".ndjson"
+	case FormatREDCap:
+		return ".csv"
+	case FormatXLSX:
+		return ".xlsx"
+	}
+	return ".parquet"
+}
+
+// csvFilePrefix returns the bytes every exported CSV file must start with that EXPORT
+// DATA cannot write itself (a BOM, a typed header), or nil when EXPORT DATA writes the
+// files as they are.
+func csvFilePrefix(p ExportParams, schema bigquery.Schema) ([]byte, error) {
+	if p.Format != FormatCSV || (!p.CSVBOM && p.CSVHeader != CSVHeaderTyped) {
+		return nil, nil
+	}
+	var b bytes.Buffer
+	if p.CSVBOM {
+		b.Write(utf8BOM)
+	}
+	if p.CSVHeader == CSVHeaderNone {
+		return b.Bytes(), nil
+	}
+	row := make([]string, len(schema))
+	for i, f := range schema {
+		row[i] = f.Name
+		if p.CSVHeader == CSVHeaderTyped {
+			row[i] += ":" + string(f.Type)
+		}
+	}
+	w := csv.NewWriter(&b)
+	w.Comma, _ = csvDelimiter(p.CSVDelimiter)
+	if err := w.Write(row); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// buildCSVExportSQL constructs the EXPORT DATA statement of a CSV export; header writes
+// the column names into every file.
+func buildCSVExportSQL(exportURI, sqlQuery string, header bool, delimiter rune) string {
+	return fmt.Sprintf(`
+		EXPORT DATA OPTIONS(
+			uri='%s',
+			format='CSV',
+			header=%t,
+			field_delimiter=%s,
+			overwrite=true
+		) AS
+		(%s)
+	`, exportURI, header, quoteBigQueryString(string(delimiter)), sqlQuery)
+}
+
+// schemaFileURI is the URI of the schema sidecar of an export: the file pattern up to
+// its wildcard, plus ".schema.json" (gs://b/out/visits-*.csv has gs://b/out/visits.schema.json).
+func schemaFileURI(exportURI string) string {
+	return sidecarURI(exportURI, "schema.json")
+}
+
+// sidecarURI is the URI of a file named suffix written next to the files of an export
+// (see schemaFileURI).
+func sidecarURI(exportURI, suffix string) string {
+	base, _, _ := strings.Cut(exportURI, "*")
+	base = strings.TrimRight(base, "-_.")
+	if strings.HasSuffix(base, "/") {
+		return base + suffix
+	}
+	return base + "." + suffix
+}
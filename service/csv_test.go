@@ -0,0 +1,277 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+func TestCheckFormat(t *testing.T) {
+	for _, ok := range []ExportParams{
+		{},
+		{Format: FormatParquet, SchemaFile: true},
+		{Format: FormatCSV, CSVHeader: CSVHeaderTyped, CSVDelimiter: ";", CSVBOM: true},
+		{Format: FormatCSV, CSVDelimiter: "tab"},
+	} {
+		if err := checkFormat(ok, "GCS_PARQUET"); err != nil {
+			t.Errorf("checkFormat(%+v) error = %v", ok, err)
+		}
+	}
+	for _, bad := range []ExportParams{
+		{Format: "xlsx"},
+		{CSVBOM: true},
+		{Format: FormatCSV, CSVHeader: "types"},
+		{Format: FormatCSV, CSVDelimiter: "||"},
+		{Format: FormatCSV, CSVDelimiter: `"`},
+	} {
+		if err := checkFormat(bad, "GCS_PARQUET"); err == nil {
+			t.Errorf("checkFormat(%+v) succeeded", bad)
+		}
+	}
+	if err := checkFormat(ExportParams{Format: FormatCSV}, "STARROCKS"); err == nil {
+		t.Error("checkFormat() accepted csv for STARROCKS")
+	}
+}
+
+func TestCSVFilePrefix(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "site; name", Type: bigquery.StringFieldType},
+	}
+	tests := []struct {
+		name string
+		p    ExportParams
+		want string
+	}{
+		{"names", ExportParams{Format: FormatCSV}, ""},
+		{"typed", ExportParams{Format: FormatCSV, CSVHeader: CSVHeaderTyped}, "id:INTEGER,site; name:STRING\n"},
+		{"bom", ExportParams{Format: FormatCSV, CSVBOM: true, CSVDelimiter: ";"}, "\ufeffid;\"site; name\"\n"},
+		{"bom only", ExportParams{Format: FormatCSV, CSVBOM: true, CSVHeader: CSVHeaderNone}, "\ufeff"},
+	}
+	for _, tt := range tests {
+		got, err := csvFilePrefix(tt.p, schema)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: csvFilePrefix() = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSchemaFileURI(t *testing.T) {
+	for uri, want := range map[string]string{
+		"gs://b/out/visits-*.csv":     "gs://b/out/visits.schema.json",
+		"gs://b/out/*.parquet":        "gs://b/out/schema.json",
+		"gs://b/out/part_*_of.csv":    "gs://b/out/part.schema.json",
+		"gs://b/out/export-*.parquet": "gs://b/out/export.schema.json",
+	} {
+		if got := schemaFileURI(uri); got != want {
+			t.Errorf("schemaFileURI(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestGCSDriverExecuteCSV(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &exportingBigQuery{
+		fakeBigQuery: fakeBigQuery{schema: bigquery.Schema{
+			{Name: "id", Type: bigquery.IntegerFieldType},
+			{Name: "visit_date", Type: bigquery.DateFieldType},
+		}},
+		gcs: gcs,
+	}
+	d := NewGCSDriver(gcs.service(t), nil)
+	res, err := d.Execute(context.Background(), bq, ExportParams{
+		Query: "SELECT id, visit_date FROM ds.visits", Output: "gs://b/out/", Filename: "visits", QueryLocation: "US",
+		Format: FormatCSV, CSVHeader: CSVHeaderTyped, CSVDelimiter: "tab", CSVBOM: true, SchemaFile: true,
+	})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.GCSPath != "gs://b/out/visits-*.csv" {
+		t.Errorf("GCSPath = %q", res.GCSPath)
+	}
+	export := bq.queries[len(bq.queries)-1]
+	if !strings.Contains(export, "format='CSV'") || !strings.Contains(export, "header=false") || !strings.Contains(export, "field_delimiter='\t'") {
+		t.Errorf("export SQL = %s", export)
+	}
+
+	gcs.mu.Lock()
+	defer gcs.mu.Unlock()
+	if got, want := gcs.names(), []string{"out/visits-000000000000.csv", "out/visits.schema.json"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("objects = %v, want %v", got, want)
+	}
+	if got := string(gcs.objects["out/visits-000000000000.csv"]); got != "\ufeffid:INTEGER\tvisit_date:DATE\n1\t2026-10-01\n" {
+		t.Errorf("CSV file = %q", got)
+	}
+	var fields []map[string]any
+	if err := json.Unmarshal(gcs.objects["out/visits.schema.json"], &fields); err != nil || len(fields) != 2 || fields[1]["type"] != "DATE" {
+		t.Errorf("schema file = %s (%v)", gcs.objects["out/visits.schema.json"], err)
+	}
+
+	cfg := &config.Config{}
+	if _, err := NewExporter(bq, NewGCSDriver(nil, nil), cfg).Run(context.Background(),
+		ExportParams{Query: "SELECT 1", Output: "gs://b/out/", QueryLocation: "US", Format: FormatCSV, CSVBOM: true}); FailureClass(err) != FailureConfig {
+		t.Errorf("Run() without a Cloud Storage client error = %v, want a config error", err)
+	}
+}
+
+// exportingBigQuery writes a one-row file to the fake Cloud Storage for every EXPORT
+// DATA statement, as the first file of its URI pattern.
+type exportingBigQuery struct {
+	fakeBigQuery
+	gcs *fakeGCS
+}
+
+var exportURIRe = regexp.MustCompile(`uri='gs://[^/]+/([^']*)'`)
+
+func (f *exportingBigQuery) RunQuery(ctx context.Context, sqlQuery, location string) (QueryJob, error) {
+	job, err := f.fakeBigQuery.RunQuery(ctx, sqlQuery, location)
+	if m := exportURIRe.FindStringSubmatch(sqlQuery); m != nil && err == nil {
+		f.gcs.mu.Lock()
+		f.gcs.objects[strings.Replace(m[1], "*", "000000000000", 1)] = []byte("1\t2026-10-01\n")
+		f.gcs.mu.Unlock()
+	}
+	return job, err
+}
+
+// fakeGCS serves the Cloud Storage JSON API calls of GCSService for a single bucket.
+// Other buckets are missing until created.
+type fakeGCS struct {
+	srv     *httptest.Server
+	mu      sync.Mutex
+	objects map[string][]byte
+	// readOnly denies creating objects in the bucket
+	readOnly bool
+	// created lists the buckets created, as project/name, and buckets how
+	created []string
+	buckets []storage.Bucket
+	// metadata holds the custom metadata set on objects
+	metadata map[string]map[string]string
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	f := &fakeGCS{objects: map[string][]byte{}}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeGCS) service(t *testing.T) *GCSService {
+	g, err := NewGCSService(context.Background(), option.WithEndpoint(f.srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func (f *fakeGCS) names() []string {
+	var names []string
+	for n := range f.objects {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeGCS) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path, _ := url.PathUnescape(r.URL.EscapedPath())
+	_, object, hasObject := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(path, "/upload"), "/storage/v1/b/b"), "/o/")
+	switch {
+	case r.Method == http.MethodGet && path == "/storage/v1/b/b":
+		json.NewEncoder(w).Encode(storage.Bucket{Location: "US"})
+	case r.Method == http.MethodGet && path == "/storage/v1/b/b/iam/testPermissions":
+		var perms storage.TestIamPermissionsResponse
+		if !f.readOnly {
+			perms.Permissions = r.URL.Query()["permissions"]
+		}
+		json.NewEncoder(w).Encode(perms)
+	case r.Method == http.MethodPost && path == "/storage/v1/b":
+		var b storage.Bucket
+		json.NewDecoder(r.Body).Decode(&b)
+		f.created = append(f.created, r.URL.Query().Get("project")+"/"+b.Name)
+		f.buckets = append(f.buckets, b)
+		json.NewEncoder(w).Encode(b)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/storage/v1/b/") && !strings.Contains(strings.TrimPrefix(path, "/storage/v1/b/"), "/"):
+		http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/upload/"):
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var meta storage.Object
+		part, err := mr.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&meta)
+		}
+		if err == nil {
+			part, err = mr.NextPart()
+		}
+		var data []byte
+		if err == nil {
+			data, err = io.ReadAll(part)
+		}
+		// Like GCS, an aborted upload leaves no object
+		if err != nil {
+			http.Error(w, `{"error": {"code": 400, "message": "incomplete upload"}}`, http.StatusBadRequest)
+			return
+		}
+		f.objects[meta.Name] = data
+		json.NewEncoder(w).Encode(meta)
+	case r.Method == http.MethodGet && path == "/storage/v1/b/b/o":
+		var list storage.Objects
+		for _, n := range f.names() {
+			if strings.HasPrefix(n, r.URL.Query().Get("prefix")) {
+				list.Items = append(list.Items, &storage.Object{Name: n, Size: uint64(len(f.objects[n]))})
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodGet && hasObject && r.URL.Query().Get("alt") == "media":
+		data, ok := f.objects[object]
+		if !ok {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodPost && hasObject && strings.HasSuffix(object, "/compose"):
+		var req storage.ComposeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var data []byte
+		for _, src := range req.SourceObjects {
+			data = append(data, f.objects[src.Name]...)
+		}
+		dst := strings.TrimSuffix(object, "/compose")
+		f.objects[dst] = data
+		json.NewEncoder(w).Encode(storage.Object{Name: dst})
+	case r.Method == http.MethodPatch && hasObject:
+		var o storage.Object
+		json.NewDecoder(r.Body).Decode(&o)
+		if f.metadata == nil {
+			f.metadata = map[string]map[string]string{}
+		}
+		if f.metadata[object] == nil {
+			f.metadata[object] = map[string]string{}
+		}
+		maps.Copy(f.metadata[object], o.Metadata)
+		json.NewEncoder(w).Encode(storage.Object{Name: object, Metadata: f.metadata[object]})
+	case r.Method == http.MethodDelete && hasObject:
+		delete(f.objects, object)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+path, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rows kept per key by a deduplicated export, by ExportParams.DedupOrderBy.
+const (
+	DedupKeepFirst  = "first"
+	DedupKeepLatest = "latest"
+)
+
+// dedupRankColumn numbers the rows of a dedup key; it is dropped from the result.
+const dedupRankColumn = "_dedup_rank"
+
+// checkDedup validates the dedup options.
+func checkDedup(p ExportParams) error {
+	if len(p.DedupColumns) == 0 {
+		if p.DedupOrderBy != "" || p.DedupKeep != "" {
+			return fmt.Errorf("dedup_order_by and dedup_keep require dedup_columns")
+		}
+		return nil
+	}
+	switch p.DedupKeep {
+	case "", DedupKeepFirst, DedupKeepLatest:
+	default:
+		return fmt.Errorf("invalid dedup_keep %q; expected %s or %s", p.DedupKeep, DedupKeepFirst, DedupKeepLatest)
+	}
+	if p.DedupKeep != "" && p.DedupOrderBy == "" {
+		return fmt.Errorf("dedup_keep requires dedup_order_by")
+	}
+	return nil
+}
+
+// dedupQuery keeps one row of query per DedupColumns key: the one with the lowest
+// (DedupKeepFirst) or highest (DedupKeepLatest, the default) DedupOrderBy value, or an
+// arbitrary one without an ordering column. Without DedupColumns query is returned as is.
+func dedupQuery(query string, p ExportParams) string {
+	if len(p.DedupColumns) == 0 {
+		return query
+	}
+	keys := make([]string, len(p.DedupColumns))
+	for i, c := range p.DedupColumns {
+		keys[i] = quoteBigQueryColumn(c)
+	}
+	over := "PARTITION BY " + strings.Join(keys, ", ")
+	if p.DedupOrderBy != "" {
+		dir := "DESC"
+		if p.DedupKeep == DedupKeepFirst {
+			dir = "ASC"
+		}
+		over += " ORDER BY " + quoteBigQueryColumn(p.DedupOrderBy) + " " + dir
+	}
+	return fmt.Sprintf("SELECT * EXCEPT (%s) FROM (SELECT *, ROW_NUMBER() OVER (%s) AS %s FROM (%s)) WHERE %s = 1",
+		dedupRankColumn, over, dedupRankColumn, query, dedupRankColumn)
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDedupQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		p    ExportParams
+		want string
+	}{
+		{"none", ExportParams{}, "SELECT * FROM ds.t"},
+		{"latest", ExportParams{DedupColumns: []string{"id", "site"}, DedupOrderBy: "updated_at"},
+			"SELECT * EXCEPT (_dedup_rank) FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY `id`, `site` ORDER BY `updated_at` DESC) AS _dedup_rank FROM (SELECT * FROM ds.t)) WHERE _dedup_rank = 1"},
+		{"first", ExportParams{DedupColumns: []string{"id"}, DedupOrderBy: "updated_at", DedupKeep: DedupKeepFirst},
+			"SELECT * EXCEPT (_dedup_rank) FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY `id` ORDER BY `updated_at` ASC) AS _dedup_rank FROM (SELECT * FROM ds.t)) WHERE _dedup_rank = 1"},
+		{"any", ExportParams{DedupColumns: []string{"id"}},
+			"SELECT * EXCEPT (_dedup_rank) FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY `id`) AS _dedup_rank FROM (SELECT * FROM ds.t)) WHERE _dedup_rank = 1"},
+	}
+	for _, tt := range tests {
+		if got := dedupQuery("SELECT * FROM ds.t", tt.p); got != tt.want {
+			t.Errorf("%s: dedupQuery() =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunDedup(t *testing.T) {
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	params := ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/",
+		DedupColumns: []string{"visit_id"}, DedupOrderBy: "ingested_at", LineageColumns: true}
+	if _, err := e.Run(context.Background(), params); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	export := bq.queries[len(bq.queries)-1]
+	if !strings.Contains(export, "AS _source_query_hash FROM (SELECT * EXCEPT (_dedup_rank) FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY `visit_id` ORDER BY `ingested_at` DESC)") {
+		t.Errorf("export query %s does not deduplicate before the lineage columns", export)
+	}
+
+	for _, bad := range []ExportParams{
+		{Query: "SELECT 1", DedupOrderBy: "ts"},
+		{Query: "SELECT 1", DedupColumns: []string{"id"}, DedupKeep: DedupKeepFirst},
+		{Query: "SELECT 1", DedupColumns: []string{"id"}, DedupOrderBy: "ts", DedupKeep: "last"},
+	} {
+		bad.QueryLocation, bad.Output = "US", "gs://b/out/"
+		if _, err := e.Run(context.Background(), bad); FailureClass(err) != FailureConfig {
+			t.Errorf("Run(%+v) error = %v, want a config error", bad, err)
+		}
+	}
+}
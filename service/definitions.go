@@ -0,0 +1,159 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Definitions are the pipelines, with their schedules, as a declarative document: the
+// pipelines section of CONFIG_FILE.
+type Definitions struct {
+	Pipelines map[string]config.Pipeline `yaml:"pipelines" json:"pipelines"`
+}
+
+// DefinitionsChanges reports the pipelines applying definitions created, updated, left
+// unchanged and deleted, by name.
+type DefinitionsChanges struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged"`
+	Deleted   []string `json:"deleted"`
+	// DryRun is set when the changes were only planned
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// Definitions returns the pipelines visible to the caller in ctx.
+func (s *PipelineStore) Definitions(ctx context.Context) Definitions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d := Definitions{Pipelines: map[string]config.Pipeline{}}
+	for name, p := range s.pipelines {
+		if PipelineVisible(ctx, p) {
+			d.Pipelines[name] = p
+		}
+	}
+	return d
+}
+
+// MarshalDefinitions writes d as YAML, leaving out empty fields.
+func MarshalDefinitions(d Definitions) ([]byte, error) {
+	// The JSON form omits empty fields; its fields are named as in YAML
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	blockStyle(&doc)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// blockStyle drops the flow style and quotes of a document parsed from JSON, leaving the
+// encoder to quote only what needs it, and the empty mappings of unset structs.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	if n.Kind == yaml.MappingNode {
+		content := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if v := n.Content[i+1]; v.Kind != yaml.MappingNode || len(v.Content) > 0 {
+				content = append(content, n.Content[i], v)
+			}
+		}
+		n.Content = content
+	}
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// ParseDefinitions reads a YAML (or JSON) definitions document, rejecting unknown fields.
+func ParseDefinitions(data []byte) (Definitions, error) {
+	var d Definitions
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&d); err != nil && !errors.Is(err, io.EOF) {
+		return Definitions{}, ConfigError(fmt.Errorf("invalid definitions: %w", err))
+	}
+	return d, nil
+}
+
+// Apply makes the pipelines visible to the caller in ctx those of d: it creates the
+// missing ones, replaces those that differ and, with prune, deletes those d leaves out,
+// so applying the same document again changes nothing. All pipelines are validated
+// before any is stored. Tenant callers own the pipelines they apply and cannot replace
+// another tenant's. With dryRun, the changes are only reported.
+func (s *PipelineStore) Apply(ctx context.Context, d Definitions, prune, dryRun bool) (DefinitionsChanges, error) {
+	tenant, _, isTenant := TenantFrom(ctx)
+	for name, p := range d.Pipelines {
+		if isTenant {
+			p.Tenant = tenant
+			d.Pipelines[name] = p
+		}
+		if err := config.ValidatePipeline(name, p); err != nil {
+			return DefinitionsChanges{}, ConfigError(err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes := DefinitionsChanges{Created: []string{}, Updated: []string{}, Unchanged: []string{}, Deleted: []string{}, DryRun: dryRun}
+	for name, p := range d.Pipelines {
+		existing, ok := s.pipelines[name]
+		switch {
+		case !ok:
+			changes.Created = append(changes.Created, name)
+		case !PipelineVisible(ctx, existing):
+			return DefinitionsChanges{}, fmt.Errorf("%w: pipeline name already in use: %s", ErrForbidden, name)
+		case samePipeline(existing, p):
+			changes.Unchanged = append(changes.Unchanged, name)
+		default:
+			changes.Updated = append(changes.Updated, name)
+		}
+	}
+	if prune {
+		for name, p := range s.pipelines {
+			if _, keep := d.Pipelines[name]; !keep && PipelineVisible(ctx, p) {
+				changes.Deleted = append(changes.Deleted, name)
+			}
+		}
+	}
+	for _, names := range [][]string{changes.Created, changes.Updated, changes.Unchanged, changes.Deleted} {
+		sort.Strings(names)
+	}
+	if dryRun {
+		return changes, nil
+	}
+	for _, name := range append(changes.Created, changes.Updated...) {
+		s.pipelines[name] = d.Pipelines[name]
+	}
+	for _, name := range changes.Deleted {
+		delete(s.pipelines, name)
+	}
+	return changes, nil
+}
+
+// samePipeline reports whether two pipelines are defined alike, regardless of empty
+// against absent fields.
+func samePipeline(a, b config.Pipeline) bool {
+	x, errX := json.Marshal(a)
+	y, errY := json.Marshal(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefinitions(t *testing.T) {
+	store := NewPipelineStore(&config.Config{Pipelines: map[string]config.Pipeline{
+		"visits": {Query: "SELECT *\nFROM ds.visits", Schedule: "@daily", Destination: config.Destination{Output: "gs://b/visits/"}},
+		"labs":   {Query: "SELECT 1", Destination: config.Destination{Output: "gs://b/labs/"}, Tenant: "a"},
+	}})
+	ctx := context.Background()
+
+	data, err := MarshalDefinitions(store.Definitions(ctx))
+	if err != nil {
+		t.Fatalf("MarshalDefinitions() error = %v", err)
+	}
+	doc := string(data)
+	if !strings.Contains(doc, "    destination:\n      output: gs://b/visits/\n    schedule: '@daily'\n") || !strings.Contains(doc, "query: |-\n      SELECT *\n      FROM ds.visits") ||
+		strings.Contains(doc, "priority") || strings.Contains(doc, "notify") || strings.Contains(doc, "{") {
+		t.Errorf("MarshalDefinitions() =\n%s\nwant block YAML without empty fields", doc)
+	}
+	d, err := ParseDefinitions(data)
+	if err != nil {
+		t.Fatalf("ParseDefinitions() error = %v", err)
+	}
+	if !reflect.DeepEqual(d, store.Definitions(ctx)) {
+		t.Errorf("ParseDefinitions() = %+v, want the exported pipelines", d)
+	}
+
+	// Applying the exported document again changes nothing
+	changes, err := store.Apply(ctx, d, true, false)
+	if err != nil || len(changes.Unchanged) != 2 || len(changes.Created)+len(changes.Updated)+len(changes.Deleted) != 0 {
+		t.Errorf("Apply(same) = %+v, %v, want all unchanged", changes, err)
+	}
+
+	d, _ = ParseDefinitions([]byte("pipelines:\n  visits:\n    query: SELECT 2\n    destination: {output: gs://b/visits/}\n  vitals:\n    query: SELECT 3\n    destination: {output: gs://b/vitals/}\n"))
+	changes, err = store.Apply(ctx, d, true, true)
+	want := DefinitionsChanges{Created: []string{"vitals"}, Updated: []string{"visits"}, Unchanged: []string{}, Deleted: []string{"labs"}, DryRun: true}
+	if err != nil || !reflect.DeepEqual(changes, want) {
+		t.Errorf("Apply(dry run) = %+v, %v, want %+v", changes, err, want)
+	}
+	if _, ok := store.Get("vitals"); ok {
+		t.Error("Apply(dry run) stored a pipeline")
+	}
+	if _, err := store.Apply(ctx, d, true, false); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if p, ok := store.Get("visits"); !ok || p.Query != "SELECT 2" || p.Schedule != "" {
+		t.Errorf("visits = %+v, want replaced", p)
+	}
+	if _, ok := store.Get("labs"); ok {
+		t.Error("Apply(prune) kept labs")
+	}
+
+	tenantCtx := WithTenant(ctx, "a", config.Tenant{})
+	if _, err := store.Apply(tenantCtx, d, false, false); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Apply(tenant, another tenant's pipelines) error = %v, want ErrForbidden", err)
+	}
+	if _, err := ParseDefinitions([]byte("pipelines:\n  x:\n    qurey: SELECT 1\n")); FailureClass(err) != FailureConfig {
+		t.Errorf("ParseDefinitions(unknown field) error = %v, want a config error", err)
+	}
+	if _, err := store.Apply(ctx, Definitions{Pipelines: map[string]config.Pipeline{"bad name!": {Query: "SELECT 1"}}}, false, false); FailureClass(err) != FailureConfig {
+		t.Errorf("Apply(invalid) error = %v, want a config error", err)
+	}
+}
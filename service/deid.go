@@ -0,0 +1,297 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// DeidAudit records which de-identification profile produced an export: the profile's
+// name, a fingerprint of its rules and an ID of its key (neither reveals the key), and
+// the outcome of its k-anonymity check.
+type DeidAudit struct {
+	Profile     string `json:"profile"`
+	Fingerprint string `json:"fingerprint"`
+	KeyID       string `json:"key_id,omitempty"`
+	// K is the profile's threshold; SmallClasses counts the combinations of the
+	// quasi-identifiers found in fewer than K rows, SmallClassRows their rows
+	K              int      `json:"k,omitempty"`
+	SmallClasses   int64    `json:"small_classes,omitempty"`
+	SmallClassRows int64    `json:"small_class_rows,omitempty"`
+	Warnings       []string `json:"warnings,omitempty"`
+}
+
+// deidentification is a profile resolved for one run.
+type deidentification struct {
+	profile config.DeidProfile
+	// keyset is the KEYS.KEYSET_CHAIN expression of the profile's wrapped keyset
+	keyset string
+	// audit is filled in as the run applies the profile
+	audit DeidAudit
+}
+
+// applyDeidProfile resolves the de-identification profile of an export.
+func (e *Exporter) applyDeidProfile(p ExportParams) (ExportParams, error) {
+	if p.DeidProfile == "" {
+		return p, nil
+	}
+	profile, ok := e.DeidProfiles[p.DeidProfile]
+	if !ok {
+		return p, fmt.Errorf("unknown deid_profile %q", p.DeidProfile)
+	}
+	p.deid = newDeidentification(p.DeidProfile, profile)
+	return p, nil
+}
+
+func newDeidentification(name string, profile config.DeidProfile) *deidentification {
+	rules, _ := json.Marshal(profile)
+	sum := sha256.Sum256(rules)
+	d := &deidentification{
+		profile: profile,
+		audit:   DeidAudit{Profile: name, Fingerprint: hex.EncodeToString(sum[:8]), K: profile.K},
+	}
+	if profile.WrappedKeyset != "" {
+		// The wrapped keyset is only usable with decrypt access to the KMS key; its hash
+		// identifies it
+		d.audit.KeyID = deidKeyID(profile, nil)
+		d.keyset = fmt.Sprintf("KEYS.KEYSET_CHAIN(%s, FROM_BASE64(%s))", quoteBigQueryString(profile.KMSKey), quoteBigQueryString(profile.WrappedKeyset))
+	}
+	return d
+}
+
+// deidKeyID identifies the keys of profile, hmacKey being the key of its HMAC secret.
+func deidKeyID(profile config.DeidProfile, hmacKey []byte) string {
+	h := sha256.New()
+	h.Write([]byte("bq-exporter key id\n" + profile.KMSKey + "\n" + profile.WrappedKeyset))
+	if hmacKey != nil {
+		h.Write([]byte("\n"))
+		h.Write(hmacKey)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// The query parameters carrying the HMAC key of pseudonymize rules, padded as in HMAC.
+const (
+	deidHMACInner = "deid_hmac_inner"
+	deidHMACOuter = "deid_hmac_outer"
+)
+
+// minHMACKeyBytes is the shortest HMAC secret accepted.
+const minHMACKeyBytes = 16
+
+// withHMACKey reads the profile's HMAC secret with readSecret and returns ctx carrying
+// it as the query parameters of pseudonymize rules, so the key stays out of the SQL and
+// the job history. Profiles without one return ctx as is.
+func (d *deidentification) withHMACKey(ctx context.Context, readSecret func(context.Context, string) ([]byte, error)) (context.Context, error) {
+	if d == nil || d.profile.HMACSecret == "" {
+		return ctx, nil
+	}
+	if readSecret == nil {
+		readSecret = NewSecretReader()
+	}
+	key, err := readSecret(ctx, d.profile.HMACSecret)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to read the hmac_secret of de-identification profile %s: %w", d.audit.Profile, err)
+	}
+	if len(key) < minHMACKeyBytes {
+		return ctx, ConfigError(fmt.Errorf("the hmac_secret of de-identification profile %s is %d bytes; use at least %d random bytes", d.audit.Profile, len(key), minHMACKeyBytes))
+	}
+	d.audit.KeyID = deidKeyID(d.profile, key)
+	inner, outer := hmacPads(key)
+	return withQueryParameters(ctx,
+		bigquery.QueryParameter{Name: deidHMACInner, Value: inner},
+		bigquery.QueryParameter{Name: deidHMACOuter, Value: outer}), nil
+}
+
+// hmacPads returns the inner and outer padded keys of HMAC-SHA256 with key: the HMAC
+// of m is SHA256(outer || SHA256(inner || m)).
+func hmacPads(key []byte) (inner, outer []byte) {
+	if len(key) > sha256.BlockSize {
+		sum := sha256.Sum256(key)
+		key = sum[:]
+	}
+	inner, outer = make([]byte, sha256.BlockSize), make([]byte, sha256.BlockSize)
+	copy(inner, key)
+	copy(outer, key)
+	for i := range inner {
+		inner[i] ^= 0x36
+		outer[i] ^= 0x5c
+	}
+	return inner, outer
+}
+
+func (d *deidentification) warn(ctx context.Context, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	slog.WarnContext(ctx, "De-identification warning", "profile", d.audit.Profile, "warning", msg)
+	d.audit.Warnings = append(d.audit.Warnings, msg)
+}
+
+// deidentify wraps query in the profile's rules and runs its k-anonymity check. Rules of
+// columns the result does not have are skipped, so one profile serves several exports.
+func (d *deidentification) deidentify(ctx context.Context, bq BigQueryClient, query, location string) (string, error) {
+	if d == nil {
+		return query, nil
+	}
+	dry, err := bq.DryRun(ctx, query, location)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the result schema for de-identification: %w", err)
+	}
+	q, _, err := d.query(query, dry.Schema)
+	if err != nil {
+		return "", ConfigError(err)
+	}
+	if d.profile.K > 0 {
+		if err := d.checkKAnonymity(ctx, bq, q, dry.Schema, location); err != nil {
+			return "", err
+		}
+	}
+	slog.InfoContext(ctx, "De-identifying export", "profile", d.audit.Profile, "fingerprint", d.audit.Fingerprint, "key_id", d.audit.KeyID)
+	return q, nil
+}
+
+// query applies the rules to the columns of schema present in the result of query, and
+// returns the de-identified query and its schema.
+func (d *deidentification) query(query string, schema bigquery.Schema) (string, bigquery.Schema, error) {
+	var replace, drop []string
+	var out bigquery.Schema
+	for _, f := range schema {
+		r, ok := d.profile.Columns[f.Name]
+		if !ok {
+			out = append(out, f)
+			continue
+		}
+		c := quoteBigQueryColumn(f.Name)
+		if r.Rule == config.DeidDrop {
+			drop = append(drop, c)
+			continue
+		}
+		if f.Repeated || f.Type == bigquery.RecordFieldType {
+			return "", nil, fmt.Errorf("de-identification rule %s of column %s: ARRAY and STRUCT columns are not supported", r.Rule, f.Name)
+		}
+		g := *f
+		switch r.Rule {
+		case config.DeidPseudonymize:
+			msg := fmt.Sprintf("CAST(CAST(%s AS STRING) AS BYTES)", c)
+			if f.Type == bigquery.BytesFieldType {
+				msg = c
+			}
+			replace = append(replace, fmt.Sprintf("TO_HEX(SHA256(CONCAT(@%s, SHA256(CONCAT(@%s, %s))))) AS %s", deidHMACOuter, deidHMACInner, msg, c))
+			g.Type = bigquery.StringFieldType
+		case config.DeidEncrypt:
+			msg, data := fmt.Sprintf("CAST(%s AS STRING)", c), "''"
+			if f.Type == bigquery.BytesFieldType {
+				msg, data = c, "b''"
+			}
+			replace = append(replace, fmt.Sprintf("TO_HEX(DETERMINISTIC_ENCRYPT(%s, %s, %s)) AS %s", d.keyset, msg, data, c))
+			g.Type = bigquery.StringFieldType
+		case config.DeidGeneralize:
+			switch f.Type {
+			case bigquery.DateFieldType, bigquery.DateTimeFieldType, bigquery.TimestampFieldType:
+			default:
+				return "", nil, fmt.Errorf("de-identification rule generalize of column %s: expected a DATE, DATETIME or TIMESTAMP column, got %s", f.Name, f.Type)
+			}
+			unit := strings.ToUpper(r.Granularity)
+			if unit == "WEEK" {
+				unit = "ISOWEEK"
+			}
+			replace = append(replace, fmt.Sprintf("DATE_TRUNC(CAST(%s AS DATE), %s) AS %s", c, unit, c))
+			g.Type = bigquery.DateFieldType
+		case config.DeidSuppress:
+			replace = append(replace, fmt.Sprintf("IF(FALSE, %s, NULL) AS %s", c, c))
+		}
+		out = append(out, &g)
+	}
+	if len(replace) == 0 && len(drop) == 0 {
+		return query, out, nil
+	}
+	sel := "SELECT *"
+	if len(drop) > 0 {
+		sel += " EXCEPT (" + strings.Join(drop, ", ") + ")"
+	}
+	if len(replace) > 0 {
+		sel += " REPLACE (" + strings.Join(replace, ", ") + ")"
+	}
+	return sel + " FROM (" + query + ")", out, nil
+}
+
+// checkKAnonymity counts the combinations of the quasi-identifiers found in fewer than K
+// rows of the de-identified result and warns about them; it does not stop the export.
+func (d *deidentification) checkKAnonymity(ctx context.Context, bq BigQueryClient, query string, schema bigquery.Schema, location string) error {
+	present := map[string]bool{}
+	for _, f := range schema {
+		present[f.Name] = true
+	}
+	var cols []string
+	for _, c := range d.profile.QuasiIdentifiers {
+		if !present[c] {
+			d.warn(ctx, "quasi-identifier %s is not in the result and was not checked", c)
+			continue
+		}
+		cols = append(cols, quoteBigQueryColumn(c))
+	}
+	if len(cols) == 0 {
+		return nil
+	}
+	it, err := bq.ReadRows(ctx, buildKAnonymitySQL(query, cols, d.profile.K), location)
+	if err != nil {
+		return fmt.Errorf("failed to check k-anonymity: %w", err)
+	}
+	defer it.Close()
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil {
+		if err == iterator.Done {
+			return fmt.Errorf("failed to check k-anonymity: no result")
+		}
+		return fmt.Errorf("failed to check k-anonymity: %w", err)
+	}
+	d.audit.SmallClasses, _ = row[0].(int64)
+	d.audit.SmallClassRows, _ = row[1].(int64)
+	if d.audit.SmallClasses > 0 {
+		d.warn(ctx, "%d combinations of %s (%d rows) occur fewer than %d times", d.audit.SmallClasses,
+			strings.Join(d.profile.QuasiIdentifiers, ", "), d.audit.SmallClassRows, d.profile.K)
+	}
+	return nil
+}
+
+func buildKAnonymitySQL(query string, cols []string, k int) string {
+	return fmt.Sprintf("SELECT COUNT(*), IFNULL(SUM(n), 0) FROM (SELECT COUNT(*) AS n FROM (%s) GROUP BY %s HAVING COUNT(*) < %d)",
+		query, strings.Join(cols, ", "), k)
+}
+
+// recordDeidAudit appends the audit of a de-identified export to the BigQuery table
+// named by DEID_AUDIT_TABLE, if set, so the profile behind every output can be traced
+// after the job history has rolled over.
+func recordDeidAudit(ctx context.Context, bq BigQueryClient, params ExportParams, res ExportResult) error {
+	table := os.Getenv("DEID_AUDIT_TABLE")
+	if table == "" || params.deid == nil {
+		return nil
+	}
+	table, err := resolveBigQueryTable(table, "")
+	if err != nil {
+		return ConfigError(fmt.Errorf("invalid DEID_AUDIT_TABLE: %w", err))
+	}
+	a := params.deid.audit
+	dest := cmp.Or(res.GCSPath, res.Table)
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (run_id STRING, profile STRING, fingerprint STRING, key_id STRING, destination STRING, "+
+		"row_count INT64, k INT64, small_classes INT64, small_class_rows INT64, exported_at TIMESTAMP);\n"+
+		"INSERT INTO %s (run_id, profile, fingerprint, key_id, destination, row_count, k, small_classes, small_class_rows, exported_at) "+
+		"VALUES (%s, %s, %s, %s, %s, %d, %d, %d, %d, CURRENT_TIMESTAMP());",
+		quoteBigQueryTable(table), quoteBigQueryTable(table),
+		quoteBigQueryString(logging.RequestID(ctx)), quoteBigQueryString(a.Profile), quoteBigQueryString(a.Fingerprint),
+		quoteBigQueryString(a.KeyID), quoteBigQueryString(dest), res.Rows, a.K, a.SmallClasses, a.SmallClassRows)
+	if _, err := bq.RunQuery(ctx, stmt, params.QueryLocation); err != nil {
+		return fmt.Errorf("the export completed but its de-identification audit could not be written to %s: %w", table, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"slices"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+var testDeidProfile = config.DeidProfile{
+	HMACSecret:    "projects/p/secrets/deid-share",
+	KMSKey:        "gcp-kms://projects/p/locations/us/keyRings/deid/cryptoKeys/share",
+	WrappedKeyset: "CiQAp9Dn",
+	Columns: map[string]config.DeidRule{
+		"patient_id": {Rule: config.DeidPseudonymize},
+		"visit_id":   {Rule: config.DeidEncrypt},
+		"birth_date": {Rule: config.DeidGeneralize, Granularity: "week"},
+		"phone":      {Rule: config.DeidSuppress},
+		"name":       {Rule: config.DeidDrop},
+		"address":    {Rule: config.DeidDrop},
+	},
+	QuasiIdentifiers: []string{"birth_date", "sex"},
+	K:                5,
+}
+
+var testDeidSchema = bigquery.Schema{
+	{Name: "patient_id", Type: bigquery.IntegerFieldType},
+	{Name: "visit_id", Type: bigquery.StringFieldType},
+	{Name: "name", Type: bigquery.StringFieldType},
+	{Name: "birth_date", Type: bigquery.TimestampFieldType},
+	{Name: "sex", Type: bigquery.StringFieldType},
+	{Name: "phone", Type: bigquery.StringFieldType},
+}
+
+func TestDeidQuery(t *testing.T) {
+	d := newDeidentification("p", testDeidProfile)
+	got, schema, err := d.query("SELECT * FROM ds.patients", testDeidSchema)
+	if err != nil {
+		t.Fatalf("query() error = %v", err)
+	}
+	want := "SELECT * EXCEPT (`name`) REPLACE (" +
+		"TO_HEX(SHA256(CONCAT(@deid_hmac_outer, SHA256(CONCAT(@deid_hmac_inner, CAST(CAST(`patient_id` AS STRING) AS BYTES)))))) AS `patient_id`, " +
+		"TO_HEX(DETERMINISTIC_ENCRYPT(KEYS.KEYSET_CHAIN('gcp-kms://projects/p/locations/us/keyRings/deid/cryptoKeys/share', FROM_BASE64('CiQAp9Dn')), " +
+		"CAST(`visit_id` AS STRING), '')) AS `visit_id`, " +
+		"DATE_TRUNC(CAST(`birth_date` AS DATE), ISOWEEK) AS `birth_date`, IF(FALSE, `phone`, NULL) AS `phone`) FROM (SELECT * FROM ds.patients)"
+	if got != want {
+		t.Errorf("query() =\n%s\nwant\n%s", got, want)
+	}
+	var types []string
+	for _, f := range schema {
+		types = append(types, f.Name+" "+string(f.Type))
+	}
+	if got := strings.Join(types, ", "); got != "patient_id STRING, visit_id STRING, birth_date DATE, sex STRING, phone STRING" {
+		t.Errorf("query() schema = %s", got)
+	}
+	if testDeidSchema[0].Type != bigquery.IntegerFieldType {
+		t.Errorf("query() changed the input schema")
+	}
+
+	if got, _, _ := d.query("q", bigquery.Schema{{Name: "patient_id", Type: bigquery.BytesFieldType}}); !strings.Contains(got, "SHA256(CONCAT(@deid_hmac_inner, `patient_id`))") {
+		t.Errorf("query() of a BYTES column = %s", got)
+	}
+	if got, _, _ := d.query("q", bigquery.Schema{{Name: "visit_id", Type: bigquery.BytesFieldType}}); !strings.Contains(got, "FROM_BASE64('CiQAp9Dn')), `visit_id`, b''))") {
+		t.Errorf("query() of an encrypted BYTES column = %s", got)
+	}
+	if got, _, _ := d.query("q", bigquery.Schema{{Name: "sex", Type: bigquery.StringFieldType}}); got != "q" {
+		t.Errorf("query() without rule columns = %s, want the query unchanged", got)
+	}
+	for name, schema := range map[string]bigquery.Schema{
+		"generalize string":  {{Name: "birth_date", Type: bigquery.StringFieldType}},
+		"pseudonymize array": {{Name: "patient_id", Type: bigquery.IntegerFieldType, Repeated: true}},
+	} {
+		if _, _, err := d.query("q", schema); err == nil {
+			t.Errorf("%s: query() succeeded", name)
+		}
+	}
+}
+
+// The HMAC of pseudonymize rules, computed in BigQuery from the padded keys, is the
+// HMAC-SHA256 of the value.
+func TestHMACPads(t *testing.T) {
+	for _, key := range [][]byte{[]byte("0123456789abcdef"), bytes.Repeat([]byte{7}, 100)} {
+		inner, outer := hmacPads(key)
+		msg := []byte("P-0042")
+		in := sha256.Sum256(append(slices.Clone(inner), msg...))
+		got := sha256.Sum256(append(slices.Clone(outer), in[:]...))
+		mac := hmac.New(sha256.New, key)
+		mac.Write(msg)
+		if !hmac.Equal(got[:], mac.Sum(nil)) {
+			t.Errorf("HMAC from the pads of a %d byte key differs from crypto/hmac", len(key))
+		}
+	}
+}
+
+func TestExportDeidProfile(t *testing.T) {
+	t.Setenv("DEID_AUDIT_TABLE", "audit.deid")
+	bq := &fakeBigQuery{schema: testDeidSchema, rows: [][]bigquery.Value{{int64(2), int64(3)}}}
+	cfg := &config.Config{DeidProfiles: map[string]config.DeidProfile{"share": testDeidProfile}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), cfg)
+	key := []byte("a 32 byte key for the share test")
+	var secretsRead []string
+	e.ReadSecret = func(ctx context.Context, name string) ([]byte, error) {
+		secretsRead = append(secretsRead, name)
+		return key, nil
+	}
+	res, err := e.Run(context.Background(), ExportParams{
+		Query: "SELECT * FROM ds.patients", QueryLocation: "US", Output: "gs://b/share/", DeidProfile: "share",
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	a := res.Deidentification
+	if a == nil || a.Profile != "share" || a.Fingerprint == "" || a.KeyID == "" || a.SmallClasses != 2 || a.SmallClassRows != 3 || len(a.Warnings) != 1 {
+		t.Fatalf("Deidentification = %+v", a)
+	}
+	var check, export, audit string
+	for _, q := range bq.queries {
+		switch {
+		case strings.Contains(q, "HAVING COUNT(*) < 5"):
+			check = q
+		case strings.Contains(q, "EXPORT DATA"):
+			export = q
+		case strings.Contains(q, "INSERT INTO `audit.deid`"):
+			audit = q
+		}
+	}
+	if !strings.Contains(check, "GROUP BY `birth_date`, `sex`") || !strings.Contains(check, "ISOWEEK") {
+		t.Errorf("k-anonymity query = %s", check)
+	}
+	if !strings.Contains(export, "EXCEPT (`name`) REPLACE (") || !strings.Contains(export, "@deid_hmac_inner") {
+		t.Errorf("export SQL = %s", export)
+	}
+	if !slices.Equal(secretsRead, []string{testDeidProfile.HMACSecret}) || a.KeyID == deidKeyID(testDeidProfile, nil) {
+		t.Errorf("secrets read = %v, key ID = %s", secretsRead, a.KeyID)
+	}
+	if !strings.Contains(audit, "'share', '"+a.Fingerprint+"', '"+a.KeyID+"'") {
+		t.Errorf("audit SQL = %s", audit)
+	}
+
+	bad := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/share/", DeidProfile: "other"}
+	if _, err := e.Run(context.Background(), bad); FailureClass(err) != FailureConfig {
+		t.Errorf("Run(%+v) error = %v, want a config error", bad, err)
+	}
+	key = []byte("short")
+	short := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/share/", DeidProfile: "share"}
+	if _, err := e.Run(context.Background(), short); FailureClass(err) != FailureConfig {
+		t.Errorf("Run() with a short HMAC secret error = %v, want a config error", err)
+	}
+}
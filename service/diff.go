@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// DiffOpColumn is the column diff exports add to every row: DiffInsert, DiffUpdate or
+	// DiffDelete.
+	DiffOpColumn = "_op"
+	DiffInsert   = "I"
+	DiffUpdate   = "U"
+	DiffDelete   = "D"
+
+	// diffHashColumn holds the fingerprint of a row in the snapshot table.
+	diffHashColumn = "_row_hash"
+)
+
+// runDiff exports only the rows that changed since the previous run. The previous run is
+// remembered in the BigQuery snapshot table params.DiffSnapshot (key columns plus a row
+// hash): the current result is materialized next to it, compared on params.KeyColumns,
+// and inserted, updated and deleted rows are handed to the driver with an op column.
+// Deleted rows carry only their key columns. The snapshot advances only after the driver
+// succeeded, so a failed run is diffed again in full next time.
+func (e *Exporter) runDiff(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	snapshot, err := resolveDiffSnapshot(params.DiffSnapshot)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if len(params.KeyColumns) == 0 {
+		return ExportResult{}, fmt.Errorf("diff exports require key_columns")
+	}
+	filtered, err := rowFilterQuery(params.Query, params)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	current, err := params.deid.deidentify(ctx, bq, dedupQuery(filtered, params), params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	dry, err := bq.DryRun(ctx, current, params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if err := checkDiffSchema(dry.Schema, params.KeyColumns); err != nil {
+		return ExportResult{}, err
+	}
+
+	next := snapshot + "__next"
+	cleanup := registerCleanup(ctx, CleanupBigQueryTable, next, params.QueryLocation)
+	slog.InfoContext(ctx, "Materializing current result for diff", "snapshot", snapshot)
+	if job, err := bq.RunQuery(ctx, buildDiffPrepareSQL(snapshot, next, current, params.KeyColumns), params.QueryLocation); err != nil {
+		return ExportResult{Job: job}, fmt.Errorf("failed to prepare diff against %s: %w", snapshot, err)
+	}
+
+	diffParams := params
+	diffParams.Query = buildDiffQuery(snapshot, next, params.KeyColumns, dry.Schema)
+	if params.LineageColumns {
+		diffParams.Query = lineageQuery(ctx, diffParams.Query, params)
+	}
+	res, err := e.Driver.Execute(ctx, bq, diffParams)
+	if err != nil {
+		dropCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if _, dropErr := bq.RunQuery(dropCtx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", quoteBigQueryTable(next)), params.QueryLocation); dropErr != nil {
+			slog.ErrorContext(ctx, "Failed to drop diff staging table", "table", next, "error", dropErr)
+		} else {
+			cleanup.done(ctx)
+		}
+		return res, err
+	}
+
+	if _, err := bq.RunQuery(ctx, buildDiffAdvanceSQL(snapshot, next, params.KeyColumns), params.QueryLocation); err != nil {
+		return res, fmt.Errorf("changes were exported but the snapshot %s could not be advanced (the next run will re-send them): %w", snapshot, err)
+	}
+	cleanup.done(ctx)
+	slog.InfoContext(ctx, "Diff export completed", "snapshot", snapshot, "changed_rows", res.Rows)
+	return res, nil
+}
+
+// resolveDiffSnapshot validates the snapshot table name, which must name its dataset.
+func resolveDiffSnapshot(table string) (string, error) {
+	if !strings.Contains(table, ".") {
+		return "", fmt.Errorf("diff_snapshot must be a BigQuery table in dataset.table or project.dataset.table format, got %q", table)
+	}
+	return resolveBigQueryTable(table, "")
+}
+
+func checkDiffSchema(schema bigquery.Schema, keys []string) error {
+	cols := make([]string, len(schema))
+	for i, f := range schema {
+		if f.Name == DiffOpColumn || f.Name == diffHashColumn {
+			return fmt.Errorf("query result must not contain the reserved column %q", f.Name)
+		}
+		cols[i] = f.Name
+	}
+	for _, k := range keys {
+		if !slices.Contains(cols, k) {
+			return fmt.Errorf("key column %q is not in the query result", k)
+		}
+	}
+	return nil
+}
+
+// buildDiffPrepareSQL materializes the current result with row hashes into next (which
+// expires on its own if a run dies halfway) and creates the snapshot table on first use.
+func buildDiffPrepareSQL(snapshot, next, query string, keys []string) string {
+	return fmt.Sprintf("CREATE OR REPLACE TABLE %s OPTIONS(expiration_timestamp = TIMESTAMP_ADD(CURRENT_TIMESTAMP(), INTERVAL 1 DAY)) AS\n", quoteBigQueryTable(next)) +
+		fmt.Sprintf("SELECT t.*, TO_HEX(MD5(TO_JSON_STRING(t))) AS %s FROM (%s) AS t;\n", diffHashColumn, query) +
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s AS SELECT %s FROM %s WHERE FALSE;", quoteBigQueryTable(snapshot), diffSnapshotColumns(keys), quoteBigQueryTable(next))
+}
+
+func diffSnapshotColumns(keys []string) string {
+	cols := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		cols = append(cols, quoteBigQueryColumn(k))
+	}
+	return strings.Join(append(cols, diffHashColumn), ", ")
+}
+
+// buildDiffQuery selects the changed rows of next compared to snapshot.
+func buildDiffQuery(snapshot, next string, keys []string, schema bigquery.Schema) string {
+	on := make([]string, len(keys))
+	for i, k := range keys {
+		on[i] = fmt.Sprintf("n.%s = s.%s", quoteBigQueryColumn(k), quoteBigQueryColumn(k))
+	}
+	join := strings.Join(on, " AND ")
+	deleted := make([]string, len(schema))
+	for i, f := range schema {
+		col := quoteBigQueryColumn(f.Name)
+		if slices.Contains(keys, f.Name) {
+			deleted[i] = "s." + col
+		} else {
+			deleted[i] = "NULL AS " + col
+		}
+	}
+	return fmt.Sprintf("SELECT n.* EXCEPT(%s), IF(s.%s IS NULL, '%s', '%s') AS %s\nFROM %s AS n LEFT JOIN %s AS s ON %s\nWHERE s.%s IS NULL OR s.%s != n.%s\n",
+		diffHashColumn, diffHashColumn, DiffInsert, DiffUpdate, DiffOpColumn,
+		quoteBigQueryTable(next), quoteBigQueryTable(snapshot), join,
+		diffHashColumn, diffHashColumn, diffHashColumn) +
+		fmt.Sprintf("UNION ALL\nSELECT %s, '%s' AS %s\nFROM %s AS s LEFT JOIN %s AS n ON %s\nWHERE n.%s IS NULL",
+			strings.Join(deleted, ", "), DiffDelete, DiffOpColumn,
+			quoteBigQueryTable(snapshot), quoteBigQueryTable(next), join, diffHashColumn)
+}
+
+// buildDiffAdvanceSQL replaces the snapshot with the keys and hashes of next.
+func buildDiffAdvanceSQL(snapshot, next string, keys []string) string {
+	return fmt.Sprintf("CREATE OR REPLACE TABLE %s AS SELECT %s FROM %s;\nDROP TABLE %s;",
+		quoteBigQueryTable(snapshot), diffSnapshotColumns(keys), quoteBigQueryTable(next), quoteBigQueryTable(next))
+}
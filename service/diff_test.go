@@ -0,0 +1,61 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestBuildDiffQuery(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "status", Type: bigquery.StringFieldType},
+	}
+	got := buildDiffQuery("ds.snap", "ds.snap__next", []string{"id"}, schema)
+	for _, want := range []string{
+		"SELECT n.* EXCEPT(_row_hash), IF(s._row_hash IS NULL, 'I', 'U') AS _op",
+		"FROM `ds.snap__next` AS n LEFT JOIN `ds.snap` AS s ON n.`id` = s.`id`",
+		"WHERE s._row_hash IS NULL OR s._row_hash != n._row_hash",
+		"SELECT s.`id`, NULL AS `status`, 'D' AS _op",
+		"FROM `ds.snap` AS s LEFT JOIN `ds.snap__next` AS n ON n.`id` = s.`id`",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("diff query missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	bq := &fakeBigQuery{schema: bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	_, err := e.Run(context.Background(), ExportParams{
+		Query:         "SELECT id FROM ds.src",
+		QueryLocation: "US",
+		Output:        "gs://b/changes/",
+		KeyColumns:    []string{"id"},
+		DiffSnapshot:  "ds.snap",
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	// dry run, prepare, export of the changes, snapshot advance
+	if len(bq.queries) != 4 {
+		t.Fatalf("queries = %d, want 4: %q", len(bq.queries), bq.queries)
+	}
+	if !strings.Contains(bq.queries[1], "CREATE OR REPLACE TABLE `ds.snap__next`") {
+		t.Errorf("prepare SQL = %s", bq.queries[1])
+	}
+	if !strings.Contains(bq.queries[2], "EXPORT DATA") || !strings.Contains(bq.queries[2], "AS _op") {
+		t.Errorf("export SQL does not export the diff: %s", bq.queries[2])
+	}
+	if !strings.HasPrefix(bq.queries[3], "CREATE OR REPLACE TABLE `ds.snap` AS SELECT `id`, _row_hash FROM `ds.snap__next`") {
+		t.Errorf("advance SQL = %s", bq.queries[3])
+	}
+
+	if _, err := e.Run(context.Background(), ExportParams{Query: "SELECT 1", QueryLocation: "US", DiffSnapshot: "snap", KeyColumns: []string{"id"}}); err == nil {
+		t.Errorf("Run() with unqualified diff_snapshot should fail")
+	}
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDiscoveryNotFound is returned for unknown discoveries (or not visible to the caller).
+var ErrDiscoveryNotFound = errors.New("discovery not found")
+
+// DiscoveryState is the status of one discovery.
+type DiscoveryState struct {
+	Discovery string     `json:"discovery"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Dataset   string     `json:"dataset"`
+	Interval  string     `json:"interval"`
+	LastScan  *time.Time `json:"last_scan,omitempty"`
+	NextScan  *time.Time `json:"next_scan,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	// Pending are the proposed pipelines awaiting approval
+	Pending []string `json:"pending"`
+}
+
+// DiscoveryScan is the outcome of one scan of a discovery's dataset.
+type DiscoveryScan struct {
+	Discovery string `json:"discovery"`
+	// Tables is how many tables of the dataset the discovery selects
+	Tables int `json:"tables"`
+	// Proposed are the pipelines created for new tables
+	Proposed []string `json:"proposed"`
+}
+
+// Discoverer scans the datasets of the configured discoveries for new tables and
+// proposes a pipeline for each from the discovery's template, pending approval: new
+// study forms get an export definition instead of being forgotten. A table whose
+// pipeline name is taken is skipped, and a table is proposed once per process, so a
+// rejected (deleted) proposal is not proposed again until a restart restores it.
+//
+// Proposals and approvals are kept by the coordinator, so they survive restarts and
+// reach every instance; a new table is recorded and notified only by the instance
+// holding the discovery's scan lease, the others add its pipeline without a notification.
+type Discoverer struct {
+	e           *Exporter
+	discoveries map[string]config.Discovery
+	tenants     map[string]config.Tenant
+	coord       Coordinator
+
+	scanning sync.Mutex // serializes scans
+	mu       sync.Mutex
+	state    map[string]*discoveryEntry
+}
+
+type discoveryEntry struct {
+	lastScan time.Time
+	lastErr  string
+	seen     map[string]bool
+}
+
+func NewDiscoverer(e *Exporter, discoveries map[string]config.Discovery, tenants map[string]config.Tenant) *Discoverer {
+	d := &Discoverer{e: e, discoveries: discoveries, tenants: tenants, coord: e.Coordinator, state: map[string]*discoveryEntry{}}
+	if d.coord == nil {
+		d.coord = newLocalCoordinator()
+	}
+	for name := range discoveries {
+		d.state[name] = &discoveryEntry{seen: map[string]bool{}}
+	}
+	return d
+}
+
+// Coordinator keys of the proposals (a config.DiscoveredTable) and approvals (a
+// discoveryApproval), by pipeline.
+const (
+	discoveryProposedKey = "discovery:proposed:"
+	discoveryApprovedKey = "discovery:approved:"
+)
+
+type discoveryApproval struct {
+	At        time.Time `json:"at"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// Run scans every discovery on start and then at its interval, until ctx is cancelled.
+func (d *Discoverer) Run(ctx context.Context) {
+	slog.InfoContext(ctx, "Table discovery started", "discoveries", len(d.discoveries))
+	for {
+		d.tick(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// tick applies the approvals made on other instances and scans the discoveries due at
+// now.
+func (d *Discoverer) tick(ctx context.Context, now time.Time) {
+	if err := d.syncApprovals(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to load pipeline approvals", "error", err)
+	}
+	for _, name := range d.names() {
+		disc := d.discoveries[name]
+		interval, _ := disc.ScanInterval()
+		d.mu.Lock()
+		due := d.state[name].lastScan.IsZero() || !now.Before(d.state[name].lastScan.Add(interval))
+		d.mu.Unlock()
+		if !due {
+			continue
+		}
+		if _, err := d.run(logging.WithRequestID(ctx, logging.NewRequestID()), name, disc); err != nil {
+			slog.ErrorContext(ctx, "Table discovery failed", "discovery", name, "dataset", disc.Dataset, "error", err)
+		}
+	}
+}
+
+// Scan scans a discovery visible to the caller in ctx now.
+func (d *Discoverer) Scan(ctx context.Context, name string) (DiscoveryScan, error) {
+	disc, ok := d.discoveries[name]
+	if !ok || !discoveryVisible(ctx, disc) {
+		return DiscoveryScan{}, fmt.Errorf("%w: %s", ErrDiscoveryNotFound, name)
+	}
+	return d.run(ctx, name, disc)
+}
+
+// run lists the tables of the discovery's dataset, as its tenant, and proposes the
+// pipelines of the new ones.
+func (d *Discoverer) run(ctx context.Context, name string, disc config.Discovery) (DiscoveryScan, error) {
+	d.scanning.Lock()
+	defer d.scanning.Unlock()
+	if disc.Tenant != "" {
+		ctx = WithTenant(ctx, disc.Tenant, d.tenants[disc.Tenant])
+	}
+	res := DiscoveryScan{Discovery: name, Proposed: []string{}}
+	template := ExportParams{
+		QueryLocation:             disc.QueryLocation,
+		ImpersonateServiceAccount: disc.Template.Destination.ImpersonateServiceAccount,
+	}
+	tables, err := d.e.datasetTables(ctx, disc.Dataset, template, disc.Selects)
+	now := time.Now().UTC()
+	d.mu.Lock()
+	st := d.state[name]
+	st.lastScan, st.lastErr = now, ""
+	if err != nil {
+		st.lastErr = err.Error()
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return res, err
+	}
+	res.Tables = len(tables)
+	proposed, err := d.coord.Scan(ctx, discoveryProposedKey)
+	if err != nil {
+		return res, fmt.Errorf("failed to load proposals: %w", err)
+	}
+	approved, err := d.coord.Scan(ctx, discoveryApprovedKey)
+	if err != nil {
+		return res, fmt.Errorf("failed to load approvals: %w", err)
+	}
+	// Only the lease holder records and notifies new tables, so each is notified once
+	key, holder := "discovery:"+name, logging.RequestID(ctx)
+	leader, _, err := d.coord.TryLock(ctx, key, holder, leaseTTL)
+	if err != nil {
+		return res, err
+	}
+	if leader {
+		defer func() {
+			if err := d.coord.Unlock(context.WithoutCancel(ctx), key, holder); err != nil {
+				slog.WarnContext(ctx, "Failed to release discovery lease", "discovery", name, "error", err)
+			}
+		}()
+	}
+	for _, table := range tables {
+		d.mu.Lock()
+		seen := st.seen[table]
+		st.seen[table] = true
+		d.mu.Unlock()
+		if seen {
+			continue
+		}
+		pipeline, p := disc.Propose(table)
+		if _, exists := d.e.Pipelines.Get(pipeline); exists {
+			continue
+		}
+		_, ok := approved[discoveryApprovedKey+pipeline]
+		p.PendingApproval = !ok
+		p.Discovered = &config.DiscoveredTable{Discovery: name, Dataset: disc.Dataset, Table: table, At: now}
+		data, known := proposed[discoveryProposedKey+pipeline]
+		if known {
+			// Proposed before a restart or by another instance: restore it quietly
+			var rec config.DiscoveredTable
+			if json.Unmarshal(data, &rec) == nil {
+				p.Discovered = &rec
+			}
+		}
+		if err := d.e.Pipelines.Put(pipeline, p); err != nil {
+			slog.WarnContext(ctx, "Skipping discovered table", "discovery", name, "table", table, "error", err)
+			continue
+		}
+		if known || !leader {
+			continue
+		}
+		data, _ = json.Marshal(p.Discovered)
+		if err := d.coord.Put(ctx, discoveryProposedKey+pipeline, data); err != nil {
+			slog.ErrorContext(ctx, "Failed to record proposal", "discovery", name, "pipeline", pipeline, "error", err)
+		}
+		slog.WarnContext(ctx, "Discovered new table; its pipeline awaits approval", "discovery", name,
+			"dataset", disc.Dataset, "table", table, "pipeline", pipeline)
+		d.e.Notifier.NotifyDiscovered(ctx, pipeline, p, d.e.Driver.Name())
+		res.Proposed = append(res.Proposed, pipeline)
+	}
+	return res, nil
+}
+
+// Approve lets a pipeline proposed by a discovery run, if it is visible to the caller in
+// ctx, and records the approval for the other instances and restarts.
+func (d *Discoverer) Approve(ctx context.Context, name string) (config.Pipeline, error) {
+	if p, ok := d.e.Pipelines.Get(name); ok && p.Discovered != nil && PipelineVisible(ctx, p) {
+		data, _ := json.Marshal(discoveryApproval{At: time.Now().UTC(), RequestID: logging.RequestID(ctx)})
+		if err := d.coord.Put(ctx, discoveryApprovedKey+name, data); err != nil {
+			return config.Pipeline{}, fmt.Errorf("failed to record approval: %w", err)
+		}
+	}
+	return d.e.Pipelines.Approve(ctx, name)
+}
+
+// syncApprovals approves the pending pipelines approved on another instance.
+func (d *Discoverer) syncApprovals(ctx context.Context) error {
+	approved, err := d.coord.Scan(ctx, discoveryApprovedKey)
+	if err != nil {
+		return err
+	}
+	for key := range approved {
+		name := strings.TrimPrefix(key, discoveryApprovedKey)
+		if p, ok := d.e.Pipelines.Get(name); ok && p.PendingApproval {
+			if _, err := d.e.Pipelines.Approve(ctx, name); err == nil {
+				slog.InfoContext(ctx, "Pipeline approved on another instance", "pipeline", name)
+			}
+		}
+	}
+	return nil
+}
+
+// List returns the discoveries visible to the caller in ctx, by name.
+func (d *Discoverer) List(ctx context.Context) []DiscoveryState {
+	pending := map[string][]string{}
+	for _, pipeline := range d.e.Pipelines.Names() {
+		if p, ok := d.e.Pipelines.Get(pipeline); ok && p.PendingApproval && p.Discovered != nil {
+			pending[p.Discovered.Discovery] = append(pending[p.Discovered.Discovery], pipeline)
+		}
+	}
+	out := []DiscoveryState{}
+	for _, name := range d.names() {
+		disc := d.discoveries[name]
+		if !discoveryVisible(ctx, disc) {
+			continue
+		}
+		interval, _ := disc.ScanInterval()
+		st := DiscoveryState{Discovery: name, Tenant: disc.Tenant, Dataset: disc.Dataset, Interval: interval.String(), Pending: []string{}}
+		if p := pending[name]; p != nil {
+			st.Pending = p
+		}
+		d.mu.Lock()
+		if e := d.state[name]; !e.lastScan.IsZero() {
+			last, next := e.lastScan, e.lastScan.Add(interval)
+			st.LastScan, st.NextScan, st.LastError = &last, &next, e.lastErr
+		}
+		d.mu.Unlock()
+		out = append(out, st)
+	}
+	return out
+}
+
+func (d *Discoverer) names() []string {
+	names := make([]string, 0, len(d.discoveries))
+	for name := range d.discoveries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// discoveryVisible reports whether the caller in ctx may see and scan the discovery.
+func discoveryVisible(ctx context.Context, disc config.Discovery) bool {
+	name, _, ok := TenantFrom(ctx)
+	return !ok || disc.Tenant == name
+}
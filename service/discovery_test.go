@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestDiscoverer(t *testing.T) {
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "table_name", Type: bigquery.StringFieldType}},
+		rows:   [][]bigquery.Value{{"form_consent"}, {"form_visit"}, {"tmp_load"}},
+	}
+	cfg := &config.Config{
+		Pipelines: map[string]config.Pipeline{
+			"study_form_consent": {Query: "SELECT 1", Destination: config.Destination{Output: "gs://b/consent/"}},
+		},
+		Tenants: map[string]config.Tenant{"clinic_a": {APIKeys: []string{"key-a"}}},
+		Discoveries: map[string]config.Discovery{
+			"study": {
+				Dataset:       "study_a",
+				QueryLocation: "US",
+				Include:       []string{"form_*"},
+				Tenant:        "clinic_a",
+				Name:          "study_{table}",
+				Template:      config.Pipeline{Destination: config.Destination{Output: "gs://b/{dataset}/{table}/"}, Schedule: "@daily"},
+			},
+		},
+	}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), cfg)
+	d := NewDiscoverer(e, cfg.Discoveries, cfg.Tenants)
+	ctx := context.Background()
+
+	d.tick(ctx, time.Now())
+	if !strings.Contains(bq.queries[0], "FROM `study_a`.INFORMATION_SCHEMA.TABLES") {
+		t.Errorf("listing query = %s", bq.queries[0])
+	}
+	p, ok := e.Pipelines.Get("study_form_visit")
+	if !ok || !p.PendingApproval || p.Tenant != "clinic_a" || p.Discovered == nil || p.Discovered.Table != "form_visit" {
+		t.Fatalf("proposed pipeline = %+v, %v", p, ok)
+	}
+	if p.Query != "SELECT * FROM `study_a.form_visit`" || p.Destination.Output != "gs://b/study_a/form_visit/" || p.QueryLocation != "US" {
+		t.Errorf("proposed pipeline = %+v", p)
+	}
+	if existing, _ := e.Pipelines.Get("study_form_consent"); existing.PendingApproval || existing.Query != "SELECT 1" {
+		t.Errorf("existing pipeline replaced by %+v", existing)
+	}
+	if st := d.List(ctx); len(st) != 1 || !slices.Equal(st[0].Pending, []string{"study_form_visit"}) || st[0].LastScan == nil {
+		t.Errorf("List() = %+v", st)
+	}
+
+	// Pending pipelines do not run, and are not scheduled
+	if _, err := e.RunPipeline(ctx, "study_form_visit", ExportParams{}, nil); !errors.Is(err, ErrPipelinePending) {
+		t.Errorf("RunPipeline() of a pending pipeline error = %v, want ErrPipelinePending", err)
+	}
+	if _, err := d.Approve(WithTenant(ctx, "other", config.Tenant{}), "study_form_visit"); !errors.Is(err, ErrPipelineNotFound) {
+		t.Errorf("Approve() by another tenant error = %v", err)
+	}
+	if p, err := d.Approve(ctx, "study_form_visit"); err != nil || p.PendingApproval {
+		t.Fatalf("Approve() = %+v, %v", p, err)
+	}
+	if _, err := e.RunPipeline(ctx, "study_form_visit", ExportParams{}, nil); err != nil {
+		t.Errorf("RunPipeline() after approval error = %v", err)
+	}
+
+	// A rejected proposal is not proposed again; tables added later are
+	e.Pipelines.Delete("study_form_visit")
+	bq.rows = append(bq.rows, []bigquery.Value{"form_lab"})
+	res, err := d.Scan(ctx, "study")
+	if err != nil || !slices.Equal(res.Proposed, []string{"study_form_lab"}) || res.Tables != 3 {
+		t.Errorf("Scan() = %+v, %v", res, err)
+	}
+	if _, err := d.Scan(WithTenant(ctx, "other", config.Tenant{}), "study"); !errors.Is(err, ErrDiscoveryNotFound) {
+		t.Errorf("Scan() by another tenant error = %v", err)
+	}
+}
+
+func TestDiscovererSharesProposals(t *testing.T) {
+	var notified atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { notified.Add(1) }))
+	defer hook.Close()
+	mr := miniredis.RunT(t)
+	discoveries := map[string]config.Discovery{
+		"study": {
+			Dataset:  "study_a",
+			Name:     "study_{table}",
+			Template: config.Pipeline{Destination: config.Destination{Output: "gs://b/{table}/"}, Notify: config.Notify{Webhooks: []string{hook.URL}}},
+		},
+	}
+	instance := func() (*Exporter, *Discoverer) {
+		bq := &fakeBigQuery{
+			schema: bigquery.Schema{{Name: "table_name", Type: bigquery.StringFieldType}},
+			rows:   [][]bigquery.Value{{"form_visit"}},
+		}
+		e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+		e.Coordinator = newTestRedisCoordinator(t, mr)
+		return e, NewDiscoverer(e, discoveries, nil)
+	}
+	ctx := context.Background()
+
+	// An instance without the scan lease adds the pipeline but neither records nor notifies it
+	a, da := instance()
+	if ok, _, _ := a.Coordinator.TryLock(ctx, "discovery:study", "other", time.Minute); !ok {
+		t.Fatal("TryLock() = false")
+	}
+	if _, err := da.Scan(ctx, "study"); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if p, ok := a.Pipelines.Get("study_form_visit"); !ok || !p.PendingApproval || notified.Load() != 0 {
+		t.Fatalf("pipeline = %+v, %v; notified %d times", p, ok, notified.Load())
+	}
+	_ = a.Coordinator.Unlock(ctx, "discovery:study", "other")
+
+	// The lease holder records and notifies it once
+	b, db := instance()
+	if _, err := db.Scan(ctx, "study"); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if notified.Load() != 1 {
+		t.Errorf("notified %d times, want 1", notified.Load())
+	}
+	if _, err := db.Approve(ctx, "study_form_visit"); err != nil {
+		t.Fatalf("Approve() error = %v", err)
+	}
+	if p, _ := b.Pipelines.Get("study_form_visit"); p.PendingApproval {
+		t.Error("pipeline pending after Approve()")
+	}
+
+	// Other instances pick the approval up, and a restart restores it without notifying
+	da.tick(ctx, time.Now())
+	if p, _ := a.Pipelines.Get("study_form_visit"); p.PendingApproval {
+		t.Error("pipeline approved on another instance still pending")
+	}
+	c, dc := instance()
+	if _, err := dc.Scan(ctx, "study"); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if p, ok := c.Pipelines.Get("study_form_visit"); !ok || p.PendingApproval || notified.Load() != 1 {
+		t.Errorf("restored pipeline = %+v, %v; notified %d times", p, ok, notified.Load())
+	}
+}
@@ -0,0 +1,314 @@
+package service
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"google.golang.org/api/iterator"
+)
+
+// Download formats.
+const (
+	DownloadCSV    = "csv"
+	DownloadNDJSON = "ndjson"
+)
+
+// Default bounds of a download unless DOWNLOAD_MAX_ROWS and DOWNLOAD_MAX_BYTES set others.
+const (
+	defaultDownloadMaxRows  = 100000
+	defaultDownloadMaxBytes = 100 << 20 // 100 MiB
+)
+
+// downloadFlushRows is how many rows are written between flushes of the response.
+const downloadFlushRows = 1000
+
+// downloadLimitsFromEnv reads DOWNLOAD_MAX_ROWS and DOWNLOAD_MAX_BYTES, the most rows and
+// bytes a download may stream.
+func downloadLimitsFromEnv() (int64, int64) {
+	rows, bytes := int64(defaultDownloadMaxRows), int64(defaultDownloadMaxBytes)
+	if n, err := strconv.ParseInt(os.Getenv("DOWNLOAD_MAX_ROWS"), 10, 64); err == nil && n > 0 {
+		rows = n
+	}
+	if n, err := strconv.ParseInt(os.Getenv("DOWNLOAD_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		bytes = n
+	}
+	return rows, bytes
+}
+
+// DownloadStream receives a download: Begin is called once, before the first byte, when
+// the query succeeded; Flush after every chunk of rows.
+type DownloadStream interface {
+	io.Writer
+	Begin()
+	Flush()
+}
+
+// DownloadResult reports a download.
+type DownloadResult struct {
+	Rows           int64
+	Bytes          int64
+	BytesProcessed int64
+	// Truncated is set when the result had more rows or bytes than the download allows
+	Truncated bool
+}
+
+// Download streams the result of params.Query to w as CSV (with a header row of column
+// names, unless params.CSVHeader is none, and params.CSVDelimiter between fields) or
+// NDJSON, for small ad-hoc extracts. It stops at params.Limit rows, DOWNLOAD_MAX_ROWS or
+// DOWNLOAD_MAX_BYTES, whichever comes first, and reports the result as truncated.
+// Tenant requests are confined to the tenant's row filters and quotas. Downloads count
+// towards usage but are not recorded in the job history. Errors before Begin leave w
+// untouched; after it, the stream is incomplete.
+func (e *Exporter) Download(ctx context.Context, params ExportParams, w DownloadStream) (DownloadResult, error) {
+	params.QueryLocation = cmp.Or(params.QueryLocation, e.Defaults.QueryLocation)
+	rank, err := priorityRank(params.Priority)
+	if err != nil {
+		return DownloadResult{}, ConfigError(err)
+	}
+	delimiter, err := csvDelimiter(params.CSVDelimiter)
+	switch {
+	case err != nil:
+		return DownloadResult{}, ConfigError(err)
+	case params.Format != DownloadCSV && params.Format != DownloadNDJSON:
+		return DownloadResult{}, ConfigError(fmt.Errorf("unknown download format %q; expected csv or ndjson", params.Format))
+	case params.CSVHeader != "" && params.CSVHeader != CSVHeaderNames && params.CSVHeader != CSVHeaderNone:
+		return DownloadResult{}, ConfigError(fmt.Errorf("invalid csv_header %q for a download; expected names or none", params.CSVHeader))
+	case params.Limit < 0:
+		return DownloadResult{}, ConfigError(fmt.Errorf("limit must not be negative"))
+	}
+	maxRows, maxBytes := e.DownloadMaxRows, e.DownloadMaxBytes
+	if maxRows <= 0 || maxBytes <= 0 {
+		maxRows, maxBytes = downloadLimitsFromEnv()
+	}
+	if params.Limit > 0 {
+		maxRows = min(maxRows, params.Limit)
+	}
+	tenant, t, isTenant := TenantFrom(ctx)
+	if isTenant {
+		if sa := params.ImpersonateServiceAccount; sa != "" {
+			if _, err := applyTenant(ExportParams{ImpersonateServiceAccount: sa}, tenant, t); err != nil {
+				return DownloadResult{}, err
+			}
+		}
+		params = applyTenantRowFilter(ctx, params, t)
+		if err := e.Usage.checkQuota(ctx); err != nil {
+			return DownloadResult{}, err
+		}
+		// A download streams for as long as an export runs: it takes a slot as well
+		release, err := e.slots.acquire(tenant, t.MaxConcurrentExports)
+		if err != nil {
+			return DownloadResult{}, err
+		}
+		defer release()
+	}
+	if params.Query, err = rowFilterQuery(params.Query, params); err != nil {
+		return DownloadResult{}, err
+	}
+	if params, err = applySnapshotTime(params, time.Now()); err != nil {
+		return DownloadResult{}, err
+	}
+
+	release, err := e.queue.acquire(ctx, rank, func() {})
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	defer release()
+	client, err := e.impersonatedClient(ctx, params)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	bq := &meteredBigQuery{BigQueryClient: client}
+	res, err := e.download(ctx, bq, params, delimiter, maxRows, maxBytes, t.MaxBytesPerQuery, w)
+	res.BytesProcessed = bq.bytes.Load()
+	e.Usage.record(ctx, res.BytesProcessed, res.Rows)
+	return res, err
+}
+
+func (e *Exporter) download(ctx context.Context, bq BigQueryClient, params ExportParams, delimiter rune, maxRows, maxBytes, maxQueryBytes int64, w DownloadStream) (DownloadResult, error) {
+	var res DownloadResult
+	if maxQueryBytes > 0 {
+		dry, err := bq.DryRun(ctx, params.Query, params.QueryLocation)
+		if err != nil {
+			return res, fmt.Errorf("failed to estimate query cost: %w", err)
+		}
+		if dry.TotalBytesProcessed > maxQueryBytes {
+			return res, fmt.Errorf("%w: query would process %d bytes, tenant limit is %d", ErrQuotaExceeded, dry.TotalBytesProcessed, maxQueryBytes)
+		}
+	}
+	location, err := ResolveLocation(ctx, bq, params.Query, params.QueryLocation)
+	if err != nil {
+		return res, err
+	}
+	slog.InfoContext(ctx, "Starting download", "format", params.Format, "max_rows", maxRows, "max_bytes", maxBytes)
+	// One row past the cap tells a full result from a truncated one
+	it, err := bq.ReadRows(ctx, fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", params.Query, maxRows+1), location)
+	if err != nil {
+		return res, err
+	}
+	defer it.Close()
+	var row []bigquery.Value
+	err = it.Next(&row)
+	if err != nil && err != iterator.Done {
+		return res, err
+	}
+	schema := it.Schema()
+
+	w.Begin()
+	counter := &countingWriter{w: w}
+	out := bufio.NewWriter(counter)
+	var line strings.Builder
+	cw := csv.NewWriter(&line)
+	cw.Comma = delimiter
+	// writeLine writes a line unless it would exceed maxBytes
+	writeLine := func() bool {
+		if counter.n+int64(out.Buffered()+line.Len()) > maxBytes {
+			res.Truncated = true
+			return false
+		}
+		out.WriteString(line.String())
+		line.Reset()
+		return true
+	}
+	if params.Format == DownloadCSV && params.CSVHeader != CSVHeaderNone {
+		names := make([]string, len(schema))
+		for i, f := range schema {
+			names[i] = f.Name
+		}
+		cw.Write(names)
+		cw.Flush()
+		writeLine()
+	}
+	for err != iterator.Done && !res.Truncated {
+		if err != nil {
+			out.Flush()
+			res.Bytes = counter.n
+			return res, err
+		}
+		if res.Rows == maxRows {
+			res.Truncated = true
+			break
+		}
+		if params.Format == DownloadCSV {
+			cells := make([]string, len(row))
+			for i, v := range row {
+				cells[i] = downloadCSVCell(v)
+			}
+			cw.Write(cells)
+			cw.Flush()
+		} else {
+			// An object per row, its fields in column order
+			line.WriteByte('{')
+			for i, v := range row[:min(len(row), len(schema))] {
+				name, _ := json.Marshal(schema[i].Name)
+				value, jerr := json.Marshal(downloadJSONValue(v))
+				if jerr != nil {
+					return res, jerr
+				}
+				if i > 0 {
+					line.WriteByte(',')
+				}
+				line.Write(name)
+				line.WriteByte(':')
+				line.Write(value)
+			}
+			line.WriteString("}\n")
+		}
+		if !writeLine() {
+			break
+		}
+		res.Rows++
+		if res.Rows%downloadFlushRows == 0 {
+			out.Flush()
+			w.Flush()
+		}
+		err = it.Next(&row)
+	}
+	if ferr := out.Flush(); ferr != nil {
+		return res, ferr
+	}
+	w.Flush()
+	res.Bytes = counter.n
+	slog.InfoContext(ctx, "Download completed", "rows", res.Rows, "bytes", res.Bytes, "truncated", res.Truncated)
+	return res, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// downloadCSVCell formats a value for a CSV download: BYTES as base64, as BigQuery's CSV
+// exports do, but timestamps as in JSON downloads (RFC 3339 in UTC, where BigQuery writes
+// 2006-01-02 15:04:05 UTC) and arrays and structs as JSON.
+func downloadCSVCell(v bigquery.Value) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case []bigquery.Value, map[string]bigquery.Value:
+		data, _ := json.Marshal(downloadJSONValue(v))
+		return string(data)
+	}
+	switch v := downloadJSONValue(v).(type) {
+	case string:
+		return v
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// downloadJSONValue converts a BigQuery value into its JSON form: NUMERIC exactly, dates
+// and times as strings (timestamps in UTC), BYTES as base64.
+func downloadJSONValue(v bigquery.Value) any {
+	switch v := v.(type) {
+	case *big.Rat:
+		s := strings.TrimRight(v.FloatString(38), "0")
+		return json.Number(strings.TrimSuffix(s, "."))
+	case civil.Date:
+		return v.String()
+	case civil.DateTime:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case civil.Time:
+		return v.String()
+	case []bigquery.Value:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = downloadJSONValue(e)
+		}
+		return out
+	case map[string]bigquery.Value:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = downloadJSONValue(e)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+// bufferStream is a DownloadStream into memory.
+type bufferStream struct {
+	bytes.Buffer
+	began bool
+}
+
+func (b *bufferStream) Begin() { b.began = true }
+func (b *bufferStream) Flush() {}
+
+func TestDownload(t *testing.T) {
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}, {Name: "site", Type: bigquery.StringFieldType}, {Name: "visit_date", Type: bigquery.DateFieldType}},
+		rows: [][]bigquery.Value{
+			{int64(1), "A1", civil.Date{Year: 2026, Month: 10, Day: 13}},
+			{int64(2), "B, 2", nil},
+			{int64(3), "C3", civil.Date{Year: 2026, Month: 10, Day: 14}},
+		},
+	}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	ctx := context.Background()
+
+	var csvOut bufferStream
+	res, err := e.Download(ctx, ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Format: DownloadCSV}, &csvOut)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	want := "id,site,visit_date\n1,A1,2026-10-13\n2,\"B, 2\",\n3,C3,2026-10-14\n"
+	if csvOut.String() != want || res.Rows != 3 || res.Truncated || res.Bytes != int64(len(want)) {
+		t.Errorf("Download() = %+v, %q, want %q", res, csvOut.String(), want)
+	}
+	if q := bq.queries[len(bq.queries)-1]; !strings.Contains(q, "LIMIT 100001") {
+		t.Errorf("download query = %s, want the row cap plus one", q)
+	}
+
+	var ndjson bufferStream
+	res, err = e.Download(ctx, ExportParams{Query: "SELECT 1", QueryLocation: "US", Format: DownloadNDJSON, Limit: 2}, &ndjson)
+	if err != nil {
+		t.Fatalf("Download(ndjson) error = %v", err)
+	}
+	want = `{"id":1,"site":"A1","visit_date":"2026-10-13"}` + "\n" + `{"id":2,"site":"B, 2","visit_date":null}` + "\n"
+	if ndjson.String() != want || res.Rows != 2 || !res.Truncated {
+		t.Errorf("Download(ndjson, limit 2) = %+v, %q, want %q truncated", res, ndjson.String(), want)
+	}
+
+	// Rows past the byte cap are left out
+	e.DownloadMaxBytes = 40
+	var capped bufferStream
+	res, err = e.Download(ctx, ExportParams{Query: "SELECT 1", QueryLocation: "US", Format: DownloadCSV}, &capped)
+	if err != nil || res.Rows != 1 || !res.Truncated || capped.Len() > 40 {
+		t.Errorf("Download() over the byte cap = %+v, %v, %q", res, err, capped.String())
+	}
+
+	// A running download takes one of the tenant's export slots
+	tenant := config.Tenant{MaxConcurrentExports: 1}
+	release, err := e.slots.acquire("a", tenant.MaxConcurrentExports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var busy bufferStream
+	if _, err := e.Download(WithTenant(ctx, "a", tenant), ExportParams{Query: "SELECT 1", QueryLocation: "US", Format: DownloadCSV}, &busy); !errors.Is(err, ErrQuotaExceeded) || busy.began {
+		t.Errorf("Download() with the tenant's slots taken error = %v, want ErrQuotaExceeded", err)
+	}
+	release()
+	if _, err := e.Download(WithTenant(ctx, "a", tenant), ExportParams{Query: "SELECT 1", QueryLocation: "US", Format: DownloadCSV}, &busy); err != nil {
+		t.Errorf("Download() with a free slot error = %v", err)
+	}
+
+	var rejected bufferStream
+	if _, err := e.Download(ctx, ExportParams{Query: "SELECT 1", Format: "xlsx"}, &rejected); FailureClass(err) != FailureConfig || rejected.began {
+		t.Errorf("Download(xlsx) error = %v, began = %v, want a config error before streaming", err, rejected.began)
+	}
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// googleDriveDriverName is the EXPORT_DRIVER value of GoogleDriveDriver.
+const googleDriveDriverName = "GOOGLE_DRIVE"
+
+// FormatXLSX is the Excel workbook format of Google Drive exports.
+const FormatXLSX = "xlsx"
+
+// defaultDriveMaxRows is the row cap of Google Drive exports unless DRIVE_MAX_ROWS sets
+// another.
+const defaultDriveMaxRows = 50000
+
+// DriveService uploads files to Google Drive folders, also of shared drives.
+type DriveService struct {
+	svc *drive.Service
+}
+
+// NewDriveService creates the Google Drive client; opts carry its credentials.
+func NewDriveService(ctx context.Context, opts ...option.ClientOption) (*DriveService, error) {
+	// drive.file covers the files the service creates and replaces; it sees no others
+	opts = append([]option.ClientOption{option.WithScopes(drive.DriveFileScope)}, opts...)
+	svc, err := drive.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Google Drive client: %w", err)
+	}
+	return &DriveService{svc: svc}, nil
+}
+
+// NewDriveServiceFromEnv creates the Google Drive client acting as DRIVE_SERVICE_ACCOUNT,
+// impersonated with the service credentials in opts, or as the service itself. With
+// DRIVE_DELEGATED_USER the account acts as that Workspace user through domain-wide
+// delegation, so files are owned by the user instead of the service account.
+func NewDriveServiceFromEnv(ctx context.Context, opts ...option.ClientOption) (*DriveService, error) {
+	account, user := os.Getenv("DRIVE_SERVICE_ACCOUNT"), os.Getenv("DRIVE_DELEGATED_USER")
+	if account == "" {
+		if user != "" {
+			return nil, ConfigError(fmt.Errorf("DRIVE_DELEGATED_USER needs DRIVE_SERVICE_ACCOUNT, the account with domain-wide delegation"))
+		}
+		return NewDriveService(ctx, opts...)
+	}
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: account,
+		Scopes:          []string{drive.DriveFileScope},
+		Subject:         user,
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", account, err)
+	}
+	return NewDriveService(ctx, option.WithTokenSource(ts))
+}
+
+// parseDriveURI splits "drive://<folder ID>/<name>" into the folder ID and the file name,
+// which may be empty.
+func parseDriveURI(uri string) (string, string, error) {
+	rest, ok := strings.CutPrefix(uri, "drive://")
+	if !ok {
+		return "", "", fmt.Errorf("not a drive:// URI: %q", uri)
+	}
+	folder, name, _ := strings.Cut(rest, "/")
+	if folder == "" {
+		return "", "", fmt.Errorf("missing folder ID in %q", uri)
+	}
+	return folder, name, nil
+}
+
+// Upload writes data to the file name of folder and returns its link. A file of that
+// name in the folder is replaced, keeping its ID and sharing, so links to a recurring
+// deliverable stay valid.
+func (s *DriveService) Upload(ctx context.Context, folder, name, contentType string, data []byte) (string, error) {
+	q := fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false", driveQueryString(name), driveQueryString(folder))
+	list, err := s.svc.Files.List().Q(q).Fields("files(id)").SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to list Google Drive folder %s: %w", folder, err)
+	}
+	var f *drive.File
+	if len(list.Files) > 0 {
+		f, err = s.svc.Files.Update(list.Files[0].Id, &drive.File{}).Media(bytes.NewReader(data)).
+			SupportsAllDrives(true).Fields("id", "webViewLink").Context(ctx).Do()
+	} else {
+		f, err = s.svc.Files.Create(&drive.File{Name: name, Parents: []string{folder}, MimeType: contentType}).Media(bytes.NewReader(data)).
+			SupportsAllDrives(true).Fields("id", "webViewLink").Context(ctx).Do()
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s to Google Drive folder %s: %w", name, folder, err)
+	}
+	return f.WebViewLink, nil
+}
+
+// driveQueryString escapes s for a string literal of a Drive files query.
+func driveQueryString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// GoogleDriveDriver delivers small results as one CSV or XLSX file to a Google Drive
+// folder (output drive://<folder ID>/). The file is built in memory, so results of more
+// than maxRows rows fail before anything is uploaded.
+type GoogleDriveDriver struct {
+	drive   *DriveService
+	maxRows int
+}
+
+// NewGoogleDriveDriver returns a Google Drive driver; DRIVE_MAX_ROWS (default 50000)
+// caps the rows of a file.
+func NewGoogleDriveDriver(d *DriveService) *GoogleDriveDriver {
+	maxRows := defaultDriveMaxRows
+	if n, err := strconv.Atoi(os.Getenv("DRIVE_MAX_ROWS")); err == nil && n > 0 {
+		maxRows = n
+	}
+	return &GoogleDriveDriver{drive: d, maxRows: maxRows}
+}
+
+func (d *GoogleDriveDriver) Name() string {
+	return googleDriveDriverName
+}
+
+func (d *GoogleDriveDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{Files: true, ReadsRows: true}
+}
+
+// driveFile is the folder and file name an export with params uploads to: the name of
+// the output if it has the format's extension, otherwise <filename or name>[-timestamp].
+func driveFile(params ExportParams, timestamp string) (string, string, error) {
+	folder, name, err := parseDriveURI(params.Output)
+	if err != nil {
+		return "", "", err
+	}
+	ext := exportExtension(cmp.Or(params.Format, FormatCSV))
+	if !strings.HasSuffix(name, ext) {
+		name = cmp.Or(params.Filename, params.Name, "export")
+		if params.UseTimestamp != nil && *params.UseTimestamp {
+			name += "-" + timestamp
+		}
+		name += ext
+	}
+	return folder, name, nil
+}
+
+func (d *GoogleDriveDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	if d.drive == nil {
+		return ExportResult{}, ConfigError(fmt.Errorf("the %s driver needs a Google Drive client", googleDriveDriverName))
+	}
+	folder, name, err := driveFile(params, time.Now().Format("20060102-150405"))
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	slog.InfoContext(ctx, "Starting Google Drive export", "folder", folder, "file", name, "max_rows", d.maxRows)
+
+	// One row past the cap tells a full result from one that is too large
+	it, err := bq.ReadRows(ctx, fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", params.Query, d.maxRows+1), params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, fmt.Errorf("export to Google Drive failed: %w", err)
+	}
+	defer it.Close()
+	if it, err = transformRows(ctx, it, params.transformers); err != nil {
+		return ExportResult{}, err
+	}
+	var rows [][]bigquery.Value
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return ExportResult{Job: it.Job()}, fmt.Errorf("export to Google Drive failed: %w", err)
+		}
+		if len(rows) == d.maxRows {
+			return ExportResult{Job: it.Job()}, DataError(fmt.Errorf("result has more than %d rows (DRIVE_MAX_ROWS); export larger results to Cloud Storage", d.maxRows))
+		}
+		rows = append(rows, row)
+	}
+	res := ExportResult{Rows: int64(len(rows)), Job: it.Job()}
+
+	var buf bytes.Buffer
+	contentType := "text/csv"
+	if params.Format == FormatXLSX {
+		contentType = xlsxContentType
+		err = writeXLSX(&buf, []xlsxSheet{{name: "Sheet1", schema: it.Schema(), rows: rows}})
+	} else {
+		err = writeDriveCSV(&buf, params, it.Schema(), rows)
+	}
+	if err != nil {
+		return res, fmt.Errorf("failed to build %s: %w", name, err)
+	}
+	link, err := d.drive.Upload(ctx, folder, name, contentType, buf.Bytes())
+	if err != nil {
+		return res, err
+	}
+	res.GCSPath, res.Files, res.BytesWritten = link, 1, int64(buf.Len())
+	slog.InfoContext(ctx, "Google Drive export completed", "file", name, "link", link, "rows", res.Rows, "bytes_written", res.BytesWritten)
+	return res, nil
+}
+
+// writeDriveCSV writes rows as CSV with the header row and delimiter of params, formatted
+// like downloads.
+func writeDriveCSV(buf *bytes.Buffer, params ExportParams, schema bigquery.Schema, rows [][]bigquery.Value) error {
+	cw := csv.NewWriter(buf)
+	cw.Comma, _ = csvDelimiter(params.CSVDelimiter)
+	if params.CSVHeader != CSVHeaderNone {
+		names := make([]string, len(schema))
+		for i, f := range schema {
+			names[i] = f.Name
+			if params.CSVHeader == CSVHeaderTyped {
+				names[i] += ":" + string(f.Type)
+			}
+		}
+		cw.Write(names)
+	}
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			cells[i] = downloadCSVCell(v)
+		}
+		cw.Write(cells)
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+// fakeDrive serves the Files calls of DriveService: files are kept by ID with their name,
+// folder and the multipart upload body.
+type fakeDrive struct {
+	srv   *httptest.Server
+	mu    sync.Mutex
+	files map[string]*fakeDriveFile
+	// queries are the q parameters of the file lists
+	queries []string
+}
+
+type fakeDriveFile struct {
+	name, folder string
+	body         string
+}
+
+func newFakeDrive(t *testing.T) *fakeDrive {
+	f := &fakeDrive{files: map[string]*fakeDriveFile{}}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeDrive) service(t *testing.T) *DriveService {
+	d, err := NewDriveService(context.Background(), option.WithEndpoint(f.srv.URL+"/drive/v3/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func (f *fakeDrive) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	reply := func(id string) {
+		json.NewEncoder(w).Encode(map[string]string{"id": id, "webViewLink": "https://drive.google.com/file/d/" + id + "/view"})
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/drive/v3/files":
+		q := r.URL.Query().Get("q")
+		f.queries = append(f.queries, q)
+		var found []map[string]string
+		for id, file := range f.files {
+			if strings.Contains(q, "name = '"+file.name+"'") && strings.Contains(q, "'"+file.folder+"' in parents") {
+				found = append(found, map[string]string{"id": id})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"files": found})
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/drive/v3/files":
+		var meta struct {
+			Name    string   `json:"name"`
+			Parents []string `json:"parents"`
+		}
+		// The metadata is the first part of the multipart body
+		if _, part, ok := strings.Cut(string(body), "\r\n\r\n"); ok {
+			json.NewDecoder(strings.NewReader(part)).Decode(&meta)
+		}
+		id := fmt.Sprintf("file%d", len(f.files)+1)
+		f.files[id] = &fakeDriveFile{name: meta.Name, folder: strings.Join(meta.Parents, ","), body: string(body)}
+		reply(id)
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/upload/drive/v3/files/"):
+		id := strings.TrimPrefix(r.URL.Path, "/upload/drive/v3/files/")
+		file := f.files[id]
+		if file == nil {
+			http.NotFound(w, r)
+			return
+		}
+		file.body = string(body)
+		reply(id)
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.String(), http.StatusNotImplemented)
+	}
+}
+
+func TestDriveFile(t *testing.T) {
+	yes := true
+	tests := []struct {
+		params     ExportParams
+		folder, fn string
+	}{
+		{ExportParams{Output: "drive://F1/", Name: "visits"}, "F1", "visits.csv"},
+		{ExportParams{Output: "drive://F1", Filename: "report", Format: FormatXLSX, UseTimestamp: &yes}, "F1", "report-20240102-030405.xlsx"},
+		{ExportParams{Output: "drive://F1/weekly.xlsx", Filename: "report", Format: FormatXLSX}, "F1", "weekly.xlsx"},
+		{ExportParams{Output: "drive://F1/"}, "F1", "export.csv"},
+	}
+	for _, tt := range tests {
+		folder, name, err := driveFile(tt.params, "20240102-030405")
+		if err != nil || folder != tt.folder || name != tt.fn {
+			t.Errorf("driveFile(%s) = %s, %s, %v, want %s, %s", tt.params.Output, folder, name, err, tt.folder, tt.fn)
+		}
+	}
+	if _, _, err := driveFile(ExportParams{Output: "gs://b/out/"}, ""); err == nil {
+		t.Error("driveFile(gs://) error = nil, want an error")
+	}
+}
+
+func TestGoogleDriveDriver(t *testing.T) {
+	fd := newFakeDrive(t)
+	d := NewGoogleDriveDriver(fd.service(t))
+	schema := bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}, {Name: "site", Type: bigquery.StringFieldType}}
+	bq := &fakeBigQuery{schema: schema, rows: [][]bigquery.Value{{int64(1), "a"}, {int64(2), "b,c"}}}
+	params := ExportParams{Query: "SELECT 1", Output: "drive://folder1/", Filename: "visits"}
+	res, err := d.Execute(context.Background(), bq, params)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.Rows != 2 || res.Files != 1 || res.GCSPath != "https://drive.google.com/file/d/file1/view" {
+		t.Errorf("Execute() = %+v, want 2 rows in one file at its Drive link", res)
+	}
+	file := fd.files["file1"]
+	if file == nil || file.name != "visits.csv" || file.folder != "folder1" || !strings.Contains(file.body, "id,site\n1,a\n2,\"b,c\"\n") {
+		t.Errorf("files = %+v, want visits.csv with a header row in folder1", fd.files)
+	}
+	if !strings.Contains(bq.queries[0], "LIMIT 50001") {
+		t.Errorf("query = %s, want one row past the cap", bq.queries[0])
+	}
+
+	// A second run replaces the file in place
+	bq.rows = bq.rows[:1]
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() again error = %v", err)
+	}
+	if len(fd.files) != 1 || strings.Contains(fd.files["file1"].body, "b,c") {
+		t.Errorf("files = %+v, want file1 updated", fd.files)
+	}
+
+	// csv_header and csv_delimiter shape the file
+	csvParams := params
+	csvParams.Filename, csvParams.CSVDelimiter, csvParams.CSVHeader = "typed", ";", CSVHeaderTyped
+	if _, err := d.Execute(context.Background(), bq, csvParams); err != nil {
+		t.Fatalf("Execute() with csv options error = %v", err)
+	}
+	if f := fd.files["file2"]; f == nil || f.name != "typed.csv" || !strings.Contains(f.body, "id:INTEGER;site:STRING\n1;a\n") {
+		t.Errorf("files = %+v, want typed.csv with a typed header and ; delimiters", fd.files)
+	}
+	csvParams.Filename, csvParams.CSVDelimiter, csvParams.CSVHeader = "bare", "", CSVHeaderNone
+	if _, err := d.Execute(context.Background(), bq, csvParams); err != nil {
+		t.Fatalf("Execute() without a header error = %v", err)
+	}
+	if f := fd.files["file3"]; f == nil || strings.Contains(f.body, "id") || !strings.Contains(f.body, "1,a\n") {
+		t.Errorf("files = %+v, want bare.csv without a header row", fd.files)
+	}
+
+	params.Format = FormatXLSX
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() xlsx error = %v", err)
+	}
+	if f := fd.files["file4"]; f == nil || f.name != "visits.xlsx" || !strings.Contains(f.body, xlsxContentType) {
+		t.Errorf("files = %+v, want a visits.xlsx workbook", fd.files)
+	}
+
+	d.maxRows = 1
+	bq.rows = [][]bigquery.Value{{int64(1), "a"}, {int64(2), "b"}}
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData {
+		t.Errorf("Execute() over the cap error = %v, want a data error", err)
+	}
+}
+
+func TestCheckFormatGoogleDrive(t *testing.T) {
+	for _, p := range []ExportParams{{}, {Format: FormatCSV}, {Format: FormatXLSX}, {Format: FormatCSV, CSVDelimiter: ";", CSVHeader: CSVHeaderTyped}, {CSVHeader: CSVHeaderNone}} {
+		if err := checkFormat(p, googleDriveDriverName); err != nil {
+			t.Errorf("checkFormat(%q) error = %v", p.Format, err)
+		}
+	}
+	for _, p := range []ExportParams{{Format: FormatParquet}, {Format: FormatXLSX, CSVDelimiter: ";"}, {Format: FormatCSV, CSVHeader: "upper"}, {Format: FormatCSV, CSVDelimiter: "ab"}, {Format: FormatCSV, CSVBOM: true}, {SchemaFile: true}} {
+		if err := checkFormat(p, googleDriveDriverName); err == nil {
+			t.Errorf("checkFormat(%+v) error = nil, want an error", p)
+		}
+	}
+}
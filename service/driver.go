@@ -1,24 +1,294 @@
 package service
 
-import "context"
+import (
+	"bq-exporter/config"
+	"context"
+	"time"
+)
 
 type ExportParams struct {
+	// Pipeline is the pipeline the run belongs to, if any (informational)
+	Pipeline string
+	// RetryOf is the job ID of the failed run this run retries, if any (informational)
+	RetryOf string
+	// Priority is PriorityInteractive, PriorityNormal (default) or PriorityBatch
+	Priority string
+	// Debug reports the executed statements in ExportResult.Statements
+	Debug bool
+	// LogicalDate is the date or time slot the run exports, e.g. the schedule time of a
+	// Cloud Scheduler job; an identical export of the same logical date that already
+	// succeeded answers the run with its result (see runFingerprint)
+	LogicalDate string
+	// Limit and SamplePercent export only part of the result, for test runs: a random
+	// SamplePercent of the rows, then at most Limit of them
+	Limit         int64
+	SamplePercent float64
+	// Name is the logical export name used to fill defaulted filenames and tables
+	Name          string
 	Query         string
 	Output        string
 	Filename      string
 	QueryLocation string
-	UseTimestamp  bool
-	Table         string
-	Database      string
-	CreateDDL     string
+	// SnapshotTime, if set, reads the query's tables as of this time (FOR SYSTEM_TIME
+	// AS OF): an RFC 3339 timestamp, or SnapshotTimeNow for the start of the run
+	SnapshotTime string
+	UseTimestamp *bool
+	Table        string
+	Database     string
+	CreateDDL    string
+	// ImpersonateServiceAccount, if set, runs the BigQuery side of the export as this
+	// service account instead of the service identity
+	ImpersonateServiceAccount string
+	// LineageColumns appends the provenance columns _export_job_id, _exported_at and
+	// _source_query_hash to every exported row
+	LineageColumns bool
+	// Labels and Description are attached to the destination after the load, with their
+	// placeholders filled in (see labelDestination)
+	Labels      map[string]string
+	Description string
+	// Transforms transform the rows in flight, in order, for the drivers that read them
+	Transforms []config.Transform
+	// ComputedColumns are appended to every row after the transforms, computed by CEL
+	// expressions over the other columns
+	ComputedColumns []config.ComputedColumn
+	// transformers are the transforms built for the run (see applyTransforms)
+	transformers []RowTransformer
+
+	// GCS options: Format is FormatParquet (default), FormatCSV, FormatFHIR or
+	// FormatREDCap; CSV files start with a CSVHeader row (names, typed or none) and
+	// optionally a UTF-8 BOM, with fields separated by CSVDelimiter (default ",").
+	// SchemaFile writes the result schema next to the files. FHIRMapping and
+	// REDCapMapping name the configured mappings of FormatFHIR and FormatREDCap files.
+	Format        string
+	CSVHeader     string
+	CSVDelimiter  string
+	CSVBOM        bool
+	SchemaFile    bool
+	FHIRMapping   string
+	REDCapMapping string
+	// fhir and redcap are the resolved mappings (see applyFormatMapping)
+	fhir   *config.FHIRMapping
+	redcap *config.REDCapMapping
+	// ResolveSingleFile returns the name of the file written, instead of the pattern, in
+	// ExportResult.GCSPath when the export wrote a single file (GCS drivers)
+	ResolveSingleFile bool
+
+	// GCS_PARQUET_WRITE options: RowGroupRows is the number of rows per Parquet row group
+	// (default 100000) and MaxFileRows, if set, starts a new file after that many rows
+	RowGroupRows int
+	MaxFileRows  int64
+	// ParquetTimestamp, ParquetDecimal and ParquetString choose the Parquet types of
+	// timestamps, NUMERIC/BIGNUMERIC and strings (see parquetTypesOf)
+	ParquetTimestamp string
+	ParquetDecimal   string
+	ParquetString    string
+
+	// REDIS options: RedisType is RedisHash (default) or RedisSet, and RedisTTL, a
+	// duration, expires the keys written
+	RedisType string
+	RedisTTL  string
+
+	// StarRocks options
+	ReplicationNum int
+	LoadStrategy   string
+	// DeleteColumn marks rows to delete from the destination by KeyColumns instead of
+	// loading them, when its value is one of DeleteValues
+	DeleteColumn string
+	DeleteValues []string
+	// ColumnNames is the column name policy: quote (default), sanitize or strict;
+	// ColumnCase the column case policy: preserve (default), lower or upper
+	ColumnNames string
+	ColumnCase  string
+	// StringType is the type of created string columns: varchar (default, 1024 bytes),
+	// string or auto (sized from the data)
+	StringType string
+	// Verify checks the destination row count after StarRocks loads, on the read
+	// endpoint when one is configured
+	Verify bool
+	// AllowSchemaChanges false fails exports that would change the schema of the
+	// destination (see applyFeatures); nil allows them
+	AllowSchemaChanges *bool
+
+	// BigQuery destination table options; KeyColumns also identify rows in diff exports
+	WriteMode           string
+	KeyColumns          []string
+	DestinationLocation string
+
+	// DiffSnapshot, if set, makes the export a diff against the snapshot stored in this
+	// BigQuery table: only changed rows are exported, with an op column
+	DiffSnapshot string
+
+	// ChangesTable, if set, sources the export from the change history of this BigQuery
+	// table (CHANGES or APPENDS per ChangesMode) since the previous run; Query is optional
+	// and reads the history as table "changes"
+	ChangesTable string
+	ChangesMode  string
+
+	// DedupColumns, if set, keeps one row per key of these columns: the first or latest
+	// (DedupKeep, default latest) by DedupOrderBy, or any one without it
+	DedupColumns []string
+	DedupOrderBy string
+	DedupKeep    string
+
+	// DeidProfile names the configured de-identification profile applied to the result;
+	// deid is the profile resolved for the run (see applyDeidProfile)
+	DeidProfile string
+	deid        *deidentification
+
+	// Assertions are checked against the destination after the load
+	Assertions []config.Assertion
+	// NotifySample samples the destination for the run's notifications (see sampleRows)
+	NotifySample *config.NotifySample
+
+	// rowFilters are the conditions of the tenant (and API key) rows must satisfy (see
+	// applyTenantRowFilter)
+	rowFilters []string
+	// disabledFeatures are the features turned off for the destination (see
+	// applyFeatures)
+	disabledFeatures []string
+
+	// ShardColumn, ShardIndex and ShardCount restrict the export to the rows whose
+	// ShardColumn value hashes to ShardIndex modulo ShardCount; ShardLabel names the
+	// slice of a sharded export and suffixes its GCS filename (see TaskShard)
+	ShardColumn string
+	ShardIndex  int
+	ShardCount  int
+	ShardLabel  string
+
+	// ChunkColumn, ChunkBy, ChunkStart and ChunkEnd split the export into one export per
+	// day, week or month (default) of the ChunkColumn dates from ChunkStart to ChunkEnd
+	// (see runChunks)
+	ChunkColumn string
+	ChunkBy     string
+	ChunkStart  string
+	ChunkEnd    string
 }
 
 type ExportResult struct {
 	GCSPath string
 	Table   string
 	Rows    int64
+	Job     QueryJob
+
+	// DuplicateOf is the job ID of the identical run whose result answered this one
+	DuplicateOf string
+
+	// RowsDeleted counts destination rows deleted through the delete marker
+	RowsDeleted int64
+	// ColumnMapping maps result columns renamed by the column name or case policy to their
+	// destination names
+	ColumnMapping map[string]string
+	// DestinationRows is the destination row count after a verified load
+	DestinationRows int64
+	// Tables is the outcome of every table of a dataset sync
+	Tables []SnapshotTable
+
+	// Deidentification is the audit of a de-identified export (filled in by the Exporter)
+	Deidentification *DeidAudit
+	// Assertions are the outcomes of the export's assertions (filled in by the Exporter)
+	Assertions []AssertionResult
+	// QualityReport reports the assertions (filled in by the Exporter)
+	QualityReport *QualityReport
+	// Files and BytesWritten count the files an export wrote and their size, when the
+	// driver knows them (for EXPORT DATA, the size from the output listing)
+	Files        int64
+	BytesWritten int64
+	// Chunks are the outcomes of the date ranges of a chunked export
+	Chunks []ExportChunk
+	// Sample holds anonymized rows of the destination (filled in by the Exporter)
+	Sample *RowSample
+
+	// BytesProcessed sums the BigQuery jobs of the export (filled in by the Exporter)
+	BytesProcessed int64
+	// Statements lists the executed statements of debug exports (filled in by the
+	// Exporter, also when the export failed)
+	Statements []Statement
+	// Warnings are the steps that failed after the load committed, such as labelling the
+	// destination (filled in by the Exporter)
+	Warnings []string
 }
 
 type ExportDriver interface {
-	Execute(ctx context.Context, bq *BigQueryService, params ExportParams) (ExportResult, error)
+	// Name is the EXPORT_DRIVER value selecting this driver.
+	Name() string
+	// Capabilities are what the checks shared by all drivers need to know of this one.
+	Capabilities() DriverCapabilities
+	Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error)
+}
+
+// DriverCapabilities describe what a driver supports, so the shared checks ask the
+// driver instead of listing driver names.
+type DriverCapabilities struct {
+	// Files is set for drivers writing files named by output and filename; Folders when
+	// the output is a path that can take a folder per export, unlike Drive folder IDs
+	Files, Folders bool
+	// Extension is the extension of the files when it does not follow the format
+	Extension string
+	// FileTables is set for file drivers writing a table named by table into each file
+	FileTables bool
+	// ReadsRows is set for drivers reading the query result themselves, so they can
+	// transform the rows
+	ReadsRows bool
+	// Labels is set for destinations that labels and a description can be attached to
+	Labels bool
+	// Readback is how BigQuery reads the destination back, for assertions and samples
+	Readback Readback
+	// QuotaBackoff is the first delay after a BigQuery quota error (default 30s)
+	QuotaBackoff time.Duration
+}
+
+// Readback is how BigQuery reads back what an export wrote.
+type Readback int
+
+const (
+	// ReadbackNone is for destinations BigQuery cannot read.
+	ReadbackNone Readback = iota
+	// ReadbackFiles loads the written files, when their format can be loaded.
+	ReadbackFiles
+	// ReadbackQuery queries the destination table.
+	ReadbackQuery
+)
+
+// drivers are the drivers of this build, for the checks that only know the EXPORT_DRIVER
+// value, such as config validation.
+var drivers = []ExportDriver{
+	&GCSDriver{}, &ParquetWriteDriver{}, &StarRocksDriver{}, &BigQueryTableDriver{}, &AzureBlobDriver{},
+	&GoogleDriveDriver{}, &HTTPPostDriver{}, &FirestoreDriver{}, &SpannerDriver{}, &RedisDriver{}, &SQLiteDriver{},
+}
+
+// knownDriver returns the driver of this build named name.
+func knownDriver(name string) (ExportDriver, bool) {
+	for _, d := range drivers {
+		if d.Name() == name {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// driverCapabilities returns the capabilities of the driver named name; none for
+// unknown drivers.
+func driverCapabilities(name string) DriverCapabilities {
+	if d, ok := knownDriver(name); ok {
+		return d.Capabilities()
+	}
+	return DriverCapabilities{}
+}
+
+// driverNames returns the names of the drivers of this build having the capabilities
+// has (all with nil).
+func driverNames(has func(DriverCapabilities) bool) []string {
+	var names []string
+	for _, d := range drivers {
+		if has == nil || has(d.Capabilities()) {
+			names = append(names, d.Name())
+		}
+	}
+	return names
+}
+
+// destinationTabler is implemented by drivers loading into a named table, to resolve
+// the [project.]dataset.table or database.table an export writes.
+type destinationTabler interface {
+	destinationTable(params ExportParams) (string, error)
 }
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	WriteModeReplace = "replace"
+	WriteModeAppend  = "append"
+	WriteModeMerge   = "merge"
+)
+
+// bigQueryStageTable is the script-scoped temp table cross-region loads land in.
+const bigQueryStageTable = "_bq_exporter_stage"
+
+// BigQueryTableDriver materializes query results into another BigQuery table, possibly in
+// another project. When the destination dataset lives in a different location than the
+// query, results bounce through GCS: EXPORT DATA in the source location, an optional
+// cross-location object copy, and LOAD DATA in the destination location.
+type BigQueryTableDriver struct {
+	gcs     *GCSService
+	staging StagingBuckets
+}
+
+func NewBigQueryTableDriver(gcs *GCSService, staging StagingBuckets) *BigQueryTableDriver {
+	return &BigQueryTableDriver{gcs: gcs, staging: staging}
+}
+
+func (d *BigQueryTableDriver) Name() string {
+	return "BIGQUERY"
+}
+
+// Capabilities: table loads run into per-table update limits that clear within seconds,
+// so quota errors are retried sooner than for the other drivers.
+func (d *BigQueryTableDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{Labels: true, Readback: ReadbackQuery, QuotaBackoff: 10 * time.Second}
+}
+
+func (d *BigQueryTableDriver) destinationTable(params ExportParams) (string, error) {
+	return resolveBigQueryTable(params.Table, params.Database)
+}
+
+// breakerDestination keys the breakers of table loads by dataset.
+func (d *BigQueryTableDriver) breakerDestination(params ExportParams) string {
+	dataset := params.Database
+	if before, _, ok := strings.Cut(params.Table, "."); ok && dataset == "" {
+		dataset = before
+	}
+	return "bigquery:" + dataset
+}
+
+func (d *BigQueryTableDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	table, err := resolveBigQueryTable(params.Table, params.Database)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	mode, err := bigQueryWriteMode(params)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+
+	// MERGE needs the full column list for its UPDATE clause
+	var cols []string
+	if mode == WriteModeMerge {
+		dry, err := bq.DryRun(ctx, params.Query, params.QueryLocation)
+		if err != nil {
+			return ExportResult{}, err
+		}
+		for _, f := range dry.Schema {
+			cols = append(cols, f.Name)
+		}
+		for _, k := range params.KeyColumns {
+			if !slices.Contains(cols, k) {
+				return ExportResult{}, ConfigError(fmt.Errorf("key column %q is not in the query result", k))
+			}
+		}
+	}
+
+	destLocation := params.DestinationLocation
+	if destLocation == "" || strings.EqualFold(destLocation, params.QueryLocation) {
+		slog.InfoContext(ctx, "Writing BigQuery destination table", "table", table, "write_mode", mode)
+		script := buildBigQueryWriteSQL(quoteBigQueryTable(table), mode, "("+params.Query+")", params.KeyColumns, cols, params.featureEnabled(config.FeatureAutoDDL))
+		job, err := bq.RunQuery(ctx, script, params.QueryLocation)
+		if err != nil {
+			return ExportResult{Table: table, Job: job}, fmt.Errorf("failed to write %s: %w", table, err)
+		}
+		return ExportResult{Table: table, Job: job}, nil
+	}
+
+	return d.executeCrossRegion(ctx, bq, params, table, mode, cols, destLocation)
+}
+
+func (d *BigQueryTableDriver) executeCrossRegion(ctx context.Context, bq BigQueryClient, params ExportParams, table, mode string, cols []string, destLocation string) (ExportResult, error) {
+	srcBucket := d.staging.For(params.QueryLocation)
+	dstBucket := d.staging.For(destLocation)
+	if srcBucket == "" || dstBucket == "" {
+		return ExportResult{}, fmt.Errorf("cross-region write from %s to %s requires staging buckets for both locations (GCS_STAGING_BUCKETS)", params.QueryLocation, destLocation)
+	}
+
+	prefix := stagingPrefix(ctx)
+
+	slog.InfoContext(ctx, "Staging cross-region BigQuery write", "table", table, "write_mode", mode,
+		"source_location", params.QueryLocation, "destination_location", destLocation,
+		"source_bucket", srcBucket, "destination_bucket", dstBucket)
+
+	cleanups := []*cleanupHandle{registerCleanup(ctx, CleanupGCSPrefix, fmt.Sprintf("gs://%s/%s", srcBucket, prefix), "")}
+	if dstBucket != srcBucket {
+		cleanups = append(cleanups, registerCleanup(ctx, CleanupGCSPrefix, fmt.Sprintf("gs://%s/%s", dstBucket, prefix), ""))
+	}
+	exportURI := fmt.Sprintf("gs://%s/%spart-*.parquet", srcBucket, prefix)
+	job, err := bq.RunQuery(ctx, buildExportSQL(exportURI, params.Query), params.QueryLocation)
+	if err != nil {
+		return ExportResult{Table: table, Job: job}, fmt.Errorf("failed to stage results to %s: %w", exportURI, err)
+	}
+
+	if dstBucket != srcBucket {
+		if d.gcs == nil {
+			return ExportResult{Table: table, Job: job}, fmt.Errorf("cross-location staging copy needs a Cloud Storage client")
+		}
+		if _, err := d.gcs.CopyPrefix(ctx, srcBucket, prefix, dstBucket, prefix); err != nil {
+			return ExportResult{Table: table, Job: job}, err
+		}
+	}
+
+	loadURI := fmt.Sprintf("gs://%s/%spart-*.parquet", dstBucket, prefix)
+	script := fmt.Sprintf("LOAD DATA INTO TEMP TABLE %s FROM FILES(format='PARQUET', uris=['%s']);\n", bigQueryStageTable, loadURI) +
+		buildBigQueryWriteSQL(quoteBigQueryTable(table), mode, bigQueryStageTable, params.KeyColumns, cols, params.featureEnabled(config.FeatureAutoDDL))
+	job, err = bq.RunQuery(ctx, script, destLocation)
+	if err != nil {
+		return ExportResult{Table: table, Job: job}, fmt.Errorf("failed to load staged results into %s: %w", table, err)
+	}
+	// The staged files of a successful load are kept, as its source
+	for _, h := range cleanups {
+		h.done(ctx)
+	}
+	return ExportResult{Table: table, GCSPath: loadURI, Job: job}, nil
+}
+
+// bigQueryWriteMode returns the normalized write mode of an export (default replace).
+func bigQueryWriteMode(params ExportParams) (string, error) {
+	mode := strings.ToLower(params.WriteMode)
+	if mode == "" {
+		mode = WriteModeReplace
+	}
+	switch mode {
+	case WriteModeReplace, WriteModeAppend:
+	case WriteModeMerge:
+		if len(params.KeyColumns) == 0 {
+			return "", fmt.Errorf("write_mode %q requires key_columns", mode)
+		}
+	default:
+		return "", fmt.Errorf("unknown write_mode %q; expected replace, append or merge", params.WriteMode)
+	}
+	return mode, nil
+}
+
+// resolveBigQueryTable accepts "table" (with dataset), "dataset.table" or
+// "project.dataset.table" and returns the dotted name.
+func resolveBigQueryTable(table, dataset string) (string, error) {
+	if table == "" {
+		return "", fmt.Errorf("table is required for the BIGQUERY driver")
+	}
+	if !strings.Contains(table, ".") {
+		if strings.TrimSpace(dataset) == "" {
+			return "", fmt.Errorf("dataset not specified; provide 'database' or use table in 'dataset.table' format")
+		}
+		table = dataset + "." + table
+	}
+	parts := strings.Split(table, ".")
+	if len(parts) > 3 {
+		return "", fmt.Errorf("invalid BigQuery table %q; expected [project.]dataset.table", table)
+	}
+	for _, p := range parts {
+		if p == "" || strings.ContainsAny(p, "`;\n ") {
+			return "", fmt.Errorf("invalid BigQuery table %q", table)
+		}
+	}
+	return table, nil
+}
+
+func quoteBigQueryTable(table string) string {
+	return "`" + table + "`"
+}
+
+func quoteBigQueryColumn(col string) string {
+	return "`" + strings.ReplaceAll(col, "`", "\\`") + "`"
+}
+
+// buildBigQueryWriteSQL builds the script writing source (a parenthesized query or a
+// table name) into the quoted destination table. Without create, append and merge fail
+// when the table is missing instead of creating it.
+func buildBigQueryWriteSQL(dest, mode, source string, keys, cols []string, create bool) string {
+	if mode == WriteModeReplace {
+		return fmt.Sprintf("CREATE OR REPLACE TABLE %s AS SELECT * FROM %s;", dest, source)
+	}
+
+	// append and merge create the table on first run with the result's schema
+	var ddl string
+	if create {
+		ddl = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s AS SELECT * FROM %s WHERE FALSE;\n", dest, source)
+	}
+	if mode == WriteModeAppend {
+		return ddl + fmt.Sprintf("INSERT INTO %s SELECT * FROM %s;", dest, source)
+	}
+
+	on := make([]string, len(keys))
+	for i, k := range keys {
+		on[i] = fmt.Sprintf("target.%s = source.%s", quoteBigQueryColumn(k), quoteBigQueryColumn(k))
+	}
+	var set []string
+	for _, c := range cols {
+		if !slices.Contains(keys, c) {
+			set = append(set, fmt.Sprintf("%s = source.%s", quoteBigQueryColumn(c), quoteBigQueryColumn(c)))
+		}
+	}
+	merge := fmt.Sprintf("MERGE %s AS target USING %s AS source\nON %s\n", dest, source, strings.Join(on, " AND "))
+	if len(set) > 0 {
+		merge += fmt.Sprintf("WHEN MATCHED THEN UPDATE SET %s\n", strings.Join(set, ", "))
+	}
+	merge += "WHEN NOT MATCHED THEN INSERT ROW;"
+	return ddl + merge
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestResolveBigQueryTable(t *testing.T) {
+	tests := []struct {
+		table, dataset, want string
+		wantErr              bool
+	}{
+		{"events", "analytics", "analytics.events", false},
+		{"analytics.events", "", "analytics.events", false},
+		{"other-project.analytics.events", "ignored", "other-project.analytics.events", false},
+		{"events", "", "", true},
+		{"a.b.c.d", "", "", true},
+		{"analytics.ev`ents", "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveBigQueryTable(tt.table, tt.dataset)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolveBigQueryTable(%q, %q) = %q, %v; want %q, err=%v", tt.table, tt.dataset, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBuildBigQueryWriteSQLMerge(t *testing.T) {
+	sql := buildBigQueryWriteSQL("`ds.t`", WriteModeMerge, "(SELECT 1)", []string{"id"}, []string{"id", "name"}, true)
+	for _, want := range []string{
+		"CREATE TABLE IF NOT EXISTS `ds.t` AS SELECT * FROM (SELECT 1) WHERE FALSE;",
+		"MERGE `ds.t` AS target USING (SELECT 1) AS source",
+		"ON target.`id` = source.`id`",
+		"WHEN MATCHED THEN UPDATE SET `name` = source.`name`",
+		"WHEN NOT MATCHED THEN INSERT ROW;",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("merge SQL missing %q:\n%s", want, sql)
+		}
+	}
+}
+
+func TestBigQueryTableDriverMergeValidatesKeys(t *testing.T) {
+	bq := &fakeBigQuery{schema: bigquery.Schema{{Name: "id"}, {Name: "name"}}}
+	d := NewBigQueryTableDriver(nil, nil)
+	_, err := d.Execute(context.Background(), bq, ExportParams{
+		Query: "SELECT id, name FROM src", Table: "ds.t", WriteMode: "merge", KeyColumns: []string{"missing"},
+	})
+	if err == nil || !strings.Contains(err.Error(), `key column "missing"`) {
+		t.Fatalf("Execute() error = %v, want missing key column", err)
+	}
+}
+
+func TestBigQueryTableDriverCrossRegionNeedsStaging(t *testing.T) {
+	bq := &fakeBigQuery{}
+	d := NewBigQueryTableDriver(nil, ParseStagingBuckets(""))
+	_, err := d.Execute(context.Background(), bq, ExportParams{
+		Query: "SELECT 1", QueryLocation: "US", Table: "ds.t", DestinationLocation: "asia-southeast2",
+	})
+	if err == nil || !strings.Contains(err.Error(), "GCS_STAGING_BUCKETS") {
+		t.Fatalf("Execute() error = %v, want staging bucket error", err)
+	}
+	if len(bq.queries) != 0 {
+		t.Errorf("no query should run without staging buckets")
+	}
+}
@@ -1,19 +1,300 @@
 package service
 
 import (
+	"cmp"
 	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	storage "google.golang.org/api/storage/v1"
 )
 
-type GCSDriver struct{}
+// GCSDriver exports query results as Parquet files with EXPORT DATA. EXPORT DATA needs
+// the bucket in the query's location; when it is not, results are staged in a
+// same-location bucket and copied to the target, or the export fails with an actionable
+// error if no staging bucket is configured.
+type GCSDriver struct {
+	gcs     *GCSService
+	staging StagingBuckets
+}
+
+// NewGCSDriver returns a GCS driver. With a nil gcs, bucket locations are not checked.
+func NewGCSDriver(gcs *GCSService, staging StagingBuckets) *GCSDriver {
+	return &GCSDriver{gcs: gcs, staging: staging}
+}
+
+func (d *GCSDriver) Name() string {
+	return "GCS_PARQUET"
+}
 
-func NewGCSDriver() *GCSDriver {
-	return &GCSDriver{}
+func (d *GCSDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{Files: true, Folders: true, Labels: true, Readback: ReadbackFiles}
 }
 
-func (d *GCSDriver) Execute(ctx context.Context, bq *BigQueryService, params ExportParams) (ExportResult, error) {
-	path, err := bq.ExportQueryToParquet(ctx, params.Query, params.Output, params.Filename, params.QueryLocation, params.UseTimestamp)
+func (d *GCSDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	if params.Format == FormatREDCap {
+		// The import columns are formatted by type, taken from a (free) dry run
+		dry, err := bq.DryRun(ctx, params.Query, params.QueryLocation)
+		if err != nil {
+			return ExportResult{}, fmt.Errorf("failed to read the result schema: %w", err)
+		}
+		if params, err = redcapParams(params, dry.Schema); err != nil {
+			return ExportResult{}, ConfigError(err)
+		}
+	}
+	// Generate timestamp for filename
+	timestamp := time.Now().Format("20060102-150405")
+	useTimestamp := params.UseTimestamp != nil && *params.UseTimestamp
+	exportURI := buildExportURI(params.Output, params.Filename, timestamp, useTimestamp, exportExtension(params.Format))
+
+	slog.InfoContext(ctx, "Starting BigQuery export",
+		"output_uri", params.Output,
+		"filename", params.Filename,
+		"export_uri", exportURI,
+		"format", cmp.Or(params.Format, FormatParquet),
+		"timestamp", timestamp,
+		"use_timestamp", useTimestamp,
+	)
+
+	if params.Format == FormatFHIR {
+		return d.executeFHIR(ctx, bq, params, exportURI)
+	}
+
+	// Typed headers and the schema sidecar take the columns from a (free) dry run
+	var schema bigquery.Schema
+	if params.SchemaFile || params.CSVHeader == CSVHeaderTyped || params.CSVBOM {
+		if d.gcs == nil {
+			return ExportResult{}, ConfigError(fmt.Errorf("schema_file, csv_bom and typed CSV headers need a Cloud Storage client"))
+		}
+		dry, err := bq.DryRun(ctx, params.Query, params.QueryLocation)
+		if err != nil {
+			return ExportResult{}, fmt.Errorf("failed to read the result schema: %w", err)
+		}
+		schema = dry.Schema
+	}
+	head, err := csvFilePrefix(params, schema)
+	if err != nil {
+		return ExportResult{}, err
+	}
+
+	stageBucket, err := d.stagingBucketFor(ctx, exportURI, params, false)
 	if err != nil {
 		return ExportResult{}, err
 	}
-	return ExportResult{GCSPath: path}, nil
+	var res ExportResult
+	if stageBucket != "" || head != nil {
+		res, err = d.executeStaged(ctx, bq, params, exportURI, stageBucket, head)
+	} else {
+		res, err = d.executeDirect(ctx, bq, params, exportURI)
+	}
+	if err != nil {
+		return res, err
+	}
+	if d.gcs != nil {
+		// EXPORT DATA reports its files but not their size: the output listing tells
+		if files, size, err := d.gcs.PatternSize(ctx, res.GCSPath); err != nil {
+			slog.WarnContext(ctx, "Could not size the exported files", "gcs_path", res.GCSPath, "error", err)
+		} else {
+			res.Files, res.BytesWritten = cmp.Or(res.Files, files), size
+		}
+	}
+	if params.SchemaFile {
+		if err := d.writeSchemaFile(ctx, exportURI, schema); err != nil {
+			return res, err
+		}
+	}
+	slog.InfoContext(ctx, "Export job completed successfully", "export_uri", exportURI, "job_id", res.Job.ID, "rows", res.Rows, "files", res.Files, "bytes", res.BytesWritten)
+	return res, nil
+}
+
+func (d *GCSDriver) executeDirect(ctx context.Context, bq BigQueryClient, params ExportParams, exportURI string) (ExportResult, error) {
+	job, err := bq.RunQuery(ctx, d.exportSQL(exportURI, params, false), params.QueryLocation)
+	if err != nil {
+		return ExportResult{Job: job}, fmt.Errorf("export to %s failed: %w", exportURI, err)
+	}
+	return ExportResult{GCSPath: exportURI, Rows: job.ExportedRows, Files: job.ExportedFiles, Job: job}, nil
+}
+
+// exportSQL is the EXPORT DATA statement writing the params' format to uri; with
+// prefixed, CSV files get their header row from the file head instead.
+func (d *GCSDriver) exportSQL(uri string, params ExportParams, prefixed bool) string {
+	if params.Format != FormatCSV {
+		return buildExportSQL(uri, params.Query)
+	}
+	delimiter, _ := csvDelimiter(params.CSVDelimiter)
+	header := !prefixed && (params.CSVHeader == "" || params.CSVHeader == CSVHeaderNames)
+	return buildCSVExportSQL(uri, params.Query, header, delimiter)
+}
+
+// stagingBucketFor checks the target bucket (see GCSService.CheckBucket), for the account
+// the export impersonates, and its location against the query location, and returns the
+// staging bucket to export through, or "" when the export can go direct. With dryRun, a
+// missing bucket is not created.
+func (d *GCSDriver) stagingBucketFor(ctx context.Context, exportURI string, params ExportParams, dryRun bool) (string, error) {
+	if d.gcs == nil {
+		return "", nil
+	}
+	bucket, _, err := parseGCSURI(exportURI)
+	if err != nil {
+		return "", err
+	}
+	location := params.QueryLocation
+	bucketLocation, err := d.gcs.CheckBucket(ctx, bucket, location, params.ImpersonateServiceAccount, dryRun)
+	if err != nil {
+		return "", err
+	}
+	if exportLocationCompatible(location, bucketLocation) {
+		return "", nil
+	}
+	stage := d.staging.For(location)
+	if stage == "" {
+		return "", fmt.Errorf("%w: bucket gs://%s is in %s but the query runs in %s; EXPORT DATA requires the bucket in the query location. "+
+			"Use a bucket in %s or configure a staging bucket for %s in GCS_STAGING_BUCKETS", ErrBucketUnusable, bucket, bucketLocation, strings.ToUpper(location), strings.ToUpper(location), location)
+	}
+	return stage, nil
+}
+
+// executeStaged exports under a per-run prefix mirroring the target object path, then
+// moves the files into place: from a staging bucket in the query location, copied to the
+// target bucket, and with a file head (BOM, typed header), composed after it. stageBucket
+// is "" when only the head needs staging; the files are then staged in the target bucket.
+func (d *GCSDriver) executeStaged(ctx context.Context, bq BigQueryClient, params ExportParams, exportURI, stageBucket string, head []byte) (ExportResult, error) {
+	bucket, object, err := parseGCSURI(exportURI)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if stageBucket == "" {
+		stageBucket = bucket
+	}
+	prefix := stagingPrefix(ctx)
+	stageURI := fmt.Sprintf("gs://%s/%s%s", stageBucket, prefix, object)
+	cleanups := []*cleanupHandle{registerCleanup(ctx, CleanupGCSPrefix, fmt.Sprintf("gs://%s/%s", stageBucket, prefix), "")}
+	if stageBucket != bucket && head != nil {
+		cleanups = append(cleanups, registerCleanup(ctx, CleanupGCSPrefix, fmt.Sprintf("gs://%s/%s", bucket, prefix), ""))
+	}
+
+	slog.InfoContext(ctx, "Staging export", "export_uri", exportURI, "staging_uri", stageURI)
+	job, err := bq.RunQuery(ctx, d.exportSQL(stageURI, params, head != nil), params.QueryLocation)
+	if err != nil {
+		return ExportResult{Job: job}, fmt.Errorf("export to staging %s failed: %w", stageURI, err)
+	}
+	if stageBucket != bucket {
+		dstPrefix := ""
+		if head != nil {
+			// Composing needs the sources in the target bucket
+			dstPrefix = prefix
+		}
+		if _, err := d.gcs.CopyPrefix(ctx, stageBucket, prefix, bucket, dstPrefix); err != nil {
+			return ExportResult{Job: job}, err
+		}
+		if err := d.gcs.DeletePrefix(ctx, stageBucket, prefix); err != nil {
+			slog.WarnContext(ctx, "Failed to clean up staged export", "staging_uri", stageURI, "error", err)
+		}
+	}
+	if head != nil {
+		if _, err := d.gcs.PrependToPrefix(ctx, bucket, prefix, "text/csv", head); err != nil {
+			return ExportResult{Job: job}, err
+		}
+	}
+	for _, h := range cleanups {
+		h.done(ctx)
+	}
+	return ExportResult{GCSPath: exportURI, Rows: job.ExportedRows, Files: job.ExportedFiles, Job: job}, nil
+}
+
+// writeSchemaFile writes the result schema, in the BigQuery JSON schema format, next to
+// the exported files (see schemaFileURI).
+func (d *GCSDriver) writeSchemaFile(ctx context.Context, exportURI string, schema bigquery.Schema) error {
+	data, err := schema.ToJSONFields()
+	if err != nil {
+		return fmt.Errorf("failed to encode the schema: %w", err)
+	}
+	uri := schemaFileURI(exportURI)
+	bucket, name, err := parseGCSURI(uri)
+	if err != nil {
+		return err
+	}
+	if err := d.gcs.WriteObject(ctx, bucket, name, "application/json", data); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Wrote schema file", "schema_uri", uri)
+	return nil
+}
+
+// buildExportURI generates the final EXPORT DATA URI from the requested output, for files
+// with extension ext (".parquet", ".csv"):
+//  1. If it ends with "/", it's a folder. Append "{baseName}-{timestamp?-}*{ext}"
+//  2. If it doesn't have the extension and no wildcard (*):
+//     - Assume it's a folder path missing the slash. Append "/{baseName}-{timestamp?-}*{ext}"
+//  3. If user provided a specific pattern (e.g. ".../my-file-*.parquet"), use it as is (ignoring filename/timestamp injection to respect strict overrides)
+func buildExportURI(outputURI, filename, timestamp string, useTimestamp bool, ext string) string {
+	// Determine the base filename prefix
+	baseName := filename
+	if baseName == "" {
+		baseName = "export"
+	}
+	if useTimestamp {
+		baseName = baseName + "-" + timestamp
+	}
+
+	if strings.HasSuffix(outputURI, "/") {
+		return fmt.Sprintf("%s%s-*%s", outputURI, baseName, ext)
+	}
+	if !strings.HasSuffix(outputURI, ext) && !strings.Contains(outputURI, "*") {
+		// Treat as folder, append slash and filename pattern
+		return fmt.Sprintf("%s/%s-*%s", outputURI, baseName, ext)
+	}
+
+	// NOTE: If outputURI contained a pattern (case 3), we use it exactly as provided.
+	// This supports "legacy" or explicit behavior where user wants full control.
+	// However, if they provided 'filename', they should likely stick to folder paths in 'output'.
+	return outputURI
+}
+
+// singleFileURI is the file an export to the pattern uri wrote when it wrote one:
+// EXPORT DATA, like GCS_PARQUET_WRITE, numbers the files of a pattern from 000000000000.
+func singleFileURI(uri string) string {
+	return strings.Replace(uri, "*", fmt.Sprintf("%012d", 0), 1)
+}
+
+// resolveSingleFile returns the file written by an export of a single file, for consumers
+// that cannot expand wildcards, once it is found in the bucket; otherwise the GCSPath of
+// res, unchanged.
+func (e *Exporter) resolveSingleFile(ctx context.Context, res ExportResult) string {
+	if res.Files != 1 || !strings.Contains(res.GCSPath, "*") {
+		return res.GCSPath
+	}
+	uri := singleFileURI(res.GCSPath)
+	bucket, name, err := parseGCSURI(uri)
+	if err != nil {
+		return res.GCSPath
+	}
+	objs, err := e.GCS.ListObjects(ctx, bucket, name)
+	if err == nil && !slices.ContainsFunc(objs, func(o *storage.Object) bool { return o.Name == name }) {
+		err = fmt.Errorf("%s not found", uri)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Could not resolve the exported file", "gcs_path", res.GCSPath, "error", err)
+		return res.GCSPath
+	}
+	return uri
+}
+
+// buildExportSQL constructs the EXPORT DATA statement.
+// We wrap the user query in parentheses to ensure syntax correctness
+// overwrite=true ensures that if we are re-running a job with the exact same timestamp (unlikely)
+// or if the user provided a fixed path, we overwrite.
+func buildExportSQL(exportURI, sqlQuery string) string {
+	return fmt.Sprintf(`
+		EXPORT DATA OPTIONS(
+			uri='%s',
+			format='PARQUET',
+			overwrite=true
+		) AS
+		(%s)
+	`, exportURI, sqlQuery)
 }
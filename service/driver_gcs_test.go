@@ -0,0 +1,189 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+func TestBuildExportURI(t *testing.T) {
+	const ts = "20260105-080000"
+	tests := []struct {
+		name         string
+		output       string
+		filename     string
+		useTimestamp bool
+		want         string
+	}{
+		{"folder with slash", "gs://bucket/exports/", "", false, "gs://bucket/exports/export-*.parquet"},
+		{"folder without slash", "gs://bucket/exports", "daily", false, "gs://bucket/exports/daily-*.parquet"},
+		{"folder with timestamp", "gs://bucket/exports/", "daily", true, "gs://bucket/exports/daily-20260105-080000-*.parquet"},
+		{"explicit pattern", "gs://bucket/exports/my-*.parquet", "ignored", true, "gs://bucket/exports/my-*.parquet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildExportURI(tt.output, tt.filename, ts, tt.useTimestamp, ".parquet"); got != tt.want {
+				t.Errorf("buildExportURI() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCSDriverExecute(t *testing.T) {
+	bq := &fakeBigQuery{}
+	res, err := NewGCSDriver(nil, nil).Execute(context.Background(), bq, ExportParams{
+		Query:         "SELECT 1 AS x",
+		Output:        "gs://bucket/out/",
+		QueryLocation: "asia-southeast2",
+	})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.GCSPath != "gs://bucket/out/export-*.parquet" {
+		t.Errorf("GCSPath = %q", res.GCSPath)
+	}
+	if len(bq.queries) != 1 {
+		t.Fatalf("queries submitted = %d, want 1", len(bq.queries))
+	}
+	sql := bq.queries[0]
+	if !strings.Contains(sql, "EXPORT DATA") || !strings.Contains(sql, "uri='gs://bucket/out/export-*.parquet'") || !strings.Contains(sql, "(SELECT 1 AS x)") {
+		t.Errorf("unexpected export SQL: %s", sql)
+	}
+	if bq.locations[0] != "asia-southeast2" {
+		t.Errorf("location = %q, want asia-southeast2", bq.locations[0])
+	}
+	if want := (QueryJob{ProjectID: "test-project", ID: "job_fake", Location: "asia-southeast2"}); res.Job != want {
+		t.Errorf("Job = %+v, want %+v", res.Job, want)
+	}
+}
+
+func TestGCSDriverExecuteError(t *testing.T) {
+	bq := &fakeBigQuery{err: errors.New("access denied")}
+	_, err := NewGCSDriver(nil, nil).Execute(context.Background(), bq, ExportParams{Query: "SELECT 1", Output: "gs://bucket/out/"})
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Fatalf("Execute() error = %v, want wrapped access denied", err)
+	}
+
+	// The failed job stays identifiable through the wrapped error
+	bq.err = &JobError{Job: QueryJob{ProjectID: "test-project", ID: "job_failed", Location: "US"}, Err: errors.New("division by zero")}
+	_, err = NewGCSDriver(nil, nil).Execute(context.Background(), bq, ExportParams{Query: "SELECT 1/0", Output: "gs://bucket/out/"})
+	var jobErr *JobError
+	if !errors.As(err, &jobErr) || jobErr.Job.ID != "job_failed" {
+		t.Errorf("Execute() error = %v, want the JobError of job_failed", err)
+	}
+}
+
+func TestExportLocationCompatible(t *testing.T) {
+	tests := []struct {
+		query, bucket string
+		want          bool
+	}{
+		{"asia-southeast2", "ASIA-SOUTHEAST2", true},
+		{"US", "US", true},
+		{"US", "US-CENTRAL1", true},
+		{"EU", "EUROPE-WEST4", true},
+		{"US", "ASIA-SOUTHEAST1", false},
+		{"asia-southeast2", "US", false},
+		{"", "US", true},
+	}
+	for _, tt := range tests {
+		if got := exportLocationCompatible(tt.query, tt.bucket); got != tt.want {
+			t.Errorf("exportLocationCompatible(%q, %q) = %v, want %v", tt.query, tt.bucket, got, tt.want)
+		}
+	}
+}
+
+func TestResolveSingleFile(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{schema: testParquetSchema, rows: testParquetRows(3)}
+	e := NewExporter(bq, NewParquetWriteDriver(gcs.service(t)), &config.Config{})
+	e.GCS = gcs.service(t)
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/", Filename: "visits", ResolveSingleFile: true}
+	res, err := e.Run(context.Background(), params)
+	if err != nil || res.GCSPath != "gs://b/out/visits-000000000000.parquet" {
+		t.Errorf("Run() = %q, %v, want the single file", res.GCSPath, err)
+	}
+
+	params.Filename, params.MaxFileRows = "split", 2
+	if res, err := e.Run(context.Background(), params); err != nil || res.GCSPath != "gs://b/out/split-*.parquet" {
+		t.Errorf("Run() of two files = %q, %v, want the pattern", res.GCSPath, err)
+	}
+
+	e.Driver = NewStarRocksDriver(nil, nil)
+	if _, err := e.Run(context.Background(), ExportParams{Query: "SELECT 1", Table: "t", ResolveSingleFile: true}); FailureClass(err) != FailureConfig {
+		t.Errorf("Run() for STARROCKS error = %v, want a config error", err)
+	}
+}
+
+func TestGCSDriverChecksBucket(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{}
+	d := NewGCSDriver(gcs.service(t), nil)
+	params := ExportParams{Query: "SELECT 1", Output: "gs://missing/out/", QueryLocation: "asia-southeast2"}
+	if _, err := d.Execute(context.Background(), bq, params); !errors.Is(err, ErrBucketUnusable) || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Execute() to a missing bucket error = %v, want ErrBucketUnusable", err)
+	}
+	gcs.readOnly = true
+	params.Output, params.QueryLocation = "gs://b/out/", "US"
+	if _, err := d.Execute(context.Background(), bq, params); !errors.Is(err, ErrBucketUnusable) || !strings.Contains(err.Error(), "storage.objects.create") {
+		t.Errorf("Execute() to a read-only bucket error = %v, want ErrBucketUnusable", err)
+	}
+	if len(bq.queries) != 0 {
+		t.Errorf("queries = %v, want none before the bucket is usable", bq.queries)
+	}
+
+	d.gcs.AutoCreate = &BucketCreation{Project: "p", StorageClass: "NEARLINE"}
+	params.Output, params.QueryLocation = "gs://missing/out/", "asia-southeast2"
+	if _, err := d.gcs.CheckBucket(context.Background(), "missing", "asia-southeast2", "", true); err != nil || len(gcs.created) != 0 {
+		t.Errorf("CheckBucket(dry run) = %v, created %v, want nothing created", err, gcs.created)
+	}
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() with bucket creation error = %v", err)
+	}
+	if len(gcs.created) != 1 || gcs.created[0] != "p/missing" || len(bq.queries) != 1 {
+		t.Errorf("created = %v, queries = %d, want p/missing created before the export", gcs.created, len(bq.queries))
+	}
+	if iam := gcs.buckets[0].IamConfiguration; iam == nil || iam.UniformBucketLevelAccess == nil || !iam.UniformBucketLevelAccess.Enabled || iam.PublicAccessPrevention != "enforced" {
+		t.Errorf("created bucket IAM configuration = %+v, want uniform access and public access prevention enforced", iam)
+	}
+}
+
+func TestGCSDriverChecksBucketAsImpersonatedAccount(t *testing.T) {
+	gcs, asReader := newFakeGCS(t), newFakeGCS(t)
+	asReader.readOnly = true
+	bq := &fakeBigQuery{}
+	d := NewGCSDriver(gcs.service(t), nil)
+	// The account can only read the bucket the service may write to
+	d.gcs.impersonated = map[string]*storage.Service{"reader@p.iam.gserviceaccount.com": asReader.service(t).svc}
+	params := ExportParams{Query: "SELECT 1", Output: "gs://b/out/", QueryLocation: "US", ImpersonateServiceAccount: "reader@p.iam.gserviceaccount.com"}
+	_, err := d.Execute(context.Background(), bq, params)
+	if !errors.Is(err, ErrBucketUnusable) || !strings.Contains(err.Error(), "reader@p.iam.gserviceaccount.com cannot write") {
+		t.Errorf("Execute() as a read-only account error = %v, want ErrBucketUnusable naming the account", err)
+	}
+	if len(bq.queries) != 0 {
+		t.Errorf("queries = %v, want none before the bucket is usable", bq.queries)
+	}
+	params.ImpersonateServiceAccount = ""
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Errorf("Execute() as the service error = %v", err)
+	}
+}
+
+func TestGCSDriverSizesExportedFiles(t *testing.T) {
+	gcs := newFakeGCS(t)
+	// The files EXPORT DATA wrote, and another file of the folder
+	gcs.objects["out/export-000000000000.parquet"] = make([]byte, 100)
+	gcs.objects["out/export-000000000001.parquet"] = make([]byte, 20)
+	gcs.objects["out/visits.parquet"] = make([]byte, 5)
+	res, err := NewGCSDriver(gcs.service(t), nil).Execute(context.Background(), &fakeBigQuery{}, ExportParams{Query: "SELECT 1", Output: "gs://b/out/", QueryLocation: "US"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.Files != 2 || res.BytesWritten != 120 {
+		t.Errorf("Execute() = %d files, %d bytes, want 2 files, 120 bytes", res.Files, res.BytesWritten)
+	}
+}
@@ -0,0 +1,545 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/decimal128"
+	"github.com/apache/arrow/go/v15/arrow/decimal256"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/compress"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	parquetWriteDriverName = "GCS_PARQUET_WRITE"
+	// defaultRowGroupRows is the number of rows per row group unless RowGroupRows is set
+	defaultRowGroupRows = 100_000
+	parquetContentType  = "application/vnd.apache.parquet"
+)
+
+// ParquetWriteDriver exports query results as Parquet files it encodes itself instead of
+// running EXPORT DATA: it reads the rows (through the BigQuery Storage Read API when the
+// client has it enabled) and streams the files to Cloud Storage as they are written. Any
+// query ReadRows can run can be exported, including scripts, the bucket may be in any
+// location, and rows pass through the service, where they can be transformed.
+type ParquetWriteDriver struct {
+	gcs *GCSService
+}
+
+// NewParquetWriteDriver returns a GCS_PARQUET_WRITE driver writing through gcs.
+func NewParquetWriteDriver(gcs *GCSService) *ParquetWriteDriver {
+	return &ParquetWriteDriver{gcs: gcs}
+}
+
+func (d *ParquetWriteDriver) Name() string {
+	return parquetWriteDriverName
+}
+
+func (d *ParquetWriteDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{Files: true, Folders: true, ReadsRows: true, Labels: true, Readback: ReadbackFiles}
+}
+
+// Parquet type representations of the GCS_PARQUET_WRITE driver. The defaults are those
+// EXPORT DATA writes; the others suit consumers that cannot read them (older Spark and
+// Hive read INT96 timestamps, Athena and Spark decimals of up to 38 digits).
+const (
+	ParquetTimestampMicros = "micros"
+	ParquetTimestampMillis = "millis"
+	ParquetTimestampInt96  = "int96"
+
+	ParquetDecimal       = "decimal"
+	ParquetDecimal38     = "decimal38"
+	ParquetDecimalString = "string"
+
+	ParquetString      = "string"
+	ParquetLargeString = "large_string"
+)
+
+// parquetTypes are the type representations of the files of an export.
+type parquetTypes struct {
+	timestamp string
+	decimal   string
+	str       string
+}
+
+// parquetTypesOf returns the type representations params ask for.
+func parquetTypesOf(p ExportParams) (parquetTypes, error) {
+	t := parquetTypes{
+		timestamp: cmp.Or(strings.ToLower(p.ParquetTimestamp), ParquetTimestampMicros),
+		decimal:   cmp.Or(strings.ToLower(p.ParquetDecimal), ParquetDecimal),
+		str:       cmp.Or(strings.ToLower(p.ParquetString), ParquetString),
+	}
+	switch t.timestamp {
+	case ParquetTimestampMicros, ParquetTimestampMillis, ParquetTimestampInt96:
+	default:
+		return t, fmt.Errorf("unknown parquet_timestamp %q; expected %s, %s or %s", p.ParquetTimestamp, ParquetTimestampMicros, ParquetTimestampMillis, ParquetTimestampInt96)
+	}
+	switch t.decimal {
+	case ParquetDecimal, ParquetDecimal38, ParquetDecimalString:
+	default:
+		return t, fmt.Errorf("unknown parquet_decimal %q; expected %s, %s or %s", p.ParquetDecimal, ParquetDecimal, ParquetDecimal38, ParquetDecimalString)
+	}
+	switch t.str {
+	case ParquetString, ParquetLargeString:
+	default:
+		return t, fmt.Errorf("unknown parquet_string %q; expected %s or %s", p.ParquetString, ParquetString, ParquetLargeString)
+	}
+	return t, nil
+}
+
+// checkParquetWrite validates the options of the GCS_PARQUET_WRITE driver.
+func checkParquetWrite(p ExportParams, driver string) error {
+	if (p.RowGroupRows != 0 || p.MaxFileRows != 0) && driver != parquetWriteDriverName {
+		return fmt.Errorf("row_group_rows and max_file_rows are only supported by the %s driver", parquetWriteDriverName)
+	}
+	if p.RowGroupRows < 0 || p.MaxFileRows < 0 {
+		return fmt.Errorf("row_group_rows and max_file_rows cannot be negative")
+	}
+	if (p.ParquetTimestamp != "" || p.ParquetDecimal != "" || p.ParquetString != "") && driver != parquetWriteDriverName {
+		// EXPORT DATA has no options for them
+		return fmt.Errorf("parquet_timestamp, parquet_decimal and parquet_string are only supported by the %s driver, which writes the files itself", parquetWriteDriverName)
+	}
+	_, err := parquetTypesOf(p)
+	return err
+}
+
+func (d *ParquetWriteDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	if d.gcs == nil {
+		return ExportResult{}, ConfigError(fmt.Errorf("the %s driver needs a Cloud Storage client", parquetWriteDriverName))
+	}
+	timestamp := time.Now().Format("20060102-150405")
+	useTimestamp := params.UseTimestamp != nil && *params.UseTimestamp
+	exportURI := buildExportURI(params.Output, params.Filename, timestamp, useTimestamp, exportExtension(FormatParquet))
+	bucket, pattern, err := parseGCSURI(exportURI)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if params.MaxFileRows > 0 && !strings.Contains(pattern, "*") {
+		return ExportResult{}, ConfigError(fmt.Errorf("output %s needs a * wildcard to split the export into files of max_file_rows", exportURI))
+	}
+	if _, err := d.gcs.CheckBucket(ctx, bucket, params.QueryLocation, "", false); err != nil {
+		return ExportResult{}, err
+	}
+	rowGroupRows := cmp.Or(params.RowGroupRows, defaultRowGroupRows)
+	types, err := parquetTypesOf(params)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+
+	slog.InfoContext(ctx, "Starting Parquet write-through export",
+		"output_uri", params.Output,
+		"filename", params.Filename,
+		"export_uri", exportURI,
+		"row_group_rows", rowGroupRows,
+		"max_file_rows", params.MaxFileRows,
+		"parquet_types", fmt.Sprintf("%+v", types),
+		"timestamp", timestamp,
+		"use_timestamp", useTimestamp,
+	)
+
+	it, err := bq.ReadRows(ctx, params.Query, params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, fmt.Errorf("export to %s failed: %w", exportURI, err)
+	}
+	defer it.Close()
+	if it, err = transformRows(ctx, it, params.transformers); err != nil {
+		return ExportResult{}, err
+	}
+
+	res := ExportResult{GCSPath: exportURI}
+	var (
+		schema   *arrow.Schema
+		file     *parquetFile
+		files    int
+		cleanups []*cleanupHandle
+	)
+	open := func() error {
+		name := strings.Replace(pattern, "*", fmt.Sprintf("%012d", files), 1)
+		// The files written so far are deleted if a later one fails
+		cleanups = append(cleanups, registerCleanup(ctx, CleanupGCSObject, fmt.Sprintf("gs://%s/%s", bucket, name), ""))
+		f, err := newParquetFile(ctx, d.gcs, bucket, name, schema, rowGroupRows, types)
+		if err != nil {
+			return err
+		}
+		file = f
+		files++
+		res.Files++
+		return nil
+	}
+	fail := func(err error) (ExportResult, error) {
+		if file != nil {
+			file.abort(err)
+		}
+		res.Job = it.Job()
+		return res, err
+	}
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err != nil && err != iterator.Done {
+			return fail(fmt.Errorf("export to %s failed: %w", exportURI, err))
+		}
+		// The schema is known once the first page has been fetched
+		if schema == nil && len(it.Schema()) > 0 {
+			s, serr := arrowSchema(it.Schema(), types)
+			if serr != nil {
+				return fail(ConfigError(serr))
+			}
+			schema = s
+		}
+		if err == iterator.Done {
+			break
+		}
+		if schema == nil {
+			return fail(fmt.Errorf("export to %s failed: the query result has no schema", exportURI))
+		}
+		if file == nil {
+			if err := open(); err != nil {
+				return fail(err)
+			}
+		}
+		if err := file.append(it.Schema(), row); err != nil {
+			return fail(DataError(fmt.Errorf("row %d: %w", res.Rows+1, err)))
+		}
+		res.Rows++
+		if params.MaxFileRows > 0 && file.rows == params.MaxFileRows {
+			err := file.close()
+			res.BytesWritten += file.obj.Written()
+			file = nil
+			if err != nil {
+				return fail(err)
+			}
+		}
+	}
+	res.Job = it.Job()
+	// Like EXPORT DATA, an empty result still writes one file (with the schema)
+	if file == nil && files == 0 {
+		if schema == nil {
+			return res, fmt.Errorf("export to %s failed: the query result has no schema", exportURI)
+		}
+		if err := open(); err != nil {
+			return res, err
+		}
+	}
+	if file != nil {
+		if err := file.close(); err != nil {
+			return res, err
+		}
+		res.BytesWritten += file.obj.Written()
+	}
+	for _, h := range cleanups {
+		h.done(ctx)
+	}
+	slog.InfoContext(ctx, "Export job completed successfully", "export_uri", exportURI, "job_id", res.Job.ID, "rows", res.Rows, "files", files, "bytes_written", res.BytesWritten)
+	return res, nil
+}
+
+// parquetFile is one Parquet file being written: rows are buffered into a record of up
+// to rowGroupRows rows, each written as a row group.
+type parquetFile struct {
+	obj          *ObjectWriter
+	w            *pqarrow.FileWriter
+	b            *array.RecordBuilder
+	rowGroupRows int
+	batch        int
+	rows         int64
+}
+
+func newParquetFile(ctx context.Context, gcs *GCSService, bucket, name string, schema *arrow.Schema, rowGroupRows int, types parquetTypes) (*parquetFile, error) {
+	obj := gcs.NewObjectWriter(ctx, bucket, name, parquetContentType)
+	props := parquet.NewWriterProperties(
+		parquet.WithCompression(compress.Codecs.Snappy),
+		parquet.WithMaxRowGroupLength(int64(rowGroupRows)),
+	)
+	arrowProps := []pqarrow.WriterOption{pqarrow.WithStoreSchema()}
+	if types.timestamp == ParquetTimestampInt96 {
+		arrowProps = append(arrowProps, pqarrow.WithDeprecatedInt96Timestamps(true))
+	}
+	w, err := pqarrow.NewFileWriter(schema, obj, props, pqarrow.NewArrowWriterProperties(arrowProps...))
+	if err != nil {
+		obj.Abort(err)
+		return nil, fmt.Errorf("failed to start Parquet file gs://%s/%s: %w", bucket, name, err)
+	}
+	return &parquetFile{obj: obj, w: w, b: array.NewRecordBuilder(memory.DefaultAllocator, schema), rowGroupRows: rowGroupRows}, nil
+}
+
+func (f *parquetFile) append(schema bigquery.Schema, row []bigquery.Value) error {
+	if len(row) != len(schema) {
+		return fmt.Errorf("got %d values for %d columns", len(row), len(schema))
+	}
+	for i, fs := range schema {
+		if err := appendArrowValue(f.b.Field(i), fs, row[i], fs.Repeated); err != nil {
+			return fmt.Errorf("column %s: %w", fs.Name, err)
+		}
+	}
+	f.rows++
+	if f.batch++; f.batch == f.rowGroupRows {
+		return f.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group.
+func (f *parquetFile) flush() error {
+	if f.batch == 0 {
+		return nil
+	}
+	rec := f.b.NewRecord()
+	defer rec.Release()
+	f.batch = 0
+	return f.w.Write(rec)
+}
+
+// close writes the remaining rows and the footer and completes the upload.
+func (f *parquetFile) close() error {
+	defer f.b.Release()
+	if err := f.flush(); err != nil {
+		f.obj.Abort(err)
+		return err
+	}
+	err := f.w.Close()
+	if cerr := f.obj.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// abort drops the file after a failure.
+func (f *parquetFile) abort(cause error) {
+	f.obj.Abort(cause)
+	f.b.Release()
+}
+
+// BigQuery NUMERIC and BIGNUMERIC as Parquet decimals, as EXPORT DATA writes them.
+const (
+	numericPrecision, numericScale       = 38, 9
+	bigNumericPrecision, bigNumericScale = 76, 38
+)
+
+// arrowSchema maps a BigQuery result schema to the Arrow schema of its Parquet files.
+func arrowSchema(schema bigquery.Schema, types parquetTypes) (*arrow.Schema, error) {
+	fields := make([]arrow.Field, len(schema))
+	for i, f := range schema {
+		t, err := arrowType(f, types)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = arrow.Field{Name: f.Name, Type: t, Nullable: !f.Required && !f.Repeated}
+	}
+	return arrow.NewSchema(fields, nil), nil
+}
+
+func arrowType(f *bigquery.FieldSchema, types parquetTypes) (arrow.DataType, error) {
+	str := arrow.BinaryTypes.String
+	if types.str == ParquetLargeString {
+		str = arrow.BinaryTypes.LargeString
+	}
+	timestampUnit := arrow.Microsecond
+	switch types.timestamp {
+	case ParquetTimestampMillis:
+		timestampUnit = arrow.Millisecond
+	case ParquetTimestampInt96:
+		// pqarrow writes INT96 from nanoseconds only
+		timestampUnit = arrow.Nanosecond
+	}
+	var t arrow.DataType
+	switch f.Type {
+	case bigquery.StringFieldType, bigquery.GeographyFieldType, bigquery.JSONFieldType, bigquery.IntervalFieldType:
+		t = str
+	case bigquery.BytesFieldType:
+		t = arrow.BinaryTypes.Binary
+	case bigquery.IntegerFieldType:
+		t = arrow.PrimitiveTypes.Int64
+	case bigquery.FloatFieldType:
+		t = arrow.PrimitiveTypes.Float64
+	case bigquery.BooleanFieldType:
+		t = arrow.FixedWidthTypes.Boolean
+	case bigquery.TimestampFieldType:
+		t = &arrow.TimestampType{Unit: timestampUnit, TimeZone: "UTC"}
+	case bigquery.DateTimeFieldType:
+		t = &arrow.TimestampType{Unit: timestampUnit}
+	case bigquery.DateFieldType:
+		t = arrow.FixedWidthTypes.Date32
+	case bigquery.TimeFieldType:
+		t = arrow.FixedWidthTypes.Time64us
+	case bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		switch {
+		case types.decimal == ParquetDecimalString:
+			t = str
+		case f.Type == bigquery.NumericFieldType, types.decimal == ParquetDecimal38:
+			// BIGNUMERIC values must then fit NUMERIC
+			t = &arrow.Decimal128Type{Precision: numericPrecision, Scale: numericScale}
+		default:
+			t = &arrow.Decimal256Type{Precision: bigNumericPrecision, Scale: bigNumericScale}
+		}
+	case bigquery.RecordFieldType:
+		fields := make([]arrow.Field, len(f.Schema))
+		for i, sub := range f.Schema {
+			st, err := arrowType(sub, types)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = arrow.Field{Name: sub.Name, Type: st, Nullable: !sub.Required && !sub.Repeated}
+		}
+		t = arrow.StructOf(fields...)
+	default:
+		return nil, fmt.Errorf("column %s: type %s is not supported by the %s driver", f.Name, f.Type, parquetWriteDriverName)
+	}
+	if f.Repeated {
+		t = arrow.ListOf(t)
+	}
+	return t, nil
+}
+
+// appendArrowValue appends one BigQuery value of field f to b. Repeated fields are lists
+// (NULL arrays are empty, as in BigQuery); their elements are appended with repeated false.
+func appendArrowValue(b array.Builder, f *bigquery.FieldSchema, v bigquery.Value, repeated bool) error {
+	if repeated {
+		lb := b.(*array.ListBuilder)
+		lb.Append(true)
+		values, ok := v.([]bigquery.Value)
+		if !ok && v != nil {
+			return fmt.Errorf("unexpected %T for an ARRAY", v)
+		}
+		for _, e := range values {
+			if err := appendArrowValue(lb.ValueBuilder(), f, e, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if v == nil {
+		b.AppendNull()
+		return nil
+	}
+	var ok bool
+	switch b := b.(type) {
+	case *array.StringBuilder, *array.LargeStringBuilder:
+		var s string
+		switch v := v.(type) {
+		case string:
+			s, ok = v, true
+		case *bigquery.IntervalValue:
+			s, ok = v.String(), true
+		case *big.Rat:
+			s, ok = string(downloadJSONValue(v).(json.Number)), true
+		}
+		if ok {
+			b.(interface{ Append(string) }).Append(s)
+		}
+	case *array.BinaryBuilder:
+		var x []byte
+		if x, ok = v.([]byte); ok {
+			b.Append(x)
+		}
+	case *array.Int64Builder:
+		var x int64
+		if x, ok = v.(int64); ok {
+			b.Append(x)
+		}
+	case *array.Float64Builder:
+		var x float64
+		if x, ok = v.(float64); ok {
+			b.Append(x)
+		}
+	case *array.BooleanBuilder:
+		var x bool
+		if x, ok = v.(bool); ok {
+			b.Append(x)
+		}
+	case *array.TimestampBuilder:
+		var t time.Time
+		switch v := v.(type) {
+		case time.Time:
+			t, ok = v, true
+		case civil.DateTime:
+			t, ok = v.In(time.UTC), true
+		}
+		if ok {
+			switch b.Type().(*arrow.TimestampType).Unit {
+			case arrow.Millisecond:
+				b.Append(arrow.Timestamp(t.UnixMilli()))
+			case arrow.Nanosecond:
+				if t.Year() < 1678 || t.Year() > 2261 {
+					return fmt.Errorf("%s is outside the years 1678 to 2261 of INT96 timestamps", t.Format(time.RFC3339))
+				}
+				b.Append(arrow.Timestamp(t.UnixNano()))
+			default:
+				b.Append(arrow.Timestamp(t.UnixMicro()))
+			}
+		}
+	case *array.Date32Builder:
+		var x civil.Date
+		if x, ok = v.(civil.Date); ok {
+			b.Append(arrow.Date32FromTime(x.In(time.UTC)))
+		}
+	case *array.Time64Builder:
+		var x civil.Time
+		if x, ok = v.(civil.Time); ok {
+			us := (int64(x.Hour)*3600+int64(x.Minute)*60+int64(x.Second))*1_000_000 + int64(x.Nanosecond)/1000
+			b.Append(arrow.Time64(us))
+		}
+	case *array.Decimal128Builder:
+		var x *big.Rat
+		if x, ok = v.(*big.Rat); ok {
+			n, err := scaledDecimal(x, numericScale)
+			if err != nil {
+				return err
+			}
+			// Only BIGNUMERIC values can be too large
+			if len(new(big.Int).Abs(n).String()) > numericPrecision {
+				return fmt.Errorf("%s does not fit DECIMAL(%d, %d)", x.FloatString(numericScale), numericPrecision, numericScale)
+			}
+			b.Append(decimal128.FromBigInt(n))
+		}
+	case *array.Decimal256Builder:
+		var x *big.Rat
+		if x, ok = v.(*big.Rat); ok {
+			n, err := scaledDecimal(x, bigNumericScale)
+			if err != nil {
+				return err
+			}
+			b.Append(decimal256.FromBigInt(n))
+		}
+	case *array.StructBuilder:
+		var rec []bigquery.Value
+		if rec, ok = v.([]bigquery.Value); ok {
+			if len(rec) != len(f.Schema) {
+				return fmt.Errorf("got %d values for the %d fields of a STRUCT", len(rec), len(f.Schema))
+			}
+			b.Append(true)
+			for i, sub := range f.Schema {
+				if err := appendArrowValue(b.FieldBuilder(i), sub, rec[i], sub.Repeated); err != nil {
+					return fmt.Errorf("field %s: %w", sub.Name, err)
+				}
+			}
+		}
+	}
+	if !ok {
+		return fmt.Errorf("unexpected %T for %s", v, f.Type)
+	}
+	return nil
+}
+
+// scaledDecimal returns r as an integer of scale decimal digits.
+func scaledDecimal(r *big.Rat, scale int) (*big.Int, error) {
+	n := new(big.Int).Mul(r.Num(), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil))
+	q, m := new(big.Int).QuoRem(n, r.Denom(), new(big.Int))
+	if m.Sign() != 0 {
+		return nil, fmt.Errorf("%s has more than %d decimal places", r.RatString(), scale)
+	}
+	return q, nil
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+)
+
+var testParquetSchema = bigquery.Schema{
+	{Name: "id", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "name", Type: bigquery.StringFieldType},
+	{Name: "amount", Type: bigquery.NumericFieldType},
+	{Name: "visit_date", Type: bigquery.DateFieldType},
+	{Name: "seen_at", Type: bigquery.TimestampFieldType},
+	{Name: "codes", Type: bigquery.StringFieldType, Repeated: true},
+	{Name: "site", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+		{Name: "code", Type: bigquery.StringFieldType},
+		{Name: "beds", Type: bigquery.IntegerFieldType},
+	}},
+}
+
+func testParquetRows(n int) [][]bigquery.Value {
+	rows := make([][]bigquery.Value, n)
+	for i := range rows {
+		rows[i] = []bigquery.Value{
+			int64(i + 1), "visit", big.NewRat(int64(i)*10+5, 10), civil.Date{Year: 2026, Month: 10, Day: 1},
+			time.Date(2026, 10, 1, 8, 30, 0, 0, time.UTC), []bigquery.Value{"A01", "B02"}, []bigquery.Value{"A1", int64(20)},
+		}
+	}
+	// NULLs of every kind
+	rows[n-1] = []bigquery.Value{int64(n), nil, nil, nil, nil, nil, nil}
+	return rows
+}
+
+func readParquet(t *testing.T, data []byte) (arrow.Table, int) {
+	t.Helper()
+	r, err := file.NewParquetReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid Parquet file: %v", err)
+	}
+	fr, err := pqarrow.NewFileReader(r, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := fr.ReadTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tbl.Release)
+	return tbl, r.NumRowGroups()
+}
+
+func TestParquetWriteDriver(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{schema: testParquetSchema, rows: testParquetRows(5)}
+	d := NewParquetWriteDriver(gcs.service(t))
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/", Filename: "visits", RowGroupRows: 2}
+	res, err := d.Execute(context.Background(), bq, params)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.Rows != 5 || res.GCSPath != "gs://b/out/visits-*.parquet" {
+		t.Errorf("Execute() = %+v", res)
+	}
+	data := gcs.objects["out/visits-000000000000.parquet"]
+	if data == nil {
+		t.Fatalf("objects = %v", gcs.names())
+	}
+	if res.Files != 1 || res.BytesWritten != int64(len(data)) {
+		t.Errorf("Execute() files = %d, bytes = %d, want 1 file of %d bytes", res.Files, res.BytesWritten, len(data))
+	}
+	tbl, groups := readParquet(t, data)
+	if tbl.NumRows() != 5 || groups != 3 {
+		t.Errorf("file has %d rows in %d row groups, want 5 in 3", tbl.NumRows(), groups)
+	}
+	want := []string{
+		"id int64 false", "name utf8 true", "amount decimal(38, 9) true", "visit_date date32 true",
+		"seen_at timestamp[us, tz=UTC] true", "codes list<list: utf8, nullable> false", "site struct<code: utf8, beds: int64> true",
+	}
+	for i, f := range tbl.Schema().Fields() {
+		if got := fmt.Sprintf("%s %s %t", f.Name, f.Type, f.Nullable); i >= len(want) || got != want[i] {
+			t.Errorf("field %d = %s", i, got)
+		}
+	}
+	rec := array.NewTableReader(tbl, 5)
+	defer rec.Release()
+	rec.Next()
+	cols := rec.Record().Columns()
+	if got := cols[2].ValueStr(1); got != "1.5" {
+		t.Errorf("amount = %s", got)
+	}
+	if got := cols[5].ValueStr(0); got != `["A01","B02"]` {
+		t.Errorf("codes = %s", got)
+	}
+	if got := cols[6].ValueStr(0); got != `{"beds":20,"code":"A1"}` {
+		t.Errorf("site = %s", got)
+	}
+	if !cols[1].IsNull(4) || !cols[6].IsNull(4) || cols[5].ValueStr(4) != "[]" {
+		t.Errorf("NULL row = %s %s %s", cols[1].ValueStr(4), cols[5].ValueStr(4), cols[6].ValueStr(4))
+	}
+
+	// max_file_rows splits the files; an empty result still writes one
+	params.MaxFileRows, params.Filename = 2, "split"
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() with max_file_rows error = %v", err)
+	}
+	for _, name := range []string{"out/split-000000000000.parquet", "out/split-000000000001.parquet", "out/split-000000000002.parquet"} {
+		if gcs.objects[name] == nil {
+			t.Errorf("missing %s in %v", name, gcs.names())
+		}
+	}
+	empty := &fakeBigQuery{schema: testParquetSchema}
+	params.Filename = "empty"
+	if _, err := d.Execute(context.Background(), empty, params); err != nil {
+		t.Fatalf("Execute() of an empty result error = %v", err)
+	}
+	if tbl, _ := readParquet(t, gcs.objects["out/empty-000000000000.parquet"]); tbl.NumRows() != 0 || tbl.NumCols() != 7 {
+		t.Errorf("empty file has %d rows and %d columns", tbl.NumRows(), tbl.NumCols())
+	}
+
+	for name, bad := range map[string]ExportParams{
+		"single file split": {Output: "gs://b/out/one.parquet", MaxFileRows: 2},
+	} {
+		bad.Query = "SELECT 1"
+		if _, err := d.Execute(context.Background(), bq, bad); FailureClass(err) != FailureConfig {
+			t.Errorf("%s: Execute() error = %v, want a config error", name, err)
+		}
+	}
+	rng := &fakeBigQuery{schema: bigquery.Schema{{Name: "r", Type: bigquery.RangeFieldType}}, rows: [][]bigquery.Value{{nil}}}
+	if _, err := d.Execute(context.Background(), rng, params); FailureClass(err) != FailureConfig {
+		t.Errorf("Execute() of a RANGE column error = %v, want a config error", err)
+	}
+	if _, ok := gcs.objects["out/empty-000000000000.parquet"]; !ok {
+		t.Errorf("a failed export replaced an existing file")
+	}
+}
+
+func TestParquetWriteTypes(t *testing.T) {
+	gcs := newFakeGCS(t)
+	schema := append(testParquetSchema[:len(testParquetSchema):len(testParquetSchema)], &bigquery.FieldSchema{Name: "big", Type: bigquery.BigNumericFieldType})
+	rows := testParquetRows(2)
+	for i := range rows {
+		rows[i] = append(rows[i], big.NewRat(1, 4))
+	}
+	bq := &fakeBigQuery{schema: schema, rows: rows}
+	d := NewParquetWriteDriver(gcs.service(t))
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/one.parquet",
+		ParquetTimestamp: ParquetTimestampInt96, ParquetDecimal: ParquetDecimal38, ParquetString: ParquetLargeString}
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	r, err := file.NewParquetReader(bytes.NewReader(gcs.objects["out/one.parquet"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := r.MetaData().Schema
+	if got := columns.Column(columns.ColumnIndexByName("seen_at")).PhysicalType(); got != parquet.Types.Int96 {
+		t.Errorf("seen_at is %s, want INT96", got)
+	}
+	if got := columns.Column(columns.ColumnIndexByName("big")).LogicalType().String(); got != "Decimal(precision=38, scale=9)" {
+		t.Errorf("big is %s, want a DECIMAL(38, 9)", got)
+	}
+	tbl, _ := readParquet(t, gcs.objects["out/one.parquet"])
+	if got := tbl.Schema().Field(1).Type; got != arrow.BinaryTypes.LargeString {
+		t.Errorf("name is %s, want large_utf8", got)
+	}
+
+	params.ParquetTimestamp, params.ParquetDecimal, params.ParquetString = ParquetTimestampMillis, ParquetDecimalString, ""
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	tbl, _ = readParquet(t, gcs.objects["out/one.parquet"])
+	if got := tbl.Schema().Field(4).Type.String(); got != "timestamp[ms, tz=UTC]" {
+		t.Errorf("seen_at is %s, want milliseconds", got)
+	}
+	rec := array.NewTableReader(tbl, 2)
+	defer rec.Release()
+	rec.Next()
+	if got := rec.Record().Column(2).ValueStr(0); got != "0.5" {
+		t.Errorf("amount = %s, want the exact string", got)
+	}
+
+	// BIGNUMERIC values beyond NUMERIC fail instead of losing digits
+	params.ParquetDecimal = ParquetDecimal38
+	rows[0][len(rows[0])-1] = big.NewRat(1, 1<<40)
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData {
+		t.Errorf("Execute() of a BIGNUMERIC with 40 decimals error = %v, want a data error", err)
+	}
+	rows[0][len(rows[0])-1] = new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil))
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData {
+		t.Errorf("Execute() of a BIGNUMERIC of 31 digits error = %v, want a data error", err)
+	}
+}
+
+func TestCheckParquetWrite(t *testing.T) {
+	if err := checkParquetWrite(ExportParams{RowGroupRows: 1000}, "GCS_PARQUET"); err == nil {
+		t.Error("checkParquetWrite() accepted row_group_rows for GCS_PARQUET")
+	}
+	if err := checkParquetWrite(ExportParams{ParquetTimestamp: ParquetTimestampInt96}, "GCS_PARQUET"); err == nil {
+		t.Error("checkParquetWrite() accepted parquet_timestamp for GCS_PARQUET")
+	}
+	if err := checkParquetWrite(ExportParams{ParquetDecimal: "float"}, parquetWriteDriverName); err == nil {
+		t.Error("checkParquetWrite() accepted an unknown parquet_decimal")
+	}
+	if err := checkParquetWrite(ExportParams{MaxFileRows: -1}, parquetWriteDriverName); err == nil {
+		t.Error("checkParquetWrite() accepted a negative max_file_rows")
+	}
+	if err := checkFormat(ExportParams{Format: FormatParquet}, parquetWriteDriverName); err != nil {
+		t.Errorf("checkFormat() error = %v", err)
+	}
+	if err := checkFormat(ExportParams{Format: FormatCSV}, parquetWriteDriverName); err == nil {
+		t.Errorf("checkFormat() accepted csv for %s", parquetWriteDriverName)
+	}
+}
@@ -1,20 +1,87 @@
 package service
 
 import (
+	"bq-exporter/config"
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 )
 
 type StarRocksDriver struct {
-	sr *StarRocksService
+	sr    *StarRocksService
+	locks *tableLocks
 }
 
-func NewStarRocksDriver(sr *StarRocksService) *StarRocksDriver {
-	return &StarRocksDriver{sr: sr}
+// NewStarRocksDriver loads into sr, locking destination tables through coord (nil locks
+// them on this instance only).
+func NewStarRocksDriver(sr *StarRocksService, coord Coordinator) *StarRocksDriver {
+	return &StarRocksDriver{sr: sr, locks: newTableLocksFromEnv(coord)}
 }
 
-func (d *StarRocksDriver) Execute(ctx context.Context, bq *BigQueryService, params ExportParams) (ExportResult, error) {
+func (d *StarRocksDriver) Name() string {
+	return "STARROCKS"
+}
+
+func (d *StarRocksDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{ReadsRows: true, Labels: true, Readback: ReadbackQuery}
+}
+
+func (d *StarRocksDriver) destinationTable(params ExportParams) (string, error) {
+	return d.resolveTable(params)
+}
+
+func (d *StarRocksDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	table, err := d.resolveTable(params)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	// Concurrent loads into one table would interleave their DDL and rows
+	lockCtx, unlock, err := d.locks.acquire(ctx, table)
+	if err != nil {
+		return ExportResult{Table: table}, err
+	}
+	// A deferred swap keeps the table locked until the sync commits or discards it
+	swaps := deferredSwapsFrom(ctx)
+	held := false
+	defer func() {
+		if !held {
+			unlock()
+		}
+	}()
+	res, err := d.sr.LoadFromBigQuery(lockCtx, bq, LoadOptions{
+		Query:          params.Query,
+		Location:       params.QueryLocation,
+		Table:          table,
+		CreateDDL:      params.CreateDDL,
+		ReplicationNum: params.ReplicationNum,
+		Strategy:       params.LoadStrategy,
+		DeleteColumn:   params.DeleteColumn,
+		DeleteValues:   params.DeleteValues,
+		KeyColumns:     params.KeyColumns,
+		ColumnNames:    params.ColumnNames,
+		ColumnCase:     params.ColumnCase,
+		StringType:     params.StringType,
+		Verify:         params.Verify,
+		FreezeSchema:   !params.featureEnabled(config.FeatureSchemaEvolution),
+		NoCreate:       !params.featureEnabled(config.FeatureAutoDDL),
+		Transformers:   params.transformers,
+	})
+	if err != nil {
+		if cause := context.Cause(lockCtx); errors.Is(cause, ErrLeaseLost) && ctx.Err() == nil {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+		return ExportResult{Table: table, Job: res.Job, ColumnMapping: res.ColumnMapping}, err
+	}
+	if swaps != nil {
+		swaps.hold(unlock)
+		held = true
+	}
+	return ExportResult{Table: table, Rows: res.Rows, Job: res.Job, RowsDeleted: res.Deleted, ColumnMapping: res.ColumnMapping, DestinationRows: res.DestinationRows}, nil
+}
+
+// resolveTable returns the db.table an export writes to and checks its load strategy.
+func (d *StarRocksDriver) resolveTable(params ExportParams) (string, error) {
 	table := params.Table
 	if table == "" {
 		table = "export"
@@ -25,12 +92,13 @@ func (d *StarRocksDriver) Execute(ctx context.Context, bq *BigQueryService, para
 		} else if strings.TrimSpace(d.sr.dbname) != "" {
 			table = d.sr.dbname + "." + table
 		} else {
-			return ExportResult{}, fmt.Errorf("database not specified; provide 'database' or use table in 'db.table' format")
+			return "", fmt.Errorf("database not specified; provide 'database' or use table in 'db.table' format")
 		}
 	}
-	rows, err := d.sr.LoadFromBigQuery(ctx, bq, params.Query, params.QueryLocation, table, params.CreateDDL)
-	if err != nil {
-		return ExportResult{}, err
+	switch params.LoadStrategy {
+	case "", LoadStrategyInsert, LoadStrategySwap:
+	default:
+		return "", fmt.Errorf("unknown load_strategy %q; expected insert or swap", params.LoadStrategy)
 	}
-	return ExportResult{Table: table, Rows: rows}, nil
+	return table, nil
 }
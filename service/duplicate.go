@@ -0,0 +1,115 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultDuplicateWindow is how long a succeeded run answers identical runs of the same
+// logical date, unless DUPLICATE_RUN_WINDOW says otherwise.
+const defaultDuplicateWindow = 24 * time.Hour
+
+// ErrDuplicateRun is returned when an identical export of the same logical date is still
+// in progress.
+var ErrDuplicateRun = errors.New("duplicate run")
+
+// checkLogicalDate accepts a date (2026-10-14) or an RFC 3339 time.
+func checkLogicalDate(v string) error {
+	if v == "" {
+		return nil
+	}
+	if _, err := time.Parse(time.DateOnly, v); err == nil {
+		return nil
+	}
+	if _, err := time.Parse(time.RFC3339, v); err != nil {
+		return fmt.Errorf("invalid logical_date %q: expected a date (2006-01-02) or an RFC 3339 time", v)
+	}
+	return nil
+}
+
+// runFingerprint identifies an export definition and logical date: the hash of its
+// resolved parameters, leaving out those that do not change what it exports.
+func runFingerprint(p ExportParams) string {
+	params := resolvedParams(p)
+	delete(params, "priority")
+	delete(params, "debug")
+	// Maps marshal with sorted keys
+	b, _ := json.Marshal(params)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// duplicateLocked returns the latest run of tenant with the fingerprint that is in
+// progress or succeeded within the duplicate window, if any. Runs answered from another
+// run never count.
+func (s *JobStore) duplicateLocked(tenant, fingerprint string, now time.Time) *JobRecord {
+	runs := s.jobs[tenant]
+	for i := len(runs) - 1; i >= 0; i-- {
+		if s.duplicates(runs[i], fingerprint, now) {
+			return runs[i]
+		}
+	}
+	return nil
+}
+
+// duplicates reports whether r is an identical run that answers a new run of fingerprint.
+func (s *JobStore) duplicates(r *JobRecord, fingerprint string, now time.Time) bool {
+	if r.Fingerprint != fingerprint || r.DuplicateOf != "" {
+		return false
+	}
+	switch r.Status {
+	case JobQueued, JobDeferred, JobRunning:
+		return true
+	case JobSucceeded:
+		return r.FinishedAt != nil && now.Sub(*r.FinishedAt) <= s.duplicateWindow
+	}
+	return false
+}
+
+// answerDuplicate completes rec, an identical run of prior, with the result of prior,
+// or fails it while prior is still in progress.
+func (s *JobStore) answerDuplicate(rec *JobRecord, prior JobRecord) (ExportResult, error) {
+	if prior.Status != JobSucceeded {
+		err := fmt.Errorf("%w: job %s is already running this export for logical date %s", ErrDuplicateRun, prior.ID, prior.LogicalDate)
+		s.finish(rec, ExportResult{}, err)
+		return ExportResult{}, err
+	}
+	res := ExportResult{
+		GCSPath:          prior.GCSPath,
+		Table:            prior.Table,
+		Rows:             prior.Rows,
+		Job:              recordedQueryJob(prior),
+		DuplicateOf:      prior.ID,
+		RowsDeleted:      prior.RowsDeleted,
+		Deidentification: prior.Deidentification,
+		Assertions:       prior.Assertions,
+		QualityReport:    prior.QualityReport,
+		Files:            prior.FilesWritten,
+		BytesWritten:     prior.BytesWritten,
+		Sample:           prior.Sample,
+		BytesProcessed:   prior.BytesProcessed,
+		Warnings:         prior.Warnings,
+	}
+	s.finish(rec, res, nil)
+	return res, nil
+}
+
+// recordedQueryJob is the BigQuery job of rec, with the project and location its console
+// URL was built from.
+func recordedQueryJob(rec JobRecord) QueryJob {
+	job := QueryJob{ID: rec.BigQueryJobID}
+	if u, err := url.Parse(rec.BigQueryJobURL); err == nil {
+		job.ProjectID = u.Query().Get("project")
+		// j is bq:<location>:<job ID>
+		if parts := strings.SplitN(u.Query().Get("j"), ":", 3); len(parts) == 3 {
+			job.Location = parts[1]
+		}
+	}
+	return job
+}
@@ -0,0 +1,539 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"time"
+)
+
+// Exporter is the single entry point for running an export, shared by the HTTP API and
+// job mode: it merges configured destination defaults into the request, resolves the
+// query location and hands the export to the driver.
+type Exporter struct {
+	BQ        BigQueryClient
+	Driver    ExportDriver
+	Defaults  config.DestinationDefaults
+	Pipelines *PipelineStore
+	Notifier  *Notifier
+	Jobs      *JobStore
+	Usage     *UsageStore
+	// Metrics count the exports of this instance (GET /metrics)
+	Metrics *Metrics
+	// Impersonator provides clients for exports with a service account to impersonate;
+	// nil disables impersonation
+	Impersonator *Impersonator
+	// GCS writes workbook exports; nil disables them
+	GCS *GCSService
+	// XLSXMaxRows caps the rows of a workbook export (XLSX_MAX_ROWS)
+	XLSXMaxRows int
+	// DownloadMaxRows and DownloadMaxBytes bound streamed downloads (DOWNLOAD_MAX_ROWS,
+	// DOWNLOAD_MAX_BYTES)
+	DownloadMaxRows, DownloadMaxBytes int64
+	// FHIRMappings and REDCapMappings are the configured mappings of fhir and redcap
+	// exports
+	FHIRMappings   map[string]config.FHIRMapping
+	REDCapMappings map[string]config.REDCapMapping
+	// DeidProfiles are the configured de-identification profiles
+	DeidProfiles map[string]config.DeidProfile
+	// ReadSecret reads Secret Manager secret versions, such as the hmac_secret of
+	// de-identification profiles (see NewSecretReader)
+	ReadSecret func(ctx context.Context, name string) ([]byte, error)
+	// Tenants are the configured tenants, by name; retries run with their current rules
+	Tenants map[string]config.Tenant
+	// Environment rewrites the destinations of pipeline runs (ENVIRONMENT)
+	Environment config.Environment
+	// Coordinator shares schedule runs and state between instances (COORDINATION_URL)
+	Coordinator Coordinator
+	// Lineage reports the lineage of successful exports to data catalogs; nil disables it
+	Lineage *LineageEmitter
+	// Naming is the naming policy of destinations
+	Naming config.NamingPolicy
+	// Features turn automatic schema changes, DDL and overwrites on or off per destination
+	Features config.Features
+	// Cleanups removes the debris of exports failing partway; nil disables it
+	Cleanups *Cleanups
+	// Instance is this instance, whose lease tells others that its runs are not
+	// orphaned; nil disables the recovery of orphaned runs
+	Instance *Instance
+	// OrphanPolicy is what becomes of orphaned runs (ORPHANED_JOB_POLICY)
+	OrphanPolicy string
+	// Heartbeats sets the heartbeats and watchdog of running exports
+	Heartbeats HeartbeatPolicy
+	// ValidationReportPrefix is where the validation reports of table exports are stored
+	// (VALIDATION_REPORT_PREFIX); empty keeps them in the job history only
+	ValidationReportPrefix string
+
+	slots tenantSlots
+	queue *exportQueue
+	quota *quotaBackoff
+	// breakers stop exports into destinations that keep failing
+	breakers *circuitBreakers
+	// results holds the rows of completed runs for paging
+	results *resultPages
+}
+
+func NewExporter(bq BigQueryClient, driver ExportDriver, cfg *config.Config) *Exporter {
+	e := &Exporter{
+		BQ:        bq,
+		Driver:    driver,
+		Defaults:  cfg.DefaultsFor(driver.Name()),
+		Pipelines: NewPipelineStore(cfg),
+		Notifier:  NewNotifier(),
+		Jobs:      newJobStoreFromEnv(),
+		Usage:     newUsageStore(""),
+		Metrics:   NewMetrics(),
+		queue:     newExportQueueFromEnv(),
+		quota:     newQuotaBackoffFromEnv(driver.Name()),
+		breakers:  newCircuitBreakersFromEnv(),
+		results:   newResultPagesFromEnv(),
+
+		Heartbeats: heartbeatPolicyFromEnv(),
+		ReadSecret: NewSecretReader(),
+
+		Coordinator: newLocalCoordinator(),
+
+		XLSXMaxRows: xlsxMaxRowsFromEnv(),
+
+		ValidationReportPrefix: os.Getenv("VALIDATION_REPORT_PREFIX"),
+	}
+	e.DownloadMaxRows, e.DownloadMaxBytes = downloadLimitsFromEnv()
+	if cfg != nil {
+		e.FHIRMappings = cfg.FHIRMappings
+		e.REDCapMappings = cfg.REDCapMappings
+		e.DeidProfiles = cfg.DeidProfiles
+		e.Tenants = cfg.Tenants
+		e.Environment = cfg.CurrentEnvironment()
+		e.Naming = cfg.Naming
+		e.Features = cfg.Features
+	}
+	return e
+}
+
+// Run executes one export and records it in the job history. Tenant requests are
+// confined to the tenant's destinations and quotas. Beyond MAX_CONCURRENT_EXPORTS, exports
+// wait for a slot in priority order. Exports failing on BigQuery quotas are deferred and
+// run again (see quotaBackoff), unless their caller waits for them (WithSynchronous), and exports into a destination that keeps failing are
+// stopped by its circuit breaker (see circuitBreakers).
+func (e *Exporter) Run(ctx context.Context, params ExportParams) (ExportResult, error) {
+	if params.ChunkColumn != "" {
+		return e.runChunks(ctx, params)
+	}
+	params = applyDefaults(params, e.Defaults)
+	rank, err := priorityRank(params.Priority)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if params, err = applyShard(params, e.Driver.Name()); err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if err := checkLogicalDate(params.LogicalDate); err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	// Runs of "now" identify by the request, not by the time it resolves to
+	requestedSnapshot := params.SnapshotTime
+	if params, err = applySnapshotTime(params, time.Now()); err != nil {
+		return ExportResult{}, err
+	}
+	tenant, t, isTenant := TenantFrom(ctx)
+	if isTenant {
+		if params, err = applyTenant(params, tenant, t); err != nil {
+			return ExportResult{}, err
+		}
+		if params, err = tenantTable(params, e.Driver.Name(), tenant); err != nil {
+			return ExportResult{}, err
+		}
+		params = applyTenantRowFilter(ctx, params, t)
+		if err := e.Usage.checkQuota(ctx); err != nil {
+			return ExportResult{}, err
+		}
+		release, err := e.slots.acquire(tenant, t.MaxConcurrentExports)
+		if err != nil {
+			return ExportResult{}, err
+		}
+		defer release()
+	}
+
+	var fingerprint string
+	if params.LogicalDate != "" {
+		p := params
+		p.SnapshotTime = requestedSnapshot
+		fingerprint = runFingerprint(p)
+	}
+	rec, prior := e.Jobs.start(ctx, e.Driver.Name(), params, fingerprint)
+	if logging.RequestID(ctx) == "" {
+		ctx = logging.WithRequestID(ctx, rec.ID)
+	}
+	if prior != nil {
+		slog.InfoContext(ctx, "Identical export of this logical date already ran", "duplicate_of", prior.ID, "status", prior.Status, "logical_date", params.LogicalDate)
+		return e.Jobs.answerDuplicate(rec, *prior)
+	}
+	ticket, err := e.breakers.admit(ctx, breakerDestination(e.Driver, params), func(until time.Time, err error) {
+		e.Jobs.deferred(rec, until, err.Error(), false)
+	})
+	if err != nil {
+		e.finish(rec, ExportResult{}, err)
+		return ExportResult{}, err
+	}
+	defer ticket.release()
+	if until := e.quota.cooldown(); !until.IsZero() && synchronous(ctx) {
+		err := &RetryAfterError{RetryAfter: time.Until(until), Err: errors.New("recent BigQuery quota errors of other exports have not cleared")}
+		e.finish(rec, ExportResult{}, err)
+		return ExportResult{}, err
+	} else if !until.IsZero() {
+		slog.InfoContext(ctx, "Deferring export until recent BigQuery quota errors clear", "until", until)
+		e.Jobs.deferred(rec, until, "waiting for BigQuery quota errors of other exports to clear", false)
+		if err := waitUntil(ctx, until); err != nil {
+			e.finish(rec, ExportResult{}, err)
+			return ExportResult{}, err
+		}
+	}
+	release, err := e.queue.acquire(ctx, rank, func() { e.Jobs.queued(rec) })
+	if err != nil {
+		e.finish(rec, ExportResult{}, err)
+		return ExportResult{}, err
+	}
+	defer func() { release() }()
+	e.Jobs.running(rec)
+	if rank == rankBatch && e.queue.preempt {
+		ctx = withYield(ctx, e.queue.yield)
+	}
+	client, err := e.impersonatedClient(ctx, params)
+	if err != nil {
+		e.finish(rec, ExportResult{}, err)
+		return ExportResult{}, err
+	}
+	var stmts *statementLog
+	if params.Debug {
+		ctx, stmts = withStatementLog(ctx)
+	}
+	bq := &meteredBigQuery{BigQueryClient: client}
+	watched, unwatch := e.watch(ctx, rec)
+	var res ExportResult
+	for attempt := 0; ; attempt++ {
+		runCtx, cleanups := withCleanups(watched, e.Cleanups)
+		res, err = e.run(runCtx, bq, params, t.MaxBytesPerQuery)
+		cleanups.finish(ctx, !loadCommitted(err))
+		delay, ok := e.quota.deferral(err, attempt)
+		if ok && synchronous(ctx) {
+			err = &RetryAfterError{RetryAfter: delay, Err: err}
+			break
+		}
+		if !ok {
+			break
+		}
+		// The slot is free for other exports while this one waits
+		release()
+		until := time.Now().Add(delay)
+		slog.WarnContext(ctx, "BigQuery quota exhausted; deferring the export", "attempt", attempt+1, "until", until, "error", err)
+		e.Jobs.deferred(rec, until, err.Error(), true)
+		if werr := waitUntil(ctx, until); werr != nil {
+			err = fmt.Errorf("%w (deferred after: %v)", werr, err)
+			break
+		}
+		if release, err = e.queue.acquire(ctx, rank, func() { e.Jobs.queued(rec) }); err != nil {
+			release = func() {}
+			break
+		}
+		e.Jobs.running(rec)
+		progressFrom(watched).touch()
+	}
+	if err != nil && errors.Is(context.Cause(watched), ErrJobStalled) {
+		err = fmt.Errorf("%w: no activity for %s: %w", ErrJobStalled, e.Heartbeats.StallTimeout, err)
+	}
+	unwatch()
+	if err == nil {
+		e.quota.succeeded()
+	}
+	ticket.report(ctx, err)
+	res.BytesProcessed = bq.bytes.Load()
+	res.Statements = stmts.list()
+	// Failed exports are accounted too: BigQuery bills the bytes they scanned
+	e.Usage.record(ctx, res.BytesProcessed, res.Rows)
+	if swaps := deferredSwapsFrom(ctx); swaps != nil && err == nil {
+		// The job runs until its sync swaps the table into place
+		swaps.finishAfter(res.Table, func(err error) { e.finish(rec, res, err) })
+		return res, nil
+	}
+	e.finish(rec, res, err)
+	return res, err
+}
+
+// finish records the outcome of the run rec in the job history and the metrics.
+func (e *Exporter) finish(rec *JobRecord, res ExportResult, err error) {
+	e.Jobs.finish(rec, res, err)
+	e.Metrics.recordExport(e.Driver.Name(), res, err)
+}
+
+func (e *Exporter) run(ctx context.Context, bq BigQueryClient, params ExportParams, maxBytes int64) (ExportResult, error) {
+	started := time.Now()
+	if err := e.checkParams(params); err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if err := e.checkNaming(ctx, params); err != nil {
+		return ExportResult{}, err
+	}
+	params, err := e.applyFeatures(params)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if len(params.Assertions) > 0 && deferredSwapsFrom(ctx) != nil {
+		// The destination only holds the load once the sync swaps it in
+		return ExportResult{}, ConfigError(fmt.Errorf("assertions cannot check the tables of a defer_swaps sync"))
+	}
+	if (len(params.Labels) > 0 || params.Description != "") && deferredSwapsFrom(ctx) != nil {
+		return ExportResult{}, ConfigError(fmt.Errorf("labels cannot be attached to the tables of a defer_swaps sync"))
+	}
+	if params, err = e.applyFormatMapping(params); err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if params, err = e.applyDeidProfile(params); err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if ctx, err = params.deid.withHMACKey(ctx, e.ReadSecret); err != nil {
+		return ExportResult{}, err
+	}
+	if params, err = applyTransforms(params); err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	probe, err := probeQuery(params)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if params.QueryLocation, err = checkQueryBytes(ctx, bq, probe, params.QueryLocation, maxBytes); err != nil {
+		return ExportResult{}, err
+	}
+	location, err := ResolveLocation(ctx, bq, probe, params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	params.QueryLocation = location
+	var res ExportResult
+	switch {
+	case params.DiffSnapshot != "":
+		res, err = e.runDiff(ctx, bq, params)
+	case params.ChangesTable != "":
+		res, err = e.runChanges(ctx, bq, params)
+	default:
+		res, err = e.runQuery(ctx, bq, params)
+	}
+	if err == nil && (len(params.Labels) > 0 || params.Description != "") {
+		// The load is committed; failing it now would invite a duplicate retry
+		if lerr := e.labelDestination(ctx, bq, params, res); lerr != nil {
+			slog.WarnContext(ctx, "Failed to label the destination", "error", lerr)
+			res.Warnings = append(res.Warnings, lerr.Error())
+		}
+	}
+	if params.deid != nil {
+		audit := params.deid.audit
+		res.Deidentification = &audit
+		if err == nil {
+			err = recordDeidAudit(ctx, bq, params, res)
+		}
+	}
+	if err == nil && len(params.Assertions) > 0 {
+		res.Assertions, err = e.checkAssertions(ctx, bq, params, res)
+		if res.Assertions != nil {
+			report := newQualityReport(ctx, e.Driver.Name(), params, res)
+			// The export is committed; a report that cannot be stored must not fail it
+			if werr := e.writeQualityReport(ctx, &report, res.GCSPath); werr != nil {
+				slog.WarnContext(ctx, "Failed to store the validation report", "error", werr)
+				report.StorageError = werr.Error()
+			}
+			res.QualityReport = &report
+		}
+	}
+	if params.NotifySample != nil && loadCommitted(err) {
+		var serr error
+		if res.Sample, serr = e.sampleRows(ctx, bq, params, res); serr != nil {
+			slog.WarnContext(ctx, "Failed to sample the destination for notifications", "error", serr)
+		}
+	}
+	if params.ResolveSingleFile && loadCommitted(err) {
+		res.GCSPath = e.resolveSingleFile(ctx, res)
+	}
+	if err == nil && e.Lineage != nil {
+		e.reportLineage(ctx, bq, params, probe, res, started)
+	}
+	return res, err
+}
+
+// checkQueryBytes rejects query when a dry run estimates it processes more than maxBytes,
+// the tenant's MaxBytesPerQuery, and returns location or, unset, the location of the
+// dry run. Without a limit, nothing is run.
+func checkQueryBytes(ctx context.Context, bq BigQueryClient, query, location string, maxBytes int64) (string, error) {
+	if maxBytes <= 0 {
+		return location, nil
+	}
+	dry, err := bq.DryRun(ctx, query, location)
+	if err != nil {
+		return "", fmt.Errorf("failed to estimate query cost: %w", err)
+	}
+	if dry.TotalBytesProcessed > maxBytes {
+		return "", fmt.Errorf("%w: query would process %d bytes, tenant limit is %d", ErrQuotaExceeded, dry.TotalBytesProcessed, maxBytes)
+	}
+	return cmp.Or(location, dry.Location), nil
+}
+
+// runQuery exports the result of params.Query.
+func (e *Exporter) runQuery(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	query, err := rowFilterQuery(params.Query, params)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	query, err = params.deid.deidentify(ctx, bq, sampleQuery(dedupQuery(query, params), params), params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if params.LineageColumns {
+		query = lineageQuery(ctx, query, params)
+	}
+	params.Query = query
+	return e.Driver.Execute(ctx, bq, params)
+}
+
+// checkParams rejects option combinations no export supports.
+func (e *Exporter) checkParams(params ExportParams) error {
+	if params.DiffSnapshot != "" && params.ChangesTable != "" {
+		return fmt.Errorf("diff_snapshot and changes_table cannot be combined")
+	}
+	if params.DeleteColumn != "" && e.Driver.Name() != "STARROCKS" {
+		return fmt.Errorf("delete_column is only supported by the STARROCKS driver")
+	}
+	if params.ColumnNames != "" && e.Driver.Name() != "STARROCKS" {
+		return fmt.Errorf("column_names is only supported by the STARROCKS driver")
+	}
+	if params.ColumnCase != "" && e.Driver.Name() != "STARROCKS" {
+		return fmt.Errorf("column_case is only supported by the STARROCKS driver")
+	}
+	if params.StringType != "" && e.Driver.Name() != "STARROCKS" {
+		return fmt.Errorf("string_type is only supported by the STARROCKS driver")
+	}
+	if params.Verify && e.Driver.Name() != "STARROCKS" {
+		return fmt.Errorf("verify is only supported by the STARROCKS driver")
+	}
+	if err := checkFormat(params, e.Driver.Name()); err != nil {
+		return err
+	}
+	if err := checkParquetWrite(params, e.Driver.Name()); err != nil {
+		return err
+	}
+	if err := checkRedis(params, e.Driver.Name()); err != nil {
+		return err
+	}
+	if err := checkLabels(params, e.Driver.Name()); err != nil {
+		return err
+	}
+	if err := checkTransforms(params, e.Driver.Name()); err != nil {
+		return err
+	}
+	if err := checkDedup(params); err != nil {
+		return err
+	}
+	if params.ResolveSingleFile {
+		if driver := e.Driver.Name(); driver != "GCS_PARQUET" && driver != parquetWriteDriverName {
+			return fmt.Errorf("resolve_single_file is only supported by the GCS_PARQUET and %s drivers", parquetWriteDriverName)
+		}
+		if e.GCS == nil {
+			return fmt.Errorf("resolve_single_file needs a Cloud Storage client")
+		}
+	}
+	if err := checkAssertionsSupported(params, e.Driver.Name()); err != nil {
+		return err
+	}
+	if params.NotifySample != nil {
+		if err := checkDestinationReadable(params, e.Driver.Name(), "notification samples"); err != nil {
+			return err
+		}
+	}
+	return checkSample(params)
+}
+
+// probeQuery is the query cost estimates and location detection run against. Change
+// history queries are only built once the watermark is known; the source table stands in
+// for them.
+func probeQuery(params ExportParams) (string, error) {
+	if params.ChangesTable != "" {
+		return rowFilterQuery("SELECT * FROM "+quoteBigQueryTable(params.ChangesTable), params)
+	}
+	return rowFilterQuery(params.Query, params)
+}
+
+// applyDefaults fills empty request fields from the destination defaults. Naming
+// templates only apply when the request carries a logical name.
+func applyDefaults(p ExportParams, d config.DestinationDefaults) ExportParams {
+	if p.QueryLocation == "" {
+		p.QueryLocation = d.QueryLocation
+	}
+	if p.Output == "" {
+		p.Output = d.Output
+	}
+	if p.Filename == "" && p.Name != "" {
+		p.Filename = config.RenderName(d.Filename, p.Name)
+	}
+	if p.UseTimestamp == nil {
+		p.UseTimestamp = d.UseTimestamp
+	}
+	if p.Database == "" {
+		p.Database = d.Database
+	}
+	if p.Table == "" && p.Name != "" {
+		p.Table = config.RenderName(d.Table, p.Name)
+	}
+	if p.ReplicationNum == 0 {
+		p.ReplicationNum = d.ReplicationNum
+	}
+	if p.LoadStrategy == "" {
+		p.LoadStrategy = d.LoadStrategy
+	}
+	if p.ColumnNames == "" {
+		p.ColumnNames = d.ColumnNames
+	}
+	if p.ColumnCase == "" {
+		p.ColumnCase = d.ColumnCase
+	}
+	if p.StringType == "" {
+		p.StringType = d.StringType
+	}
+	if d.Verify {
+		p.Verify = true
+	}
+	if d.LineageColumns {
+		p.LineageColumns = true
+	}
+	if len(d.Labels) > 0 {
+		labels := maps.Clone(d.Labels)
+		maps.Copy(labels, p.Labels)
+		p.Labels = labels
+	}
+	if p.WriteMode == "" {
+		p.WriteMode = d.WriteMode
+	}
+	if p.DestinationLocation == "" {
+		p.DestinationLocation = d.DestinationLocation
+	}
+	return p
+}
+
+// ResolveLocation returns location if set, otherwise detects it by dry-running the query
+// without a location.
+func ResolveLocation(ctx context.Context, bq BigQueryClient, sqlQuery, location string) (string, error) {
+	if location != "" {
+		return location, nil
+	}
+	dry, err := bq.DryRun(ctx, sqlQuery, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to detect query location (set query_location explicitly): %w", err)
+	}
+	if dry.Location == "" {
+		return "", fmt.Errorf("could not detect query location; set query_location explicitly")
+	}
+	slog.InfoContext(ctx, "Detected query location", "location", dry.Location)
+	return dry.Location, nil
+}
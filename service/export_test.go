@@ -0,0 +1,57 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"testing"
+)
+
+func TestResolveLocation(t *testing.T) {
+	bq := &fakeBigQuery{location: "asia-southeast2"}
+	got, err := ResolveLocation(context.Background(), bq, "SELECT 1", "")
+	if err != nil || got != "asia-southeast2" {
+		t.Fatalf("ResolveLocation() = %q, %v; want detected asia-southeast2", got, err)
+	}
+
+	bq = &fakeBigQuery{}
+	got, err = ResolveLocation(context.Background(), bq, "SELECT 1", "US")
+	if err != nil || got != "US" {
+		t.Fatalf("ResolveLocation() = %q, %v; want explicit US", got, err)
+	}
+	if len(bq.queries) != 0 {
+		t.Errorf("explicit location should not dry-run")
+	}
+
+	if _, err := ResolveLocation(context.Background(), &fakeBigQuery{}, "SELECT 1", ""); err == nil {
+		t.Errorf("ResolveLocation() without detectable location should fail")
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	yes := true
+	d := config.DestinationDefaults{
+		QueryLocation:  "asia-southeast2",
+		Output:         "gs://bucket/exports/",
+		Filename:       "{name}-snapshot",
+		UseTimestamp:   &yes,
+		Database:       "analytics",
+		Table:          "stg_{name}",
+		ReplicationNum: 3,
+		Labels:         map[string]string{"owner": "data-team", "pipeline": "{pipeline}"},
+	}
+	got := applyDefaults(ExportParams{Name: "patients", Query: "SELECT 1"}, d)
+	if got.QueryLocation != "asia-southeast2" || got.Output != "gs://bucket/exports/" || got.Filename != "patients-snapshot" ||
+		got.UseTimestamp == nil || !*got.UseTimestamp || got.Database != "analytics" || got.Table != "stg_patients" || got.ReplicationNum != 3 {
+		t.Errorf("applyDefaults() = %+v", got)
+	}
+
+	// Request values win over defaults
+	no := false
+	got = applyDefaults(ExportParams{Name: "patients", Table: "custom", Database: "other", UseTimestamp: &no, Labels: map[string]string{"owner": "site-a"}}, d)
+	if got.Table != "custom" || got.Database != "other" || *got.UseTimestamp || got.Labels["owner"] != "site-a" || got.Labels["pipeline"] != "{pipeline}" {
+		t.Errorf("applyDefaults() overrode request values: %+v", got)
+	}
+	if d.Labels["owner"] != "data-team" {
+		t.Errorf("applyDefaults() changed the default labels: %v", d.Labels)
+	}
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/go-sql-driver/mysql"
+	"google.golang.org/api/googleapi"
+)
+
+// Failure classes of export errors, for callers that branch on why an export failed.
+const (
+	// FailureConfig is a request or configuration the export cannot run with: unknown
+	// options, invalid or forbidden queries and destinations, missing pipelines. Running
+	// it again fails the same way.
+	FailureConfig = "config"
+	// FailureTransient is an outage, rate limit, timeout or cancellation; running the
+	// export again may succeed.
+	FailureTransient = "transient"
+	// FailureData is data the destination does not accept: values too long for their
+	// column, rejected rows, result columns missing from the table, a load that does not
+	// verify.
+	FailureData = "data"
+	// FailureOther is any other error.
+	FailureOther = "error"
+)
+
+// Job mode exit codes by failure class.
+const (
+	ExitOK        = 0
+	ExitOther     = 1
+	ExitConfig    = 2
+	ExitTransient = 3
+	ExitData      = 4
+)
+
+// classifiedError marks an error with its failure class, keeping its message.
+type classifiedError struct {
+	class string
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+func (e *classifiedError) Unwrap() error { return e.err }
+
+// ConfigError marks err as a FailureConfig error.
+func ConfigError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: FailureConfig, err: err}
+}
+
+// TransientError marks err as a FailureTransient error, such as a failure to connect to
+// a backend at startup.
+func TransientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: FailureTransient, err: err}
+}
+
+// DataError marks err as a FailureData error.
+func DataError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: FailureData, err: err}
+}
+
+// transientReasons are the BigQuery and Google API error reasons worth retrying.
+var transientReasons = map[string]bool{
+	"backendError":          true,
+	"internalError":         true,
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+	"jobBackendError":       true,
+	"jobInternalError":      true,
+}
+
+// configReasons are the BigQuery error reasons caused by the query or its permissions.
+var configReasons = map[string]bool{
+	"invalidQuery":      true,
+	"notFound":          true,
+	"accessDenied":      true,
+	"duplicate":         true,
+	"billingNotEnabled": true,
+}
+
+// FailureClass returns the failure class of an export error ("" for nil).
+func FailureClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	switch {
+	case errors.Is(err, ErrPipelineNotFound), errors.Is(err, ErrPipelineParameters), errors.Is(err, ErrForbidden), errors.Is(err, ErrBucketUnusable):
+		return FailureConfig
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrDestinationUnavailable),
+		errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		return FailureTransient
+	}
+	var be *bigquery.Error
+	if errors.As(err, &be) {
+		switch {
+		case transientReasons[be.Reason]:
+			return FailureTransient
+		case configReasons[be.Reason]:
+			return FailureConfig
+		case be.Reason == "invalid":
+			// Job errors on values (bad casts, rows EXPORT DATA cannot write)
+			return FailureData
+		}
+	}
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		for _, item := range ge.Errors {
+			if transientReasons[item.Reason] {
+				return FailureTransient
+			}
+		}
+		switch {
+		case ge.Code == 429 || ge.Code >= 500:
+			return FailureTransient
+		case ge.Code == 400 || ge.Code == 403 || ge.Code == 404:
+			return FailureConfig
+		}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return FailureTransient
+	}
+	return FailureOther
+}
+
+// ExitCode returns the job mode exit code of an export error.
+func ExitCode(err error) int {
+	switch FailureClass(err) {
+	case "":
+		return ExitOK
+	case FailureConfig:
+		return ExitConfig
+	case FailureTransient:
+		return ExitTransient
+	case FailureData:
+		return ExitData
+	}
+	return ExitOther
+}
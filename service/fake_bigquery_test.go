@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// fakeBigQuery is an in-memory BigQueryClient that records submitted queries and
+// serves canned rows.
+type fakeBigQuery struct {
+	schema   bigquery.Schema
+	rows     [][]bigquery.Value
+	err      error
+	location string // reported by DryRun
+	// referenced are the tables DryRun reports the query reads
+	referenced []string
+	bytes      int64 // reported by DryRun and RunQuery jobs
+
+	mu        sync.Mutex // guards queries and locations for parallel exports
+	queries   []string
+	locations []string
+}
+
+func (f *fakeBigQuery) record(sqlQuery, location string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, sqlQuery)
+	f.locations = append(f.locations, location)
+}
+
+func (f *fakeBigQuery) RunQuery(ctx context.Context, sqlQuery, location string) (QueryJob, error) {
+	f.record(sqlQuery, location)
+	if f.err != nil {
+		return QueryJob{}, f.err
+	}
+	return QueryJob{ProjectID: "test-project", ID: "job_fake", Location: location, BytesProcessed: f.bytes}, nil
+}
+
+func (f *fakeBigQuery) ReadRows(ctx context.Context, sqlQuery, location string) (RowIterator, error) {
+	f.record(sqlQuery, location)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &fakeRowIterator{schema: f.schema, rows: f.rows}, nil
+}
+
+func (f *fakeBigQuery) DryRun(ctx context.Context, sqlQuery, location string) (DryRunResult, error) {
+	f.record(sqlQuery, location)
+	if f.err != nil {
+		return DryRunResult{}, f.err
+	}
+	return DryRunResult{Schema: f.schema, Location: f.location, TotalBytesProcessed: f.bytes, ReferencedTables: f.referenced}, nil
+}
+
+type fakeRowIterator struct {
+	schema bigquery.Schema
+	rows   [][]bigquery.Value
+	pos    int
+}
+
+func (it *fakeRowIterator) Next(dst *[]bigquery.Value) error {
+	if it.pos >= len(it.rows) {
+		return iterator.Done
+	}
+	*dst = it.rows[it.pos]
+	it.pos++
+	return nil
+}
+
+func (it *fakeRowIterator) Schema() bigquery.Schema {
+	return it.schema
+}
+
+func (it *fakeRowIterator) Job() QueryJob {
+	return QueryJob{ProjectID: "test-project", ID: "job_fake"}
+}
+
+func (it *fakeRowIterator) Close() {}
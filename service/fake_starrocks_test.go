@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStarRocks is an in-memory database/sql connector that understands the StarRocks
+// statements of a load: it keeps the columns and row counts of tables and records every
+// statement executed. Statements containing fail fail.
+type fakeStarRocks struct {
+	fail string
+
+	mu         sync.Mutex
+	tables     map[string]*fakeSRTable // by db.table
+	statements []string
+}
+
+type fakeSRTable struct {
+	cols []string
+	rows int
+}
+
+// newFakeStarRocks returns the fake, holding tables (db.table to column names), and a
+// StarRocksService in database analytics using it.
+func newFakeStarRocks(t *testing.T, tables map[string][]string) (*fakeStarRocks, *StarRocksService) {
+	t.Helper()
+	f := &fakeStarRocks{tables: map[string]*fakeSRTable{}}
+	for name, cols := range tables {
+		f.tables[name] = &fakeSRTable{cols: cols}
+	}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return f, &StarRocksService{db: db, dbname: "analytics"}
+}
+
+// table returns the named table, or nil if it does not exist.
+func (f *fakeStarRocks) table(name string) *fakeSRTable {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tables[name]
+}
+
+// executed returns the statements executed that start with prefix.
+func (f *fakeStarRocks) executed(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, s := range f.statements {
+		if strings.HasPrefix(s, prefix) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (f *fakeStarRocks) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeSRConn{f: f}, nil
+}
+func (f *fakeStarRocks) Open(name string) (driver.Conn, error) { return &fakeSRConn{f: f}, nil }
+func (f *fakeStarRocks) Driver() driver.Driver                 { return f }
+
+var (
+	srCreateLike = regexp.MustCompile(`^CREATE TABLE (\S+) LIKE (\S+)$`)
+	srInsert     = regexp.MustCompile(`^INSERT INTO (\S+) `)
+	srSwap       = regexp.MustCompile(`^ALTER TABLE (\S+) SWAP WITH (\S+)$`)
+	srDrop       = regexp.MustCompile(`^DROP TABLE IF EXISTS (\S+) FORCE$`)
+	srCount      = regexp.MustCompile(`^SELECT COUNT\(\*\) FROM (\S+)$`)
+)
+
+// exec applies a statement; inserts add to pending, applied when their transaction commits.
+func (f *fakeStarRocks) exec(query string, pending map[string]int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query = strings.TrimSpace(query)
+	f.statements = append(f.statements, query)
+	if f.fail != "" && strings.Contains(query, f.fail) {
+		return errors.New("injected failure")
+	}
+	if m := srCreateLike.FindStringSubmatch(query); m != nil {
+		src, ok := f.tables[m[2]]
+		if !ok {
+			return errors.New("unknown table " + m[2])
+		}
+		f.tables[m[1]] = &fakeSRTable{cols: src.cols}
+	} else if m := srInsert.FindStringSubmatch(query); m != nil {
+		if _, ok := f.tables[m[1]]; !ok {
+			return errors.New("unknown table " + m[1])
+		}
+		pending[m[1]] += strings.Count(query, "), (") + 1
+	} else if m := srSwap.FindStringSubmatch(query); m != nil {
+		// The table swapped with is named within the database of the first
+		db, _, _ := strings.Cut(m[1], ".")
+		other := db + "." + m[2]
+		a, b := f.tables[m[1]], f.tables[other]
+		if a == nil || b == nil {
+			return errors.New("unknown table")
+		}
+		f.tables[m[1]], f.tables[other] = b, a
+	} else if m := srDrop.FindStringSubmatch(query); m != nil {
+		delete(f.tables, m[1])
+	}
+	return nil
+}
+
+func (f *fakeStarRocks) query(query string, args []driver.NamedValue) (driver.Rows, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query = strings.TrimSpace(query)
+	switch {
+	case strings.Contains(query, "information_schema.tables"):
+		rows := &fakeSRRows{cols: []string{"one"}}
+		if _, ok := f.tables[args[0].Value.(string)+"."+args[1].Value.(string)]; ok {
+			rows.values = [][]driver.Value{{int64(1)}}
+		}
+		return rows, nil
+	case strings.Contains(query, "information_schema.columns"):
+		rows := &fakeSRRows{cols: []string{"column_name", "data_type", "character_maximum_length"}}
+		if t, ok := f.tables[args[0].Value.(string)+"."+args[1].Value.(string)]; ok {
+			for _, c := range t.cols {
+				rows.values = append(rows.values, []driver.Value{c, "bigint", nil})
+			}
+		}
+		return rows, nil
+	}
+	if m := srCount.FindStringSubmatch(query); m != nil {
+		t, ok := f.tables[m[1]]
+		if !ok {
+			return nil, errors.New("unknown table " + m[1])
+		}
+		return &fakeSRRows{cols: []string{"count"}, values: [][]driver.Value{{int64(t.rows)}}}, nil
+	}
+	return nil, errors.New("unsupported query: " + query)
+}
+
+type fakeSRConn struct {
+	f       *fakeStarRocks
+	pending map[string]int // rows inserted by the open transaction, by table
+}
+
+func (c *fakeSRConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (c *fakeSRConn) Close() error { return nil }
+func (c *fakeSRConn) Begin() (driver.Tx, error) {
+	c.pending = map[string]int{}
+	return c, nil
+}
+
+func (c *fakeSRConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	pending := c.pending
+	if pending == nil {
+		// Outside a transaction, inserts apply right away
+		pending = map[string]int{}
+		defer c.apply(pending)
+	}
+	if err := c.f.exec(query, pending); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeSRConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.f.query(query, args)
+}
+
+func (c *fakeSRConn) apply(pending map[string]int) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	for name, n := range pending {
+		if t, ok := c.f.tables[name]; ok {
+			t.rows += n
+		}
+	}
+}
+
+func (c *fakeSRConn) Commit() error {
+	c.apply(c.pending)
+	c.pending = nil
+	return nil
+}
+
+func (c *fakeSRConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+
+type fakeSRRows struct {
+	cols   []string
+	values [][]driver.Value
+}
+
+func (r *fakeSRRows) Columns() []string { return r.cols }
+func (r *fakeSRRows) Close() error      { return nil }
+func (r *fakeSRRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// featureDestination returns the name the features of an export's destination are
+// configured by (see config.Features): the db.table of StarRocks, the
+// [project.]dataset.table of BigQuery, and the table or output of other drivers.
+func (e *Exporter) featureDestination(params ExportParams) string {
+	if d, ok := e.Driver.(destinationTabler); ok {
+		t, _ := d.destinationTable(params)
+		return t
+	}
+	return cmp.Or(params.Table, params.Output)
+}
+
+// applyFeatures resolves the features of the destination of params, and rejects exports
+// that would overwrite a destination where overwrite is disabled. Exports that do not
+// allow schema changes run without schema evolution and auto DDL, and are rejected when
+// they would replace the destination's schema.
+func (e *Exporter) applyFeatures(params ExportParams) (ExportParams, error) {
+	destination := e.featureDestination(params)
+	params.disabledFeatures = e.Features.Disabled(destination)
+	if params.AllowSchemaChanges != nil && !*params.AllowSchemaChanges {
+		if strings.TrimSpace(params.CreateDDL) != "" {
+			return params, fmt.Errorf("create_ddl cannot be combined with allow_schema_changes false")
+		}
+		if e.Driver.Name() == "BIGQUERY" {
+			if mode, err := bigQueryWriteMode(params); err == nil && mode == WriteModeReplace {
+				return params, fmt.Errorf("write_mode replace (the default) recreates %s with the schema of the result, and allow_schema_changes is false; use write_mode append or merge", destination)
+			}
+		}
+		for _, name := range []string{config.FeatureSchemaEvolution, config.FeatureAutoDDL} {
+			if params.featureEnabled(name) {
+				params.disabledFeatures = append(params.disabledFeatures, name)
+			}
+		}
+	}
+	if params.featureEnabled(config.FeatureOverwrite) {
+		return params, nil
+	}
+	switch e.Driver.Name() {
+	case "STARROCKS":
+		if params.LoadStrategy == LoadStrategySwap {
+			return params, fmt.Errorf("load_strategy swap replaces %s, and overwrite is disabled for it; use load_strategy insert", destination)
+		}
+	case "BIGQUERY":
+		if mode, err := bigQueryWriteMode(params); err == nil && mode == WriteModeReplace {
+			return params, fmt.Errorf("write_mode replace (the default) overwrites %s, and overwrite is disabled for it; use write_mode append or merge", destination)
+		}
+	}
+	return params, nil
+}
+
+// featureEnabled reports whether the feature name is on for the destination of p.
+func (p ExportParams) featureEnabled(name string) bool {
+	return !slices.Contains(p.disabledFeatures, name)
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFeaturesGateBigQueryWrites(t *testing.T) {
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewBigQueryTableDriver(nil, nil), &config.Config{})
+	if err := e.Features.Disable(config.FeatureOverwrite, config.FeatureAutoDDL); err != nil {
+		t.Fatal(err)
+	}
+	_, err := e.Run(context.Background(), ExportParams{Query: "SELECT 1", QueryLocation: "US", Table: "mart.visits"})
+	if FailureClass(err) != FailureConfig || !strings.Contains(err.Error(), "overwrite is disabled") {
+		t.Fatalf("Run() of a replace error = %v, want a config error", err)
+	}
+	if len(bq.queries) != 0 {
+		t.Errorf("queries = %v, want none", bq.queries)
+	}
+
+	if _, err := e.Run(context.Background(), ExportParams{Query: "SELECT 1", QueryLocation: "US", Table: "mart.visits", WriteMode: WriteModeAppend}); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range bq.queries {
+		if strings.Contains(q, "CREATE TABLE") {
+			t.Errorf("query %q creates the table, auto_ddl is disabled", q)
+		}
+	}
+}
+
+func TestAllowSchemaChanges(t *testing.T) {
+	e := NewExporter(&fakeBigQuery{}, NewStarRocksDriver(&StarRocksService{dbname: "mart"}, nil), &config.Config{})
+	allow := false
+	params, err := e.applyFeatures(ExportParams{Table: "visits", AllowSchemaChanges: &allow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.featureEnabled(config.FeatureSchemaEvolution) || params.featureEnabled(config.FeatureAutoDDL) || !params.featureEnabled(config.FeatureOverwrite) {
+		t.Errorf("disabled features = %v, want schema_evolution and auto_ddl", params.disabledFeatures)
+	}
+	if _, err := e.applyFeatures(ExportParams{Table: "visits", AllowSchemaChanges: &allow, CreateDDL: "CREATE TABLE visits (id INT)"}); err == nil {
+		t.Error("applyFeatures() with create_ddl error = nil, want an error")
+	}
+
+	// Pipeline runs cannot be allowed the schema changes their pipeline forbids
+	allowed := true
+	if got := overlayParams(ExportParams{AllowSchemaChanges: &allow}, ExportParams{AllowSchemaChanges: &allowed}); *got.AllowSchemaChanges {
+		t.Error("overlayParams() allowed the schema changes of a pipeline forbidding them")
+	}
+	if got := overlayParams(ExportParams{}, ExportParams{AllowSchemaChanges: &allow}); got.AllowSchemaChanges == nil || *got.AllowSchemaChanges {
+		t.Error("overlayParams() did not forbid schema changes")
+	}
+
+	bq := NewExporter(&fakeBigQuery{}, NewBigQueryTableDriver(nil, nil), &config.Config{})
+	if _, err := bq.applyFeatures(ExportParams{Table: "mart.visits", AllowSchemaChanges: &allow}); err == nil || !strings.Contains(err.Error(), "write_mode replace") {
+		t.Errorf("applyFeatures() of a BigQuery replace error = %v, want an error", err)
+	}
+}
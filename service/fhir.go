@@ -0,0 +1,330 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"google.golang.org/api/iterator"
+)
+
+// FormatFHIR writes FHIR resources as NDJSON, one resource per result row, built by the
+// fhir_mappings entry named by ExportParams.FHIRMapping.
+const FormatFHIR = "fhir"
+
+const fhirContentType = "application/fhir+ndjson"
+
+// fhirFileResources is the number of resources per NDJSON file; larger results are split
+// into numbered files like those of EXPORT DATA.
+var fhirFileResources = 100000
+
+// fhirElement is one element of a mapping, with its columns resolved against the result.
+type fhirElement struct {
+	path []config.FHIRPathSegment
+	// column is the index of a mapped column, or -1 for templates and fixed values
+	column   int
+	template string
+	columns  map[string]int
+	fixed    any
+}
+
+// fhirElements resolves a mapping against the result schema, failing on columns the
+// result does not have.
+func fhirElements(m *config.FHIRMapping, schema bigquery.Schema) ([]fhirElement, error) {
+	index := map[string]int{}
+	for i, f := range schema {
+		index[f.Name] = i
+	}
+	lookup := func(path, col string) (int, error) {
+		i, ok := index[col]
+		if !ok {
+			return 0, fmt.Errorf("FHIR element %s maps column %s, which the query result does not have", path, col)
+		}
+		return i, nil
+	}
+	var elems []fhirElement
+	for path, v := range m.Elements {
+		segs, err := config.ParseFHIRPath(path)
+		if err != nil {
+			return nil, err
+		}
+		el := fhirElement{path: segs, column: -1}
+		if cols := m.TemplateColumns(v); cols != nil {
+			el.template, el.columns = v, map[string]int{}
+			for _, c := range cols {
+				if el.columns[c], err = lookup(path, c); err != nil {
+					return nil, err
+				}
+			}
+		} else if el.column, err = lookup(path, v); err != nil {
+			return nil, err
+		}
+		elems = append(elems, el)
+	}
+	for path, v := range m.Fixed {
+		segs, err := config.ParseFHIRPath(path)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, fhirElement{path: segs, column: -1, fixed: v})
+	}
+	return elems, nil
+}
+
+// fhirResource builds the resource of one row as a JSON object with resourceType first.
+// NULL columns, empty strings and empty arrays leave their element out, as FHIR does not
+// allow empty values.
+func fhirResource(resourceType string, elems []fhirElement, row []bigquery.Value) ([]byte, error) {
+	res := map[string]any{}
+	for _, el := range elems {
+		var v any
+		switch {
+		case el.fixed != nil:
+			v = el.fixed
+		case el.template != "":
+			s, ok := fhirTemplate(el, row)
+			if !ok {
+				continue
+			}
+			v = s
+		default:
+			var ok bool
+			if v, ok = fhirValue(row[el.column]); !ok {
+				continue
+			}
+		}
+		setFHIRElement(res, el.path, v)
+	}
+	compactFHIR(res)
+	body, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	head, _ := json.Marshal(resourceType)
+	out := append([]byte(`{"resourceType":`), head...)
+	if len(body) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, body[1:]...), nil
+}
+
+var fhirPlaceholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// fhirTemplate fills a {column} template; ok is false when one of its columns is NULL.
+func fhirTemplate(el fhirElement, row []bigquery.Value) (string, bool) {
+	ok := true
+	s := fhirPlaceholderRe.ReplaceAllStringFunc(el.template, func(ph string) string {
+		v, present := fhirValue(row[el.columns[ph[1:len(ph)-1]]])
+		if !present {
+			ok = false
+			return ""
+		}
+		if s, isString := v.(string); isString {
+			return s
+		}
+		return fmt.Sprint(v)
+	})
+	return s, ok
+}
+
+// fhirValue converts a BigQuery value into its FHIR JSON form: dates and times as FHIR
+// date, dateTime/instant (UTC) and time strings, NUMERIC exactly, BYTES as base64.
+func fhirValue(v bigquery.Value) (any, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return v, v != ""
+	case int64, float64, bool, []byte:
+		return v, true
+	case *big.Rat:
+		s := strings.TrimRight(v.FloatString(38), "0")
+		return json.Number(strings.TrimSuffix(s, ".")), true
+	case civil.Date:
+		return v.String(), true
+	case civil.DateTime:
+		return v.In(time.UTC).Format(time.RFC3339Nano), true
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), true
+	case civil.Time:
+		return v.String(), true
+	case []bigquery.Value:
+		var out []any
+		for _, e := range v {
+			if c, ok := fhirValue(e); ok {
+				out = append(out, c)
+			}
+		}
+		return out, len(out) > 0
+	case map[string]bigquery.Value:
+		out := map[string]any{}
+		for k, e := range v {
+			if c, ok := fhirValue(e); ok {
+				out[k] = c
+			}
+		}
+		return out, len(out) > 0
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// setFHIRElement sets the element at path, creating the objects and arrays on the way.
+// Mappings are validated not to overlap, so nothing set is overwritten.
+func setFHIRElement(obj map[string]any, path []config.FHIRPathSegment, v any) {
+	for i, seg := range path {
+		last := i == len(path)-1
+		if seg.Index < 0 {
+			if last {
+				obj[seg.Name] = v
+				return
+			}
+			child, _ := obj[seg.Name].(map[string]any)
+			if child == nil {
+				child = map[string]any{}
+				obj[seg.Name] = child
+			}
+			obj = child
+			continue
+		}
+		arr, _ := obj[seg.Name].([]any)
+		for len(arr) <= seg.Index {
+			arr = append(arr, nil)
+		}
+		obj[seg.Name] = arr
+		if last {
+			arr[seg.Index] = v
+			return
+		}
+		child, _ := arr[seg.Index].(map[string]any)
+		if child == nil {
+			child = map[string]any{}
+			arr[seg.Index] = child
+		}
+		obj = child
+	}
+}
+
+// compactFHIR drops the holes that indices skipped over from arrays, so name[1] without
+// name[0] becomes the first name.
+func compactFHIR(obj map[string]any) {
+	for k, v := range obj {
+		switch v := v.(type) {
+		case map[string]any:
+			compactFHIR(v)
+		case []any:
+			out := v[:0]
+			for _, e := range v {
+				if e == nil {
+					continue
+				}
+				if m, ok := e.(map[string]any); ok {
+					compactFHIR(m)
+				}
+				out = append(out, e)
+			}
+			obj[k] = out
+		}
+	}
+}
+
+// executeFHIR reads the result rows and writes them as FHIR resources to NDJSON files of
+// up to fhirFileResources lines, numbered in place of the URI's wildcard.
+func (d *GCSDriver) executeFHIR(ctx context.Context, bq BigQueryClient, params ExportParams, exportURI string) (ExportResult, error) {
+	if d.gcs == nil {
+		return ExportResult{}, ConfigError(fmt.Errorf("format %s needs a Cloud Storage client", FormatFHIR))
+	}
+	bucket, pattern, err := parseGCSURI(exportURI)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if !strings.Contains(pattern, "*") {
+		return ExportResult{}, ConfigError(fmt.Errorf("output %s needs a * wildcard for the numbered %s files", exportURI, FormatFHIR))
+	}
+	it, err := bq.ReadRows(ctx, params.Query, params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, fmt.Errorf("export to %s failed: %w", exportURI, err)
+	}
+	defer it.Close()
+
+	var (
+		res   = ExportResult{GCSPath: exportURI}
+		elems []fhirElement
+		buf   bytes.Buffer
+		lines int
+		files int
+	)
+	flush := func() error {
+		name := strings.Replace(pattern, "*", fmt.Sprintf("%012d", files), 1)
+		if err := d.gcs.WriteObject(ctx, bucket, name, fhirContentType, buf.Bytes()); err != nil {
+			return err
+		}
+		files++
+		res.Files++
+		res.BytesWritten += int64(buf.Len())
+		buf.Reset()
+		lines = 0
+		return nil
+	}
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err != nil && err != iterator.Done {
+			res.Job = it.Job()
+			return res, fmt.Errorf("export to %s failed: %w", exportURI, err)
+		}
+		// The schema is known once the first page has been fetched
+		if elems == nil && len(it.Schema()) > 0 {
+			e, eerr := fhirElements(params.fhir, it.Schema())
+			if eerr != nil {
+				return res, ConfigError(eerr)
+			}
+			elems = e
+		}
+		if err == iterator.Done {
+			break
+		}
+		if elems == nil {
+			return res, fmt.Errorf("export to %s failed: the query result has no schema", exportURI)
+		}
+		line, err := fhirResource(params.fhir.ResourceType, elems, row)
+		if err != nil {
+			return res, DataError(fmt.Errorf("row %d: %w", res.Rows+1, err))
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		res.Rows++
+		if lines++; lines == fhirFileResources {
+			if err := flush(); err != nil {
+				return res, err
+			}
+		}
+	}
+	res.Job = it.Job()
+	// Like EXPORT DATA, an empty result still writes one (empty) file
+	if lines > 0 || files == 0 {
+		if err := flush(); err != nil {
+			return res, err
+		}
+	}
+	slog.InfoContext(ctx, "Wrote FHIR resources", "export_uri", exportURI, "resource_type", params.fhir.ResourceType, "resources", res.Rows, "files", files, "bytes_written", res.BytesWritten)
+	return res, nil
+}
+
+// fhirColumns lists the columns a mapping reads, sorted, for plans.
+func fhirColumns(m *config.FHIRMapping) []string {
+	cols := m.Columns()
+	sort.Strings(cols)
+	return slices.Compact(cols)
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+var testPatientMapping = config.FHIRMapping{
+	ResourceType: "Patient",
+	Elements: map[string]string{
+		"id":                             "patient_id",
+		"identifier[0].value":            "study_code",
+		"name[0].family":                 "last_name",
+		"name[0].given":                  "given_names",
+		"birthDate":                      "dob",
+		"telecom[1].value":               "phone",
+		"managingOrganization.reference": "Organization/{site_id}",
+	},
+	Fixed: map[string]any{"identifier[0].system": "https://example.org/study-a"},
+}
+
+var testPatientSchema = bigquery.Schema{
+	{Name: "patient_id"}, {Name: "study_code"}, {Name: "last_name"}, {Name: "given_names"}, {Name: "dob"}, {Name: "phone"}, {Name: "site_id"},
+}
+
+func TestFHIRResource(t *testing.T) {
+	elems, err := fhirElements(&testPatientMapping, testPatientSchema)
+	if err != nil {
+		t.Fatalf("fhirElements() error = %v", err)
+	}
+	tests := []struct {
+		name string
+		row  []bigquery.Value
+		want string
+	}{
+		{
+			"full",
+			[]bigquery.Value{"p1", "A-001", "Nguyen", []bigquery.Value{"Van", nil, "An"}, civil.Date{Year: 1990, Month: 5, Day: 2}, "+84 1", int64(7)},
+			`{"resourceType":"Patient","birthDate":"1990-05-02","id":"p1","identifier":[{"system":"https://example.org/study-a","value":"A-001"}],` +
+				`"managingOrganization":{"reference":"Organization/7"},"name":[{"family":"Nguyen","given":["Van","An"]}],"telecom":[{"value":"+84 1"}]}`,
+		},
+		{
+			"nulls",
+			[]bigquery.Value{"p2", nil, "", []bigquery.Value{}, nil, nil, nil},
+			`{"resourceType":"Patient","id":"p2","identifier":[{"system":"https://example.org/study-a"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := fhirResource("Patient", elems, tt.row)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: fhirResource() = %s, %v\nwant %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := fhirElements(&testPatientMapping, testPatientSchema[:6]); err == nil || !strings.Contains(err.Error(), "site_id") {
+		t.Errorf("fhirElements() without site_id error = %v", err)
+	}
+}
+
+func TestExportFHIR(t *testing.T) {
+	defer func(n int) { fhirFileResources = n }(fhirFileResources)
+	fhirFileResources = 2
+
+	gcs := newFakeGCS(t)
+	row := []bigquery.Value{"p1", "A-001", "Nguyen", nil, nil, nil, "s1"}
+	bq := &fakeBigQuery{schema: testPatientSchema, rows: [][]bigquery.Value{row, row, row}}
+	cfg := &config.Config{FHIRMappings: map[string]config.FHIRMapping{"patient": testPatientMapping}}
+	e := NewExporter(bq, NewGCSDriver(gcs.service(t), nil), cfg)
+	res, err := e.Run(context.Background(), ExportParams{
+		Query: "SELECT * FROM ds.patients", QueryLocation: "US", Output: "gs://b/fhir/", Filename: "Patient",
+		Format: FormatFHIR, FHIRMapping: "patient",
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if res.GCSPath != "gs://b/fhir/Patient-*.ndjson" || res.Rows != 3 {
+		t.Errorf("Run() = %+v", res)
+	}
+	gcs.mu.Lock()
+	if got := strings.Join(gcs.names(), " "); got != "fhir/Patient-000000000000.ndjson fhir/Patient-000000000001.ndjson" {
+		t.Errorf("objects = %s", got)
+	}
+	first, second := string(gcs.objects["fhir/Patient-000000000000.ndjson"]), string(gcs.objects["fhir/Patient-000000000001.ndjson"])
+	gcs.mu.Unlock()
+	if strings.Count(first, "\n") != 2 || strings.Count(second, "\n") != 1 || !strings.HasPrefix(second, `{"resourceType":"Patient","id":"p1",`) {
+		t.Errorf("files = %q, %q", first, second)
+	}
+
+	// An empty result writes no resources
+	empty := NewExporter(&fakeBigQuery{schema: testPatientSchema}, NewGCSDriver(gcs.service(t), nil), cfg)
+	if res, err := empty.Run(context.Background(), ExportParams{
+		Query: "SELECT * FROM ds.patients", QueryLocation: "US", Output: "gs://b/empty/", Filename: "Patient",
+		Format: FormatFHIR, FHIRMapping: "patient",
+	}); err != nil || res.Rows != 0 {
+		t.Errorf("Run() of an empty result = %+v, %v", res, err)
+	}
+
+	for _, bad := range []ExportParams{
+		{Format: FormatFHIR},
+		{Format: FormatFHIR, FHIRMapping: "visit"},
+		{FHIRMapping: "patient"},
+		{Format: FormatFHIR, FHIRMapping: "patient", SchemaFile: true},
+	} {
+		bad.Query, bad.QueryLocation, bad.Output = "SELECT 1", "US", "gs://b/fhir/"
+		if _, err := e.Run(context.Background(), bad); FailureClass(err) != FailureConfig {
+			t.Errorf("Run(%+v) error = %v, want a config error", bad, err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// firestoreDriverName is the EXPORT_DRIVER value of FirestoreDriver.
+const firestoreDriverName = "FIRESTORE"
+
+// firestoreBatchWrites is the most writes Firestore commits at once.
+const firestoreBatchWrites = 500
+
+// reservedDocumentID matches the document IDs Firestore reserves.
+var reservedDocumentID = regexp.MustCompile(`^__.*__$`)
+
+// FirestoreService writes documents to one Firestore database.
+type FirestoreService struct {
+	client *firestore.Client
+}
+
+// NewFirestoreService connects to the database of project ("" or "(default)" for the
+// default database).
+func NewFirestoreService(ctx context.Context, project, database string, opts ...option.ClientOption) (*FirestoreService, error) {
+	var (
+		client *firestore.Client
+		err    error
+	)
+	if database == "" || database == firestore.DefaultDatabaseID {
+		client, err = firestore.NewClient(ctx, project, opts...)
+	} else {
+		client, err = firestore.NewClientWithDatabase(ctx, project, database, opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Firestore client: %w", err)
+	}
+	return &FirestoreService{client: client}, nil
+}
+
+func (s *FirestoreService) Close() error {
+	return s.client.Close()
+}
+
+// FirestoreDriver writes every result row as a document of the collection named by the
+// table option, with the value of the single key column as document ID. Documents are
+// replaced, or with write_mode merge only their exported fields updated; documents of
+// keys missing from the result are kept. Writes are committed 500 at a time, each
+// commit atomic, so a failed export may leave the commits before it.
+type FirestoreDriver struct {
+	fs *FirestoreService
+}
+
+func NewFirestoreDriver(fs *FirestoreService) *FirestoreDriver {
+	return &FirestoreDriver{fs: fs}
+}
+
+func (d *FirestoreDriver) Name() string {
+	return firestoreDriverName
+}
+
+func (d *FirestoreDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{ReadsRows: true}
+}
+
+// firestoreTarget returns the collection path, key column and merge mode of an export.
+func firestoreTarget(params ExportParams) (string, string, bool, error) {
+	collection := strings.Trim(cmp.Or(params.Table, params.Name), "/")
+	if collection == "" {
+		return "", "", false, fmt.Errorf("the %s driver needs table, the collection to write to", firestoreDriverName)
+	}
+	// Collections are the odd segments of a path: visits, or sites/a/visits
+	if strings.Count(collection, "/")%2 != 0 {
+		return "", "", false, fmt.Errorf("invalid collection %q; expected a collection path such as visits or sites/site_a/visits", collection)
+	}
+	if len(params.KeyColumns) != 1 {
+		return "", "", false, fmt.Errorf("the %s driver needs key_columns with one column, the document ID", firestoreDriverName)
+	}
+	var merge bool
+	switch strings.ToLower(params.WriteMode) {
+	case "", WriteModeReplace:
+	case WriteModeMerge:
+		merge = true
+	default:
+		return "", "", false, fmt.Errorf("unknown write_mode %q for the %s driver; expected replace or merge", params.WriteMode, firestoreDriverName)
+	}
+	return collection, params.KeyColumns[0], merge, nil
+}
+
+func (d *FirestoreDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	collection, key, merge, err := firestoreTarget(params)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if d.fs == nil {
+		return ExportResult{}, ConfigError(fmt.Errorf("the %s driver needs a Firestore client", firestoreDriverName))
+	}
+	slog.InfoContext(ctx, "Starting Firestore export", "collection", collection, "key_column", key, "merge", merge)
+	it, err := bq.ReadRows(ctx, params.Query, params.QueryLocation)
+	if err != nil {
+		return ExportResult{Table: collection}, fmt.Errorf("export to Firestore failed: %w", err)
+	}
+	defer it.Close()
+	if it, err = transformRows(ctx, it, params.transformers); err != nil {
+		return ExportResult{Table: collection}, err
+	}
+
+	res := ExportResult{Table: collection}
+	coll := d.fs.client.Collection(collection)
+	keyIndex := -1
+	var docs []firestoreDocument
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			res.Job = it.Job()
+			return res, fmt.Errorf("export to Firestore failed: %w", err)
+		}
+		schema := it.Schema()
+		if keyIndex < 0 {
+			if keyIndex = schemaIndex(schema, key); keyIndex < 0 {
+				return res, ConfigError(fmt.Errorf("key column %q is not a column of the result", key))
+			}
+		}
+		id, err := documentID(row[keyIndex])
+		if err != nil {
+			res.Job = it.Job()
+			return res, DataError(fmt.Errorf("row %d: %w", res.Rows+int64(len(docs))+1, err))
+		}
+		data := make(map[string]any, len(row))
+		for i, v := range row[:min(len(row), len(schema))] {
+			data[schema[i].Name] = firestoreValue(schema[i], v)
+		}
+		docs = append(docs, firestoreDocument{ref: coll.Doc(id), data: data})
+		if len(docs) == firestoreBatchWrites {
+			if err := d.commit(ctx, docs, merge); err != nil {
+				res.Job = it.Job()
+				return res, err
+			}
+			res.Rows += int64(len(docs))
+			docs = docs[:0]
+		}
+	}
+	res.Job = it.Job()
+	if err := d.commit(ctx, docs, merge); err != nil {
+		return res, err
+	}
+	res.Rows += int64(len(docs))
+	slog.InfoContext(ctx, "Firestore export completed", "collection", collection, "documents", res.Rows)
+	return res, nil
+}
+
+type firestoreDocument struct {
+	ref  *firestore.DocumentRef
+	data map[string]any
+}
+
+// commit writes docs in one transaction, which Firestore retries when it is contended.
+func (d *FirestoreDriver) commit(ctx context.Context, docs []firestoreDocument, merge bool) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	err := d.fs.client.RunTransaction(ctx, func(_ context.Context, tx *firestore.Transaction) error {
+		for _, doc := range docs {
+			var opts []firestore.SetOption
+			if merge {
+				opts = append(opts, firestore.MergeAll)
+			}
+			if err := tx.Set(doc.ref, doc.data, opts...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %d documents to Firestore: %w", len(docs), err)
+	}
+	return nil
+}
+
+// schemaIndex returns the index of the column name in schema, or -1.
+func schemaIndex(schema bigquery.Schema, name string) int {
+	for i, f := range schema {
+		if strings.EqualFold(f.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// documentID returns the document ID of a key value, rejecting those Firestore does not
+// accept.
+func documentID(v bigquery.Value) (string, error) {
+	var id string
+	switch v := v.(type) {
+	case nil:
+		return "", fmt.Errorf("key column is NULL")
+	case string:
+		id = v
+	case int64:
+		id = strconv.FormatInt(v, 10)
+	default:
+		id = fmt.Sprint(downloadJSONValue(v))
+	}
+	switch {
+	case id == "", id == ".", id == "..", strings.Contains(id, "/"), reservedDocumentID.MatchString(id):
+		return "", fmt.Errorf("invalid document ID %q", id)
+	case len(id) > 1500:
+		return "", fmt.Errorf("document ID of %d bytes is longer than 1500", len(id))
+	}
+	return id, nil
+}
+
+// firestoreValue converts a BigQuery value of field into a Firestore value: records
+// become maps, NUMERIC and BIGNUMERIC exact strings and dates and times strings;
+// timestamps stay timestamps.
+func firestoreValue(field *bigquery.FieldSchema, v bigquery.Value) any {
+	switch v := v.(type) {
+	case []bigquery.Value:
+		if field.Repeated {
+			elem := *field
+			elem.Repeated = false
+			out := make([]any, len(v))
+			for i, e := range v {
+				out[i] = firestoreValue(&elem, e)
+			}
+			return out
+		}
+		out := make(map[string]any, len(v))
+		for i, e := range v[:min(len(v), len(field.Schema))] {
+			out[field.Schema[i].Name] = firestoreValue(field.Schema[i], e)
+		}
+		return out
+	case map[string]bigquery.Value:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = downloadJSONValue(e)
+		}
+		return out
+	case *big.Rat:
+		return downloadJSONValue(v).(json.Number).String()
+	case civil.Date, civil.DateTime, civil.Time:
+		return fmt.Sprint(v)
+	}
+	return v
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeFirestore records the writes of committed transactions.
+type fakeFirestore struct {
+	pb.UnimplementedFirestoreServer
+	mu      sync.Mutex
+	commits [][]*pb.Write
+}
+
+func (f *fakeFirestore) BeginTransaction(context.Context, *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	return &pb.BeginTransactionResponse{Transaction: []byte("tx")}, nil
+}
+
+func (f *fakeFirestore) Commit(_ context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commits = append(f.commits, req.Writes)
+	results := make([]*pb.WriteResult, len(req.Writes))
+	for i := range results {
+		results[i] = &pb.WriteResult{UpdateTime: timestamppb.Now()}
+	}
+	return &pb.CommitResponse{WriteResults: results, CommitTime: timestamppb.Now()}, nil
+}
+
+// newFakeFirestore serves the fake as the Firestore emulator.
+func newFakeFirestore(t *testing.T) (*fakeFirestore, *FirestoreService) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFirestore{}
+	srv := grpc.NewServer()
+	pb.RegisterFirestoreServer(srv, f)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	t.Setenv("FIRESTORE_EMULATOR_HOST", l.Addr().String())
+	fs, err := NewFirestoreService(context.Background(), "test-project", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return f, fs
+}
+
+func TestFirestoreDriver(t *testing.T) {
+	f, fs := newFakeFirestore(t)
+	d := NewFirestoreDriver(fs)
+	schema := bigquery.Schema{
+		{Name: "site_id", Type: bigquery.StringFieldType},
+		{Name: "beds", Type: bigquery.NumericFieldType},
+		{Name: "opened", Type: bigquery.DateFieldType},
+	}
+	var rows [][]bigquery.Value
+	for i := range firestoreBatchWrites + 1 {
+		rows = append(rows, []bigquery.Value{"site" + strconv.Itoa(i), big.NewRat(5, 2), civil.Date{Year: 2024, Month: 1, Day: 2}})
+	}
+	bq := &fakeBigQuery{schema: schema, rows: rows}
+	params := ExportParams{Query: "SELECT 1", Table: "sites", KeyColumns: []string{"site_id"}}
+	res, err := d.Execute(context.Background(), bq, params)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.Rows != int64(len(rows)) || res.Table != "sites" {
+		t.Errorf("Execute() = %d rows to %s, want %d to sites", res.Rows, res.Table, len(rows))
+	}
+	if len(f.commits) != 2 || len(f.commits[0]) != firestoreBatchWrites || len(f.commits[1]) != 1 {
+		t.Fatalf("commits = %d, want one of %d writes and one of 1", len(f.commits), firestoreBatchWrites)
+	}
+	w := f.commits[0][0]
+	doc := w.GetUpdate()
+	if !strings.HasSuffix(doc.GetName(), "/documents/sites/"+rows[0][0].(string)) {
+		t.Errorf("document = %s, want the key as ID", doc.GetName())
+	}
+	if got := doc.Fields["beds"].GetStringValue(); got != "2.5" {
+		t.Errorf("beds = %v, want the exact NUMERIC as a string", doc.Fields["beds"])
+	}
+	if got := doc.Fields["opened"].GetStringValue(); got != "2024-01-02" {
+		t.Errorf("opened = %v, want the date as a string", doc.Fields["opened"])
+	}
+	if w.UpdateMask != nil {
+		t.Errorf("update mask = %v, want documents replaced", w.UpdateMask)
+	}
+
+	f.commits = nil
+	params.WriteMode = WriteModeMerge
+	bq.rows = rows[:1]
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() merge error = %v", err)
+	}
+	if len(f.commits) != 1 || len(f.commits[0][0].GetUpdateMask().GetFieldPaths()) != 3 {
+		t.Errorf("commits = %v, want a merge of the exported fields", f.commits)
+	}
+
+	bq.rows = [][]bigquery.Value{{"a/b", nil, nil}}
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData {
+		t.Errorf("Execute() with a key containing / error = %v, want a data error", err)
+	}
+	params.KeyColumns = nil
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureConfig {
+		t.Errorf("Execute() without key_columns error = %v, want a config error", err)
+	}
+}
+
+func TestFirestoreTarget(t *testing.T) {
+	keys := []string{"id"}
+	for _, tt := range []struct {
+		table string
+		ok    bool
+	}{{"visits", true}, {"sites/a/visits", true}, {"/visits/", true}, {"sites/a", false}, {"", false}} {
+		_, _, _, err := firestoreTarget(ExportParams{Table: tt.table, KeyColumns: keys})
+		if (err == nil) != tt.ok {
+			t.Errorf("firestoreTarget(%q) error = %v, want ok %v", tt.table, err, tt.ok)
+		}
+	}
+}
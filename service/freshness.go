@@ -0,0 +1,152 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FreshnessState is the freshness SLO status of one pipeline.
+type FreshnessState struct {
+	Pipeline  string `json:"pipeline"`
+	Tenant    string `json:"tenant,omitempty"`
+	Freshness string `json:"freshness"`
+	// LastSuccess is the end of the last successful run seen by this instance
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// Deadline is when the pipeline becomes stale without another successful run
+	Deadline   time.Time  `json:"deadline"`
+	Stale      bool       `json:"stale"`
+	StaleSince *time.Time `json:"stale_since,omitempty"`
+}
+
+func (st FreshnessState) describe() string {
+	if st.LastSuccess == nil {
+		return fmt.Sprintf("no successful run within the freshness SLO of %s", st.Freshness)
+	}
+	return fmt.Sprintf("no successful run within the freshness SLO of %s; last success at %s", st.Freshness, st.LastSuccess.Format(time.RFC3339))
+}
+
+// FreshnessMonitor checks the pipelines declaring a freshness SLO: a pipeline is stale
+// when no run of it succeeded for longer than its freshness. Each breach is logged and
+// sent once to the pipeline's webhooks (status "stale") and counted in the metrics; the
+// next successful run clears it. The state is per instance: successes are taken from
+// this instance's job history, and the SLO counts from the monitor's start for pipelines
+// without one, so a restart never reports a breach before a full freshness period has
+// passed.
+type FreshnessMonitor struct {
+	e       *Exporter
+	started time.Time
+
+	mu    sync.Mutex
+	state map[string]*FreshnessState
+}
+
+func NewFreshnessMonitor(e *Exporter) *FreshnessMonitor {
+	return &FreshnessMonitor{e: e, started: time.Now().UTC(), state: map[string]*FreshnessState{}}
+}
+
+// Run checks the pipelines every minute until ctx is cancelled.
+func (m *FreshnessMonitor) Run(ctx context.Context) {
+	slog.InfoContext(ctx, "Freshness monitor started")
+	for {
+		m.check(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// check updates every pipeline's state at now and reports new breaches.
+func (m *FreshnessMonitor) check(ctx context.Context, now time.Time) {
+	now = now.UTC()
+	success := m.lastSuccesses()
+	for _, name := range m.e.Pipelines.Names() {
+		p, ok := m.e.Pipelines.Get(name)
+		if !ok {
+			continue
+		}
+		slo, err := p.FreshnessSLO()
+		if err != nil || slo == 0 || p.PendingApproval {
+			m.mu.Lock()
+			delete(m.state, name)
+			m.mu.Unlock()
+			m.e.Metrics.remove("bq_exporter_pipeline_stale", "pipeline", name)
+			continue
+		}
+
+		m.mu.Lock()
+		st, ok := m.state[name]
+		if !ok {
+			st = &FreshnessState{Pipeline: name}
+			m.state[name] = st
+		}
+		st.Tenant, st.Freshness = p.Tenant, p.Freshness
+		// Job history is bounded, so a success that was evicted is remembered here
+		if t, ok := success[name]; ok && (st.LastSuccess == nil || t.After(*st.LastSuccess)) {
+			st.LastSuccess = &t
+		}
+		from := m.started
+		if st.LastSuccess != nil {
+			from = *st.LastSuccess
+		}
+		st.Deadline = from.Add(slo)
+		breached := now.After(st.Deadline) && !st.Stale
+		switch {
+		case breached:
+			st.Stale, st.StaleSince = true, &now
+		case !now.After(st.Deadline):
+			st.Stale, st.StaleSince = false, nil
+		}
+		report := *st
+		m.mu.Unlock()
+
+		stale := 0.0
+		if report.Stale {
+			stale = 1
+		}
+		m.e.Metrics.set("bq_exporter_pipeline_stale", stale, "pipeline", name)
+		if breached {
+			m.e.Metrics.add("bq_exporter_freshness_breaches_total", 1, "pipeline", name)
+			slog.WarnContext(ctx, "Pipeline freshness SLO breached", "pipeline", name, "tenant", p.Tenant,
+				"freshness", p.Freshness, "last_success", report.LastSuccess, "deadline", report.Deadline)
+			m.e.Notifier.NotifyStale(logging.WithRequestID(ctx, logging.NewRequestID()), name, p.Notify, m.e.Driver.Name(), report)
+		}
+	}
+}
+
+// lastSuccesses returns the end of the latest successful run of every pipeline in the
+// job history.
+func (m *FreshnessMonitor) lastSuccesses() map[string]time.Time {
+	out := map[string]time.Time{}
+	// The unscoped context sees every tenant's runs
+	for _, r := range m.e.Jobs.List(context.Background()) {
+		if r.Pipeline == "" || r.Status != JobSucceeded || r.FinishedAt == nil {
+			continue
+		}
+		if t, ok := out[r.Pipeline]; !ok || r.FinishedAt.After(t) {
+			out[r.Pipeline] = *r.FinishedAt
+		}
+	}
+	return out
+}
+
+// List returns the freshness state of the pipelines visible to the caller in ctx, by
+// pipeline name.
+func (m *FreshnessMonitor) List(ctx context.Context) []FreshnessState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []FreshnessState{}
+	for name, st := range m.state {
+		if p, ok := m.e.Pipelines.Get(name); ok && PipelineVisible(ctx, p) {
+			out = append(out, *st)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Pipeline < out[j].Pipeline })
+	return out
+}
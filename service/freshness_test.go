@@ -0,0 +1,90 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFreshnessMonitor(t *testing.T) {
+	var mu sync.Mutex
+	var events []PipelineEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev PipelineEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("invalid event: %v", err)
+		}
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{Pipelines: map[string]config.Pipeline{
+		"daily": {Query: "SELECT 1", Freshness: "24h", Notify: config.Notify{Webhooks: []string{srv.URL}}},
+		"adhoc": {Query: "SELECT 2"},
+	}}
+	e := NewExporter(&fakeBigQuery{}, NewGCSDriver(nil, nil), cfg)
+	m := NewFreshnessMonitor(e)
+	ctx := context.Background()
+	start := m.started
+
+	m.check(ctx, start.Add(time.Hour))
+	states := m.List(ctx)
+	if len(states) != 1 || states[0].Stale || !states[0].Deadline.Equal(start.Add(24*time.Hour)) {
+		t.Fatalf("states within the SLO = %+v", states)
+	}
+
+	m.check(ctx, start.Add(25*time.Hour))
+	m.check(ctx, start.Add(26*time.Hour))
+	mu.Lock()
+	if len(events) != 1 || events[0].Status != "stale" || events[0].Pipeline != "daily" || events[0].Freshness != "24h" {
+		t.Errorf("events after the breach = %+v, want one stale event", events)
+	}
+	mu.Unlock()
+	if st := m.List(ctx)[0]; !st.Stale || st.StaleSince == nil {
+		t.Errorf("state after the breach = %+v, want stale", st)
+	}
+	assertMetrics(t, e.Metrics, `bq_exporter_pipeline_stale{pipeline="daily"} 1`, `bq_exporter_freshness_breaches_total{pipeline="daily"} 1`)
+
+	rec, _ := e.Jobs.start(ctx, "GCS_PARQUET", ExportParams{Pipeline: "daily"}, "")
+	e.Jobs.finish(rec, ExportResult{}, nil)
+	m.check(ctx, time.Now().Add(time.Minute))
+	if st := m.List(ctx)[0]; st.Stale || st.LastSuccess == nil {
+		t.Errorf("state after a success = %+v, want fresh", st)
+	}
+	assertMetrics(t, e.Metrics, `bq_exporter_pipeline_stale{pipeline="daily"} 0`, `bq_exporter_freshness_breaches_total{pipeline="daily"} 1`)
+
+	// A pipeline that no longer declares an SLO has no gauge
+	p, _ := e.Pipelines.Get("daily")
+	p.Freshness = ""
+	if err := e.Pipelines.Put("daily", p); err != nil {
+		t.Fatal(err)
+	}
+	m.check(ctx, time.Now())
+	var out strings.Builder
+	e.Metrics.WriteTo(&out)
+	if strings.Contains(out.String(), "bq_exporter_pipeline_stale{") {
+		t.Errorf("metrics after the SLO was removed = %s", out.String())
+	}
+}
+
+// assertMetrics checks that m serves the series lines want.
+func assertMetrics(t *testing.T, m *Metrics, want ...string) {
+	t.Helper()
+	var out strings.Builder
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range want {
+		if !strings.Contains(out.String(), w+"\n") {
+			t.Errorf("metrics missing %q:\n%s", w, out.String())
+		}
+	}
+}
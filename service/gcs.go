@@ -0,0 +1,483 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// GCSService wraps the Cloud Storage JSON API for the object handling the drivers
+// need around EXPORT DATA (staging, copying, listing).
+type GCSService struct {
+	svc  *storage.Service
+	opts []option.ClientOption
+	// AutoCreate, if set, creates missing output buckets (see CheckBucket)
+	AutoCreate *BucketCreation
+
+	mu sync.Mutex
+	// impersonated are the clients acting as the service accounts buckets are checked for
+	impersonated map[string]*storage.Service
+}
+
+// ErrBucketUnusable is returned, before anything is exported, for output buckets that do
+// not exist, the service cannot write to, or EXPORT DATA cannot reach.
+var ErrBucketUnusable = errors.New("output bucket unusable")
+
+// BucketCreation configures the output buckets created on first use: in Project, in
+// Location (default: the query location, as EXPORT DATA requires) and with StorageClass
+// (default: Cloud Storage's, STANDARD).
+type BucketCreation struct {
+	Project      string
+	Location     string
+	StorageClass string
+}
+
+// BucketCreationFromEnv reads GCS_CREATE_BUCKETS (creation is disabled unless true),
+// GCS_BUCKET_LOCATION and GCS_BUCKET_STORAGE_CLASS; buckets are created in project.
+func BucketCreationFromEnv(project string) *BucketCreation {
+	if create, _ := strconv.ParseBool(os.Getenv("GCS_CREATE_BUCKETS")); !create {
+		return nil
+	}
+	return &BucketCreation{Project: project, Location: os.Getenv("GCS_BUCKET_LOCATION"), StorageClass: strings.ToUpper(os.Getenv("GCS_BUCKET_STORAGE_CLASS"))}
+}
+
+// NewGCSService creates the Cloud Storage client; opts carry explicitly configured
+// credentials, if any.
+func NewGCSService(ctx context.Context, opts ...option.ClientOption) (*GCSService, error) {
+	svc, err := storage.NewService(ctx, append([]option.ClientOption{option.WithScopes(storage.DevstorageReadWriteScope)}, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Storage client: %w", err)
+	}
+	return &GCSService{svc: svc, opts: opts}, nil
+}
+
+// impersonate returns the Cloud Storage client acting as serviceAccount, minting tokens
+// with the service credentials like Impersonator. Clients are kept for the life of the
+// process.
+func (g *GCSService) impersonate(ctx context.Context, serviceAccount string) (*storage.Service, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if svc, ok := g.impersonated[serviceAccount]; ok {
+		return svc, nil
+	}
+	// Token sources and clients outlive the request that created them
+	ts, err := impersonate.CredentialsTokenSource(context.Background(), impersonate.CredentialsConfig{
+		TargetPrincipal: serviceAccount,
+		Scopes:          []string{storage.DevstorageReadWriteScope},
+	}, g.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", serviceAccount, err)
+	}
+	svc, err := storage.NewService(context.Background(), option.WithTokenSource(ts))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Storage client: %w", err)
+	}
+	if g.impersonated == nil {
+		g.impersonated = map[string]*storage.Service{}
+	}
+	g.impersonated[serviceAccount] = svc
+	return svc, nil
+}
+
+// parseGCSURI splits "gs://bucket/path/to/object" into bucket and object name.
+func parseGCSURI(uri string) (string, string, error) {
+	rest, ok := strings.CutPrefix(uri, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("not a gs:// URI: %q", uri)
+	}
+	bucket, object, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("missing bucket in %q", uri)
+	}
+	return bucket, object, nil
+}
+
+// PatternSize returns the number and total size of the objects matching pattern, a gs://
+// file or wildcard pattern.
+func (g *GCSService) PatternSize(ctx context.Context, pattern string) (files, size int64, err error) {
+	bucket, name, err := parseGCSURI(pattern)
+	if err != nil {
+		return 0, 0, err
+	}
+	prefix, _, _ := strings.Cut(name, "*")
+	objs, err := g.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, o := range objs {
+		if ok, _ := path.Match(name, o.Name); ok {
+			files++
+			size += int64(o.Size)
+		}
+	}
+	return files, size, nil
+}
+
+// ListObjects returns all objects in bucket whose name starts with prefix.
+func (g *GCSService) ListObjects(ctx context.Context, bucket, prefix string) ([]*storage.Object, error) {
+	var out []*storage.Object
+	err := g.svc.Objects.List(bucket).Prefix(prefix).Pages(ctx, func(objs *storage.Objects) error {
+		out = append(out, objs.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list gs://%s/%s: %w", bucket, prefix, err)
+	}
+	return out, nil
+}
+
+// OpenObject starts reading gs://bucket/name.
+func (g *GCSService) OpenObject(ctx context.Context, bucket, name string) (io.ReadCloser, error) {
+	resp, err := g.svc.Objects.Get(bucket, name).Context(ctx).Download()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gs://%s/%s: %w", bucket, name, err)
+	}
+	return resp.Body, nil
+}
+
+// CopyPrefix copies every object under srcPrefix in srcBucket to dstPrefix in dstBucket
+// using server-side rewrites (which work across locations), and returns the number of
+// objects copied.
+func (g *GCSService) CopyPrefix(ctx context.Context, srcBucket, srcPrefix, dstBucket, dstPrefix string) (int, error) {
+	objs, err := g.ListObjects(ctx, srcBucket, srcPrefix)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range objs {
+		dstName := dstPrefix + strings.TrimPrefix(o.Name, srcPrefix)
+		token := ""
+		for {
+			call := g.svc.Objects.Rewrite(srcBucket, o.Name, dstBucket, dstName, &storage.Object{}).Context(ctx)
+			if token != "" {
+				call = call.RewriteToken(token)
+			}
+			res, err := call.Do()
+			if err != nil {
+				return 0, fmt.Errorf("failed to copy gs://%s/%s to gs://%s/%s: %w", srcBucket, o.Name, dstBucket, dstName, err)
+			}
+			if res.Done {
+				break
+			}
+			token = res.RewriteToken
+		}
+	}
+	slog.InfoContext(ctx, "Copied staged objects", "source", "gs://"+srcBucket+"/"+srcPrefix,
+		"destination", "gs://"+dstBucket+"/"+dstPrefix, "objects", len(objs))
+	return len(objs), nil
+}
+
+// WriteObject uploads data as the object gs://bucket/name, replacing it if it exists.
+func (g *GCSService) WriteObject(ctx context.Context, bucket, name, contentType string, data []byte) error {
+	_, err := g.svc.Objects.Insert(bucket, &storage.Object{Name: name, ContentType: contentType}).
+		Media(bytes.NewReader(data)).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to write gs://%s/%s: %w", bucket, name, err)
+	}
+	return nil
+}
+
+// ObjectWriter streams the data written to it into a Cloud Storage object (see
+// NewObjectWriter).
+type ObjectWriter struct {
+	pw      *io.PipeWriter
+	done    chan error
+	once    sync.Once
+	err     error
+	label   string
+	written int64
+}
+
+// NewObjectWriter starts an upload of gs://bucket/name fed by the returned writer. The
+// object is created (or replaced) only when Close completes the upload; Abort drops it.
+func (g *GCSService) NewObjectWriter(ctx context.Context, bucket, name, contentType string) *ObjectWriter {
+	pr, pw := io.Pipe()
+	w := &ObjectWriter{pw: pw, done: make(chan error, 1), label: "gs://" + bucket + "/" + name}
+	go func() {
+		_, err := g.svc.Objects.Insert(bucket, &storage.Object{Name: name, ContentType: contentType}).
+			Media(pr).Context(ctx).Do()
+		if err != nil {
+			err = fmt.Errorf("failed to write %s: %w", w.label, err)
+		}
+		// Unblocks writes to an upload that failed early
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+func (w *ObjectWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write %s: %w", w.label, err)
+	}
+	return n, nil
+}
+
+// Close completes the upload and returns its error; further calls return the same error.
+func (w *ObjectWriter) Close() error {
+	w.once.Do(func() {
+		w.pw.Close()
+		w.err = <-w.done
+	})
+	return w.err
+}
+
+// Written returns the bytes written to the object so far.
+func (w *ObjectWriter) Written() int64 {
+	return w.written
+}
+
+// Abort cancels an unfinished upload, so the object is not written.
+func (w *ObjectWriter) Abort(cause error) {
+	w.once.Do(func() {
+		w.pw.CloseWithError(cause)
+		<-w.done
+		w.err = cause
+	})
+}
+
+// PrependToPrefix rewrites every object under srcPrefix in bucket as the object named
+// without the prefix, starting with data: it composes an object holding data with each
+// of them, then deletes the sources. It returns the number of objects written.
+func (g *GCSService) PrependToPrefix(ctx context.Context, bucket, srcPrefix, contentType string, data []byte) (int, error) {
+	objs, err := g.ListObjects(ctx, bucket, srcPrefix)
+	if err != nil {
+		return 0, err
+	}
+	head := strings.TrimSuffix(srcPrefix, "/") + ".head"
+	if err := g.WriteObject(ctx, bucket, head, contentType, data); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := g.svc.Objects.Delete(bucket, head).Context(context.WithoutCancel(ctx)).Do(); err != nil {
+			slog.WarnContext(ctx, "Failed to delete composed file head", "object", "gs://"+bucket+"/"+head, "error", err)
+		}
+	}()
+	for _, o := range objs {
+		dstName := strings.TrimPrefix(o.Name, srcPrefix)
+		req := &storage.ComposeRequest{
+			SourceObjects: []*storage.ComposeRequestSourceObjects{{Name: head}, {Name: o.Name}},
+			Destination:   &storage.Object{ContentType: contentType},
+		}
+		if _, err := g.svc.Objects.Compose(bucket, dstName, req).Context(ctx).Do(); err != nil {
+			return 0, fmt.Errorf("failed to compose gs://%s/%s: %w", bucket, dstName, err)
+		}
+	}
+	if err := g.DeletePrefix(ctx, bucket, srcPrefix); err != nil {
+		slog.WarnContext(ctx, "Failed to clean up composed sources", "prefix", "gs://"+bucket+"/"+srcPrefix, "error", err)
+	}
+	return len(objs), nil
+}
+
+// StagingBuckets maps BigQuery locations (lower-cased) to staging buckets; the ""
+// entry is the fallback for any location.
+type StagingBuckets map[string]string
+
+// ParseStagingBuckets parses GCS_STAGING_BUCKETS: either a single bucket used for
+// every location ("gs://staging") or a comma-separated list of location=bucket pairs
+// ("US=gs://stage-us,asia-southeast2=gs://stage-jkt").
+func ParseStagingBuckets(v string) StagingBuckets {
+	out := StagingBuckets{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		loc, bucket, ok := strings.Cut(part, "=")
+		if !ok {
+			loc, bucket = "", part
+		}
+		bucket = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(bucket), "gs://"), "/")
+		out[strings.ToLower(strings.TrimSpace(loc))] = bucket
+	}
+	return out
+}
+
+// stagingPrefix is the object prefix a run stages its files under, keyed by the
+// request's correlation ID so staged files can be traced back to the run.
+func stagingPrefix(ctx context.Context) string {
+	return runPrefix(ctx, "bq-exporter-staging")
+}
+
+// runPrefix is the object prefix of a run under root (see stagingPrefix).
+func runPrefix(ctx context.Context, root string) string {
+	runID := logging.RequestID(ctx)
+	if runID == "" {
+		runID = time.Now().Format("20060102-150405.000000")
+	}
+	return fmt.Sprintf("%s/%s/", root, runID)
+}
+
+// For returns the staging bucket name for a location, or "" if none is configured.
+func (b StagingBuckets) For(location string) string {
+	if bucket, ok := b[strings.ToLower(location)]; ok {
+		return bucket
+	}
+	return b[""]
+}
+
+// BucketLocation returns the location of a bucket as reported by Cloud Storage
+// (upper-case, e.g. "US", "ASIA-SOUTHEAST2").
+func (g *GCSService) BucketLocation(ctx context.Context, bucket string) (string, error) {
+	b, err := g.svc.Buckets.Get(bucket).Fields("location").Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to read bucket gs://%s: %w", bucket, err)
+	}
+	return strings.ToUpper(b.Location), nil
+}
+
+// CheckBucket checks that bucket exists and that the service may create objects in it,
+// and returns its location ("" when its metadata cannot be read). A missing bucket is
+// an ErrBucketUnusable error, unless AutoCreate is set: it is then created in location
+// (the query's) or the configured one, or with dryRun only reported as if it were.
+// Writing is checked for serviceAccount, the account EXPORT DATA writes as when the
+// export impersonates one, or else the service.
+func (g *GCSService) CheckBucket(ctx context.Context, bucket, location, serviceAccount string, dryRun bool) (string, error) {
+	bucketLocation, err := g.BucketLocation(ctx, bucket)
+	var ge *googleapi.Error
+	switch {
+	case err == nil:
+	case errors.As(err, &ge) && ge.Code == http.StatusNotFound:
+		if g.AutoCreate == nil {
+			return "", fmt.Errorf("%w: bucket gs://%s does not exist", ErrBucketUnusable, bucket)
+		}
+		if dryRun {
+			return strings.ToUpper(cmp.Or(g.AutoCreate.Location, location)), nil
+		}
+		return g.createBucket(ctx, bucket, location, serviceAccount)
+	default:
+		// Writing may be allowed without reading the bucket metadata
+		slog.WarnContext(ctx, "Could not check bucket location", "bucket", bucket, "error", err)
+	}
+	if err := g.checkWritable(ctx, bucket, serviceAccount); err != nil {
+		return "", err
+	}
+	return bucketLocation, nil
+}
+
+// checkWritable checks that the service, or serviceAccount if set, may create objects in
+// bucket, if Cloud Storage tells.
+func (g *GCSService) checkWritable(ctx context.Context, bucket, serviceAccount string) error {
+	svc, who := g.svc, "the service"
+	if serviceAccount != "" {
+		var err error
+		if svc, err = g.impersonate(ctx, serviceAccount); err != nil {
+			return err
+		}
+		who = serviceAccount
+	}
+	perms, err := svc.Buckets.TestIamPermissions(bucket, []string{"storage.objects.create"}).Context(ctx).Do()
+	if err != nil {
+		slog.WarnContext(ctx, "Could not check bucket permissions", "bucket", bucket, "error", err)
+		return nil
+	}
+	if !slices.Contains(perms.Permissions, "storage.objects.create") {
+		return fmt.Errorf("%w: %s cannot write to gs://%s; it needs storage.objects.create (e.g. roles/storage.objectCreator) on the bucket", ErrBucketUnusable, who, bucket)
+	}
+	return nil
+}
+
+// createBucket creates bucket as configured by AutoCreate and returns its location. The
+// buckets hold exports of clinical data: access is uniform, by IAM only, and they can
+// never be made public.
+func (g *GCSService) createBucket(ctx context.Context, bucket, location, serviceAccount string) (string, error) {
+	c := g.AutoCreate
+	b := &storage.Bucket{
+		Name:         bucket,
+		Location:     strings.ToUpper(cmp.Or(c.Location, location)),
+		StorageClass: c.StorageClass,
+		IamConfiguration: &storage.BucketIamConfiguration{
+			UniformBucketLevelAccess: &storage.BucketIamConfigurationUniformBucketLevelAccess{Enabled: true},
+			PublicAccessPrevention:   "enforced",
+		},
+	}
+	if b.Location == "" {
+		return "", fmt.Errorf("%w: bucket gs://%s does not exist and no location is known to create it in; set GCS_BUCKET_LOCATION", ErrBucketUnusable, bucket)
+	}
+	created, err := g.svc.Buckets.Insert(c.Project, b).Context(ctx).Do()
+	var ge *googleapi.Error
+	if errors.As(err, &ge) && ge.Code == http.StatusConflict {
+		// Created meanwhile, by a concurrent export or someone else
+		return b.Location, g.checkWritable(ctx, bucket, serviceAccount)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to create bucket gs://%s: %w", ErrBucketUnusable, bucket, err)
+	}
+	slog.InfoContext(ctx, "Created output bucket", "bucket", bucket, "location", created.Location, "storage_class", created.StorageClass)
+	return strings.ToUpper(created.Location), nil
+}
+
+// SetMetadata sets custom metadata keys of gs://bucket/name, keeping its other keys.
+func (g *GCSService) SetMetadata(ctx context.Context, bucket, name string, metadata map[string]string) error {
+	if _, err := g.svc.Objects.Patch(bucket, name, &storage.Object{Metadata: metadata}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to set the metadata of gs://%s/%s: %w", bucket, name, err)
+	}
+	return nil
+}
+
+// DeleteObject deletes gs://bucket/name; an object that does not exist is not an error.
+func (g *GCSService) DeleteObject(ctx context.Context, bucket, name string) error {
+	err := g.svc.Objects.Delete(bucket, name).Context(ctx).Do()
+	var ge *googleapi.Error
+	if err != nil && !(errors.As(err, &ge) && ge.Code == http.StatusNotFound) {
+		return fmt.Errorf("failed to delete gs://%s/%s: %w", bucket, name, err)
+	}
+	return nil
+}
+
+// DeletePrefix deletes every object under prefix in bucket.
+func (g *GCSService) DeletePrefix(ctx context.Context, bucket, prefix string) error {
+	objs, err := g.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if err := g.svc.Objects.Delete(bucket, o.Name).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("failed to delete gs://%s/%s: %w", bucket, o.Name, err)
+		}
+	}
+	return nil
+}
+
+// multiRegionMembers lists the bucket location prefixes and dual-regions contained in
+// each BigQuery multi-region.
+var multiRegionMembers = map[string][]string{
+	"US": {"US-", "NAM4"},
+	"EU": {"EUROPE-", "EUR4", "EUR5", "EUR7", "EUR8"},
+}
+
+// exportLocationCompatible reports whether EXPORT DATA from a query running in
+// queryLocation can write to a bucket in bucketLocation: the locations must match, or
+// the bucket must sit inside the query's multi-region.
+func exportLocationCompatible(queryLocation, bucketLocation string) bool {
+	q := strings.ToUpper(queryLocation)
+	b := strings.ToUpper(bucketLocation)
+	if q == "" || b == "" || q == b {
+		return true
+	}
+	for _, member := range multiRegionMembers[q] {
+		if strings.HasPrefix(b, member) {
+			return true
+		}
+	}
+	return false
+}
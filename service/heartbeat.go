@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// ErrJobStalled is returned when the watchdog cancelled an export that showed no activity
+// for the stall timeout.
+var ErrJobStalled = errors.New("export stalled")
+
+// HeartbeatPolicy sets how running exports report their progress and when they count as
+// stalled.
+type HeartbeatPolicy struct {
+	// Interval is how often a running export records a heartbeat; 0 disables them
+	Interval time.Duration
+	// StallTimeout is how long an export may go without activity (a statement, rows read,
+	// or a BigQuery job running) before it is marked stalled; 0 never marks exports stalled
+	StallTimeout time.Duration
+	// Cancel cancels stalled exports, and with them their BigQuery job
+	Cancel bool
+}
+
+// heartbeatPolicyFromEnv reads JOB_HEARTBEAT_INTERVAL (default 30s), JOB_STALL_TIMEOUT
+// and JOB_STALL_CANCEL.
+func heartbeatPolicyFromEnv() HeartbeatPolicy {
+	p := HeartbeatPolicy{Interval: 30 * time.Second}
+	if d, err := time.ParseDuration(os.Getenv("JOB_HEARTBEAT_INTERVAL")); err == nil && d >= 0 {
+		p.Interval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("JOB_STALL_TIMEOUT")); err == nil && d > 0 {
+		p.StallTimeout = d
+	}
+	p.Cancel, _ = strconv.ParseBool(os.Getenv("JOB_STALL_CANCEL"))
+	return p
+}
+
+// progress is the activity of one export.
+type progress struct {
+	rows atomic.Int64
+	// last is the time of the last activity, in Unix nanoseconds
+	last atomic.Int64
+}
+
+type progressKey struct{}
+
+func withProgress(ctx context.Context) (context.Context, *progress) {
+	p := &progress{}
+	p.touch()
+	return context.WithValue(ctx, progressKey{}, p), p
+}
+
+func progressFrom(ctx context.Context) *progress {
+	p, _ := ctx.Value(progressKey{}).(*progress)
+	return p
+}
+
+func (p *progress) touch() {
+	if p != nil {
+		p.last.Store(time.Now().UnixNano())
+	}
+}
+
+func (p *progress) lastActivity() time.Time {
+	return time.Unix(0, p.last.Load()).UTC()
+}
+
+// progressRows counts the rows read from it as progress.
+type progressRows struct {
+	RowIterator
+	p *progress
+}
+
+func (r *progressRows) Next(dst *[]bigquery.Value) error {
+	err := r.RowIterator.Next(dst)
+	if err == nil {
+		r.p.rows.Add(1)
+	}
+	r.p.touch()
+	return err
+}
+
+// jobStatusPoll is how often a running export waiting on a BigQuery job checks that the
+// job is still running.
+var jobStatusPoll = 10 * time.Second
+
+// touchWhileRunning counts a BigQuery job that status reports running as activity of the
+// export of ctx, checking every jobStatusPoll until the returned func stops it: a long
+// EXPORT DATA or MERGE is not stalled while BigQuery works on it.
+func touchWhileRunning(ctx context.Context, status func(context.Context) (*bigquery.JobStatus, error)) func() {
+	p := progressFrom(ctx)
+	if p == nil {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(jobStatusPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			st, err := status(ctx)
+			if err != nil {
+				slog.DebugContext(ctx, "Failed to check the BigQuery job status", "error", err)
+				continue
+			}
+			if st.State == bigquery.Running {
+				p.touch()
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// watch records heartbeats of rec until the returned func stops them and, with a stall
+// timeout, is the watchdog of the run: a run without activity for the timeout is marked
+// stalled, and cancelled with Cancel. The returned context carries the run's progress.
+func (e *Exporter) watch(ctx context.Context, rec *JobRecord) (context.Context, func()) {
+	ctx, p := withProgress(ctx)
+	h := e.Heartbeats
+	if h.Interval <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			last := p.lastActivity()
+			stalled := h.StallTimeout > 0 && time.Since(last) > h.StallTimeout
+			if !e.Jobs.heartbeat(rec, p.rows.Load(), last, stalled) {
+				continue
+			}
+			slog.WarnContext(ctx, "Export stalled", "last_activity", last, "rows_processed", p.rows.Load(), "stall_timeout", h.StallTimeout, "cancel", h.Cancel)
+			if h.Cancel {
+				cancel(ErrJobStalled)
+			}
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		<-done
+		cancel(nil)
+	}
+}
+
+// heartbeat records the progress of a run and whether it is stalled, and reports whether
+// it just stalled. Only running runs stall: a queued or deferred run is waiting, and its
+// activity is reset when it runs again.
+func (s *JobStore) heartbeat(rec *JobRecord, rows int64, last time.Time, stalled bool) bool {
+	s.mu.Lock()
+	now := time.Now().UTC()
+	rec.HeartbeatAt, rec.LastActivityAt, rec.RowsProcessed = &now, &last, rows
+	stalled = stalled && rec.Status == JobRunning
+	started := stalled && rec.StalledSince == nil
+	switch {
+	case started:
+		rec.StalledSince = &now
+	case !stalled:
+		rec.StalledSince = nil
+	}
+	job := s.snapshotLocked(rec)
+	s.mu.Unlock()
+	s.store(job)
+	return started
+}
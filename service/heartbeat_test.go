@@ -0,0 +1,107 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// hangingBigQuery is a BigQuery whose jobs never finish until cancelled.
+type hangingBigQuery struct {
+	fakeBigQuery
+}
+
+func (h *hangingBigQuery) RunQuery(ctx context.Context, sqlQuery, location string) (QueryJob, error) {
+	h.record(sqlQuery, location)
+	<-ctx.Done()
+	return QueryJob{}, ctx.Err()
+}
+
+func TestWatchdogCancelsStalledExport(t *testing.T) {
+	e := NewExporter(&hangingBigQuery{}, NewGCSDriver(nil, nil), &config.Config{})
+	e.Heartbeats = HeartbeatPolicy{Interval: 10 * time.Millisecond, StallTimeout: 50 * time.Millisecond, Cancel: true}
+	ctx := logging.WithRequestID(context.Background(), "run-1")
+	_, err := e.Run(ctx, ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/v/"})
+	if !errors.Is(err, ErrJobStalled) {
+		t.Fatalf("Run() error = %v, want ErrJobStalled", err)
+	}
+	rec, _ := e.Jobs.Get(ctx, "run-1")
+	if rec.Status != JobFailed || rec.StalledSince == nil || rec.HeartbeatAt == nil || rec.LastActivityAt == nil {
+		t.Errorf("record = %+v, want a failed run marked stalled", rec)
+	}
+}
+
+func TestHeartbeatProgress(t *testing.T) {
+	ctx, p := withProgress(context.Background())
+	bq := &meteredBigQuery{BigQueryClient: &fakeBigQuery{rows: [][]bigquery.Value{{int64(1)}, {int64(2)}}}}
+	p.last.Store(0)
+	it, err := bq.ReadRows(ctx, "SELECT 1", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var row []bigquery.Value
+	for it.Next(&row) == nil {
+	}
+	if p.rows.Load() != 2 || time.Since(p.lastActivity()) > time.Minute {
+		t.Errorf("progress = %d rows, last activity %v", p.rows.Load(), p.lastActivity())
+	}
+
+	// Only running runs stall, once until they show activity again
+	s := NewJobStore(0)
+	rec, _ := s.start(logging.WithRequestID(context.Background(), "run-1"), "GCS_PARQUET", ExportParams{}, "")
+	last := time.Now().Add(-time.Hour)
+	if !s.heartbeat(rec, 2, last, true) || rec.RowsProcessed != 2 || rec.StalledSince == nil {
+		t.Errorf("heartbeat() of a stalled run = %+v", rec)
+	}
+	if s.heartbeat(rec, 2, last, true) {
+		t.Error("heartbeat() reported a stalled run again")
+	}
+	if s.heartbeat(rec, 3, time.Now(), false); rec.StalledSince != nil {
+		t.Error("heartbeat() with activity kept the run stalled")
+	}
+	s.queued(rec)
+	if s.heartbeat(rec, 3, last, true) || rec.StalledSince != nil {
+		t.Error("heartbeat() marked a queued run stalled")
+	}
+}
+
+func TestTouchWhileRunning(t *testing.T) {
+	defer func(d time.Duration) { jobStatusPoll = d }(jobStatusPoll)
+	jobStatusPoll = time.Millisecond
+	ctx, p := withProgress(context.Background())
+	var state atomic.Int64
+	state.Store(int64(bigquery.Pending))
+	polled := make(chan struct{}, 1)
+	stop := touchWhileRunning(ctx, func(context.Context) (*bigquery.JobStatus, error) {
+		select {
+		case polled <- struct{}{}:
+		default:
+		}
+		return &bigquery.JobStatus{State: bigquery.State(state.Load())}, nil
+	})
+	defer stop()
+
+	// A pending job is no activity; a running one is
+	p.last.Store(0)
+	<-polled
+	<-polled
+	if p.last.Load() != 0 {
+		t.Errorf("pending job touched the progress")
+	}
+	state.Store(int64(bigquery.Running))
+	deadline := time.Now().Add(time.Second)
+	for p.last.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if p.last.Load() == 0 {
+		t.Error("running job did not touch the progress")
+	}
+	// Without a watched export, nothing polls
+	touchWhileRunning(context.Background(), nil)()
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// HTTPOptions are the settings of outbound HTTP connections. Installed as the default
+// transport, they apply to BigQuery, Cloud Storage, IAM and token endpoints (the Google
+// clients copy it), StarRocks Stream Load and webhooks.
+type HTTPOptions struct {
+	DialTimeout         time.Duration
+	KeepAlive           time.Duration
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for a response once a request was sent, so a
+	// webhook or HTTP_POST endpoint that accepts connections but never answers fails the
+	// call. It is not set on the default transport: BigQuery, Cloud Storage and Stream
+	// Load calls may legitimately answer later
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+
+	// proxy is the proxy configuration of HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	proxy *httpproxy.Config
+}
+
+// defaultHTTPOptions are the timeouts used unless HTTP_* variables say otherwise.
+var defaultHTTPOptions = HTTPOptions{
+	DialTimeout:           30 * time.Second,
+	KeepAlive:             30 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 2 * time.Minute,
+	IdleConnTimeout:       90 * time.Second,
+}
+
+// HTTPOptionsFromEnv reads HTTP_DIAL_TIMEOUT, HTTP_KEEP_ALIVE, HTTP_TLS_HANDSHAKE_TIMEOUT,
+// HTTP_RESPONSE_HEADER_TIMEOUT and HTTP_IDLE_CONN_TIMEOUT (durations; "0" disables the
+// timeout and invalid values keep the default), and the proxies of HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY (or their lowercase forms).
+func HTTPOptionsFromEnv() (HTTPOptions, error) {
+	o := defaultHTTPOptions
+	for env, d := range map[string]*time.Duration{
+		"HTTP_DIAL_TIMEOUT":            &o.DialTimeout,
+		"HTTP_KEEP_ALIVE":              &o.KeepAlive,
+		"HTTP_TLS_HANDSHAKE_TIMEOUT":   &o.TLSHandshakeTimeout,
+		"HTTP_RESPONSE_HEADER_TIMEOUT": &o.ResponseHeaderTimeout,
+		"HTTP_IDLE_CONN_TIMEOUT":       &o.IdleConnTimeout,
+	} {
+		if v, err := time.ParseDuration(os.Getenv(env)); err == nil && v >= 0 {
+			*d = v
+		}
+	}
+	o.proxy = httpproxy.FromEnvironment()
+	for env, raw := range map[string]string{"HTTPS_PROXY": o.proxy.HTTPSProxy, "HTTP_PROXY": o.proxy.HTTPProxy} {
+		if raw == "" {
+			continue
+		}
+		if _, err := proxyURL(raw); err != nil {
+			return o, ConfigError(fmt.Errorf("invalid %s: %w", env, err))
+		}
+	}
+	return o, nil
+}
+
+// proxyURL parses a proxy setting, which may omit the http:// scheme.
+func proxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		if u, err = url.Parse("http://" + raw); err != nil {
+			return nil, err
+		}
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing proxy host in %q", raw)
+	}
+	return u, nil
+}
+
+// Transport returns an HTTP transport with the options, except ResponseHeaderTimeout.
+func (o HTTPOptions) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: o.DialTimeout, KeepAlive: o.KeepAlive}).DialContext
+	t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	t.IdleConnTimeout = o.IdleConnTimeout
+	if o.proxy != nil {
+		proxy := o.proxy.ProxyFunc()
+		t.Proxy = func(r *http.Request) (*url.URL, error) { return proxy(r.URL) }
+	}
+	return t
+}
+
+// endpointHeaderTimeout is the ResponseHeaderTimeout installed by ConfigureHTTP.
+var endpointHeaderTimeout = defaultHTTPOptions.ResponseHeaderTimeout
+
+// endpointTransport returns a copy of the default transport bounding the wait for
+// response headers, for the clients of webhooks and HTTP_POST endpoints.
+func endpointTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = endpointHeaderTimeout
+	return t
+}
+
+// ConfigureHTTP installs the options as the default HTTP transport, and the
+// ResponseHeaderTimeout of webhook and HTTP_POST clients. Call it before any client is
+// created; clients created earlier keep their transport.
+func ConfigureHTTP(o HTTPOptions) {
+	http.DefaultTransport = o.Transport()
+	endpointHeaderTimeout = o.ResponseHeaderTimeout
+	http.DefaultClient = &http.Client{Transport: http.DefaultTransport}
+	attrs := []any{"response_header_timeout", o.ResponseHeaderTimeout, "dial_timeout", o.DialTimeout}
+	if o.proxy != nil {
+		for name, raw := range map[string]string{"https_proxy": o.proxy.HTTPSProxy, "http_proxy": o.proxy.HTTPProxy} {
+			if u, err := proxyURL(raw); raw != "" && err == nil {
+				// Never log proxy credentials
+				attrs = append(attrs, name, u.Redacted())
+			}
+		}
+		if o.proxy.NoProxy != "" {
+			attrs = append(attrs, "no_proxy", o.proxy.NoProxy)
+		}
+	}
+	slog.Info("Outbound HTTP configured", attrs...)
+}
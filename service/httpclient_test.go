@@ -0,0 +1,57 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTPOptionsFromEnv(t *testing.T) {
+	t.Setenv("HTTP_RESPONSE_HEADER_TIMEOUT", "45s")
+	t.Setenv("HTTP_DIAL_TIMEOUT", "soon")
+	t.Setenv("HTTPS_PROXY", "proxy.hospital.local:3128")
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("NO_PROXY", "starrocks.internal,10.0.0.0/8")
+	o, err := HTTPOptionsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.ResponseHeaderTimeout != 45*time.Second || o.DialTimeout != defaultHTTPOptions.DialTimeout {
+		t.Errorf("HTTPOptionsFromEnv() = %+v", o)
+	}
+	// The response header timeout is left to webhook and HTTP_POST clients
+	tr := o.Transport()
+	if tr.ResponseHeaderTimeout != 0 || tr.TLSHandshakeTimeout != 10*time.Second {
+		t.Errorf("Transport() timeouts = %v, %v", tr.ResponseHeaderTimeout, tr.TLSHandshakeTimeout)
+	}
+	for target, want := range map[string]string{
+		"https://bigquery.googleapis.com/bigquery/v2/projects": "http://proxy.hospital.local:3128",
+		"http://starrocks.internal:8030/api/transaction/begin": "",
+		"http://10.1.2.3:8030/api/transaction/begin":           "",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		u, err := tr.Proxy(req)
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if err != nil || got != want {
+			t.Errorf("proxy of %s = %q, %v, want %q", target, got, err, want)
+		}
+	}
+
+	post, err := NewHTTPPostDriver("https://ingest.example.org/rows", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]*http.Client{"webhook": NewNotifier().client, "HTTP_POST": post.client} {
+		if got := c.Transport.(*http.Transport).ResponseHeaderTimeout; got != defaultHTTPOptions.ResponseHeaderTimeout {
+			t.Errorf("%s response header timeout = %v, want %v", name, got, defaultHTTPOptions.ResponseHeaderTimeout)
+		}
+	}
+
+	t.Setenv("HTTPS_PROXY", "ftp://proxy:21")
+	if _, err := HTTPOptionsFromEnv(); err == nil {
+		t.Error("HTTPOptionsFromEnv() with an ftp proxy succeeded")
+	}
+}
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// httpPostDriverName is the EXPORT_DRIVER value of HTTPPostDriver.
+const httpPostDriverName = "HTTP_POST"
+
+// Defaults of HTTPPostDriver.
+const (
+	defaultHTTPPostBatchRows = 500
+	defaultHTTPPostRetries   = 5
+	defaultHTTPPostTimeout   = 30 * time.Second
+	maxHTTPPostBackoff       = time.Minute
+)
+
+// HTTPPostBatch is the JSON body of one request of an HTTP_POST export.
+type HTTPPostBatch struct {
+	RequestID string `json:"request_id"`
+	Table     string `json:"table,omitempty"`
+	// Batch numbers the batches of the export from 0; Final marks the last one, which is
+	// sent, without rows, for an empty result too
+	Batch int              `json:"batch"`
+	Final bool             `json:"final"`
+	Rows  []map[string]any `json:"rows"`
+}
+
+// HTTPPostDriver posts the result rows as JSON batches to a REST ingestion endpoint, one
+// batch at a time and in order (of key_columns, when given). Batches failing with a
+// network error, HTTP 408, 429 or a 5xx status are retried with exponential backoff (or
+// after Retry-After), with the same Idempotency-Key; other statuses fail the export.
+// Batches accepted before a failure are not taken back, and such exports are not
+// deferred on BigQuery quota errors (see partialDelivery).
+type HTTPPostDriver struct {
+	client *http.Client
+	// endpoint is the configured URL; outputs must be under it, since the headers carry
+	// its credentials
+	endpoint  string
+	headers   http.Header
+	batchRows int
+	retries   int
+	backoff   time.Duration
+}
+
+// NewHTTPPostDriver returns a driver posting to endpoint with headers.
+func NewHTTPPostDriver(endpoint string, headers http.Header) (*HTTPPostDriver, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, ConfigError(fmt.Errorf("invalid HTTP_POST_URL %q; expected an http(s) URL", endpoint))
+	}
+	return &HTTPPostDriver{
+		client:    &http.Client{Timeout: defaultHTTPPostTimeout, Transport: endpointTransport()},
+		endpoint:  endpoint,
+		headers:   headers,
+		batchRows: defaultHTTPPostBatchRows,
+		retries:   defaultHTTPPostRetries,
+		backoff:   time.Second,
+	}, nil
+}
+
+// NewHTTPPostDriverFromEnv reads HTTP_POST_URL, HTTP_POST_HEADERS (a JSON object of
+// header values, e.g. {"Authorization": "Bearer ..."}), HTTP_POST_BATCH_ROWS (default
+// 500), HTTP_POST_RETRIES (default 5) and HTTP_POST_TIMEOUT (per request, default 30s).
+func NewHTTPPostDriverFromEnv() (*HTTPPostDriver, error) {
+	headers := http.Header{}
+	if raw := os.Getenv("HTTP_POST_HEADERS"); raw != "" {
+		var values map[string]string
+		if err := json.Unmarshal([]byte(raw), &values); err != nil {
+			return nil, ConfigError(fmt.Errorf("invalid HTTP_POST_HEADERS; expected a JSON object of strings: %w", err))
+		}
+		for k, v := range values {
+			headers.Set(k, v)
+		}
+	}
+	d, err := NewHTTPPostDriver(os.Getenv("HTTP_POST_URL"), headers)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := strconv.Atoi(os.Getenv("HTTP_POST_BATCH_ROWS")); err == nil && n > 0 {
+		d.batchRows = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("HTTP_POST_RETRIES")); err == nil && n >= 0 {
+		d.retries = n
+	}
+	if t, err := time.ParseDuration(os.Getenv("HTTP_POST_TIMEOUT")); err == nil && t > 0 {
+		d.client.Timeout = t
+	}
+	return d, nil
+}
+
+func (d *HTTPPostDriver) Name() string {
+	return httpPostDriverName
+}
+
+func (d *HTTPPostDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{ReadsRows: true}
+}
+
+// target is the URL an export with output posts to: output, which must be under the
+// configured endpoint, or the endpoint itself.
+func (d *HTTPPostDriver) target(output string) (string, error) {
+	if output == "" {
+		return d.endpoint, nil
+	}
+	base := strings.TrimSuffix(d.endpoint, "/")
+	if output != base && !strings.HasPrefix(output, base+"/") && !strings.HasPrefix(output, base+"?") {
+		return "", fmt.Errorf("output %q is not under HTTP_POST_URL %s", output, d.endpoint)
+	}
+	return output, nil
+}
+
+func (d *HTTPPostDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	target, err := d.target(params.Output)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	slog.InfoContext(ctx, "Starting HTTP POST export", "url", target, "batch_rows", d.batchRows)
+	query := params.Query
+	if len(params.KeyColumns) > 0 {
+		// Batches of a run then hold the rows they held in a previous one
+		keys := make([]string, len(params.KeyColumns))
+		for i, k := range params.KeyColumns {
+			keys[i] = quoteBigQueryColumn(k)
+		}
+		query = fmt.Sprintf("SELECT * FROM (%s) ORDER BY %s", query, strings.Join(keys, ", "))
+	}
+	it, err := bq.ReadRows(ctx, query, params.QueryLocation)
+	if err != nil {
+		return ExportResult{}, fmt.Errorf("export to %s failed: %w", target, err)
+	}
+	defer it.Close()
+	if it, err = transformRows(ctx, it, params.transformers); err != nil {
+		return ExportResult{}, err
+	}
+
+	var res ExportResult
+	batch := HTTPPostBatch{RequestID: logging.RequestID(ctx), Table: params.Table, Rows: []map[string]any{}}
+	// Once the endpoint accepted a batch, the export cannot start over
+	partial := func(err error) error {
+		if batch.Batch > 0 {
+			return &partialDelivery{err}
+		}
+		return err
+	}
+	send := func(final bool) error {
+		batch.Final = final
+		n, err := d.post(ctx, target, batch)
+		res.BytesWritten += n
+		if err != nil {
+			return partial(fmt.Errorf("batch %d: %w", batch.Batch, err))
+		}
+		res.Rows += int64(len(batch.Rows))
+		batch.Batch++
+		batch.Rows = batch.Rows[:0]
+		return nil
+	}
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			res.Job = it.Job()
+			return res, partial(fmt.Errorf("export to %s failed: %w", target, err))
+		}
+		// A full batch is sent once another row follows, so the last one is marked final
+		if len(batch.Rows) == d.batchRows {
+			if err := send(false); err != nil {
+				res.Job = it.Job()
+				return res, err
+			}
+		}
+		schema := it.Schema()
+		obj := make(map[string]any, len(row))
+		for i, v := range row[:min(len(row), len(schema))] {
+			obj[schema[i].Name] = downloadJSONValue(v)
+		}
+		batch.Rows = append(batch.Rows, obj)
+	}
+	res.Job = it.Job()
+	if err := send(true); err != nil {
+		return res, err
+	}
+	slog.InfoContext(ctx, "HTTP POST export completed", "url", target, "rows", res.Rows, "batches", batch.Batch, "bytes_written", res.BytesWritten)
+	return res, nil
+}
+
+// post sends one batch, retrying transient failures, and returns the bytes of its body.
+// The Idempotency-Key names the batch and a hash of its content, so a batch of a retried
+// run holding other rows is not dropped as a duplicate.
+func (d *HTTPPostDriver) post(ctx context.Context, target string, batch HTTPPostBatch) (int64, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return 0, DataError(fmt.Errorf("failed to encode rows: %w", err))
+	}
+	sum := sha256.Sum256(body)
+	key := fmt.Sprintf("%s-%d-%s", batch.RequestID, batch.Batch, hex.EncodeToString(sum[:8]))
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := d.send(ctx, target, key, body)
+		if err == nil {
+			return int64(len(body)), nil
+		}
+		var permanent *httpPostError
+		if errors.As(err, &permanent) && !permanent.retryable() || ctx.Err() != nil || attempt == d.retries {
+			return 0, err
+		}
+		delay := min(d.backoff<<attempt, maxHTTPPostBackoff)
+		if retryAfter > 0 {
+			delay = min(retryAfter, maxHTTPPostBackoff)
+		}
+		slog.WarnContext(ctx, "Retrying HTTP POST batch", "batch", batch.Batch, "attempt", attempt+1, "delay", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// httpPostError is a batch the endpoint answered with a failure status.
+type httpPostError struct {
+	status int
+	body   string
+}
+
+func (e *httpPostError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("endpoint returned HTTP %d", e.status)
+	}
+	return fmt.Sprintf("endpoint returned HTTP %d: %s", e.status, e.body)
+}
+
+func (e *httpPostError) retryable() bool {
+	return e.status == http.StatusRequestTimeout || e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// send posts body once. Failure statuses other than retryable ones are config errors
+// (401, 403, 404) or data errors (the endpoint rejected the rows).
+func (d *HTTPPostDriver) send(ctx context.Context, target, key string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, ConfigError(err)
+	}
+	for k, v := range d.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return 0, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	herr := &httpPostError{status: resp.StatusCode, body: strings.TrimSpace(string(msg))}
+	var retryAfter time.Duration
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		retryAfter = time.Duration(s) * time.Second
+	}
+	switch {
+	case herr.retryable():
+		return retryAfter, herr
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusNotFound:
+		return 0, ConfigError(herr)
+	}
+	return 0, DataError(herr)
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestHTTPPostDriver(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches []HTTPPostBatch
+		keys    []string
+		fail    = map[int]int{} // batch -> status of its first attempt
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" || r.URL.Path != "/ingest/visits" {
+			http.Error(w, "unexpected request", http.StatusUnauthorized)
+			return
+		}
+		var b HTTPPostBatch
+		json.NewDecoder(r.Body).Decode(&b)
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if status := fail[b.Batch]; status != 0 {
+			delete(fail, b.Batch)
+			http.Error(w, "try again", status)
+			return
+		}
+		batches = append(batches, b)
+	}))
+	defer srv.Close()
+
+	d, err := NewHTTPPostDriver(srv.URL+"/ingest/", http.Header{"Authorization": {"Bearer secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.batchRows, d.backoff = 2, time.Millisecond
+	ctx := logging.WithRequestID(context.Background(), "run-1")
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}},
+		rows:   [][]bigquery.Value{{int64(1)}, {int64(2)}, {int64(3)}},
+	}
+	params := ExportParams{Query: "SELECT 1", Output: srv.URL + "/ingest/visits", Table: "visits"}
+	fail[1] = http.StatusServiceUnavailable
+	res, err := d.Execute(ctx, bq, params)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.Rows != 3 || len(batches) != 2 || len(batches[0].Rows) != 2 || batches[0].Final || !batches[1].Final || batches[1].Table != "visits" {
+		t.Errorf("batches = %+v, want 2 and 1 rows, the last final", batches)
+	}
+	if len(keys) != 3 || !strings.HasPrefix(keys[0], "run-1-0-") || !strings.HasPrefix(keys[1], "run-1-1-") || keys[2] != keys[1] {
+		t.Errorf("idempotency keys = %v, want run-1-<batch>-<hash>, kept by the retry", keys)
+	}
+	first := keys[0]
+
+	// The same batch with other rows has another key
+	keys, bq.rows = nil, [][]bigquery.Value{{int64(4)}, {int64(5)}, {int64(6)}}
+	if _, err := d.Execute(ctx, bq, params); err != nil || len(keys) != 2 || keys[0] == first {
+		t.Errorf("Execute() of other rows = %v, keys %v, want a key other than %s", err, keys, first)
+	}
+
+	// Rows are posted in the order of key_columns, so batches hold the same rows again
+	keyed := params
+	keyed.KeyColumns = []string{"id"}
+	if _, err := d.Execute(ctx, bq, keyed); err != nil || !strings.Contains(bq.queries[len(bq.queries)-1], "SELECT * FROM (SELECT 1) ORDER BY `id`") {
+		t.Errorf("Execute() with key_columns = %v, query %s", err, bq.queries[len(bq.queries)-1])
+	}
+
+	// A failure after accepted batches is marked, so the export is not run again
+	var partial *partialDelivery
+	fail[1] = http.StatusUnprocessableEntity
+	if _, err := d.Execute(ctx, bq, params); !errors.As(err, &partial) || FailureClass(err) != FailureData {
+		t.Errorf("Execute() failing the second batch error = %v, want a data error after a partial delivery", err)
+	}
+
+	// An empty result still posts the final batch
+	batches, bq.rows = nil, nil
+	if res, err := d.Execute(ctx, bq, params); err != nil || res.Rows != 0 || len(batches) != 1 || !batches[0].Final {
+		t.Errorf("Execute() of no rows = %v, batches %+v, want one empty final batch", err, batches)
+	}
+
+	keys, bq.rows = nil, [][]bigquery.Value{{int64(1)}}
+	fail[0] = http.StatusUnprocessableEntity
+	if _, err := d.Execute(ctx, bq, params); FailureClass(err) != FailureData || len(keys) != 1 || errors.As(err, &partial) {
+		t.Errorf("Execute() rejected error = %v after %d attempts, want a data error without retries", err, len(keys))
+	}
+
+	params.Output = "https://elsewhere.example/ingest/visits"
+	if _, err := d.Execute(ctx, bq, params); FailureClass(err) != FailureConfig {
+		t.Errorf("Execute() outside HTTP_POST_URL error = %v, want a config error", err)
+	}
+}
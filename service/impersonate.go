@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// Impersonator creates BigQuery clients acting as a target service account, so exports
+// can read with a least-privilege identity chosen per destination or request instead of
+// the service's own. The service identity needs roles/iam.serviceAccountTokenCreator on
+// every target. Clients are created on first use and kept for the life of the process.
+type Impersonator struct {
+	projectID string
+	opts      []option.ClientOption
+
+	// StorageRead enables the Storage Read API on the impersonated clients (see
+	// BigQueryService.EnableStorageRead)
+	StorageRead bool
+
+	mu      sync.Mutex
+	clients map[string]*BigQueryService
+}
+
+// NewImpersonator mints tokens with the service credentials in opts. BigQuery jobs run
+// in the project of the target service account, or projectID for accounts outside a
+// project (e.g. default compute accounts).
+func NewImpersonator(projectID string, opts ...option.ClientOption) *Impersonator {
+	return &Impersonator{projectID: projectID, opts: opts, clients: map[string]*BigQueryService{}}
+}
+
+// Client returns the BigQuery client impersonating serviceAccount.
+func (i *Impersonator) Client(ctx context.Context, serviceAccount string) (BigQueryClient, error) {
+	if !strings.Contains(serviceAccount, "@") {
+		return nil, fmt.Errorf("invalid service account %q: expected an email address", serviceAccount)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if c, ok := i.clients[serviceAccount]; ok {
+		return c, nil
+	}
+	// Token sources and clients outlive the request that created them
+	ts, err := impersonate.CredentialsTokenSource(context.Background(), impersonate.CredentialsConfig{
+		TargetPrincipal: serviceAccount,
+		Scopes:          credentialScopes,
+	}, i.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", serviceAccount, err)
+	}
+	slog.InfoContext(ctx, "Impersonating service account", "service_account", serviceAccount)
+	c, err := NewBigQueryService(context.Background(), serviceAccountProject(serviceAccount, i.projectID), option.WithTokenSource(ts))
+	if err != nil {
+		return nil, err
+	}
+	if i.StorageRead {
+		if err := c.EnableStorageRead(context.Background(), option.WithTokenSource(ts)); err != nil {
+			slog.WarnContext(ctx, "Reading results through the REST API", "service_account", serviceAccount, "error", err)
+		}
+	}
+	i.clients[serviceAccount] = c
+	return c, nil
+}
+
+// Close closes the impersonated clients.
+func (i *Impersonator) Close() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for sa, c := range i.clients {
+		c.Close()
+		delete(i.clients, sa)
+	}
+}
+
+// serviceAccountProject returns the project of a user-managed service account
+// (name@project.iam.gserviceaccount.com), or fallback.
+func serviceAccountProject(serviceAccount, fallback string) string {
+	_, domain, _ := strings.Cut(serviceAccount, "@")
+	if project, ok := strings.CutSuffix(domain, ".iam.gserviceaccount.com"); ok && project != "" {
+		return project
+	}
+	return fallback
+}
+
+// impersonatedClient returns the BigQuery client an export runs with: the service's own,
+// or one impersonating params.ImpersonateServiceAccount.
+func (e *Exporter) impersonatedClient(ctx context.Context, params ExportParams) (BigQueryClient, error) {
+	if params.ImpersonateServiceAccount == "" {
+		return e.BQ, nil
+	}
+	if e.Impersonator == nil {
+		return nil, fmt.Errorf("impersonate_service_account is not supported by this deployment")
+	}
+	return e.Impersonator.Client(ctx, params.ImpersonateServiceAccount)
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"testing"
+)
+
+func TestServiceAccountProject(t *testing.T) {
+	tests := map[string]string{
+		"reader@study-a.iam.gserviceaccount.com":              "study-a",
+		"123-compute@developer.gserviceaccount.com":           "default-prj",
+		"study-b@appspot.gserviceaccount.com":                 "default-prj",
+		"service-123@gcp-sa-bigquery.iam.gserviceaccount.com": "gcp-sa-bigquery",
+	}
+	for sa, want := range tests {
+		if got := serviceAccountProject(sa, "default-prj"); got != want {
+			t.Errorf("serviceAccountProject(%q) = %q, want %q", sa, got, want)
+		}
+	}
+}
+
+func TestExporterImpersonationDisabled(t *testing.T) {
+	e := NewExporter(&fakeBigQuery{location: "US"}, NewGCSDriver(nil, nil), &config.Config{})
+	_, err := e.Run(context.Background(), ExportParams{Query: "SELECT 1", Output: "gs://b/p", ImpersonateServiceAccount: "reader@study-a.iam.gserviceaccount.com"})
+	if err == nil {
+		t.Fatal("Run() with impersonation but no Impersonator error = nil")
+	}
+	jobs := e.Jobs.List(context.Background())
+	if len(jobs) != 1 || jobs[0].Status != JobFailed || jobs[0].ServiceAccount != "reader@study-a.iam.gserviceaccount.com" {
+		t.Errorf("jobs = %+v, want one failed run recording the service account", jobs)
+	}
+}
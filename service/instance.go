@@ -0,0 +1,57 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"fmt"
+)
+
+// Instance is this process among those sharing a coordinator. While it runs it holds the
+// lease "instance:<ID>", which tells the other instances that the runs and cleanup
+// actions it registered are not orphaned. With the local coordinator, only the instance
+// itself sees its lease: every other instance counts as stopped.
+type Instance struct {
+	ID      string
+	coord   Coordinator
+	release func()
+}
+
+// NewInstance returns this instance in coord, with a new ID.
+func NewInstance(coord Coordinator) *Instance {
+	return &Instance{ID: logging.NewRequestID(), coord: coord}
+}
+
+func instanceLease(id string) string {
+	return "instance:" + id
+}
+
+// Start holds the lease of the instance until Close.
+func (i *Instance) Start(ctx context.Context) error {
+	ok, holder, err := i.coord.TryLock(ctx, instanceLease(i.ID), i.ID, leaseTTL)
+	if err != nil {
+		return fmt.Errorf("failed to take the instance lease: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("the instance lease is held by %s", holder)
+	}
+	_, i.release = holdLease(ctx, i.coord, instanceLease(i.ID), i.ID, leaseTTL)
+	return nil
+}
+
+// Close frees the instance lease.
+func (i *Instance) Close() {
+	if i.release != nil {
+		i.release()
+	}
+}
+
+// stopped reports whether the instance id no longer holds its lease: it stopped, or
+// crashed more than leaseTTL ago. Without a shared coordinator no other instance is
+// known to have stopped.
+func (i *Instance) stopped(ctx context.Context, id string) (bool, error) {
+	if id == i.ID || !sharedCoordinator(i.coord) {
+		return false, nil
+	}
+	holder, err := i.coord.Holder(ctx, instanceLease(id))
+	return holder == "", err
+}
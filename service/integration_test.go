@@ -0,0 +1,144 @@
+//go:build integration
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// Integration tests run the full export path against the BigQuery emulator and StarRocks
+// started by docker-compose.test.yml:
+//
+//	docker compose -f docker-compose.test.yml up --detach --wait --wait-timeout 300
+//	go test -tags integration ./...
+
+const integrationDatabase = "it_exporter"
+
+func setenvDefault(t *testing.T, key, value string) {
+	t.Helper()
+	if os.Getenv(key) == "" {
+		t.Setenv(key, value)
+	}
+}
+
+func newIntegrationBigQuery(t *testing.T) *BigQueryService {
+	t.Helper()
+	setenvDefault(t, "BIGQUERY_EMULATOR_HOST", "http://localhost:9050")
+	bq, err := NewBigQueryService(context.Background(), "test-project")
+	if err != nil {
+		t.Fatalf("failed to create BigQuery client: %v", err)
+	}
+	t.Cleanup(func() { bq.Close() })
+	return bq
+}
+
+func newIntegrationStarRocks(t *testing.T) *StarRocksService {
+	t.Helper()
+	setenvDefault(t, "STARROCKS_HOST", "127.0.0.1")
+	setenvDefault(t, "STARROCKS_PORT", "19030")
+	setenvDefault(t, "STARROCKS_USER", "root")
+	sr, err := NewStarRocksServiceFromEnv()
+	if err != nil {
+		t.Fatalf("failed to connect to StarRocks: %v", err)
+	}
+	t.Cleanup(func() { sr.Close() })
+	return sr
+}
+
+func countRows(t *testing.T, sr *StarRocksService, table string) int64 {
+	t.Helper()
+	var n int64
+	if err := sr.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatalf("failed to count rows in %s: %v", table, err)
+	}
+	return n
+}
+
+func TestIntegrationStarRocksLoad(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	bq := newIntegrationBigQuery(t)
+	sr := newIntegrationStarRocks(t)
+	driver := NewStarRocksDriver(sr, nil)
+
+	table := fmt.Sprintf("patients_%d", time.Now().UnixNano())
+	res, err := driver.Execute(ctx, bq, ExportParams{
+		Query:         "SELECT id, site, enrolled_at FROM test_data.patients",
+		QueryLocation: "US",
+		Table:         table,
+		Database:      integrationDatabase,
+	})
+	if err != nil {
+		t.Fatalf("first load failed: %v", err)
+	}
+	fullName := integrationDatabase + "." + table
+	if res.Table != fullName {
+		t.Errorf("table = %q, want %q", res.Table, fullName)
+	}
+	if res.Rows != 3 {
+		t.Errorf("rows = %d, want 3", res.Rows)
+	}
+	if got := countRows(t, sr, fullName); got != 3 {
+		t.Errorf("destination count = %d, want 3", got)
+	}
+
+	// A second load with an extra column exercises schema evolution
+	res, err = driver.Execute(ctx, bq, ExportParams{
+		Query:         "SELECT id, site, enrolled_at, weight_kg FROM test_data.patients",
+		QueryLocation: "US",
+		Table:         table,
+		Database:      integrationDatabase,
+		Verify:        true,
+	})
+	if err != nil {
+		t.Fatalf("second load failed: %v", err)
+	}
+	if res.DestinationRows != 6 {
+		t.Errorf("verified destination rows = %d, want 6", res.DestinationRows)
+	}
+	cols, err := sr.getExistingColumns(ctx, integrationDatabase, table)
+	if err != nil {
+		t.Fatalf("failed to read columns: %v", err)
+	}
+	if len(cols) != 4 || cols[3].Name != "weight_kg" {
+		t.Errorf("columns after evolution = %+v, want weight_kg appended", cols)
+	}
+	if got := countRows(t, sr, fullName); got != 6 {
+		t.Errorf("destination count after append = %d, want 6", got)
+	}
+}
+
+func TestIntegrationStarRocksCustomDDL(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	bq := newIntegrationBigQuery(t)
+	sr := newIntegrationStarRocks(t)
+	driver := NewStarRocksDriver(sr, nil)
+
+	table := fmt.Sprintf("sites_%d", time.Now().UnixNano())
+	fullName := integrationDatabase + "." + table
+	ddl := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id BIGINT, site VARCHAR(64))
+		ENGINE=OLAP DUPLICATE KEY(id) DISTRIBUTED BY HASH(id) BUCKETS 1
+		PROPERTIES ("replication_num" = "1")`, fullName)
+	res, err := driver.Execute(ctx, bq, ExportParams{
+		Query:         "SELECT id, site FROM test_data.patients WHERE id > 1",
+		QueryLocation: "US",
+		Table:         fullName,
+		CreateDDL:     ddl,
+	})
+	if err != nil {
+		t.Fatalf("load with custom DDL failed: %v", err)
+	}
+	if res.Rows != 2 {
+		t.Errorf("rows = %d, want 2", res.Rows)
+	}
+	if got := countRows(t, sr, fullName); got != 2 {
+		t.Errorf("destination count = %d, want 2", got)
+	}
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// paramNames are the request names of the ExportParams fields the snake_case rule of
+// paramName gets wrong.
+var paramNames = map[string]string{
+	"CSVBOM":        "csv_bom",
+	"REDCapMapping": "redcap_mapping",
+}
+
+// paramName turns an ExportParams field name into its request name: CSVHeader is
+// csv_header.
+func paramName(field string) string {
+	if name, ok := paramNames[field]; ok {
+		return name
+	}
+	r := []rune(field)
+	var b strings.Builder
+	for i, c := range r {
+		if unicode.IsUpper(c) && i > 0 && (unicode.IsLower(r[i-1]) || unicode.IsDigit(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
+
+// resolvedParams returns the parameters a run was started with, after pipeline
+// rendering, defaults, sharding, snapshot time resolution and tenant rules, by request
+// name. Unset parameters are left out; so is retry_of, which differs for every retry.
+func resolvedParams(p ExportParams) map[string]any {
+	out := map[string]any{}
+	v, t := reflect.ValueOf(p), reflect.TypeOf(p)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() || f.Name == "RetryOf" || v.Field(i).IsZero() {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Pointer {
+			fv = fv.Elem()
+		}
+		out[paramName(f.Name)] = fv.Interface()
+	}
+	// The tenant's row filters change the result as much as the query does
+	if len(p.rowFilters) > 0 {
+		out["row_filters"] = p.rowFilters
+	}
+	return out
+}
+
+// JobDiff lists what changed in the resolved parameters of a run since an earlier one.
+type JobDiff struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Changes []ParamChange `json:"changes"`
+	// QueryDiff is a line diff of the queries, when they differ: unchanged lines start
+	// with "  ", removed lines with "- " and added lines with "+ "
+	QueryDiff []string `json:"query_diff,omitempty"`
+}
+
+// ParamChange is one parameter set, changed or unset between two runs; From or To is
+// missing when the parameter was not set.
+type ParamChange struct {
+	Param string `json:"param"`
+	From  any    `json:"from,omitempty"`
+	To    any    `json:"to,omitempty"`
+}
+
+// Diff compares the resolved parameters of run id with those of run against, or, when
+// against is empty, with the latest earlier run of the same pipeline, name or
+// destination.
+func (s *JobStore) Diff(ctx context.Context, id, against string) (JobDiff, error) {
+	runs := s.List(ctx)
+	i := slices.IndexFunc(runs, func(r JobRecord) bool { return r.ID == id })
+	if i < 0 {
+		return JobDiff{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	to := runs[i]
+	var from JobRecord
+	if against != "" {
+		j := slices.IndexFunc(runs, func(r JobRecord) bool { return r.ID == against })
+		if j < 0 {
+			return JobDiff{}, fmt.Errorf("%w: %s", ErrJobNotFound, against)
+		}
+		from = runs[j]
+	} else {
+		// Runs are listed newest first
+		series := jobSeries(to)
+		j := slices.IndexFunc(runs[i+1:], func(r JobRecord) bool { return jobSeries(r) == series })
+		if j < 0 {
+			return JobDiff{}, fmt.Errorf("%w: no earlier run of %s than %s", ErrJobNotFound, series, id)
+		}
+		from = runs[i+1+j]
+	}
+	return diffParams(from, to), nil
+}
+
+// jobSeries identifies the runs that export the same thing, so a run can be compared
+// with the one before it.
+func jobSeries(r JobRecord) string {
+	switch {
+	case r.Pipeline != "":
+		return "pipeline " + r.Pipeline
+	case r.Name != "":
+		return "export " + r.Name
+	}
+	dest, _ := r.Params["output"].(string)
+	if table, _ := r.Params["table"].(string); table != "" {
+		db, _ := r.Params["database"].(string)
+		dest = strings.TrimPrefix(db+"."+table, ".")
+	}
+	return "destination " + cmp.Or(dest, "(default)")
+}
+
+func diffParams(from, to JobRecord) JobDiff {
+	d := JobDiff{From: from.ID, To: to.ID, Changes: []ParamChange{}}
+	var names []string
+	for name := range from.Params {
+		names = append(names, name)
+	}
+	for name := range to.Params {
+		if _, ok := from.Params[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		a, b := from.Params[name], to.Params[name]
+		// Values compare by their JSON form, so a nil and an empty list are the same
+		ja, _ := json.Marshal(a)
+		jb, _ := json.Marshal(b)
+		if string(ja) != string(jb) {
+			d.Changes = append(d.Changes, ParamChange{Param: name, From: a, To: b})
+		}
+	}
+	qa, _ := from.Params["query"].(string)
+	qb, _ := to.Params["query"].(string)
+	if qa != qb {
+		d.QueryDiff = lineDiff(strings.Split(qa, "\n"), strings.Split(qb, "\n"))
+	}
+	return d
+}
+
+// lineDiffMaxLines bounds the queries lineDiff compares line by line; longer ones are
+// shown as entirely replaced.
+const lineDiffMaxLines = 2000
+
+// lineDiff returns a line diff of a and b through their longest common subsequence.
+func lineDiff(a, b []string) []string {
+	var out []string
+	if len(a) > lineDiffMaxLines || len(b) > lineDiffMaxLines {
+		for _, l := range a {
+			out = append(out, "- "+l)
+		}
+		for _, l := range b {
+			out = append(out, "+ "+l)
+		}
+		return out
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// JobResult is the machine-readable outcome of a job mode run, written to JOB_RESULT_FILE
+// for the orchestrator that started the job. ExitCode is also the process exit code.
+type JobResult struct {
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	// Failure is the failure class: config, transient, data or error
+	Failure string `json:"failure,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	RequestID  string    `json:"request_id"`
+	Pipeline   string    `json:"pipeline,omitempty"`
+	TaskIndex  int       `json:"task_index"`
+	TaskCount  int       `json:"task_count"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	GCSPath         string            `json:"gcs_path,omitempty"`
+	Table           string            `json:"table,omitempty"`
+	Rows            int64             `json:"rows"`
+	RowsDeleted     int64             `json:"rows_deleted,omitempty"`
+	DestinationRows int64             `json:"destination_rows,omitempty"`
+	BytesProcessed  int64             `json:"bytes_processed,omitempty"`
+	FilesWritten    int64             `json:"files_written,omitempty"`
+	BytesWritten    int64             `json:"bytes_written,omitempty"`
+	ColumnMapping   map[string]string `json:"column_mapping,omitempty"`
+	BigQueryJobID   string            `json:"bigquery_job_id,omitempty"`
+	BigQueryJobURL  string            `json:"bigquery_job_url,omitempty"`
+}
+
+// NewJobResult describes a run that started at started and ended with res and err.
+func NewJobResult(requestID string, started time.Time, res ExportResult, err error) JobResult {
+	r := JobResult{
+		Status:          JobSucceeded,
+		RequestID:       requestID,
+		TaskCount:       1,
+		StartedAt:       started.UTC(),
+		FinishedAt:      time.Now().UTC(),
+		GCSPath:         res.GCSPath,
+		Table:           res.Table,
+		Rows:            res.Rows,
+		RowsDeleted:     res.RowsDeleted,
+		DestinationRows: res.DestinationRows,
+		BytesProcessed:  res.BytesProcessed,
+		FilesWritten:    res.Files,
+		BytesWritten:    res.BytesWritten,
+		ColumnMapping:   res.ColumnMapping,
+		BigQueryJobID:   res.Job.ID,
+		BigQueryJobURL:  res.Job.ConsoleURL(),
+	}
+	if err != nil {
+		r.Status, r.Failure, r.Error, r.ExitCode = JobFailed, FailureClass(err), err.Error(), ExitCode(err)
+	}
+	return r
+}
+
+// WriteJobResult writes r as JSON to dest: a local path, or a gs://bucket/object written
+// through gcs. "{task_index}" in dest is replaced by the task index, so the tasks of a
+// parallel job do not overwrite each other's result.
+func WriteJobResult(ctx context.Context, dest string, r JobResult, gcs *GCSService) error {
+	dest = strings.ReplaceAll(dest, "{task_index}", fmt.Sprint(r.TaskIndex))
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if !strings.HasPrefix(dest, "gs://") {
+		if err := os.WriteFile(dest, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write job result: %w", err)
+		}
+		return nil
+	}
+	bucket, object, err := parseGCSURI(dest)
+	if err != nil {
+		return err
+	}
+	if object == "" || strings.HasSuffix(object, "/") {
+		return fmt.Errorf("job result destination %q is not an object", dest)
+	}
+	if gcs == nil {
+		return fmt.Errorf("no Cloud Storage client to write %s", dest)
+	}
+	return gcs.WriteObject(ctx, bucket, object, "application/json", data)
+}
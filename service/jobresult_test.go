@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+func TestFailureClass(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{fmt.Errorf("failed to insert rows into StarRocks: %w", DataError(errors.New("too long"))), FailureData},
+		{ConfigError(errors.New("unknown load_strategy")), FailureConfig},
+		{fmt.Errorf("%w: nightly", ErrPipelineNotFound), FailureConfig},
+		{fmt.Errorf("export failed: %w", context.DeadlineExceeded), FailureTransient},
+		{&bigquery.Error{Reason: "invalidQuery"}, FailureConfig},
+		{&bigquery.Error{Reason: "backendError"}, FailureTransient},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, FailureTransient},
+		{&googleapi.Error{Code: 404}, FailureConfig},
+		{&googleapi.Error{Code: 503}, FailureTransient},
+		{errors.New("something else"), FailureOther},
+	} {
+		if got := FailureClass(tc.err); got != tc.want {
+			t.Errorf("FailureClass(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+	if got := ExitCode(DataError(errors.New("x"))); got != ExitData {
+		t.Errorf("ExitCode(data error) = %d, want %d", got, ExitData)
+	}
+}
+
+// Startup failures in job mode exit with the code of their class: invalid settings are
+// configuration errors, backends that cannot be reached are transient.
+func TestStartupFailureClass(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		run  func() error
+		want string
+	}{
+		{"proxy", map[string]string{"HTTPS_PROXY": "ftp://proxy:21"}, func() error { _, err := HTTPOptionsFromEnv(); return err }, FailureConfig},
+		{"credentials", map[string]string{"GOOGLE_CREDENTIALS_JSON": "{"}, func() error { _, err := CredentialsFromEnv(context.Background()); return err }, FailureConfig},
+		{"coordination scheme", map[string]string{"COORDINATION_URL": "memcached://cache:11211"}, func() error { _, err := NewCoordinatorFromEnv(context.Background()); return err }, FailureConfig},
+		{"coordination down", map[string]string{"COORDINATION_URL": "redis://" + closed + "?max_retries=-1"}, func() error { _, err := NewCoordinatorFromEnv(context.Background()); return err }, FailureTransient},
+		{"job store down", map[string]string{"JOB_STORE_URL": "redis://" + closed + "?max_retries=-1"}, func() error { _, err := NewJobStoreFromEnv(context.Background()); return err }, FailureTransient},
+		{"starrocks env", map[string]string{"STARROCKS_HOST": ""}, func() error { _, err := NewStarRocksServiceFromEnv(); return err }, FailureConfig},
+		{"http post", map[string]string{"HTTP_POST_URL": "ftp://ingest"}, func() error { _, err := NewHTTPPostDriverFromEnv(); return err }, FailureConfig},
+		{"azure", map[string]string{"AZURE_STORAGE_ENDPOINT": "", "AZURE_STORAGE_ACCOUNT": ""}, func() error { _, err := NewAzureBlobServiceFromEnv(); return err }, FailureConfig},
+		{"orphans", map[string]string{"ORPHANED_JOB_POLICY": "retry"}, func() error { _, err := OrphanPolicyFromEnv(); return err }, FailureConfig},
+		{"webhook tls", map[string]string{"WEBHOOK_CLIENT_CERT_FILE": "client.pem"}, func() error { _, err := NewNotifierFromEnv(); return err }, FailureConfig},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			if got := FailureClass(tc.run()); got != tc.want {
+				t.Errorf("failure class = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteJobResult(t *testing.T) {
+	dir := t.TempDir()
+	started := time.Now().Add(-time.Minute)
+	r := NewJobResult("exec-1", started, ExportResult{Table: "analytics.visits", Rows: 3},
+		fmt.Errorf("verify: %w", DataError(errors.New("load verification failed"))))
+	r.TaskIndex, r.TaskCount = 2, 4
+	if err := WriteJobResult(context.Background(), filepath.Join(dir, "result-{task_index}.json"), r, nil); err != nil {
+		t.Fatalf("WriteJobResult() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "result-2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got JobResult
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != JobFailed || got.Failure != FailureData || got.ExitCode != ExitData || got.Rows != 3 || got.RequestID != "exec-1" {
+		t.Errorf("result = %+v", got)
+	}
+	if err := WriteJobResult(context.Background(), "gs://bucket/results/", r, nil); err == nil {
+		t.Error("WriteJobResult() accepted a folder")
+	}
+}
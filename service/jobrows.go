@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// ErrJobRowsUnavailable is returned for runs whose exported rows cannot be paged.
+var ErrJobRowsUnavailable = errors.New("job rows not available")
+
+// Page sizes of JobRows.
+const (
+	defaultRowsPageSize = 1000
+	maxRowsPageSize     = 10000
+)
+
+// rowsColumn numbers the rows of a materialized result, for paging.
+const rowsColumn = "_bq_exporter_row"
+
+var unsafeTableChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// RowsColumn is a column of a page of rows.
+type RowsColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// RowsPage is one page of the rows a run exported.
+type RowsPage struct {
+	JobID     string           `json:"job_id"`
+	Columns   []RowsColumn     `json:"columns"`
+	Rows      []map[string]any `json:"rows"`
+	TotalRows int64            `json:"total_rows"`
+	// NextPageToken asks for the following page; it is empty on the last one
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// resultPages materializes the rows of completed runs into numbered tables of a BigQuery
+// dataset, so they can be paged without reading the destination. Each table is created on
+// the first page asked for and expires after ttl; tables are remembered per instance.
+type resultPages struct {
+	dataset  string
+	location string
+	ttl      time.Duration
+
+	mu     sync.Mutex
+	tables map[string]*resultTable // by table name
+}
+
+type resultTable struct {
+	mu sync.Mutex // serializes the materialization
+	// usable is until when pages may be read from the table
+	usable time.Time
+}
+
+// newResultPagesFromEnv reads RESULTS_DATASET (paging is disabled without it),
+// RESULTS_LOCATION (default: inferred by BigQuery) and RESULTS_TTL (default 24h).
+func newResultPagesFromEnv() *resultPages {
+	r := &resultPages{dataset: os.Getenv("RESULTS_DATASET"), location: os.Getenv("RESULTS_LOCATION"), ttl: 24 * time.Hour, tables: map[string]*resultTable{}}
+	if d, err := time.ParseDuration(os.Getenv("RESULTS_TTL")); err == nil && d > 0 {
+		r.ttl = d
+	}
+	return r
+}
+
+// table is the results table of a run, named after a hash of its tenant, job ID and
+// start time: distinct runs never share a table, even when their job IDs differ only in
+// characters table names cannot hold.
+func (r *resultPages) table(rec JobRecord) string {
+	sum := sha256.Sum256([]byte(rec.Tenant + "\x00" + rec.ID + "\x00" + rec.StartedAt.UTC().Format(time.RFC3339Nano)))
+	return r.dataset + ".rows_" + hex.EncodeToString(sum[:16])
+}
+
+// JobRows returns a page of the rows a succeeded run visible to the caller in ctx
+// exported: read back from its GCS Parquet or CSV files, or for the BIGQUERY driver
+// copied from the destination table it replaced, as of the end of the run.
+// pageToken is the NextPageToken of the previous page ("" for the first), and pageSize
+// defaults to 1000 rows, at most 10000.
+func (e *Exporter) JobRows(ctx context.Context, id, pageToken string, pageSize int) (RowsPage, error) {
+	rec, ok := e.Jobs.Get(ctx, id)
+	if !ok {
+		return RowsPage{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if rec.Status != JobSucceeded {
+		return RowsPage{}, fmt.Errorf("%w: job %s is %s", ErrJobRowsUnavailable, id, rec.Status)
+	}
+	if e.results == nil || e.results.dataset == "" {
+		return RowsPage{}, ConfigError(fmt.Errorf("paging exported rows needs RESULTS_DATASET"))
+	}
+	offset := int64(0)
+	if pageToken != "" {
+		n, err := strconv.ParseInt(pageToken, 10, 64)
+		if err != nil || n < 0 {
+			return RowsPage{}, ConfigError(fmt.Errorf("invalid page_token %q", pageToken))
+		}
+		offset = n
+	}
+	switch {
+	case pageSize <= 0:
+		pageSize = defaultRowsPageSize
+	case pageSize > maxRowsPageSize:
+		pageSize = maxRowsPageSize
+	}
+	source, err := rowsSource(rec)
+	if err != nil {
+		return RowsPage{}, err
+	}
+	if rec.Tenant != "" {
+		ctx = WithTenant(ctx, rec.Tenant, rec.tenant)
+	}
+	client, err := e.impersonatedClient(ctx, rec.params)
+	if err != nil {
+		return RowsPage{}, err
+	}
+	bq := &meteredBigQuery{BigQueryClient: client}
+	page, err := e.rowsPage(ctx, bq, rec, source, offset, pageSize)
+	e.Usage.record(ctx, bq.bytes.Load(), int64(len(page.Rows)))
+	return page, err
+}
+
+// rowsSource returns the script loading the rows of a run into the temp table _rows.
+func rowsSource(rec JobRecord) (string, error) {
+	switch rec.Driver {
+	case "GCS_PARQUET", parquetWriteDriverName:
+		if rec.GCSPath == "" {
+			break
+		}
+		if script, ok := loadFilesScript(rec.GCSPath, rec.params); ok {
+			return script, nil
+		}
+		return "", fmt.Errorf("%w: %s files of job %s cannot be paged", ErrJobRowsUnavailable, rec.params.Format, rec.ID)
+	case "BIGQUERY":
+		if mode, err := bigQueryWriteMode(rec.params); err != nil || mode != WriteModeReplace || rec.Table == "" {
+			return "", fmt.Errorf("%w: job %s did not replace its table, which holds other rows too", ErrJobRowsUnavailable, rec.ID)
+		}
+		if rec.FinishedAt == nil {
+			break
+		}
+		// Later runs may have replaced the table since; time travel reads what this one wrote
+		return fmt.Sprintf("CREATE TEMP TABLE _rows AS SELECT * FROM %s FOR SYSTEM_TIME AS OF %s;", quoteBigQueryTable(rec.Table), bigQueryTimestamp(*rec.FinishedAt)), nil
+	}
+	return "", fmt.Errorf("%w: rows loaded by the %s driver cannot be paged", ErrJobRowsUnavailable, rec.Driver)
+}
+
+// loadFilesScript returns the statement loading the Parquet or CSV files an export with
+// params wrote to uris into the temp table _rows; other formats cannot be loaded.
+func loadFilesScript(uris string, params ExportParams) (string, bool) {
+	switch params.Format {
+	case "", FormatParquet:
+		return fmt.Sprintf("LOAD DATA INTO TEMP TABLE _rows FROM FILES(format='PARQUET', uris=[%s]);", quoteBigQueryString(uris)), true
+	case FormatCSV:
+		skip := 1
+		if params.CSVHeader == CSVHeaderNone {
+			skip = 0
+		}
+		delimiter, _ := csvDelimiter(params.CSVDelimiter)
+		return fmt.Sprintf("LOAD DATA INTO TEMP TABLE _rows FROM FILES(format='CSV', uris=[%s], skip_leading_rows=%d, field_delimiter=%s);",
+			quoteBigQueryString(uris), skip, quoteBigQueryString(string(delimiter))), true
+	}
+	return "", false
+}
+
+// rowsPage materializes the rows of rec, unless they are, and reads a page of them.
+func (e *Exporter) rowsPage(ctx context.Context, bq BigQueryClient, rec JobRecord, source string, offset int64, pageSize int) (RowsPage, error) {
+	r := e.results
+	r.mu.Lock()
+	t := r.tables[r.table(rec)]
+	if t == nil {
+		t = &resultTable{}
+		r.tables[r.table(rec)] = t
+	}
+	r.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if err := r.materialize(ctx, bq, t, rec, source); err != nil {
+			return RowsPage{}, err
+		}
+		page, err := r.readPage(ctx, bq, rec, offset, pageSize)
+		if err != nil && attempt == 0 && FailureClass(err) == FailureConfig {
+			// Expired, or created by another instance that saw it expire earlier
+			t.mu.Lock()
+			t.usable = time.Time{}
+			t.mu.Unlock()
+			continue
+		}
+		return page, err
+	}
+}
+
+// materialize creates the numbered table of rec's rows, unless this or another instance
+// created it: the first table is kept, so the pages of all instances agree.
+func (r *resultPages) materialize(ctx context.Context, bq BigQueryClient, t *resultTable, rec JobRecord, source string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Now().Before(t.usable) {
+		return nil
+	}
+	name := r.table(rec)
+	expiry := time.Now().Add(r.ttl)
+	script := fmt.Sprintf("IF NOT EXISTS (SELECT 1 FROM %s.INFORMATION_SCHEMA.TABLES WHERE table_name = %s) THEN\n", quoteBigQueryTable(r.dataset), quoteBigQueryString(name[strings.LastIndex(name, ".")+1:])) +
+		source + "\n" +
+		fmt.Sprintf("CREATE TABLE %s OPTIONS(expiration_timestamp=TIMESTAMP %s) AS SELECT ROW_NUMBER() OVER () AS %s, * FROM _rows;\n",
+			quoteBigQueryTable(name), quoteBigQueryString(expiry.UTC().Format("2006-01-02 15:04:05+00")), rowsColumn) +
+		"END IF;"
+	slog.InfoContext(ctx, "Materializing exported rows for paging", "job_id", rec.ID, "table", name, "expires", expiry)
+	if _, err := bq.RunQuery(ctx, script, r.location); err != nil {
+		return fmt.Errorf("failed to materialize the rows of job %s: %w", rec.ID, err)
+	}
+	// Pages stop a little before the table expires
+	t.usable = expiry.Add(-time.Minute)
+	return nil
+}
+
+// readPage reads the page of the materialized rows of rec after offset.
+func (r *resultPages) readPage(ctx context.Context, bq BigQueryClient, rec JobRecord, offset int64, pageSize int) (RowsPage, error) {
+	table := quoteBigQueryTable(r.table(rec))
+	// One row past the page tells whether another follows
+	q := fmt.Sprintf("SELECT * EXCEPT(%s) FROM %s WHERE %s > %d ORDER BY %s LIMIT %d", rowsColumn, table, rowsColumn, offset, rowsColumn, pageSize+1)
+	it, err := bq.ReadRows(ctx, q, r.location)
+	if err != nil {
+		return RowsPage{}, fmt.Errorf("failed to read the rows of job %s: %w", rec.ID, err)
+	}
+	defer it.Close()
+	page := RowsPage{JobID: rec.ID, Rows: []map[string]any{}, TotalRows: rec.Rows}
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return RowsPage{}, fmt.Errorf("failed to read the rows of job %s: %w", rec.ID, err)
+		}
+		if len(page.Rows) == pageSize {
+			page.NextPageToken = strconv.FormatInt(offset+int64(pageSize), 10)
+			break
+		}
+		schema := it.Schema()
+		obj := make(map[string]any, len(row))
+		for i, v := range row[:min(len(row), len(schema))] {
+			obj[schema[i].Name] = downloadJSONValue(v)
+		}
+		page.Rows = append(page.Rows, obj)
+	}
+	for _, f := range it.Schema() {
+		page.Columns = append(page.Columns, RowsColumn{Name: f.Name, Type: strings.ToUpper(string(f.Type))})
+	}
+	return page, nil
+}
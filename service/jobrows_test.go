@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestJobRows(t *testing.T) {
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}, {Name: "site", Type: bigquery.StringFieldType}},
+		rows:   [][]bigquery.Value{{int64(1), "A1"}, {int64(2), "B2"}, {int64(3), "C3"}},
+	}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	ctx := logging.WithRequestID(context.Background(), "run-1")
+	if _, err := e.Run(ctx, ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/"}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	e.results = &resultPages{}
+	if _, err := e.JobRows(ctx, "run-1", "", 0); FailureClass(err) != FailureConfig {
+		t.Errorf("JobRows() without RESULTS_DATASET error = %v, want a config error", err)
+	}
+
+	e.results = &resultPages{dataset: "results", ttl: time.Hour, tables: map[string]*resultTable{}}
+	page, err := e.JobRows(ctx, "run-1", "", 2)
+	if err != nil {
+		t.Fatalf("JobRows() error = %v", err)
+	}
+	if len(page.Rows) != 2 || page.Rows[1]["site"] != "B2" || page.NextPageToken != "2" || len(page.Columns) != 2 || page.Columns[0].Type != "INTEGER" {
+		t.Errorf("JobRows() = %+v, want 2 rows and a next page", page)
+	}
+	n := len(bq.queries)
+	script, read := bq.queries[n-2], bq.queries[n-1]
+	rec, _ := e.Jobs.Get(ctx, "run-1")
+	table := e.results.table(rec)
+	if !strings.Contains(script, "LOAD DATA INTO TEMP TABLE _rows FROM FILES(format='PARQUET'") || !strings.Contains(script, "CREATE TABLE `"+table+"`") {
+		t.Errorf("materialization = %s, want the Parquet files loaded into %s", script, table)
+	}
+	if !strings.Contains(read, "> 0 ORDER BY") || !strings.Contains(read, "LIMIT 3") {
+		t.Errorf("page query = %s, want the rows after offset 0, one past the page", read)
+	}
+
+	// The table is materialized once
+	if _, err := e.JobRows(ctx, "run-1", page.NextPageToken, 2); err != nil {
+		t.Fatalf("JobRows(next page) error = %v", err)
+	}
+	if got := bq.queries[n:]; len(got) != 1 || !strings.Contains(got[0], "> 2 ORDER BY") {
+		t.Errorf("next page queries = %v, want one read after offset 2", got)
+	}
+	if _, err := e.JobRows(ctx, "run-1", "next", 2); FailureClass(err) != FailureConfig {
+		t.Errorf("JobRows(invalid token) error = %v, want a config error", err)
+	}
+
+	bq.err = errors.New("boom")
+	e.Run(logging.WithRequestID(context.Background(), "run-2"), ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/"})
+	if _, err := e.JobRows(ctx, "run-2", "", 0); !errors.Is(err, ErrJobRowsUnavailable) {
+		t.Errorf("JobRows(failed run) error = %v, want ErrJobRowsUnavailable", err)
+	}
+	if _, err := e.JobRows(ctx, "missing", "", 0); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("JobRows(missing) error = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestResultPagesTable(t *testing.T) {
+	r := &resultPages{dataset: "results"}
+	started := time.Date(2026, 10, 14, 2, 0, 0, 0, time.UTC)
+	a := r.table(JobRecord{ID: "x-1", StartedAt: started})
+	for _, other := range []JobRecord{
+		{ID: "x_1", StartedAt: started},
+		{ID: "x-1", StartedAt: started.Add(time.Second)},
+		{ID: "x-1", StartedAt: started, Tenant: "b"},
+	} {
+		if r.table(other) == a {
+			t.Errorf("table(%+v) = %s, the table of another run", other, a)
+		}
+	}
+	if !strings.HasPrefix(a, "results.rows_") || a != r.table(JobRecord{ID: "x-1", StartedAt: started}) {
+		t.Errorf("table() = %s", a)
+	}
+}
+
+func TestRowsSourceBigQuery(t *testing.T) {
+	finished := time.Date(2026, 10, 14, 2, 5, 0, 0, time.UTC)
+	rec := JobRecord{ID: "run-1", Driver: "BIGQUERY", Table: "mart.visits", FinishedAt: &finished}
+	script, err := rowsSource(rec)
+	if err != nil || script != "CREATE TEMP TABLE _rows AS SELECT * FROM `mart.visits` FOR SYSTEM_TIME AS OF TIMESTAMP '2026-10-14 02:05:00+00';" {
+		t.Errorf("rowsSource() = %s, %v, want the table as of the end of the run", script, err)
+	}
+	rec.params.WriteMode = WriteModeAppend
+	if _, err := rowsSource(rec); !errors.Is(err, ErrJobRowsUnavailable) {
+		t.Errorf("rowsSource(append) error = %v, want ErrJobRowsUnavailable", err)
+	}
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	// JobDeferred is a run waiting out BigQuery quota errors before it starts again
+	JobDeferred  = "deferred"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+var (
+	// ErrJobNotFound is returned when a job ID is unknown or not visible to the caller.
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobNotRetryable is returned when retrying a job that did not fail.
+	ErrJobNotRetryable = errors.New("job not retryable")
+)
+
+// JobRecord is one export run in the job history.
+type JobRecord struct {
+	ID       string `json:"id"`
+	Tenant   string `json:"tenant,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+	Name     string `json:"name,omitempty"`
+	RetryOf  string `json:"retry_of,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	// ServiceAccount is the impersonated service account, if any
+	ServiceAccount string `json:"service_account,omitempty"`
+	Driver         string `json:"driver"`
+	// Instance is the ID of the instance running it (see Instance)
+	Instance   string     `json:"instance,omitempty"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	GCSPath        string `json:"gcs_path,omitempty"`
+	Table          string `json:"table,omitempty"`
+	Rows           int64  `json:"rows_loaded,omitempty"`
+	RowsDeleted    int64  `json:"rows_deleted,omitempty"`
+	BytesProcessed int64  `json:"bytes_processed,omitempty"`
+	FilesWritten   int64  `json:"files_written,omitempty"`
+	BytesWritten   int64  `json:"bytes_written,omitempty"`
+	BigQueryJobID  string `json:"bigquery_job_id,omitempty"`
+	BigQueryJobURL string `json:"bigquery_job_url,omitempty"`
+	Error          string `json:"error,omitempty"`
+	// Deidentification is the audit of a de-identified export
+	Deidentification *DeidAudit `json:"deidentification,omitempty"`
+	// Assertions are the outcomes of the run's assertions
+	Assertions []AssertionResult `json:"assertions,omitempty"`
+	// QualityReport is the evidence of the assertions, with where it was stored
+	QualityReport *QualityReport `json:"validation_report,omitempty"`
+	// Sample holds anonymized rows of the destination, when the pipeline asks for them
+	Sample *RowSample `json:"sample,omitempty"`
+	// Warnings are the steps that failed after the run committed
+	Warnings []string `json:"warnings,omitempty"`
+	// Params are the fully resolved parameters of the run (see resolvedParams)
+	Params map[string]any `json:"params,omitempty"`
+	// LogicalDate and Fingerprint identify runs of a logical date (see runFingerprint);
+	// DuplicateOf is the run whose result answered an identical one
+	LogicalDate string `json:"logical_date,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// HeartbeatAt is the last heartbeat of a running run, with its RowsProcessed so far
+	// and the time of its LastActivityAt; StalledSince is when the watchdog found it
+	// without activity, while it is stalled
+	HeartbeatAt    *time.Time `json:"heartbeat_at,omitempty"`
+	RowsProcessed  int64      `json:"rows_processed,omitempty"`
+	LastActivityAt *time.Time `json:"last_activity_at,omitempty"`
+	StalledSince   *time.Time `json:"stalled_since,omitempty"`
+	// Deferrals counts how often quota errors deferred the run; DeferredUntil and
+	// DeferredReason describe the current deferral
+	Deferrals      int        `json:"deferrals,omitempty"`
+	DeferredUntil  *time.Time `json:"deferred_until,omitempty"`
+	DeferredReason string     `json:"deferred_reason,omitempty"`
+
+	// params and tenant are what the run was started with, kept for retries
+	params ExportParams
+	tenant config.Tenant
+}
+
+// JobStore keeps the most recent export runs in memory, and in Redis when configured,
+// partitioned by tenant so that one tenant's traffic never evicts another's history. The
+// "" partition holds admin and single-tenant runs.
+type JobStore struct {
+	mu    sync.RWMutex
+	limit int
+	jobs  map[string][]*JobRecord // tenant -> runs, oldest first
+	// redis shares the history between instances and restarts; nil keeps it in memory
+	redis *redisJobs
+	// Instance is the ID of this instance, recorded on its runs
+	Instance string
+	// duplicateWindow is how long a succeeded run answers identical runs of its
+	// logical date; 0 disables duplicate detection
+	duplicateWindow time.Duration
+}
+
+// NewJobStore keeps up to limit runs per tenant (default 100).
+func NewJobStore(limit int) *JobStore {
+	if limit <= 0 {
+		limit = 100
+	}
+	return &JobStore{limit: limit, jobs: map[string][]*JobRecord{}, duplicateWindow: defaultDuplicateWindow}
+}
+
+// newJobStoreFromEnv sizes the store from JOB_HISTORY_LIMIT and sets the duplicate
+// window from DUPLICATE_RUN_WINDOW.
+func newJobStoreFromEnv() *JobStore {
+	n, _ := strconv.Atoi(os.Getenv("JOB_HISTORY_LIMIT"))
+	s := NewJobStore(n)
+	if d, err := time.ParseDuration(os.Getenv("DUPLICATE_RUN_WINDOW")); err == nil && d >= 0 {
+		s.duplicateWindow = d
+	}
+	return s
+}
+
+// withChildRequestID gives the n-th of several exports run for one request its own job
+// ID, the request's ID suffixed with n, so each is a separate job in the history.
+func withChildRequestID(ctx context.Context, n int) context.Context {
+	id := logging.RequestID(ctx)
+	if id == "" {
+		id = logging.NewRequestID()
+	}
+	suffix := "-" + strconv.Itoa(n)
+	if len(id)+len(suffix) > 64 {
+		id = id[:64-len(suffix)]
+	}
+	return logging.WithRequestID(ctx, id+suffix)
+}
+
+// start records a running export and returns its record. When the run has a logical
+// date and fingerprint, it also returns the identical run in progress or recently
+// succeeded, if any; the check and the record are atomic, so of two identical runs
+// started together one sees the other. With Redis, runs claim their fingerprint there,
+// so this holds across instances too.
+func (s *JobStore) start(ctx context.Context, driver string, params ExportParams, fingerprint string) (*JobRecord, *JobRecord) {
+	rec := &JobRecord{
+		ID:             logging.RequestID(ctx),
+		Tenant:         TenantName(ctx),
+		Pipeline:       params.Pipeline,
+		Name:           params.Name,
+		RetryOf:        params.RetryOf,
+		Priority:       params.Priority,
+		ServiceAccount: params.ImpersonateServiceAccount,
+		Driver:         driver,
+		Instance:       s.Instance,
+		Status:         JobRunning,
+		StartedAt:      time.Now().UTC(),
+		Params:         resolvedParams(params),
+		LogicalDate:    params.LogicalDate,
+		params:         params,
+	}
+	_, rec.tenant, _ = TenantFrom(ctx)
+	if rec.ID == "" {
+		rec.ID = logging.NewRequestID()
+	}
+	detect := params.LogicalDate != "" && s.duplicateWindow > 0
+	s.mu.Lock()
+	var prior *JobRecord
+	if detect {
+		rec.Fingerprint = fingerprint
+		if r := s.duplicateLocked(rec.Tenant, fingerprint, time.Now().UTC()); r != nil {
+			cp := *r
+			prior = &cp
+		}
+	}
+	runs := append(s.jobs[rec.Tenant], rec)
+	if len(runs) > s.limit {
+		runs = runs[len(runs)-s.limit:]
+	}
+	s.jobs[rec.Tenant] = runs
+	job := s.snapshotLocked(rec)
+	s.mu.Unlock()
+	s.store(job)
+	// Runs of other instances are only in Redis. The run is stored before it claims the
+	// fingerprint, so whichever run holds the claim can be read back.
+	if detect && prior == nil && s.redis != nil {
+		now := time.Now().UTC()
+		r, err := s.redis.claim(ctx, rec.Tenant, fingerprint, rec.ID, func(r *JobRecord) bool { return s.duplicates(r, fingerprint, now) })
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to claim the logical date of the run; identical runs of other instances are not detected", "error", err)
+		}
+		prior = r
+	}
+	return rec, prior
+}
+
+// queued marks a run as waiting for an export slot.
+func (s *JobStore) queued(rec *JobRecord) {
+	s.mu.Lock()
+	rec.Status = JobQueued
+	job := s.snapshotLocked(rec)
+	s.mu.Unlock()
+	s.store(job)
+}
+
+// deferred marks a run as waiting until until for reason; retry counts it as a deferral
+// of the run after its own quota error.
+func (s *JobStore) deferred(rec *JobRecord, until time.Time, reason string, retry bool) {
+	s.mu.Lock()
+	rec.Status = JobDeferred
+	until = until.UTC()
+	rec.DeferredUntil, rec.DeferredReason = &until, reason
+	if retry {
+		rec.Deferrals++
+	}
+	job := s.snapshotLocked(rec)
+	s.mu.Unlock()
+	s.store(job)
+}
+
+// running marks a run as admitted.
+func (s *JobStore) running(rec *JobRecord) {
+	s.mu.Lock()
+	rec.Status = JobRunning
+	rec.DeferredUntil, rec.DeferredReason = nil, ""
+	job := s.snapshotLocked(rec)
+	s.mu.Unlock()
+	s.store(job)
+}
+
+// finish records the outcome of a run.
+func (s *JobStore) finish(rec *JobRecord, res ExportResult, err error) {
+	s.mu.Lock()
+	defer func() {
+		job := s.snapshotLocked(rec)
+		s.mu.Unlock()
+		s.store(job)
+	}()
+	now := time.Now().UTC()
+	rec.FinishedAt = &now
+	rec.DeferredUntil, rec.DeferredReason = nil, ""
+	rec.GCSPath = res.GCSPath
+	rec.Table = res.Table
+	rec.Rows = res.Rows
+	rec.RowsDeleted = res.RowsDeleted
+	rec.BytesProcessed = res.BytesProcessed
+	rec.FilesWritten = res.Files
+	rec.BytesWritten = res.BytesWritten
+	rec.Deidentification = res.Deidentification
+	rec.Assertions = res.Assertions
+	rec.QualityReport = res.QualityReport
+	rec.Sample = res.Sample
+	rec.Warnings = res.Warnings
+	rec.DuplicateOf = res.DuplicateOf
+	if res.Job.ID != "" {
+		rec.BigQueryJobID = res.Job.ID
+		rec.BigQueryJobURL = res.Job.ConsoleURL()
+	}
+	if err != nil {
+		rec.Status = JobFailed
+		rec.Error = err.Error()
+	} else {
+		rec.Status = JobSucceeded
+	}
+}
+
+// List returns the runs visible to the caller in ctx, newest first: a tenant sees its own
+// runs, the admin sees all runs. With Redis, these are the runs of every instance.
+func (s *JobStore) List(ctx context.Context) []JobRecord {
+	if out, ok := s.storedRuns(ctx); ok {
+		sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+		return out
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []JobRecord
+	tenant, _, isTenant := TenantFrom(ctx)
+	for name, runs := range s.jobs {
+		if isTenant && name != tenant {
+			continue
+		}
+		for _, r := range runs {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out
+}
+
+// Get returns one run if it is visible to the caller in ctx.
+func (s *JobStore) Get(ctx context.Context, id string) (JobRecord, bool) {
+	for _, r := range s.List(ctx) {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return JobRecord{}, false
+}
+
+// Retry re-runs a failed job with the parameters it was started with, as the tenant that
+// owned it, with the tenant's current configuration. Loads are transactional, so the retry starts over rather than resuming;
+// change history and diff exports pick up from their last committed watermark or
+// snapshot. The new run records the original job ID in RetryOf.
+func (e *Exporter) Retry(ctx context.Context, id string) (ExportResult, error) {
+	rec, ok := e.Jobs.Get(ctx, id)
+	if !ok {
+		return ExportResult{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if rec.Status != JobFailed {
+		return ExportResult{}, fmt.Errorf("%w: job %s is %s", ErrJobNotRetryable, id, rec.Status)
+	}
+	if rec.Driver == workbookDriverName {
+		return ExportResult{}, fmt.Errorf("%w: job %s is a workbook export; send the workbook request again", ErrJobNotRetryable, id)
+	}
+	if rec.Tenant != "" {
+		// The tenant's current rules apply, not those stored with the run: a row filter
+		// tightened since is added to the filters the run was started with
+		t, ok := e.Tenants[rec.Tenant]
+		if !ok {
+			return ExportResult{}, fmt.Errorf("%w: tenant %q of job %s is no longer configured", ErrForbidden, rec.Tenant, id)
+		}
+		ctx = WithTenant(ctx, rec.Tenant, t)
+	}
+	params := rec.params
+	params.RetryOf = rec.ID
+	res, err := e.Run(ctx, params)
+	if params.Pipeline != "" {
+		if p, ok := e.Pipelines.Get(params.Pipeline); ok {
+			e.Notifier.NotifyPipeline(ctx, params.Pipeline, p.Notify, e.Driver.Name(), res, err)
+		}
+	}
+	return res, err
+}
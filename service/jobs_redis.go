@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultJobTTL is how long Redis keeps a run after it last changed, unless JOB_TTL says
+// otherwise.
+const defaultJobTTL = 7 * 24 * time.Hour
+
+// redisJobs keeps the job history in Redis, so it survives restarts and scale to zero
+// and every instance sees the runs of the others. A run is one key holding it as JSON,
+// expiring ttl after its last change; each tenant's runs are indexed in a sorted set by
+// start time, trimmed to the history limit.
+type redisJobs struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// storedJob is a run as stored in Redis, with what a retry needs.
+type storedJob struct {
+	JobRecord
+	RetryParams  ExportParams  `json:"retry_params"`
+	RowFilters   []string      `json:"retry_row_filters,omitempty"`
+	TenantConfig config.Tenant `json:"retry_tenant"`
+}
+
+// NewJobStoreFromEnv returns the job history of newJobStoreFromEnv, kept in the Redis of
+// JOB_STORE_URL when set (keys under JOB_STORE_PREFIX, default "bq-exporter:", expiring
+// JOB_TTL after a run's last change, default 7 days).
+func NewJobStoreFromEnv(ctx context.Context) (*JobStore, error) {
+	s := newJobStoreFromEnv()
+	raw := os.Getenv("JOB_STORE_URL")
+	if raw == "" {
+		return s, nil
+	}
+	opts, err := redis.ParseURL(raw)
+	if err != nil {
+		return nil, ConfigError(fmt.Errorf("invalid JOB_STORE_URL: %w", err))
+	}
+	prefix := os.Getenv("JOB_STORE_PREFIX")
+	if prefix == "" {
+		prefix = "bq-exporter:"
+	}
+	ttl := defaultJobTTL
+	if d, err := time.ParseDuration(os.Getenv("JOB_TTL")); err == nil && d > 0 {
+		ttl = d
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, TransientError(fmt.Errorf("failed to connect to the job store %s: %w", opts.Addr, err))
+	}
+	s.redis = &redisJobs{client: client, prefix: prefix, ttl: ttl}
+	return s, nil
+}
+
+// Close disconnects the store from Redis, if it uses it.
+func (s *JobStore) Close() error {
+	if s.redis == nil {
+		return nil
+	}
+	return s.redis.client.Close()
+}
+
+func (r *redisJobs) jobKey(id string) string       { return r.prefix + "job:" + id }
+func (r *redisJobs) indexKey(tenant string) string { return r.prefix + "jobs:" + tenant }
+func (r *redisJobs) tenantsKey() string            { return r.prefix + "job-tenants" }
+
+// fingerprintKey holds the ID of the run that claimed a fingerprint of tenant; tenant
+// names have no ":".
+func (r *redisJobs) fingerprintKey(tenant, fingerprint string) string {
+	return r.prefix + "fingerprint:" + tenant + ":" + fingerprint
+}
+
+// takeOverScript gives a claim to ARGV[2] if ARGV[1] still holds it.
+var takeOverScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3]) end return false`)
+
+// claim makes run id the run of fingerprint for tenant, with SET NX, unless the run
+// holding the claim duplicates it: it then returns that run. Claims of runs that no longer
+// duplicate (they failed, expired or left the duplicate window) are taken over.
+func (r *redisJobs) claim(ctx context.Context, tenant, fingerprint, id string, duplicates func(*JobRecord) bool) (*JobRecord, error) {
+	key := r.fingerprintKey(tenant, fingerprint)
+	for range 5 {
+		ok, err := r.client.SetNX(ctx, key, id, r.ttl).Result()
+		if err != nil || ok {
+			return nil, err
+		}
+		holder, err := r.client.Get(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if holder == id {
+			return nil, nil
+		}
+		job, err := r.get(ctx, holder)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil && duplicates(&job.JobRecord) {
+			prior := job.JobRecord
+			return &prior, nil
+		}
+		err = takeOverScript.Run(ctx, r.client, []string{key}, holder, id, r.ttl.Milliseconds()).Err()
+		if err == nil {
+			return nil, nil
+		}
+		if err != redis.Nil {
+			return nil, err
+		}
+		// Another run took it over first
+	}
+	return nil, fmt.Errorf("the claim of fingerprint %s keeps changing hands", fingerprint)
+}
+
+// get returns the stored run id, or nil when it does not exist.
+func (r *redisJobs) get(ctx context.Context, id string) (*storedJob, error) {
+	data, err := r.client.Get(ctx, r.jobKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job storedJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// save stores a run and indexes it, keeping the latest limit runs of its tenant.
+func (r *redisJobs) save(ctx context.Context, job storedJob, limit int) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	index := r.indexKey(job.Tenant)
+	_, err = r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, r.jobKey(job.ID), data, r.ttl)
+		p.ZAdd(ctx, index, redis.Z{Score: float64(job.StartedAt.UnixMicro()), Member: job.ID})
+		p.ZRemRangeByRank(ctx, index, 0, int64(-limit-1))
+		p.Expire(ctx, index, r.ttl)
+		p.SAdd(ctx, r.tenantsKey(), job.Tenant)
+		return nil
+	})
+	return err
+}
+
+// list returns the runs of tenant, or of all tenants, in no particular order.
+func (r *redisJobs) list(ctx context.Context, tenant string, all bool) ([]storedJob, error) {
+	tenants := []string{tenant}
+	if all {
+		var err error
+		if tenants, err = r.client.SMembers(ctx, r.tenantsKey()).Result(); err != nil {
+			return nil, err
+		}
+	}
+	var keys []string
+	for _, t := range tenants {
+		ids, err := r.client.ZRange(ctx, r.indexKey(t), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			keys = append(keys, r.jobKey(id))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	vals, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]storedJob, 0, len(vals))
+	for i, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			// Expired since it was indexed
+			continue
+		}
+		var job storedJob
+		if err := json.Unmarshal([]byte(s), &job); err != nil {
+			slog.WarnContext(ctx, "Skipping unreadable job record", "key", keys[i], "error", err)
+			continue
+		}
+		out = append(out, job)
+	}
+	return out, nil
+}
+
+// snapshotLocked copies rec for store, or returns nil when the store does not use Redis.
+func (s *JobStore) snapshotLocked(rec *JobRecord) *storedJob {
+	if s.redis == nil {
+		return nil
+	}
+	return &storedJob{JobRecord: *rec, RetryParams: rec.params, RowFilters: rec.params.rowFilters, TenantConfig: rec.tenant}
+}
+
+// store writes a snapshot of a run to Redis. A failed write is logged: the run goes on,
+// but other instances may see an outdated record.
+func (s *JobStore) store(job *storedJob) {
+	if job == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.redis.save(ctx, *job, s.limit); err != nil {
+		slog.Error("Failed to store job record", "job_id", job.ID, "error", err)
+	}
+}
+
+// storedRuns returns the runs Redis holds for the caller in ctx, as records ready for
+// retries, or false when the store does not use Redis or it could not be read.
+func (s *JobStore) storedRuns(ctx context.Context) ([]JobRecord, bool) {
+	if s.redis == nil {
+		return nil, false
+	}
+	tenant, _, isTenant := TenantFrom(ctx)
+	jobs, err := s.redis.list(ctx, tenant, !isTenant)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read the job store; listing this instance's runs", "error", err)
+		return nil, false
+	}
+	out := make([]JobRecord, len(jobs))
+	for i, job := range jobs {
+		rec := job.JobRecord
+		rec.params, rec.tenant = job.RetryParams, job.TenantConfig
+		rec.params.rowFilters = job.RowFilters
+		out[i] = rec
+	}
+	return out, true
+}
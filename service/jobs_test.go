@@ -0,0 +1,248 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"cmp"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestExporterRetry(t *testing.T) {
+	bq := &fakeBigQuery{err: errors.New("backend error")}
+	tenant := config.Tenant{OutputPrefix: "gs://exports/a/"}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{Tenants: map[string]config.Tenant{"a": tenant}})
+	ctx := WithTenant(logging.WithRequestID(context.Background(), "run-1"), "a", tenant)
+
+	if _, err := e.Run(ctx, ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Name: "visits"}); err == nil {
+		t.Fatal("Run() error = nil, want backend error")
+	}
+	if _, err := e.Retry(ctx, "missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("Retry(missing) error = %v, want ErrJobNotFound", err)
+	}
+
+	// The admin retries the tenant's job; it still runs as the tenant, with the row
+	// filter the tenant has been given since
+	bq.err = nil
+	e.Tenants = map[string]config.Tenant{"a": {OutputPrefix: "gs://exports/a/", RowFilter: "site = 'A'"}}
+	admin := logging.WithRequestID(context.Background(), "run-2")
+	if _, err := e.Retry(admin, "run-1"); err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	if len(bq.queries) == 0 || !strings.Contains(bq.queries[len(bq.queries)-1], "site = 'A'") {
+		t.Errorf("retry queries = %v, want the tenant's current row filter", bq.queries)
+	}
+	retry, ok := e.Jobs.Get(ctx, "run-2")
+	if !ok || retry.RetryOf != "run-1" || retry.Status != JobSucceeded || retry.Name != "visits" {
+		t.Fatalf("retry record = %+v, want succeeded retry of run-1 for tenant a", retry)
+	}
+	if _, err := e.Retry(admin, "run-2"); !errors.Is(err, ErrJobNotRetryable) {
+		t.Fatalf("Retry(succeeded) error = %v, want ErrJobNotRetryable", err)
+	}
+
+	// Jobs of a tenant removed from the configuration are not retried
+	bq.err = errors.New("backend error")
+	e.Run(WithTenant(logging.WithRequestID(context.Background(), "run-3"), "a", tenant), ExportParams{Query: "SELECT 1", QueryLocation: "US"})
+	e.Tenants = nil
+	if _, err := e.Retry(admin, "run-3"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Retry() of a removed tenant's job error = %v, want ErrForbidden", err)
+	}
+}
+
+func TestJobDiff(t *testing.T) {
+	e := NewExporter(&fakeBigQuery{}, NewGCSDriver(nil, nil), &config.Config{})
+	run := func(id string, p ExportParams) {
+		t.Helper()
+		p.QueryLocation, p.Name = "US", cmp.Or(p.Name, "visits")
+		e.Run(logging.WithRequestID(context.Background(), id), p)
+	}
+	run("mon", ExportParams{Query: "SELECT id,\n  site\nFROM ds.visits", Output: "gs://b/v/", Limit: 10})
+	run("other", ExportParams{Query: "SELECT 1", Name: "other"})
+	run("tue", ExportParams{Query: "SELECT id,\n  site,\n  ward\nFROM ds.visits", Output: "gs://b/v/", CSVBOM: true})
+
+	rec, _ := e.Jobs.Get(context.Background(), "tue")
+	if rec.Params["csv_bom"] != true || rec.Params["output"] != "gs://b/v/" || rec.Params["limit"] != nil {
+		t.Errorf("Params = %v", rec.Params)
+	}
+	d, err := e.Jobs.Diff(context.Background(), "tue", "")
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	if d.From != "mon" || len(d.Changes) != 3 || d.Changes[0].Param != "csv_bom" || d.Changes[1].Param != "limit" || d.Changes[1].To != nil || d.Changes[2].Param != "query" {
+		t.Errorf("Diff() = %+v", d)
+	}
+	if got := strings.Join(d.QueryDiff, "|"); got != "  SELECT id,|-   site|+   site,|+   ward|  FROM ds.visits" {
+		t.Errorf("QueryDiff = %s", got)
+	}
+	if d, err := e.Jobs.Diff(context.Background(), "tue", "other"); err != nil || d.From != "other" {
+		t.Errorf("Diff(against other) = %+v, %v", d, err)
+	}
+	if _, err := e.Jobs.Diff(context.Background(), "mon", ""); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Diff() of the first run error = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestDuplicateRun(t *testing.T) {
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	run := func(id string, p ExportParams) (ExportResult, error) {
+		t.Helper()
+		p.Query, p.QueryLocation, p.Output, p.SnapshotTime = "SELECT 1", "US", "gs://b/v/", "now"
+		return e.Run(logging.WithRequestID(context.Background(), id), p)
+	}
+	if _, err := run("first", ExportParams{LogicalDate: "2026-10-13"}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	// A scheduler retry of the same logical date, at a later "now" and priority
+	res, err := run("retry", ExportParams{LogicalDate: "2026-10-13", Priority: "batch"})
+	if err != nil || res.DuplicateOf != "first" {
+		t.Fatalf("Run(retry) = %+v, %v, want a duplicate of first", res, err)
+	}
+	if rec, _ := e.Jobs.Get(context.Background(), "retry"); rec.Status != JobSucceeded || rec.DuplicateOf != "first" {
+		t.Errorf("retry record = %+v, want a succeeded duplicate of first", rec)
+	}
+	if len(bq.queries) != 1 {
+		t.Errorf("queries = %d, want the retry answered without a query", len(bq.queries))
+	}
+
+	// Another logical date, or no logical date, exports again
+	if res, _ := run("next", ExportParams{LogicalDate: "2026-10-14T02:00:00Z"}); res.DuplicateOf != "" {
+		t.Errorf("Run(next) is a duplicate of %s", res.DuplicateOf)
+	}
+	if res, _ := run("adhoc", ExportParams{}); res.DuplicateOf != "" {
+		t.Errorf("Run(adhoc) is a duplicate of %s", res.DuplicateOf)
+	}
+	if len(bq.queries) != 3 {
+		t.Errorf("queries = %d, want 3", len(bq.queries))
+	}
+
+	// An identical run still in progress rejects the retry
+	running, _ := e.Jobs.start(context.Background(), "GCS", ExportParams{LogicalDate: "2026-10-15"}, "f")
+	if dup, prior := e.Jobs.start(context.Background(), "GCS", ExportParams{LogicalDate: "2026-10-15"}, "f"); prior == nil || prior.ID != running.ID {
+		t.Errorf("start() prior = %+v, want %s", prior, running.ID)
+	} else if _, err := e.Jobs.answerDuplicate(dup, *prior); !errors.Is(err, ErrDuplicateRun) {
+		t.Errorf("answerDuplicate() error = %v, want ErrDuplicateRun", err)
+	}
+
+	// A duplicate reports the whole outcome of the run it copies
+	orig, _ := e.Jobs.start(context.Background(), "GCS", ExportParams{LogicalDate: "2026-10-16"}, "g")
+	want := ExportResult{
+		GCSPath: "gs://b/v/", Rows: 40, Job: QueryJob{ProjectID: "p", ID: "job_9", Location: "EU"},
+		Deidentification: &DeidAudit{Profile: "share", KeyID: "k"},
+		Assertions:       []AssertionResult{{Name: "rows", Check: "row_count", Passed: true, Observed: "40"}},
+		QualityReport:    &QualityReport{Success: true, RunID: orig.ID},
+		Files:            2, BytesWritten: 512, BytesProcessed: 4096,
+		Sample:   &RowSample{Columns: []string{"id"}},
+		Warnings: []string{"labels: denied"},
+	}
+	e.Jobs.finish(orig, want, nil)
+	dup, prior := e.Jobs.start(context.Background(), "GCS", ExportParams{LogicalDate: "2026-10-16"}, "g")
+	if prior == nil {
+		t.Fatal("start() found no prior run")
+	}
+	got, err := e.Jobs.answerDuplicate(dup, *prior)
+	want.DuplicateOf = orig.ID
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("answerDuplicate() = %+v, %v, want %+v", got, err, want)
+	}
+	origRec, _ := e.Jobs.Get(context.Background(), orig.ID)
+	dupRec, _ := e.Jobs.Get(context.Background(), dup.ID)
+	origRec.ID, origRec.StartedAt, origRec.FinishedAt, origRec.DuplicateOf = dupRec.ID, dupRec.StartedAt, dupRec.FinishedAt, dupRec.DuplicateOf
+	if !reflect.DeepEqual(dupRec, origRec) {
+		t.Errorf("duplicate record = %+v, want the outcome of %+v", dupRec, origRec)
+	}
+
+	if _, err := run("bad", ExportParams{LogicalDate: "yesterday"}); FailureClass(err) != FailureConfig {
+		t.Errorf("Run(invalid logical date) error = %v, want a config error", err)
+	}
+
+	e.Jobs.duplicateWindow = 0
+	if res, _ := run("again", ExportParams{LogicalDate: "2026-10-13"}); res.DuplicateOf != "" {
+		t.Errorf("Run() with detection disabled is a duplicate of %s", res.DuplicateOf)
+	}
+}
+
+func TestRedisJobStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("JOB_STORE_URL", "redis://"+mr.Addr())
+	t.Setenv("JOB_TTL", "1h")
+	// Each exporter is an instance, or the service after a restart
+	tenant := config.Tenant{OutputPrefix: "gs://exports/a/", RowFilter: "site = 'A'"}
+	instance := func(bq *fakeBigQuery) *Exporter {
+		t.Helper()
+		e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{Tenants: map[string]config.Tenant{"a": tenant}})
+		jobs, err := NewJobStoreFromEnv(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { jobs.Close() })
+		e.Jobs = jobs
+		return e
+	}
+	ctx := WithTenant(logging.WithRequestID(context.Background(), "run-1"), "a", tenant)
+	failing := &fakeBigQuery{err: errors.New("backend error")}
+	first := instance(failing)
+	if _, err := first.Run(ctx, ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Name: "visits"}); err == nil {
+		t.Fatal("Run() error = nil, want backend error")
+	}
+
+	bq := &fakeBigQuery{}
+	second := instance(bq)
+	rec, ok := second.Jobs.Get(context.Background(), "run-1")
+	if !ok || rec.Status != JobFailed || rec.Tenant != "a" || rec.Error == "" {
+		t.Fatalf("record on another instance = %+v, %v, want the failed run", rec, ok)
+	}
+	if _, ok := second.Jobs.Get(WithTenant(context.Background(), "b", config.Tenant{}), "run-1"); ok {
+		t.Error("run of tenant a is visible to tenant b")
+	}
+	// The retry runs as the tenant, with its row filter
+	if _, err := second.Retry(logging.WithRequestID(context.Background(), "run-2"), "run-1"); err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	if len(bq.queries) == 0 || !strings.Contains(bq.queries[len(bq.queries)-1], "site = 'A'") {
+		t.Errorf("retry queries = %v, want the tenant's row filter", bq.queries)
+	}
+	if runs := first.Jobs.List(ctx); len(runs) != 2 || runs[0].ID != "run-2" || runs[0].RetryOf != "run-1" || runs[0].Status != JobSucceeded {
+		t.Errorf("runs on the first instance = %+v, want the retry first", runs)
+	}
+
+	// Identical runs of a logical date are detected across instances
+	failing.err = nil
+	p := ExportParams{Query: "SELECT 2", QueryLocation: "US", Output: "gs://b/v/", LogicalDate: "2026-10-13"}
+	if _, err := first.Run(logging.WithRequestID(context.Background(), "daily-1"), p); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := second.Run(logging.WithRequestID(context.Background(), "daily-2"), p); err != nil || res.DuplicateOf != "daily-1" {
+		t.Errorf("Run() on another instance = %+v, %v, want a duplicate of daily-1", res, err)
+	}
+
+	// Of identical runs started together, the one claiming the fingerprint runs
+	claimed, _ := first.Jobs.start(logging.WithRequestID(context.Background(), "claim-1"), "GCS_PARQUET", p, "fp")
+	if dup, prior := second.Jobs.start(logging.WithRequestID(context.Background(), "claim-2"), "GCS_PARQUET", p, "fp"); prior == nil || prior.ID != "claim-1" {
+		t.Errorf("start() on another instance prior = %+v, want claim-1", prior)
+	} else if _, err := second.Jobs.answerDuplicate(dup, *prior); !errors.Is(err, ErrDuplicateRun) {
+		t.Errorf("answerDuplicate() error = %v, want ErrDuplicateRun", err)
+	}
+	if !mr.Exists("bq-exporter:fingerprint::fp") {
+		t.Error("no fingerprint claim in Redis")
+	}
+	// The claim of a failed run is taken over
+	first.Jobs.finish(claimed, ExportResult{}, errors.New("backend error"))
+	if _, prior := second.Jobs.start(logging.WithRequestID(context.Background(), "claim-3"), "GCS_PARQUET", p, "fp"); prior != nil {
+		t.Errorf("start() after the claiming run failed prior = %+v, want none", prior)
+	}
+	if holder, _ := mr.Get("bq-exporter:fingerprint::fp"); holder != "claim-3" {
+		t.Errorf("fingerprint claim = %q, want claim-3", holder)
+	}
+
+	mr.FastForward(2 * time.Hour)
+	if runs := second.Jobs.List(context.Background()); len(runs) != 0 {
+		t.Errorf("runs after the TTL = %d, want 0", len(runs))
+	}
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// Placeholders of label values and descriptions, filled in when the destination is
+// labelled: the pipeline and logical name of the export, the time of the load (ISO 8601
+// basic format, e.g. 20261014T090000Z, which fits BigQuery label values) and the run's
+// request ID.
+const (
+	labelPipeline    = "{pipeline}"
+	labelName        = "{name}"
+	labelRefreshedAt = "{refreshed_at}"
+	labelRunID       = "{run_id}"
+)
+
+// labelKeyPattern is the label key syntax of BigQuery, which the other destinations
+// accept too.
+var labelKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+// checkLabels rejects labels and descriptions for destinations they cannot be attached to.
+func checkLabels(p ExportParams, driver string) error {
+	if len(p.Labels) == 0 && p.Description == "" {
+		return nil
+	}
+	if !driverCapabilities(driver).Labels {
+		return fmt.Errorf("labels and description are not supported by the %s driver", driver)
+	}
+	for k := range p.Labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key %q; expected lowercase letters, digits, _ and -, starting with a letter", k)
+		}
+	}
+	return nil
+}
+
+// renderLabels fills in the placeholders of the labels and description of params for a
+// load finished at at.
+func renderLabels(ctx context.Context, params ExportParams, at time.Time) (map[string]string, string) {
+	r := strings.NewReplacer(
+		labelPipeline, params.Pipeline,
+		labelName, params.Name,
+		labelRefreshedAt, at.UTC().Format("20060102T150405Z"),
+		labelRunID, logging.RequestID(ctx),
+	)
+	labels := make(map[string]string, len(params.Labels))
+	for k, v := range params.Labels {
+		labels[k] = r.Replace(v)
+	}
+	return labels, r.Replace(params.Description)
+}
+
+// labelDestination attaches the labels and description of params to the destination of
+// res: as the labels and description of a BigQuery table, the comment of a StarRocks
+// table, or the custom metadata of the files written to Cloud Storage.
+func (e *Exporter) labelDestination(ctx context.Context, bq BigQueryClient, params ExportParams, res ExportResult) error {
+	labels, description := renderLabels(ctx, params, time.Now())
+	switch e.Driver.Name() {
+	case "BIGQUERY":
+		// SET OPTIONS replaces the labels; keep those managed elsewhere
+		existing, err := bigQueryTableLabels(ctx, bq, res.Table, cmp.Or(params.DestinationLocation, params.QueryLocation))
+		if err != nil {
+			return fmt.Errorf("failed to read the labels of table %s: %w", res.Table, err)
+		}
+		maps.Copy(existing, labels)
+		stmt := bigQueryLabelsSQL(res.Table, existing, description)
+		if _, err := bq.RunQuery(ctx, stmt, cmp.Or(params.DestinationLocation, params.QueryLocation)); err != nil {
+			return fmt.Errorf("failed to label table %s: %w", res.Table, err)
+		}
+	case "STARROCKS":
+		d, ok := e.Driver.(*StarRocksDriver)
+		if !ok {
+			return fmt.Errorf("labelling the destination needs the StarRocks service")
+		}
+		db, tbl := d.sr.parseDBTable(res.Table)
+		stmt := fmt.Sprintf("ALTER TABLE %s.%s COMMENT = %s", quoteSRIdent(db), quoteSRIdent(tbl), quoteSRString(starRocksComment(labels, description)))
+		recordStatement(ctx, StatementStarRocks, stmt)
+		if _, err := d.sr.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to label table %s: %w", res.Table, err)
+		}
+	default:
+		if e.GCS == nil {
+			return fmt.Errorf("labelling files needs a Cloud Storage client")
+		}
+		if description != "" {
+			labels["description"] = description
+		}
+		n, err := e.labelFiles(ctx, res.GCSPath, labels)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Labelled exported files", "gcs_path", res.GCSPath, "files", n, "labels", slices.Sorted(maps.Keys(labels)))
+		return nil
+	}
+	slog.InfoContext(ctx, "Labelled destination table", "table", res.Table, "labels", slices.Sorted(maps.Keys(labels)))
+	return nil
+}
+
+// labelFiles sets metadata on the files of pattern, a gs:// file or wildcard pattern, and
+// returns their number. Other metadata of the files is kept.
+func (e *Exporter) labelFiles(ctx context.Context, pattern string, metadata map[string]string) (int, error) {
+	bucket, name, err := parseGCSURI(pattern)
+	if err != nil {
+		return 0, err
+	}
+	prefix, _, _ := strings.Cut(name, "*")
+	objs, err := e.GCS.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, o := range objs {
+		if ok, _ := path.Match(name, o.Name); !ok {
+			continue
+		}
+		if err := e.GCS.SetMetadata(ctx, bucket, o.Name, metadata); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no exported file matches %s", pattern)
+	}
+	return n, nil
+}
+
+// bigQueryLabelOption matches a label of the labels option in INFORMATION_SCHEMA, e.g.
+// STRUCT("team", "data"); label keys and values hold no quotes.
+var bigQueryLabelOption = regexp.MustCompile(`STRUCT\("([^"]*)", "([^"]*)"\)`)
+
+// bigQueryTableLabels reads the labels table has now.
+func bigQueryTableLabels(ctx context.Context, bq BigQueryClient, table, location string) (map[string]string, error) {
+	dataset, name := table[:max(strings.LastIndex(table, "."), 0)], table[strings.LastIndex(table, ".")+1:]
+	q := fmt.Sprintf("SELECT option_value FROM %s.INFORMATION_SCHEMA.TABLE_OPTIONS WHERE table_name = %s AND option_name = 'labels'",
+		quoteBigQueryTable(dataset), quoteBigQueryString(name))
+	it, err := bq.ReadRows(ctx, q, location)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	labels := map[string]string{}
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return labels, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) == 0 {
+			continue
+		}
+		v, _ := row[0].(string)
+		for _, m := range bigQueryLabelOption.FindAllStringSubmatch(v, -1) {
+			labels[m[1]] = m[2]
+		}
+	}
+}
+
+// bigQueryLabelsSQL sets the labels and description of table. The labels replace those
+// of the table, so callers merge in its existing ones; values are lowercased and their
+// other characters BigQuery rejects replaced with _.
+func bigQueryLabelsSQL(table string, labels map[string]string, description string) string {
+	var opts []string
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels))
+		for _, k := range slices.Sorted(maps.Keys(labels)) {
+			pairs = append(pairs, fmt.Sprintf("(%s, %s)", quoteBigQueryString(k), quoteBigQueryString(bigQueryLabelValue(labels[k]))))
+		}
+		opts = append(opts, "labels = ["+strings.Join(pairs, ", ")+"]")
+	}
+	if description != "" {
+		opts = append(opts, "description = "+quoteBigQueryString(description))
+	}
+	return fmt.Sprintf("ALTER TABLE %s SET OPTIONS (%s)", quoteBigQueryTable(table), strings.Join(opts, ", "))
+}
+
+// bigQueryLabelValue is v as a BigQuery label value: at most 63 lowercase letters,
+// digits, _ and -.
+func bigQueryLabelValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, v)
+	return v[:min(len(v), 63)]
+}
+
+// starRocksComment is the table comment carrying labels, which StarRocks tables have no
+// other place for: the description, then the labels as key=value pairs.
+func starRocksComment(labels map[string]string, description string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	if len(pairs) == 0 {
+		return description
+	}
+	if description == "" {
+		return strings.Join(pairs, ", ")
+	}
+	return description + " (" + strings.Join(pairs, ", ") + ")"
+}
+
+func quoteSRString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
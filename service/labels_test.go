@@ -0,0 +1,86 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestLabelDestination(t *testing.T) {
+	ctx := logging.WithRequestID(context.Background(), "run1")
+	params := ExportParams{
+		Pipeline:    "daily_visits",
+		Labels:      map[string]string{"owner": "Data Team", "pipeline": "{pipeline}", "refreshed_at": "{refreshed_at}"},
+		Description: "Visits of {pipeline}, run {run_id}",
+	}
+
+	// Labels managed elsewhere are kept; those of the export win
+	bq := &fakeBigQuery{rows: [][]bigquery.Value{{`[STRUCT("cost_center", "cc-12"), STRUCT("owner", "someone_else")]`}}}
+	e := NewExporter(bq, NewBigQueryTableDriver(nil, nil), &config.Config{})
+	if err := e.labelDestination(ctx, bq, params, ExportResult{Table: "p.mart.visits"}); err != nil {
+		t.Fatalf("labelDestination() error = %v", err)
+	}
+	if len(bq.queries) != 2 || bq.queries[0] != "SELECT option_value FROM `p.mart`.INFORMATION_SCHEMA.TABLE_OPTIONS WHERE table_name = 'visits' AND option_name = 'labels'" {
+		t.Fatalf("queries = %q, want the existing labels read first", bq.queries)
+	}
+	if !strings.HasPrefix(bq.queries[1], "ALTER TABLE `p.mart.visits` SET OPTIONS (labels = [('cost_center', 'cc-12'), ('owner', 'data_team'), ('pipeline', 'daily_visits'), ('refreshed_at', '20") ||
+		!strings.HasSuffix(bq.queries[1], "description = 'Visits of daily_visits, run run1')") {
+		t.Errorf("queries = %q", bq.queries)
+	}
+	bq.rows = nil
+
+	gcs := newFakeGCS(t)
+	gcs.objects["out/visits-000000000000.parquet"] = []byte("1")
+	gcs.objects["out/visits-000000000001.parquet"] = []byte("2")
+	gcs.objects["out/visits.schema.json"] = []byte("{}")
+	e = NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	e.GCS = gcs.service(t)
+	if err := e.labelDestination(ctx, bq, params, ExportResult{GCSPath: "gs://b/out/visits-*.parquet"}); err != nil {
+		t.Fatalf("labelDestination() files error = %v", err)
+	}
+	if len(gcs.metadata) != 2 || gcs.metadata["out/visits-000000000001.parquet"]["owner"] != "Data Team" ||
+		gcs.metadata["out/visits-000000000000.parquet"]["description"] != "Visits of daily_visits, run run1" {
+		t.Errorf("metadata = %v, want the labels on the two files", gcs.metadata)
+	}
+	if err := e.labelDestination(ctx, bq, params, ExportResult{GCSPath: "gs://b/other/*.parquet"}); err == nil {
+		t.Error("labelDestination() without files error = nil, want an error")
+	}
+
+	// A committed export that cannot be labelled succeeds with a warning
+	res, err := e.Run(ctx, ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/other/", Labels: params.Labels})
+	if err != nil || len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "no exported file matches") {
+		t.Errorf("Run(labels fail) = %v, %v, want success with a warning", res.Warnings, err)
+	}
+}
+
+func TestCheckLabels(t *testing.T) {
+	for _, tt := range []struct {
+		driver string
+		p      ExportParams
+		ok     bool
+	}{
+		{"STARROCKS", ExportParams{Labels: map[string]string{"owner": "x"}}, true},
+		{sqliteDriverName, ExportParams{Description: "extract"}, true},
+		{"BIGQUERY", ExportParams{Labels: map[string]string{"Owner": "x"}}, false},
+		{redisDriverName, ExportParams{Labels: map[string]string{"owner": "x"}}, false},
+		{redisDriverName, ExportParams{}, true},
+	} {
+		if err := checkLabels(tt.p, tt.driver); (err == nil) != tt.ok {
+			t.Errorf("checkLabels(%+v, %s) error = %v, want ok %v", tt.p, tt.driver, err, tt.ok)
+		}
+	}
+}
+
+func TestStarRocksComment(t *testing.T) {
+	labels := map[string]string{"pipeline": "daily", "owner": "data-team"}
+	if got := starRocksComment(labels, "Visits"); got != "Visits (owner=data-team, pipeline=daily)" {
+		t.Errorf("starRocksComment() = %q", got)
+	}
+	if got := quoteSRString(`it's`); got != `'it\'s'` {
+		t.Errorf("quoteSRString() = %s", got)
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Lineage columns appended to the exported rows with ExportParams.LineageColumns.
+const (
+	// LineageJobIDColumn is the job ID of the export run (see /api/jobs)
+	LineageJobIDColumn = "_export_job_id"
+	// LineageExportedAtColumn is when the run submitted its export query
+	LineageExportedAtColumn = "_exported_at"
+	// LineageQueryHashColumn is the SHA-256 of the source query (see sourceQueryHash)
+	LineageQueryHashColumn = "_source_query_hash"
+)
+
+// lineageQuery appends the lineage columns of the run in ctx to the result of query.
+// source is the export as requested, before diff or change history exports rewrote its
+// query.
+func lineageQuery(ctx context.Context, query string, source ExportParams) string {
+	at := time.Now()
+	return fmt.Sprintf("SELECT *, %s AS %s, %s AS %s, %s AS %s FROM (%s)",
+		quoteBigQueryString(logging.RequestID(ctx)), LineageJobIDColumn,
+		bigQueryTimestamp(at), LineageExportedAtColumn,
+		quoteBigQueryString(sourceQueryHash(source)), LineageQueryHashColumn,
+		query)
+}
+
+// lineageSchema is the schema of the lineage columns.
+func lineageSchema() bigquery.Schema {
+	return bigquery.Schema{
+		{Name: LineageJobIDColumn, Type: bigquery.StringFieldType},
+		{Name: LineageExportedAtColumn, Type: bigquery.TimestampFieldType},
+		{Name: LineageQueryHashColumn, Type: bigquery.StringFieldType},
+	}
+}
+
+// sourceQueryHash identifies the source of an export: the hex SHA-256 of its query (the
+// rendered query of pipelines) and, for change history exports, its source table. Runs
+// of the same source share the hash.
+func sourceQueryHash(p ExportParams) string {
+	src := p.Query
+	if p.ChangesTable != "" {
+		src = "changes_table " + p.ChangesTable + "\n" + src
+	}
+	sum := sha256.Sum256([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
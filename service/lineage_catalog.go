@@ -0,0 +1,322 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	datalineage "google.golang.org/api/datalineage/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// lineageTimeout bounds the lineage reports of one export.
+const lineageTimeout = 30 * time.Second
+
+// LineageEmitter reports the lineage of successful exports, from the BigQuery tables their
+// query read to their destination, to the Dataplex Data Lineage API and to DataHub, so
+// catalogs show where the exported tables and files come from. Lineage is table-level:
+// BigQuery reports the tables a query read, not which of their columns feed which result
+// column.
+type LineageEmitter struct {
+	// dataplex is nil unless lineage goes to Dataplex, under parent
+	dataplex *datalineage.Service
+	parent   string
+
+	// datahubURL is the DataHub GMS server, if lineage goes to DataHub
+	datahubURL   string
+	datahubToken string
+	datahubEnv   string
+	client       *http.Client
+
+	// pending counts the lineage being reported in the background
+	pending sync.WaitGroup
+}
+
+// NewLineageEmitterFromEnv returns nil unless lineage is configured:
+// LINEAGE_DATAPLEX_LOCATION (e.g. us) reports it to Dataplex in project
+// LINEAGE_PROJECT_ID (default project), with the service's credentials in opts;
+// LINEAGE_DATAHUB_URL reports it to that DataHub server, authenticated with
+// LINEAGE_DATAHUB_TOKEN, for datasets of the environment LINEAGE_DATAHUB_ENV
+// (default PROD).
+func NewLineageEmitterFromEnv(ctx context.Context, project string, opts ...option.ClientOption) (*LineageEmitter, error) {
+	location, hub := os.Getenv("LINEAGE_DATAPLEX_LOCATION"), os.Getenv("LINEAGE_DATAHUB_URL")
+	if location == "" && hub == "" {
+		return nil, nil
+	}
+	l := &LineageEmitter{client: &http.Client{Timeout: lineageTimeout}}
+	if location != "" {
+		if p := os.Getenv("LINEAGE_PROJECT_ID"); p != "" {
+			project = p
+		}
+		if project == "" {
+			return nil, ConfigError(fmt.Errorf("LINEAGE_DATAPLEX_LOCATION needs LINEAGE_PROJECT_ID or GCP_PROJECT_ID"))
+		}
+		svc, err := datalineage.NewService(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Data Lineage client: %w", err)
+		}
+		l.dataplex, l.parent = svc, fmt.Sprintf("projects/%s/locations/%s", project, location)
+	}
+	if hub != "" {
+		u, err := url.Parse(hub)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, ConfigError(fmt.Errorf("invalid LINEAGE_DATAHUB_URL %q; expected the http(s) URL of the DataHub GMS server", hub))
+		}
+		l.datahubURL = strings.TrimSuffix(hub, "/")
+		l.datahubToken = os.Getenv("LINEAGE_DATAHUB_TOKEN")
+		l.datahubEnv = "PROD"
+		if env := os.Getenv("LINEAGE_DATAHUB_ENV"); env != "" {
+			l.datahubEnv = env
+		}
+	}
+	return l, nil
+}
+
+// lineageEntity is a source or destination of lineage: the system holding it and its
+// name there, e.g. bigquery and project.dataset.table.
+type lineageEntity struct {
+	system string
+	name   string
+}
+
+// fqn is the fully qualified name of the entity in Dataplex.
+func (e lineageEntity) fqn() string {
+	if e.system == "gcs" {
+		// gcs:<bucket>.<path>
+		bucket, prefix, _ := strings.Cut(e.name, "/")
+		return "gcs:" + bucket + "." + prefix
+	}
+	return e.system + ":" + e.name
+}
+
+// datahubURN is the URN of the entity as a DataHub dataset of env.
+func (e lineageEntity) datahubURN(env string) string {
+	return fmt.Sprintf("urn:li:dataset:(urn:li:dataPlatform:%s,%s,%s)", e.system, e.name, env)
+}
+
+// lineageDestination returns the destination of an export, if it has one lineage can
+// name: the table of table drivers, or the folder of the files of file drivers.
+func lineageDestination(driver string, res ExportResult) (lineageEntity, bool) {
+	switch driver {
+	case "BIGQUERY":
+		table := res.Table
+		if strings.Count(table, ".") == 1 && res.Job.ProjectID != "" {
+			table = res.Job.ProjectID + "." + table
+		}
+		return lineageEntity{"bigquery", table}, table != ""
+	case "STARROCKS":
+		return lineageEntity{"starrocks", res.Table}, res.Table != ""
+	}
+	if u, err := url.Parse(res.GCSPath); err == nil && u.Host != "" {
+		// A pattern or file stands for the files of its folder
+		dir := path.Dir(strings.TrimPrefix(u.Path, "/"))
+		name := u.Host
+		if dir != "." {
+			name += "/" + dir
+		}
+		switch u.Scheme {
+		case "gs":
+			return lineageEntity{"gcs", name}, true
+		case "az":
+			return lineageEntity{"abs", name}, true
+		case "drive":
+			return lineageEntity{"gdrive", name}, true
+		}
+	}
+	return lineageEntity{strings.ToLower(driver), res.Table}, res.Table != ""
+}
+
+// reportLineage reports the lineage of a successful export in the background, so slow or
+// unreachable catalogs never hold it up. Under deferred swaps it waits for its table to
+// be swapped into place, and is dropped if it is not.
+func (e *Exporter) reportLineage(ctx context.Context, bq BigQueryClient, params ExportParams, probe string, res ExportResult, started time.Time) {
+	ctx = context.WithoutCancel(ctx)
+	report := func() {
+		e.Lineage.pending.Go(func() { e.emitLineage(ctx, bq, params, probe, res, started) })
+	}
+	if swaps := deferredSwapsFrom(ctx); swaps != nil {
+		swaps.finishAfter(res.Table, func(err error) {
+			if err == nil {
+				report()
+			}
+		})
+		return
+	}
+	report()
+}
+
+// Wait blocks until the lineage reported in the background is delivered, or ctx is done.
+func (l *LineageEmitter) Wait(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		l.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.WarnContext(ctx, "Lineage still being reported at shutdown", "error", ctx.Err())
+	}
+}
+
+// emitLineage reports the lineage of a successful export, started at started; probe is
+// its source query. Failures are logged: lineage never fails an export.
+func (e *Exporter) emitLineage(ctx context.Context, bq BigQueryClient, params ExportParams, probe string, res ExportResult, started time.Time) {
+	dest, ok := lineageDestination(e.Driver.Name(), res)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lineageTimeout)
+	defer cancel()
+	dry, err := bq.DryRun(ctx, probe, params.QueryLocation)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to look up the source tables of the export for lineage", "error", err)
+		return
+	}
+	var sources []lineageEntity
+	for _, t := range dry.ReferencedTables {
+		sources = append(sources, lineageEntity{"bigquery", t})
+	}
+	if len(sources) == 0 {
+		return
+	}
+	if err := e.Lineage.emit(ctx, sources, dest, started, time.Now()); err != nil {
+		slog.WarnContext(ctx, "Failed to report lineage", "destination", dest.fqn(), "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "Reported lineage", "destination", dest.fqn(), "sources", len(sources))
+}
+
+// emit reports that one run read sources to write dest.
+func (l *LineageEmitter) emit(ctx context.Context, sources []lineageEntity, dest lineageEntity, start, end time.Time) error {
+	var errs []error
+	if l.dataplex != nil {
+		if err := l.emitDataplex(ctx, sources, dest, start, end); err != nil {
+			errs = append(errs, fmt.Errorf("dataplex: %w", err))
+		}
+	}
+	if l.datahubURL != "" {
+		if err := l.emitDataHub(ctx, sources, dest, end); err != nil {
+			errs = append(errs, fmt.Errorf("datahub: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// emitDataplex records a run with one lineage event of the process of dest, which all
+// runs into dest share.
+func (l *LineageEmitter) emitDataplex(ctx context.Context, sources []lineageEntity, dest lineageEntity, start, end time.Time) error {
+	sum := sha256.Sum256([]byte(dest.fqn()))
+	process := l.parent + "/processes/bq-exporter-" + hex.EncodeToString(sum[:8])
+	_, err := l.dataplex.Projects.Locations.Processes.Create(l.parent, &datalineage.GoogleCloudDatacatalogLineageV1Process{
+		Name:        process,
+		DisplayName: "bq-exporter to " + dest.fqn(),
+		Origin:      &datalineage.GoogleCloudDatacatalogLineageV1Origin{SourceType: "CUSTOM", Name: "bq-exporter"},
+	}).Context(ctx).Do()
+	if err != nil && !isAlreadyExists(err) {
+		return fmt.Errorf("failed to create process: %w", err)
+	}
+	run := &datalineage.GoogleCloudDatacatalogLineageV1Run{
+		DisplayName: logging.RequestID(ctx),
+		State:       "COMPLETED",
+		StartTime:   start.UTC().Format(time.RFC3339Nano),
+		EndTime:     end.UTC().Format(time.RFC3339Nano),
+	}
+	if id := logging.RequestID(ctx); id != "" {
+		run.Name = process + "/runs/" + id
+	}
+	created, err := l.dataplex.Projects.Locations.Processes.Runs.Create(process, run).Context(ctx).Do()
+	if err != nil && isAlreadyExists(err) && run.Name != "" {
+		// A retried report of the run
+		created, err = run, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create run: %w", err)
+	}
+	event := &datalineage.GoogleCloudDatacatalogLineageV1LineageEvent{StartTime: run.StartTime, EndTime: run.EndTime}
+	for _, src := range sources {
+		event.Links = append(event.Links, &datalineage.GoogleCloudDatacatalogLineageV1EventLink{
+			Source: &datalineage.GoogleCloudDatacatalogLineageV1EntityReference{FullyQualifiedName: src.fqn()},
+			Target: &datalineage.GoogleCloudDatacatalogLineageV1EntityReference{FullyQualifiedName: dest.fqn()},
+		})
+	}
+	if _, err := l.dataplex.Projects.Locations.Processes.Runs.LineageEvents.Create(created.Name, event).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to create lineage event: %w", err)
+	}
+	return nil
+}
+
+func isAlreadyExists(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusConflict
+}
+
+// emitDataHub sets the upstream lineage of dest to sources. The aspect is replaced, so
+// DataHub shows the sources of the latest run.
+func (l *LineageEmitter) emitDataHub(ctx context.Context, sources []lineageEntity, dest lineageEntity, at time.Time) error {
+	type upstream struct {
+		AuditStamp struct {
+			Time  int64  `json:"time"`
+			Actor string `json:"actor"`
+		} `json:"auditStamp"`
+		Dataset string `json:"dataset"`
+		Type    string `json:"type"`
+	}
+	var aspect struct {
+		Upstreams []upstream `json:"upstreams"`
+	}
+	for _, src := range sources {
+		u := upstream{Dataset: src.datahubURN(l.datahubEnv), Type: "TRANSFORMED"}
+		u.AuditStamp.Time, u.AuditStamp.Actor = at.UnixMilli(), "urn:li:corpuser:bq-exporter"
+		aspect.Upstreams = append(aspect.Upstreams, u)
+	}
+	value, err := json.Marshal(aspect)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{"proposal": map[string]any{
+		"entityType": "dataset",
+		"entityUrn":  dest.datahubURN(l.datahubEnv),
+		"changeType": "UPSERT",
+		"aspectName": "upstreamLineage",
+		"aspect":     map[string]string{"value": string(value), "contentType": "application/json"},
+	}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.datahubURL+"/aspects?action=ingestProposal", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-RestLi-Protocol-Version", "2.0.0")
+	if l.datahubToken != "" {
+		req.Header.Set("Authorization", "Bearer "+l.datahubToken)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("DataHub returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
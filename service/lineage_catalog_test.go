@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// fakeCatalogs serves the Data Lineage API and the DataHub ingestion endpoint.
+type fakeCatalogs struct {
+	mu        sync.Mutex
+	processes map[string]bool
+	events    []string
+	proposals []map[string]any
+}
+
+func (f *fakeCatalogs) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	var obj map[string]any
+	json.Unmarshal(body, &obj)
+	switch {
+	case r.URL.Path == "/aspects" && r.URL.Query().Get("action") == "ingestProposal":
+		f.proposals = append(f.proposals, obj["proposal"].(map[string]any))
+	case strings.HasSuffix(r.URL.Path, "/processes"):
+		name := obj["name"].(string)
+		if f.processes[name] {
+			http.Error(w, `{"error": {"code": 409, "message": "exists"}}`, http.StatusConflict)
+			return
+		}
+		f.processes[name] = true
+		w.Write(body)
+	case strings.HasSuffix(r.URL.Path, "/runs"):
+		w.Write(body)
+	case strings.HasSuffix(r.URL.Path, "/lineageEvents"):
+		f.events = append(f.events, r.URL.Path+" "+string(body))
+		w.Write(body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLineageEmitter(t *testing.T) {
+	f := &fakeCatalogs{processes: map[string]bool{}}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	t.Setenv("LINEAGE_DATAPLEX_LOCATION", "us")
+	t.Setenv("LINEAGE_DATAHUB_URL", srv.URL)
+	l, err := NewLineageEmitterFromEnv(context.Background(), "p", option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bq := &fakeBigQuery{referenced: []string{"src.clinical.visits", "src.clinical.sites"}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	e.Lineage = l
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/", Filename: "visits"}
+	for _, id := range []string{"run1", "run2"} {
+		ctx := logging.WithRequestID(context.Background(), id)
+		if _, err := e.Run(ctx, params); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		// Lineage is reported in the background
+		l.Wait(ctx)
+	}
+	if len(f.processes) != 1 {
+		t.Errorf("processes = %v, want one shared by the runs", f.processes)
+	}
+	if len(f.events) != 2 || !strings.Contains(f.events[1], "/runs/run2/lineageEvents") ||
+		!strings.Contains(f.events[1], `"source":{"fullyQualifiedName":"bigquery:src.clinical.visits"},"target":{"fullyQualifiedName":"gcs:b.out"}`) {
+		t.Errorf("lineage events = %v", f.events)
+	}
+	if len(f.proposals) != 2 || f.proposals[0]["entityUrn"] != "urn:li:dataset:(urn:li:dataPlatform:gcs,b/out,PROD)" ||
+		!strings.Contains(f.proposals[0]["aspect"].(map[string]any)["value"].(string), "urn:li:dataPlatform:bigquery,src.clinical.sites,PROD") {
+		t.Errorf("DataHub proposals = %v", f.proposals)
+	}
+
+	// Under deferred swaps, lineage waits for the table to be swapped in
+	ctx, d := withDeferredSwaps(logging.WithRequestID(context.Background(), "run3"))
+	res := ExportResult{GCSPath: "gs://b/out/visits-*.parquet", Table: "db.visits"}
+	for _, commit := range []bool{false, true} {
+		d.add(deferredSwap{table: "db.visits", lock: context.Background(), swap: func(context.Context) error { return nil }, drop: func() {}})
+		e.reportLineage(ctx, bq, params, "SELECT 1", res, time.Now())
+		l.Wait(ctx)
+		if len(f.events) != 2 {
+			t.Fatalf("lineage events before the swaps settled = %d, want 2", len(f.events))
+		}
+		if !commit {
+			d.discard(ctx)
+		} else if err := d.commit(ctx); err != nil {
+			t.Fatalf("commit() error = %v", err)
+		}
+		l.Wait(ctx)
+	}
+	if len(f.events) != 3 || !strings.Contains(f.events[2], "/runs/run3/lineageEvents") {
+		t.Errorf("lineage events = %d, want one more after the commit only", len(f.events))
+	}
+
+	// A failing catalog does not fail the export
+	srv.Close()
+	if _, err := e.Run(context.Background(), params); err != nil {
+		t.Errorf("Run() with the catalogs down error = %v", err)
+	}
+}
+
+func TestLineageDestination(t *testing.T) {
+	for _, tt := range []struct {
+		driver string
+		res    ExportResult
+		want   string
+	}{
+		{"BIGQUERY", ExportResult{Table: "mart.visits", Job: QueryJob{ProjectID: "p"}}, "bigquery:p.mart.visits"},
+		{"STARROCKS", ExportResult{Table: "db.visits"}, "starrocks:db.visits"},
+		{parquetWriteDriverName, ExportResult{GCSPath: "gs://b/out/visits-*.parquet"}, "gcs:b.out"},
+		{azureBlobDriverName, ExportResult{GCSPath: "az://deliveries/site-a/export-*.parquet"}, "abs:deliveries/site-a"},
+		{spannerDriverName, ExportResult{Table: "sites"}, "spanner:sites"},
+	} {
+		got, ok := lineageDestination(tt.driver, tt.res)
+		if !ok || got.fqn() != tt.want {
+			t.Errorf("lineageDestination(%s, %+v) = %s, %v, want %s", tt.driver, tt.res, got.fqn(), ok, tt.want)
+		}
+	}
+	if _, ok := lineageDestination(httpPostDriverName, ExportResult{}); ok {
+		t.Error("lineageDestination() of an HTTP_POST export is ok, want none")
+	}
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRunLineageColumns(t *testing.T) {
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	params := ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/", LineageColumns: true}
+	if _, err := e.Run(ctx, params); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	export := bq.queries[len(bq.queries)-1]
+	for _, want := range []string{
+		"SELECT *, 'req-1' AS _export_job_id, TIMESTAMP '",
+		"AS _exported_at, '" + sourceQueryHash(params) + "' AS _source_query_hash FROM (SELECT * FROM ds.visits)",
+	} {
+		if !strings.Contains(export, want) {
+			t.Errorf("export query %s does not contain %q", export, want)
+		}
+	}
+	if _, ok := e.Jobs.Get(ctx, "req-1"); !ok {
+		t.Error("the lineage job ID is not the job ID in the history")
+	}
+	if sourceQueryHash(params) == sourceQueryHash(ExportParams{Query: "SELECT * FROM ds.visits", ChangesTable: "ds.visits"}) {
+		t.Error("change history exports share the hash of a plain query")
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics holds the counters and gauges of GET /metrics, served in the Prometheus text
+// format. They are per instance and count from its start: sum the counters across the
+// instances of a deployment.
+type Metrics struct {
+	mu     sync.Mutex
+	series map[metricSeries]float64
+}
+
+// metricSeries is a metric with its labels, rendered as name{key="value",...}.
+type metricSeries struct {
+	name, labels string
+}
+
+// metricDefs are the metrics served, by name.
+var metricDefs = map[string]struct{ kind, help string }{
+	"bq_exporter_exports_total":              {"counter", "Exports finished, by driver and status."},
+	"bq_exporter_export_rows_total":          {"counter", "Rows loaded by successful exports, by driver."},
+	"bq_exporter_export_files_total":         {"counter", "Files written by successful exports, by driver."},
+	"bq_exporter_export_bytes_written_total": {"counter", "Bytes of the files written by successful exports, by driver."},
+	"bq_exporter_bytes_processed_total":      {"counter", "BigQuery bytes processed by exports, by driver."},
+	"bq_exporter_pipeline_stale":             {"gauge", "Whether a pipeline is past its freshness SLO (1) or not (0), by pipeline."},
+	"bq_exporter_freshness_breaches_total":   {"counter", "Freshness SLO breaches, by pipeline."},
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{series: map[metricSeries]float64{}}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// seriesOf returns the series of metric name with labels, given as key-value pairs.
+func seriesOf(name string, labels []string) metricSeries {
+	if _, ok := metricDefs[name]; !ok {
+		panic("undefined metric " + name)
+	}
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	return metricSeries{name: name, labels: b.String()}
+}
+
+// add adds v to a counter.
+func (m *Metrics) add(name string, v float64, labels ...string) {
+	k := seriesOf(name, labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series[k] += v
+}
+
+// set sets a gauge to v.
+func (m *Metrics) set(name string, v float64, labels ...string) {
+	k := seriesOf(name, labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series[k] = v
+}
+
+// remove drops a series, e.g. the gauge of a pipeline no longer monitored.
+func (m *Metrics) remove(name string, labels ...string) {
+	k := seriesOf(name, labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.series, k)
+}
+
+// recordExport counts a finished export of driver.
+func (m *Metrics) recordExport(driver string, res ExportResult, err error) {
+	status := string(JobSucceeded)
+	if err != nil {
+		status = string(JobFailed)
+	}
+	m.add("bq_exporter_exports_total", 1, "driver", driver, "status", status)
+	m.add("bq_exporter_bytes_processed_total", float64(res.BytesProcessed), "driver", driver)
+	if err != nil {
+		return
+	}
+	m.add("bq_exporter_export_rows_total", float64(res.Rows), "driver", driver)
+	m.add("bq_exporter_export_files_total", float64(res.Files), "driver", driver)
+	m.add("bq_exporter_export_bytes_written_total", float64(res.BytesWritten), "driver", driver)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	values := maps.Clone(m.series)
+	m.mu.Unlock()
+	series := slices.SortedFunc(maps.Keys(values), func(a, b metricSeries) int {
+		return strings.Compare(a.name+"{"+a.labels, b.name+"{"+b.labels)
+	})
+
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(metricDefs)) {
+		def := metricDefs[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, def.help, name, def.kind)
+		for _, s := range series {
+			if s.name != name {
+				continue
+			}
+			if s.labels != "" {
+				fmt.Fprintf(&b, "%s{%s} %s\n", name, s.labels, strconv.FormatFloat(values[s], 'g', -1, 64))
+			} else {
+				fmt.Fprintf(&b, "%s %s\n", name, strconv.FormatFloat(values[s], 'g', -1, 64))
+			}
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	gcs := newFakeGCS(t)
+	gcs.objects["out/export-000000000000.parquet"] = make([]byte, 64)
+	bq := &fakeBigQuery{bytes: 1000}
+	e := NewExporter(bq, NewGCSDriver(gcs.service(t), nil), &config.Config{})
+	ctx := context.Background()
+	if _, err := e.Run(ctx, ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/"}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	bq.err = errors.New("boom")
+	if _, err := e.Run(ctx, ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/"}); err == nil {
+		t.Fatal("Run() error = nil, want the query error")
+	}
+
+	var out strings.Builder
+	if _, err := e.Metrics.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE bq_exporter_exports_total counter\n",
+		`bq_exporter_exports_total{driver="GCS_PARQUET",status="failed"} 1` + "\n",
+		`bq_exporter_exports_total{driver="GCS_PARQUET",status="succeeded"} 1` + "\n",
+		`bq_exporter_export_files_total{driver="GCS_PARQUET"} 1` + "\n",
+		`bq_exporter_export_bytes_written_total{driver="GCS_PARQUET"} 64` + "\n",
+		`bq_exporter_bytes_processed_total{driver="GCS_PARQUET"} 1000` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMetricLabelsEscaped(t *testing.T) {
+	m := NewMetrics()
+	m.add("bq_exporter_exports_total", 1, "driver", "a\"b\\c\nd", "status", "failed")
+	var out strings.Builder
+	m.WriteTo(&out)
+	if want := `bq_exporter_exports_total{driver="a\"b\\c\nd",status="failed"} 1`; !strings.Contains(out.String(), want) {
+		t.Errorf("metrics = %s, want %s", out.String(), want)
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// destinationNames returns the names of the destination of params the naming policy
+// rules: its database and table, for table drivers, or the name of its files, without
+// folder and extension, for file drivers. Names the driver will reject are left empty.
+func (e *Exporter) destinationNames(params ExportParams) (database, table, file string) {
+	if d, ok := e.Driver.(destinationTabler); ok {
+		t, err := d.destinationTable(params)
+		if err != nil {
+			return "", "", ""
+		}
+		parts := strings.Split(t, ".")
+		return parts[len(parts)-2], parts[len(parts)-1], ""
+	}
+	if !e.Driver.Capabilities().Files {
+		return "", "", ""
+	}
+	out := strings.TrimSuffix(params.Output, "/")
+	if base := path.Base(out); strings.Contains(base, ".") || strings.Contains(base, "*") {
+		// The output names the files: the rule applies to the name before the wildcard,
+		// which the shard numbers replace, so visits-*.parquet is checked as visits
+		name, _, _ := strings.Cut(base, ".")
+		name, _, _ = strings.Cut(name, "*")
+		return "", "", strings.TrimRight(name, "-_")
+	}
+	return "", "", cmp.Or(params.Filename, "export")
+}
+
+// checkNaming checks the destination of params against the naming policy: violations
+// fail the export as a config error, or are only logged with enforcement warn.
+func (e *Exporter) checkNaming(ctx context.Context, params ExportParams) error {
+	violations, err := e.namingViolations(ctx, params)
+	if err != nil || len(violations) == 0 {
+		return err
+	}
+	if e.Naming.Enforcement == config.NamingWarn {
+		slog.WarnContext(ctx, "Destination breaks the naming policy", "violations", violations)
+		return nil
+	}
+	return ConfigError(fmt.Errorf("naming policy: %s", strings.Join(violations, "; ")))
+}
+
+// namingViolations lists the names of the destination of params breaking the naming
+// policy.
+func (e *Exporter) namingViolations(ctx context.Context, params ExportParams) ([]string, error) {
+	n := e.Naming
+	if n.Databases == "" && n.Tables == "" && n.Files == "" {
+		return nil, nil
+	}
+	tenant, _, _ := TenantFrom(ctx)
+	vars := config.NamingVars{Name: params.Name, Pipeline: params.Pipeline, Tenant: tenant}
+	database, table, file := e.destinationNames(params)
+	var violations []string
+	for _, c := range []struct{ kind, name, rule string }{
+		{"database", database, n.Databases},
+		{"table", table, n.Tables},
+		{"file name", file, n.Files},
+	} {
+		if c.name == "" || c.rule == "" {
+			continue
+		}
+		ok, err := config.MatchName(c.rule, c.name, vars)
+		if err != nil {
+			return nil, ConfigError(fmt.Errorf("invalid naming rule %q: %w", c.rule, err))
+		}
+		if !ok {
+			violations = append(violations, fmt.Sprintf("%s %q does not follow the naming convention %s", c.kind, c.name, c.rule))
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"testing"
+)
+
+func TestCheckNaming(t *testing.T) {
+	cfg := &config.Config{Naming: config.NamingPolicy{Databases: "mart|stg", Tables: "(fact|dim)_{name}", Files: "[a-z0-9_]+"}}
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewBigQueryTableDriver(nil, nil), cfg)
+	ctx := context.Background()
+	if err := e.checkNaming(ctx, ExportParams{Name: "visits", Table: "p.mart.fact_visits"}); err != nil {
+		t.Errorf("checkNaming() error = %v", err)
+	}
+	if err := e.checkNaming(ctx, ExportParams{Name: "visits", Table: "Visits_Final", Database: "scratch"}); FailureClass(err) != FailureConfig {
+		t.Errorf("checkNaming() of a mis-named table error = %v, want a config error", err)
+	}
+	if _, err := e.Run(ctx, ExportParams{Name: "visits", Query: "SELECT 1", QueryLocation: "US", Table: "mart.tmp"}); FailureClass(err) != FailureConfig || len(bq.queries) > 0 {
+		t.Errorf("Run() of a mis-named table error = %v after %d queries, want a config error before any", err, len(bq.queries))
+	}
+
+	e = NewExporter(bq, NewGCSDriver(nil, nil), cfg)
+	for _, tt := range []struct {
+		params ExportParams
+		ok     bool
+	}{
+		{ExportParams{Output: "gs://b/out/", Filename: "site_a"}, true},
+		{ExportParams{Output: "gs://b/out/Site A-*.parquet"}, false},
+		{ExportParams{Output: "gs://b/out"}, true},
+		{ExportParams{Output: "gs://b/out/site_a-*.parquet"}, true},
+		{ExportParams{Output: "gs://b/out/site_a_*.csv.gz"}, true},
+		{ExportParams{Output: "gs://b/out/site_a.parquet"}, true},
+		{ExportParams{Output: "gs://b/out/*.parquet"}, true},
+	} {
+		if err := e.checkNaming(ctx, tt.params); (err == nil) != tt.ok {
+			t.Errorf("checkNaming(%+v) error = %v, want ok %v", tt.params, err, tt.ok)
+		}
+	}
+
+	e.Naming.Enforcement = config.NamingWarn
+	if err := e.checkNaming(ctx, ExportParams{Output: "gs://b/out/", Filename: "Site-A"}); err != nil {
+		t.Errorf("checkNaming() with enforcement warn error = %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// PipelineEvent is the JSON body posted to pipeline webhooks when a run finishes.
+type PipelineEvent struct {
+	Pipeline       string    `json:"pipeline"`
+	Status         string    `json:"status"` // success, failure, stale or discovered
+	RequestID      string    `json:"request_id"`
+	Driver         string    `json:"driver"`
+	GCSPath        string    `json:"gcs_path,omitempty"`
+	Table          string    `json:"table,omitempty"`
+	Rows           int64     `json:"rows_loaded,omitempty"`
+	FilesWritten   int64     `json:"files_written,omitempty"`
+	BigQueryJobURL string    `json:"bigquery_job_url,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	FinishedAt     time.Time `json:"finished_at"`
+
+	// Sample holds anonymized rows of the destination, when the pipeline asks for them
+	Sample *RowSample `json:"sample,omitempty"`
+
+	// Freshness and LastSuccess describe the breached SLO of stale events
+	Freshness   string     `json:"freshness,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// Notifier delivers pipeline events to webhooks.
+type Notifier struct {
+	client *http.Client
+}
+
+// defaultWebhookTimeout bounds a webhook delivery unless WEBHOOK_TIMEOUT says otherwise.
+const defaultWebhookTimeout = 10 * time.Second
+
+func NewNotifier() *Notifier {
+	return &Notifier{client: &http.Client{Timeout: defaultWebhookTimeout, Transport: endpointTransport()}}
+}
+
+// NewNotifierFromEnv configures TLS for webhook endpoints: WEBHOOK_CA_FILE adds PEM CA
+// certificates trusted on top of the system roots, and WEBHOOK_CLIENT_CERT_FILE with
+// WEBHOOK_CLIENT_KEY_FILE is the client certificate presented to endpoints requiring
+// mutual TLS. The key pair is re-read for every connection so rotated certificates are
+// picked up without a restart. WEBHOOK_TIMEOUT bounds a delivery (default 10s).
+func NewNotifierFromEnv() (*Notifier, error) {
+	n := NewNotifier()
+	if d, err := time.ParseDuration(os.Getenv("WEBHOOK_TIMEOUT")); err == nil && d > 0 {
+		n.client.Timeout = d
+	}
+	cfg, err := webhookTLSConfig(os.Getenv("WEBHOOK_CA_FILE"), os.Getenv("WEBHOOK_CLIENT_CERT_FILE"), os.Getenv("WEBHOOK_CLIENT_KEY_FILE"))
+	if err != nil || cfg == nil {
+		return n, ConfigError(err)
+	}
+	n.client.Transport.(*http.Transport).TLSClientConfig = cfg
+	return n, nil
+}
+
+// webhookTLSConfig returns nil when no file is configured.
+func webhookTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read WEBHOOK_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("WEBHOOK_CA_FILE %s contains no PEM certificates", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("WEBHOOK_CLIENT_CERT_FILE and WEBHOOK_CLIENT_KEY_FILE must be set together")
+		}
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("invalid webhook client certificate: %w", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load webhook client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+	return cfg, nil
+}
+
+// NotifyPipeline posts the outcome of a pipeline run to its webhooks. Delivery failures
+// are logged and never fail the run.
+func (n *Notifier) NotifyPipeline(ctx context.Context, pipeline string, cfg config.Notify, driver string, res ExportResult, runErr error) {
+	if n == nil || len(cfg.Webhooks) == 0 {
+		return
+	}
+	ev := PipelineEvent{
+		Pipeline:     pipeline,
+		Status:       "success",
+		RequestID:    logging.RequestID(ctx),
+		Driver:       driver,
+		GCSPath:      res.GCSPath,
+		Table:        res.Table,
+		Rows:         res.Rows,
+		FilesWritten: res.Files,
+		Sample:       res.Sample,
+		FinishedAt:   time.Now().UTC(),
+	}
+	if res.Job.ID != "" {
+		ev.BigQueryJobURL = res.Job.ConsoleURL()
+	}
+	if runErr != nil {
+		ev.Status = "failure"
+		ev.Error = runErr.Error()
+	}
+	n.deliver(ctx, cfg, ev)
+}
+
+// NotifyStale posts a freshness SLO breach to the pipeline's webhooks.
+func (n *Notifier) NotifyStale(ctx context.Context, pipeline string, cfg config.Notify, driver string, st FreshnessState) {
+	if n == nil || len(cfg.Webhooks) == 0 {
+		return
+	}
+	n.deliver(ctx, cfg, PipelineEvent{
+		Pipeline:    pipeline,
+		Status:      "stale",
+		RequestID:   logging.RequestID(ctx),
+		Driver:      driver,
+		Error:       st.describe(),
+		FinishedAt:  time.Now().UTC(),
+		Freshness:   st.Freshness,
+		LastSuccess: st.LastSuccess,
+	})
+}
+
+// NotifyDiscovered posts a pipeline proposed by a discovery, awaiting approval, to the
+// webhooks of its template.
+func (n *Notifier) NotifyDiscovered(ctx context.Context, pipeline string, p config.Pipeline, driver string) {
+	if n == nil || len(p.Notify.Webhooks) == 0 || p.Discovered == nil {
+		return
+	}
+	n.deliver(ctx, p.Notify, PipelineEvent{
+		Pipeline:   pipeline,
+		Status:     "discovered",
+		RequestID:  logging.RequestID(ctx),
+		Driver:     driver,
+		Table:      p.Discovered.Dataset + "." + p.Discovered.Table,
+		Error:      "new table " + p.Discovered.Dataset + "." + p.Discovered.Table + "; the pipeline runs once approved",
+		FinishedAt: time.Now().UTC(),
+	})
+}
+
+// deliver posts ev to the webhooks that want its status.
+func (n *Notifier) deliver(ctx context.Context, cfg config.Notify, ev PipelineEvent) {
+	if !cfg.Wants(ev.Status) {
+		return
+	}
+	pipeline := ev.Pipeline
+	body, err := json.Marshal(ev)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode pipeline event", "error", err)
+		return
+	}
+	// Deliver even when the run was cancelled; that is exactly when someone should hear about it
+	sendCtx := context.WithoutCancel(ctx)
+	for _, url := range cfg.Webhooks {
+		if err := n.post(sendCtx, url, body); err != nil {
+			slog.WarnContext(ctx, "Failed to deliver pipeline notification", "pipeline", pipeline, "webhook", url, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Delivered pipeline notification", "pipeline", pipeline, "webhook", url, "status", ev.Status)
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifierMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert := writeClientCert(t, dir)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("WEBHOOK_CA_FILE", caFile)
+	t.Setenv("WEBHOOK_CLIENT_CERT_FILE", "")
+	t.Setenv("WEBHOOK_CLIENT_KEY_FILE", "")
+	n, err := NewNotifierFromEnv()
+	if err != nil {
+		t.Fatalf("NewNotifierFromEnv() error = %v", err)
+	}
+	if err := n.post(t.Context(), srv.URL, []byte("{}")); err == nil {
+		t.Error("post() without client certificate error = nil")
+	}
+
+	t.Setenv("WEBHOOK_CLIENT_CERT_FILE", filepath.Join(dir, "client.pem"))
+	t.Setenv("WEBHOOK_CLIENT_KEY_FILE", filepath.Join(dir, "client-key.pem"))
+	if n, err = NewNotifierFromEnv(); err != nil {
+		t.Fatalf("NewNotifierFromEnv() error = %v", err)
+	}
+	if err := n.post(t.Context(), srv.URL, []byte("{}")); err != nil {
+		t.Errorf("post() with client certificate error = %v", err)
+	}
+
+	t.Setenv("WEBHOOK_CLIENT_KEY_FILE", "")
+	if _, err := NewNotifierFromEnv(); err == nil {
+		t.Error("NewNotifierFromEnv() with certificate but no key error = nil")
+	}
+}
+
+// writeClientCert writes a self-signed client certificate and key to dir.
+func writeClientCert(t *testing.T, dir string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bq-exporter"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Policies of orphaned runs, which an instance left queued, deferred or running when it
+// stopped.
+const (
+	// OrphanFail marks them failed (default)
+	OrphanFail = "fail"
+	// OrphanRequeue marks them failed and retries them once, on the recovering instance
+	OrphanRequeue = "requeue"
+)
+
+// orphanClaimTTL keeps other instances from recovering a run this one recovers.
+const orphanClaimTTL = 10 * time.Minute
+
+// OrphanPolicyFromEnv returns the policy of orphaned runs of ORPHANED_JOB_POLICY.
+func OrphanPolicyFromEnv() (string, error) {
+	switch p := os.Getenv("ORPHANED_JOB_POLICY"); p {
+	case "", OrphanFail:
+		return OrphanFail, nil
+	case OrphanRequeue:
+		return p, nil
+	default:
+		return "", ConfigError(fmt.Errorf("invalid ORPHANED_JOB_POLICY %q; expected %s or %s", p, OrphanFail, OrphanRequeue))
+	}
+}
+
+// RecoverInBackground recovers what stopped instances left behind, now and once more
+// after the lease of an instance that just crashed (such as the previous process of this
+// one) has expired: first their pending cleanup actions, then their orphaned runs.
+func (e *Exporter) RecoverInBackground(ctx context.Context) {
+	go func() {
+		for _, wait := range []time.Duration{0, leaseTTL + 5*time.Second} {
+			if err := waitUntil(ctx, time.Now().Add(wait)); err != nil {
+				return
+			}
+			if e.Cleanups != nil {
+				if n, err := e.Cleanups.Recover(ctx); err != nil {
+					slog.WarnContext(ctx, "Failed to recover pending cleanups", "error", err)
+				} else if n > 0 {
+					slog.InfoContext(ctx, "Recovered pending cleanups", "actions", n)
+				}
+			}
+			if n, err := e.RecoverOrphanedJobs(ctx); err != nil {
+				slog.WarnContext(ctx, "Failed to recover orphaned jobs", "error", err)
+			} else if n > 0 {
+				slog.InfoContext(ctx, "Recovered orphaned jobs", "jobs", n, "policy", e.OrphanPolicy)
+			}
+		}
+	}()
+}
+
+// RecoverOrphanedJobs marks the runs that stopped instances left unfinished as failed
+// and, with OrphanRequeue, retries them in the background. It returns how many it
+// recovered. Only a job history in Redis (JOB_STORE_URL) outlives its instance, and
+// only a shared coordinator (COORDINATION_URL) tells stopped instances from live ones, so
+// without both nothing is recovered.
+func (e *Exporter) RecoverOrphanedJobs(ctx context.Context) (int, error) {
+	if e.Instance == nil || e.Jobs.redis == nil {
+		return 0, nil
+	}
+	if !sharedCoordinator(e.Instance.coord) {
+		slog.WarnContext(ctx, "Not recovering orphaned jobs: the job history is shared but COORDINATION_URL is not set, so the runs of live instances cannot be told from orphaned ones")
+		return 0, nil
+	}
+	runs, ok := e.Jobs.storedRuns(ctx)
+	if !ok {
+		return 0, fmt.Errorf("the job store could not be read")
+	}
+	n := 0
+	for _, rec := range runs {
+		switch rec.Status {
+		case JobQueued, JobDeferred, JobRunning:
+		default:
+			continue
+		}
+		if rec.Instance == "" {
+			// Recorded before runs named their instance
+			continue
+		}
+		if stopped, err := e.Instance.stopped(ctx, rec.Instance); err != nil || !stopped {
+			continue
+		}
+		if ok, _, err := e.Coordinator.TryLock(ctx, "orphan:"+rec.ID, e.Instance.ID, orphanClaimTTL); err != nil || !ok {
+			continue
+		}
+		status := rec.Status
+		e.Jobs.orphaned(rec, fmt.Sprintf("orphaned: instance %s stopped while the run was %s", rec.Instance, status))
+		slog.WarnContext(ctx, "Marked orphaned job failed", "job_id", rec.ID, "instance", rec.Instance, "status", status, "pipeline", rec.Pipeline)
+		n++
+		// A retry orphaned in turn is not retried again, so a run crashing its instance
+		// does not crash every instance in turn
+		if e.OrphanPolicy != OrphanRequeue || rec.RetryOf != "" {
+			continue
+		}
+		go func(id string) {
+			rctx := logging.WithRequestID(context.WithoutCancel(ctx), logging.NewRequestID())
+			if _, err := e.Retry(rctx, id); err != nil {
+				slog.ErrorContext(rctx, "Requeued orphaned job failed", "retry_of", id, "error", err)
+			}
+		}(rec.ID)
+	}
+	return n, nil
+}
+
+// orphaned records that a run stored by another instance failed for reason.
+func (s *JobStore) orphaned(rec JobRecord, reason string) {
+	now := time.Now().UTC()
+	rec.Status = JobFailed
+	rec.Error = reason
+	rec.FinishedAt = &now
+	rec.DeferredUntil, rec.DeferredReason = nil, ""
+	s.mu.Lock()
+	job := s.snapshotLocked(&rec)
+	s.mu.Unlock()
+	s.store(job)
+}
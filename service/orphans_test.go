@@ -0,0 +1,95 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRecoverOrphanedJobs(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("JOB_STORE_URL", "redis://"+mr.Addr())
+	ctx := context.Background()
+	instance := func() *Exporter {
+		t.Helper()
+		e := NewExporter(&fakeBigQuery{}, NewGCSDriver(nil, nil), &config.Config{})
+		jobs, err := NewJobStoreFromEnv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { jobs.Close() })
+		e.Jobs, e.Coordinator = jobs, newTestRedisCoordinator(t, mr)
+		e.Instance = NewInstance(e.Coordinator)
+		if err := e.Instance.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		e.Jobs.Instance = e.Instance.ID
+		return e
+	}
+
+	// The first instance crashes while it runs an export
+	crashed := instance()
+	rec, _ := crashed.Jobs.start(logging.WithRequestID(ctx, "run-1"), "GCS_PARQUET", ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/v/"}, "")
+	crashed.Jobs.running(rec)
+
+	e := instance()
+	e.OrphanPolicy = OrphanRequeue
+	if n, err := e.RecoverOrphanedJobs(ctx); n != 0 || err != nil {
+		t.Fatalf("RecoverOrphanedJobs() while the instance lives = %d, %v", n, err)
+	}
+	mr.FastForward(leaseTTL + time.Second)
+	if n, err := e.RecoverOrphanedJobs(ctx); n != 1 || err != nil {
+		t.Fatalf("RecoverOrphanedJobs() = %d, %v, want 1 job", n, err)
+	}
+	if got, _ := e.Jobs.Get(ctx, "run-1"); got.Status != JobFailed || !strings.Contains(got.Error, "orphaned") || got.FinishedAt == nil {
+		t.Errorf("orphaned record = %+v, want failed", got)
+	}
+	// It is requeued in the background
+	var retry JobRecord
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && retry.Status != JobSucceeded; time.Sleep(10 * time.Millisecond) {
+		for _, r := range e.Jobs.List(ctx) {
+			if r.RetryOf == "run-1" {
+				retry = r
+			}
+		}
+	}
+	if retry.Status != JobSucceeded || retry.Instance != e.Instance.ID {
+		t.Errorf("requeued run = %+v, want a succeeded retry on the recovering instance", retry)
+	}
+	if n, _ := e.RecoverOrphanedJobs(ctx); n != 0 {
+		t.Errorf("RecoverOrphanedJobs() again = %d, want 0", n)
+	}
+
+	// Without a shared coordinator, the runs of other instances are left alone
+	rec, _ = crashed.Jobs.start(logging.WithRequestID(ctx, "run-2"), "GCS_PARQUET", ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/v/"}, "")
+	crashed.Jobs.running(rec)
+	mr.FastForward(leaseTTL + time.Second)
+	local := instance()
+	local.Coordinator = newLocalCoordinator()
+	local.Instance = NewInstance(local.Coordinator)
+	if n, err := local.RecoverOrphanedJobs(ctx); n != 0 || err != nil {
+		t.Errorf("RecoverOrphanedJobs() without a shared coordinator = %d, %v, want 0", n, err)
+	}
+	if got, _ := local.Jobs.Get(ctx, "run-2"); got.Status != JobRunning {
+		t.Errorf("run of another instance = %+v, want it still running", got)
+	}
+}
+
+func TestOrphanPolicyFromEnv(t *testing.T) {
+	if p, err := OrphanPolicyFromEnv(); p != OrphanFail || err != nil {
+		t.Errorf("OrphanPolicyFromEnv() default = %q, %v", p, err)
+	}
+	t.Setenv("ORPHANED_JOB_POLICY", "requeue")
+	if p, _ := OrphanPolicyFromEnv(); p != OrphanRequeue {
+		t.Errorf("OrphanPolicyFromEnv() = %q", p)
+	}
+	t.Setenv("ORPHANED_JOB_POLICY", "retry")
+	if _, err := OrphanPolicyFromEnv(); err == nil {
+		t.Error("OrphanPolicyFromEnv() accepted an unknown policy")
+	}
+}
@@ -0,0 +1,406 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrPipelineNotFound is returned when a run or lookup names an unknown pipeline.
+	ErrPipelineNotFound = errors.New("pipeline not found")
+	// ErrPipelineParameters is returned when a pipeline run lacks query parameter values.
+	ErrPipelineParameters = errors.New("invalid pipeline parameters")
+	// ErrPipelinePending is returned when running a discovered pipeline that was not
+	// approved yet.
+	ErrPipelinePending = errors.New("pipeline awaits approval")
+)
+
+// PipelineStore holds the named pipelines, seeded from the config file and managed
+// through the API. Changes made through the API are kept in memory only.
+type PipelineStore struct {
+	mu        sync.RWMutex
+	pipelines map[string]config.Pipeline
+}
+
+func NewPipelineStore(cfg *config.Config) *PipelineStore {
+	s := &PipelineStore{pipelines: map[string]config.Pipeline{}}
+	if cfg != nil {
+		for name, p := range cfg.Pipelines {
+			s.pipelines[name] = p
+		}
+	}
+	return s
+}
+
+// Names returns the pipeline names in sorted order.
+func (s *PipelineStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.pipelines))
+	for name := range s.pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *PipelineStore) Get(name string) (config.Pipeline, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.pipelines[name]
+	return p, ok
+}
+
+// Put validates and stores a pipeline, replacing any existing one with the same name.
+func (s *PipelineStore) Put(name string, p config.Pipeline) error {
+	if err := config.ValidatePipeline(name, p); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pipelines[name] = p
+	return nil
+}
+
+// Delete removes a pipeline and reports whether it existed.
+func (s *PipelineStore) Delete(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pipelines[name]
+	delete(s.pipelines, name)
+	return ok
+}
+
+// Approve lets a pipeline proposed by a discovery run, if it is visible to the caller in
+// ctx, and returns it.
+func (s *PipelineStore) Approve(ctx context.Context, name string) (config.Pipeline, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pipelines[name]
+	if !ok || !PipelineVisible(ctx, p) {
+		return config.Pipeline{}, fmt.Errorf("%w: %s", ErrPipelineNotFound, name)
+	}
+	p.PendingApproval = false
+	s.pipelines[name] = p
+	return p, nil
+}
+
+// PipelineParams builds the export parameters of a pipeline run: the rendered query and
+// the pipeline's destination, with non-empty fields of overrides taking precedence.
+func PipelineParams(name string, p config.Pipeline, overrides ExportParams, parameters map[string]string) (ExportParams, error) {
+	query, err := p.RenderQuery(parameters)
+	if err != nil {
+		return ExportParams{}, fmt.Errorf("%w: pipeline %q: %v", ErrPipelineParameters, name, err)
+	}
+	d := p.Destination
+	base := ExportParams{
+		Pipeline:                  name,
+		Name:                      name,
+		Priority:                  p.Priority,
+		Query:                     query,
+		QueryLocation:             p.QueryLocation,
+		SnapshotTime:              p.SnapshotTime,
+		Output:                    d.Output,
+		Filename:                  d.Filename,
+		UseTimestamp:              d.UseTimestamp,
+		Format:                    d.Format,
+		CSVHeader:                 d.CSVHeader,
+		CSVDelimiter:              d.CSVDelimiter,
+		CSVBOM:                    d.CSVBOM,
+		SchemaFile:                d.SchemaFile,
+		ResolveSingleFile:         d.ResolveSingleFile,
+		FHIRMapping:               d.FHIRMapping,
+		REDCapMapping:             d.REDCapMapping,
+		RowGroupRows:              d.RowGroupRows,
+		MaxFileRows:               d.MaxFileRows,
+		ParquetTimestamp:          d.ParquetTimestamp,
+		ParquetDecimal:            d.ParquetDecimal,
+		ParquetString:             d.ParquetString,
+		RedisType:                 d.RedisType,
+		RedisTTL:                  d.RedisTTL,
+		Table:                     d.Table,
+		Database:                  d.Database,
+		CreateDDL:                 d.CreateDDL,
+		ImpersonateServiceAccount: d.ImpersonateServiceAccount,
+		LineageColumns:            d.LineageColumns,
+		Labels:                    d.Labels,
+		Description:               d.Description,
+		Transforms:                d.Transforms,
+		ComputedColumns:           d.ComputedColumns,
+		ReplicationNum:            d.ReplicationNum,
+		LoadStrategy:              d.LoadStrategy,
+		ColumnNames:               d.ColumnNames,
+		ColumnCase:                d.ColumnCase,
+		StringType:                d.StringType,
+		Verify:                    d.Verify,
+		AllowSchemaChanges:        d.AllowSchemaChanges,
+		DeleteColumn:              d.DeleteColumn,
+		DeleteValues:              d.DeleteValues,
+		WriteMode:                 d.WriteMode,
+		KeyColumns:                d.KeyColumns,
+		DestinationLocation:       d.DestinationLocation,
+		DiffSnapshot:              d.DiffSnapshot,
+		ChangesTable:              p.ChangesTable,
+		ChangesMode:               p.ChangesMode,
+		DedupColumns:              p.DedupColumns,
+		DedupOrderBy:              p.DedupOrderBy,
+		DedupKeep:                 p.DedupKeep,
+		DeidProfile:               p.DeidProfile,
+		Assertions:                p.Assertions,
+		NotifySample:              p.Notify.Sample,
+		ChunkColumn:               p.ChunkColumn,
+		ChunkBy:                   p.ChunkBy,
+	}
+	return overlayParams(base, overrides), nil
+}
+
+// overlayParams returns base with every non-empty field of o applied on top. The query
+// is never overridden.
+func overlayParams(base, o ExportParams) ExportParams {
+	if o.Name != "" {
+		base.Name = o.Name
+	}
+	if o.Priority != "" {
+		base.Priority = o.Priority
+	}
+	if o.Debug {
+		base.Debug = true
+	}
+	if o.LogicalDate != "" {
+		base.LogicalDate = o.LogicalDate
+	}
+	if o.Limit != 0 {
+		base.Limit = o.Limit
+	}
+	if o.SamplePercent != 0 {
+		base.SamplePercent = o.SamplePercent
+	}
+	if o.QueryLocation != "" {
+		base.QueryLocation = o.QueryLocation
+	}
+	if o.SnapshotTime != "" {
+		base.SnapshotTime = o.SnapshotTime
+	}
+	if o.Output != "" {
+		base.Output = o.Output
+	}
+	if o.Filename != "" {
+		base.Filename = o.Filename
+	}
+	if o.UseTimestamp != nil {
+		base.UseTimestamp = o.UseTimestamp
+	}
+	if o.Format != "" {
+		base.Format = o.Format
+	}
+	if o.CSVHeader != "" {
+		base.CSVHeader = o.CSVHeader
+	}
+	if o.CSVDelimiter != "" {
+		base.CSVDelimiter = o.CSVDelimiter
+	}
+	if o.CSVBOM {
+		base.CSVBOM = true
+	}
+	if o.SchemaFile {
+		base.SchemaFile = true
+	}
+	if o.ResolveSingleFile {
+		base.ResolveSingleFile = true
+	}
+	if o.FHIRMapping != "" {
+		base.FHIRMapping = o.FHIRMapping
+	}
+	if o.REDCapMapping != "" {
+		base.REDCapMapping = o.REDCapMapping
+	}
+	if o.RowGroupRows != 0 {
+		base.RowGroupRows = o.RowGroupRows
+	}
+	if o.MaxFileRows != 0 {
+		base.MaxFileRows = o.MaxFileRows
+	}
+	if o.ParquetTimestamp != "" {
+		base.ParquetTimestamp = o.ParquetTimestamp
+	}
+	if o.ParquetDecimal != "" {
+		base.ParquetDecimal = o.ParquetDecimal
+	}
+	if o.ParquetString != "" {
+		base.ParquetString = o.ParquetString
+	}
+	if o.RedisType != "" {
+		base.RedisType = o.RedisType
+	}
+	if o.RedisTTL != "" {
+		base.RedisTTL = o.RedisTTL
+	}
+	if o.Table != "" {
+		base.Table = o.Table
+	}
+	if o.Database != "" {
+		base.Database = o.Database
+	}
+	if o.CreateDDL != "" {
+		base.CreateDDL = o.CreateDDL
+	}
+	if o.ImpersonateServiceAccount != "" {
+		base.ImpersonateServiceAccount = o.ImpersonateServiceAccount
+	}
+	if o.ReplicationNum != 0 {
+		base.ReplicationNum = o.ReplicationNum
+	}
+	if o.LoadStrategy != "" {
+		base.LoadStrategy = o.LoadStrategy
+	}
+	if o.ColumnNames != "" {
+		base.ColumnNames = o.ColumnNames
+	}
+	if o.ColumnCase != "" {
+		base.ColumnCase = o.ColumnCase
+	}
+	if o.StringType != "" {
+		base.StringType = o.StringType
+	}
+	if o.Verify {
+		base.Verify = true
+	}
+	// A request can forbid schema changes, but not allow those the pipeline forbids
+	if o.AllowSchemaChanges != nil && !*o.AllowSchemaChanges {
+		base.AllowSchemaChanges = o.AllowSchemaChanges
+	}
+	if o.LineageColumns {
+		base.LineageColumns = true
+	}
+	if len(o.Labels) > 0 {
+		labels := maps.Clone(base.Labels)
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		maps.Copy(labels, o.Labels)
+		base.Labels = labels
+	}
+	if o.Description != "" {
+		base.Description = o.Description
+	}
+	if len(o.Transforms) > 0 {
+		base.Transforms = o.Transforms
+	}
+	if len(o.ComputedColumns) > 0 {
+		base.ComputedColumns = o.ComputedColumns
+	}
+	if o.DeleteColumn != "" {
+		base.DeleteColumn = o.DeleteColumn
+	}
+	if len(o.DeleteValues) > 0 {
+		base.DeleteValues = o.DeleteValues
+	}
+	if o.WriteMode != "" {
+		base.WriteMode = o.WriteMode
+	}
+	if len(o.KeyColumns) > 0 {
+		base.KeyColumns = o.KeyColumns
+	}
+	if o.DestinationLocation != "" {
+		base.DestinationLocation = o.DestinationLocation
+	}
+	if o.DiffSnapshot != "" {
+		base.DiffSnapshot = o.DiffSnapshot
+	}
+	if o.ChangesTable != "" {
+		base.ChangesTable = o.ChangesTable
+	}
+	if o.ChangesMode != "" {
+		base.ChangesMode = o.ChangesMode
+	}
+	if len(o.DedupColumns) > 0 {
+		base.DedupColumns = o.DedupColumns
+	}
+	if o.DedupOrderBy != "" {
+		base.DedupOrderBy = o.DedupOrderBy
+	}
+	if o.DedupKeep != "" {
+		base.DedupKeep = o.DedupKeep
+	}
+	if o.DeidProfile != "" {
+		base.DeidProfile = o.DeidProfile
+	}
+	if len(o.Assertions) > 0 {
+		base.Assertions = o.Assertions
+	}
+	if o.ShardCount != 0 {
+		base.ShardColumn, base.ShardIndex, base.ShardCount = o.ShardColumn, o.ShardIndex, o.ShardCount
+	}
+	if o.ShardLabel != "" {
+		base.ShardLabel = o.ShardLabel
+	}
+	if o.ChunkColumn != "" {
+		base.ChunkColumn = o.ChunkColumn
+	}
+	if o.ChunkBy != "" {
+		base.ChunkBy = o.ChunkBy
+	}
+	if o.ChunkStart != "" {
+		base.ChunkStart = o.ChunkStart
+	}
+	if o.ChunkEnd != "" {
+		base.ChunkEnd = o.ChunkEnd
+	}
+	return base
+}
+
+// applyEnvironment rewrites the destination of a pipeline run for the environment the
+// service runs in.
+func applyEnvironment(p ExportParams, env config.Environment) ExportParams {
+	p.Output = env.Output(p.Output)
+	p.Database = env.Database(p.Database)
+	p.Table = env.Table(p.Table)
+	p.ImpersonateServiceAccount = env.ServiceAccount(p.ImpersonateServiceAccount)
+	return p
+}
+
+// ParseParameters parses "key=value" pairs separated by commas (JOB_PARAMETERS).
+func ParseParameters(v string) map[string]string {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	out := map[string]string{}
+	for _, kv := range strings.Split(v, ",") {
+		k, val, _ := strings.Cut(kv, "=")
+		if k = strings.TrimSpace(k); k != "" {
+			out[k] = strings.TrimSpace(val)
+		}
+	}
+	return out
+}
+
+// RunPipeline runs the named pipeline with optional destination and query parameter
+// overrides, then sends the pipeline's notifications.
+func (e *Exporter) RunPipeline(ctx context.Context, name string, overrides ExportParams, parameters map[string]string) (ExportResult, error) {
+	p, ok := e.Pipelines.Get(name)
+	if !ok || !PipelineVisible(ctx, p) {
+		return ExportResult{}, fmt.Errorf("%w: %s", ErrPipelineNotFound, name)
+	}
+	if p.PendingApproval {
+		return ExportResult{}, fmt.Errorf("%w: %s", ErrPipelinePending, name)
+	}
+	params, err := PipelineParams(name, p, overrides, parameters)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	params = applyEnvironment(params, e.Environment)
+	var res ExportResult
+	if p.Sync != nil {
+		res, err = e.runSync(ctx, p.Sync, params)
+	} else {
+		res, err = e.Run(ctx, params)
+	}
+	e.Notifier.NotifyPipeline(ctx, name, p.Notify, e.Driver.Name(), res, err)
+	return res, err
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPipelineParams(t *testing.T) {
+	p := config.Pipeline{
+		Query:         "SELECT * FROM ds.visits WHERE day >= '{{start}}' AND site = '{{ site }}'",
+		QueryLocation: "asia-southeast2",
+		Parameters:    map[string]string{"start": "2026-01-01", "site": "HCMC"},
+		Destination:   config.Destination{Output: "gs://bucket/visits/", Table: "visits"},
+	}
+	got, err := PipelineParams("visits", p, ExportParams{Table: "visits_override"}, map[string]string{"site": "HN"})
+	if err != nil {
+		t.Fatalf("PipelineParams() error = %v", err)
+	}
+	if want := "SELECT * FROM ds.visits WHERE day >= '2026-01-01' AND site = 'HN'"; got.Query != want {
+		t.Errorf("Query = %q, want %q", got.Query, want)
+	}
+	if got.Name != "visits" || got.Table != "visits_override" || got.Output != "gs://bucket/visits/" || got.QueryLocation != "asia-southeast2" {
+		t.Errorf("unexpected params: %+v", got)
+	}
+
+	// Request parameters stay inside their string literal
+	got, err = PipelineParams("visits", p, ExportParams{}, map[string]string{"site": "HN' OR site != '"})
+	if want := `SELECT * FROM ds.visits WHERE day >= '2026-01-01' AND site = 'HN\' OR site != \''`; err != nil || got.Query != want {
+		t.Errorf("Query = %q, %v, want %q", got.Query, err, want)
+	}
+
+	// A request can point a change history pipeline at another table
+	changes := config.Pipeline{ChangesTable: "ds.visits", ChangesMode: "appends"}
+	got, err = PipelineParams("visits_changes", changes, ExportParams{ChangesTable: "ds.visits_hn"}, nil)
+	if err != nil || got.ChangesTable != "ds.visits_hn" || got.ChangesMode != "appends" {
+		t.Errorf("PipelineParams() with a changes_table override = %q %q, %v", got.ChangesTable, got.ChangesMode, err)
+	}
+
+	p.Parameters = nil
+	if _, err := PipelineParams("visits", p, ExportParams{}, nil); !errors.Is(err, ErrPipelineParameters) {
+		t.Errorf("PipelineParams() without parameter values error = %v, want ErrPipelineParameters", err)
+	}
+}
+
+func TestRunPipelineNotifies(t *testing.T) {
+	events := make(chan PipelineEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev PipelineEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		events <- ev
+	}))
+	defer hook.Close()
+
+	cfg := &config.Config{Pipelines: map[string]config.Pipeline{
+		"daily": {
+			Query:         "SELECT 1",
+			QueryLocation: "US",
+			Destination:   config.Destination{Output: "gs://bucket/daily/"},
+			Notify:        config.Notify{Webhooks: []string{hook.URL}},
+		},
+	}}
+	e := NewExporter(&fakeBigQuery{}, NewGCSDriver(nil, nil), cfg)
+
+	if _, err := e.RunPipeline(context.Background(), "missing", ExportParams{}, nil); !errors.Is(err, ErrPipelineNotFound) {
+		t.Fatalf("RunPipeline(missing) error = %v, want ErrPipelineNotFound", err)
+	}
+	res, err := e.RunPipeline(context.Background(), "daily", ExportParams{}, nil)
+	if err != nil {
+		t.Fatalf("RunPipeline() error = %v", err)
+	}
+	ev := <-events
+	if ev.Pipeline != "daily" || ev.Status != "success" || ev.GCSPath != res.GCSPath {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+}
+
+func TestRunPipelineEnvironment(t *testing.T) {
+	cfg := &config.Config{
+		Pipelines: map[string]config.Pipeline{
+			"daily": {Query: "SELECT 1", QueryLocation: "US", Destination: config.Destination{Output: "gs://prod-exports/daily/"}},
+		},
+		Environments: map[string]config.Environment{
+			"staging": {Outputs: map[string]string{"gs://prod-exports/": "gs://staging-exports/"}},
+		},
+	}
+	if err := cfg.UseEnvironment("staging"); err != nil {
+		t.Fatalf("UseEnvironment() error = %v", err)
+	}
+	e := NewExporter(&fakeBigQuery{}, NewGCSDriver(nil, nil), cfg)
+	res, err := e.RunPipeline(context.Background(), "daily", ExportParams{}, nil)
+	if err != nil {
+		t.Fatalf("RunPipeline() error = %v", err)
+	}
+	if want := "gs://staging-exports/daily/"; !strings.HasPrefix(res.GCSPath, want) {
+		t.Errorf("GCSPath = %s, want under %s", res.GCSPath, want)
+	}
+	// The definition itself is unchanged, to be promoted as is
+	if p, _ := e.Pipelines.Get("daily"); p.Destination.Output != "gs://prod-exports/daily/" {
+		t.Errorf("pipeline output = %s, want the definition's", p.Destination.Output)
+	}
+}
@@ -0,0 +1,751 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// ExportPlan describes what an export would do, without running it.
+type ExportPlan struct {
+	Driver        string `json:"driver"`
+	Pipeline      string `json:"pipeline,omitempty"`
+	QueryLocation string `json:"query_location"`
+	// EstimatedBytes is the dry-run estimate of the bytes the query processes
+	EstimatedBytes int64 `json:"estimated_bytes"`
+
+	// Destination is the resolved table or GCS URI
+	Destination string `json:"destination"`
+	// Strategy is how rows reach the destination: export_data or export_data_staged
+	// (GCS), insert, stream_load or swap (StarRocks), replace, append or merge, each
+	// optionally _cross_region (BigQuery)
+	Strategy string `json:"strategy"`
+	// Steps are the operations the export would run, in order
+	Steps []string `json:"steps"`
+
+	// EstimatedRows is only known when the plan counted the rows; EstimatedBatches then
+	// follows from BatchRows
+	EstimatedRows    *int64 `json:"estimated_rows,omitempty"`
+	BatchRows        int    `json:"batch_rows,omitempty"`
+	EstimatedBatches int64  `json:"estimated_batches,omitempty"`
+
+	Columns       []PlanColumn   `json:"columns"`
+	SchemaChanges []SchemaChange `json:"schema_changes,omitempty"`
+	Warnings      []string       `json:"warnings,omitempty"`
+}
+
+// PlanColumn maps a result column to its destination type (where the driver chooses it)
+// and, when the column name policy renames it, its destination name.
+type PlanColumn struct {
+	Name            string `json:"name"`
+	SourceType      string `json:"source_type"`
+	DestinationType string `json:"destination_type,omitempty"`
+	DestinationName string `json:"destination_name,omitempty"`
+}
+
+// Schema change actions.
+const (
+	SchemaCreateTable   = "create_table"
+	SchemaAddColumn     = "add_column"
+	SchemaTypeMismatch  = "type_mismatch"
+	SchemaMissingColumn = "column_not_in_result"
+)
+
+// SchemaChange is a difference between the query result and the destination table.
+type SchemaChange struct {
+	Action string `json:"action"`
+	Column string `json:"column,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (p *ExportPlan) step(format string, args ...any) {
+	p.Steps = append(p.Steps, fmt.Sprintf(format, args...))
+}
+
+func (p *ExportPlan) warn(format string, args ...any) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
+// exportPlanner is implemented by drivers that can describe an export without running
+// it. schema is the dry-run result schema.
+type exportPlanner interface {
+	plan(ctx context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error
+}
+
+// Plan resolves an export like Run and reports what it would do, without writing
+// anything or consuming quota. Only the query is dry-run; with countRows the result rows
+// are counted too, which runs (and bills) a COUNT(*) over the query: like an export, it
+// is held to the tenant's MaxBytesPerQuery and quotas, and counted in its usage.
+func (e *Exporter) Plan(ctx context.Context, params ExportParams, countRows bool) (*ExportPlan, error) {
+	params = applyDefaults(params, e.Defaults)
+	if _, err := priorityRank(params.Priority); err != nil {
+		return nil, err
+	}
+	tenant, t, isTenant := TenantFrom(ctx)
+	if isTenant {
+		var err error
+		if params, err = applyTenant(params, tenant, t); err != nil {
+			return nil, err
+		}
+		if params, err = tenantTable(params, e.Driver.Name(), tenant); err != nil {
+			return nil, err
+		}
+		params = applyTenantRowFilter(ctx, params, t)
+	}
+	if err := e.checkParams(params); err != nil {
+		return nil, err
+	}
+	params, err := e.applyFeatures(params)
+	if err != nil {
+		return nil, err
+	}
+	if params, err = e.applyFormatMapping(params); err != nil {
+		return nil, err
+	}
+	if params, err = e.applyDeidProfile(params); err != nil {
+		return nil, err
+	}
+	if params, err = applyTransforms(params); err != nil {
+		return nil, err
+	}
+	params, err = applySnapshotTime(params, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	bq, err := e.impersonatedClient(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	probe, err := probeQuery(params)
+	if err != nil {
+		return nil, err
+	}
+	dry, err := bq.DryRun(ctx, probe, params.QueryLocation)
+	if err != nil {
+		return nil, err
+	}
+	p := &ExportPlan{Driver: e.Driver.Name(), Pipeline: params.Pipeline, QueryLocation: params.QueryLocation, EstimatedBytes: dry.TotalBytesProcessed}
+	if p.QueryLocation == "" {
+		p.QueryLocation = dry.Location
+	}
+	params.QueryLocation = p.QueryLocation
+	violations, err := e.namingViolations(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range violations {
+		if e.Naming.Enforcement == config.NamingWarn {
+			p.warn("%s", v)
+		} else {
+			p.warn("%s; the export would be rejected", v)
+		}
+	}
+	if t.MaxBytesPerQuery > 0 && dry.TotalBytesProcessed > t.MaxBytesPerQuery {
+		p.warn("query would process %d bytes, over the tenant limit of %d; the export would be rejected", dry.TotalBytesProcessed, t.MaxBytesPerQuery)
+	}
+	if params.ImpersonateServiceAccount != "" {
+		p.step("run BigQuery jobs as %s", params.ImpersonateServiceAccount)
+	}
+	if params.SnapshotTime != "" {
+		p.step("read the query's tables as of %s", params.SnapshotTime)
+	}
+	if len(params.rowFilters) > 0 {
+		p.step("keep only the rows where (%s), as required for the tenant", strings.Join(params.rowFilters, ") AND ("))
+	}
+	schema := dry.Schema
+	switch {
+	case params.DiffSnapshot != "":
+		p.step("diff the query result against snapshot %s by key columns %s and export only changed rows with an %s column", params.DiffSnapshot, strings.Join(params.KeyColumns, ", "), DiffOpColumn)
+		if len(params.KeyColumns) == 0 {
+			p.warn("diff_snapshot requires key_columns; the export would fail")
+		}
+		schema = append(slices.Clone(schema), &bigquery.FieldSchema{Name: DiffOpColumn, Type: bigquery.StringFieldType})
+	case params.ChangesTable != "":
+		p.step("read the change history of %s since the stored watermark", params.ChangesTable)
+		if params.Query != "" {
+			p.warn("columns are those of %s; the query over the change history may return different ones", params.ChangesTable)
+		}
+	}
+	if len(params.DedupColumns) > 0 {
+		keep := "any"
+		if params.DedupOrderBy != "" {
+			keep = cmp.Or(params.DedupKeep, DedupKeepLatest) + " by " + params.DedupOrderBy
+		}
+		p.step("keep one row per %s (%s)", strings.Join(params.DedupColumns, ", "), keep)
+	}
+	if params.SamplePercent > 0 && params.SamplePercent < 100 {
+		p.step("keep a random %g%% of the rows", params.SamplePercent)
+	}
+	if params.Limit > 0 {
+		p.step("keep at most %d rows", params.Limit)
+	}
+	if d := params.deid; d != nil {
+		var err error
+		if _, schema, err = d.query("", schema); err != nil {
+			return nil, err
+		}
+		p.step("de-identify the result with profile %s (fingerprint %s)", d.audit.Profile, d.audit.Fingerprint)
+		if d.profile.K > 0 {
+			p.step("warn when a combination of %s occurs in fewer than %d rows", strings.Join(d.profile.QuasiIdentifiers, ", "), d.profile.K)
+		}
+	}
+	if params.LineageColumns {
+		p.step("append the lineage columns %s, %s and %s to every row", LineageJobIDColumn, LineageExportedAtColumn, LineageQueryHashColumn)
+		schema = append(slices.Clone(schema), lineageSchema()...)
+	}
+	if len(params.transformers) > 0 {
+		types := make([]string, len(params.Transforms))
+		for i, t := range params.Transforms {
+			types[i] = t.Type
+		}
+		if len(types) > 0 {
+			p.step("transform the rows as they are read: %s", strings.Join(types, ", "))
+		}
+		for _, c := range params.ComputedColumns {
+			p.step("compute column %s = %s", c.Name, c.Expression)
+		}
+		var err error
+		if schema, err = transformSchema(params.transformers, schema); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range schema {
+		p.Columns = append(p.Columns, PlanColumn{Name: f.Name, SourceType: string(f.Type)})
+	}
+
+	if countRows {
+		// The count is billed like an export: it is held to the tenant's limits, and used
+		if err := e.Usage.checkQuota(ctx); err != nil {
+			return nil, err
+		}
+		if _, err := checkQueryBytes(ctx, bq, probe, params.QueryLocation, t.MaxBytesPerQuery); err != nil {
+			return nil, err
+		}
+		metered := &meteredBigQuery{BigQueryClient: bq}
+		n, err := countQueryRows(ctx, metered, probe, params.QueryLocation)
+		e.Usage.recordQuery(ctx, metered.bytes.Load())
+		if err != nil {
+			return nil, fmt.Errorf("failed to count rows: %w", err)
+		}
+		p.EstimatedRows = &n
+	}
+	planner, ok := e.Driver.(exportPlanner)
+	if !ok {
+		p.warn("driver %s cannot describe its destination", e.Driver.Name())
+		return p, nil
+	}
+	if err := planner.plan(ctx, params, schema, p); err != nil {
+		return nil, err
+	}
+	if len(params.Labels) > 0 || params.Description != "" {
+		what := slices.Sorted(maps.Keys(params.Labels))
+		if params.Description != "" {
+			what = append(what, "description")
+		}
+		p.step("label the destination: %s", strings.Join(what, ", "))
+	}
+	if p.EstimatedRows != nil && p.BatchRows > 0 {
+		p.EstimatedBatches = (*p.EstimatedRows + int64(p.BatchRows) - 1) / int64(p.BatchRows)
+	}
+	return p, nil
+}
+
+// PlanPipeline plans a run of a named pipeline, like RunPipeline.
+func (e *Exporter) PlanPipeline(ctx context.Context, name string, overrides ExportParams, parameters map[string]string, countRows bool) (*ExportPlan, error) {
+	p, ok := e.Pipelines.Get(name)
+	if !ok || !PipelineVisible(ctx, p) {
+		return nil, fmt.Errorf("%w: %s", ErrPipelineNotFound, name)
+	}
+	if p.Sync != nil {
+		return nil, ConfigError(fmt.Errorf("pipeline %q syncs dataset %s; plan its tables one by one", name, p.Sync.Dataset))
+	}
+	params, err := PipelineParams(name, p, overrides, parameters)
+	if err != nil {
+		return nil, err
+	}
+	return e.Plan(ctx, applyEnvironment(params, e.Environment), countRows)
+}
+
+func countQueryRows(ctx context.Context, bq BigQueryClient, sqlQuery, location string) (int64, error) {
+	it, err := bq.ReadRows(ctx, "SELECT COUNT(*) FROM ("+sqlQuery+")", location)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil {
+		if err == iterator.Done {
+			return 0, fmt.Errorf("no result")
+		}
+		return 0, err
+	}
+	n, ok := row[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected count %v", row[0])
+	}
+	return n, nil
+}
+
+func (d *GCSDriver) plan(ctx context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	if params.Format == FormatREDCap {
+		var err error
+		if params, err = redcapParams(params, schema); err != nil {
+			return err
+		}
+		p.step("select the REDCap import columns of mapping %s from the result", params.REDCapMapping)
+	}
+	format := "Parquet"
+	if params.Format == FormatCSV {
+		format = "CSV"
+	}
+	useTimestamp := params.UseTimestamp != nil && *params.UseTimestamp
+	p.Destination = buildExportURI(params.Output, params.Filename, time.Now().Format("20060102-150405"), useTimestamp, exportExtension(params.Format))
+	if !strings.HasPrefix(p.Destination, "gs://") {
+		return fmt.Errorf("output must be a gs:// URI, got %q", params.Output)
+	}
+	if params.Format == FormatFHIR {
+		if _, err := fhirElements(params.fhir, schema); err != nil {
+			return err
+		}
+		p.Strategy = "fhir_ndjson"
+		p.step("read the result rows and write them as FHIR %s resources (columns %s) to %s, %d resources per file",
+			params.fhir.ResourceType, strings.Join(fhirColumns(params.fhir), ", "), p.Destination, fhirFileResources)
+		if d.gcs == nil {
+			p.warn("the export would fail: format %s needs a Cloud Storage client", FormatFHIR)
+		}
+		return nil
+	}
+	stageBucket, err := d.stagingBucketFor(ctx, p.Destination, params, true)
+	if err != nil {
+		return err
+	}
+	if stageBucket == "" {
+		p.Strategy = "export_data"
+		p.step("EXPORT DATA as %s to %s in %s", format, p.Destination, params.QueryLocation)
+	} else {
+		p.Strategy = "export_data_staged"
+		p.step("EXPORT DATA as %s to staging bucket gs://%s in %s", format, stageBucket, params.QueryLocation)
+		p.step("copy the files to %s and delete the staged copies", p.Destination)
+	}
+	if head, _ := csvFilePrefix(params, schema); head != nil {
+		p.step("compose every file after a head with the byte order mark or header row")
+	}
+	if params.SchemaFile {
+		p.step("write the result schema to %s", schemaFileURI(p.Destination))
+	}
+	if d.gcs == nil {
+		p.warn("bucket location not checked: no Cloud Storage client")
+	}
+	if useTimestamp {
+		p.warn("the timestamp in the destination is that of the plan; the export uses its own start time")
+	}
+	return nil
+}
+
+func (d *ParquetWriteDriver) plan(_ context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	useTimestamp := params.UseTimestamp != nil && *params.UseTimestamp
+	p.Destination = buildExportURI(params.Output, params.Filename, time.Now().Format("20060102-150405"), useTimestamp, exportExtension(FormatParquet))
+	if !strings.HasPrefix(p.Destination, "gs://") {
+		return fmt.Errorf("output must be a gs:// URI, got %q", params.Output)
+	}
+	types, err := parquetTypesOf(params)
+	if err != nil {
+		return err
+	}
+	if _, err := arrowSchema(schema, types); err != nil {
+		return err
+	}
+	if params.MaxFileRows > 0 && !strings.Contains(p.Destination, "*") {
+		return fmt.Errorf("output %s needs a * wildcard to split the export into files of max_file_rows", p.Destination)
+	}
+	p.Strategy = "parquet_write"
+	p.step("read the result rows and write them as Parquet to %s, %d rows per row group", p.Destination, cmp.Or(params.RowGroupRows, defaultRowGroupRows))
+	if params.MaxFileRows > 0 {
+		p.step("start a new file every %d rows", params.MaxFileRows)
+	}
+	if types != (parquetTypes{ParquetTimestampMicros, ParquetDecimal, ParquetString}) {
+		p.step("write timestamps as %s, decimals as %s and strings as %s", types.timestamp, types.decimal, types.str)
+	}
+	if d.gcs == nil {
+		p.warn("the export would fail: the %s driver needs a Cloud Storage client", parquetWriteDriverName)
+	}
+	if useTimestamp {
+		p.warn("the timestamp in the destination is that of the plan; the export uses its own start time")
+	}
+	return nil
+}
+
+func (d *AzureBlobDriver) plan(ctx context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	useTimestamp := params.UseTimestamp != nil && *params.UseTimestamp
+	p.Destination = buildExportURI(params.Output, params.Filename, time.Now().Format("20060102-150405"), useTimestamp, exportExtension(params.Format))
+	container, _, err := parseAzureURI(p.Destination)
+	if err != nil {
+		return fmt.Errorf("output must be an az:// URI, got %q", params.Output)
+	}
+	stageBucket := d.staging.For(params.QueryLocation)
+	if stageBucket == "" {
+		return fmt.Errorf("the %s driver stages files in Cloud Storage; configure a staging bucket for %s in GCS_STAGING_BUCKETS", azureBlobDriverName, params.QueryLocation)
+	}
+	if d.blob != nil {
+		if err := d.blob.CheckContainer(ctx, container); err != nil {
+			return err
+		}
+	}
+	p.Strategy = "export_data_azure"
+	p.step("EXPORT DATA as %s to staging bucket gs://%s in %s", cmp.Or(params.Format, FormatParquet), stageBucket, params.QueryLocation)
+	if head, _ := csvFilePrefix(params, schema); head != nil {
+		p.step("compose every file after a head with the byte order mark or header row")
+	}
+	if params.SchemaFile {
+		p.step("write the result schema to %s", schemaFileURI(p.Destination))
+	}
+	p.step("stream the files to %s in Azure Blob Storage and delete the staged copies", p.Destination)
+	if useTimestamp {
+		p.warn("the timestamp in the destination is that of the plan; the export uses its own start time")
+	}
+	return nil
+}
+
+func (d *GoogleDriveDriver) plan(_ context.Context, params ExportParams, _ bigquery.Schema, p *ExportPlan) error {
+	folder, name, err := driveFile(params, time.Now().Format("20060102-150405"))
+	if err != nil {
+		return fmt.Errorf("output must be a drive:// URI, got %q", params.Output)
+	}
+	p.Destination = "drive://" + folder + "/" + name
+	p.Strategy = "drive_upload"
+	p.step("read at most %d rows of the result", d.maxRows)
+	p.step("upload them as %s to Google Drive folder %s, replacing a file of that name", name, folder)
+	if params.UseTimestamp != nil && *params.UseTimestamp {
+		p.warn("the timestamp in the destination is that of the plan; the export uses its own start time")
+	}
+	return nil
+}
+
+func (d *HTTPPostDriver) plan(_ context.Context, params ExportParams, _ bigquery.Schema, p *ExportPlan) error {
+	target, err := d.target(params.Output)
+	if err != nil {
+		return err
+	}
+	p.Destination, p.Strategy = target, "http_post"
+	p.BatchRows = d.batchRows
+	p.step("read the result rows")
+	p.step("POST them to %s in JSON batches of %d rows, the last marked final, retrying transient failures up to %d times", target, d.batchRows, d.retries)
+	return nil
+}
+
+func (d *FirestoreDriver) plan(_ context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	collection, key, merge, err := firestoreTarget(params)
+	if err != nil {
+		return err
+	}
+	if schemaIndex(schema, key) < 0 {
+		return fmt.Errorf("key column %q is not a column of the result", key)
+	}
+	p.Destination, p.Strategy = collection, "firestore_set"
+	p.BatchRows = firestoreBatchWrites
+	p.step("read the result rows")
+	if merge {
+		p.step("merge every row into document <%s> of collection %s, committing %d documents at a time", key, collection, firestoreBatchWrites)
+	} else {
+		p.step("replace document <%s> of collection %s with every row, committing %d documents at a time", key, collection, firestoreBatchWrites)
+	}
+	return nil
+}
+
+func (d *SpannerDriver) plan(ctx context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	table, err := spannerTable(params)
+	if err != nil {
+		return err
+	}
+	p.Destination, p.Strategy = table, "insert_or_update"
+	p.BatchRows = max(1, spannerBatchCells/max(1, len(schema)))
+	exists := true
+	if d.sp != nil {
+		if exists, err = d.sp.tableExists(ctx, table); err != nil {
+			return err
+		}
+	}
+	if !exists {
+		ddl := strings.TrimSpace(params.CreateDDL)
+		if ddl == "" && !params.featureEnabled(config.FeatureAutoDDL) {
+			p.warn("%s does not exist and creating tables is disabled for it (auto_ddl or allow_schema_changes); the export would fail", table)
+		} else if ddl == "" {
+			if ddl, err = spannerCreateDDL(table, schema, params.KeyColumns); err != nil {
+				return err
+			}
+		}
+		if ddl != "" {
+			p.step("%s", ddl)
+		}
+	}
+	p.step("read the result rows")
+	p.step("InsertOrUpdate them into Spanner table %s, committing %d rows at a time", table, p.BatchRows)
+	return nil
+}
+
+func (d *RedisDriver) plan(_ context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	prefix, typ, ttl, err := redisOptions(params)
+	if err != nil {
+		return err
+	}
+	if _, err := newRedisKeys(schema, prefix, typ, params.KeyColumns); err != nil {
+		return err
+	}
+	key := prefix
+	for _, k := range params.KeyColumns {
+		key += ":<" + k + ">"
+	}
+	p.Destination, p.Strategy = key, "redis_"+typ
+	p.step("read at most %d rows of the result", d.maxRows)
+	p.step("replace the %s at every key %s, %d keys per transaction", typ, key, redisBatchKeys)
+	if ttl > 0 {
+		p.step("expire the keys after %s", ttl)
+	} else {
+		p.warn("without redis_ttl, keys of rows that leave the result are never removed")
+	}
+	return nil
+}
+
+func (d *SQLiteDriver) plan(_ context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	uri, table, err := sqliteFile(params, time.Now().Format("20060102-150405"))
+	if err != nil {
+		return err
+	}
+	index, err := sqliteIndexDDL(table, schema, params.KeyColumns)
+	if err != nil {
+		return err
+	}
+	p.Destination, p.Strategy = uri, "sqlite_file"
+	p.step("read the result rows into table %s of a local SQLite file", table)
+	if index != "" {
+		p.step("create a unique index on %s", strings.Join(params.KeyColumns, ", "))
+	}
+	p.step("upload the file to %s", uri)
+	if d.gcs == nil {
+		p.warn("the export would fail: the %s driver needs a Cloud Storage client", sqliteDriverName)
+	}
+	if params.UseTimestamp != nil && *params.UseTimestamp {
+		p.warn("the timestamp in the destination is that of the plan; the export uses its own start time")
+	}
+	return nil
+}
+
+func (d *BigQueryTableDriver) plan(_ context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	table, err := resolveBigQueryTable(params.Table, params.Database)
+	if err != nil {
+		return err
+	}
+	mode, err := bigQueryWriteMode(params)
+	if err != nil {
+		return err
+	}
+	for _, k := range params.KeyColumns {
+		if mode == WriteModeMerge && !slices.ContainsFunc(schema, func(f *bigquery.FieldSchema) bool { return f.Name == k }) {
+			return fmt.Errorf("key column %q is not in the query result", k)
+		}
+	}
+	p.Destination, p.Strategy = table, mode
+	for i := range p.Columns {
+		p.Columns[i].DestinationType = p.Columns[i].SourceType
+	}
+	if mode != WriteModeReplace && !params.featureEnabled(config.FeatureAutoDDL) {
+		p.warn("creating tables is disabled for %s (auto_ddl or allow_schema_changes): the export fails if the table does not exist", table)
+	}
+	destLocation := params.DestinationLocation
+	if destLocation == "" || strings.EqualFold(destLocation, params.QueryLocation) {
+		p.step("%s %s from the query in %s", bigQueryWriteVerb(mode), table, params.QueryLocation)
+		return nil
+	}
+	srcBucket, dstBucket := d.staging.For(params.QueryLocation), d.staging.For(destLocation)
+	if srcBucket == "" || dstBucket == "" {
+		return fmt.Errorf("cross-region write from %s to %s requires staging buckets for both locations (GCS_STAGING_BUCKETS)", params.QueryLocation, destLocation)
+	}
+	p.Strategy = mode + "_cross_region"
+	p.step("EXPORT DATA as Parquet to staging bucket gs://%s in %s", srcBucket, params.QueryLocation)
+	if dstBucket != srcBucket {
+		p.step("copy the staged files to gs://%s", dstBucket)
+	}
+	p.step("LOAD DATA into a temporary table in %s and %s %s", destLocation, bigQueryWriteVerb(mode), table)
+	return nil
+}
+
+func bigQueryWriteVerb(mode string) string {
+	switch mode {
+	case WriteModeAppend:
+		return "append to"
+	case WriteModeMerge:
+		return "merge into"
+	}
+	return "replace"
+}
+
+func (d *StarRocksDriver) plan(ctx context.Context, params ExportParams, schema bigquery.Schema, p *ExportPlan) error {
+	table, err := d.resolveTable(params)
+	if err != nil {
+		return err
+	}
+	del, err := newDeleteMarker(schema, params.DeleteColumn, params.DeleteValues, params.KeyColumns)
+	if err != nil {
+		return err
+	}
+	keys, err := keyColumnIndexes(schema, params.KeyColumns)
+	if err != nil {
+		return err
+	}
+	schema, mapping, err := destinationSchema(schema, params.ColumnNames, params.ColumnCase)
+	if err != nil {
+		return err
+	}
+	if schema, err = stringTypeSchema(schema, params.StringType); err != nil {
+		return err
+	}
+	if params.StringType == StringTypeAuto && strings.TrimSpace(params.CreateDDL) == "" {
+		p.step("size new string columns from their longest value in the result (runs one more query over it)")
+		p.warn("string_type is auto: new string columns are shown with the default length; the export sizes them from the data")
+	}
+	p.Destination = table
+	db, tbl := d.sr.parseDBTable(table)
+	for i, f := range schema {
+		p.Columns[i].DestinationType = mapSRType(f)
+		p.Columns[i].DestinationName = mapping[p.Columns[i].Name]
+		if f.Repeated || f.Type == bigquery.RecordFieldType {
+			p.warn("column %q has an unsupported complex type; the export would fail", f.Name)
+		}
+	}
+
+	switch {
+	case params.LoadStrategy == LoadStrategySwap:
+		if del != nil {
+			return fmt.Errorf("delete_column cannot be combined with the swap load strategy, which replaces the whole table")
+		}
+		p.Strategy = "swap"
+	case d.sr.loadMethod == LoadMethodStream:
+		p.Strategy = "stream_load"
+	default:
+		p.Strategy = LoadStrategyInsert
+	}
+
+	if strings.TrimSpace(params.CreateDDL) != "" || params.featureEnabled(config.FeatureAutoDDL) {
+		p.step("CREATE DATABASE IF NOT EXISTS %s", db)
+	}
+	if strings.TrimSpace(params.CreateDDL) != "" {
+		p.step("apply the provided create_ddl")
+		p.warn("the table schema comes from create_ddl and is not compared with the query result")
+	} else if err := d.planSchema(ctx, db, tbl, params, schema, keys, p); err != nil {
+		return err
+	}
+
+	target := table
+	if p.Strategy == "swap" {
+		target = fmt.Sprintf("a staging table %s__staging_<n> created LIKE %s", tbl, table)
+	}
+	if d.sr.loadMethod == LoadMethodStream {
+		p.BatchRows = streamChunkRows()
+		p.step("Stream Load rows into %s in one transaction, %d rows per chunk", target, p.BatchRows)
+	} else {
+		p.BatchRows = insertBatchSize()
+		p.step("INSERT rows into %s in one transaction, %d rows per statement", target, p.BatchRows)
+	}
+	if del != nil {
+		p.step("delete rows whose %s marks them deleted, by %s, in source order", params.DeleteColumn, strings.Join(params.KeyColumns, ", "))
+	}
+	if p.Strategy == "swap" {
+		p.step("ALTER TABLE %s SWAP WITH the staging table and drop it", table)
+	}
+	if params.Verify {
+		where := "the load connections"
+		if d.sr.readDB != nil {
+			where = "the read endpoint"
+		}
+		p.step("SELECT COUNT(*) FROM %s on %s to verify the load", table, where)
+	}
+	return nil
+}
+
+// planSchema compares the query result with the destination table, or plans its creation.
+func (d *StarRocksDriver) planSchema(ctx context.Context, db, tbl string, params ExportParams, schema bigquery.Schema, keys []int, p *ExportPlan) error {
+	exists, err := d.sr.tableExists(ctx, db, tbl)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s.%s: %w", db, tbl, err)
+	}
+	fullName := d.sr.qualify(db, tbl)
+	if !exists && !params.featureEnabled(config.FeatureAutoDDL) {
+		p.warn("%s does not exist and creating tables is disabled for it (auto_ddl or allow_schema_changes); the export would fail", fullName)
+		return nil
+	}
+	if !exists {
+		ddl, err := buildCreateTableDDL(fullName, schema, keys, params.DeleteColumn != "", params.ReplicationNum)
+		if err != nil {
+			return err
+		}
+		p.SchemaChanges = append(p.SchemaChanges, SchemaChange{Action: SchemaCreateTable, Detail: strings.TrimSpace(ddl)})
+		model, names := "DUPLICATE", []string{schema[0].Name}
+		if params.DeleteColumn != "" {
+			model = "PRIMARY"
+		}
+		if len(keys) > 0 {
+			names = names[:0]
+			for _, i := range keys {
+				names = append(names, schema[i].Name)
+			}
+		}
+		p.step("create %s (%s KEY on %s)", fullName, model, strings.Join(names, ", "))
+		return nil
+	}
+	cur, err := d.sr.getExistingColumns(ctx, db, tbl)
+	if err != nil {
+		return fmt.Errorf("failed to read the columns of %s: %w", fullName, err)
+	}
+	existing := make(map[string]string, len(cur))
+	for _, c := range cur {
+		existing[strings.ToLower(c.Name)] = strings.ToUpper(c.Type)
+	}
+	result := map[string]bool{}
+	for _, f := range schema {
+		result[strings.ToLower(f.Name)] = true
+		want := mapSRType(f)
+		got, ok := existing[strings.ToLower(f.Name)]
+		switch {
+		case !ok && !params.featureEnabled(config.FeatureSchemaEvolution):
+			p.SchemaChanges = append(p.SchemaChanges, SchemaChange{Action: SchemaAddColumn, Column: f.Name, Detail: want})
+			p.warn("%s lacks column %q and schema changes are disabled for it (schema_evolution or allow_schema_changes); the export would fail", fullName, f.Name)
+		case !ok:
+			p.SchemaChanges = append(p.SchemaChanges, SchemaChange{Action: SchemaAddColumn, Column: f.Name, Detail: want})
+			p.step("ALTER TABLE %s ADD COLUMN %s %s", fullName, quoteSRIdent(f.Name), want)
+		case baseSRType(got) != baseSRType(want):
+			p.SchemaChanges = append(p.SchemaChanges, SchemaChange{Action: SchemaTypeMismatch, Column: f.Name, Detail: fmt.Sprintf("destination is %s, query result maps to %s", got, want)})
+			p.warn("column %q is %s in %s but the query returns %s; values are converted on load", f.Name, got, fullName, f.Type)
+		}
+	}
+	for _, c := range cur {
+		if !result[strings.ToLower(c.Name)] {
+			p.SchemaChanges = append(p.SchemaChanges, SchemaChange{Action: SchemaMissingColumn, Column: c.Name, Detail: "loaded rows get the column default"})
+		}
+	}
+	return nil
+}
+
+// baseSRType strips the length or precision of a StarRocks type: VARCHAR(1024) ->
+// VARCHAR, and STRING is VARCHAR. information_schema reports decimals by width (DECIMAL64, DECIMAL128).
+func baseSRType(t string) string {
+	if i := strings.IndexByte(t, '('); i >= 0 {
+		t = t[:i]
+	}
+	t = strings.ToUpper(strings.TrimSpace(t))
+	if strings.HasPrefix(t, "DECIMAL") {
+		return "DECIMAL"
+	}
+	if t == "STRING" {
+		return "VARCHAR"
+	}
+	return t
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestPlanDoesNotExport(t *testing.T) {
+	bq := &fakeBigQuery{location: "asia-southeast2", bytes: 1 << 20, schema: bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "name", Type: bigquery.StringFieldType},
+	}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	plan, err := e.Plan(context.Background(), ExportParams{Query: "SELECT id, name FROM t", Output: "gs://bucket/out/"}, false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if plan.Destination != "gs://bucket/out/export-*.parquet" || plan.Strategy != "export_data" || plan.QueryLocation != "asia-southeast2" || plan.EstimatedBytes != 1<<20 {
+		t.Errorf("plan = %+v", plan)
+	}
+	if len(plan.Columns) != 2 || plan.Columns[1].SourceType != "STRING" {
+		t.Errorf("columns = %+v", plan.Columns)
+	}
+	for _, q := range bq.queries {
+		if strings.Contains(q, "EXPORT DATA") {
+			t.Errorf("Plan() submitted %q", q)
+		}
+	}
+	if jobs := e.Jobs.List(context.Background()); len(jobs) != 0 {
+		t.Errorf("Plan() recorded jobs %+v", jobs)
+	}
+}
+
+func TestPlanBigQueryTable(t *testing.T) {
+	bq := &fakeBigQuery{location: "US", schema: bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}}}
+	e := NewExporter(bq, NewBigQueryTableDriver(nil, ParseStagingBuckets("US=gs://stage-us,EU=gs://stage-eu")), &config.Config{})
+	plan, err := e.Plan(context.Background(), ExportParams{Query: "SELECT 1 AS id", Table: "mart.visits", WriteMode: "merge", KeyColumns: []string{"id"}, DestinationLocation: "EU"}, false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if plan.Destination != "mart.visits" || plan.Strategy != "merge_cross_region" || len(plan.Steps) != 3 {
+		t.Errorf("plan = %+v", plan)
+	}
+
+	if _, err := e.Plan(context.Background(), ExportParams{Query: "SELECT 1 AS id", Table: "mart.visits", WriteMode: "merge", KeyColumns: []string{"visit_id"}}, false); err == nil {
+		t.Error("Plan() with unknown key column error = nil")
+	}
+}
+
+func TestPlanEstimatesBatches(t *testing.T) {
+	bq := &fakeBigQuery{location: "US", schema: bigquery.Schema{{Name: "n", Type: bigquery.IntegerFieldType}}, rows: [][]bigquery.Value{{int64(2500)}}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	plan, err := e.Plan(context.Background(), ExportParams{Query: "SELECT 1", Output: "gs://bucket/out/"}, true)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if plan.EstimatedRows == nil || *plan.EstimatedRows != 2500 {
+		t.Errorf("EstimatedRows = %v, want 2500", plan.EstimatedRows)
+	}
+
+	// The count is held to the tenant's byte limit and quota; the rest of a plan is not
+	bq.bytes = 600
+	params := ExportParams{Query: "SELECT 1", Output: "gs://bucket/out/"}
+	tenants := []struct {
+		name   string
+		tenant config.Tenant
+	}{
+		{"bytes per query", config.Tenant{MaxBytesPerQuery: 100}},
+		{"monthly quota", config.Tenant{Quota: config.Quota{MonthlyBytes: 500}}},
+	}
+	e.Usage.record(WithTenant(context.Background(), "a", config.Tenant{}), 600, 0)
+	for _, tt := range tenants {
+		ctx := WithTenant(context.Background(), "a", tt.tenant)
+		if _, err := e.Plan(ctx, params, true); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("%s: Plan(count_rows) error = %v, want ErrQuotaExceeded", tt.name, err)
+		}
+		if _, err := e.Plan(ctx, params, false); err != nil {
+			t.Errorf("%s: Plan() error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestBaseSRType(t *testing.T) {
+	for got, want := range map[string]string{"varchar(1024)": "VARCHAR", "DECIMAL128(38,9)": "DECIMAL", "bigint": "BIGINT"} {
+		if b := baseSRType(got); b != want {
+			t.Errorf("baseSRType(%q) = %q, want %q", got, b, want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// destinationChecker is implemented by drivers that can check their destination without
+// exporting anything. outputs are the gs:// outputs the configuration writes to.
+type destinationChecker interface {
+	checkDestination(ctx context.Context, r *ValidationReport, outputs []string)
+}
+
+// Preflight checks with lightweight calls that the service can use BigQuery and reach its
+// destination and buckets, so revoked credentials or missing permissions surface at
+// startup instead of at the first scheduled export.
+func (e *Exporter) Preflight(ctx context.Context) *ValidationReport {
+	r := &ValidationReport{OK: true}
+	if _, err := e.BQ.DryRun(ctx, "SELECT 1", e.Defaults.QueryLocation); err != nil {
+		r.fail("preflight.bigquery", err)
+	} else {
+		r.pass("preflight.bigquery", "dry-run succeeded")
+	}
+	if c, ok := e.Driver.(destinationChecker); ok {
+		c.checkDestination(ctx, r, e.configuredOutputs())
+	} else {
+		r.skip("preflight.destination", "no check for driver "+e.Driver.Name())
+	}
+	return r
+}
+
+// configuredOutputs lists the distinct default and pipeline outputs.
+func (e *Exporter) configuredOutputs() []string {
+	seen := map[string]bool{}
+	add := func(o string) {
+		if strings.HasPrefix(o, "gs://") {
+			seen[o] = true
+		}
+	}
+	add(e.Defaults.Output)
+	for _, name := range e.Pipelines.Names() {
+		if p, ok := e.Pipelines.Get(name); ok {
+			add(p.Destination.Output)
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for o := range seen {
+		out = append(out, o)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkBuckets reads the metadata of every output and staging bucket.
+func checkBuckets(ctx context.Context, r *ValidationReport, gcs *GCSService, outputs []string, staging StagingBuckets) {
+	if gcs == nil {
+		r.skip("preflight.gcs", "no Cloud Storage client")
+		return
+	}
+	buckets := map[string]bool{}
+	for _, o := range outputs {
+		if b, _, err := parseGCSURI(o); err == nil {
+			buckets[b] = true
+		}
+	}
+	for _, b := range staging {
+		buckets[b] = true
+	}
+	if len(buckets) == 0 {
+		r.skip("preflight.gcs", "no buckets configured")
+		return
+	}
+	names := make([]string, 0, len(buckets))
+	for b := range buckets {
+		names = append(names, b)
+	}
+	sort.Strings(names)
+	for _, b := range names {
+		if loc, err := gcs.BucketLocation(ctx, b); err != nil {
+			r.fail("preflight.gcs.gs://"+b, err)
+		} else {
+			r.pass("preflight.gcs.gs://"+b, loc)
+		}
+	}
+}
+
+func (d *GCSDriver) checkDestination(ctx context.Context, r *ValidationReport, outputs []string) {
+	checkBuckets(ctx, r, d.gcs, outputs, d.staging)
+}
+
+func (d *ParquetWriteDriver) checkDestination(ctx context.Context, r *ValidationReport, outputs []string) {
+	checkBuckets(ctx, r, d.gcs, outputs, nil)
+}
+
+func (d *BigQueryTableDriver) checkDestination(ctx context.Context, r *ValidationReport, _ []string) {
+	checkBuckets(ctx, r, d.gcs, nil, d.staging)
+}
+
+func (d *StarRocksDriver) checkDestination(ctx context.Context, r *ValidationReport, _ []string) {
+	if _, err := d.sr.db.ExecContext(ctx, "SELECT 1"); err != nil {
+		r.fail("preflight.starrocks", err)
+	} else {
+		r.pass("preflight.starrocks", d.sr.fes.String())
+	}
+	if d.sr.loadMethod != LoadMethodStream {
+		return
+	}
+	// Stream Load needs the FE HTTP port; one reachable FE is enough
+	var errs []string
+	for _, addr := range d.sr.httpAddrs() {
+		conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			r.pass("preflight.starrocks.stream_load", addr)
+			return
+		}
+		errs = append(errs, err.Error())
+	}
+	r.fail("preflight.starrocks.stream_load", fmt.Errorf("no FE HTTP endpoint reachable: %s", strings.Join(errs, "; ")))
+}
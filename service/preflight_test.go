@@ -0,0 +1,33 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	cfg := &config.Config{
+		Defaults: map[string]config.DestinationDefaults{"GCS_PARQUET": {Output: "gs://exports/default/"}},
+		Pipelines: map[string]config.Pipeline{
+			"daily": {Query: "SELECT 1", Destination: config.Destination{Output: "gs://reports/daily/"}},
+		},
+	}
+	bq := &fakeBigQuery{err: errors.New("permission denied")}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), cfg)
+
+	if got, want := e.configuredOutputs(), []string{"gs://exports/default/", "gs://reports/daily/"}; !slices.Equal(got, want) {
+		t.Errorf("configuredOutputs() = %v, want %v", got, want)
+	}
+	r := e.Preflight(context.Background())
+	if r.OK || r.Checks[0].Name != "preflight.bigquery" || r.Checks[0].Status != CheckFail {
+		t.Fatalf("Preflight() = %+v, want failed BigQuery check", r)
+	}
+
+	bq.err = nil
+	if r := e.Preflight(context.Background()); !r.OK {
+		t.Fatalf("Preflight() = %+v, want OK", r)
+	}
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// PriorityInteractive is for exports someone is waiting on; they are admitted first.
+	PriorityInteractive = "interactive"
+	// PriorityNormal is the default priority.
+	PriorityNormal = "normal"
+	// PriorityBatch is for bulk and backfill exports, admitted last.
+	PriorityBatch = "batch"
+)
+
+// Ranks order the priorities, higher first.
+const (
+	rankBatch = iota
+	rankNormal
+	rankInteractive
+)
+
+// priorityRank returns the rank of a priority; "" is normal.
+func priorityRank(p string) (int, error) {
+	switch strings.ToLower(p) {
+	case PriorityInteractive:
+		return rankInteractive, nil
+	case "", PriorityNormal:
+		return rankNormal, nil
+	case PriorityBatch:
+		return rankBatch, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q; expected interactive, normal or batch", p)
+}
+
+// exportQueue admits at most limit concurrent exports (unlimited when limit <= 0).
+// Waiting exports are admitted by priority, then in arrival order. With preempt set,
+// batch StarRocks loads pause between chunks while an interactive export runs.
+type exportQueue struct {
+	limit   int
+	preempt bool
+
+	mu      sync.Mutex
+	running int
+	seq     uint64
+	waiting []*queueWaiter
+	// interactive counts running interactive exports; idle is closed when it drops to 0
+	interactive int
+	idle        chan struct{}
+}
+
+type queueWaiter struct {
+	rank  int
+	seq   uint64
+	ready chan struct{}
+}
+
+// newExportQueueFromEnv reads MAX_CONCURRENT_EXPORTS and PREEMPT_BATCH_LOADS.
+func newExportQueueFromEnv() *exportQueue {
+	limit, _ := strconv.Atoi(os.Getenv("MAX_CONCURRENT_EXPORTS"))
+	preempt, _ := strconv.ParseBool(os.Getenv("PREEMPT_BATCH_LOADS"))
+	return &exportQueue{limit: limit, preempt: preempt}
+}
+
+// acquire waits for an export slot, calling onQueue if the export has to wait; the
+// returned func releases the slot.
+func (q *exportQueue) acquire(ctx context.Context, rank int, onQueue func()) (func(), error) {
+	q.mu.Lock()
+	if q.limit <= 0 || (q.running < q.limit && len(q.waiting) == 0) {
+		q.admitLocked(rank)
+		q.mu.Unlock()
+		return q.releaser(rank), nil
+	}
+	q.seq++
+	w := &queueWaiter{rank: rank, seq: q.seq, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, w)
+	position := len(q.waiting)
+	q.mu.Unlock()
+
+	slog.InfoContext(ctx, "Export queued", "limit", q.limit, "position", position)
+	onQueue()
+	select {
+	case <-w.ready:
+		return q.releaser(rank), nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i, o := range q.waiting {
+			if o == w {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+		// Admitted while being cancelled: hand the slot on
+		q.releaseLocked(rank)
+		return nil, ctx.Err()
+	}
+}
+
+func (q *exportQueue) admitLocked(rank int) {
+	q.running++
+	if rank == rankInteractive {
+		if q.interactive == 0 {
+			q.idle = make(chan struct{})
+		}
+		q.interactive++
+	}
+}
+
+func (q *exportQueue) releaser(rank int) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.releaseLocked(rank)
+		})
+	}
+}
+
+// releaseLocked frees a slot and admits the best waiting export.
+func (q *exportQueue) releaseLocked(rank int) {
+	q.running--
+	if rank == rankInteractive {
+		q.interactive--
+		if q.interactive == 0 {
+			close(q.idle)
+		}
+	}
+	if len(q.waiting) == 0 {
+		return
+	}
+	best := 0
+	for i, w := range q.waiting {
+		if w.rank > q.waiting[best].rank || (w.rank == q.waiting[best].rank && w.seq < q.waiting[best].seq) {
+			best = i
+		}
+	}
+	w := q.waiting[best]
+	q.waiting = append(q.waiting[:best], q.waiting[best+1:]...)
+	q.admitLocked(w.rank)
+	close(w.ready)
+}
+
+// yield blocks while an interactive export is running.
+func (q *exportQueue) yield(ctx context.Context) error {
+	q.mu.Lock()
+	if q.interactive == 0 {
+		q.mu.Unlock()
+		return nil
+	}
+	idle := q.idle
+	q.mu.Unlock()
+	slog.InfoContext(ctx, "Pausing batch load while an interactive export runs")
+	select {
+	case <-idle:
+		slog.InfoContext(ctx, "Resuming batch load")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type yieldKey struct{}
+
+// withYield makes loads running under ctx call yield between chunks.
+func withYield(ctx context.Context, yield func(context.Context) error) context.Context {
+	return context.WithValue(ctx, yieldKey{}, yield)
+}
+
+// yieldBetweenChunks lets a preemptible load pause; loads call it before each chunk.
+func yieldBetweenChunks(ctx context.Context) error {
+	if yield, ok := ctx.Value(yieldKey{}).(func(context.Context) error); ok {
+		return yield(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExportQueueAdmitsByPriority(t *testing.T) {
+	q := &exportQueue{limit: 1}
+	ctx := context.Background()
+	release, err := q.acquire(ctx, rankNormal, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan int, 3)
+	queued := make(chan struct{})
+	for _, rank := range []int{rankBatch, rankNormal, rankInteractive} {
+		go func(rank int) {
+			rel, err := q.acquire(ctx, rank, func() { queued <- struct{}{} })
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			admitted <- rank
+			rel()
+		}(rank)
+		<-queued // keep arrival order deterministic
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := q.acquire(cancelled, rankInteractive, func() { queued <- struct{}{} })
+		errc <- err
+	}()
+	<-queued
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled acquire() error = %v", err)
+	}
+
+	release()
+	for _, want := range []int{rankInteractive, rankNormal, rankBatch} {
+		if got := <-admitted; got != want {
+			t.Fatalf("admitted rank %d, want %d", got, want)
+		}
+	}
+}
+
+func TestExportQueueYieldsToInteractive(t *testing.T) {
+	q := &exportQueue{preempt: true}
+	ctx := context.Background()
+	if err := q.yield(ctx); err != nil {
+		t.Fatalf("yield() without interactive exports = %v", err)
+	}
+	release, _ := q.acquire(ctx, rankInteractive, func() {})
+
+	done := make(chan error, 1)
+	go func() { done <- yieldBetweenChunks(withYield(ctx, q.yield)) }()
+	select {
+	case <-done:
+		t.Fatal("batch load did not pause while an interactive export runs")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("yield() = %v", err)
+	}
+}
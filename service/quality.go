@@ -0,0 +1,191 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrQualityReportNotFound is returned for runs that checked no assertions.
+var ErrQualityReportNotFound = errors.New("validation report not found")
+
+// QualityReport is the validation report of the assertions checked on one run, the evidence
+// for the data managers receiving the delivery. It follows the shape of a Great Expectations
+// validation result: overall success, statistics and one result per expectation.
+type QualityReport struct {
+	Success  bool   `json:"success"`
+	RunID    string `json:"run_id"`
+	Tenant   string `json:"tenant,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Driver   string `json:"driver"`
+	// DataAsset is the table or the exported files checked
+	DataAsset   string            `json:"data_asset"`
+	ValidatedAt time.Time         `json:"validated_at"`
+	Statistics  QualityStatistics `json:"statistics"`
+	Results     []QualityResult   `json:"results"`
+	// JSONURI and HTMLURI are where the report was stored in Cloud Storage, if it was
+	JSONURI string `json:"json_uri,omitempty"`
+	HTMLURI string `json:"html_uri,omitempty"`
+	// StorageError is why the report could not be stored; the export still stands
+	StorageError string `json:"storage_error,omitempty"`
+}
+
+// QualityStatistics counts the expectations of a report.
+type QualityStatistics struct {
+	Evaluated      int     `json:"evaluated_expectations"`
+	Successful     int     `json:"successful_expectations"`
+	Unsuccessful   int     `json:"unsuccessful_expectations"`
+	SuccessPercent float64 `json:"success_percent"`
+}
+
+// QualityResult is one assertion of a report, with its Great Expectations type.
+type QualityResult struct {
+	ExpectationType string `json:"expectation_type"`
+	AssertionResult
+}
+
+// expectationTypes name the checks of assertions as Great Expectations does.
+var expectationTypes = map[string]string{
+	checkRowCount:  "expect_table_row_count_to_be_between",
+	checkNotNull:   "expect_column_values_to_not_be_null",
+	checkMax:       "expect_column_max_to_be",
+	checkCondition: "expect_rows_to_satisfy_condition",
+}
+
+// newQualityReport reports the assertions of the export of params into res.
+func newQualityReport(ctx context.Context, driver string, params ExportParams, res ExportResult) QualityReport {
+	r := QualityReport{
+		Success:     true,
+		RunID:       logging.RequestID(ctx),
+		Tenant:      TenantName(ctx),
+		Pipeline:    params.Pipeline,
+		Name:        params.Name,
+		Driver:      driver,
+		DataAsset:   res.Table,
+		ValidatedAt: time.Now().UTC(),
+		Results:     make([]QualityResult, len(res.Assertions)),
+	}
+	if r.DataAsset == "" {
+		r.DataAsset = res.GCSPath
+	}
+	for i, a := range res.Assertions {
+		r.Results[i] = QualityResult{ExpectationType: expectationTypes[a.Check], AssertionResult: a}
+		if a.Passed {
+			r.Statistics.Successful++
+		} else {
+			r.Statistics.Unsuccessful++
+			r.Success = false
+		}
+	}
+	r.Statistics.Evaluated = len(r.Results)
+	if r.Statistics.Evaluated > 0 {
+		r.Statistics.SuccessPercent = 100 * float64(r.Statistics.Successful) / float64(r.Statistics.Evaluated)
+	}
+	return r
+}
+
+// writeQualityReport stores r in Cloud Storage as JSON and HTML: next to the exported
+// files at gcsPath or, for tables, under ValidationReportPrefix by run ID. Without
+// either, the report is only kept in the job history.
+func (e *Exporter) writeQualityReport(ctx context.Context, r *QualityReport, gcsPath string) error {
+	var base string
+	if gcsPath != "" {
+		base = sidecarURI(gcsPath, "validation")
+	} else if prefix := e.ValidationReportPrefix; prefix != "" {
+		base = strings.TrimSuffix(prefix, "/") + "/" + unsafeTableChars.ReplaceAllString(r.RunID, "_") + ".validation"
+	} else {
+		return nil
+	}
+	if e.GCS == nil {
+		slog.WarnContext(ctx, "Validation report not stored without Cloud Storage", "uri", base)
+		return nil
+	}
+	r.JSONURI, r.HTMLURI = base+".json", base+".html"
+	htmlData, err := RenderQualityReport(*r)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		uri, contentType string
+		data             []byte
+	}{{r.JSONURI, "application/json", append(jsonData, '\n')}, {r.HTMLURI, "text/html; charset=utf-8", htmlData}} {
+		bucket, name, err := parseGCSURI(f.uri)
+		if err != nil {
+			return ConfigError(fmt.Errorf("invalid validation report location: %w", err))
+		}
+		if err := e.GCS.WriteObject(ctx, bucket, name, f.contentType, f.data); err != nil {
+			return fmt.Errorf("the export completed but its validation report could not be written to %s: %w", f.uri, err)
+		}
+	}
+	slog.InfoContext(ctx, "Wrote validation report", "json_uri", r.JSONURI, "html_uri", r.HTMLURI, "success", r.Success)
+	return nil
+}
+
+var qualityReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Validation report {{.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-top: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.4em 0.8em; text-align: left; }
+th { background: #f4f4f4; }
+.passed { color: #1a7f37; font-weight: bold; }
+.failed { color: #cf222e; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Validation report: <span class="{{if .Success}}passed{{else}}failed{{end}}">{{if .Success}}passed{{else}}failed{{end}}</span></h1>
+<table>
+<tr><th>Run</th><td>{{.RunID}}</td></tr>
+{{- if .Tenant}}<tr><th>Tenant</th><td>{{.Tenant}}</td></tr>{{end}}
+{{- if .Pipeline}}<tr><th>Pipeline</th><td>{{.Pipeline}}</td></tr>{{end}}
+{{- if .Name}}<tr><th>Name</th><td>{{.Name}}</td></tr>{{end}}
+<tr><th>Driver</th><td>{{.Driver}}</td></tr>
+<tr><th>Data asset</th><td>{{.DataAsset}}</td></tr>
+<tr><th>Validated at</th><td>{{.ValidatedAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Expectations</th><td>{{.Statistics.Successful}} of {{.Statistics.Evaluated}} passed ({{printf "%.1f" .Statistics.SuccessPercent}}%)</td></tr>
+</table>
+<table>
+<tr><th>Expectation</th><th>Type</th><th>Status</th><th>Observed</th><th>Expected</th></tr>
+{{- range .Results}}
+<tr><td>{{.Name}}</td><td>{{.ExpectationType}}</td><td class="{{if .Passed}}passed{{else}}failed{{end}}">{{if .Passed}}passed{{else}}failed{{end}}</td><td>{{if .Observed}}{{.Observed}}{{else}}NULL{{end}}</td><td>{{.Expected}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// RenderQualityReport renders r as a standalone HTML page.
+func RenderQualityReport(r QualityReport) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := qualityReportTemplate.Execute(&buf, r); err != nil {
+		return nil, fmt.Errorf("failed to render the validation report: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// QualityReport returns the validation report of a run visible to the caller in ctx.
+func (s *JobStore) QualityReport(ctx context.Context, id string) (QualityReport, error) {
+	rec, ok := s.Get(ctx, id)
+	if !ok {
+		return QualityReport{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if rec.QualityReport == nil {
+		return QualityReport{}, fmt.Errorf("%w: job %s checked no assertions", ErrQualityReportNotFound, id)
+	}
+	return *rec.QualityReport, nil
+}
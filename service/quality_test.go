@@ -0,0 +1,62 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestQualityReport(t *testing.T) {
+	minRows := int64(5)
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{rows: [][]bigquery.Value{{int64(3), int64(0)}}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	e.GCS = gcs.service(t)
+	ctx := logging.WithRequestID(context.Background(), "run-1")
+	res, err := e.Run(ctx, ExportParams{Name: "visits", Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/",
+		Assertions: []config.Assertion{{MinRows: &minRows}, {NotNull: "site"}}})
+	if !errors.Is(err, ErrAssertionsFailed) {
+		t.Fatalf("Run() error = %v, want ErrAssertionsFailed", err)
+	}
+	r := res.QualityReport
+	if r == nil || r.Success || r.Statistics.Evaluated != 2 || r.Statistics.Successful != 1 || r.Statistics.SuccessPercent != 50 ||
+		r.Results[0].ExpectationType != "expect_table_row_count_to_be_between" || r.Results[1].Check != checkNotNull || r.DataAsset != res.GCSPath {
+		t.Fatalf("QualityReport = %+v, want one of two expectations passed", r)
+	}
+	if r.JSONURI != "gs://b/out/visits.validation.json" || r.HTMLURI != "gs://b/out/visits.validation.html" {
+		t.Errorf("report URIs = %s, %s, want next to the export", r.JSONURI, r.HTMLURI)
+	}
+	var stored QualityReport
+	if err := json.Unmarshal(gcs.objects["out/visits.validation.json"], &stored); err != nil || stored.RunID != "run-1" || stored.Success {
+		t.Errorf("stored report = %+v (%v), want the failed run-1", stored, err)
+	}
+	if page := string(gcs.objects["out/visits.validation.html"]); !strings.Contains(page, "at least 5 rows") || !strings.Contains(page, "1 of 2 passed (50.0%)") {
+		t.Errorf("HTML report = %s, want the expectations listed", page)
+	}
+
+	got, err := e.Jobs.QualityReport(ctx, "run-1")
+	if err != nil || got.JSONURI != r.JSONURI {
+		t.Errorf("Jobs.QualityReport() = %+v, %v, want the report in the job history", got, err)
+	}
+	e.Run(logging.WithRequestID(context.Background(), "run-2"), ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/"})
+	if _, err := e.Jobs.QualityReport(ctx, "run-2"); !errors.Is(err, ErrQualityReportNotFound) {
+		t.Errorf("Jobs.QualityReport(no assertions) error = %v, want ErrQualityReportNotFound", err)
+	}
+
+	// A report that cannot be stored does not fail the committed export
+	down := newFakeGCS(t)
+	e.GCS = down.service(t)
+	down.srv.Close()
+	bq.rows = [][]bigquery.Value{{int64(5), int64(0)}}
+	res, err = e.Run(logging.WithRequestID(context.Background(), "run-3"), ExportParams{Name: "visits", Query: "SELECT * FROM ds.visits",
+		QueryLocation: "US", Output: "gs://b/out/", Assertions: []config.Assertion{{MinRows: &minRows}}})
+	if err != nil || res.QualityReport == nil || !strings.Contains(res.QualityReport.StorageError, "could not be written") {
+		t.Errorf("Run(report not stored) = %+v, %v, want success with the storage error on the report", res.QualityReport, err)
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// quotaReasons are the BigQuery error reasons of exhausted rate limits and quotas.
+var quotaReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+}
+
+// bigQueryQuotaError reports whether err is a BigQuery rate limit or quota error, which a
+// run started later is likely to get past.
+func bigQueryQuotaError(err error) bool {
+	var be *bigquery.Error
+	if errors.As(err, &be) && quotaReasons[be.Reason] {
+		return true
+	}
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		if ge.Code == 429 {
+			return true
+		}
+		for _, item := range ge.Errors {
+			if quotaReasons[item.Reason] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// defaultQuotaBackoff is the first delay after a quota error for drivers that set none
+// (DriverCapabilities.QuotaBackoff): they mostly hit concurrent query and export limits.
+const defaultQuotaBackoff = 30 * time.Second
+
+// quotaBackoff defers exports hitting BigQuery quotas instead of failing them. The delay
+// adapts to the driver's recent quota errors: each one doubles it, up to max, and each
+// export that succeeds halves it again. While it lasts, new exports of the instance wait
+// too, so they do not pile onto the exhausted quota.
+type quotaBackoff struct {
+	base, max time.Duration
+	// retries is how many times one export is deferred before it fails
+	retries int
+
+	mu    sync.Mutex
+	delay time.Duration
+	until time.Time
+}
+
+// newQuotaBackoffFromEnv reads BIGQUERY_QUOTA_RETRIES (default 5, 0 disables deferrals),
+// BIGQUERY_QUOTA_BACKOFF (the first delay, default by driver) and
+// BIGQUERY_QUOTA_MAX_BACKOFF (default 10m).
+func newQuotaBackoffFromEnv(driver string) *quotaBackoff {
+	b := &quotaBackoff{base: cmp.Or(driverCapabilities(driver).QuotaBackoff, defaultQuotaBackoff), max: 10 * time.Minute, retries: 5}
+	if b.base == 0 {
+		b.base = 30 * time.Second
+	}
+	if n, err := strconv.Atoi(os.Getenv("BIGQUERY_QUOTA_RETRIES")); err == nil && n >= 0 {
+		b.retries = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("BIGQUERY_QUOTA_BACKOFF")); err == nil && d > 0 {
+		b.base = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("BIGQUERY_QUOTA_MAX_BACKOFF")); err == nil && d > 0 {
+		b.max = d
+	}
+	b.max = max(b.max, b.base)
+	return b
+}
+
+// partialDelivery marks the error of an export that had delivered rows its destination
+// cannot take back, such as HTTP_POST batches the endpoint accepted: running it again
+// would deliver them twice, so it is not deferred.
+type partialDelivery struct{ err error }
+
+func (p *partialDelivery) Error() string { return p.err.Error() }
+func (p *partialDelivery) Unwrap() error { return p.err }
+
+// RetryAfterError is the error of an export whose caller waits for it (see
+// WithSynchronous) when BigQuery quotas are exhausted: instead of deferring it, the export
+// fails and the caller is told to send it again after RetryAfter. It matches
+// ErrQuotaExceeded.
+type RetryAfterError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v: BigQuery quota exhausted, retry after %s: %v", ErrQuotaExceeded, e.RetryAfter.Round(time.Second), e.Err)
+}
+
+func (e *RetryAfterError) Unwrap() []error { return []error{ErrQuotaExceeded, e.Err} }
+
+type synchronousKey struct{}
+
+// WithSynchronous marks ctx as that of a request whose caller waits for the export, such
+// as an HTTP request: it is not deferred on BigQuery quota errors, which could keep the
+// caller waiting for most of an hour, but fails with a RetryAfterError.
+func WithSynchronous(ctx context.Context) context.Context {
+	return context.WithValue(ctx, synchronousKey{}, true)
+}
+
+func synchronous(ctx context.Context) bool {
+	sync, _ := ctx.Value(synchronousKey{}).(bool)
+	return sync
+}
+
+// deferral returns how long to defer an export that failed with err after attempt
+// deferrals, or false when it should fail: err is no quota error, the export delivered
+// part of its rows or it was deferred too often. Every quota error extends the wait of the
+// other exports.
+func (b *quotaBackoff) deferral(err error, attempt int) (time.Duration, bool) {
+	var partial *partialDelivery
+	if b == nil || b.retries == 0 || !bigQueryQuotaError(err) || errors.As(err, &partial) {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.delay == 0 {
+		b.delay = b.base
+	} else {
+		b.delay = min(2*b.delay, b.max)
+	}
+	if until := time.Now().Add(b.delay); until.After(b.until) {
+		b.until = until
+	}
+	return b.delay, attempt < b.retries
+}
+
+// succeeded relaxes the delay after a successful export.
+func (b *quotaBackoff) succeeded() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.delay /= 2; b.delay < b.base {
+		b.delay = 0
+	}
+}
+
+// cooldown returns when exports may start again after recent quota errors (zero when
+// they may start now).
+func (b *quotaBackoff) cooldown() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.until) {
+		return b.until
+	}
+	return time.Time{}
+}
+
+// waitUntil waits until t or ctx is done.
+func waitUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		slog.InfoContext(ctx, "Deferred export cancelled")
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// quotaLimitedBigQuery fails the first failures queries with a quota error.
+type quotaLimitedBigQuery struct {
+	*fakeBigQuery
+	failures int
+}
+
+func (q *quotaLimitedBigQuery) RunQuery(ctx context.Context, sqlQuery, location string) (QueryJob, error) {
+	if q.failures > 0 {
+		q.failures--
+		q.record(sqlQuery, location)
+		return QueryJob{}, fmt.Errorf("export failed: %w", &bigquery.Error{Reason: "rateLimitExceeded", Message: "Exceeded rate limits"})
+	}
+	return q.fakeBigQuery.RunQuery(ctx, sqlQuery, location)
+}
+
+func TestQuotaBackoff(t *testing.T) {
+	bq := &quotaLimitedBigQuery{fakeBigQuery: &fakeBigQuery{}, failures: 2}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	e.quota = &quotaBackoff{base: 10 * time.Millisecond, max: 15 * time.Millisecond, retries: 2}
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/"}
+	ctx := logging.WithRequestID(context.Background(), "quota-1")
+
+	if _, err := e.Run(ctx, params); err != nil {
+		t.Fatalf("Run() after quota errors error = %v", err)
+	}
+	rec, _ := e.Jobs.Get(ctx, "quota-1")
+	if rec.Status != JobSucceeded || rec.Deferrals != 2 || rec.DeferredUntil != nil || len(bq.queries) != 3 {
+		t.Errorf("record = %+v after %d queries, want succeeded after 2 deferrals", rec, len(bq.queries))
+	}
+	if e.quota.delay != 0 {
+		t.Errorf("delay after a success = %v, want the base delay halved to 0", e.quota.delay)
+	}
+
+	// Exports deferred too often fail as transient
+	bq.failures = 3
+	_, err := e.Run(logging.WithRequestID(context.Background(), "quota-2"), params)
+	if !bigQueryQuotaError(err) || FailureClass(err) != FailureTransient {
+		t.Fatalf("Run() error = %v (%s), want a transient quota error", err, FailureClass(err))
+	}
+	if rec, _ := e.Jobs.Get(ctx, "quota-2"); rec.Status != JobFailed || rec.Deferrals != 2 {
+		t.Errorf("record = %+v, want failed after 2 deferrals", rec)
+	}
+
+	// Meanwhile other exports wait for the quota to clear
+	if until := e.quota.cooldown(); until.IsZero() {
+		t.Error("cooldown() after a quota error is zero")
+	}
+	if _, ok := e.quota.deferral(errors.New("syntax error"), 0); ok {
+		t.Error("deferral() of a non-quota error succeeded")
+	}
+	quotaErr := &bigquery.Error{Reason: "quotaExceeded"}
+	if _, ok := e.quota.deferral(&partialDelivery{quotaErr}, 0); ok {
+		t.Error("deferral() of an export that delivered part of its rows succeeded")
+	}
+
+	// Callers that wait are told when to retry instead
+	e.quota = &quotaBackoff{base: time.Minute, max: time.Minute, retries: 2}
+	bq.failures = 1
+	sync := WithSynchronous(logging.WithRequestID(context.Background(), "quota-3"))
+	_, err = e.Run(sync, params)
+	var ra *RetryAfterError
+	if !errors.As(err, &ra) || ra.RetryAfter != time.Minute || !errors.Is(err, ErrQuotaExceeded) || !bigQueryQuotaError(err) {
+		t.Fatalf("synchronous Run() error = %v, want a RetryAfterError of 1m", err)
+	}
+	if rec, _ := e.Jobs.Get(ctx, "quota-3"); rec.Status != JobFailed || rec.Deferrals != 0 {
+		t.Errorf("record = %+v, want failed without deferral", rec)
+	}
+	_, err = e.Run(WithSynchronous(context.Background()), params)
+	if !errors.As(err, &ra) || ra.RetryAfter <= 0 || ra.RetryAfter > time.Minute {
+		t.Errorf("synchronous Run() during the cooldown error = %v, want a RetryAfterError", err)
+	}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// FormatREDCap writes CSV files for the REDCap data import tool, with the columns named
+// and formatted by the redcap_mappings entry named by ExportParams.REDCapMapping.
+const FormatREDCap = "redcap"
+
+// redcapParams turns a redcap export into the CSV export of the query selecting the
+// import columns from the result (see redcapQuery).
+func redcapParams(p ExportParams, schema bigquery.Schema) (ExportParams, error) {
+	q, err := redcapQuery(p.redcap, p.Query, schema)
+	if err != nil {
+		return p, err
+	}
+	p.Query, p.Format, p.CSVHeader = q, FormatCSV, CSVHeaderNames
+	return p, nil
+}
+
+// redcapQuery selects the columns of a REDCap import from the result of q: the record ID,
+// redcap_event_name and the repeating instrument columns as mapped, then the fields in the
+// order of their columns in the result. Values take REDCap's formats: dates as Y-M-D,
+// datetimes and timestamps (in UTC) as Y-M-D H:M, booleans as 1 and 0. A row whose event
+// column value is not mapped fails the query.
+func redcapQuery(m *config.REDCapMapping, q string, schema bigquery.Schema) (string, error) {
+	fields := map[string]*bigquery.FieldSchema{}
+	order := map[string]int{}
+	for i, f := range schema {
+		fields[f.Name], order[f.Name] = f, i
+	}
+	column := func(what, c string) (string, error) {
+		if fields[c] == nil {
+			return "", fmt.Errorf("REDCap %s maps column %s, which the query result does not have", what, c)
+		}
+		return quoteBigQueryColumn(c), nil
+	}
+
+	var cols []string
+	id, err := column("record ID", m.RecordID)
+	if err != nil {
+		return "", err
+	}
+	cols = append(cols, fmt.Sprintf("CAST(%s AS STRING) AS %s", id, cmp.Or(m.RecordIDField, config.REDCapRecordIDField)))
+	if e := m.Event; e != nil {
+		expr := quoteBigQueryString(e.Name)
+		if e.Column != "" {
+			c, err := column("event", e.Column)
+			if err != nil {
+				return "", err
+			}
+			values := make([]string, 0, len(e.Values))
+			for v := range e.Values {
+				values = append(values, v)
+			}
+			sort.Strings(values)
+			var b strings.Builder
+			fmt.Fprintf(&b, "CASE CAST(%s AS STRING)", c)
+			for _, v := range values {
+				fmt.Fprintf(&b, " WHEN %s THEN %s", quoteBigQueryString(v), quoteBigQueryString(e.Values[v]))
+			}
+			fmt.Fprintf(&b, " ELSE ERROR(CONCAT(%s, IFNULL(CAST(%s AS STRING), 'NULL'))) END",
+				quoteBigQueryString("no REDCap event is mapped for "+e.Column+" value "), c)
+			expr = b.String()
+		}
+		cols = append(cols, expr+" AS "+config.REDCapEventColumn)
+	}
+	if m.RepeatInstance != "" {
+		instrument := "CAST(NULL AS STRING)"
+		if m.RepeatInstrument != "" {
+			instrument = quoteBigQueryString(m.RepeatInstrument)
+		}
+		c, err := column("repeat instance", m.RepeatInstance)
+		if err != nil {
+			return "", err
+		}
+		cols = append(cols, instrument+" AS "+config.REDCapRepeatInstrumentColumn, c+" AS "+config.REDCapRepeatInstanceColumn)
+	}
+
+	names := make([]string, 0, len(m.Fields))
+	for name, c := range m.Fields {
+		if fields[c] == nil {
+			return "", fmt.Errorf("REDCap field %s maps column %s, which the query result does not have", name, c)
+		}
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(cmp.Compare(order[m.Fields[a]], order[m.Fields[b]]), cmp.Compare(a, b))
+	})
+	clock := "%H:%M"
+	if m.DatetimeSeconds {
+		clock = "%H:%M:%S"
+	}
+	for _, name := range names {
+		f := fields[m.Fields[name]]
+		c := quoteBigQueryColumn(f.Name)
+		if f.Repeated || f.Type == bigquery.RecordFieldType {
+			return "", fmt.Errorf("REDCap field %s maps column %s of type %s; REDCap fields are flat values", name, f.Name, redcapTypeName(f))
+		}
+		expr := c
+		switch f.Type {
+		case bigquery.DateFieldType:
+			expr = fmt.Sprintf("FORMAT_DATE('%%Y-%%m-%%d', %s)", c)
+		case bigquery.DateTimeFieldType:
+			expr = fmt.Sprintf("FORMAT_DATETIME('%%Y-%%m-%%d %s', %s)", clock, c)
+		case bigquery.TimestampFieldType:
+			expr = fmt.Sprintf("FORMAT_TIMESTAMP('%%Y-%%m-%%d %s', %s, 'UTC')", clock, c)
+		case bigquery.TimeFieldType:
+			expr = fmt.Sprintf("FORMAT_TIME('%s', %s)", clock, c)
+		case bigquery.BooleanFieldType:
+			expr = fmt.Sprintf("CAST(CAST(%s AS INT64) AS STRING)", c)
+		}
+		cols = append(cols, expr+" AS "+name)
+	}
+	return "SELECT " + strings.Join(cols, ", ") + " FROM (" + q + ")", nil
+}
+
+func redcapTypeName(f *bigquery.FieldSchema) string {
+	if f.Repeated {
+		return "ARRAY<" + string(f.Type) + ">"
+	}
+	return string(f.Type)
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+var testREDCapMapping = config.REDCapMapping{
+	RecordID:         "patient_id",
+	RecordIDField:    "study_id",
+	Event:            &config.REDCapEvent{Column: "visit", Values: map[string]string{"D7": "day_7_arm_1", "D0": "baseline_arm_1"}},
+	RepeatInstrument: "labs",
+	RepeatInstance:   "lab_no",
+	Fields:           map[string]string{"lab_date": "taken_at", "hb": "hb_g_dl", "fasting": "fasting", "hb_copy": "hb_g_dl"},
+}
+
+var testREDCapSchema = bigquery.Schema{
+	{Name: "patient_id", Type: bigquery.IntegerFieldType},
+	{Name: "visit", Type: bigquery.StringFieldType},
+	{Name: "lab_no", Type: bigquery.IntegerFieldType},
+	{Name: "hb_g_dl", Type: bigquery.FloatFieldType},
+	{Name: "taken_at", Type: bigquery.TimestampFieldType},
+	{Name: "fasting", Type: bigquery.BooleanFieldType},
+	{Name: "notes", Type: bigquery.StringFieldType, Repeated: true},
+}
+
+func TestREDCapQuery(t *testing.T) {
+	got, err := redcapQuery(&testREDCapMapping, "SELECT * FROM ds.labs", testREDCapSchema)
+	if err != nil {
+		t.Fatalf("redcapQuery() error = %v", err)
+	}
+	want := "SELECT CAST(`patient_id` AS STRING) AS study_id, " +
+		"CASE CAST(`visit` AS STRING) WHEN 'D0' THEN 'baseline_arm_1' WHEN 'D7' THEN 'day_7_arm_1' " +
+		"ELSE ERROR(CONCAT('no REDCap event is mapped for visit value ', IFNULL(CAST(`visit` AS STRING), 'NULL'))) END AS redcap_event_name, " +
+		"'labs' AS redcap_repeat_instrument, `lab_no` AS redcap_repeat_instance, " +
+		"`hb_g_dl` AS hb, `hb_g_dl` AS hb_copy, FORMAT_TIMESTAMP('%Y-%m-%d %H:%M', `taken_at`, 'UTC') AS lab_date, " +
+		"CAST(CAST(`fasting` AS INT64) AS STRING) AS fasting FROM (SELECT * FROM ds.labs)"
+	if got != want {
+		t.Errorf("redcapQuery() =\n%s\nwant\n%s", got, want)
+	}
+
+	event := config.REDCapMapping{RecordID: "patient_id", Event: &config.REDCapEvent{Name: "enrolment_arm_1"}, Fields: map[string]string{"visit": "visit"}}
+	if got, _ := redcapQuery(&event, "q", testREDCapSchema); got != "SELECT CAST(`patient_id` AS STRING) AS record_id, 'enrolment_arm_1' AS redcap_event_name, `visit` AS visit FROM (q)" {
+		t.Errorf("redcapQuery() with a fixed event = %s", got)
+	}
+	for name, bad := range map[string]config.REDCapMapping{
+		"missing column": {RecordID: "patient_id", Fields: map[string]string{"age": "age"}},
+		"array":          {RecordID: "patient_id", Fields: map[string]string{"notes": "notes"}},
+	} {
+		if _, err := redcapQuery(&bad, "q", testREDCapSchema); err == nil {
+			t.Errorf("%s: redcapQuery() succeeded", name)
+		}
+	}
+}
+
+func TestExportREDCap(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &exportingBigQuery{fakeBigQuery: fakeBigQuery{schema: testREDCapSchema}, gcs: gcs}
+	cfg := &config.Config{REDCapMappings: map[string]config.REDCapMapping{"labs": testREDCapMapping}}
+	e := NewExporter(bq, NewGCSDriver(gcs.service(t), nil), cfg)
+	res, err := e.Run(context.Background(), ExportParams{
+		Query: "SELECT * FROM ds.labs", QueryLocation: "US", Output: "gs://b/redcap/", Filename: "labs",
+		Format: FormatREDCap, REDCapMapping: "labs",
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if res.GCSPath != "gs://b/redcap/labs-*.csv" {
+		t.Errorf("GCSPath = %q", res.GCSPath)
+	}
+	export := bq.queries[len(bq.queries)-1]
+	if !strings.Contains(export, "format='CSV'") || !strings.Contains(export, "header=true") || !strings.Contains(export, "AS redcap_event_name") {
+		t.Errorf("export SQL = %s", export)
+	}
+
+	for _, bad := range []ExportParams{
+		{Format: FormatREDCap},
+		{Format: FormatREDCap, REDCapMapping: "visits"},
+		{REDCapMapping: "labs"},
+		{Format: FormatREDCap, REDCapMapping: "labs", CSVBOM: true},
+	} {
+		bad.Query, bad.QueryLocation, bad.Output = "SELECT 1", "US", "gs://b/redcap/"
+		if _, err := e.Run(context.Background(), bad); FailureClass(err) != FailureConfig {
+			t.Errorf("Run(%+v) error = %v, want a config error", bad, err)
+		}
+	}
+}
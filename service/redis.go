@@ -0,0 +1,262 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/api/iterator"
+)
+
+// redisDriverName is the EXPORT_DRIVER value of RedisDriver.
+const redisDriverName = "REDIS"
+
+// Key types of RedisDriver.
+const (
+	RedisHash = "hash"
+	RedisSet  = "set"
+)
+
+// defaultRedisMaxRows is the row cap of Redis exports unless REDIS_MAX_ROWS sets another.
+const defaultRedisMaxRows = 100000
+
+// redisBatchKeys is the number of keys written per MULTI/EXEC transaction.
+const redisBatchKeys = 500
+
+// RedisDriver loads small lookup tables into Redis. With redis_type hash every row is a
+// hash of its non-NULL columns at <table>:<key column values>; with redis_type set the
+// values of the one other column are the members of the set at <table>:<key values>, or
+// at <table> without key_columns. Every key written is replaced as a whole and expires
+// after redis_ttl, if set; keys of rows no longer in the result are left to expire. The
+// result is read before anything is written, so results of more than maxRows rows fail
+// without touching Redis.
+type RedisDriver struct {
+	client  *redis.Client
+	maxRows int
+}
+
+func NewRedisDriver(client *redis.Client) *RedisDriver {
+	return &RedisDriver{client: client, maxRows: defaultRedisMaxRows}
+}
+
+// NewRedisDriverFromEnv connects to REDIS_URL (redis:// or rediss://); REDIS_MAX_ROWS
+// (default 100000) caps the rows of an export.
+func NewRedisDriverFromEnv(ctx context.Context) (*RedisDriver, error) {
+	opts, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+	if err != nil {
+		return nil, ConfigError(fmt.Errorf("invalid REDIS_URL: %w", err))
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, TransientError(fmt.Errorf("failed to connect to Redis %s: %w", opts.Addr, err))
+	}
+	d := NewRedisDriver(client)
+	if n, err := strconv.Atoi(os.Getenv("REDIS_MAX_ROWS")); err == nil && n > 0 {
+		d.maxRows = n
+	}
+	return d, nil
+}
+
+func (d *RedisDriver) Name() string {
+	return redisDriverName
+}
+
+func (d *RedisDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{ReadsRows: true}
+}
+
+func (d *RedisDriver) Close() error {
+	return d.client.Close()
+}
+
+// redisOptions returns the key prefix, key type and TTL of an export.
+func redisOptions(p ExportParams) (string, string, time.Duration, error) {
+	prefix := cmp.Or(p.Table, p.Name)
+	if prefix == "" {
+		return "", "", 0, fmt.Errorf("the %s driver needs table, the prefix of its keys", redisDriverName)
+	}
+	typ := cmp.Or(strings.ToLower(p.RedisType), RedisHash)
+	switch typ {
+	case RedisHash:
+		if len(p.KeyColumns) == 0 {
+			return "", "", 0, fmt.Errorf("redis_type %s needs key_columns", RedisHash)
+		}
+	case RedisSet:
+	default:
+		return "", "", 0, fmt.Errorf("unknown redis_type %q; expected %s or %s", p.RedisType, RedisHash, RedisSet)
+	}
+	var ttl time.Duration
+	if p.RedisTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(p.RedisTTL); err != nil || ttl <= 0 {
+			return "", "", 0, fmt.Errorf("invalid redis_ttl %q; expected a positive duration such as 25h", p.RedisTTL)
+		}
+	}
+	return prefix, typ, ttl, nil
+}
+
+// checkRedis validates the options of the REDIS driver.
+func checkRedis(p ExportParams, driver string) error {
+	if driver != redisDriverName {
+		if p.RedisType != "" || p.RedisTTL != "" {
+			return fmt.Errorf("redis_type and redis_ttl are only supported by the %s driver", redisDriverName)
+		}
+		return nil
+	}
+	_, _, _, err := redisOptions(p)
+	return err
+}
+
+func (d *RedisDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	prefix, typ, ttl, err := redisOptions(params)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	res := ExportResult{Table: prefix}
+	slog.InfoContext(ctx, "Starting Redis export", "prefix", prefix, "redis_type", typ, "ttl", ttl, "max_rows", d.maxRows)
+
+	// One row past the cap tells a full result from one that is too large
+	it, err := bq.ReadRows(ctx, fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", params.Query, d.maxRows+1), params.QueryLocation)
+	if err != nil {
+		return res, fmt.Errorf("export to Redis failed: %w", err)
+	}
+	defer it.Close()
+	if it, err = transformRows(ctx, it, params.transformers); err != nil {
+		return res, err
+	}
+	var (
+		keys   []string
+		values = map[string][]any{} // field-value pairs of hashes, members of sets
+		plan   *redisKeys
+	)
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			res.Job = it.Job()
+			return res, fmt.Errorf("export to Redis failed: %w", err)
+		}
+		if res.Rows == int64(d.maxRows) {
+			res.Job = it.Job()
+			return res, DataError(fmt.Errorf("result has more than %d rows (REDIS_MAX_ROWS); Redis exports are for lookup tables", d.maxRows))
+		}
+		if plan == nil {
+			if plan, err = newRedisKeys(it.Schema(), prefix, typ, params.KeyColumns); err != nil {
+				res.Job = it.Job()
+				return res, ConfigError(err)
+			}
+		}
+		key, vals, err := plan.row(row)
+		if err != nil {
+			res.Job = it.Job()
+			return res, DataError(fmt.Errorf("row %d: %w", res.Rows+1, err))
+		}
+		if _, seen := values[key]; !seen {
+			keys = append(keys, key)
+		}
+		if typ == RedisHash {
+			// The last row of a key wins
+			values[key] = vals
+		} else {
+			values[key] = append(values[key], vals...)
+		}
+		res.Rows++
+	}
+	res.Job = it.Job()
+
+	for batch := range slices.Chunk(keys, redisBatchKeys) {
+		_, err := d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range batch {
+				pipe.Del(ctx, key)
+				if vals := values[key]; len(vals) > 0 {
+					if typ == RedisHash {
+						pipe.HSet(ctx, key, vals...)
+					} else {
+						pipe.SAdd(ctx, key, vals...)
+					}
+				}
+				if ttl > 0 {
+					pipe.Expire(ctx, key, ttl)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return res, fmt.Errorf("failed to write Redis keys: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "Redis export completed", "prefix", prefix, "rows", res.Rows, "keys", len(keys))
+	return res, nil
+}
+
+// redisKeys maps result rows to their key and the values stored at it.
+type redisKeys struct {
+	schema bigquery.Schema
+	prefix string
+	typ    string
+	keys   []int
+	// member is the column of set members
+	member int
+}
+
+func newRedisKeys(schema bigquery.Schema, prefix, typ string, keyColumns []string) (*redisKeys, error) {
+	k := &redisKeys{schema: schema, prefix: prefix, typ: typ, member: -1}
+	for _, name := range keyColumns {
+		i := schemaIndex(schema, name)
+		if i < 0 {
+			return nil, fmt.Errorf("key column %q is not a column of the result", name)
+		}
+		k.keys = append(k.keys, i)
+	}
+	if typ == RedisSet {
+		for i := range schema {
+			if slices.Contains(k.keys, i) {
+				continue
+			}
+			if k.member >= 0 {
+				return nil, fmt.Errorf("redis_type %s needs one column besides key_columns, the members; the result has more", RedisSet)
+			}
+			k.member = i
+		}
+		if k.member < 0 {
+			return nil, fmt.Errorf("redis_type %s needs one column besides key_columns, the members", RedisSet)
+		}
+	}
+	return k, nil
+}
+
+// row returns the key of row and its field-value pairs (hashes) or member (sets).
+func (k *redisKeys) row(row []bigquery.Value) (string, []any, error) {
+	key := k.prefix
+	for _, i := range k.keys {
+		if row[i] == nil {
+			return "", nil, fmt.Errorf("key column %s is NULL", k.schema[i].Name)
+		}
+		key += ":" + downloadCSVCell(row[i])
+	}
+	if k.typ == RedisSet {
+		if row[k.member] == nil {
+			return key, nil, nil
+		}
+		return key, []any{downloadCSVCell(row[k.member])}, nil
+	}
+	var vals []any
+	for i, v := range row[:min(len(row), len(k.schema))] {
+		if v != nil {
+			vals = append(vals, k.schema[i].Name, downloadCSVCell(v))
+		}
+	}
+	return key, vals, nil
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisDriver(t *testing.T) {
+	mr := miniredis.RunT(t)
+	d := NewRedisDriver(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	t.Cleanup(func() { d.Close() })
+	schema := bigquery.Schema{
+		{Name: "site_id", Type: bigquery.StringFieldType},
+		{Name: "beds", Type: bigquery.IntegerFieldType},
+		{Name: "name", Type: bigquery.StringFieldType},
+	}
+	bq := &fakeBigQuery{schema: schema, rows: [][]bigquery.Value{
+		{"a", int64(10), "Alpha"},
+		{"b", nil, "Beta"},
+	}}
+	mr.HSet("sites:b", "beds", "3")
+	params := ExportParams{Query: "SELECT 1", Table: "sites", KeyColumns: []string{"site_id"}, RedisTTL: "25h"}
+	res, err := d.Execute(context.Background(), bq, params)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.Rows != 2 || res.Table != "sites" {
+		t.Errorf("Execute() = %d rows to %s, want 2 to sites", res.Rows, res.Table)
+	}
+	if got := mr.HGet("sites:a", "beds"); got != "10" {
+		t.Errorf("sites:a beds = %q, want 10", got)
+	}
+	if mr.Exists("sites:b") && mr.HGet("sites:b", "beds") != "" {
+		t.Error("sites:b keeps beds, want the hash replaced by the row")
+	}
+	if ttl := mr.TTL("sites:a"); ttl != 25*time.Hour {
+		t.Errorf("TTL = %s, want 25h", ttl)
+	}
+
+	bq.schema = schema[:2]
+	bq.rows = [][]bigquery.Value{{"a", int64(1)}, {"a", int64(2)}, {"b", int64(3)}}
+	params = ExportParams{Query: "SELECT 1", Table: "beds", KeyColumns: []string{"site_id"}, RedisType: RedisSet}
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() set error = %v", err)
+	}
+	if got, _ := mr.Members("beds:a"); len(got) != 2 {
+		t.Errorf("beds:a = %v, want two members", got)
+	}
+
+	d.maxRows = 2
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData {
+		t.Errorf("Execute() over the row cap error = %v, want a data error", err)
+	}
+	d.maxRows = defaultRedisMaxRows
+	bq.rows = [][]bigquery.Value{{nil, int64(1)}}
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData {
+		t.Errorf("Execute() with a NULL key error = %v, want a data error", err)
+	}
+	bq.schema = schema
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureConfig {
+		t.Errorf("Execute() set of two value columns error = %v, want a config error", err)
+	}
+}
+
+func TestCheckRedis(t *testing.T) {
+	for _, tt := range []struct {
+		driver string
+		p      ExportParams
+		ok     bool
+	}{
+		{redisDriverName, ExportParams{Table: "sites", KeyColumns: []string{"id"}}, true},
+		{redisDriverName, ExportParams{Table: "wards", RedisType: "set", RedisTTL: "1h"}, true},
+		{redisDriverName, ExportParams{Table: "sites"}, false},
+		{redisDriverName, ExportParams{Table: "sites", RedisType: "list"}, false},
+		{redisDriverName, ExportParams{Table: "wards", RedisType: "set", RedisTTL: "-1h"}, false},
+		{"STARROCKS", ExportParams{RedisTTL: "1h"}, false},
+	} {
+		if err := checkRedis(tt.p, tt.driver); (err == nil) != tt.ok {
+			t.Errorf("checkRedis(%+v, %s) error = %v, want ok %v", tt.p, tt.driver, err, tt.ok)
+		}
+	}
+}
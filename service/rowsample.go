@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// RowSample is a few rows of a run's destination, limited to the configured columns and
+// with masked values unless their column is clear (see config.NotifySample).
+type RowSample struct {
+	Columns []string `json:"columns"`
+	// Rows hold the values as text, nil for NULL
+	Rows [][]*string `json:"rows"`
+}
+
+// sampleRows reads the sample of params.NotifySample from the destination of res.
+func (e *Exporter) sampleRows(ctx context.Context, bq BigQueryClient, params ExportParams, res ExportResult) (*RowSample, error) {
+	s := params.NotifySample
+	if err := s.Validate(); err != nil {
+		return nil, ConfigError(err)
+	}
+	n := cmp.Or(s.Rows, config.DefaultSampleRows)
+	rows, err := e.readDestination(ctx, bq, params, res, func(d destinationDialect, mapping map[string]string, table string) string {
+		cols := make([]string, len(s.Columns))
+		for i, c := range s.Columns {
+			cols[i] = d.quote(cmp.Or(mapping[c], c))
+		}
+		return fmt.Sprintf("SELECT %s FROM %s LIMIT %d", strings.Join(cols, ", "), table, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sample := &RowSample{Columns: s.Columns, Rows: make([][]*string, len(rows))}
+	for i, row := range rows {
+		sample.Rows[i] = make([]*string, len(row))
+		for j, v := range row {
+			if !v.Valid {
+				continue
+			}
+			text := v.String
+			if !slices.Contains(s.Clear, s.Columns[j]) {
+				text = maskValue(text)
+			}
+			sample.Rows[i][j] = &text
+		}
+	}
+	return sample, nil
+}
+
+// maskValue keeps the shape of a value but not its characters: letters become x (X when
+// upper case), digits 9, and everything else stays.
+func maskValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsUpper(r):
+			return 'X'
+		case unicode.IsLetter(r):
+			return 'x'
+		case unicode.IsDigit(r):
+			return '9'
+		}
+		return r
+	}, s)
+}
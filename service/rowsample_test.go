@@ -0,0 +1,39 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestSampleRows(t *testing.T) {
+	bq := &fakeBigQuery{rows: [][]bigquery.Value{{"A1", "Nguyen Van An", nil}, {"B2", "Tran Thi 2", int64(41)}}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	ctx := logging.WithRequestID(context.Background(), "run-1")
+	sample := &config.NotifySample{Rows: 2, Columns: []string{"site", "name", "age"}, Clear: []string{"site"}}
+	res, err := e.Run(ctx, ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/out/", NotifySample: sample})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if q := bq.queries[len(bq.queries)-1]; !strings.Contains(q, "LOAD DATA INTO TEMP TABLE _rows") || !strings.Contains(q, "SELECT `site`, `name`, `age` FROM _rows LIMIT 2") {
+		t.Errorf("sample query = %s, want the configured columns of the exported files", q)
+	}
+	s := res.Sample
+	if s == nil || len(s.Rows) != 2 || *s.Rows[0][0] != "A1" || *s.Rows[0][1] != "Xxxxxx Xxx Xx" || s.Rows[0][2] != nil || *s.Rows[1][1] != "Xxxx Xxx 9" || *s.Rows[1][2] != "99" {
+		t.Fatalf("Run() sample = %+v, want two rows masked but for the sites", s)
+	}
+	if rec, _ := e.Jobs.Get(ctx, "run-1"); rec.Sample != s {
+		t.Errorf("job record sample = %+v, want the run's sample", rec.Sample)
+	}
+
+	// A failed sample does not fail the run
+	bq.rows = nil
+	if res, err := e.Run(logging.WithRequestID(context.Background(), "run-2"), ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/out/",
+		NotifySample: &config.NotifySample{Columns: []string{"site"}, Clear: []string{"name"}}}); err != nil || res.Sample != nil {
+		t.Errorf("Run(invalid sample) = %+v, %v, want success without a sample", res.Sample, err)
+	}
+}
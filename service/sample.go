@@ -0,0 +1,35 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// checkSample validates the test export options limit and sample_percent. Incremental
+// exports reject them: their watermark or snapshot would advance past the rows left out.
+func checkSample(p ExportParams) error {
+	if p.Limit == 0 && p.SamplePercent == 0 {
+		return nil
+	}
+	switch {
+	case p.Limit < 0:
+		return fmt.Errorf("limit must be positive, got %d", p.Limit)
+	case p.SamplePercent < 0 || p.SamplePercent > 100:
+		return fmt.Errorf("sample_percent must be between 0 and 100, got %g", p.SamplePercent)
+	case p.DiffSnapshot != "" || p.ChangesTable != "":
+		return fmt.Errorf("limit and sample_percent cannot be combined with diff_snapshot or changes_table")
+	}
+	return nil
+}
+
+// sampleQuery keeps a random SamplePercent of the rows of query, then at most Limit of
+// them. Sampling filters the result, so the query still scans (and bills) all its input.
+func sampleQuery(query string, p ExportParams) string {
+	if p.SamplePercent > 0 && p.SamplePercent < 100 {
+		query = fmt.Sprintf("SELECT * FROM (%s) WHERE RAND() < %s", query, strconv.FormatFloat(p.SamplePercent/100, 'g', -1, 64))
+	}
+	if p.Limit > 0 {
+		query = fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", query, p.Limit)
+	}
+	return query
+}
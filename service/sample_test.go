@@ -0,0 +1,51 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSampleQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		p    ExportParams
+		want string
+	}{
+		{"none", ExportParams{}, "SELECT * FROM ds.t"},
+		{"limit", ExportParams{Limit: 100}, "SELECT * FROM (SELECT * FROM ds.t) LIMIT 100"},
+		{"sample", ExportParams{SamplePercent: 2.5}, "SELECT * FROM (SELECT * FROM ds.t) WHERE RAND() < 0.025"},
+		{"everything", ExportParams{SamplePercent: 100}, "SELECT * FROM ds.t"},
+		{"both", ExportParams{SamplePercent: 10, Limit: 5}, "SELECT * FROM (SELECT * FROM (SELECT * FROM ds.t) WHERE RAND() < 0.1) LIMIT 5"},
+	}
+	for _, tt := range tests {
+		if got := sampleQuery("SELECT * FROM ds.t", tt.p); got != tt.want {
+			t.Errorf("%s: sampleQuery() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunSample(t *testing.T) {
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	params := ExportParams{Query: "SELECT * FROM ds.visits", QueryLocation: "US", Output: "gs://b/staging/", Limit: 1000, SamplePercent: 1}
+	if _, err := e.Run(context.Background(), params); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if export := bq.queries[len(bq.queries)-1]; !strings.Contains(export, "WHERE RAND() < 0.01) LIMIT 1000") {
+		t.Errorf("export query %s is not sampled", export)
+	}
+
+	for _, bad := range []ExportParams{
+		{Query: "SELECT 1", Limit: -1},
+		{Query: "SELECT 1", SamplePercent: 150},
+		{Query: "SELECT 1", Limit: 10, DiffSnapshot: "ds.snap", KeyColumns: []string{"id"}},
+		{ChangesTable: "ds.visits", SamplePercent: 5},
+	} {
+		bad.QueryLocation, bad.Output = "US", "gs://b/staging/"
+		if _, err := e.Run(context.Background(), bad); FailureClass(err) != FailureConfig {
+			t.Errorf("Run(%+v) error = %v, want a config error", bad, err)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrScheduleNotFound is returned for pipelines without a schedule (or not visible to
+	// the caller).
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrScheduleRunning is returned when triggering a schedule whose run is in progress.
+	ErrScheduleRunning = errors.New("schedule already running")
+)
+
+// ScheduleState is the runtime state of one pipeline schedule.
+type ScheduleState struct {
+	Pipeline string     `json:"pipeline"`
+	Tenant   string     `json:"tenant,omitempty"`
+	Schedule string     `json:"schedule"`
+	Paused   bool       `json:"paused"`
+	PausedAt *time.Time `json:"paused_at,omitempty"`
+	Running  bool       `json:"running"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastJobID  string     `json:"last_job_id,omitempty"`
+	LastStatus string     `json:"last_status,omitempty"`
+}
+
+// Scheduler runs pipelines on their cron schedules. Schedules can be paused, resumed and
+// triggered at runtime; pauses and the last run of every schedule are persisted as JSON
+// when a state file is configured, so they survive restarts and redeploys. Runs missed
+// while the service was down or a schedule was paused are not caught up.
+//
+// With a shared coordinator, every instance may run the scheduler: each scheduled time
+// starts one run, on the first instance to claim it, a schedule runs on one instance at
+// a time, and the state is kept by the coordinator instead of the state file.
+type Scheduler struct {
+	e       *Exporter
+	tenants map[string]config.Tenant
+	loc     *time.Location
+	path    string
+	coord   Coordinator
+	shared  bool
+
+	mu    sync.Mutex
+	state map[string]*ScheduleState
+	runs  sync.WaitGroup
+}
+
+// NewScheduler evaluates schedules in loc and loads the state file at path, if any (""
+// keeps state in memory only).
+func NewScheduler(e *Exporter, tenants map[string]config.Tenant, loc *time.Location, path string) (*Scheduler, error) {
+	s := &Scheduler{e: e, tenants: tenants, loc: loc, path: path, coord: e.Coordinator, state: map[string]*ScheduleState{}}
+	if s.coord == nil {
+		s.coord = newLocalCoordinator()
+	}
+	s.shared = sharedCoordinator(s.coord)
+	if path == "" || s.shared {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule state file: %w", err)
+	}
+	var states []ScheduleState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("failed to parse schedule state file %s: %w", path, err)
+	}
+	for _, st := range states {
+		st := st
+		st.Running, st.NextRun = false, nil
+		s.state[st.Pipeline] = &st
+	}
+	return s, nil
+}
+
+// NewSchedulerFromEnv evaluates schedules in SCHEDULER_TIMEZONE (default UTC) and
+// persists state to SCHEDULE_STATE_FILE when set.
+func NewSchedulerFromEnv(e *Exporter, tenants map[string]config.Tenant) (*Scheduler, error) {
+	loc := time.UTC
+	if tz := os.Getenv("SCHEDULER_TIMEZONE"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid SCHEDULER_TIMEZONE: %w", err)
+		}
+	}
+	return NewScheduler(e, tenants, loc, os.Getenv("SCHEDULE_STATE_FILE"))
+}
+
+// Run starts due pipelines every minute until ctx is cancelled, then waits for runs in
+// progress (which are cancelled along with ctx) to finish.
+func (s *Scheduler) Run(ctx context.Context) {
+	slog.InfoContext(ctx, "Scheduler started", "timezone", s.loc.String())
+	defer s.runs.Wait()
+	for {
+		s.tick(ctx, time.Now())
+		now := time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+	}
+}
+
+// tick starts the schedules due at now and plans their next run.
+func (s *Scheduler) tick(ctx context.Context, now time.Time) {
+	now = now.In(s.loc)
+	for _, name := range s.e.Pipelines.Names() {
+		p, ok := s.e.Pipelines.Get(name)
+		if !ok || p.Schedule == "" || p.PendingApproval {
+			continue
+		}
+		sched, err := config.ParseSchedule(p.Schedule)
+		if err != nil {
+			slog.ErrorContext(ctx, "Skipping pipeline with invalid schedule", "pipeline", name, "error", err)
+			continue
+		}
+		s.mu.Lock()
+		st := s.entryLocked(ctx, name, p)
+		due := st.NextRun != nil && !now.Before(*st.NextRun)
+		var fire time.Time
+		if due {
+			fire = *st.NextRun
+		}
+		if st.NextRun == nil || due {
+			if next := sched.Next(now); !next.IsZero() {
+				st.NextRun = &next
+			}
+		}
+		start := due && !st.Paused && !st.Running
+		if due && st.Running {
+			slog.WarnContext(ctx, "Skipping scheduled run: previous run still in progress", "pipeline", name)
+		}
+		if start {
+			st.Running = true
+		}
+		s.mu.Unlock()
+		if !start {
+			continue
+		}
+		runCtx := logging.WithRequestID(ctx, logging.NewRequestID())
+		leaseCtx, release, holder, err := s.claim(runCtx, name, fire)
+		if release == nil {
+			switch {
+			case err != nil:
+				slog.ErrorContext(ctx, "Skipping scheduled run: failed to claim it", "pipeline", name, "error", err)
+			case holder != "":
+				slog.WarnContext(ctx, "Skipping scheduled run: previous run still in progress", "pipeline", name, "job_id", holder)
+			default:
+				slog.DebugContext(ctx, "Scheduled run started by another instance", "pipeline", name)
+			}
+			s.mu.Lock()
+			s.state[name].Running = false
+			s.mu.Unlock()
+			continue
+		}
+		s.launch(leaseCtx, name, p, release)
+	}
+}
+
+// scheduleClaimTTL is how long the claim of a scheduled time keeps other instances from
+// running it too; it only needs to outlast their clock skew.
+const scheduleClaimTTL = time.Hour
+
+// claim takes the run lease of a schedule for the run of ctx and, with fire set, the
+// scheduled time fire. It returns the context of the run, cancelled when the lease is
+// lost, and a func releasing the lease; or nil and the holder of the lease when a run is
+// in progress, or nil and "" when another instance already started the run of fire.
+func (s *Scheduler) claim(ctx context.Context, name string, fire time.Time) (context.Context, func(), string, error) {
+	key, holder := "schedule:"+name, logging.RequestID(ctx)
+	ok, cur, err := s.coord.TryLock(ctx, key, holder, leaseTTL)
+	if err != nil || !ok {
+		return nil, nil, cur, err
+	}
+	leaseCtx, release := holdLease(ctx, s.coord, key, holder, leaseTTL)
+	if !fire.IsZero() {
+		ok, _, err := s.coord.TryLock(ctx, key+"@"+fire.UTC().Format(time.RFC3339), holder, scheduleClaimTTL)
+		if err != nil || !ok {
+			release()
+			return nil, nil, "", err
+		}
+	}
+	return leaseCtx, release, "", nil
+}
+
+// entryLocked returns the state of a scheduled pipeline, resetting its plan when the
+// schedule changed.
+func (s *Scheduler) entryLocked(ctx context.Context, name string, p config.Pipeline) *ScheduleState {
+	st, ok := s.state[name]
+	if !ok {
+		st = &ScheduleState{Pipeline: name}
+		s.state[name] = st
+	}
+	s.refreshLocked(ctx, st)
+	if st.Schedule != p.Schedule {
+		st.Schedule, st.NextRun = p.Schedule, nil
+	}
+	st.Tenant = p.Tenant
+	return st
+}
+
+// refreshLocked loads the pause and last run of a schedule kept by a shared coordinator,
+// which other instances may have changed.
+func (s *Scheduler) refreshLocked(ctx context.Context, st *ScheduleState) {
+	if !s.shared {
+		return
+	}
+	data, err := s.coord.Get(ctx, "schedule-state:"+st.Pipeline)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load schedule state", "pipeline", st.Pipeline, "error", err)
+		return
+	}
+	var shared ScheduleState
+	if data == nil || json.Unmarshal(data, &shared) != nil {
+		return
+	}
+	st.Paused, st.PausedAt = shared.Paused, shared.PausedAt
+	st.LastRun, st.LastJobID, st.LastStatus = shared.LastRun, shared.LastJobID, shared.LastStatus
+}
+
+// launch runs the pipeline in the background as its owning tenant, then releases the run
+// lease of the schedule.
+func (s *Scheduler) launch(ctx context.Context, name string, p config.Pipeline, release func()) {
+	if p.Tenant != "" {
+		ctx = WithTenant(ctx, p.Tenant, s.tenants[p.Tenant])
+	}
+	jobID := logging.RequestID(ctx)
+	s.runs.Add(1)
+	go func() {
+		defer s.runs.Done()
+		defer release()
+		slog.InfoContext(ctx, "Starting scheduled pipeline run", "pipeline", name)
+		_, err := s.e.RunPipeline(ctx, name, ExportParams{}, nil)
+		if err != nil {
+			slog.ErrorContext(ctx, "Scheduled pipeline run failed", "pipeline", name, "error", err)
+		}
+		now := time.Now().In(s.loc)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		st := s.state[name]
+		s.refreshLocked(ctx, st)
+		st.Running = false
+		st.LastRun, st.LastJobID, st.LastStatus = &now, jobID, JobSucceeded
+		if err != nil {
+			st.LastStatus = JobFailed
+		}
+		s.saveLocked(ctx, name)
+	}()
+}
+
+// List returns the schedules visible to the caller in ctx, by pipeline name.
+func (s *Scheduler) List(ctx context.Context) []ScheduleState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []ScheduleState{}
+	for _, name := range s.e.Pipelines.Names() {
+		p, ok := s.e.Pipelines.Get(name)
+		if !ok || p.Schedule == "" || !PipelineVisible(ctx, p) {
+			continue
+		}
+		st := *s.entryLocked(ctx, name, p)
+		if s.shared && !st.Running {
+			holder, _ := s.coord.Holder(ctx, "schedule:"+name)
+			st.Running = holder != ""
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Pipeline < out[j].Pipeline })
+	return out
+}
+
+// Pause stops a schedule from starting runs until it is resumed; a run in progress
+// continues.
+func (s *Scheduler) Pause(ctx context.Context, name string) (ScheduleState, error) {
+	return s.update(ctx, name, func(st *ScheduleState) {
+		if !st.Paused {
+			now := time.Now().In(s.loc)
+			st.Paused, st.PausedAt = true, &now
+		}
+	})
+}
+
+// Resume lets a paused schedule start runs again, from its next matching time.
+func (s *Scheduler) Resume(ctx context.Context, name string) (ScheduleState, error) {
+	return s.update(ctx, name, func(st *ScheduleState) {
+		st.Paused, st.PausedAt = false, nil
+	})
+}
+
+// Trigger starts a run of the schedule now, even if it is paused, and returns its job ID.
+// The run continues after the caller's request ends.
+func (s *Scheduler) Trigger(ctx context.Context, name string) (string, error) {
+	p, err := s.scheduled(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	st := s.entryLocked(ctx, name, p)
+	if st.Running {
+		s.mu.Unlock()
+		return "", fmt.Errorf("%w: %s", ErrScheduleRunning, name)
+	}
+	st.Running = true
+	s.mu.Unlock()
+	runCtx := context.WithoutCancel(ctx)
+	if logging.RequestID(runCtx) == "" {
+		runCtx = logging.WithRequestID(runCtx, logging.NewRequestID())
+	}
+	leaseCtx, release, holder, err := s.claim(runCtx, name, time.Time{})
+	if release == nil {
+		s.mu.Lock()
+		st.Running = false
+		s.mu.Unlock()
+		if err != nil {
+			return "", fmt.Errorf("failed to claim schedule %s: %w", name, err)
+		}
+		return "", fmt.Errorf("%w: %s (job %s)", ErrScheduleRunning, name, holder)
+	}
+	s.launch(leaseCtx, name, p, release)
+	return logging.RequestID(runCtx), nil
+}
+
+func (s *Scheduler) update(ctx context.Context, name string, fn func(*ScheduleState)) (ScheduleState, error) {
+	p, err := s.scheduled(ctx, name)
+	if err != nil {
+		return ScheduleState{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.entryLocked(ctx, name, p)
+	fn(st)
+	s.saveLocked(ctx, name)
+	return *st, nil
+}
+
+// scheduled returns the pipeline if it has a schedule and is visible to the caller.
+func (s *Scheduler) scheduled(ctx context.Context, name string) (config.Pipeline, error) {
+	p, ok := s.e.Pipelines.Get(name)
+	if !ok || p.Schedule == "" || !PipelineVisible(ctx, p) {
+		return config.Pipeline{}, fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	return p, nil
+}
+
+// saveLocked persists the state of the schedule name: to the shared coordinator, or
+// with every other schedule to the state file.
+func (s *Scheduler) saveLocked(ctx context.Context, name string) {
+	if s.shared {
+		data, err := json.Marshal(s.state[name])
+		if err == nil {
+			err = s.coord.Put(ctx, "schedule-state:"+name, data)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to persist schedule state", "pipeline", name, "error", err)
+		}
+		return
+	}
+	if s.path == "" {
+		return
+	}
+	states := make([]ScheduleState, 0, len(s.state))
+	for _, st := range s.state {
+		states = append(states, *st)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Pipeline < states[j].Pipeline })
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to persist schedule state", "error", err)
+	}
+}
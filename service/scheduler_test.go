@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRunsPausesAndTriggers(t *testing.T) {
+	cfg := &config.Config{Pipelines: map[string]config.Pipeline{
+		"nightly": {
+			Query:         "SELECT 1",
+			QueryLocation: "US",
+			Destination:   config.Destination{Output: "gs://bucket/nightly/"},
+			Schedule:      "*/5 * * * *",
+		},
+		"adhoc": {Query: "SELECT 2", QueryLocation: "US"},
+	}}
+	e := NewExporter(&fakeBigQuery{}, NewGCSDriver(nil, nil), cfg)
+	path := filepath.Join(t.TempDir(), "schedules.json")
+	s, err := NewScheduler(e, nil, time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	at := func(h, m int) time.Time { return time.Date(2026, 3, 2, h, m, 0, 0, time.UTC) }
+
+	s.tick(ctx, at(10, 2)) // plans 10:05
+	s.tick(ctx, at(10, 5))
+	s.runs.Wait()
+	if n := len(e.Jobs.List(ctx)); n != 1 {
+		t.Fatalf("runs after 10:05 = %d, want 1", n)
+	}
+
+	if _, err := s.Pause(ctx, "adhoc"); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("Pause(unscheduled) error = %v, want ErrScheduleNotFound", err)
+	}
+	if _, err := s.Pause(ctx, "nightly"); err != nil {
+		t.Fatal(err)
+	}
+	s.tick(ctx, at(10, 10))
+	s.runs.Wait()
+	if n := len(e.Jobs.List(ctx)); n != 1 {
+		t.Fatalf("runs while paused = %d, want 1", n)
+	}
+
+	// The pause survives a restart
+	restarted, err := NewScheduler(e, nil, time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := restarted.List(ctx)
+	if len(states) != 1 || !states[0].Paused || states[0].LastStatus != JobSucceeded {
+		t.Fatalf("restored states = %+v, want paused nightly with last success", states)
+	}
+
+	jobID, err := restarted.Trigger(logging.WithRequestID(ctx, "manual-1"), "nightly")
+	if err != nil || jobID != "manual-1" {
+		t.Fatalf("Trigger() = %q, %v", jobID, err)
+	}
+	restarted.runs.Wait()
+	if job, ok := e.Jobs.Get(ctx, "manual-1"); !ok || job.Pipeline != "nightly" || job.Status != JobSucceeded {
+		t.Fatalf("triggered job = %+v, %v", job, ok)
+	}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TaskShard is the share of an export one task of a parallel Cloud Run job runs. With
+// Column, the task exports the rows whose Column value hashes to Index modulo Count; with
+// Partitions, it runs the export once for each of the partitions Index, Index+Count, ...
+// with the partition as the value of the Parameter query placeholder.
+type TaskShard struct {
+	Index int
+	Count int
+
+	Column     string
+	Parameter  string
+	Partitions []string
+}
+
+// TaskShardFromEnv reads the task position from CLOUD_RUN_TASK_INDEX and
+// CLOUD_RUN_TASK_COUNT, and how to shard from JOB_SHARD_COLUMN or JOB_SHARD_PARTITIONS
+// (comma-separated) with JOB_SHARD_PARAMETER (default "partition").
+func TaskShardFromEnv() (TaskShard, error) {
+	s := TaskShard{Count: 1, Column: strings.TrimSpace(os.Getenv("JOB_SHARD_COLUMN")), Parameter: "partition"}
+	if v := os.Getenv("CLOUD_RUN_TASK_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return TaskShard{}, fmt.Errorf("invalid CLOUD_RUN_TASK_COUNT %q", v)
+		}
+		s.Count = n
+	}
+	if v := os.Getenv("CLOUD_RUN_TASK_INDEX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n >= s.Count {
+			return TaskShard{}, fmt.Errorf("invalid CLOUD_RUN_TASK_INDEX %q for %d tasks", v, s.Count)
+		}
+		s.Index = n
+	}
+	if p := strings.TrimSpace(os.Getenv("JOB_SHARD_PARAMETER")); p != "" {
+		s.Parameter = p
+	}
+	for _, v := range strings.Split(os.Getenv("JOB_SHARD_PARTITIONS"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			s.Partitions = append(s.Partitions, v)
+		}
+	}
+	if s.Column != "" && len(s.Partitions) > 0 {
+		return TaskShard{}, fmt.Errorf("JOB_SHARD_COLUMN and JOB_SHARD_PARTITIONS cannot be combined")
+	}
+	return s, nil
+}
+
+// Enabled reports whether the export is sharded: by partitions, or by column across
+// more than one task.
+func (s TaskShard) Enabled() bool {
+	return len(s.Partitions) > 0 || (s.Column != "" && s.Count > 1)
+}
+
+// Assigned returns the partitions of this task.
+func (s TaskShard) Assigned() []string {
+	var out []string
+	for i := s.Index; i < len(s.Partitions); i += s.Count {
+		out = append(out, s.Partitions[i])
+	}
+	return out
+}
+
+var shardLabelRe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// RunShard runs this task's share of an export: the query in overrides, or the named
+// pipeline. Partitions run one after the other and stop at the first failure; the
+// result adds up their rows.
+func (e *Exporter) RunShard(ctx context.Context, s TaskShard, pipeline string, overrides ExportParams, parameters map[string]string) (ExportResult, error) {
+	run := func(ctx context.Context, params ExportParams, parameters map[string]string) (ExportResult, error) {
+		if pipeline != "" {
+			return e.RunPipeline(ctx, pipeline, params, parameters)
+		}
+		if len(parameters) > 0 {
+			query, err := config.Pipeline{Query: params.Query}.RenderQuery(parameters)
+			if err != nil {
+				return ExportResult{}, fmt.Errorf("%w: %v", ErrPipelineParameters, err)
+			}
+			params.Query = query
+		}
+		return e.Run(ctx, params)
+	}
+
+	// All partitions read the same point in time
+	overrides, err := resolveSnapshotTime(overrides, time.Now())
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if len(s.Partitions) == 0 {
+		params := overrides
+		params.ShardColumn, params.ShardIndex, params.ShardCount = s.Column, s.Index, s.Count
+		params.ShardLabel = fmt.Sprintf("shard%d-of-%d", s.Index, s.Count)
+		slog.InfoContext(ctx, "Running export shard", "column", s.Column, "task_index", s.Index, "task_count", s.Count)
+		return run(ctx, params, parameters)
+	}
+
+	assigned := s.Assigned()
+	slog.InfoContext(ctx, "Running export partitions", "partitions", assigned, "task_index", s.Index, "task_count", s.Count)
+	var total ExportResult
+	for i, part := range assigned {
+		params := overrides
+		params.ShardLabel = shardLabelRe.ReplaceAllString(part, "_")
+		values := maps.Clone(parameters)
+		if values == nil {
+			values = map[string]string{}
+		}
+		values[s.Parameter] = part
+		// Every partition is a job of its own
+		res, err := run(withChildRequestID(ctx, i+1), params, values)
+		total.GCSPath, total.Table, total.Job = res.GCSPath, res.Table, res.Job
+		total.Rows += res.Rows
+		total.RowsDeleted += res.RowsDeleted
+		total.BytesProcessed += res.BytesProcessed
+		total.Files += res.Files
+		total.BytesWritten += res.BytesWritten
+		total.Statements = append(total.Statements, res.Statements...)
+		if err != nil {
+			return total, fmt.Errorf("partition %s: %w", part, err)
+		}
+		slog.InfoContext(ctx, "Export partition completed", "partition", part, "rows", res.Rows)
+	}
+	return total, nil
+}
+
+// applyShard confines a sharded export to its slice of the result. Shards run in
+// parallel against the same destination, so exports replacing the destination, or
+// keeping a snapshot or watermark of it, cannot be sharded.
+func applyShard(p ExportParams, driver string) (ExportParams, error) {
+	if p.ShardLabel == "" && p.ShardCount <= 1 {
+		return p, nil
+	}
+	switch {
+	case p.DiffSnapshot != "" || p.ChangesTable != "":
+		return p, fmt.Errorf("diff and change history exports cannot be sharded")
+	case p.LoadStrategy == LoadStrategySwap:
+		return p, fmt.Errorf("sharded exports cannot use the swap load strategy, which replaces the whole table")
+	case driver == "BIGQUERY" && p.WriteMode != WriteModeAppend && p.WriteMode != WriteModeMerge:
+		return p, fmt.Errorf("sharded BigQuery exports need write_mode append or merge")
+	}
+	if caps := driverCapabilities(driver); p.ShardLabel != "" && caps.Files {
+		// An explicit object pattern ignores the filename, so shards would overwrite each other
+		ext := cmp.Or(caps.Extension, exportExtension(p.Format))
+		if strings.HasSuffix(p.Output, ext) || strings.Contains(p.Output, "*") {
+			return p, fmt.Errorf("sharded GCS exports need a folder output, not the object pattern %q", p.Output)
+		}
+		name := p.Filename
+		if name == "" {
+			name = "export"
+		}
+		p.Filename = name + "-" + p.ShardLabel
+	}
+	if p.ShardCount > 1 {
+		if p.ShardIndex < 0 || p.ShardIndex >= p.ShardCount {
+			return p, fmt.Errorf("shard index %d out of range for %d shards", p.ShardIndex, p.ShardCount)
+		}
+		// NULL keys hash like '' so every row belongs to exactly one shard
+		p.Query = fmt.Sprintf("SELECT * FROM (%s) WHERE ABS(MOD(FARM_FINGERPRINT(COALESCE(CAST(%s AS STRING), '')), %d)) = %d",
+			p.Query, quoteBigQueryColumn(p.ShardColumn), p.ShardCount, p.ShardIndex)
+	}
+	// The recorded parameters already carry the shard, so a retry must not apply it again
+	p.ShardColumn, p.ShardIndex, p.ShardCount, p.ShardLabel = "", 0, 0, ""
+	return p, nil
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTaskShardFromEnv(t *testing.T) {
+	t.Setenv("CLOUD_RUN_TASK_INDEX", "1")
+	t.Setenv("CLOUD_RUN_TASK_COUNT", "3")
+	t.Setenv("JOB_SHARD_PARTITIONS", "2026-01, 2026-02,2026-03,2026-04,2026-05")
+	s, err := TaskShardFromEnv()
+	if err != nil {
+		t.Fatalf("TaskShardFromEnv() error = %v", err)
+	}
+	if !s.Enabled() || s.Parameter != "partition" {
+		t.Errorf("TaskShardFromEnv() = %+v", s)
+	}
+	if got, want := s.Assigned(), []string{"2026-02", "2026-05"}; !slices.Equal(got, want) {
+		t.Errorf("Assigned() = %v, want %v", got, want)
+	}
+
+	t.Setenv("JOB_SHARD_COLUMN", "patient_id")
+	if _, err := TaskShardFromEnv(); err == nil {
+		t.Error("TaskShardFromEnv() accepted both a column and partitions")
+	}
+	t.Setenv("JOB_SHARD_PARTITIONS", "")
+	t.Setenv("CLOUD_RUN_TASK_INDEX", "3")
+	if _, err := TaskShardFromEnv(); err == nil {
+		t.Error("TaskShardFromEnv() accepted a task index beyond the task count")
+	}
+}
+
+func TestApplyShard(t *testing.T) {
+	p, err := applyShard(ExportParams{Query: "SELECT * FROM ds.visits", Output: "gs://b/out/", Filename: "visits",
+		ShardColumn: "patient_id", ShardIndex: 2, ShardCount: 4, ShardLabel: "shard2-of-4"}, "GCS_PARQUET")
+	if err != nil {
+		t.Fatalf("applyShard() error = %v", err)
+	}
+	want := "SELECT * FROM (SELECT * FROM ds.visits) WHERE ABS(MOD(FARM_FINGERPRINT(COALESCE(CAST(`patient_id` AS STRING), '')), 4)) = 2"
+	if p.Query != want {
+		t.Errorf("query = %q, want %q", p.Query, want)
+	}
+	if p.Filename != "visits-shard2-of-4" {
+		t.Errorf("filename = %q", p.Filename)
+	}
+	if p.ShardCount != 0 || p.ShardLabel != "" {
+		t.Errorf("shard still set after applying it: %+v", p)
+	}
+
+	for name, tc := range map[string]struct {
+		params ExportParams
+		driver string
+	}{
+		"swap":             {ExportParams{ShardLabel: "a", LoadStrategy: LoadStrategySwap}, "STARROCKS"},
+		"diff":             {ExportParams{ShardLabel: "a", DiffSnapshot: "ops.snap"}, "GCS_PARQUET"},
+		"object pattern":   {ExportParams{ShardLabel: "a", Output: "gs://b/out/visits-*.parquet"}, "GCS_PARQUET"},
+		"bigquery replace": {ExportParams{ShardLabel: "a", WriteMode: WriteModeReplace}, "BIGQUERY"},
+	} {
+		if _, err := applyShard(tc.params, tc.driver); err == nil {
+			t.Errorf("%s: applyShard() accepted the export", name)
+		}
+	}
+}
+
+func TestRunShardPartitions(t *testing.T) {
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	s := TaskShard{Index: 0, Count: 2, Parameter: "month", Partitions: []string{"2026-01", "2026-02", "2026-03"}}
+	_, err := e.RunShard(context.Background(), s, "", ExportParams{
+		Query:         "SELECT * FROM ds.visits WHERE month = '{{month}}'",
+		QueryLocation: "US",
+		Output:        "gs://b/out/",
+		Filename:      "visits",
+	}, nil)
+	if err != nil {
+		t.Fatalf("RunShard() error = %v", err)
+	}
+	var exports []string
+	for _, q := range bq.queries {
+		if strings.Contains(q, "EXPORT DATA") {
+			exports = append(exports, q)
+		}
+	}
+	if len(exports) != 2 {
+		t.Fatalf("exports = %q, want 2", exports)
+	}
+	for i, part := range []string{"2026-01", "2026-03"} {
+		if !strings.Contains(exports[i], "month = '"+part+"'") || !strings.Contains(exports[i], "visits-"+part+"-") {
+			t.Errorf("export %d = %s, want partition %s", i, exports[i], part)
+		}
+	}
+}
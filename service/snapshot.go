@@ -0,0 +1,274 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// SnapshotOptions selects the tables of a dataset snapshot.
+type SnapshotOptions struct {
+	// Dataset is the source BigQuery dataset, "dataset" or "project.dataset"
+	Dataset string
+	// Include and Exclude are table name globs (path.Match syntax, e.g. "visit_*"); a
+	// table is exported if it matches an Include pattern (or there are none) and no
+	// Exclude pattern.
+	Include []string
+	Exclude []string
+	// Parallelism is how many tables export at a time (default 1); MAX_CONCURRENT_EXPORTS
+	// still bounds the exports of the whole instance
+	Parallelism int
+	// DependsOn lists the parent tables of a table: it starts once they finished, and is
+	// skipped if one of them failed. Parents that are not selected are ignored.
+	DependsOn map[string][]string
+}
+
+// SnapshotSkipped is the status of a snapshot table whose parent table failed.
+const SnapshotSkipped = "skipped"
+
+// SnapshotTable is the outcome of the export of one table of a snapshot.
+type SnapshotTable struct {
+	Table  string `json:"table"`
+	Status string `json:"status"`
+	// JobID is the table's run in the job history, to retry it on its own
+	JobID string `json:"job_id,omitempty"`
+	// Committed reports whether the table's destination holds the export: false for
+	// failed and skipped tables, and for the tables of a defer_swaps sync that were not
+	// swapped into place
+	Committed      bool   `json:"committed"`
+	GCSPath        string `json:"gcs_path,omitempty"`
+	Destination    string `json:"destination_table,omitempty"`
+	Rows           int64  `json:"rows"`
+	BytesProcessed int64  `json:"bytes_processed,omitempty"`
+	BigQueryJobID  string `json:"bigquery_job_id,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// SnapshotResult lists the tables of a dataset snapshot in name order.
+type SnapshotResult struct {
+	Dataset   string          `json:"dataset"`
+	Tables    []SnapshotTable `json:"tables"`
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Skipped   int             `json:"skipped,omitempty"`
+}
+
+// Snapshot exports every selected table of a BigQuery dataset with the destination
+// settings of template: for GCS_PARQUET into <output>/<table>/, for STARROCKS and
+// BIGQUERY into the same-named table of template's database. Every table is a separate
+// export in the job history; up to opts.Parallelism run at a time, children after their
+// parents, and a failed table only stops its children. The error is only set when the
+// tables cannot be listed or none is selected.
+func (e *Exporter) Snapshot(ctx context.Context, opts SnapshotOptions, template ExportParams) (SnapshotResult, error) {
+	if template.Query != "" || template.ChangesTable != "" || template.DiffSnapshot != "" {
+		return SnapshotResult{}, ConfigError(fmt.Errorf("a dataset snapshot exports whole tables; query, changes_table and diff_snapshot are not supported"))
+	}
+	if template.Format == FormatFHIR || template.Format == FormatREDCap {
+		return SnapshotResult{}, ConfigError(fmt.Errorf("a dataset snapshot exports tables of different shapes; format %s maps a single one", template.Format))
+	}
+	// All tables read the same point in time
+	template, err := resolveSnapshotTime(template, time.Now())
+	if err != nil {
+		return SnapshotResult{}, err
+	}
+	tables, err := e.snapshotTables(ctx, opts, template)
+	if err != nil {
+		return SnapshotResult{}, err
+	}
+	if len(tables) == 0 {
+		return SnapshotResult{}, ConfigError(fmt.Errorf("no table of dataset %s is selected", opts.Dataset))
+	}
+
+	slog.InfoContext(ctx, "Starting dataset snapshot", "dataset", opts.Dataset, "tables", len(tables), "parallelism", max(opts.Parallelism, 1))
+	out := SnapshotResult{Dataset: opts.Dataset, Tables: make([]SnapshotTable, len(tables))}
+	index := make(map[string]int, len(tables))
+	for i, t := range tables {
+		index[t] = i
+	}
+	const (
+		pending = iota
+		running
+		finished
+	)
+	state := make([]int, len(tables))
+	// ready reports whether table i can start, and the first of its parents that did not
+	// succeed
+	ready := func(i int) (bool, string) {
+		for _, parent := range opts.DependsOn[tables[i]] {
+			j, ok := index[parent]
+			if !ok {
+				continue
+			}
+			if state[j] != finished {
+				return false, ""
+			}
+			if out.Tables[j].Status != JobSucceeded {
+				return true, parent
+			}
+		}
+		return true, ""
+	}
+
+	done := make(chan int)
+	active, left := 0, len(tables)
+	for left > 0 {
+		for progress := true; progress; {
+			progress = false
+			for i := range tables {
+				if state[i] != pending || active >= max(opts.Parallelism, 1) {
+					continue
+				}
+				ok, failedParent := ready(i)
+				switch {
+				case !ok:
+					continue
+				case failedParent != "":
+					out.Tables[i] = SnapshotTable{Table: tables[i], Status: SnapshotSkipped, Error: "parent table " + failedParent + " did not load"}
+					state[i] = finished
+					left--
+					progress = true
+					continue
+				}
+				state[i] = running
+				active++
+				go func() {
+					out.Tables[i] = e.snapshotTable(withChildRequestID(ctx, i+1), template, opts.Dataset, tables[i])
+					done <- i
+				}()
+			}
+		}
+		if left == 0 {
+			break
+		}
+		if active == 0 {
+			// Only a dependency cycle leaves tables that can never start
+			for i := range tables {
+				if state[i] == pending {
+					out.Tables[i] = SnapshotTable{Table: tables[i], Status: SnapshotSkipped, Error: "dependency cycle"}
+					state[i] = finished
+					left--
+				}
+			}
+			break
+		}
+		i := <-done
+		state[i] = finished
+		active--
+		left--
+	}
+	for _, st := range out.Tables {
+		switch st.Status {
+		case JobSucceeded:
+			out.Succeeded++
+		case JobFailed:
+			out.Failed++
+		default:
+			out.Skipped++
+		}
+	}
+	slog.InfoContext(ctx, "Dataset snapshot completed", "dataset", opts.Dataset, "succeeded", out.Succeeded, "failed", out.Failed)
+	return out, nil
+}
+
+// snapshotTable exports one table of a snapshot.
+func (e *Exporter) snapshotTable(ctx context.Context, template ExportParams, dataset, table string) SnapshotTable {
+	res, err := e.Run(ctx, snapshotTableParams(template, e.Driver.Name(), dataset, table))
+	st := SnapshotTable{Table: table, Status: JobSucceeded, JobID: logging.RequestID(ctx), Rows: res.Rows, BytesProcessed: res.BytesProcessed,
+		GCSPath: res.GCSPath, Destination: res.Table, BigQueryJobID: res.Job.ID}
+	// Deferred swaps commit at the end of their sync
+	st.Committed = loadCommitted(err) && deferredSwapsFrom(ctx) == nil
+	if err != nil {
+		st.Status, st.Error = JobFailed, err.Error()
+		slog.WarnContext(ctx, "Snapshot table failed", "dataset", dataset, "table", table, "error", err)
+	}
+	return st
+}
+
+// snapshotTableParams derives the export of one table from the snapshot template.
+func snapshotTableParams(template ExportParams, driver, dataset, table string) ExportParams {
+	p := template
+	p.Query = "SELECT * FROM " + quoteBigQueryTable(dataset+"."+table)
+	p.Name = table
+	if template.Name != "" {
+		p.Name = template.Name + "_" + table
+	}
+	caps := driverCapabilities(driver)
+	if caps.Files {
+		p.Filename = table
+		if caps.Folders {
+			p.Output = strings.TrimSuffix(template.Output, "/") + "/" + table + "/"
+		}
+		// Otherwise, as with Drive folder IDs, every table is a file of the one folder
+	}
+	if !caps.Files || caps.FileTables {
+		p.Table = table
+	}
+	return p
+}
+
+// snapshotTables lists the base tables of the dataset matching the options, by name.
+func (e *Exporter) snapshotTables(ctx context.Context, opts SnapshotOptions, template ExportParams) ([]string, error) {
+	if opts.Dataset == "" || strings.Count(opts.Dataset, ".") > 1 {
+		return nil, ConfigError(fmt.Errorf("invalid dataset %q; expected dataset or project.dataset", opts.Dataset))
+	}
+	for _, pattern := range append(append([]string(nil), opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, ConfigError(fmt.Errorf("invalid table pattern %q: %w", pattern, err))
+		}
+	}
+	return e.datasetTables(ctx, opts.Dataset, template, opts.selects)
+}
+
+// datasetTables lists the base tables of dataset that selects accepts, by name, read as
+// the service account template impersonates.
+func (e *Exporter) datasetTables(ctx context.Context, dataset string, template ExportParams, selects func(string) bool) ([]string, error) {
+	client, err := e.impersonatedClient(ctx, template)
+	if err != nil {
+		return nil, err
+	}
+	q := fmt.Sprintf("SELECT table_name FROM %s.INFORMATION_SCHEMA.TABLES WHERE table_type = 'BASE TABLE' ORDER BY table_name",
+		quoteBigQueryTable(dataset))
+	it, err := client.ReadRows(ctx, q, template.QueryLocation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the tables of %s: %w", dataset, err)
+	}
+	defer it.Close()
+	var tables []string
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the tables of %s: %w", dataset, err)
+		}
+		if len(row) == 0 {
+			continue
+		}
+		if name, ok := row[0].(string); ok && selects(name) {
+			tables = append(tables, name)
+		}
+	}
+	return tables, nil
+}
+
+// selects reports whether the options export the table.
+func (o SnapshotOptions) selects(table string) bool {
+	match := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, table); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(o.Include) == 0 || match(o.Include)) && !match(o.Exclude)
+}
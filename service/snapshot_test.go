@@ -0,0 +1,217 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestSnapshot(t *testing.T) {
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "table_name", Type: bigquery.StringFieldType}},
+		rows:   [][]bigquery.Value{{"patients"}, {"tmp_import"}, {"visits"}},
+	}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	res, err := e.Snapshot(context.Background(), SnapshotOptions{Dataset: "study_a", Exclude: []string{"tmp_*"}},
+		ExportParams{QueryLocation: "US", Output: "gs://b/freeze/2026-10"})
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if !strings.Contains(bq.queries[0], "FROM `study_a`.INFORMATION_SCHEMA.TABLES") {
+		t.Errorf("listing query = %s", bq.queries[0])
+	}
+	if res.Succeeded != 2 || res.Failed != 0 || len(res.Tables) != 2 {
+		t.Fatalf("Snapshot() = %+v", res)
+	}
+	for i, table := range []string{"patients", "visits"} {
+		want := "gs://b/freeze/2026-10/" + table + "/" + table + "-*.parquet"
+		if res.Tables[i].Table != table || res.Tables[i].GCSPath != want || !res.Tables[i].Committed || res.Tables[i].JobID == "" {
+			t.Errorf("table %d = %+v, want %s committed to %s", i, res.Tables[i], table, want)
+		}
+	}
+	if !strings.Contains(bq.queries[len(bq.queries)-1], "SELECT * FROM `study_a.visits`") {
+		t.Errorf("last export = %s", bq.queries[len(bq.queries)-1])
+	}
+
+	if _, err := e.Snapshot(context.Background(), SnapshotOptions{Dataset: "study_a", Include: []string{"lab_*"}},
+		ExportParams{Output: "gs://b/freeze"}); err == nil {
+		t.Error("Snapshot() without matching tables succeeded")
+	}
+}
+
+func TestRunSyncPipeline(t *testing.T) {
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "table_name", Type: bigquery.StringFieldType}},
+		rows:   [][]bigquery.Value{{"labs"}, {"patients"}, {"visits"}},
+	}
+	cfg := &config.Config{Pipelines: map[string]config.Pipeline{
+		"study_a_sync": {
+			QueryLocation: "US",
+			Sync:          &config.Sync{Dataset: "study_a", Include: []string{"patients", "visits"}, Parallelism: 2},
+			Destination:   config.Destination{Output: "gs://b/mirror"},
+		},
+	}}
+	if err := config.ValidatePipeline("study_a_sync", cfg.Pipelines["study_a_sync"]); err != nil {
+		t.Fatalf("ValidatePipeline() error = %v", err)
+	}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), cfg)
+	res, err := e.RunPipeline(context.Background(), "study_a_sync", ExportParams{}, nil)
+	if err != nil {
+		t.Fatalf("RunPipeline() error = %v", err)
+	}
+	if len(res.Tables) != 2 || res.Tables[0].Table != "patients" || res.Tables[1].Table != "visits" {
+		t.Errorf("tables = %+v", res.Tables)
+	}
+	for _, j := range e.Jobs.List(context.Background()) {
+		if j.Pipeline != "study_a_sync" {
+			t.Errorf("job %s is not recorded as a run of the pipeline: %+v", j.ID, j)
+		}
+	}
+
+	bad := cfg.Pipelines["study_a_sync"]
+	bad.Query = "SELECT 1"
+	if err := config.ValidatePipeline("study_a_sync", bad); err == nil {
+		t.Error("ValidatePipeline() accepted sync with a query")
+	}
+}
+
+// failingBigQuery fails the queries mentioning match.
+type failingBigQuery struct {
+	*fakeBigQuery
+	match string
+}
+
+func (f *failingBigQuery) RunQuery(ctx context.Context, sqlQuery, location string) (QueryJob, error) {
+	if strings.Contains(sqlQuery, f.match) {
+		return QueryJob{}, errors.New("backend error")
+	}
+	return f.fakeBigQuery.RunQuery(ctx, sqlQuery, location)
+}
+
+func TestSnapshotDependencies(t *testing.T) {
+	fake := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "table_name", Type: bigquery.StringFieldType}},
+		rows:   [][]bigquery.Value{{"labs"}, {"patients"}, {"sites"}, {"visits"}},
+	}
+	e := NewExporter(fake, NewGCSDriver(nil, nil), &config.Config{})
+	opts := SnapshotOptions{
+		Dataset:     "study_a",
+		Parallelism: 4,
+		DependsOn:   map[string][]string{"visits": {"patients", "sites"}, "labs": {"visits"}},
+	}
+	if _, err := e.Snapshot(context.Background(), opts, ExportParams{QueryLocation: "US", Output: "gs://b/out"}); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	pos := map[string]int{}
+	for i, q := range fake.queries {
+		for _, table := range []string{"labs", "patients", "sites", "visits"} {
+			if strings.Contains(q, "`study_a."+table+"`") {
+				pos[table] = i
+			}
+		}
+	}
+	if pos["visits"] < pos["patients"] || pos["visits"] < pos["sites"] || pos["labs"] < pos["visits"] {
+		t.Errorf("tables exported out of dependency order: %v", pos)
+	}
+
+	e = NewExporter(&failingBigQuery{fakeBigQuery: fake, match: "study_a.patients"}, NewGCSDriver(nil, nil), &config.Config{})
+	res, err := e.Snapshot(context.Background(), opts, ExportParams{QueryLocation: "US", Output: "gs://b/out"})
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	status := map[string]string{}
+	for _, st := range res.Tables {
+		status[st.Table] = st.Status
+	}
+	want := map[string]string{"labs": SnapshotSkipped, "patients": JobFailed, "sites": JobSucceeded, "visits": SnapshotSkipped}
+	if !maps.Equal(status, want) || res.Skipped != 2 || res.Failed != 1 {
+		t.Errorf("statuses = %v (%+v), want %v", status, res, want)
+	}
+
+	if err := config.ValidatePipeline("cyclic", config.Pipeline{Sync: &config.Sync{Dataset: "study_a",
+		DependsOn: map[string][]string{"a": {"b"}, "b": {"a"}}}}); err == nil {
+		t.Error("ValidatePipeline() accepted a dependency cycle")
+	}
+}
+
+func TestDeferredSwaps(t *testing.T) {
+	var log []string
+	step := func(table string, fail bool) deferredSwap {
+		return deferredSwap{
+			table: table,
+			lock:  context.Background(),
+			swap: func(context.Context) error {
+				if fail {
+					return errors.New("swap failed")
+				}
+				log = append(log, "swap "+table)
+				return nil
+			},
+			drop: func() { log = append(log, "drop "+table) },
+		}
+	}
+	ctx, d := withDeferredSwaps(context.Background())
+	deferredSwapsFrom(ctx).add(step("patients", false))
+	d.add(step("visits", false))
+	if err := d.commit(ctx); err != nil {
+		t.Fatalf("commit() error = %v", err)
+	}
+	if want := []string{"swap patients", "swap visits", "drop patients", "drop visits"}; !slices.Equal(log, want) {
+		t.Errorf("commit steps = %v, want %v", log, want)
+	}
+
+	log = nil
+	d.add(step("patients", false))
+	d.discard(ctx)
+	if want := []string{"drop patients"}; !slices.Equal(log, want) {
+		t.Errorf("discard steps = %v, want %v", log, want)
+	}
+	if deferredSwapsFrom(context.Background()) != nil {
+		t.Error("deferredSwapsFrom() without deferral is not nil")
+	}
+
+	// Locks are held and jobs run until the swaps settle; a failed swap fails the jobs
+	// of the tables it left in place
+	log = nil
+	finished := map[string]error{}
+	for _, table := range []string{"patients", "visits", "labs"} {
+		d.add(step(table, table == "visits"))
+		d.hold(func() { log = append(log, "unlock "+table) })
+		d.finishAfter(table, func(err error) { finished[table] = err })
+	}
+	if len(log) > 0 || len(finished) > 0 {
+		t.Fatalf("settled before commit: %v %v", log, finished)
+	}
+	if err := d.commit(ctx); err == nil || !strings.Contains(err.Error(), "swapped 1 of 3 tables") {
+		t.Errorf("commit() error = %v, want the failed swap", err)
+	}
+	if want := []string{"swap patients", "drop patients", "drop visits", "drop labs", "unlock patients", "unlock visits", "unlock labs"}; !slices.Equal(log, want) {
+		t.Errorf("failed commit steps = %v, want %v", log, want)
+	}
+	if finished["patients"] != nil || finished["visits"] == nil || finished["labs"] == nil {
+		t.Errorf("finished jobs = %v, want patients succeeded and the others failed", finished)
+	}
+
+	// A table whose lock was lost is not swapped
+	lost, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrLeaseLost)
+	s := step("patients", false)
+	s.lock = lost
+	d.add(s)
+	if err := d.commit(ctx); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("commit() with a lost lock error = %v, want ErrLeaseLost", err)
+	}
+
+	clear(finished)
+	d.finishAfter("patients", func(err error) { finished["patients"] = err })
+	d.discard(ctx)
+	if !errors.Is(finished["patients"], errSwapDiscarded) {
+		t.Errorf("discarded job error = %v, want errSwapDiscarded", finished["patients"])
+	}
+}
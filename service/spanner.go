@@ -0,0 +1,381 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// spannerDriverName is the EXPORT_DRIVER value of SpannerDriver.
+const spannerDriverName = "SPANNER"
+
+// spannerBatchCells bounds the column values of one commit, well under Spanner's 80000
+// mutations, which also count the entries of secondary indexes.
+const spannerBatchCells = 20000
+
+// spannerDatabaseName matches the resource names of Spanner databases.
+var spannerDatabaseName = regexp.MustCompile(`^projects/[^/]+/instances/[^/]+/databases/[^/]+$`)
+
+// spannerTableName matches the table names of Spanner's GoogleSQL dialect.
+var spannerTableName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// spannerTenantName matches the tenants whose Spanner tables can be prefixed with their
+// name: without _, the prefix of two tenants never overlaps.
+var spannerTenantName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// SpannerService writes to one Cloud Spanner database.
+type SpannerService struct {
+	client *spanner.Client
+	admin  *database.DatabaseAdminClient
+	db     string
+}
+
+// NewSpannerService connects to db (projects/<p>/instances/<i>/databases/<d>).
+func NewSpannerService(ctx context.Context, db string, opts ...option.ClientOption) (*SpannerService, error) {
+	client, err := spanner.NewClient(ctx, db, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Spanner client: %w", err)
+	}
+	admin, err := database.NewDatabaseAdminClient(ctx, opts...)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to create Spanner admin client: %w", err)
+	}
+	return &SpannerService{client: client, admin: admin, db: db}, nil
+}
+
+func (s *SpannerService) Close() {
+	s.client.Close()
+	s.admin.Close()
+}
+
+// tableExists reports whether the schema of the database creates table.
+func (s *SpannerService) tableExists(ctx context.Context, table string) (bool, error) {
+	resp, err := s.admin.GetDatabaseDdl(ctx, &databasepb.GetDatabaseDdlRequest{Database: s.db})
+	if err != nil {
+		return false, fmt.Errorf("failed to read the Spanner schema: %w", err)
+	}
+	created := regexp.MustCompile("(?is)^\\s*CREATE\\s+TABLE\\s+`?" + regexp.QuoteMeta(table) + "`?\\s*\\(")
+	for _, stmt := range resp.Statements {
+		if created.MatchString(stmt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// updateDDL applies a schema change and waits until it is done.
+func (s *SpannerService) updateDDL(ctx context.Context, stmt string) error {
+	op, err := s.admin.UpdateDatabaseDdl(ctx, &databasepb.UpdateDatabaseDdlRequest{Database: s.db, Statements: []string{stmt}})
+	if err == nil {
+		err = op.Wait(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("spanner DDL failed: %w", err)
+	}
+	return nil
+}
+
+// SpannerDriver upserts the result rows into a Cloud Spanner table with InsertOrUpdate
+// mutations: rows of existing keys are updated in the exported columns and other rows
+// inserted. A missing table is created from the result schema with key_columns as
+// primary key, or with create_ddl. Rows are committed in batches, each atomic, so a
+// failed export may leave the batches before it.
+type SpannerDriver struct {
+	sp *SpannerService
+}
+
+func NewSpannerDriver(sp *SpannerService) *SpannerDriver {
+	return &SpannerDriver{sp: sp}
+}
+
+func (d *SpannerDriver) Name() string {
+	return spannerDriverName
+}
+
+func (d *SpannerDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{ReadsRows: true}
+}
+
+// spannerTable returns the table an export with params writes to.
+func spannerTable(params ExportParams) (string, error) {
+	table := cmp.Or(params.Table, params.Name, "export")
+	if !spannerTableName.MatchString(table) {
+		return "", fmt.Errorf("invalid Spanner table name %q", table)
+	}
+	return table, nil
+}
+
+func quoteSpannerIdent(name string) string {
+	return "`" + name + "`"
+}
+
+func (d *SpannerDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	table, err := spannerTable(params)
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	if d.sp == nil {
+		return ExportResult{}, ConfigError(fmt.Errorf("the %s driver needs a Spanner client", spannerDriverName))
+	}
+	res := ExportResult{Table: table}
+	it, err := bq.ReadRows(ctx, params.Query, params.QueryLocation)
+	if err != nil {
+		return res, fmt.Errorf("failed to execute query on BigQuery: %w", err)
+	}
+	defer it.Close()
+	if it, err = transformRows(ctx, it, params.transformers); err != nil {
+		return res, err
+	}
+	res.Job = it.Job()
+
+	// RowIterator.Schema may be empty until the first page is fetched
+	var prefetch []bigquery.Value
+	if len(it.Schema()) == 0 {
+		if err := it.Next(&prefetch); err != nil && err != iterator.Done {
+			return res, fmt.Errorf("failed to fetch BigQuery rows: %w", err)
+		}
+	}
+	schema := it.Schema()
+	if len(schema) == 0 {
+		return res, fmt.Errorf("empty BigQuery schema")
+	}
+	if err := d.ensureTable(ctx, table, schema, params); err != nil {
+		return res, err
+	}
+
+	columns := make([]string, len(schema))
+	for i, f := range schema {
+		columns[i] = f.Name
+	}
+	batchRows := max(1, spannerBatchCells/len(columns))
+	slog.InfoContext(ctx, "Starting Spanner export", "table", table, "batch_rows", batchRows)
+	var batch []*spanner.Mutation
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := d.sp.client.Apply(ctx, batch); err != nil {
+			return fmt.Errorf("failed to write %d rows to Spanner table %s: %w", len(batch), table, err)
+		}
+		res.Rows += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		row := prefetch
+		if row != nil {
+			prefetch = nil
+		} else if err := it.Next(&row); err == iterator.Done {
+			break
+		} else if err != nil {
+			return res, fmt.Errorf("failed to fetch BigQuery rows: %w", err)
+		}
+		values := make([]any, len(columns))
+		for i, v := range row[:min(len(row), len(columns))] {
+			values[i] = spannerValue(schema[i], v)
+		}
+		batch = append(batch, spanner.InsertOrUpdate(table, columns, values))
+		if len(batch) == batchRows {
+			if err := flush(); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return res, err
+	}
+	slog.InfoContext(ctx, "Spanner export completed", "table", table, "rows", res.Rows)
+	return res, nil
+}
+
+// ensureTable creates table unless it exists, with the CreateDDL of params or DDL
+// generated from schema.
+func (d *SpannerDriver) ensureTable(ctx context.Context, table string, schema bigquery.Schema, params ExportParams) error {
+	exists, err := d.sp.tableExists(ctx, table)
+	if err != nil || exists {
+		return err
+	}
+	ddl := strings.TrimSpace(params.CreateDDL)
+	if ddl == "" {
+		if !params.featureEnabled(config.FeatureAutoDDL) {
+			return ConfigError(fmt.Errorf("table %s does not exist, and creating tables is disabled for it (auto_ddl or allow_schema_changes)", table))
+		}
+		if ddl, err = spannerCreateDDL(table, schema, params.KeyColumns); err != nil {
+			return ConfigError(err)
+		}
+	}
+	slog.InfoContext(ctx, "Creating Spanner table", "table", table, "ddl", ddl)
+	recordStatement(ctx, StatementSpanner, ddl)
+	return d.sp.updateDDL(ctx, ddl)
+}
+
+// spannerCreateDDL returns the CREATE TABLE of table for the columns of schema, with
+// the primary key keys.
+func spannerCreateDDL(table string, schema bigquery.Schema, keys []string) (string, error) {
+	if len(keys) == 0 {
+		return "", fmt.Errorf("creating Spanner table %s needs key_columns, its primary key (or create_ddl)", table)
+	}
+	key := map[string]bool{}
+	quoted := make([]string, len(keys))
+	for i, k := range keys {
+		if len(columnIndexes(schema, []string{k})) == 0 {
+			return "", fmt.Errorf("key column %q is not a column of the result", k)
+		}
+		key[k] = true
+		quoted[i] = quoteSpannerIdent(k)
+	}
+	cols := make([]string, len(schema))
+	for i, f := range schema {
+		if strings.Contains(f.Name, "`") {
+			return "", fmt.Errorf("invalid Spanner column name %q", f.Name)
+		}
+		cols[i] = "  " + quoteSpannerIdent(f.Name) + " " + spannerType(f)
+		if key[f.Name] || f.Required {
+			cols[i] += " NOT NULL"
+		}
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n%s\n) PRIMARY KEY (%s)", quoteSpannerIdent(table), strings.Join(cols, ",\n"), strings.Join(quoted, ", ")), nil
+}
+
+// spannerType is the Spanner column type of a BigQuery column. Types without a Spanner
+// counterpart are strings (DATETIME, TIME, GEOGRAPHY, INTERVAL, BIGNUMERIC, RANGE) or,
+// for records and arrays of records, JSON.
+func spannerType(f *bigquery.FieldSchema) string {
+	var t string
+	switch f.Type {
+	case bigquery.IntegerFieldType:
+		t = "INT64"
+	case bigquery.FloatFieldType:
+		t = "FLOAT64"
+	case bigquery.BooleanFieldType:
+		t = "BOOL"
+	case bigquery.NumericFieldType:
+		t = "NUMERIC"
+	case bigquery.BytesFieldType:
+		t = "BYTES(MAX)"
+	case bigquery.DateFieldType:
+		t = "DATE"
+	case bigquery.TimestampFieldType:
+		t = "TIMESTAMP"
+	case bigquery.JSONFieldType, bigquery.RecordFieldType:
+		return "JSON"
+	default:
+		t = "STRING(MAX)"
+	}
+	if f.Repeated {
+		return "ARRAY<" + t + ">"
+	}
+	return t
+}
+
+// spannerValue converts a BigQuery value of field into the Go value of its spannerType
+// column.
+func spannerValue(field *bigquery.FieldSchema, v bigquery.Value) any {
+	if field.Type == bigquery.RecordFieldType {
+		return spanner.NullJSON{Value: recordJSON(field, v), Valid: v != nil}
+	}
+	if field.Type == bigquery.JSONFieldType {
+		s, ok := v.(string)
+		return spanner.NullJSON{Value: json.RawMessage(s), Valid: ok}
+	}
+	if vs, ok := v.([]bigquery.Value); ok && field.Repeated {
+		return spannerArray(field, vs)
+	}
+	switch v := v.(type) {
+	case *big.Rat:
+		if field.Type == bigquery.NumericFieldType {
+			return spanner.NullNumeric{Numeric: *v, Valid: true}
+		}
+		return downloadJSONValue(v).(json.Number).String()
+	case civil.DateTime, civil.Time:
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// spannerArray converts the values of a repeated scalar column into a typed slice, of
+// Spanner's nullable types where the elements can be NULL.
+func spannerArray(field *bigquery.FieldSchema, vs []bigquery.Value) any {
+	switch field.Type {
+	case bigquery.IntegerFieldType:
+		return nullSlice(vs, func(v int64, ok bool) spanner.NullInt64 { return spanner.NullInt64{Int64: v, Valid: ok} })
+	case bigquery.FloatFieldType:
+		return nullSlice(vs, func(v float64, ok bool) spanner.NullFloat64 { return spanner.NullFloat64{Float64: v, Valid: ok} })
+	case bigquery.BooleanFieldType:
+		return nullSlice(vs, func(v bool, ok bool) spanner.NullBool { return spanner.NullBool{Bool: v, Valid: ok} })
+	case bigquery.BytesFieldType:
+		// A nil []byte is a NULL element
+		return nullSlice(vs, func(v []byte, _ bool) []byte { return v })
+	case bigquery.DateFieldType:
+		return nullSlice(vs, func(v civil.Date, ok bool) spanner.NullDate { return spanner.NullDate{Date: v, Valid: ok} })
+	case bigquery.TimestampFieldType:
+		return nullSlice(vs, func(v time.Time, ok bool) spanner.NullTime { return spanner.NullTime{Time: v, Valid: ok} })
+	case bigquery.NumericFieldType:
+		return nullSlice(vs, func(v *big.Rat, ok bool) spanner.NullNumeric {
+			if !ok {
+				return spanner.NullNumeric{}
+			}
+			return spanner.NullNumeric{Numeric: *v, Valid: true}
+		})
+	}
+	return nullSlice(vs, func(v bigquery.Value, ok bool) spanner.NullString {
+		if !ok {
+			return spanner.NullString{}
+		}
+		return spanner.NullString{StringVal: fmt.Sprint(downloadJSONValue(v)), Valid: true}
+	})
+}
+
+// nullSlice converts the elements of an array with null, which is given whether the
+// element is a T; NULL elements are not, and become NULL rather than zero values.
+func nullSlice[T, N any](vs []bigquery.Value, null func(T, bool) N) []N {
+	out := make([]N, len(vs))
+	for i, e := range vs {
+		v, ok := e.(T)
+		out[i] = null(v, ok)
+	}
+	return out
+}
+
+// recordJSON converts a record value (or the values of a repeated record) into its JSON
+// form, with the field names of field.
+func recordJSON(field *bigquery.FieldSchema, v bigquery.Value) any {
+	vs, ok := v.([]bigquery.Value)
+	if !ok {
+		return downloadJSONValue(v)
+	}
+	if field.Repeated {
+		elem := *field
+		elem.Repeated = false
+		out := make([]any, len(vs))
+		for i, e := range vs {
+			out[i] = recordJSON(&elem, e)
+		}
+		return out
+	}
+	out := make(map[string]any, len(vs))
+	for i, e := range vs[:min(len(vs), len(field.Schema))] {
+		if field.Schema[i].Type == bigquery.RecordFieldType {
+			out[field.Schema[i].Name] = recordJSON(field.Schema[i], e)
+		} else {
+			out[field.Schema[i].Name] = downloadJSONValue(e)
+		}
+	}
+	return out
+}
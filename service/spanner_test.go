@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"cloud.google.com/go/spanner"
+	"cloud.google.com/go/spanner/spannertest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// newFakeSpanner returns a SpannerService of an in-memory Spanner database.
+func newFakeSpanner(t *testing.T) *SpannerService {
+	srv, err := spannertest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := NewSpannerService(context.Background(), "projects/p/instances/i/databases/d", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sp.Close)
+	return sp
+}
+
+func TestSpannerDriver(t *testing.T) {
+	sp := newFakeSpanner(t)
+	d := NewSpannerDriver(sp)
+	schema := bigquery.Schema{
+		{Name: "site_id", Type: bigquery.StringFieldType},
+		{Name: "beds", Type: bigquery.IntegerFieldType},
+		{Name: "opened", Type: bigquery.DateFieldType},
+		{Name: "wards", Type: bigquery.StringFieldType, Repeated: true},
+	}
+	bq := &fakeBigQuery{schema: schema, rows: [][]bigquery.Value{
+		{"a", int64(10), civil.Date{Year: 2024, Month: 1, Day: 2}, []bigquery.Value{"icu"}},
+		{"b", nil, nil, []bigquery.Value{}},
+	}}
+	params := ExportParams{Query: "SELECT 1", Table: "sites", KeyColumns: []string{"site_id"}}
+	ctx, l := withStatementLog(context.Background())
+	res, err := d.Execute(ctx, bq, params)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.Rows != 2 || res.Table != "sites" {
+		t.Errorf("Execute() = %d rows to %s, want 2 to sites", res.Rows, res.Table)
+	}
+	if stmts := l.stmts; len(stmts) != 1 || !strings.Contains(stmts[0].SQL, "PRIMARY KEY (`site_id`)") {
+		t.Errorf("statements = %+v, want the generated CREATE TABLE", stmts)
+	}
+
+	// A second run updates the rows of existing keys
+	bq.rows = [][]bigquery.Value{{"a", int64(12), nil, []bigquery.Value{}}}
+	if _, err := d.Execute(context.Background(), bq, params); err != nil {
+		t.Fatalf("Execute() again error = %v", err)
+	}
+	row, err := sp.client.Single().ReadRow(context.Background(), "sites", spanner.Key{"a"}, []string{"beds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var beds int64
+	if err := row.Columns(&beds); err != nil || beds != 12 {
+		t.Errorf("beds = %d, %v, want the updated 12", beds, err)
+	}
+	n := 0
+	sp.client.Single().Read(context.Background(), "sites", spanner.AllKeys(), []string{"site_id"}).Do(func(*spanner.Row) error {
+		n++
+		return nil
+	})
+	if n != 2 {
+		t.Errorf("table has %d rows, want 2", n)
+	}
+
+	params.Table = "visits"
+	params.KeyColumns = nil
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureConfig {
+		t.Errorf("Execute() creating a table without key_columns error = %v, want a config error", err)
+	}
+}
+
+func TestSpannerArray(t *testing.T) {
+	ints := spannerArray(&bigquery.FieldSchema{Type: bigquery.IntegerFieldType, Repeated: true}, []bigquery.Value{int64(3), nil})
+	if got, want := ints, []spanner.NullInt64{{Int64: 3, Valid: true}, {}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spannerArray(INT64) = %v, want %v", got, want)
+	}
+	strs := spannerArray(&bigquery.FieldSchema{Type: bigquery.StringFieldType, Repeated: true}, []bigquery.Value{"icu", nil})
+	if got, want := strs, []spanner.NullString{{StringVal: "icu", Valid: true}, {}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spannerArray(STRING) = %v, want %v", got, want)
+	}
+}
+
+func TestSpannerCreateDDL(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType, Required: true},
+		{Name: "taken", Type: bigquery.DateTimeFieldType},
+		{Name: "address", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{{Name: "city", Type: bigquery.StringFieldType}}},
+		{Name: "scores", Type: bigquery.FloatFieldType, Repeated: true},
+	}
+	got, err := spannerCreateDDL("visits", schema, []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "CREATE TABLE `visits` (\n  `id` INT64 NOT NULL,\n  `taken` STRING(MAX),\n  `address` JSON,\n  `scores` ARRAY<FLOAT64>\n) PRIMARY KEY (`id`)"
+	if got != want {
+		t.Errorf("spannerCreateDDL() =\n%s\nwant\n%s", got, want)
+	}
+	if _, err := spannerCreateDDL("visits", schema, []string{"missing"}); err == nil {
+		t.Error("spannerCreateDDL() with an unknown key error = nil, want an error")
+	}
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"google.golang.org/api/iterator"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sqliteDriverName  = "SQLITE"
+	sqliteExtension   = ".sqlite"
+	sqliteContentType = "application/vnd.sqlite3"
+)
+
+// Caps of SQLite exports unless SQLITE_MAX_ROWS and SQLITE_MAX_BYTES set others.
+const (
+	defaultSQLiteMaxRows  = 1000000
+	defaultSQLiteMaxBytes = 256 << 20
+)
+
+// SQLiteDriver exports the result as one SQLite database file uploaded to Cloud Storage,
+// for offline extracts that stay queryable on a laptop. The rows are read through the
+// service into a local file (in the temp directory, memory on Cloud Run), with a unique
+// index on the key columns, and the finished file is uploaded at once, so a failed export
+// leaves no file behind. Results of more than maxRows rows or about maxBytes bytes fail
+// before they fill the instance's memory.
+type SQLiteDriver struct {
+	gcs      *GCSService
+	maxRows  int
+	maxBytes int64
+}
+
+// NewSQLiteDriver returns a SQLITE driver uploading through gcs; SQLITE_MAX_ROWS (default
+// 1000000) and SQLITE_MAX_BYTES (default 256 MiB) cap the rows and estimated bytes of a
+// file.
+func NewSQLiteDriver(gcs *GCSService) *SQLiteDriver {
+	d := &SQLiteDriver{gcs: gcs, maxRows: defaultSQLiteMaxRows, maxBytes: defaultSQLiteMaxBytes}
+	if n, err := strconv.Atoi(os.Getenv("SQLITE_MAX_ROWS")); err == nil && n > 0 {
+		d.maxRows = n
+	}
+	if n, err := strconv.ParseInt(os.Getenv("SQLITE_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		d.maxBytes = n
+	}
+	return d
+}
+
+func (d *SQLiteDriver) Name() string {
+	return sqliteDriverName
+}
+
+func (d *SQLiteDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{Files: true, Extension: sqliteExtension, FileTables: true, ReadsRows: true, Labels: true}
+}
+
+// sqliteFile returns the gs:// URI of the file of an export and the table in it: output
+// names the file when it ends in .sqlite, and otherwise the folder of <filename>.sqlite.
+func sqliteFile(params ExportParams, timestamp string) (string, string, error) {
+	uri := params.Output
+	if !strings.HasSuffix(uri, sqliteExtension) {
+		name := cmp.Or(params.Filename, params.Name, "export")
+		if params.UseTimestamp != nil && *params.UseTimestamp {
+			name += "-" + timestamp
+		}
+		uri = strings.TrimSuffix(uri, "/") + "/" + name + sqliteExtension
+	}
+	if _, _, err := parseGCSURI(uri); err != nil {
+		return "", "", err
+	}
+	if strings.Contains(uri, "*") {
+		return "", "", fmt.Errorf("output %s of the %s driver names one file and cannot contain *", uri, sqliteDriverName)
+	}
+	return uri, cmp.Or(params.Table, params.Name, "export"), nil
+}
+
+func (d *SQLiteDriver) Execute(ctx context.Context, bq BigQueryClient, params ExportParams) (ExportResult, error) {
+	if d.gcs == nil {
+		return ExportResult{}, ConfigError(fmt.Errorf("the %s driver needs a Cloud Storage client", sqliteDriverName))
+	}
+	uri, table, err := sqliteFile(params, time.Now().Format("20060102-150405"))
+	if err != nil {
+		return ExportResult{}, ConfigError(err)
+	}
+	bucket, object, _ := parseGCSURI(uri)
+	if _, err := d.gcs.CheckBucket(ctx, bucket, params.QueryLocation, "", false); err != nil {
+		return ExportResult{}, err
+	}
+	slog.InfoContext(ctx, "Starting SQLite export", "export_uri", uri, "table", table, "key_columns", params.KeyColumns,
+		"max_rows", d.maxRows, "max_bytes", d.maxBytes)
+
+	res := ExportResult{GCSPath: uri, Table: table}
+	// One row past the cap tells a full result from one that is too large
+	it, err := bq.ReadRows(ctx, fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", params.Query, d.maxRows+1), params.QueryLocation)
+	if err != nil {
+		return res, fmt.Errorf("export to %s failed: %w", uri, err)
+	}
+	defer it.Close()
+	if it, err = transformRows(ctx, it, params.transformers); err != nil {
+		return res, err
+	}
+	res.Job = it.Job()
+
+	// RowIterator.Schema may be empty until the first page is fetched
+	var prefetch []bigquery.Value
+	if len(it.Schema()) == 0 {
+		if err := it.Next(&prefetch); err != nil && err != iterator.Done {
+			return res, fmt.Errorf("failed to fetch BigQuery rows: %w", err)
+		}
+	}
+	schema := it.Schema()
+	if len(schema) == 0 {
+		return res, fmt.Errorf("empty BigQuery schema")
+	}
+	index, err := sqliteIndexDDL(table, schema, params.KeyColumns)
+	if err != nil {
+		return res, ConfigError(err)
+	}
+
+	tmp, err := os.CreateTemp("", "bq-exporter-*"+sqliteExtension)
+	if err != nil {
+		return res, fmt.Errorf("failed to create SQLite file: %w", err)
+	}
+	path := tmp.Name()
+	tmp.Close()
+	defer os.Remove(path)
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return res, fmt.Errorf("failed to open SQLite file: %w", err)
+	}
+	defer db.Close()
+
+	// The file is written once, by one connection: it needs no journal
+	db.SetMaxOpenConns(1)
+	ddl := sqliteCreateDDL(table, schema)
+	recordStatement(ctx, StatementSQLite, ddl)
+	for _, stmt := range []string{"PRAGMA journal_mode = OFF", "PRAGMA synchronous = OFF", ddl} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return res, fmt.Errorf("failed to create SQLite table %s: %w", table, err)
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, fmt.Errorf("failed to write SQLite file: %w", err)
+	}
+	defer tx.Rollback()
+	insert, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s VALUES (%s)", quoteSQLiteIdent(table), strings.TrimSuffix(strings.Repeat("?, ", len(schema)), ", ")))
+	if err != nil {
+		return res, fmt.Errorf("failed to write SQLite file: %w", err)
+	}
+	values := make([]any, len(schema))
+	var size int64
+	for {
+		row := prefetch
+		if row != nil {
+			prefetch = nil
+		} else if err := it.Next(&row); err == iterator.Done {
+			break
+		} else if err != nil {
+			return res, fmt.Errorf("export to %s failed: %w", uri, err)
+		}
+		if res.Rows == int64(d.maxRows) {
+			return res, DataError(fmt.Errorf("result has more than %d rows (SQLITE_MAX_ROWS); export larger results to Cloud Storage", d.maxRows))
+		}
+		if size += int64(approxRowBytes(row)); size > d.maxBytes {
+			return res, DataError(fmt.Errorf("result is larger than %d bytes (SQLITE_MAX_BYTES) after %d rows; export larger results to Cloud Storage", d.maxBytes, res.Rows))
+		}
+		clear(values)
+		for i, v := range row[:min(len(row), len(schema))] {
+			values[i] = sqliteValue(schema[i], v)
+		}
+		if _, err := insert.ExecContext(ctx, values...); err != nil {
+			return res, fmt.Errorf("failed to write row %d to SQLite: %w", res.Rows+1, err)
+		}
+		res.Rows++
+	}
+	if err := tx.Commit(); err != nil {
+		return res, fmt.Errorf("failed to write SQLite file: %w", err)
+	}
+	if index != "" {
+		recordStatement(ctx, StatementSQLite, index)
+		if _, err := db.ExecContext(ctx, index); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				return res, DataError(fmt.Errorf("key_columns %s are not unique in the result", strings.Join(params.KeyColumns, ", ")))
+			}
+			return res, fmt.Errorf("failed to index SQLite table %s: %w", table, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		return res, fmt.Errorf("failed to write SQLite file: %w", err)
+	}
+
+	if res.BytesWritten, err = d.upload(ctx, path, bucket, object); err != nil {
+		return res, err
+	}
+	res.Files = 1
+	slog.InfoContext(ctx, "SQLite export completed", "export_uri", uri, "job_id", res.Job.ID, "rows", res.Rows, "bytes_written", res.BytesWritten)
+	return res, nil
+}
+
+// upload copies the file at path to gs://bucket/object and returns its size.
+func (d *SQLiteDriver) upload(ctx context.Context, path, bucket, object string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read SQLite file: %w", err)
+	}
+	defer f.Close()
+	w := d.gcs.NewObjectWriter(ctx, bucket, object, sqliteContentType)
+	if _, err := io.Copy(w, f); err != nil {
+		w.Abort(err)
+		return 0, fmt.Errorf("failed to upload gs://%s/%s: %w", bucket, object, err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, fmt.Errorf("failed to upload gs://%s/%s: %w", bucket, object, err)
+	}
+	return w.Written(), nil
+}
+
+func quoteSQLiteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqliteCreateDDL returns the CREATE TABLE statement of the result schema.
+func sqliteCreateDDL(table string, schema bigquery.Schema) string {
+	cols := make([]string, len(schema))
+	for i, f := range schema {
+		cols[i] = "  " + quoteSQLiteIdent(f.Name) + " " + sqliteType(f)
+		if f.Required {
+			cols[i] += " NOT NULL"
+		}
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n%s\n)", quoteSQLiteIdent(table), strings.Join(cols, ",\n"))
+}
+
+// sqliteIndexDDL returns the unique index of the key columns, or "" without any.
+func sqliteIndexDDL(table string, schema bigquery.Schema, keys []string) (string, error) {
+	if len(keys) == 0 {
+		return "", nil
+	}
+	quoted := make([]string, len(keys))
+	for i, k := range keys {
+		if len(columnIndexes(schema, []string{k})) == 0 {
+			return "", fmt.Errorf("key column %q is not a column of the result", k)
+		}
+		quoted[i] = quoteSQLiteIdent(k)
+	}
+	return fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", quoteSQLiteIdent(table+"_key"), quoteSQLiteIdent(table), strings.Join(quoted, ", ")), nil
+}
+
+// sqliteType is the SQLite column type of a BigQuery column. NUMERIC and BIGNUMERIC are
+// TEXT, which keeps them exact (SQLite arithmetic still treats them as numbers); dates
+// and times are ISO 8601 TEXT, which the SQLite date functions read; records and arrays
+// are JSON TEXT, which its JSON functions read.
+func sqliteType(f *bigquery.FieldSchema) string {
+	if f.Repeated {
+		return "TEXT"
+	}
+	switch f.Type {
+	case bigquery.IntegerFieldType, bigquery.BooleanFieldType:
+		return "INTEGER"
+	case bigquery.FloatFieldType:
+		return "REAL"
+	case bigquery.BytesFieldType:
+		return "BLOB"
+	}
+	return "TEXT"
+}
+
+// sqliteValue converts a BigQuery value of field into the value stored for it.
+func sqliteValue(field *bigquery.FieldSchema, v bigquery.Value) any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case int64, float64, string, []byte:
+		return v
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case []bigquery.Value:
+		data, _ := json.Marshal(recordJSON(field, v))
+		return string(data)
+	case *big.Rat, civil.Date, civil.DateTime, civil.Time:
+		return fmt.Sprint(downloadJSONValue(v))
+	case time.Time:
+		return v.UTC().Format("2006-01-02T15:04:05.999999Z")
+	}
+	return downloadCSVCell(v)
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openSQLite opens the SQLite file data.
+func openSQLite(t *testing.T, data []byte) *sql.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "export.sqlite")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLiteDriver(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{schema: testParquetSchema, rows: testParquetRows(3)}
+	d := NewSQLiteDriver(gcs.service(t))
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/extracts/", Name: "visits", KeyColumns: []string{"id"}}
+	ctx, l := withStatementLog(context.Background())
+	res, err := d.Execute(ctx, bq, params)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if res.Rows != 3 || res.GCSPath != "gs://b/extracts/visits.sqlite" || res.Table != "visits" {
+		t.Errorf("Execute() = %+v", res)
+	}
+	if len(l.stmts) != 2 || !strings.HasPrefix(l.stmts[1].SQL, `CREATE UNIQUE INDEX "visits_key" ON "visits" ("id")`) {
+		t.Errorf("statements = %+v, want the CREATE TABLE and the key index", l.stmts)
+	}
+	data := gcs.objects["extracts/visits.sqlite"]
+	if data == nil {
+		t.Fatalf("objects = %v", gcs.names())
+	}
+	if res.Files != 1 || res.BytesWritten != int64(len(data)) {
+		t.Errorf("Execute() = %d files of %d bytes, want 1 of %d", res.Files, res.BytesWritten, len(data))
+	}
+	db := openSQLite(t, data)
+	var (
+		amount, seen, codes, site string
+		total                     float64
+	)
+	err = db.QueryRow(`SELECT amount, seen_at, codes, site FROM visits WHERE id = 2`).Scan(&amount, &seen, &codes, &site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount != "1.5" || seen != "2026-10-01T08:30:00Z" || codes != `["A01","B02"]` || site != `{"beds":20,"code":"A1"}` {
+		t.Errorf("row = %s, %s, %s, %s", amount, seen, codes, site)
+	}
+	if err := db.QueryRow(`SELECT SUM(amount) FROM visits`).Scan(&total); err != nil || total != 2 {
+		t.Errorf("SUM(amount) = %v, %v, want the NUMERIC text summed as numbers", total, err)
+	}
+	var plan string
+	if err := db.QueryRow(`EXPLAIN QUERY PLAN SELECT * FROM visits WHERE id = 2`).Scan(new(int), new(int), new(int), &plan); err != nil || !strings.Contains(plan, "visits_key") {
+		t.Errorf("query plan = %q, %v, want the key index used", plan, err)
+	}
+
+	bq.rows = append(bq.rows, bq.rows[0])
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData {
+		t.Errorf("Execute() with a duplicate key error = %v, want a data error", err)
+	}
+	params.KeyColumns = []string{"missing"}
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureConfig {
+		t.Errorf("Execute() with an unknown key column error = %v, want a config error", err)
+	}
+	if !strings.Contains(bq.queries[len(bq.queries)-1], "LIMIT 1000001") {
+		t.Errorf("query = %s, want one row past the cap", bq.queries[len(bq.queries)-1])
+	}
+}
+
+func TestSQLiteDriverCaps(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{schema: testParquetSchema, rows: testParquetRows(3)}
+	d := NewSQLiteDriver(gcs.service(t))
+	params := ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/extracts/", Name: "visits"}
+
+	d.maxRows = 2
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData || !strings.Contains(err.Error(), "SQLITE_MAX_ROWS") {
+		t.Errorf("Execute() over the row cap error = %v, want a data error", err)
+	}
+	d.maxRows, d.maxBytes = defaultSQLiteMaxRows, 10
+	if _, err := d.Execute(context.Background(), bq, params); FailureClass(err) != FailureData || !strings.Contains(err.Error(), "SQLITE_MAX_BYTES") {
+		t.Errorf("Execute() over the byte cap error = %v, want a data error", err)
+	}
+	if len(gcs.objects) != 0 {
+		t.Errorf("objects = %v, want nothing uploaded", gcs.names())
+	}
+}
+
+func TestSQLiteFile(t *testing.T) {
+	yes := true
+	for _, tt := range []struct {
+		params     ExportParams
+		uri, table string
+	}{
+		{ExportParams{Output: "gs://b/out"}, "gs://b/out/export.sqlite", "export"},
+		{ExportParams{Output: "gs://b/out/", Filename: "site_a", Table: "visits"}, "gs://b/out/site_a.sqlite", "visits"},
+		{ExportParams{Output: "gs://b/out/study.sqlite", UseTimestamp: &yes, Name: "visits"}, "gs://b/out/study.sqlite", "visits"},
+		{ExportParams{Output: "gs://b/out/", UseTimestamp: &yes}, "gs://b/out/export-20261014-090000.sqlite", "export"},
+	} {
+		uri, table, err := sqliteFile(tt.params, "20261014-090000")
+		if err != nil || uri != tt.uri || table != tt.table {
+			t.Errorf("sqliteFile(%+v) = %s, %s, %v, want %s, %s", tt.params, uri, table, err, tt.uri, tt.table)
+		}
+	}
+	if _, _, err := sqliteFile(ExportParams{Output: "gs://b/out/visits-*.sqlite"}, ""); err == nil {
+		t.Error("sqliteFile() with a wildcard error = nil, want an error")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -16,12 +18,19 @@ import (
 )
 
 type StarRocksService struct {
-	db       *sql.DB
-	host     string
+	db *sql.DB
+	// readDB, if set, runs verification queries (see openStarRocksReadDB)
+	readDB   *sql.DB
+	fes      *fePool
 	port     string
 	user     string
 	password string
 	dbname   string
+
+	// loadMethod is LoadMethodInsert (default) or LoadMethodStream
+	loadMethod string
+	httpPort   string
+	httpClient *http.Client
 }
 
 func NewStarRocksServiceFromEnv() (*StarRocksService, error) {
@@ -33,19 +42,27 @@ func NewStarRocksServiceFromEnv() (*StarRocksService, error) {
 
 	slog.Info("Connecting to StarRocks", "host", host, "port", port, "user", user, "dbname", dbname)
 
-	if host == "" || port == "" || user == "" {
-		return nil, fmt.Errorf("missing StarRocks env: require STARROCKS_HOST, STARROCKS_PORT, STARROCKS_USER")
+	// STARROCKS_HOST may list several FEs; connections are dialed through the FE pool
+	fes := parseFEHosts(host, port)
+
+	if len(fes.addrs) == 0 || port == "" || user == "" {
+		return nil, ConfigError(fmt.Errorf("missing StarRocks env: require STARROCKS_HOST, STARROCKS_PORT, STARROCKS_USER"))
+	}
+	loadMethod := strings.ToLower(strings.TrimSpace(os.Getenv("STARROCKS_LOAD_METHOD")))
+	switch loadMethod {
+	case "", LoadMethodInsert, LoadMethodStream:
+	default:
+		return nil, ConfigError(fmt.Errorf("unknown STARROCKS_LOAD_METHOD %q; expected insert or stream", loadMethod))
 	}
 
-	var dsn string
-	// Add timeout and StarRocks-specific parameters to prevent hanging
-	// StarRocks uses MySQL protocol but may need specific settings
-	if dbname != "" {
-		dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true&timeout=10s&tls=false&allowCleartextPasswords=1", user, pass, host, port, dbname)
-	} else {
-		dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true&timeout=10s&tls=false&allowCleartextPasswords=1", user, pass, host, port)
+	wh := os.Getenv("STARROCKS_WAREHOUSE")
+	if strings.TrimSpace(wh) == "" {
+		wh = "default_warehouse"
 	}
-	slog.Info("Opening MySQL connection to StarRocks...")
+
+	fes.register(feDialNetwork)
+	dsn := withStarRocksWarehouse(starRocksDSN(user, pass, feDialNetwork, dbname), wh)
+	slog.Info("Opening MySQL connection to StarRocks...", "warehouse", wh)
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		slog.Error("Failed to open MySQL connection", "error", err)
@@ -61,91 +78,325 @@ func NewStarRocksServiceFromEnv() (*StarRocksService, error) {
 	slog.Info("Pinging StarRocks database with timeout...")
 	if err := db.PingContext(pingCtx); err != nil {
 		slog.Error("Failed to ping StarRocks", "error", err)
-		return nil, fmt.Errorf("failed to connect to StarRocks: %w", err)
+		return nil, TransientError(fmt.Errorf("failed to connect to StarRocks: %w", err))
 	}
-	slog.Info("StarRocks connection established, setting warehouse...")
+	slog.Info("StarRocks connection established")
 
-	wh := os.Getenv("STARROCKS_WAREHOUSE")
-	if strings.TrimSpace(wh) == "" {
-		wh = "default_warehouse"
-	}
-	slog.Info("Setting StarRocks warehouse", "warehouse", wh)
-	if _, err := db.Exec(fmt.Sprintf("SET warehouse = '%s'", wh)); err != nil {
-		slog.Error("Failed to set warehouse", "error", err)
-		return nil, fmt.Errorf("failed to set session warehouse %q: %w", wh, err)
+	readDB, err := openStarRocksReadDB(user, pass, dbname, port)
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 	slog.Info("StarRocks service initialized successfully")
 
 	return &StarRocksService{
 		db:       db,
-		host:     host,
+		readDB:   readDB,
+		fes:      fes,
 		port:     port,
 		user:     user,
 		password: pass,
 		dbname:   dbname,
+
+		loadMethod: loadMethod,
+		httpPort:   os.Getenv("STARROCKS_HTTP_PORT"),
+		httpClient: &http.Client{},
 	}, nil
 }
 
+// starRocksDSN is the DSN of a connection pool dialed through network.
+func starRocksDSN(user, pass, network, dbname string) string {
+	// Add timeout and StarRocks-specific parameters to prevent hanging
+	// StarRocks uses MySQL protocol but may need specific settings
+	return fmt.Sprintf("%s:%s@%s(fe-pool)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true&timeout=10s&tls=false&allowCleartextPasswords=1", user, pass, network, dbname)
+}
+
+// withStarRocksWarehouse sets the session warehouse in dsn. Session variables in the DSN
+// are set on every new connection of the pool, including those dialed to another FE
+// after a failover.
+func withStarRocksWarehouse(dsn, wh string) string {
+	return dsn + "&warehouse=" + url.QueryEscape("'"+wh+"'")
+}
+
+// openStarRocksReadDB opens the pool verification queries run on, so they do not
+// contend with loads: the FEs in STARROCKS_READ_HOST (entries without a port use
+// STARROCKS_PORT), with STARROCKS_READ_WAREHOUSE as the session warehouse. It returns
+// nil when neither is set, and verification uses the load connections.
+func openStarRocksReadDB(user, pass, dbname, port string) (*sql.DB, error) {
+	host, wh := os.Getenv("STARROCKS_READ_HOST"), strings.TrimSpace(os.Getenv("STARROCKS_READ_WAREHOUSE"))
+	if strings.TrimSpace(host) == "" && wh == "" {
+		return nil, nil
+	}
+	network := feDialNetwork
+	if strings.TrimSpace(host) != "" {
+		fes := parseFEHosts(host, port)
+		fes.register(feReadDialNetwork)
+		network = feReadDialNetwork
+	}
+	dsn := starRocksDSN(user, pass, network, dbname)
+	if wh != "" {
+		dsn = withStarRocksWarehouse(dsn, wh)
+	}
+	slog.Info("Opening StarRocks read connection", "host", host, "warehouse", wh)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetConnMaxLifetime(30 * time.Minute)
+	db.SetMaxOpenConns(4)
+	db.SetMaxIdleConns(2)
+	pingCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := db.PingContext(pingCtx); err != nil {
+		db.Close()
+		return nil, TransientError(fmt.Errorf("failed to connect to the StarRocks read endpoint: %w", err))
+	}
+	return db, nil
+}
+
 func (s *StarRocksService) Close() error {
+	if s.readDB != nil {
+		s.readDB.Close()
+	}
 	if s.db != nil {
 		return s.db.Close()
 	}
 	return nil
 }
 
+// reader is the pool of verification queries.
+func (s *StarRocksService) reader() *sql.DB {
+	if s.readDB != nil {
+		return s.readDB
+	}
+	return s.db
+}
+
+// LoadResult describes a completed StarRocks load.
+type LoadResult struct {
+	Rows int64
+	// Deleted counts the rows deleted by key because they carried the delete marker
+	Deleted int64
+	Job     QueryJob
+	// ColumnMapping maps the result columns renamed by the column name and case
+	// policies to their destination names
+	ColumnMapping map[string]string
+	// DestinationRows is the row count of the table after a verified load
+	DestinationRows int64
+}
+
+// LoadOptions describes one StarRocks load.
+type LoadOptions struct {
+	Query    string
+	Location string
+	// Table is the fully qualified "db.table" destination
+	Table string
+	// CreateDDL, if set, replaces the automatically generated CREATE TABLE
+	CreateDDL string
+	// ReplicationNum is used in generated DDL (default 1)
+	ReplicationNum int
+	// Strategy is LoadStrategyInsert (default) or LoadStrategySwap
+	Strategy string
+	// DeleteColumn, if set, marks rows to delete by KeyColumns instead of loading them:
+	// rows whose value is one of DeleteValues (default: D, DELETE, true or 1). The
+	// destination must be a PRIMARY KEY table.
+	DeleteColumn string
+	DeleteValues []string
+	// KeyColumns identify rows, and key and distribute generated tables: DUPLICATE KEY,
+	// or PRIMARY KEY with a DeleteColumn (default the first column)
+	KeyColumns []string
+	// ColumnNames is the column name policy: ColumnNamesQuote (default),
+	// ColumnNamesSanitize or ColumnNamesStrict
+	ColumnNames string
+	// ColumnCase is the column case policy: ColumnCasePreserve (default),
+	// ColumnCaseLower or ColumnCaseUpper
+	ColumnCase string
+	// StringType is the type of created string columns: StringTypeVarchar (default),
+	// StringTypeString or StringTypeAuto
+	StringType string
+	// Verify counts the destination rows after the load (see verifyLoad)
+	Verify bool
+	// FreezeSchema fails loads whose result has columns the table lacks, instead of
+	// adding them
+	FreezeSchema bool
+	// NoCreate fails loads into a missing table, instead of creating it (and its
+	// database) from generated DDL; CreateDDL still applies
+	NoCreate bool
+	// Transformers transform the rows between BigQuery and StarRocks
+	Transformers []RowTransformer
+}
+
+const (
+	// LoadStrategyInsert appends rows directly into the destination table.
+	LoadStrategyInsert = "insert"
+	// LoadStrategySwap loads into a staging copy of the destination and atomically swaps it
+	// in on success, replacing the table contents without readers seeing a partial load.
+	LoadStrategySwap = "swap"
+)
+
 // LoadFromBigQuery executes the SQL on BigQuery, ensures the StarRocks table exists (with optional
 // custom DDL or automatic schema evolution), and inserts all rows.
-func (s *StarRocksService) LoadFromBigQuery(ctx context.Context, bq *BigQueryService, sqlQuery, location, table, createDDL string) (int64, error) {
+func (s *StarRocksService) LoadFromBigQuery(ctx context.Context, bq BigQueryClient, opts LoadOptions) (LoadResult, error) {
+	table := opts.Table
+
 	// Run query
-	q := bq.client.Query(sqlQuery)
-	q.Location = location
-	it, err := q.Read(ctx)
+	it, err := bq.ReadRows(ctx, opts.Query, opts.Location)
 	if err != nil {
-		return 0, fmt.Errorf("failed to execute query on BigQuery: %w", err)
+		return LoadResult{}, fmt.Errorf("failed to execute query on BigQuery: %w", err)
+	}
+	defer it.Close()
+	if it, err = transformRows(ctx, it, opts.Transformers); err != nil {
+		return LoadResult{}, err
 	}
+	res := LoadResult{Job: it.Job()}
 
 	// Ensure schema is populated. RowIterator.Schema may be empty until the first page is fetched.
 	var prefetch []bigquery.Value
 	var havePrefetch bool
-	if len(it.Schema) == 0 {
+	if len(it.Schema()) == 0 {
 		var vals []bigquery.Value
 		if e := it.Next(&vals); e == nil {
 			prefetch = vals
 			havePrefetch = true
 		} else if e != iterator.Done {
-			return 0, fmt.Errorf("failed to fetch BigQuery rows: %w", e)
+			return res, fmt.Errorf("failed to fetch BigQuery rows: %w", e)
 		}
 	}
-	if len(it.Schema) == 0 {
-		return 0, fmt.Errorf("empty BigQuery schema")
+	schema := it.Schema()
+	if len(schema) == 0 {
+		return res, fmt.Errorf("empty BigQuery schema")
+	}
+
+	del, err := newDeleteMarker(schema, opts.DeleteColumn, opts.DeleteValues, opts.KeyColumns)
+	if err != nil {
+		return res, err
+	}
+	// Rows are identified by their key columns in errors, and created tables keyed by them
+	keys, err := keyColumnIndexes(schema, opts.KeyColumns)
+	if err != nil {
+		return res, ConfigError(err)
+	}
+	// From here on the schema carries the destination column names
+	src := schema
+	schema, res.ColumnMapping, err = destinationSchema(schema, opts.ColumnNames, opts.ColumnCase)
+	if err != nil {
+		return res, ConfigError(err)
+	}
+	if schema, err = stringTypeSchema(schema, opts.StringType); err != nil {
+		return res, ConfigError(err)
+	}
+	if opts.StringType == StringTypeAuto && strings.TrimSpace(opts.CreateDDL) == "" {
+		if schema, err = s.sizeNewStringColumns(ctx, bq, opts, src, schema); err != nil {
+			return res, err
+		}
 	}
 
 	// Ensure table exists (create or evolve)
-	if err := s.ensureTable(ctx, it.Schema, table, createDDL); err != nil {
-		return 0, fmt.Errorf("failed to ensure StarRocks table: %w", err)
+	if err := s.ensureTable(ctx, schema, keys, opts); err != nil {
+		return res, fmt.Errorf("failed to ensure StarRocks table: %w", err)
+	}
+
+	if opts.Strategy == LoadStrategySwap {
+		if del != nil {
+			return res, fmt.Errorf("delete_column cannot be combined with the swap load strategy, which replaces the whole table")
+		}
+		rows, loaded, err := s.loadWithSwap(ctx, it, schema, keys, table, prefetch, havePrefetch)
+		res.Rows = rows
+		if err == nil && opts.Verify {
+			res.DestinationRows, err = s.verifyLoad(ctx, loaded, true, rows)
+		}
+		return res, err
 	}
 
 	// Insert rows
-	rowsInserted, err := s.insertRows(ctx, it, it.Schema, table, prefetch, havePrefetch)
+	rowsInserted, rowsDeleted, err := s.loadRows(ctx, it, schema, keys, table, prefetch, havePrefetch, del)
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert rows into StarRocks: %w", err)
+		return res, fmt.Errorf("failed to insert rows into StarRocks: %w", err)
 	}
-	return rowsInserted, nil
+	res.Rows, res.Deleted = rowsInserted, rowsDeleted
+	if opts.Verify {
+		res.DestinationRows, err = s.verifyLoad(ctx, table, false, rowsInserted)
+	}
+	return res, err
 }
 
-func (s *StarRocksService) ensureTable(ctx context.Context, schema bigquery.Schema, table, createDDL string) error {
+// loadWithSwap inserts into a fresh staging table created LIKE the (already ensured)
+// destination and swaps the two with ALTER TABLE ... SWAP WITH, which StarRocks applies
+// atomically. The staging table, holding the previous contents after the swap, is dropped.
+// When ctx defers swaps (see withDeferredSwaps) the loaded staging table is handed over
+// instead, to be swapped in later. It returns the rows loaded and the table holding them
+// now, which is where the load is verified.
+func (s *StarRocksService) loadWithSwap(ctx context.Context, it RowIterator, schema bigquery.Schema, keys []int, table string, prefetch []bigquery.Value, havePrefetch bool) (int64, string, error) {
+	db, tbl := s.parseDBTable(table)
+	stagingTbl := fmt.Sprintf("%s__staging_%d", tbl, time.Now().UnixNano())
+	staging := s.qualify(db, stagingTbl)
+
+	slog.InfoContext(ctx, "Creating StarRocks staging table", "table", table, "staging_table", staging)
+	cleanup := registerCleanup(ctx, CleanupStarRocksTable, staging, "")
+	createStaging := fmt.Sprintf("CREATE TABLE %s LIKE %s", staging, table)
+	recordStatement(ctx, StatementStarRocks, createStaging)
+	if _, err := s.db.ExecContext(ctx, createStaging); err != nil {
+		return 0, "", fmt.Errorf("failed to create staging table: %w", err)
+	}
+	drop := func() {
+		dropCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		dropStaging := fmt.Sprintf("DROP TABLE IF EXISTS %s FORCE", staging)
+		recordStatement(ctx, StatementStarRocks, dropStaging)
+		if _, err := s.db.ExecContext(dropCtx, dropStaging); err != nil {
+			slog.ErrorContext(ctx, "Failed to drop StarRocks staging table", "staging_table", staging, "error", err)
+			return
+		}
+		cleanup.done(ctx)
+	}
+	swap := func(ctx context.Context) error {
+		slog.InfoContext(ctx, "Swapping StarRocks staging table into place", "table", table, "staging_table", staging)
+		q := fmt.Sprintf("ALTER TABLE %s SWAP WITH %s", table, stagingTbl)
+		recordStatement(ctx, StatementStarRocks, q)
+		if _, err := s.db.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("failed to swap staging table into %s: %w", table, err)
+		}
+		return nil
+	}
+
+	rows, _, err := s.loadRows(ctx, it, schema, keys, staging, prefetch, havePrefetch, nil)
+	if err != nil {
+		drop()
+		return 0, "", fmt.Errorf("failed to insert rows into StarRocks staging table: %w", err)
+	}
+	if d := deferredSwapsFrom(ctx); d != nil {
+		slog.InfoContext(ctx, "Deferring the StarRocks swap", "table", table, "staging_table", staging)
+		// The staging table outlives the run, until the deferred swaps commit or discard
+		cleanup.detach()
+		d.add(deferredSwap{table: table, lock: ctx, swap: swap, drop: drop})
+		return rows, staging, nil
+	}
+	// The staging table is always dropped: after a successful swap it holds the old
+	// contents, otherwise the new ones
+	defer drop()
+	if err := swap(ctx); err != nil {
+		return 0, "", err
+	}
+	return rows, table, nil
+}
+
+func (s *StarRocksService) ensureTable(ctx context.Context, schema bigquery.Schema, keys []int, opts LoadOptions) error {
+	table, createDDL := opts.Table, opts.CreateDDL
 	if table == "" {
 		return fmt.Errorf("table name is empty")
 	}
 
 	db, tbl := s.parseDBTable(table)
 
-	if err := s.ensureDatabase(ctx, db); err != nil {
-		return err
+	if strings.TrimSpace(createDDL) != "" || !opts.NoCreate {
+		if err := s.ensureDatabase(ctx, db); err != nil {
+			return err
+		}
 	}
 
 	if strings.TrimSpace(createDDL) != "" {
 		slog.InfoContext(ctx, "Applying user-provided StarRocks DDL")
+		recordStatement(ctx, StatementStarRocks, createDDL)
 		if _, err := s.db.ExecContext(ctx, createDDL); err != nil {
 			return fmt.Errorf("failed to execute provided DDL: %w", err)
 		}
@@ -157,32 +408,16 @@ func (s *StarRocksService) ensureTable(ctx context.Context, schema bigquery.Sche
 		return err
 	}
 	if !exists {
-		// Basic duplicate-key model using first column as key
-		if len(schema) == 0 {
-			return fmt.Errorf("empty BigQuery schema")
-		}
-		var cols []string
-		for _, f := range schema {
-			if f.Repeated || f.Type == bigquery.RecordFieldType {
-				return fmt.Errorf("unsupported complex type for column %q", f.Name)
-			}
-			cols = append(cols, fmt.Sprintf("`%s` %s", f.Name, mapSRType(f)))
-		}
-		colDDL := strings.Join(cols, ", ")
-		dupKey := fmt.Sprintf("`%s`", schema[0].Name)
 		fullName := s.qualify(db, tbl)
-		ddl := fmt.Sprintf(`
-			CREATE TABLE IF NOT EXISTS %s (
-				%s
-			)
-			ENGINE=OLAP
-			DUPLICATE KEY (%s)
-			DISTRIBUTED BY HASH(%s) BUCKETS 8
-			PROPERTIES (
-				"replication_num" = "1"
-			)`, fullName, colDDL, dupKey, dupKey)
-
+		if opts.NoCreate {
+			return ConfigError(fmt.Errorf("%s does not exist, and creating tables is disabled for it (auto_ddl or allow_schema_changes)", fullName))
+		}
+		ddl, err := buildCreateTableDDL(fullName, schema, keys, opts.DeleteColumn != "", opts.ReplicationNum)
+		if err != nil {
+			return ConfigError(err)
+		}
 		slog.InfoContext(ctx, "Creating StarRocks table", "table", fullName)
+		recordStatement(ctx, StatementStarRocks, ddl)
 		if _, err := s.db.ExecContext(ctx, ddl); err != nil {
 			return err
 		}
@@ -190,14 +425,107 @@ func (s *StarRocksService) ensureTable(ctx context.Context, schema bigquery.Sche
 	}
 
 	// Evolve schema: add missing columns
-	return s.evolveSchema(ctx, db, tbl, schema)
+	return s.evolveSchema(ctx, db, tbl, schema, opts.FreezeSchema)
+}
+
+// insertBatchSize is STARROCKS_BATCH_SIZE (default 1000).
+func insertBatchSize() int {
+	if n, err := strconv.Atoi(os.Getenv("STARROCKS_BATCH_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return 1000
+}
+
+// insertBatchBytes is STARROCKS_BATCH_BYTES (default 16 MiB): a batch is flushed once its
+// rows reach this estimated size, however few rows it has.
+func insertBatchBytes() int {
+	if n, err := strconv.Atoi(os.Getenv("STARROCKS_BATCH_BYTES")); err == nil && n > 0 {
+		return n
+	}
+	return 16 << 20
+}
+
+// approxRowBytes estimates the loaded size of a row, for the batch and chunk byte caps.
+// Strings and bytes count their length, other values a fixed 16 bytes.
+func approxRowBytes(values []bigquery.Value) int {
+	n := 0
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			n += len(v)
+		case []byte:
+			n += len(v)
+		case []bigquery.Value:
+			n += approxRowBytes(v)
+		default:
+			n += 16
+		}
+	}
+	return n
+}
+
+// buildCreateTableDDL generates the DDL of a missing destination table: a duplicate-key
+// model, or with primary a primary-key model, keyed and distributed by the columns of
+// schema at keys (default the first), which StarRocks wants first and, for primary keys,
+// NOT NULL.
+func buildCreateTableDDL(fullName string, schema bigquery.Schema, keys []int, primary bool, replicationNum int) (string, error) {
+	if len(schema) == 0 {
+		return "", fmt.Errorf("empty BigQuery schema")
+	}
+	if len(keys) == 0 {
+		keys = []int{0}
+	}
+	var cols, keyCols []string
+	isKey := make(map[int]bool, len(keys))
+	for _, i := range keys {
+		f := schema[i]
+		switch t := mapSRType(f); t {
+		case "DOUBLE", "JSON":
+			return "", fmt.Errorf("key column %q is %s, which StarRocks cannot key tables by; choose other key_columns", f.Name, t)
+		}
+		col := quoteSRIdent(f.Name) + " " + mapSRType(f)
+		if primary {
+			col += " NOT NULL"
+		}
+		cols = append(cols, col)
+		keyCols = append(keyCols, quoteSRIdent(f.Name))
+		isKey[i] = true
+	}
+	for i, f := range schema {
+		if f.Repeated || f.Type == bigquery.RecordFieldType {
+			return "", fmt.Errorf("unsupported complex type for column %q", f.Name)
+		}
+		if !isKey[i] {
+			cols = append(cols, quoteSRIdent(f.Name)+" "+mapSRType(f))
+		}
+	}
+	model := "DUPLICATE KEY"
+	if primary {
+		model = "PRIMARY KEY"
+	}
+	key := strings.Join(keyCols, ", ")
+	if replicationNum <= 0 {
+		replicationNum = 1
+	}
+	return fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				%s
+			)
+			ENGINE=OLAP
+			%s (%s)
+			DISTRIBUTED BY HASH(%s) BUCKETS 8
+			PROPERTIES (
+				"replication_num" = "%d"
+			)`, fullName, strings.Join(cols, ", "), model, key, key, replicationNum), nil
 }
 
 func (s *StarRocksService) ensureDatabase(ctx context.Context, db string) error {
 	if strings.TrimSpace(db) == "" {
 		return fmt.Errorf("database is empty")
 	}
-	_, err := s.db.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", db))
+	stmt := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", db)
+	recordStatement(ctx, StatementStarRocks, stmt)
+	_, err := s.db.ExecContext(ctx, stmt)
 	return err
 }
 func (s *StarRocksService) tableExists(ctx context.Context, db, tbl string) (bool, error) {
@@ -213,28 +541,43 @@ func (s *StarRocksService) tableExists(ctx context.Context, db, tbl string) (boo
 	return true, nil
 }
 
-func (s *StarRocksService) evolveSchema(ctx context.Context, db, tbl string, schema bigquery.Schema) error {
+// evolveSchema adds the columns of schema the table lacks; frozen fails instead, before
+// changing anything.
+func (s *StarRocksService) evolveSchema(ctx context.Context, db, tbl string, schema bigquery.Schema, frozen bool) error {
 	cur, err := s.getExistingColumns(ctx, db, tbl)
 	if err != nil {
 		return err
 	}
+	// StarRocks column names are case-insensitive
 	existing := make(map[string]string, len(cur))
 	for _, c := range cur {
-		existing[c.Name] = strings.ToUpper(c.Type)
+		existing[strings.ToLower(c.Name)] = strings.ToUpper(c.Type)
 	}
 
 	fullName := s.qualify(db, tbl)
+	var missing []*bigquery.FieldSchema
 	for _, f := range schema {
 		if f.Repeated || f.Type == bigquery.RecordFieldType {
 			return fmt.Errorf("unsupported complex type for column %q", f.Name)
 		}
-		if _, ok := existing[f.Name]; !ok {
-			colType := mapSRType(f)
-			ddl := fmt.Sprintf("ALTER TABLE %s ADD COLUMN `%s` %s", fullName, f.Name, colType)
-			slog.InfoContext(ctx, "Adding missing StarRocks column", "table", fullName, "column", f.Name, "type", colType)
-			if _, err := s.db.ExecContext(ctx, ddl); err != nil {
-				return err
-			}
+		if _, ok := existing[strings.ToLower(f.Name)]; !ok {
+			missing = append(missing, f)
+		}
+	}
+	if frozen && len(missing) > 0 {
+		names := make([]string, len(missing))
+		for i, f := range missing {
+			names[i] = f.Name
+		}
+		return ConfigError(fmt.Errorf("%s lacks the columns %s of the query result, and schema changes are disabled for it (schema_evolution or allow_schema_changes)", fullName, strings.Join(names, ", ")))
+	}
+	for _, f := range missing {
+		colType := mapSRType(f)
+		ddl := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", fullName, quoteSRIdent(f.Name), colType)
+		slog.InfoContext(ctx, "Adding missing StarRocks column", "table", fullName, "column", f.Name, "type", colType)
+		recordStatement(ctx, StatementStarRocks, ddl)
+		if _, err := s.db.ExecContext(ctx, ddl); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -243,11 +586,13 @@ func (s *StarRocksService) evolveSchema(ctx context.Context, db, tbl string, sch
 type srColumn struct {
 	Name string
 	Type string
+	// MaxLength is the length in bytes of string and binary columns, 0 for other types
+	MaxLength int64
 }
 
 func (s *StarRocksService) getExistingColumns(ctx context.Context, db, tbl string) ([]srColumn, error) {
 	const q = `
-		SELECT column_name, data_type
+		SELECT column_name, data_type, character_maximum_length
 		FROM information_schema.columns
 		WHERE table_schema = ? AND table_name = ?
 		ORDER BY ordinal_position
@@ -260,9 +605,11 @@ func (s *StarRocksService) getExistingColumns(ctx context.Context, db, tbl strin
 	var out []srColumn
 	for rows.Next() {
 		var c srColumn
-		if err := rows.Scan(&c.Name, &c.Type); err != nil {
+		var maxLength sql.NullInt64
+		if err := rows.Scan(&c.Name, &c.Type, &maxLength); err != nil {
 			return nil, err
 		}
+		c.MaxLength = maxLength.Int64
 		out = append(out, c)
 	}
 	return out, rows.Err()
@@ -285,64 +632,174 @@ func (s *StarRocksService) qualify(db, tbl string) string {
 	return fmt.Sprintf("%s.%s", db, tbl)
 }
 
-func (s *StarRocksService) insertRows(ctx context.Context, it *bigquery.RowIterator, schema bigquery.Schema, table string, prefetch []bigquery.Value, havePrefetch bool) (int64, error) {
-	cols := make([]string, 0, len(schema))
-	for _, f := range schema {
-		cols = append(cols, fmt.Sprintf("`%s`", f.Name))
+// loadRows writes all rows into table with the configured load method. Rows marked by
+// del (which may be nil) are deleted by key instead; it returns the loaded and deleted
+// row counts.
+func (s *StarRocksService) loadRows(ctx context.Context, it RowIterator, schema bigquery.Schema, keys []int, table string, prefetch []bigquery.Value, havePrefetch bool, del *deleteMarker) (int64, int64, error) {
+	dest, err := s.destinationColumns(ctx, table, schema)
+	if err != nil {
+		return 0, 0, err
+	}
+	cols := make([]string, len(dest))
+	for i, c := range dest {
+		cols[i] = c.Name
 	}
+	// Values too long for their column fail the load before they reach StarRocks
+	wc := newWidthCheck(table, schema, dest, keys)
+	if havePrefetch && len(prefetch) > 0 {
+		if err := wc.check(prefetch); err != nil {
+			return 0, 0, err
+		}
+	}
+	it = wc.wrap(it)
+	if s.loadMethod == LoadMethodStream {
+		return s.streamLoadRows(ctx, it, schema, cols, table, prefetch, havePrefetch, del)
+	}
+	return s.insertRows(ctx, it, schema, cols, table, prefetch, havePrefetch, del)
+}
+
+// destinationColumns maps every result column to the destination column it loads into,
+// by name: exactly, or ignoring case as StarRocks does. Loads list their columns
+// explicitly, so the destination's column order (columns added by schema evolution, or a
+// create_ddl in another order) never matters.
+func (s *StarRocksService) destinationColumns(ctx context.Context, table string, schema bigquery.Schema) ([]srColumn, error) {
+	db, tbl := s.parseDBTable(table)
+	cur, err := s.getExistingColumns(ctx, db, tbl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %w", table, err)
+	}
+	return matchColumns(table, schema, cur)
+}
+
+// matchColumns returns the destination column for each result column; a result column
+// without one is an error rather than a misaligned load.
+func matchColumns(table string, schema bigquery.Schema, cur []srColumn) ([]srColumn, error) {
+	if len(cur) == 0 {
+		return nil, fmt.Errorf("table %s has no columns or does not exist", table)
+	}
+	out := make([]srColumn, len(schema))
+	var missing []string
+	for i, f := range schema {
+		for _, c := range cur {
+			if c.Name == f.Name {
+				out[i] = c
+				break
+			}
+			if out[i].Name == "" && strings.EqualFold(c.Name, f.Name) {
+				out[i] = c
+			}
+		}
+		if out[i].Name == "" {
+			missing = append(missing, f.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, DataError(fmt.Errorf("query column(s) %s have no matching column in %s", strings.Join(missing, ", "), table))
+	}
+	return out, nil
+}
+
+// quoteColumns backquotes column names for statements.
+func quoteColumns(names []string) []string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = quoteSRIdent(n)
+	}
+	return out
+}
+
+func (s *StarRocksService) insertRows(ctx context.Context, it RowIterator, schema bigquery.Schema, destCols []string, table string, prefetch []bigquery.Value, havePrefetch bool, del *deleteMarker) (int64, int64, error) {
+	cols := quoteColumns(destCols)
+	// The transaction is bound to ctx: a cancelled request rolls it back instead of
+	// leaving it open until the server times it out.
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
+	committed := false
 	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
+		if !committed {
+			if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+				slog.ErrorContext(ctx, "Failed to roll back StarRocks transaction", "table", table, "error", rbErr)
+			}
 		}
 	}()
 
-	batchSize := 1000
-	if v := os.Getenv("STARROCKS_BATCH_SIZE"); v != "" {
-		if n, e := strconv.Atoi(v); e == nil && n > 0 {
-			batchSize = n
-		}
-	}
+	batchSize, batchBytes := insertBatchSize(), insertBatchBytes()
 
-	var total int64
+	var total, deleted int64
 	var batch [][]bigquery.Value
+	size := 0
 	if havePrefetch && len(prefetch) > 0 {
 		batch = append(batch, prefetch)
+		size = approxRowBytes(prefetch)
+	}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// Stop between batches as soon as the caller goes away
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := yieldBetweenChunks(ctx); err != nil {
+			return err
+		}
+		// Inserts and deletes are applied in source order, so a row deleted and
+		// re-inserted within one load ends up present
+		for _, seg := range del.segments(batch) {
+			if seg.deleted {
+				stmtStr, args := buildBatchDelete(table, cols, schema, del, seg.rows)
+				recordBatch(ctx, StatementStarRocksBatch, len(seg.rows), func() string {
+					stmt, _ := buildBatchDelete(table, cols, schema, del, seg.rows[:1])
+					return stmt
+				})
+				if _, err := tx.ExecContext(ctx, stmtStr, args...); err != nil {
+					return fmt.Errorf("failed to delete rows: %w", err)
+				}
+				deleted += int64(len(seg.rows))
+				continue
+			}
+			stmtStr, args := buildBatchInsert(table, cols, schema, seg.rows)
+			recordBatch(ctx, StatementStarRocksBatch, len(seg.rows), func() string {
+				stmt, _ := buildBatchInsert(table, cols, schema, seg.rows[:1])
+				return stmt
+			})
+			if _, err := tx.ExecContext(ctx, stmtStr, args...); err != nil {
+				return err
+			}
+			total += int64(len(seg.rows))
+		}
+		slog.DebugContext(ctx, "Inserted StarRocks batch", "table", table, "batch_rows", len(batch), "batch_bytes", size, "total_rows", total, "deleted_rows", deleted)
+		batch, size = batch[:0], 0
+		return nil
 	}
 	for {
 		var values []bigquery.Value
 		err := it.Next(&values)
 		if err == iterator.Done {
-			if len(batch) > 0 {
-				stmtStr, args := buildBatchInsert(table, cols, schema, batch)
-				if _, err := tx.ExecContext(ctx, stmtStr, args...); err != nil {
-					return 0, err
-				}
-				total += int64(len(batch))
-				batch = batch[:0]
+			if err := flush(); err != nil {
+				return 0, 0, err
 			}
 			break
 		}
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 		batch = append(batch, values)
-		if len(batch) >= batchSize {
-			stmtStr, args := buildBatchInsert(table, cols, schema, batch)
-			if _, err := tx.ExecContext(ctx, stmtStr, args...); err != nil {
-				return 0, err
+		size += approxRowBytes(values)
+		if len(batch) >= batchSize || size >= batchBytes {
+			if err := flush(); err != nil {
+				return 0, 0, err
 			}
-			total += int64(len(batch))
-			batch = batch[:0]
 		}
 	}
 	if err := tx.Commit(); err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	return total, nil
+	committed = true
+	slog.InfoContext(ctx, "StarRocks load committed", "table", table, "rows", total, "deleted_rows", deleted)
+	return total, deleted, nil
 }
 
 func buildBatchInsert(table string, cols []string, schema bigquery.Schema, batch [][]bigquery.Value) (string, []any) {
@@ -365,8 +822,11 @@ func buildBatchInsert(table string, cols []string, schema bigquery.Schema, batch
 func mapSRType(f *bigquery.FieldSchema) string {
 	switch f.Type {
 	case bigquery.StringFieldType:
-		return "VARCHAR(1024)"
+		return srVarchar(f.MaxLength)
 	case bigquery.BytesFieldType:
+		if f.MaxLength > 0 {
+			return fmt.Sprintf("VARBINARY(%d)", min(f.MaxLength, srMaxVarcharLength))
+		}
 		return "VARBINARY(1024)"
 	case bigquery.IntegerFieldType:
 		return "BIGINT"
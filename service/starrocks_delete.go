@@ -0,0 +1,104 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// defaultDeleteValues mark a row as deleted when DeleteValues is empty: the op types of
+// diff exports and CHANGES(), and boolean flags.
+var defaultDeleteValues = []string{DiffDelete, "DELETE", "true", "1"}
+
+// deleteMarker recognises rows that carry a delete marker. Marked rows are deleted from
+// the destination by key instead of being loaded.
+type deleteMarker struct {
+	col    int
+	keys   []int
+	values map[string]bool
+}
+
+// newDeleteMarker resolves the marker and key columns against the result schema; it
+// returns nil when no delete column is configured.
+func newDeleteMarker(schema bigquery.Schema, column string, values, keys []string) (*deleteMarker, error) {
+	if column == "" {
+		return nil, nil
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("delete_column requires key_columns to identify the rows to delete")
+	}
+	idx := func(name string) int {
+		for i, f := range schema {
+			if f.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+	m := &deleteMarker{col: idx(column), values: map[string]bool{}}
+	if m.col < 0 {
+		return nil, fmt.Errorf("delete column %q is not in the query result", column)
+	}
+	for _, k := range keys {
+		i := idx(k)
+		if i < 0 {
+			return nil, fmt.Errorf("key column %q is not in the query result", k)
+		}
+		m.keys = append(m.keys, i)
+	}
+	if len(values) == 0 {
+		values = defaultDeleteValues
+	}
+	for _, v := range values {
+		m.values[strings.ToLower(v)] = true
+	}
+	return m, nil
+}
+
+// deleted reports whether row carries the delete marker.
+func (m *deleteMarker) deleted(row []bigquery.Value) bool {
+	if m == nil || m.col >= len(row) || row[m.col] == nil {
+		return false
+	}
+	return m.values[strings.ToLower(fmt.Sprint(row[m.col]))]
+}
+
+// buildBatchDelete deletes the rows of batch by their key columns. StarRocks supports
+// such predicates on PRIMARY KEY tables.
+func buildBatchDelete(table string, cols []string, schema bigquery.Schema, m *deleteMarker, batch [][]bigquery.Value) (string, []any) {
+	conds := make([]string, len(batch))
+	args := make([]any, 0, len(batch)*len(m.keys))
+	for i, row := range batch {
+		vals := convertValues(row, schema)
+		parts := make([]string, len(m.keys))
+		for j, k := range m.keys {
+			parts[j] = cols[k] + " = ?"
+			args = append(args, vals[k])
+		}
+		conds[i] = "(" + strings.Join(parts, " AND ") + ")"
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", table, strings.Join(conds, " OR ")), args
+}
+
+// rowSegment is a run of consecutive rows that are either all loaded or all deleted.
+type rowSegment struct {
+	deleted bool
+	rows    [][]bigquery.Value
+}
+
+// segments splits batch into consecutive runs of loaded and deleted rows, so applying
+// them in order preserves the order of the source changes.
+func (m *deleteMarker) segments(batch [][]bigquery.Value) []rowSegment {
+	var out []rowSegment
+	for start := 0; start < len(batch); {
+		del := m.deleted(batch[start])
+		end := start + 1
+		for end < len(batch) && m.deleted(batch[end]) == del {
+			end++
+		}
+		out = append(out, rowSegment{del, batch[start:end]})
+		start = end
+	}
+	return out
+}
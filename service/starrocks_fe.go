@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// feDialNetwork is the network name the MySQL driver uses to reach the FE pool; the
+// address in the DSN is ignored and every new connection is dialed through the pool.
+// feReadDialNetwork reaches the FEs of the read endpoint (STARROCKS_READ_HOST).
+const (
+	feDialNetwork     = "starrocks-fe"
+	feReadDialNetwork = "starrocks-fe-read"
+)
+
+// fePool is the set of StarRocks FE nodes from STARROCKS_HOST. Connections are spread
+// round-robin over the FEs and fail over to the next one when an FE cannot be reached.
+type fePool struct {
+	addrs []string // host:port (MySQL protocol)
+	next  atomic.Uint32
+}
+
+// parseFEHosts parses a comma-separated list of FE hosts, each optionally with its own
+// MySQL port ("fe1,fe2:9031"); defaultPort applies to entries without one.
+func parseFEHosts(hosts, defaultPort string) *fePool {
+	p := &fePool{}
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, defaultPort)
+		}
+		p.addrs = append(p.addrs, h)
+	}
+	return p
+}
+
+// order returns the FEs starting at the next round-robin position.
+func (p *fePool) order() []string {
+	if p == nil || len(p.addrs) == 0 {
+		return nil
+	}
+	n := len(p.addrs)
+	start := int(p.next.Add(1)-1) % n
+	out := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, p.addrs[(start+i)%n])
+	}
+	return out
+}
+
+func (p *fePool) String() string {
+	return strings.Join(p.addrs, ",")
+}
+
+// dial connects to the first reachable FE in round-robin order.
+func (p *fePool) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	var errs []error
+	for _, addr := range p.order() {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		slog.WarnContext(ctx, "StarRocks FE unreachable, trying next", "fe", addr, "error", err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no StarRocks FE configured")
+	}
+	return nil, fmt.Errorf("all StarRocks FEs unreachable: %w", errors.Join(errs...))
+}
+
+// register makes the pool the dialer for network. The driver keeps one dialer per
+// network name, so the most recently created service wins.
+func (p *fePool) register(network string) {
+	mysql.RegisterDialContext(network, func(ctx context.Context, _ string) (net.Conn, error) {
+		return p.dial(ctx)
+	})
+}
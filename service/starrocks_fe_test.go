@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestParseFEHosts(t *testing.T) {
+	p := parseFEHosts(" fe1, fe2:9031 ,,fe3", "9030")
+	want := []string{"fe1:9030", "fe2:9031", "fe3:9030"}
+	if !reflect.DeepEqual(p.addrs, want) {
+		t.Fatalf("addrs = %v, want %v", p.addrs, want)
+	}
+	if got := p.order(); !reflect.DeepEqual(got, want) {
+		t.Errorf("first order() = %v, want %v", got, want)
+	}
+	if got := p.order(); !reflect.DeepEqual(got, []string{"fe2:9031", "fe3:9030", "fe1:9030"}) {
+		t.Errorf("second order() = %v, want rotation starting at fe2", got)
+	}
+}
+
+func TestFEPoolDialFailsOver(t *testing.T) {
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+
+	p := parseFEHosts(downAddr+","+up.Addr().String(), "9030")
+	conn, err := p.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial() error = %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != up.Addr().String() {
+		t.Errorf("connected to %s, want %s", conn.RemoteAddr(), up.Addr())
+	}
+}
+
+// The warehouse is a DSN session variable, so every pooled connection runs on it.
+func TestWithStarRocksWarehouse(t *testing.T) {
+	cfg, err := mysql.ParseDSN(withStarRocksWarehouse(starRocksDSN("u", "p", feDialNetwork, "db"), "load_wh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Params["warehouse"]; got != "'load_wh'" {
+		t.Errorf("warehouse param = %q, want 'load_wh'", got)
+	}
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Column name policies: how result column names become StarRocks column names.
+const (
+	// ColumnNamesQuote keeps every name as is; statements backquote (and escape) it, so
+	// reserved words and unusual characters are accepted as far as StarRocks allows.
+	ColumnNamesQuote = "quote"
+	// ColumnNamesSanitize renames columns to plain identifiers: characters other than
+	// letters, digits and '_' become '_', a leading digit gets a '_' prefix, reserved
+	// words get a '_' suffix and names that then collide get a _2, _3... suffix.
+	ColumnNamesSanitize = "sanitize"
+	// ColumnNamesStrict rejects the export if a name is not a plain identifier or is a
+	// reserved word.
+	ColumnNamesStrict = "strict"
+)
+
+// Column case policies: the letter case of destination column names. StarRocks compares
+// column names ignoring case, and existing columns are always matched that way; the
+// policy only decides how new columns are spelled.
+const (
+	// ColumnCasePreserve keeps the case of the result names.
+	ColumnCasePreserve = "preserve"
+	// ColumnCaseLower lowercases destination names.
+	ColumnCaseLower = "lower"
+	// ColumnCaseUpper uppercases destination names.
+	ColumnCaseUpper = "upper"
+)
+
+// srReservedWords are the StarRocks keywords that cannot be used as unquoted column names.
+var srReservedWords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`
+		ADD ALL ALTER ANALYZE AND ARRAY AS ASC BETWEEN BIGINT BITMAP BOTH BY CASE CHAR
+		CHARACTER CHECK COLLATE COLUMN COMPACTION CONVERT CREATE CROSS CUBE CURRENT_DATE
+		CURRENT_ROLE CURRENT_TIME CURRENT_TIMESTAMP CURRENT_USER DATABASE DATABASES DECIMAL
+		DECIMALV2 DECIMAL32 DECIMAL64 DECIMAL128 DEFAULT DELETE DENSE_RANK DESC DESCRIBE
+		DISTINCT DOUBLE DROP DUAL ELSE EXCEPT EXISTS EXPLAIN FALSE FIRST_VALUE FLOAT FOR
+		FORCE FROM FULL FUNCTION GRANT GROUP GROUPING GROUPING_ID GROUPS HAVING HLL HOST IF
+		IGNORE IMMEDIATE IN INDEX INFILE INNER INSERT INT INTEGER INTERSECT INTO IS JOIN
+		JSON KEY KEYS KILL LAG LARGEINT LAST_VALUE LATERAL LEAD LEFT LIKE LIMIT LOAD
+		LOCALTIME LOCALTIMESTAMP MAXVALUE MINUS MOD NTILE NOT NULL ON OR ORDER OUTER OUTFILE
+		OVER PARTITION PERCENTILE PRIMARY PROCEDURE QUALIFY RANGE RANK READ REGEXP RELEASE
+		RENAME REPLACE REVOKE RIGHT RLIKE ROW ROWS ROW_NUMBER SCHEMA SCHEMAS SELECT SET
+		SET_VAR SHOW SMALLINT SYSTEM TABLE TERMINATED TEXT THEN TINYINT TO TRUE UNION UNIQUE
+		UNSIGNED UPDATE USE USING VALUES VARCHAR WHEN WHERE WITH`) {
+		srReservedWords[w] = true
+	}
+}
+
+// quoteSRIdent backquotes a StarRocks identifier, doubling embedded backquotes.
+func quoteSRIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// plainSRIdent reports whether name needs neither quoting nor renaming.
+func plainSRIdent(name string) bool {
+	if name == "" || srReservedWords[strings.ToUpper(name)] || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if !identRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func identRune(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// destinationSchema applies the column name policy and then the column case policy to
+// the result schema. It returns the schema with destination names (a copy when anything
+// is renamed) and the renamed columns as result name -> destination name.
+func destinationSchema(schema bigquery.Schema, policy, columnCase string) (bigquery.Schema, map[string]string, error) {
+	names := make([]string, len(schema))
+	for i, f := range schema {
+		names[i] = f.Name
+	}
+	switch policy {
+	case "", ColumnNamesQuote:
+	case ColumnNamesStrict:
+		var bad []string
+		for _, f := range schema {
+			if !plainSRIdent(f.Name) {
+				bad = append(bad, strconv.Quote(f.Name))
+			}
+		}
+		if len(bad) > 0 {
+			return nil, nil, fmt.Errorf("column name(s) %s are reserved words or not plain identifiers (column_names is strict)", strings.Join(bad, ", "))
+		}
+	case ColumnNamesSanitize:
+		sanitizeNames(names)
+	default:
+		return nil, nil, fmt.Errorf("unknown column_names %q; expected quote, sanitize or strict", policy)
+	}
+
+	switch columnCase {
+	case "", ColumnCasePreserve:
+	case ColumnCaseLower:
+		for i := range names {
+			names[i] = strings.ToLower(names[i])
+		}
+	case ColumnCaseUpper:
+		for i := range names {
+			names[i] = strings.ToUpper(names[i])
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown column_case %q; expected preserve, lower or upper", columnCase)
+	}
+
+	var mapping map[string]string
+	for i, f := range schema {
+		if names[i] != f.Name {
+			if mapping == nil {
+				mapping = map[string]string{}
+			}
+			mapping[f.Name] = names[i]
+		}
+	}
+	if mapping == nil {
+		return schema, nil, nil
+	}
+	out := make(bigquery.Schema, len(schema))
+	for i, f := range schema {
+		c := *f
+		c.Name = names[i]
+		out[i] = &c
+	}
+	return out, mapping, nil
+}
+
+// sanitizeNames renames the names that are not plain identifiers in place (see
+// ColumnNamesSanitize).
+func sanitizeNames(names []string) {
+	// StarRocks column names are case-insensitive, so collisions are too
+	taken := make(map[string]bool, len(names))
+	plain := make([]bool, len(names))
+	for i, n := range names {
+		if plain[i] = plainSRIdent(n); plain[i] {
+			taken[strings.ToLower(n)] = true
+		}
+	}
+	for i, n := range names {
+		if plain[i] {
+			continue
+		}
+		base := sanitizeSRIdent(n)
+		name := base
+		for k := 2; taken[strings.ToLower(name)]; k++ {
+			name = base + "_" + strconv.Itoa(k)
+		}
+		names[i] = name
+		taken[strings.ToLower(name)] = true
+	}
+}
+
+// sanitizeSRIdent turns name into a plain identifier (see ColumnNamesSanitize).
+func sanitizeSRIdent(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if identRune(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	s := b.String()
+	switch {
+	case s == "":
+		return "col"
+	case s[0] >= '0' && s[0] <= '9':
+		s = "_" + s
+	case srReservedWords[strings.ToUpper(s)]:
+		s += "_"
+	}
+	return s
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// LoadMethodInsert loads rows with batched INSERT statements in one SQL transaction.
+	LoadMethodInsert = "insert"
+	// LoadMethodStream loads rows through Stream Load using the StarRocks transaction
+	// interface: every chunk is sent within one load transaction that is only committed
+	// once all chunks have been accepted.
+	LoadMethodStream = "stream"
+
+	// streamLoadTxnTimeout is the load transaction timeout in seconds; StarRocks aborts
+	// transactions that are neither committed nor rolled back in time.
+	streamLoadTxnTimeout = "3600"
+
+	// streamLoadOpColumn is the StarRocks load column selecting upsert (0) or delete (1)
+	// for a row of a PRIMARY KEY table.
+	streamLoadOpColumn = "__op"
+)
+
+// streamLoadResponse is the JSON body returned by the /api/transaction/* endpoints.
+type streamLoadResponse struct {
+	TxnID            int64  `json:"TxnId"`
+	Label            string `json:"Label"`
+	Status           string `json:"Status"`
+	Message          string `json:"Message"`
+	NumberLoadedRows int64  `json:"NumberLoadedRows"`
+	ErrorURL         string `json:"ErrorURL"`
+}
+
+// streamLoadTxn is one StarRocks Stream Load transaction.
+type streamLoadTxn struct {
+	s     *StarRocksService
+	addr  string // FE HTTP endpoint the transaction was started on
+	label string
+	db    string
+	table string
+	// columns is sent as the columns header of every load
+	columns string
+}
+
+// streamLoadRows sends all rows to table in chunks of at most STARROCKS_STREAM_CHUNK_ROWS
+// rows and STARROCKS_STREAM_CHUNK_BYTES within a single transaction (begin, load per
+// chunk, prepare, commit). Any failure rolls the transaction back, so no partial data
+// becomes visible. Rows marked by del are sent with the __op column set to delete, which
+// StarRocks applies to PRIMARY KEY tables.
+func (s *StarRocksService) streamLoadRows(ctx context.Context, it RowIterator, schema bigquery.Schema, destCols []string, table string, prefetch []bigquery.Value, havePrefetch bool, del *deleteMarker) (int64, int64, error) {
+	db, tbl := s.parseDBTable(table)
+	txn := &streamLoadTxn{s: s, label: streamLoadLabel(ctx), db: db, table: tbl}
+	cols := quoteColumns(destCols)
+	if del != nil {
+		cols = append(cols, streamLoadOpColumn)
+	}
+	txn.columns = strings.Join(cols, ", ")
+
+	if err := txn.begin(ctx); err != nil {
+		return 0, 0, fmt.Errorf("failed to begin stream load transaction: %w", err)
+	}
+	slog.InfoContext(ctx, "StarRocks stream load transaction started", "table", table, "label", txn.label, "fe", txn.addr)
+	committed := false
+	defer func() {
+		if !committed {
+			rbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+			defer cancel()
+			if _, err := txn.call(rbCtx, http.MethodPost, "rollback", nil); err != nil {
+				slog.ErrorContext(ctx, "Failed to roll back StarRocks stream load transaction", "label", txn.label, "error", err)
+			}
+		}
+	}()
+
+	chunkRows, chunkBytes := streamChunkRows(), streamChunkBytes()
+
+	var total, deleted, chunkDeleted int64
+	var chunk []map[string]any
+	size := 0
+	add := func(values []bigquery.Value) {
+		size += approxRowBytes(values)
+		row := streamLoadRow(values, destCols)
+		if del != nil {
+			row[streamLoadOpColumn] = 0
+			if del.deleted(values) {
+				row[streamLoadOpColumn] = 1
+				chunkDeleted++
+			}
+		}
+		chunk = append(chunk, row)
+	}
+	if havePrefetch && len(prefetch) > 0 {
+		add(prefetch)
+	}
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := yieldBetweenChunks(ctx); err != nil {
+			return err
+		}
+		body, err := json.Marshal(chunk)
+		if err != nil {
+			return fmt.Errorf("failed to encode stream load chunk: %w", err)
+		}
+		if _, err := txn.call(ctx, http.MethodPut, "load", body); err != nil {
+			return fmt.Errorf("failed to load chunk: %w", err)
+		}
+		recordBatch(ctx, StatementStreamLoad, len(chunk), func() string { return txn.describe(http.MethodPut, "load") })
+		total += int64(len(chunk)) - chunkDeleted
+		deleted += chunkDeleted
+		slog.DebugContext(ctx, "Sent StarRocks stream load chunk", "table", table, "chunk_rows", len(chunk), "total_rows", total)
+		chunk, chunkDeleted, size = chunk[:0], 0, 0
+		return nil
+	}
+	for {
+		var values []bigquery.Value
+		err := it.Next(&values)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		add(values)
+		if len(chunk) >= chunkRows || size >= chunkBytes {
+			if err := flush(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := txn.call(ctx, http.MethodPost, "prepare", nil); err != nil {
+		return 0, 0, fmt.Errorf("failed to prepare stream load transaction: %w", err)
+	}
+	if _, err := txn.call(ctx, http.MethodPost, "commit", nil); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit stream load transaction: %w", err)
+	}
+	committed = true
+	slog.InfoContext(ctx, "StarRocks stream load committed", "table", table, "label", txn.label, "rows", total, "deleted_rows", deleted)
+	return total, deleted, nil
+}
+
+// begin starts the transaction on the first reachable FE; the remaining calls of the
+// transaction go to the same FE.
+func (t *streamLoadTxn) begin(ctx context.Context) error {
+	var errs []error
+	for _, addr := range t.s.httpAddrs() {
+		t.addr = addr
+		_, err := t.call(ctx, http.MethodPost, "begin", nil)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+		var urlErr *url.Error
+		if !errors.As(err, &urlErr) || ctx.Err() != nil {
+			// The FE answered (or we were cancelled): another FE would not do better
+			break
+		}
+		slog.WarnContext(ctx, "StarRocks FE unreachable for stream load, trying next", "fe", addr, "error", err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no StarRocks FE configured")
+	}
+	return errors.Join(errs...)
+}
+
+// describe renders a transaction call with its headers for debug responses.
+func (t *streamLoadTxn) describe(method, op string) string {
+	d := fmt.Sprintf("%s /api/transaction/%s label=%s db=%s table=%s", method, op, t.label, t.db, t.table)
+	if op == "load" {
+		d += " format=json strip_outer_array=true"
+		if t.columns != "" {
+			d += " columns=" + t.columns
+		}
+	}
+	return d
+}
+
+// call invokes /api/transaction/<op> on the FE. Loads are redirected to a BE; the
+// credentials are re-applied there because net/http drops them on cross-host redirects.
+func (t *streamLoadTxn) call(ctx context.Context, method, op string, body []byte) (streamLoadResponse, error) {
+	var res streamLoadResponse
+	if op != "load" {
+		recordStatement(ctx, StatementStreamLoad, t.describe(method, op))
+	}
+	endpoint := fmt.Sprintf("http://%s/api/transaction/%s", t.addr, op)
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return res, err
+	}
+	req.SetBasicAuth(t.s.user, t.s.password)
+	req.Header.Set("label", t.label)
+	req.Header.Set("db", t.db)
+	req.Header.Set("table", t.table)
+	switch op {
+	case "begin":
+		req.Header.Set("timeout", streamLoadTxnTimeout)
+	case "load":
+		req.Header.Set("Expect", "100-continue")
+		req.Header.Set("format", "json")
+		req.Header.Set("strip_outer_array", "true")
+		if t.columns != "" {
+			req.Header.Set("columns", t.columns)
+		}
+	}
+
+	client := t.s.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	withAuth := *client
+	withAuth.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after %d redirects", len(via))
+		}
+		r.SetBasicAuth(t.s.user, t.s.password)
+		return nil
+	}
+	resp, err := withAuth.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return res, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("StarRocks %s returned HTTP %d: %s", op, resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return res, fmt.Errorf("invalid StarRocks %s response: %w", op, err)
+	}
+	if !strings.EqualFold(res.Status, "OK") {
+		msg := res.Message
+		if res.ErrorURL != "" {
+			// StarRocks rejected rows; the error log lists them
+			return res, DataError(fmt.Errorf("StarRocks %s status %s: %s (details: %s)", op, res.Status, msg, res.ErrorURL))
+		}
+		return res, fmt.Errorf("StarRocks %s status %s: %s", op, res.Status, msg)
+	}
+	return res, nil
+}
+
+// httpAddrs returns the FE HTTP endpoints used for Stream Load, in round-robin order.
+func (s *StarRocksService) httpAddrs() []string {
+	port := s.httpPort
+	if port == "" {
+		port = "8030"
+	}
+	var out []string
+	for _, addr := range s.fes.order() {
+		host, _, _ := net.SplitHostPort(addr)
+		out = append(out, net.JoinHostPort(host, port))
+	}
+	return out
+}
+
+// streamChunkRows is STARROCKS_STREAM_CHUNK_ROWS (default 50000).
+func streamChunkRows() int {
+	if n, err := strconv.Atoi(os.Getenv("STARROCKS_STREAM_CHUNK_ROWS")); err == nil && n > 0 {
+		return n
+	}
+	return 50000
+}
+
+// streamChunkBytes is STARROCKS_STREAM_CHUNK_BYTES (default 64 MiB): a chunk is sent once
+// its rows reach this estimated size, however few rows it has.
+func streamChunkBytes() int {
+	if n, err := strconv.Atoi(os.Getenv("STARROCKS_STREAM_CHUNK_BYTES")); err == nil && n > 0 {
+		return n
+	}
+	return 64 << 20
+}
+
+// streamLoadLabel builds a unique transaction label, tied to the request ID so a load can
+// be traced back to the run that issued it.
+func streamLoadLabel(ctx context.Context) string {
+	label := "bq_exporter"
+	if id := logging.RequestID(ctx); id != "" {
+		label += "_" + id
+	}
+	return fmt.Sprintf("%s_%d", label, time.Now().UnixNano())
+}
+
+// streamLoadRow converts a BigQuery row into a JSON object keyed by destination column
+// name, with values formatted the way StarRocks parses them from JSON.
+func streamLoadRow(values []bigquery.Value, cols []string) map[string]any {
+	row := make(map[string]any, len(cols))
+	for i, c := range cols {
+		if i >= len(values) {
+			break
+		}
+		row[c] = streamLoadValue(values[i])
+	}
+	return row
+}
+
+func streamLoadValue(v bigquery.Value) any {
+	switch x := v.(type) {
+	case time.Time:
+		// Same zone as the INSERT path, whose connection uses loc=Local
+		return x.In(time.Local).Format("2006-01-02 15:04:05.999999")
+	case civil.DateTime:
+		return x.Date.String() + " " + x.Time.String()
+	case civil.Date:
+		return x.String()
+	case civil.Time:
+		return x.String()
+	case *big.Rat:
+		if x == nil {
+			return nil
+		}
+		return x.FloatString(9)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// fakeFE records the transaction operations it receives; loadStatus overrides the
+// status returned for /load.
+type fakeFE struct {
+	mu         sync.Mutex
+	ops        []string
+	loaded     int
+	deletes    int
+	columns    string
+	loadStatus string
+}
+
+func (f *fakeFE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.URL.Path, "/api/transaction/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops = append(f.ops, op)
+	if user, _, ok := r.BasicAuth(); !ok || user != "root" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	status := "OK"
+	if op == "load" {
+		var rows []map[string]any
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &rows)
+		f.loaded += len(rows)
+		f.columns = r.Header.Get("columns")
+		for _, row := range rows {
+			if row[streamLoadOpColumn] == float64(1) {
+				f.deletes++
+			}
+		}
+		if f.loadStatus != "" {
+			status = f.loadStatus
+		}
+	}
+	_ = json.NewEncoder(w).Encode(streamLoadResponse{Status: status, Label: r.Header.Get("label")})
+}
+
+func newStreamTestService(t *testing.T, fe *fakeFE) *StarRocksService {
+	srv := httptest.NewServer(fe)
+	t.Cleanup(srv.Close)
+	host, port, _ := strings.Cut(strings.TrimPrefix(srv.URL, "http://"), ":")
+	return &StarRocksService{fes: parseFEHosts(host, "9030"), httpPort: port, user: "root", dbname: "db", httpClient: srv.Client()}
+}
+
+func TestStreamLoadRowsCommitsAllChunks(t *testing.T) {
+	t.Setenv("STARROCKS_STREAM_CHUNK_ROWS", "2")
+	fe := &fakeFE{}
+	s := newStreamTestService(t, fe)
+	schema := bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}}
+	it := &fakeRowIterator{schema: schema, rows: [][]bigquery.Value{{int64(2)}, {int64(3)}, {int64(4)}}}
+
+	n, _, err := s.streamLoadRows(context.Background(), it, schema, []string{"id"}, "db.t", []bigquery.Value{int64(1)}, true, nil)
+	if err != nil {
+		t.Fatalf("streamLoadRows() error = %v", err)
+	}
+	if n != 4 || fe.loaded != 4 {
+		t.Errorf("rows = %d, loaded = %d, want 4", n, fe.loaded)
+	}
+	want := "begin,load,load,prepare,commit"
+	if got := strings.Join(fe.ops, ","); got != want {
+		t.Errorf("ops = %s, want %s", got, want)
+	}
+}
+
+func TestStreamLoadRowsRollsBackOnFailure(t *testing.T) {
+	fe := &fakeFE{loadStatus: "FAILED"}
+	s := newStreamTestService(t, fe)
+	schema := bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}}
+	it := &fakeRowIterator{schema: schema, rows: [][]bigquery.Value{{int64(1)}}}
+
+	if _, _, err := s.streamLoadRows(context.Background(), it, schema, []string{"id"}, "db.t", nil, false, nil); err == nil {
+		t.Fatal("streamLoadRows() error = nil, want load failure")
+	}
+	want := "begin,load,rollback"
+	if got := strings.Join(fe.ops, ","); got != want {
+		t.Errorf("ops = %s, want %s", got, want)
+	}
+}
+
+func TestStreamLoadRowsMarksDeletes(t *testing.T) {
+	fe := &fakeFE{}
+	s := newStreamTestService(t, fe)
+	schema := bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}, {Name: "_op", Type: bigquery.StringFieldType}}
+	it := &fakeRowIterator{schema: schema, rows: [][]bigquery.Value{{int64(1), "I"}, {int64(2), "D"}, {int64(3), nil}}}
+	del, err := newDeleteMarker(schema, "_op", nil, []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, deleted, err := s.streamLoadRows(context.Background(), it, schema, []string{"id", "_op"}, "db.t", nil, false, del)
+	if err != nil {
+		t.Fatalf("streamLoadRows() error = %v", err)
+	}
+	if n != 2 || deleted != 1 || fe.deletes != 1 {
+		t.Errorf("rows = %d, deleted = %d, sent deletes = %d, want 2, 1, 1", n, deleted, fe.deletes)
+	}
+	if want := "`id`, `_op`, __op"; fe.columns != want {
+		t.Errorf("columns header = %q, want %q", fe.columns, want)
+	}
+}
+
+func TestStreamLoadRowsCapsChunkBytes(t *testing.T) {
+	t.Setenv("STARROCKS_STREAM_CHUNK_BYTES", "10")
+	fe := &fakeFE{}
+	s := newStreamTestService(t, fe)
+	schema := bigquery.Schema{{Name: "name", Type: bigquery.StringFieldType}}
+	it := &fakeRowIterator{schema: schema, rows: [][]bigquery.Value{{"abcdef"}, {"ghijkl"}, {"mn"}}}
+
+	n, _, err := s.streamLoadRows(context.Background(), it, schema, []string{"name"}, "db.t", nil, false, nil)
+	if err != nil {
+		t.Fatalf("streamLoadRows() error = %v", err)
+	}
+	if n != 3 || fe.loaded != 3 {
+		t.Errorf("rows = %d, loaded = %d, want 3", n, fe.loaded)
+	}
+	// 12 bytes after the second row fill the first chunk; the third row goes in a second
+	want := "begin,load,load,prepare,commit"
+	if got := strings.Join(fe.ops, ","); got != want {
+		t.Errorf("ops = %s, want %s", got, want)
+	}
+}
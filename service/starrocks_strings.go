@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// String type policies: the StarRocks type of STRING (and BYTES) columns the exporter
+// creates.
+const (
+	// StringTypeVarchar creates VARCHAR(1024) (VARBINARY(1024) for bytes).
+	StringTypeVarchar = "varchar"
+	// StringTypeString creates STRING, StarRocks' VARCHAR(65533).
+	StringTypeString = "string"
+	// StringTypeAuto sizes new columns from the longest value in the result, which runs
+	// one more query over it.
+	StringTypeAuto = "auto"
+)
+
+const (
+	defaultVarcharLength = 1024
+	// srStringLength is the length of the StarRocks STRING type
+	srStringLength = 65533
+	// srMaxVarcharLength is the longest VARCHAR StarRocks accepts (3.1+)
+	srMaxVarcharLength = 1048576
+	// minAutoVarcharLength is the shortest length StringTypeAuto creates
+	minAutoVarcharLength = 32
+)
+
+// srVarchar renders a string column of maxLength bytes; 0 is the default length.
+func srVarchar(maxLength int64) string {
+	switch {
+	case maxLength <= 0:
+		return fmt.Sprintf("VARCHAR(%d)", defaultVarcharLength)
+	case maxLength == srStringLength:
+		return "STRING"
+	}
+	return fmt.Sprintf("VARCHAR(%d)", min(maxLength, srMaxVarcharLength))
+}
+
+// stringTypeSchema applies a string type policy to the (destination) schema: string
+// columns carry their StarRocks length in MaxLength. StringTypeAuto lengths are set by
+// sizeNewStringColumns.
+func stringTypeSchema(schema bigquery.Schema, stringType string) (bigquery.Schema, error) {
+	switch stringType {
+	case "", StringTypeVarchar, StringTypeAuto:
+		return schema, nil
+	case StringTypeString:
+	default:
+		return nil, fmt.Errorf("unknown string_type %q; expected varchar, string or auto", stringType)
+	}
+	out := make(bigquery.Schema, len(schema))
+	for i, f := range schema {
+		c := *f
+		if c.Type == bigquery.StringFieldType && c.MaxLength == 0 {
+			c.MaxLength = srStringLength
+		}
+		out[i] = &c
+	}
+	return out, nil
+}
+
+// autoVarcharLength leaves headroom over the longest value seen: twice its length,
+// rounded up to a power of two. Columns without values get the default length.
+func autoVarcharLength(longest int64) int64 {
+	if longest <= 0 {
+		return defaultVarcharLength
+	}
+	n := int64(minAutoVarcharLength)
+	for n < 2*longest && n < srMaxVarcharLength {
+		n *= 2
+	}
+	return min(n, srMaxVarcharLength)
+}
+
+// sizeNewStringColumns sets the length of the string and bytes columns the load would
+// create (all of them for a new table, the missing ones otherwise) from the longest
+// value in the result. src is the result schema, with the names the query returns;
+// schema has the destination names.
+func (s *StarRocksService) sizeNewStringColumns(ctx context.Context, bq BigQueryClient, opts LoadOptions, src, schema bigquery.Schema) (bigquery.Schema, error) {
+	db, tbl := s.parseDBTable(opts.Table)
+	existing := map[string]bool{}
+	exists, err := s.tableExists(ctx, db, tbl)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		cur, err := s.getExistingColumns(ctx, db, tbl)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cur {
+			existing[strings.ToLower(c.Name)] = true
+		}
+	}
+	var idx []int
+	var exprs []string
+	for i, f := range schema {
+		if (f.Type == bigquery.StringFieldType || f.Type == bigquery.BytesFieldType) && !f.Repeated && f.MaxLength == 0 && !existing[strings.ToLower(f.Name)] {
+			idx = append(idx, i)
+			exprs = append(exprs, "MAX(BYTE_LENGTH("+quoteBigQueryColumn(src[i].Name)+"))")
+		}
+	}
+	if len(idx) == 0 {
+		return schema, nil
+	}
+
+	slog.InfoContext(ctx, "Measuring string columns to size them", "table", opts.Table, "columns", len(idx))
+	it, err := bq.ReadRows(ctx, fmt.Sprintf("SELECT %s FROM (%s)", strings.Join(exprs, ", "), opts.Query), opts.Location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure string columns: %w", err)
+	}
+	defer it.Close()
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil && err != iterator.Done {
+		return nil, fmt.Errorf("failed to measure string columns: %w", err)
+	}
+
+	out := append(bigquery.Schema(nil), schema...)
+	for k, i := range idx {
+		var longest int64
+		if k < len(row) {
+			longest, _ = row[k].(int64)
+		}
+		c := *out[i]
+		c.MaxLength = autoVarcharLength(longest)
+		out[i] = &c
+	}
+	return out, nil
+}
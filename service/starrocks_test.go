@@ -0,0 +1,491 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestBuildBatchInsert(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "seen_at", Type: bigquery.TimestampFieldType},
+	}
+	now := time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)
+	batch := [][]bigquery.Value{
+		{int64(1), now},
+		{int64(2), nil},
+	}
+	stmt, args := buildBatchInsert("db.t", []string{"`id`", "`seen_at`"}, schema, batch)
+	want := "INSERT INTO db.t (`id`, `seen_at`) VALUES (?, ?), (?, ?)"
+	if stmt != want {
+		t.Errorf("stmt = %q, want %q", stmt, want)
+	}
+	if len(args) != 4 || args[0] != int64(1) || args[1] != now || args[3] != nil {
+		t.Errorf("args = %v", args)
+	}
+}
+
+func TestApproxRowBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []bigquery.Value
+		want   int
+	}{
+		{"strings and bytes", []bigquery.Value{"abc", []byte("de")}, 5},
+		{"fixed width", []bigquery.Value{int64(1), 2.5, nil}, 48},
+		{"repeated", []bigquery.Value{[]bigquery.Value{"ab", "cd"}, true}, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := approxRowBytes(tt.values); got != tt.want {
+				t.Errorf("approxRowBytes() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteMarkerSegments(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "region", Type: bigquery.StringFieldType},
+		{Name: "_CHANGE_TYPE", Type: bigquery.StringFieldType},
+	}
+	if _, err := newDeleteMarker(schema, "_CHANGE_TYPE", nil, nil); err == nil {
+		t.Error("newDeleteMarker() without key columns error = nil")
+	}
+	if _, err := newDeleteMarker(schema, "deleted", nil, []string{"id"}); err == nil {
+		t.Error("newDeleteMarker() with unknown column error = nil")
+	}
+	m, err := newDeleteMarker(schema, "_CHANGE_TYPE", nil, []string{"id", "region"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := [][]bigquery.Value{
+		{int64(1), "a", "INSERT"},
+		{int64(2), "a", "DELETE"},
+		{int64(3), "b", "delete"},
+		{int64(2), "a", "UPDATE"},
+	}
+	segs := m.segments(batch)
+	if len(segs) != 3 || segs[0].deleted || !segs[1].deleted || len(segs[1].rows) != 2 || segs[2].deleted {
+		t.Fatalf("segments() = %+v, want insert, 2 deletes, insert", segs)
+	}
+
+	stmt, args := buildBatchDelete("db.t", []string{"`id`", "`region`", "`_CHANGE_TYPE`"}, schema, m, segs[1].rows)
+	want := "DELETE FROM db.t WHERE (`id` = ? AND `region` = ?) OR (`id` = ? AND `region` = ?)"
+	if stmt != want {
+		t.Errorf("stmt = %q, want %q", stmt, want)
+	}
+	if len(args) != 4 || args[0] != int64(2) || args[3] != "b" {
+		t.Errorf("args = %v", args)
+	}
+}
+
+func TestMatchColumns(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "Ward", Type: bigquery.StringFieldType},
+		{Name: "seen_at", Type: bigquery.TimestampFieldType},
+	}
+	// Destination order differs and a column was added later; names decide, not positions
+	cur := []srColumn{{Name: "seen_at"}, {Name: "id"}, {Name: "ward"}, {Name: "loaded_by"}}
+	got, err := matchColumns("db.t", schema, cur)
+	if err != nil {
+		t.Fatalf("matchColumns() error = %v", err)
+	}
+	var names []string
+	for _, c := range got {
+		names = append(names, c.Name)
+	}
+	if want := []string{"id", "ward", "seen_at"}; strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("matchColumns() = %v, want %v", names, want)
+	}
+
+	if _, err := matchColumns("db.t", schema, cur[:2]); err == nil || !strings.Contains(err.Error(), "Ward") {
+		t.Errorf("matchColumns() with missing column error = %v", err)
+	}
+}
+
+func TestDestinationSchema(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "order", Type: bigquery.StringFieldType},
+		{Name: "first name", Type: bigquery.StringFieldType},
+		{Name: "first_name", Type: bigquery.StringFieldType},
+		{Name: "2024_total", Type: bigquery.FloatFieldType},
+	}
+
+	got, mapping, err := destinationSchema(schema, ColumnNamesSanitize, "")
+	if err != nil {
+		t.Fatalf("destinationSchema(sanitize) error = %v", err)
+	}
+	var names []string
+	for _, f := range got {
+		names = append(names, f.Name)
+	}
+	if want := "id,order_,first_name_2,first_name,_2024_total"; strings.Join(names, ",") != want {
+		t.Errorf("sanitized names = %v, want %s", names, want)
+	}
+	if len(mapping) != 3 || mapping["first name"] != "first_name_2" || mapping["id"] != "" {
+		t.Errorf("mapping = %v", mapping)
+	}
+	if schema[1].Name != "order" {
+		t.Errorf("destinationSchema modified the result schema: %q", schema[1].Name)
+	}
+
+	if got, mapping, err := destinationSchema(schema, "", ""); err != nil || mapping != nil || got[2].Name != "first name" {
+		t.Errorf("destinationSchema(quote) = %v, %v, %v", got, mapping, err)
+	}
+	if _, _, err := destinationSchema(schema, ColumnNamesStrict, ""); err == nil || !strings.Contains(err.Error(), `"order", "first name", "2024_total"`) {
+		t.Errorf("destinationSchema(strict) error = %v", err)
+	}
+	if _, _, err := destinationSchema(schema, "lower", ""); err == nil {
+		t.Error("destinationSchema(lower) succeeded, want an unknown policy error")
+	}
+}
+
+func TestDestinationSchemaColumnCase(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "PatientID", Type: bigquery.StringFieldType},
+		{Name: "Admit Date", Type: bigquery.DateFieldType},
+	}
+	got, mapping, err := destinationSchema(schema, ColumnNamesSanitize, ColumnCaseLower)
+	if err != nil {
+		t.Fatalf("destinationSchema() error = %v", err)
+	}
+	if got[1].Name != "patientid" || got[2].Name != "admit_date" {
+		t.Errorf("destination names = %q, %q", got[1].Name, got[2].Name)
+	}
+	if len(mapping) != 2 || mapping["PatientID"] != "patientid" || mapping["Admit Date"] != "admit_date" {
+		t.Errorf("mapping = %v", mapping)
+	}
+
+	got, _, err = destinationSchema(schema, "", ColumnCaseUpper)
+	if err != nil || got[0].Name != "ID" || got[2].Name != "ADMIT DATE" {
+		t.Errorf("destinationSchema(upper) = %v, %v", got, err)
+	}
+	if _, _, err := destinationSchema(schema, "", "title"); err == nil {
+		t.Error("destinationSchema(title) succeeded, want an unknown policy error")
+	}
+}
+
+func TestBuildCreateTableDDLQuotesNames(t *testing.T) {
+	ddl, err := buildCreateTableDDL("db.t", bigquery.Schema{
+		{Name: "select", Type: bigquery.IntegerFieldType},
+		{Name: "odd`name", Type: bigquery.StringFieldType},
+	}, nil, false, 1)
+	if err != nil {
+		t.Fatalf("buildCreateTableDDL() error = %v", err)
+	}
+	for _, want := range []string{"`select` BIGINT", "`odd``name` VARCHAR(1024)", "DUPLICATE KEY (`select`)"} {
+		if !strings.Contains(ddl, want) {
+			t.Errorf("DDL %s does not contain %s", ddl, want)
+		}
+	}
+}
+
+func TestBuildCreateTableDDLKeyColumns(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "site", Type: bigquery.StringFieldType},
+		{Name: "visit_id", Type: bigquery.IntegerFieldType},
+		{Name: "score", Type: bigquery.FloatFieldType},
+	}
+	keys, err := keyColumnIndexes(schema, []string{"visit_id", "site"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ddl, err := buildCreateTableDDL("db.t", schema, keys, true, 1)
+	if err != nil {
+		t.Fatalf("buildCreateTableDDL() error = %v", err)
+	}
+	// Key columns come first, in key order
+	for _, want := range []string{"`visit_id` BIGINT NOT NULL, `site` VARCHAR(1024) NOT NULL, `score` DOUBLE", "PRIMARY KEY (`visit_id`, `site`)", "HASH(`visit_id`, `site`)"} {
+		if !strings.Contains(ddl, want) {
+			t.Errorf("DDL %s does not contain %s", ddl, want)
+		}
+	}
+	if _, err := buildCreateTableDDL("db.t", schema, []int{2}, false, 1); err == nil {
+		t.Error("buildCreateTableDDL() keyed by a DOUBLE error = nil, want an error")
+	}
+	for _, names := range [][]string{{"missing"}, {"site", "site"}} {
+		if _, err := keyColumnIndexes(schema, names); err == nil {
+			t.Errorf("keyColumnIndexes(%v) error = nil, want an error", names)
+		}
+	}
+}
+
+func TestWidthCheck(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "note", Type: bigquery.StringFieldType},
+	}
+	dest := []srColumn{{Name: "id", Type: "bigint"}, {Name: "note", Type: "varchar", MaxLength: 8}}
+	w := newWidthCheck("db.t", schema, dest, []int{0})
+	it := w.wrap(&fakeRowIterator{schema: schema, rows: [][]bigquery.Value{
+		{int64(1), "short"},
+		{int64(2), nil},
+		{int64(3), "much too long"},
+	}})
+	var row []bigquery.Value
+	for range 2 {
+		if err := it.Next(&row); err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+	}
+	err := it.Next(&row)
+	if err == nil || !strings.Contains(err.Error(), `column "note"`) || !strings.Contains(err.Error(), "row 3, id=3") {
+		t.Errorf("Next() over-long value error = %v", err)
+	}
+
+	if w := newWidthCheck("db.t", schema, []srColumn{{Name: "id"}, {Name: "note", Type: "json"}}, nil); w != nil {
+		t.Errorf("newWidthCheck() without lengths = %+v, want nil", w)
+	}
+}
+
+func TestMapSRType(t *testing.T) {
+	tests := map[bigquery.FieldType]string{
+		bigquery.StringFieldType:    "VARCHAR(1024)",
+		bigquery.IntegerFieldType:   "BIGINT",
+		bigquery.TimestampFieldType: "DATETIME",
+		bigquery.NumericFieldType:   "DECIMAL(38,9)",
+		bigquery.JSONFieldType:      "JSON",
+	}
+	for ft, want := range tests {
+		if got := mapSRType(&bigquery.FieldSchema{Type: ft}); got != want {
+			t.Errorf("mapSRType(%s) = %q, want %q", ft, got, want)
+		}
+	}
+}
+
+func TestStringTypes(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "note", Type: bigquery.StringFieldType},
+	}
+	got, err := stringTypeSchema(schema, StringTypeString)
+	if err != nil {
+		t.Fatalf("stringTypeSchema() error = %v", err)
+	}
+	if mapSRType(got[1]) != "STRING" || mapSRType(got[0]) != "BIGINT" || mapSRType(schema[1]) != "VARCHAR(1024)" {
+		t.Errorf("string_type string maps note to %s (result schema: %s)", mapSRType(got[1]), mapSRType(schema[1]))
+	}
+	if _, err := stringTypeSchema(schema, "text"); err == nil {
+		t.Error("stringTypeSchema(text) succeeded, want an unknown policy error")
+	}
+
+	for longest, want := range map[int64]int64{0: 1024, 3: 32, 40: 128, 64: 128, 65: 256, 2000000: srMaxVarcharLength} {
+		if got := autoVarcharLength(longest); got != want {
+			t.Errorf("autoVarcharLength(%d) = %d, want %d", longest, got, want)
+		}
+	}
+	if got := mapSRType(&bigquery.FieldSchema{Type: bigquery.BytesFieldType, MaxLength: 256}); got != "VARBINARY(256)" {
+		t.Errorf("sized bytes column maps to %s", got)
+	}
+}
+
+func TestStarRocksDriverRequiresDatabase(t *testing.T) {
+	bq := &fakeBigQuery{}
+	d := NewStarRocksDriver(&StarRocksService{}, nil)
+	_, err := d.Execute(context.Background(), bq, ExportParams{Query: "SELECT 1", Table: "events"})
+	if err == nil || !strings.Contains(err.Error(), "database not specified") {
+		t.Fatalf("Execute() error = %v, want database not specified", err)
+	}
+	if len(bq.queries) != 0 {
+		t.Errorf("BigQuery should not be queried when the table cannot be resolved")
+	}
+}
+
+func TestStarRocksDriverLocksTable(t *testing.T) {
+	bq := &fakeBigQuery{}
+	d := NewStarRocksDriver(&StarRocksService{dbname: "analytics"}, nil)
+	ctx := logging.WithRequestID(context.Background(), "first")
+	_, unlock, err := d.locks.acquire(ctx, "analytics.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Execute(context.Background(), bq, ExportParams{Query: "SELECT 1", Table: "events"})
+	if !errors.Is(err, ErrDestinationLocked) || !strings.Contains(err.Error(), "job first") {
+		t.Fatalf("Execute() error = %v, want ErrDestinationLocked by job first", err)
+	}
+	if len(bq.queries) != 0 {
+		t.Errorf("BigQuery should not be queried while the table is locked")
+	}
+	// Other tables are not locked
+	if _, release, err := d.locks.acquire(ctx, "analytics.visits"); err != nil {
+		t.Errorf("acquire(visits) error = %v", err)
+	} else {
+		release()
+	}
+
+	// With a wait, the export takes the table once it is released
+	d.locks.wait, d.locks.poll = time.Minute, time.Millisecond
+	acquired := make(chan error)
+	go func() {
+		_, release, err := d.locks.acquire(context.Background(), "analytics.events")
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	unlock()
+	if err := <-acquired; err != nil {
+		t.Errorf("acquire() after the release error = %v", err)
+	}
+	d.locks.wait = time.Millisecond
+	_, unlock, _ = d.locks.acquire(ctx, "analytics.events")
+	defer unlock()
+	if _, _, err := d.locks.acquire(context.Background(), "analytics.events"); !errors.Is(err, ErrDestinationLocked) {
+		t.Errorf("acquire() past the wait error = %v, want ErrDestinationLocked", err)
+	}
+}
+
+// cancellingIterator serves rows and cancels the request when row cancelAt is read.
+type cancellingIterator struct {
+	fakeRowIterator
+	cancelAt int
+	cancel   context.CancelFunc
+}
+
+func (it *cancellingIterator) Next(dst *[]bigquery.Value) error {
+	if it.pos == it.cancelAt {
+		it.cancel()
+	}
+	return it.fakeRowIterator.Next(dst)
+}
+
+func TestInsertRowsRollsBackOnCancel(t *testing.T) {
+	// SQLite stands in for StarRocks: it takes the same backquoted batch inserts
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "sr.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE events (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STARROCKS_BATCH_SIZE", "2")
+	s := &StarRocksService{db: db}
+	schema := bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}}
+	rows := [][]bigquery.Value{{int64(1)}, {int64(2)}, {int64(3)}, {int64(4)}}
+
+	// The first batch is inserted, then the request goes away before the second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it := &cancellingIterator{fakeRowIterator: fakeRowIterator{schema: schema, rows: rows}, cancelAt: 2, cancel: cancel}
+	if _, _, err := s.insertRows(ctx, it, schema, []string{"id"}, "events", nil, false, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("insertRows() error = %v, want context.Canceled", err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM events").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d rows left after the cancelled load, want the batch rolled back", n)
+	}
+
+	// An uncancelled load commits all batches
+	it = &cancellingIterator{fakeRowIterator: fakeRowIterator{schema: schema, rows: rows}, cancelAt: -1}
+	if got, _, err := s.insertRows(context.Background(), it, schema, []string{"id"}, "events", nil, false, nil); err != nil || got != 4 {
+		t.Fatalf("insertRows() = %d, %v, want 4 rows", got, err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM events").Scan(&n); err != nil || n != 4 {
+		t.Errorf("%d rows loaded, want 4", n)
+	}
+}
+
+func TestStarRocksSwapLoad(t *testing.T) {
+	schema := bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}}
+	rows := [][]bigquery.Value{{int64(1)}, {int64(2)}, {int64(3)}}
+	tests := []struct {
+		name     string
+		fail     string
+		wantErr  string
+		wantRows int
+	}{
+		{"swapped in", "", "", 3},
+		{"load fails", "INSERT INTO", "staging table", 5},
+		{"swap fails", "SWAP WITH", "failed to swap", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, svc := newFakeStarRocks(t, map[string][]string{"analytics.events": {"id"}})
+			sr.tables["analytics.events"].rows = 5
+			sr.fail = tt.fail
+			bq := &fakeBigQuery{schema: schema, rows: rows}
+			res, err := NewStarRocksDriver(svc, nil).Execute(context.Background(), bq, ExportParams{
+				Query: "SELECT id FROM ds.events", Table: "analytics.events", LoadStrategy: LoadStrategySwap,
+			})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Execute() error = %v, want %q", err, tt.wantErr)
+			}
+			if err == nil && res.Rows != 3 {
+				t.Errorf("Rows = %d, want 3", res.Rows)
+			}
+			// Readers see the old or the new contents, never a partial load
+			if got := sr.table("analytics.events").rows; got != tt.wantRows {
+				t.Errorf("analytics.events has %d rows, want %d", got, tt.wantRows)
+			}
+			// The staging table is dropped in every case
+			created := sr.executed("CREATE TABLE ")
+			if len(created) != 1 || !strings.HasPrefix(created[0], "CREATE TABLE analytics.events__staging_") || !strings.HasSuffix(created[0], " LIKE analytics.events") {
+				t.Fatalf("staging tables created = %q", created)
+			}
+			staging := strings.Fields(created[0])[2]
+			if sr.table(staging) != nil {
+				t.Errorf("staging table %s left behind", staging)
+			}
+			if dropped := sr.executed("DROP TABLE IF EXISTS " + staging); len(dropped) != 1 {
+				t.Errorf("staging table dropped %d times, want once", len(dropped))
+			}
+		})
+	}
+}
+
+func TestStarRocksLoadStrategies(t *testing.T) {
+	schema := bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}}
+	sr, svc := newFakeStarRocks(t, map[string][]string{"analytics.events": {"id"}})
+	sr.tables["analytics.events"].rows = 5
+	d := NewStarRocksDriver(svc, nil)
+
+	// The default strategy appends to the destination
+	bq := &fakeBigQuery{schema: schema, rows: [][]bigquery.Value{{int64(1)}}}
+	if _, err := d.Execute(context.Background(), bq, ExportParams{Query: "SELECT 1 AS id", Table: "analytics.events"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := sr.table("analytics.events").rows; got != 6 {
+		t.Errorf("analytics.events has %d rows after an insert load, want 6", got)
+	}
+	if staged := sr.executed("CREATE TABLE "); len(staged) != 0 {
+		t.Errorf("insert load created %q", staged)
+	}
+
+	bq = &fakeBigQuery{schema: schema}
+	if _, err := d.Execute(context.Background(), bq, ExportParams{Query: "SELECT 1 AS id", Table: "analytics.events", LoadStrategy: "merge"}); err == nil || !strings.Contains(err.Error(), "unknown load_strategy") {
+		t.Errorf("Execute() with load_strategy merge error = %v, want unknown load_strategy", err)
+	}
+	if len(bq.queries) != 0 {
+		t.Error("BigQuery should not be queried with an unknown load strategy")
+	}
+
+	schema = append(schema, &bigquery.FieldSchema{Name: "_CHANGE_TYPE", Type: bigquery.StringFieldType})
+	bq = &fakeBigQuery{schema: schema}
+	_, err := d.Execute(context.Background(), bq, ExportParams{
+		Query: "SELECT 1 AS id", Table: "analytics.events", LoadStrategy: LoadStrategySwap,
+		DeleteColumn: "_CHANGE_TYPE", KeyColumns: []string{"id"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "cannot be combined with the swap load strategy") {
+		t.Errorf("Execute() of a swap load with delete_column error = %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// verifyAttempts and verifyDelay bound how long verification waits for a read endpoint
+// lagging behind the load.
+const (
+	verifyAttempts = 5
+	verifyDelay    = 2 * time.Second
+)
+
+// verifyLoad counts the rows of table after a committed load, on the read endpoint when
+// one is configured, and checks the count is consistent with the load: after a swap the
+// table holds at most the loaded rows (fewer when a key model merged duplicates) and
+// some of them if any were loaded; after an insert it holds at least one row if any were
+// loaded. It returns the count.
+func (s *StarRocksService) verifyLoad(ctx context.Context, table string, swapped bool, loaded int64) (int64, error) {
+	q := fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
+	for attempt := 1; ; attempt++ {
+		recordStatement(ctx, StatementStarRocks, q)
+		var n int64
+		if err := s.reader().QueryRowContext(ctx, q).Scan(&n); err != nil {
+			return 0, fmt.Errorf("failed to count the rows of %s: %w", table, err)
+		}
+		ok := n > 0 || loaded == 0
+		if swapped && n > loaded {
+			ok = false
+		}
+		if ok {
+			slog.InfoContext(ctx, "StarRocks load verified", "table", table, "rows_loaded", loaded, "destination_rows", n)
+			return n, nil
+		}
+		if attempt == verifyAttempts {
+			if swapped {
+				return n, DataError(fmt.Errorf("load verification failed: %s has %d rows after swapping in %d", table, n, loaded))
+			}
+			return n, DataError(fmt.Errorf("load verification failed: %s has no rows after loading %d", table, loaded))
+		}
+		slog.WarnContext(ctx, "StarRocks load not visible yet, verifying again", "table", table, "destination_rows", n, "attempt", attempt)
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case <-time.After(verifyDelay):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// widthCheck fails a load on the first string or bytes value longer than its destination
+// column, naming the row and the column, instead of leaving it to StarRocks to truncate
+// the value, drop the row or abort the transaction with a generic error.
+type widthCheck struct {
+	table  string
+	schema bigquery.Schema
+	// limits are the destination lengths in bytes by result column; 0 is unchecked
+	limits []int64
+	keys   []int
+	row    int64
+}
+
+// newWidthCheck returns the check of the destination columns dest (matched to schema by
+// position), or nil if none of them has a length. keys are the columns identifying rows
+// in errors.
+func newWidthCheck(table string, schema bigquery.Schema, dest []srColumn, keys []int) *widthCheck {
+	w := &widthCheck{table: table, schema: schema, limits: make([]int64, len(dest)), keys: keys}
+	checked := false
+	for i, c := range dest {
+		if c.MaxLength > 0 {
+			w.limits[i] = c.MaxLength
+			checked = true
+		}
+	}
+	if !checked {
+		return nil
+	}
+	return w
+}
+
+// check checks the next row of the result; a nil check accepts every row.
+func (w *widthCheck) check(values []bigquery.Value) error {
+	if w == nil {
+		return nil
+	}
+	w.row++
+	for i, limit := range w.limits {
+		if limit == 0 || i >= len(values) {
+			continue
+		}
+		var n int
+		switch v := values[i].(type) {
+		case string:
+			n = len(v)
+		case []byte:
+			n = len(v)
+		default:
+			continue
+		}
+		if int64(n) > limit {
+			return DataError(fmt.Errorf("value of column %q in %s is %d bytes, longer than the column's %d (%s)", w.schema[i].Name, w.table, n, limit, w.describeRow(values)))
+		}
+	}
+	return nil
+}
+
+// describeRow identifies the current row by its position in the result and its keys.
+func (w *widthCheck) describeRow(values []bigquery.Value) string {
+	out := fmt.Sprintf("row %d", w.row)
+	if len(w.keys) == 0 {
+		return out
+	}
+	parts := make([]string, len(w.keys))
+	for j, k := range w.keys {
+		parts[j] = fmt.Sprintf("%s=%v", w.schema[k].Name, values[k])
+	}
+	return out + ", " + strings.Join(parts, ", ")
+}
+
+// wrap returns it with every row checked as it is read.
+func (w *widthCheck) wrap(it RowIterator) RowIterator {
+	if w == nil {
+		return it
+	}
+	return &widthCheckedRows{RowIterator: it, w: w}
+}
+
+type widthCheckedRows struct {
+	RowIterator
+	w *widthCheck
+}
+
+func (r *widthCheckedRows) Next(dst *[]bigquery.Value) error {
+	if err := r.RowIterator.Next(dst); err != nil {
+		return err
+	}
+	return r.w.check(*dst)
+}
+
+// columnIndexes returns the positions of the named result columns, skipping names the
+// result does not have.
+func columnIndexes(schema bigquery.Schema, names []string) []int {
+	var out []int
+	for _, n := range names {
+		for i, f := range schema {
+			if f.Name == n {
+				out = append(out, i)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// keyColumnIndexes returns the indexes of the key columns names in schema, which must all
+// be result columns, each listed once.
+func keyColumnIndexes(schema bigquery.Schema, names []string) ([]int, error) {
+	keys := make([]int, 0, len(names))
+	for i, n := range names {
+		if slices.Index(names, n) != i {
+			return nil, fmt.Errorf("key column %q is listed twice", n)
+		}
+		k := slices.IndexFunc(schema, func(f *bigquery.FieldSchema) bool { return f.Name == n })
+		if k < 0 {
+			return nil, fmt.Errorf("key column %q is not in the query result", n)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
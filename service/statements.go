@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// Statement kinds reported in debug responses.
+const (
+	StatementBigQuery       = "bigquery"
+	StatementStarRocks      = "starrocks"
+	StatementStarRocksBatch = "starrocks_batch"
+	StatementStreamLoad     = "stream_load"
+	StatementSpanner        = "spanner"
+	StatementSQLite         = "sqlite"
+)
+
+// Statement is one statement an export executed. Batch statements are reported once
+// per shape, with a single VALUES group (or key condition), how many times they ran and
+// how many rows they carried in total.
+type Statement struct {
+	Kind  string `json:"kind"`
+	SQL   string `json:"sql"`
+	Count int    `json:"count,omitempty"`
+	Rows  int64  `json:"rows,omitempty"`
+}
+
+// statementLog collects the statements of one export for debug responses.
+type statementLog struct {
+	mu    sync.Mutex
+	stmts []Statement
+}
+
+type statementLogKey struct{}
+
+// withStatementLog makes the statements executed under ctx get recorded in the
+// returned log.
+func withStatementLog(ctx context.Context) (context.Context, *statementLog) {
+	l := &statementLog{}
+	return context.WithValue(ctx, statementLogKey{}, l), l
+}
+
+func statementLogFrom(ctx context.Context) *statementLog {
+	l, _ := ctx.Value(statementLogKey{}).(*statementLog)
+	return l
+}
+
+// recordStatement records a statement when ctx carries a statement log. Statements count
+// as activity of the export (see progress).
+func recordStatement(ctx context.Context, kind, sql string) {
+	progressFrom(ctx).touch()
+	if l := statementLogFrom(ctx); l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.stmts = append(l.stmts, Statement{Kind: kind, SQL: sql})
+	}
+}
+
+// recordBatch records one execution of a batch statement carrying rows rows. shape, only
+// called when ctx carries a statement log, renders the statement for a single row.
+func recordBatch(ctx context.Context, kind string, rows int, shape func() string) {
+	progressFrom(ctx).touch()
+	l := statementLogFrom(ctx)
+	if l == nil {
+		return
+	}
+	sql := shape()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.stmts {
+		if s := &l.stmts[i]; s.Kind == kind && s.SQL == sql {
+			s.Count++
+			s.Rows += int64(rows)
+			return
+		}
+	}
+	l.stmts = append(l.stmts, Statement{Kind: kind, SQL: sql, Count: 1, Rows: int64(rows)})
+}
+
+// list returns the recorded statements in execution order; nil is an empty log.
+func (l *statementLog) list() []Statement {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Statement(nil), l.stmts...)
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRecordBatchMergesShapes(t *testing.T) {
+	ctx, l := withStatementLog(context.Background())
+	recordStatement(ctx, StatementStarRocks, "CREATE DATABASE IF NOT EXISTS d")
+	insert := func() string { return "INSERT INTO d.t (`a`) VALUES (?)" }
+	recordBatch(ctx, StatementStarRocksBatch, 1000, insert)
+	recordBatch(ctx, StatementStarRocksBatch, 2, func() string { return "DELETE FROM d.t WHERE (`a` = ?)" })
+	recordBatch(ctx, StatementStarRocksBatch, 500, insert)
+
+	got := l.list()
+	if len(got) != 3 {
+		t.Fatalf("statements = %+v, want 3", got)
+	}
+	if got[1].Count != 2 || got[1].Rows != 1500 {
+		t.Errorf("insert shape = %+v, want count 2, rows 1500", got[1])
+	}
+
+	called := false
+	recordBatch(context.Background(), StatementStarRocksBatch, 1, func() string { called = true; return "" })
+	if called {
+		t.Error("recordBatch rendered a shape without a statement log")
+	}
+}
+
+func TestExporterDebugStatements(t *testing.T) {
+	e := NewExporter(&fakeBigQuery{location: "US"}, NewGCSDriver(nil, nil), &config.Config{})
+	params := ExportParams{Query: "SELECT 1 AS x", Output: "gs://bucket/out/"}
+	res, err := e.Run(context.Background(), params)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if res.Statements != nil {
+		t.Errorf("Statements without debug = %+v", res.Statements)
+	}
+
+	params.Debug = true
+	if res, err = e.Run(context.Background(), params); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(res.Statements) != 1 || res.Statements[0].Kind != StatementBigQuery || !strings.HasPrefix(strings.TrimSpace(res.Statements[0].SQL), "EXPORT DATA") {
+		t.Errorf("Statements = %+v, want the EXPORT DATA statement", res.Statements)
+	}
+}
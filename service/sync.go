@@ -0,0 +1,190 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// runSync runs a dataset sync pipeline: a snapshot of its dataset into the destination
+// database. Tables replace their destination (the swap load strategy, for StarRocks)
+// unless the pipeline sets a load strategy. The result adds up the tables, and the
+// error reports the failed ones.
+func (e *Exporter) runSync(ctx context.Context, s *config.Sync, params ExportParams) (ExportResult, error) {
+	if params.LoadStrategy == "" && e.Driver.Name() == "STARROCKS" {
+		params.LoadStrategy = LoadStrategySwap
+	}
+	var swaps *deferredSwaps
+	if s.DeferSwaps {
+		if e.Driver.Name() != "STARROCKS" || params.LoadStrategy != LoadStrategySwap {
+			return ExportResult{}, ConfigError(fmt.Errorf("defer_swaps needs the STARROCKS driver and the swap load strategy"))
+		}
+		ctx, swaps = withDeferredSwaps(ctx)
+	}
+	snap, err := e.Snapshot(ctx, SnapshotOptions{
+		Dataset:     s.Dataset,
+		Include:     s.Include,
+		Exclude:     s.Exclude,
+		Parallelism: s.Parallelism,
+		DependsOn:   s.DependsOn,
+	}, params)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	res := ExportResult{Table: params.Database, Tables: snap.Tables}
+	var failed []string
+	for _, t := range snap.Tables {
+		res.Rows += t.Rows
+		res.BytesProcessed += t.BytesProcessed
+		if t.Status != JobSucceeded {
+			failed = append(failed, t.Table+": "+t.Error)
+		}
+	}
+	if len(failed) > 0 {
+		// No table is replaced unless all of them loaded
+		swaps.discard(ctx)
+		return res, fmt.Errorf("sync of %s failed for %d of %d tables: %s", s.Dataset, len(failed), len(snap.Tables), strings.Join(failed, "; "))
+	}
+	err = swaps.commit(ctx)
+	if swaps != nil {
+		for i, t := range res.Tables {
+			res.Tables[i].Committed = swaps.swapped[t.Destination]
+		}
+	}
+	if err != nil {
+		return res, fmt.Errorf("sync of %s: %w", s.Dataset, err)
+	}
+	return res, nil
+}
+
+// deferredSwaps holds the staging tables of swap loads that are swapped into place
+// together at the end of a sync, in the order they finished loading (parents before
+// their children). Until they commit or discard, the loads keep their table locks and
+// their jobs stay running, so no other export writes the tables and a failed swap is
+// not reported as a success.
+type deferredSwaps struct {
+	mu    sync.Mutex
+	swaps []deferredSwap
+	// swapped are the tables commit swapped into place
+	swapped map[string]bool
+	// unlocks release the table locks of the loads
+	unlocks []func()
+	// finishes end the jobs of the loads, by destination table
+	finishes []deferredFinish
+}
+
+type deferredSwap struct {
+	table string
+	// lock is the context of the table lock, cancelled when it is lost
+	lock context.Context
+	// swap puts the staging table in place; drop drops it (after a swap, with the old
+	// contents)
+	swap func(context.Context) error
+	drop func()
+}
+
+type deferredFinish struct {
+	table  string
+	finish func(error)
+}
+
+// errSwapDiscarded fails the loads of a sync whose swaps were discarded.
+var errSwapDiscarded = errors.New("the deferred swap was discarded because another table of the sync failed")
+
+type deferredSwapsKey struct{}
+
+func withDeferredSwaps(ctx context.Context) (context.Context, *deferredSwaps) {
+	d := &deferredSwaps{}
+	return context.WithValue(ctx, deferredSwapsKey{}, d), d
+}
+
+// deferredSwapsFrom returns the deferred swaps of ctx, or nil when loads swap at once.
+func deferredSwapsFrom(ctx context.Context) *deferredSwaps {
+	d, _ := ctx.Value(deferredSwapsKey{}).(*deferredSwaps)
+	return d
+}
+
+func (d *deferredSwaps) add(s deferredSwap) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.swaps = append(d.swaps, s)
+}
+
+// hold keeps a table lock until the swaps commit or discard.
+func (d *deferredSwaps) hold(unlock func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.unlocks = append(d.unlocks, unlock)
+}
+
+// finishAfter ends the job loading table once the swaps commit or discard: with nil if
+// the table was swapped into place, otherwise with the reason it was not.
+func (d *deferredSwaps) finishAfter(table string, finish func(error)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.finishes = append(d.finishes, deferredFinish{table: table, finish: finish})
+}
+
+// commit swaps every staged table into place. It stops at the first failure, or at a
+// table whose lock was lost; the tables after it keep their previous contents.
+func (d *deferredSwaps) commit(ctx context.Context) (err error) {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.swapped = map[string]bool{}
+	defer func() { d.settle(err) }()
+	for i, s := range d.swaps {
+		if cause := context.Cause(s.lock); errors.Is(cause, ErrLeaseLost) {
+			return fmt.Errorf("swapped %d of %d tables, then: %w", i, len(d.swaps), cause)
+		}
+		if err := s.swap(ctx); err != nil {
+			return fmt.Errorf("swapped %d of %d tables, then: %w", i, len(d.swaps), err)
+		}
+		d.swapped[s.table] = true
+	}
+	slog.InfoContext(ctx, "Swapped deferred StarRocks tables into place", "tables", len(d.swaps))
+	return nil
+}
+
+// discard drops every staged table, leaving the destinations untouched.
+func (d *deferredSwaps) discard(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.swaps) > 0 {
+		slog.WarnContext(ctx, "Discarded deferred StarRocks swaps", "tables", len(d.swaps))
+	}
+	d.settle(errSwapDiscarded)
+}
+
+// settle drops the staging tables, releases the table locks and ends the jobs, failing
+// those of the tables not swapped with err. d.mu must be held.
+func (d *deferredSwaps) settle(err error) {
+	for _, s := range d.swaps {
+		s.drop()
+	}
+	d.swaps = nil
+	for _, unlock := range d.unlocks {
+		unlock()
+	}
+	d.unlocks = nil
+	if err == nil {
+		err = errSwapDiscarded
+	}
+	for _, f := range d.finishes {
+		if d.swapped[f.table] {
+			f.finish(nil)
+		} else {
+			f.finish(err)
+		}
+	}
+	d.finishes = nil
+}
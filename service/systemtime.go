@@ -0,0 +1,186 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SnapshotTimeNow as snapshot_time reads the sources as of the start of the run; the
+// tables of a snapshot or sync, and the partitions of a shard, share that time.
+const SnapshotTimeNow = "now"
+
+// parseSnapshotTime parses a snapshot_time: SnapshotTimeNow (resolved to now) or an
+// RFC 3339 timestamp in the past.
+func parseSnapshotTime(v string, now time.Time) (time.Time, error) {
+	if strings.EqualFold(v, SnapshotTimeNow) {
+		return now.UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid snapshot_time %q: expected now or an RFC 3339 timestamp", v)
+	}
+	if t.After(now) {
+		return time.Time{}, fmt.Errorf("snapshot_time %s is in the future", v)
+	}
+	return t.UTC(), nil
+}
+
+// resolveSnapshotTime pins a snapshot_time of now to the current time, so every export
+// derived from params reads the same point in time.
+func resolveSnapshotTime(params ExportParams, now time.Time) (ExportParams, error) {
+	if params.SnapshotTime == "" {
+		return params, nil
+	}
+	t, err := parseSnapshotTime(params.SnapshotTime, now)
+	if err != nil {
+		return params, ConfigError(err)
+	}
+	params.SnapshotTime = t.Format(time.RFC3339Nano)
+	return params, nil
+}
+
+// applySnapshotTime reads the tables of the query as of the export's snapshot_time. Change
+// history exports read a time window of their own and cannot be combined with it.
+func applySnapshotTime(params ExportParams, now time.Time) (ExportParams, error) {
+	if params.SnapshotTime == "" {
+		return params, nil
+	}
+	if params.ChangesTable != "" {
+		return params, ConfigError(fmt.Errorf("snapshot_time cannot be combined with changes_table"))
+	}
+	params, err := resolveSnapshotTime(params, now)
+	if err != nil {
+		return params, err
+	}
+	t, _ := time.Parse(time.RFC3339Nano, params.SnapshotTime)
+	params.Query = withSystemTime(params.Query, t)
+	return params, nil
+}
+
+// fromItemEnd are the keywords that can follow a table name where an alias could be.
+var fromItemEnd = map[string]bool{
+	"AS": true, "CROSS": true, "EXCEPT": true, "FOR": true, "FULL": true, "GROUP": true,
+	"HAVING": true, "INNER": true, "INTERSECT": true, "JOIN": true, "LEFT": true,
+	"LIMIT": true, "ON": true, "ORDER": true, "PIVOT": true, "QUALIFY": true, "RIGHT": true,
+	"SELECT": true, "TABLESAMPLE": true, "UNION": true, "UNPIVOT": true, "USING": true,
+	"WHERE": true, "WINDOW": true, "WITH": true,
+}
+
+// withSystemTime adds FOR SYSTEM_TIME AS OF at to every table the query reads (see
+// scanTableRefs), after FROM, JOIN or a comma. Paths into earlier items, table-valued
+// functions and their TABLE arguments are left alone, as are unrecognized items, wildcard
+// tables, INFORMATION_SCHEMA views and tables that already read a point in time.
+func withSystemTime(query string, at time.Time) string {
+	clause := " FOR SYSTEM_TIME AS OF " + bigQueryTimestamp(at)
+	var b strings.Builder
+	last := 0
+	for _, ref := range scanTableRefs(query) {
+		name := strings.ToUpper(strings.ReplaceAll(ref.name, "`", ""))
+		if ref.correlated || ref.call || ref.tableArg || ref.unknown || ref.asOf || strings.HasSuffix(name, "*") || strings.Contains(name, "INFORMATION_SCHEMA") {
+			continue
+		}
+		b.WriteString(query[last:ref.end])
+		b.WriteString(clause)
+		last = ref.end
+	}
+	b.WriteString(query[last:])
+	return b.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func skipSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// wordAt returns the identifier starting at i, if any.
+func wordAt(s string, i int) string {
+	j := i
+	for j < len(s) && isWordByte(s[j]) {
+		j++
+	}
+	return s[i:j]
+}
+
+// aliasAt returns the end of the (possibly backquoted) alias at i.
+func aliasAt(s string, i int) int {
+	if i < len(s) && s[i] == '`' {
+		return skipQuoted(s, i)
+	}
+	return i + len(wordAt(s, i))
+}
+
+// scanTableName returns the end of the table path at i (identifiers, backquoted parts,
+// dashes of project names, dots and a trailing wildcard) and whether it is qualified.
+func scanTableName(s string, i int) (int, bool) {
+	j, dots := i, 0
+	for j < len(s) {
+		switch c := s[j]; {
+		case c == '`':
+			k := skipQuoted(s, j)
+			dots += strings.Count(s[j:k], ".")
+			j = k
+		case c == '.':
+			dots++
+			j++
+		case isWordByte(c) || c == '-' || c == '*':
+			j++
+		default:
+			return j, dots > 0
+		}
+	}
+	return j, dots > 0
+}
+
+// skipString returns the end of the string literal starting at i, triple-quoted or not.
+func skipString(s string, i int) int {
+	q := s[i]
+	if strings.HasPrefix(s[i:], strings.Repeat(string(q), 3)) {
+		if end := strings.Index(s[i+3:], strings.Repeat(string(q), 3)); end >= 0 {
+			return i + 3 + end + 3
+		}
+		return len(s)
+	}
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case q:
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// skipQuoted returns the end of the backquoted identifier starting at i.
+func skipQuoted(s string, i int) int {
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '`':
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// skipComment returns the end of the comment starting at i.
+func skipComment(s string, i int) int {
+	if strings.HasPrefix(s[i:], "/*") {
+		if end := strings.Index(s[i+2:], "*/"); end >= 0 {
+			return i + 2 + end + 2
+		}
+		return len(s)
+	}
+	if end := strings.IndexByte(s[i:], '\n'); end >= 0 {
+		return i + end
+	}
+	return len(s)
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestWithSystemTime(t *testing.T) {
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	const asOf = " FOR SYSTEM_TIME AS OF TIMESTAMP '2026-10-01 12:00:00+00'"
+	tests := []struct {
+		name, query, want string
+	}{
+		{"table", "SELECT * FROM ds.visits", "SELECT * FROM ds.visits" + asOf},
+		{"quoted", "SELECT * FROM `proj.ds.visits` WHERE x = 1", "SELECT * FROM `proj.ds.visits`" + asOf + " WHERE x = 1"},
+		{"project with dashes", "select * from my-proj.ds.visits", "select * from my-proj.ds.visits" + asOf},
+		{"aliases and joins",
+			"SELECT v.id FROM ds.visits AS v JOIN ds.patients p ON p.id = v.pid LEFT JOIN `ds`.`labs` ON TRUE",
+			"SELECT v.id FROM ds.visits AS v" + asOf + " JOIN ds.patients p" + asOf + " ON p.id = v.pid LEFT JOIN `ds`.`labs`" + asOf + " ON TRUE"},
+		{"cte and subquery",
+			"WITH recent AS (SELECT * FROM ds.visits) SELECT * FROM recent JOIN (SELECT id FROM ds.patients) USING (id)",
+			"WITH recent AS (SELECT * FROM ds.visits" + asOf + ") SELECT * FROM recent JOIN (SELECT id FROM ds.patients" + asOf + ") USING (id)"},
+		{"unnest", "SELECT x FROM ds.t, UNNEST(t.arr) x", "SELECT x FROM ds.t" + asOf + ", UNNEST(t.arr) x"},
+		{"extract", "SELECT EXTRACT(YEAR FROM v.ts) FROM ds.visits v", "SELECT EXTRACT(YEAR FROM v.ts) FROM ds.visits v" + asOf},
+		{"distinct from", "SELECT * FROM ds.a WHERE a.x IS DISTINCT FROM a.y", "SELECT * FROM ds.a" + asOf + " WHERE a.x IS DISTINCT FROM a.y"},
+		{"strings and comments",
+			"SELECT 'FROM ds.x' -- FROM ds.y\nFROM ds.z /* JOIN ds.w */",
+			"SELECT 'FROM ds.x' -- FROM ds.y\nFROM ds.z" + asOf + " /* JOIN ds.w */"},
+		{"skipped", "SELECT * FROM ds.events_* JOIN ds.INFORMATION_SCHEMA.TABLES ON TRUE",
+			"SELECT * FROM ds.events_* JOIN ds.INFORMATION_SCHEMA.TABLES ON TRUE"},
+		{"already pinned", "SELECT * FROM ds.a FOR SYSTEM_TIME AS OF TIMESTAMP '2026-01-01'",
+			"SELECT * FROM ds.a FOR SYSTEM_TIME AS OF TIMESTAMP '2026-01-01'"},
+		{"comma join", "SELECT * FROM ds.visits v, ds.patients AS p WHERE p.id = v.pid",
+			"SELECT * FROM ds.visits v" + asOf + ", ds.patients AS p" + asOf + " WHERE p.id = v.pid"},
+		{"comma join of quoted tables", "SELECT * FROM `p.ds.a`,`p.ds.b`", "SELECT * FROM `p.ds.a`" + asOf + ",`p.ds.b`" + asOf},
+		{"comma join in subquery", "SELECT * FROM (SELECT * FROM ds.a, ds.b) JOIN ds.c USING (id)",
+			"SELECT * FROM (SELECT * FROM ds.a" + asOf + ", ds.b" + asOf + ") JOIN ds.c" + asOf + " USING (id)"},
+		{"correlated path", "SELECT * FROM ds.visits v, v.labs AS l", "SELECT * FROM ds.visits v" + asOf + ", v.labs AS l"},
+		{"comma join partly pinned", "SELECT * FROM ds.a FOR SYSTEM_TIME AS OF TIMESTAMP '2026-01-01', ds.b",
+			"SELECT * FROM ds.a FOR SYSTEM_TIME AS OF TIMESTAMP '2026-01-01', ds.b" + asOf},
+		{"table functions", "SELECT * FROM APPENDS(TABLE ds.a, NULL, NULL), ds.fn(1)", "SELECT * FROM APPENDS(TABLE ds.a, NULL, NULL), ds.fn(1)"},
+		{"parenthesized join", "SELECT * FROM (ds.a JOIN ds.b USING (id))", "SELECT * FROM (ds.a" + asOf + " JOIN ds.b" + asOf + " USING (id))"},
+		{"select list commas", "SELECT a, b FROM ds.t WHERE x IN (1, 2)", "SELECT a, b FROM ds.t" + asOf + " WHERE x IN (1, 2)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withSystemTime(tt.query, at)
+			if got != tt.want {
+				t.Errorf("withSystemTime(%q) =\n%s\nwant\n%s", tt.query, got, tt.want)
+			}
+			if again := withSystemTime(got, at); again != got {
+				t.Errorf("withSystemTime() is not idempotent: %s", again)
+			}
+		})
+	}
+}
+
+func TestApplySnapshotTime(t *testing.T) {
+	now := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+	p, err := applySnapshotTime(ExportParams{Query: "SELECT * FROM ds.a", SnapshotTime: "now"}, now)
+	if err != nil {
+		t.Fatalf("applySnapshotTime() error = %v", err)
+	}
+	if p.SnapshotTime != "2026-10-14T08:00:00Z" || !strings.Contains(p.Query, "FOR SYSTEM_TIME AS OF TIMESTAMP '2026-10-14 08:00:00") {
+		t.Errorf("applySnapshotTime() = %+v", p)
+	}
+	for _, bad := range []ExportParams{
+		{Query: "SELECT 1", SnapshotTime: "yesterday"},
+		{Query: "SELECT 1", SnapshotTime: "2026-10-15T00:00:00Z"},
+		{ChangesTable: "ds.a", SnapshotTime: "now"},
+	} {
+		if _, err := applySnapshotTime(bad, now); FailureClass(err) != FailureConfig {
+			t.Errorf("applySnapshotTime(%+v) error = %v, want a config error", bad, err)
+		}
+	}
+}
+
+func TestSnapshotSharesSnapshotTime(t *testing.T) {
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "table_name", Type: bigquery.StringFieldType}},
+		rows:   [][]bigquery.Value{{"patients"}, {"visits"}},
+	}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	res, err := e.Snapshot(context.Background(), SnapshotOptions{Dataset: "study_a", Parallelism: 2},
+		ExportParams{QueryLocation: "US", Output: "gs://b/freeze", SnapshotTime: SnapshotTimeNow})
+	if err != nil || res.Succeeded != 2 {
+		t.Fatalf("Snapshot() = %+v, %v", res, err)
+	}
+	var clauses []string
+	for _, q := range bq.queries {
+		if _, clause, ok := strings.Cut(q, "FOR SYSTEM_TIME AS OF "); ok && strings.Contains(q, "EXPORT DATA") {
+			clauses = append(clauses, clause[:strings.Index(clause, "+00'")])
+		}
+	}
+	if len(clauses) != 2 || clauses[0] != clauses[1] {
+		t.Errorf("table exports read %q, want one shared point in time", clauses)
+	}
+}
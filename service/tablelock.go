@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// ErrDestinationLocked is returned when another export is loading the destination table.
+var ErrDestinationLocked = errors.New("destination table is locked")
+
+// tableLockPoll is how often an export waiting for a table checks whether it is free.
+const tableLockPoll = time.Second
+
+// tableLocks serializes the exports into the same destination table, so their schema
+// evolution and loads do not interleave: on this instance, or on all instances sharing
+// the coordinator. An export waits up to wait for the table (DESTINATION_LOCK_WAIT),
+// then gives up with ErrDestinationLocked.
+type tableLocks struct {
+	coord Coordinator
+	wait  time.Duration
+	poll  time.Duration
+}
+
+// newTableLocksFromEnv reads DESTINATION_LOCK_WAIT; by default a locked table is
+// rejected at once.
+func newTableLocksFromEnv(coord Coordinator) *tableLocks {
+	if coord == nil {
+		coord = newLocalCoordinator()
+	}
+	l := &tableLocks{coord: coord, poll: tableLockPoll}
+	if d, err := time.ParseDuration(os.Getenv("DESTINATION_LOCK_WAIT")); err == nil && d > 0 {
+		l.wait = d
+	}
+	return l
+}
+
+// acquire locks table for the export of ctx; the returned func unlocks it. The load must
+// run in the returned context, which is cancelled when the lock is lost.
+func (l *tableLocks) acquire(ctx context.Context, table string) (context.Context, func(), error) {
+	key, holder := "table:"+table, leaseHolder(ctx)
+	var deadline time.Time
+	for {
+		ok, cur, err := l.coord.TryLock(ctx, key, holder, leaseTTL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to lock destination table %s: %w", table, err)
+		}
+		if ok {
+			lockCtx, unlock := holdLease(ctx, l.coord, key, holder, leaseTTL)
+			return lockCtx, unlock, nil
+		}
+		if l.wait <= 0 {
+			return nil, nil, fmt.Errorf("%w: %s is being loaded by job %s", ErrDestinationLocked, table, cur)
+		}
+		if deadline.IsZero() {
+			slog.InfoContext(ctx, "Waiting for the destination table", "table", table, "holder", cur, "wait", l.wait)
+			deadline = time.Now().Add(l.wait)
+		} else if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("%w: %s is still being loaded by job %s after %s", ErrDestinationLocked, table, cur, l.wait)
+		}
+		select {
+		case <-time.After(min(l.poll, time.Until(deadline)+time.Millisecond)):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
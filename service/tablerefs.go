@@ -0,0 +1,241 @@
+package service
+
+import (
+	"cmp"
+	"strings"
+)
+
+// tableRef is a table a query reads: a path after FROM, JOIN or a comma of a FROM clause,
+// or a TABLE argument of a table function.
+type tableRef struct {
+	// start and end delimit the reference in the query: its name, alias and FOR
+	// SYSTEM_TIME clause
+	start, end int
+	name       string
+	// alias is the alias as written, empty without one
+	alias string
+	// asOf is set when the table reads a point in time with FOR SYSTEM_TIME AS OF, and
+	// systemTime is the clause when it reads a TIMESTAMP literal
+	asOf       bool
+	systemTime string
+	// correlated references are paths into an earlier item of the same FROM clause
+	// (implicit UNNEST), not tables
+	correlated bool
+	// call is set for calls of table-valued functions (ds.fn(...)), and tableArg for the
+	// TABLE arguments of table functions such as APPENDS and ML.PREDICT
+	call, tableArg bool
+	// unknown is set for FROM items that are neither a path, UNNEST, a subquery nor a
+	// parenthesized join, such as unqualified function calls; name is empty if the item
+	// does not start with one
+	unknown bool
+}
+
+// scanTableRefs returns the qualified names (dataset.table, project.dataset.table) query
+// reads, in order. CTEs, UNNEST and subqueries are not tables, while the items of
+// parenthesized joins are; strings, comments, EXTRACT(... FROM ...) and IS [NOT] DISTINCT
+// FROM are skipped.
+func scanTableRefs(query string) []tableRef {
+	// For the outermost query and each open parenthesis or bracket: whether it belongs to
+	// EXTRACT, whether it is in a FROM clause and the aliases of the items of that clause
+	type level struct {
+		extract, from bool
+		aliases       []string
+	}
+	levels := []level{{}}
+	var refs []tableRef
+	// itemAt is the parenthesis opening the FROM item expected after FROM, JOIN or a comma
+	// of a FROM clause, if any: a subquery or a parenthesized join
+	itemAt := -1
+	// item scans the FROM item at i of the clause of top and returns where to go on
+	item := func(top *level, i int) int {
+		ref, ok := fromItem(query, i, top.aliases)
+		if ref.name != "" && !ref.unknown {
+			top.aliases = append(top.aliases, ref.rangeName())
+		}
+		if ok {
+			refs = append(refs, ref)
+			return ref.end
+		}
+		if j := skipSpace(query, i); j < len(query) && query[j] == '(' {
+			itemAt = j
+		}
+		return i
+	}
+	prevWord := ""
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			i = skipString(query, i)
+			continue
+		case c == '`':
+			i = skipQuoted(query, i)
+			prevWord = ""
+			continue
+		case c == '-' && strings.HasPrefix(query[i:], "--"), c == '#', c == '/' && strings.HasPrefix(query[i:], "/*"):
+			i = skipComment(query, i)
+			continue
+		case c == '(' && i == itemAt:
+			if w := strings.ToUpper(wordAt(query, skipSpace(query, i+1))); w != "SELECT" && w != "WITH" {
+				// A parenthesized join, starting with its first item
+				levels = append(levels, level{from: true})
+				i = item(&levels[len(levels)-1], i+1)
+				prevWord = ""
+				continue
+			}
+			levels = append(levels, level{})
+		case c == '(' || c == '[':
+			levels = append(levels, level{extract: c == '(' && strings.EqualFold(prevWord, "EXTRACT")})
+		case c == ')' || c == ']':
+			if len(levels) > 1 {
+				levels = levels[:len(levels)-1]
+			}
+			// The alias of a subquery or UNNEST
+			if top := &levels[len(levels)-1]; top.from {
+				if alias, _ := itemAlias(query, i+1); alias != "" {
+					top.aliases = append(top.aliases, alias)
+				}
+			}
+		case c == ',' && levels[len(levels)-1].from:
+			i = item(&levels[len(levels)-1], i+1)
+			prevWord = ""
+			continue
+		}
+		if !isWordByte(c) {
+			if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				prevWord = ""
+			}
+			i++
+			continue
+		}
+
+		word := wordAt(query, i)
+		i += len(word)
+		top := &levels[len(levels)-1]
+		switch keyword := strings.ToUpper(word); keyword {
+		case "FROM", "JOIN":
+			if keyword == "FROM" && (top.extract || strings.EqualFold(prevWord, "DISTINCT")) {
+				break
+			}
+			if keyword == "FROM" {
+				top.aliases = nil
+			}
+			top.from = true
+			if next := item(top, i); next != i {
+				i = next
+				prevWord = ""
+				continue
+			}
+		case "TABLE":
+			start := skipSpace(query, i)
+			if end, qualified := scanTableName(query, start); qualified {
+				refs = append(refs, tableRef{start: start, end: end, name: query[start:end], tableArg: true})
+				i = end
+				prevWord = ""
+				continue
+			}
+		case "WHERE", "GROUP", "HAVING", "QUALIFY", "WINDOW", "ORDER", "LIMIT", "UNION", "INTERSECT", "EXCEPT", "SELECT":
+			top.from = false
+		}
+		prevWord = word
+	}
+	return refs
+}
+
+// fromItem scans the FROM item at i, a path or a call. It reports whether the item is a
+// qualified name, a table-valued function or unknown; the name of the reference is set
+// for any path, so later items can be told apart from paths into it. Parenthesized items
+// and UNNEST are left to the caller.
+func fromItem(query string, i int, aliases []string) (tableRef, bool) {
+	start := skipSpace(query, i)
+	end, qualified := scanTableName(query, start)
+	switch {
+	case end == start && start < len(query) && query[start] == '(':
+		return tableRef{}, false
+	case end == start:
+		return tableRef{start: start, end: start, unknown: true}, true
+	case end < len(query) && query[end] == '(' && !qualified:
+		if strings.EqualFold(query[start:end], "UNNEST") {
+			return tableRef{}, false
+		}
+		// The arguments are scanned on, for their TABLE arguments
+		return tableRef{start: start, end: end, name: query[start:end], unknown: true}, true
+	}
+	ref := tableRef{start: start, end: end, name: query[start:end]}
+	if end < len(query) && query[end] == '(' {
+		ref.call = true
+		return ref, true
+	}
+	if alias, aliasEnd := itemAlias(query, end); alias != "" {
+		ref.alias, ref.end = alias, aliasEnd
+	}
+	if next := skipSpace(query, ref.end); strings.EqualFold(wordAt(query, next), "FOR") {
+		ref.asOf = true
+		if clause := systemTimeLiteral(query, next); clause > next {
+			ref.systemTime = query[next:clause]
+			ref.end = clause
+		}
+	}
+	first := strings.ToLower(strings.Trim(strings.SplitN(strings.Trim(ref.name, "`"), ".", 2)[0], "`"))
+	for _, a := range aliases {
+		if strings.ToLower(strings.Trim(a, "`")) == first {
+			ref.correlated = true
+		}
+	}
+	return ref, qualified
+}
+
+// rangeName is the name the rest of the query refers to the item by: its alias, or the
+// last component of its path.
+func (r tableRef) rangeName() string {
+	return cmp.Or(r.alias, lastPathComponent(r.name))
+}
+
+// itemAlias returns the (possibly backquoted) alias of the FROM item ending at i, with or
+// without AS, and its end.
+func itemAlias(s string, i int) (string, int) {
+	next := skipSpace(s, i)
+	w := wordAt(s, next)
+	switch {
+	case strings.EqualFold(w, "AS"):
+		next = skipSpace(s, next+len(w))
+	case next < len(s) && s[next] == '`':
+	case w == "" || fromItemEnd[strings.ToUpper(w)]:
+		return "", i
+	}
+	end := aliasAt(s, next)
+	if end == next {
+		return "", i
+	}
+	return s[next:end], end
+}
+
+// systemTimeLiteral returns the end of the clause FOR SYSTEM_TIME AS OF TIMESTAMP '...' at
+// i, or i when the clause reads any other expression.
+func systemTimeLiteral(s string, i int) int {
+	j := i
+	for _, want := range []string{"FOR", "SYSTEM_TIME", "AS", "OF", "TIMESTAMP"} {
+		j = skipSpace(s, j)
+		w := wordAt(s, j)
+		if !strings.EqualFold(w, want) {
+			return i
+		}
+		j += len(w)
+	}
+	if j = skipSpace(s, j); j >= len(s) || s[j] != '\'' && s[j] != '"' {
+		return i
+	}
+	end := skipString(s, j)
+	// The literal must be the whole expression
+	if k := skipSpace(s, end); k < len(s) && !strings.ContainsRune("),;", rune(s[k])) && !fromItemEnd[strings.ToUpper(wordAt(s, k))] {
+		return i
+	}
+	return end
+}
+
+// lastPathComponent returns the table of a path such as `project.ds.table`.
+func lastPathComponent(name string) string {
+	name = strings.ReplaceAll(name, "`", "")
+	return name[strings.LastIndex(name, ".")+1:]
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrQuotaExceeded is returned when a request would exceed a tenant quota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrForbidden is returned when a tenant request targets another tenant's resources.
+	ErrForbidden = errors.New("forbidden")
+)
+
+type (
+	tenantCtxKey struct{}
+	apiKeyCtxKey struct{}
+)
+
+type tenantInfo struct {
+	name string
+	cfg  config.Tenant
+}
+
+// WithTenant returns a copy of ctx carrying the tenant a request is authenticated as.
+func WithTenant(ctx context.Context, name string, t config.Tenant) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, tenantInfo{name: name, cfg: t})
+}
+
+// TenantFrom returns the tenant carried by ctx; ok is false for admin or single-tenant
+// requests.
+func TenantFrom(ctx context.Context) (name string, t config.Tenant, ok bool) {
+	info, ok := ctx.Value(tenantCtxKey{}).(tenantInfo)
+	return info.name, info.cfg, ok
+}
+
+// WithAPIKeyID returns a copy of ctx carrying the ID of the API key a request used.
+func WithAPIKeyID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, apiKeyCtxKey{}, id)
+}
+
+// APIKeyID returns the key ID carried by ctx, or "".
+func APIKeyID(ctx context.Context) string {
+	id, _ := ctx.Value(apiKeyCtxKey{}).(string)
+	return id
+}
+
+// KeyID derives a stable, non-secret identifier for an API key, used in usage reports.
+func KeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// TenantName returns the tenant carried by ctx, or "".
+func TenantName(ctx context.Context) string {
+	name, _, _ := TenantFrom(ctx)
+	return name
+}
+
+// PipelineVisible reports whether the caller in ctx may see and run p: tenants only see
+// their own pipelines.
+func PipelineVisible(ctx context.Context, p config.Pipeline) bool {
+	name, _, ok := TenantFrom(ctx)
+	return !ok || p.Tenant == name
+}
+
+// applyTenant confines params to the tenant's destinations: its database is forced and
+// any other qualified table is rejected, diff snapshots live in its database, GCS output
+// must sit under its prefix, create_ddl needs explicit permission and only its own
+// service accounts can be impersonated.
+func applyTenant(p ExportParams, name string, t config.Tenant) (ExportParams, error) {
+	if p.DiffSnapshot != "" {
+		// The snapshot table is replaced on every run, so it is a destination too
+		if t.Database == "" {
+			return p, fmt.Errorf("%w: diff_snapshot needs a database for tenant %q", ErrForbidden, name)
+		}
+		if !strings.Contains(p.DiffSnapshot, ".") {
+			p.DiffSnapshot = t.Database + "." + p.DiffSnapshot
+		}
+		rest, ok := strings.CutPrefix(p.DiffSnapshot, t.Database+".")
+		if !ok || rest == "" || strings.Contains(rest, ".") {
+			return p, fmt.Errorf("%w: tenant %q can only keep diff snapshots in database %q", ErrForbidden, name, t.Database)
+		}
+	}
+	if t.Database != "" {
+		if strings.Contains(p.Table, ".") {
+			rest, ok := strings.CutPrefix(p.Table, t.Database+".")
+			if !ok || rest == "" || strings.Contains(rest, ".") {
+				return p, fmt.Errorf("%w: tenant %q can only write to database %q", ErrForbidden, name, t.Database)
+			}
+		}
+		if p.Database != "" && p.Database != t.Database {
+			return p, fmt.Errorf("%w: tenant %q can only write to database %q", ErrForbidden, name, t.Database)
+		}
+		p.Database = t.Database
+	}
+	if t.OutputPrefix != "" {
+		if p.Output == "" {
+			p.Output = t.OutputPrefix
+		}
+		// Compared as a folder, so prefix gs://b/site-a does not admit gs://b/site-ab/
+		folder := strings.TrimSuffix(t.OutputPrefix, "/")
+		if p.Output != folder && !strings.HasPrefix(p.Output, folder+"/") {
+			return p, fmt.Errorf("%w: tenant %q can only write under %s", ErrForbidden, name, t.OutputPrefix)
+		}
+	}
+	if p.CreateDDL != "" && !t.AllowCreateDDL {
+		return p, fmt.Errorf("%w: create_ddl is not allowed for tenant %q", ErrForbidden, name)
+	}
+	if sa := p.ImpersonateServiceAccount; sa != "" && !slices.Contains(t.ServiceAccounts, sa) {
+		return p, fmt.Errorf("%w: tenant %q cannot impersonate %s", ErrForbidden, name, sa)
+	}
+	return p, nil
+}
+
+// tenantTable confines the table of p to the tenant for drivers whose destinations have
+// no database: Firestore collections are kept under tenants/<tenant>/, Spanner tables
+// are prefixed with <tenant>_, Redis keys with <tenant>:. Tables already confined are
+// kept, so a retry is not confined twice.
+func tenantTable(p ExportParams, driver, name string) (ExportParams, error) {
+	switch driver {
+	case redisDriverName:
+		// Tenant names have no :, so the prefix of two tenants never overlaps
+		prefix := name + ":"
+		if table := cmp.Or(p.Table, p.Name); table != "" && !strings.HasPrefix(table, prefix) {
+			p.Table = prefix + table
+		}
+	case spannerDriverName:
+		if !spannerTenantName.MatchString(name) {
+			return p, fmt.Errorf("%w: tenant %q cannot export to Spanner; its tables are prefixed with the tenant name, which must be letters and digits", ErrForbidden, name)
+		}
+		prefix := name + "_"
+		if table := cmp.Or(p.Table, p.Name, "export"); !strings.HasPrefix(table, prefix) {
+			p.Table = prefix + table
+		}
+	case firestoreDriverName:
+		prefix := "tenants/" + name + "/"
+		if collection := strings.Trim(cmp.Or(p.Table, p.Name), "/"); collection != "" && !strings.HasPrefix(collection, prefix) {
+			p.Table = prefix + collection
+		}
+	}
+	return p, nil
+}
+
+// applyTenantRowFilter adds the row filters of the tenant and of the API key in ctx to
+// the conditions of p. Conditions already present are kept, so a retry stays confined to
+// the filters of the key that started it.
+func applyTenantRowFilter(ctx context.Context, p ExportParams, t config.Tenant) ExportParams {
+	filters := []string{t.RowFilter}
+	for k, f := range t.KeyRowFilters {
+		if KeyID(k) == APIKeyID(ctx) {
+			filters = append(filters, f)
+		}
+	}
+	p.rowFilters = slices.Clone(p.rowFilters)
+	for _, f := range filters {
+		if f != "" && !slices.Contains(p.rowFilters, f) {
+			p.rowFilters = append(p.rowFilters, f)
+		}
+	}
+	return p
+}
+
+// rowFilterQuery applies the tenant's row filters to every table query reads: each table
+// is replaced by a subquery keeping its rows that satisfy the filters, so the filters see
+// the columns of the source whatever the query selects. Queries reading tables the
+// rewrite cannot reach (table functions, wildcard tables, INFORMATION_SCHEMA, implicit
+// UNNEST paths, computed points in time and FROM items it does not recognize) are
+// rejected.
+func rowFilterQuery(query string, p ExportParams) (string, error) {
+	if len(p.rowFilters) == 0 {
+		return query, nil
+	}
+	var b strings.Builder
+	last := 0
+	for _, ref := range scanTableRefs(query) {
+		var reason string
+		switch {
+		case ref.unknown:
+			reason = "the unrecognized FROM item " + cmp.Or(ref.name, fmt.Sprintf("at offset %d", ref.start))
+		case ref.call:
+			reason = "the table function " + ref.name
+		case ref.tableArg:
+			reason = "the TABLE argument " + ref.name
+		case ref.correlated:
+			reason = "the path " + ref.name + " (use UNNEST)"
+		case strings.HasSuffix(ref.name, "*"):
+			reason = "the wildcard table " + ref.name
+		case strings.Contains(strings.ToUpper(ref.name), "INFORMATION_SCHEMA"):
+			reason = ref.name
+		case ref.asOf && ref.systemTime == "":
+			reason = ref.name + " as of a computed time (use snapshot_time)"
+		}
+		if reason != "" {
+			return "", fmt.Errorf("%w: the tenant's row filters cannot be applied to %s", ErrForbidden, reason)
+		}
+		alias := cmp.Or(ref.alias, "`"+lastPathComponent(ref.name)+"`")
+		systemTime := ""
+		if ref.systemTime != "" {
+			systemTime = " " + ref.systemTime
+		}
+		b.WriteString(query[last:ref.start])
+		fmt.Fprintf(&b, "(SELECT * FROM %s%s WHERE %s) AS %s", ref.name, systemTime, rowFilterCondition(p.rowFilters), alias)
+		last = ref.end
+	}
+	b.WriteString(query[last:])
+	return b.String(), nil
+}
+
+// rowFilterCondition is the conjunction of filters.
+func rowFilterCondition(filters []string) string {
+	return "(" + strings.Join(filters, ") AND (") + ")"
+}
+
+// tenantSlots counts running exports per tenant for MaxConcurrentExports.
+type tenantSlots struct {
+	mu      sync.Mutex
+	running map[string]int
+}
+
+// acquire reserves a slot for tenant, or fails if limit exports are already running.
+// The returned func releases it.
+func (s *tenantSlots) acquire(tenant string, limit int) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == nil {
+		s.running = map[string]int{}
+	}
+	if s.running[tenant] >= limit {
+		return nil, fmt.Errorf("%w: tenant %q already runs %d export(s)", ErrQuotaExceeded, tenant, limit)
+	}
+	s.running[tenant]++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running[tenant]--
+	}, nil
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestApplyTenant(t *testing.T) {
+	tenant := config.Tenant{Database: "study_a", OutputPrefix: "gs://exports/study_a/", ServiceAccounts: []string{"reader-a@study-a.iam.gserviceaccount.com"}}
+	tests := []struct {
+		name    string
+		in      ExportParams
+		wantErr bool
+		wantDB  string
+		wantOut string
+	}{
+		{"defaults", ExportParams{Table: "visits"}, false, "study_a", "gs://exports/study_a/"},
+		{"own qualified table", ExportParams{Table: "study_a.visits"}, false, "study_a", "gs://exports/study_a/"},
+		{"other database", ExportParams{Table: "study_b.visits"}, true, "", ""},
+		{"other database field", ExportParams{Database: "study_b"}, true, "", ""},
+		{"output outside prefix", ExportParams{Output: "gs://exports/study_b/"}, true, "", ""},
+		{"output under prefix", ExportParams{Output: "gs://exports/study_a/2026/"}, false, "study_a", "gs://exports/study_a/2026/"},
+		{"output is prefix folder", ExportParams{Output: "gs://exports/study_a"}, false, "study_a", "gs://exports/study_a"},
+		{"output sharing prefix", ExportParams{Output: "gs://exports/study_ab/"}, true, "", ""},
+		{"create ddl", ExportParams{CreateDDL: "CREATE TABLE x.y (id INT)"}, true, "", ""},
+		{"own service account", ExportParams{ImpersonateServiceAccount: "reader-a@study-a.iam.gserviceaccount.com"}, false, "study_a", "gs://exports/study_a/"},
+		{"other service account", ExportParams{ImpersonateServiceAccount: "reader-b@study-b.iam.gserviceaccount.com"}, true, "", ""},
+		{"own diff snapshot", ExportParams{DiffSnapshot: "study_a.visits_snapshot"}, false, "study_a", "gs://exports/study_a/"},
+		{"diff snapshot elsewhere", ExportParams{DiffSnapshot: "study_b.visits_snapshot"}, true, "", ""},
+		{"diff snapshot in another project", ExportParams{DiffSnapshot: "other.study_a.visits_snapshot"}, true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyTenant(tt.in, "a", tenant)
+			if tt.wantErr {
+				if !errors.Is(err, ErrForbidden) {
+					t.Fatalf("applyTenant() error = %v, want ErrForbidden", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyTenant() error = %v", err)
+			}
+			if got.Database != tt.wantDB || got.Output != tt.wantOut {
+				t.Errorf("applyTenant() = database %q output %q", got.Database, got.Output)
+			}
+		})
+	}
+
+	got, err := applyTenant(ExportParams{DiffSnapshot: "visits_snapshot"}, "a", tenant)
+	if err != nil || got.DiffSnapshot != "study_a.visits_snapshot" {
+		t.Errorf("applyTenant() unqualified diff snapshot = %q, %v, want it in the tenant's database", got.DiffSnapshot, err)
+	}
+	if _, err := applyTenant(ExportParams{DiffSnapshot: "ds.visits_snapshot"}, "b", config.Tenant{OutputPrefix: "gs://exports/b/"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("applyTenant() diff snapshot without tenant database error = %v, want ErrForbidden", err)
+	}
+	// A prefix without a trailing slash is still a folder
+	if _, err := applyTenant(ExportParams{Output: "gs://b/site-ab/out/"}, "a", config.Tenant{OutputPrefix: "gs://b/site-a"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("applyTenant() output under a longer folder error = %v, want ErrForbidden", err)
+	}
+	if _, err := applyTenant(ExportParams{Output: "gs://b/site-a/out/"}, "a", config.Tenant{OutputPrefix: "gs://b/site-a"}); err != nil {
+		t.Errorf("applyTenant() output under the prefix error = %v", err)
+	}
+}
+
+func TestTenantTable(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		in     ExportParams
+		want   string
+	}{
+		{"firestore collection", firestoreDriverName, ExportParams{Table: "visits"}, "tenants/a/visits"},
+		{"firestore subcollection", firestoreDriverName, ExportParams{Table: "/sites/s1/visits/"}, "tenants/a/sites/s1/visits"},
+		{"firestore name", firestoreDriverName, ExportParams{Name: "visits"}, "tenants/a/visits"},
+		{"firestore retry", firestoreDriverName, ExportParams{Table: "tenants/a/visits"}, "tenants/a/visits"},
+		{"firestore other tenant", firestoreDriverName, ExportParams{Table: "tenants/b/visits"}, "tenants/a/tenants/b/visits"},
+		{"spanner table", spannerDriverName, ExportParams{Table: "visits"}, "a_visits"},
+		{"spanner default", spannerDriverName, ExportParams{}, "a_export"},
+		{"spanner retry", spannerDriverName, ExportParams{Table: "a_visits"}, "a_visits"},
+		{"redis prefix", redisDriverName, ExportParams{Table: "site"}, "a:site"},
+		{"redis retry", redisDriverName, ExportParams{Table: "a:site"}, "a:site"},
+		{"redis other tenant", redisDriverName, ExportParams{Table: "b:site"}, "a:b:site"},
+		{"other driver", "BIGQUERY", ExportParams{Table: "visits"}, "visits"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tenantTable(tt.in, tt.driver, "a")
+			if err != nil {
+				t.Fatalf("tenantTable() error = %v", err)
+			}
+			if got.Table != tt.want {
+				t.Errorf("tenantTable() table = %q, want %q", got.Table, tt.want)
+			}
+		})
+	}
+	if _, err := tenantTable(ExportParams{Table: "visits"}, spannerDriverName, "study_a"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("tenantTable() Spanner table of tenant study_a error = %v, want ErrForbidden", err)
+	}
+}
+
+func TestExporterTenantIsolation(t *testing.T) {
+	bq := &fakeBigQuery{location: "US", bytes: 2 << 30}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	ctxA := WithTenant(logging.WithRequestID(context.Background(), "run-a"), "a", config.Tenant{OutputPrefix: "gs://exports/a/", MaxBytesPerQuery: 1 << 30})
+	ctxB := WithTenant(logging.WithRequestID(context.Background(), "run-b"), "b", config.Tenant{OutputPrefix: "gs://exports/b/"})
+
+	if _, err := e.Run(ctxA, ExportParams{Query: "SELECT 1"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Run() over byte limit error = %v, want ErrQuotaExceeded", err)
+	}
+	if _, err := e.Run(ctxB, ExportParams{Query: "SELECT 1"}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	jobsA := e.Jobs.List(ctxA)
+	if len(jobsA) != 1 || jobsA[0].ID != "run-a" || jobsA[0].Status != JobFailed {
+		t.Errorf("tenant a jobs = %+v, want only its failed run", jobsA)
+	}
+	if _, ok := e.Jobs.Get(ctxA, "run-b"); ok {
+		t.Errorf("tenant a can see tenant b's run")
+	}
+	if all := e.Jobs.List(context.Background()); len(all) != 2 {
+		t.Errorf("admin sees %d jobs, want 2", len(all))
+	}
+}
+
+func TestTenantRowFilter(t *testing.T) {
+	bq := &fakeBigQuery{location: "US"}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	tenant := config.Tenant{
+		APIKeys:       []string{"key-a1", "key-a2"},
+		RowFilter:     "site_id IN ('A1', 'A2')",
+		KeyRowFilters: map[string]string{"key-a2": "site_id = 'A2'"},
+	}
+	ctx := WithAPIKeyID(WithTenant(context.Background(), "a", tenant), KeyID("key-a2"))
+	params := ExportParams{Query: "SELECT * FROM ds.visits", Output: "gs://b/out/", DedupColumns: []string{"visit_id"}}
+	if _, err := e.Run(ctx, params); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	filtered := "SELECT * FROM (SELECT * FROM ds.visits WHERE (site_id IN ('A1', 'A2')) AND (site_id = 'A2')) AS `visits`"
+	if probe := bq.queries[0]; probe != filtered {
+		t.Errorf("probe query = %s, want %s", probe, filtered)
+	}
+	if export := bq.queries[len(bq.queries)-1]; !strings.Contains(export, "PARTITION BY `visit_id`) AS _dedup_rank FROM ("+filtered+")") {
+		t.Errorf("export query %s does not filter rows before deduplicating them", export)
+	}
+
+	// A retry by another key of the tenant keeps the filter of the key that started the run
+	retried := applyTenantRowFilter(WithAPIKeyID(WithTenant(context.Background(), "a", tenant), KeyID("key-a1")), applyTenantRowFilter(ctx, params, tenant), tenant)
+	if got, _ := rowFilterQuery("SELECT * FROM ds.visits", retried); got != filtered {
+		t.Errorf("retried row filter = %s", got)
+	}
+	if got, _ := rowFilterQuery("q", params); got != "q" {
+		t.Errorf("rowFilterQuery() without filters = %s", got)
+	}
+}
+
+func TestRowFilterQuery(t *testing.T) {
+	p := ExportParams{rowFilters: []string{"site_id = 'A1'"}}
+	tests := []struct {
+		query, want string
+	}{
+		// Replacing the filter column in the result does not widen what the source yields
+		{"SELECT * EXCEPT(site_id), 'A1' AS site_id FROM ds.visits",
+			"SELECT * EXCEPT(site_id), 'A1' AS site_id FROM (SELECT * FROM ds.visits WHERE (site_id = 'A1')) AS `visits`"},
+		{"SELECT v.id FROM `proj.ds.visits` AS v JOIN ds.sites s ON v.site = s.id",
+			"SELECT v.id FROM (SELECT * FROM `proj.ds.visits` WHERE (site_id = 'A1')) AS v JOIN (SELECT * FROM ds.sites WHERE (site_id = 'A1')) AS s ON v.site = s.id"},
+		{"SELECT * FROM ds.a, ds.b WHERE a.id = b.id",
+			"SELECT * FROM (SELECT * FROM ds.a WHERE (site_id = 'A1')) AS `a`, (SELECT * FROM ds.b WHERE (site_id = 'A1')) AS `b` WHERE a.id = b.id"},
+		{"SELECT (SELECT MAX(n) FROM ds.counts) FROM (SELECT 1) t",
+			"SELECT (SELECT MAX(n) FROM (SELECT * FROM ds.counts WHERE (site_id = 'A1')) AS `counts`) FROM (SELECT 1) t"},
+		{"SELECT * FROM ds.a v FOR SYSTEM_TIME AS OF TIMESTAMP '2026-10-01 00:00:00+00' WHERE x",
+			"SELECT * FROM (SELECT * FROM ds.a FOR SYSTEM_TIME AS OF TIMESTAMP '2026-10-01 00:00:00+00' WHERE (site_id = 'A1')) AS v WHERE x"},
+		{"WITH c AS (SELECT * FROM ds.a) SELECT * FROM c, UNNEST(c.items) i",
+			"WITH c AS (SELECT * FROM (SELECT * FROM ds.a WHERE (site_id = 'A1')) AS `a`) SELECT * FROM c, UNNEST(c.items) i"},
+		{"SELECT 'FROM ds.a' FROM x -- FROM ds.b",
+			"SELECT 'FROM ds.a' FROM x -- FROM ds.b"},
+		// The items of parenthesized joins are tables too
+		{"SELECT * FROM (ds.a JOIN ds.b USING (id))",
+			"SELECT * FROM ((SELECT * FROM ds.a WHERE (site_id = 'A1')) AS `a` JOIN (SELECT * FROM ds.b WHERE (site_id = 'A1')) AS `b` USING (id))"},
+		{"SELECT * FROM ds.a LEFT JOIN (ds.b CROSS JOIN ds.c) ON a.id = b.id",
+			"SELECT * FROM (SELECT * FROM ds.a WHERE (site_id = 'A1')) AS `a` LEFT JOIN ((SELECT * FROM ds.b WHERE (site_id = 'A1')) AS `b` CROSS JOIN (SELECT * FROM ds.c WHERE (site_id = 'A1')) AS `c`) ON a.id = b.id"},
+		{"SELECT * FROM (ds.a)",
+			"SELECT * FROM ((SELECT * FROM ds.a WHERE (site_id = 'A1')) AS `a`)"},
+		{"SELECT * FROM ((SELECT * FROM ds.a) x, (ds.b))",
+			"SELECT * FROM ((SELECT * FROM (SELECT * FROM ds.a WHERE (site_id = 'A1')) AS `a`) x, ((SELECT * FROM ds.b WHERE (site_id = 'A1')) AS `b`))"},
+	}
+	for _, tt := range tests {
+		got, err := rowFilterQuery(tt.query, p)
+		if err != nil || got != tt.want {
+			t.Errorf("rowFilterQuery(%q) =\n%s, %v\nwant\n%s", tt.query, got, err, tt.want)
+		}
+	}
+
+	for _, q := range []string{
+		"SELECT * FROM ds.visits_*",
+		"SELECT * FROM ds.INFORMATION_SCHEMA.TABLES",
+		"SELECT * FROM APPENDS(TABLE ds.visits, NULL, NULL)",
+		"SELECT * FROM ds.tvf(1)",
+		"SELECT * FROM ds.visits v, v.items",
+		"SELECT * FROM ds.visits FOR SYSTEM_TIME AS OF CURRENT_TIMESTAMP() - INTERVAL 1 HOUR",
+		"SELECT * FROM EXTERNAL_QUERY('conn', 'SELECT 1')",
+		"SELECT * FROM @source",
+	} {
+		if _, err := rowFilterQuery(q, p); !errors.Is(err, ErrForbidden) {
+			t.Errorf("rowFilterQuery(%q) error = %v, want ErrForbidden", q, err)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"google.golang.org/api/iterator"
+)
+
+// RowTransformer transforms the rows of an export in flight, a batch at a time, between
+// the BigQuery reader and the destination writer. A new transformer is built for every
+// export, so it may keep state between batches.
+type RowTransformer interface {
+	// Schema returns the schema of the transformed rows, given the schema of the rows
+	// read. It is called once, before the first batch.
+	Schema(in bigquery.Schema) (bigquery.Schema, error)
+	// Transform returns the transformed batch. It may change the rows in place, and drop
+	// or add rows.
+	Transform(ctx context.Context, rows [][]bigquery.Value) ([][]bigquery.Value, error)
+}
+
+// RowTransformerFactory builds a transformer from a transforms entry of an export.
+type RowTransformerFactory func(t config.Transform) (RowTransformer, error)
+
+// Built-in transforms.
+const (
+	TransformRename = "rename"
+	TransformCast   = "cast"
+	TransformMask   = "mask"
+)
+
+// transformBatchRows is the number of rows handed to the transformers at a time.
+const transformBatchRows = 1000
+
+var (
+	rowTransformersMu sync.Mutex
+	rowTransformers   = map[string]RowTransformerFactory{
+		TransformRename: newRenameTransformer,
+		TransformCast:   newCastTransformer,
+		TransformMask:   newMaskTransformer,
+	}
+)
+
+// RegisterRowTransformer makes a custom transformer available to the transforms of
+// exports as type name. Call it from an init function of a file compiled into the
+// service; it panics if name is already taken.
+func RegisterRowTransformer(name string, factory RowTransformerFactory) {
+	rowTransformersMu.Lock()
+	defer rowTransformersMu.Unlock()
+	if name == "" || factory == nil {
+		panic("service: RegisterRowTransformer needs a name and a factory")
+	}
+	if _, dup := rowTransformers[name]; dup {
+		panic("service: RegisterRowTransformer called twice for transform " + name)
+	}
+	rowTransformers[name] = factory
+}
+
+// applyTransforms builds the transformers of an export's transforms and computed columns.
+func applyTransforms(p ExportParams) (ExportParams, error) {
+	p.transformers = nil
+	for i, t := range p.Transforms {
+		rowTransformersMu.Lock()
+		factory, ok := rowTransformers[t.Type]
+		rowTransformersMu.Unlock()
+		if !ok {
+			return p, fmt.Errorf("transforms[%d]: unknown type %q", i, t.Type)
+		}
+		tr, err := factory(t)
+		if err != nil {
+			return p, fmt.Errorf("transforms[%d] (%s): %w", i, t.Type, err)
+		}
+		p.transformers = append(p.transformers, namedTransformer{name: fmt.Sprintf("transforms[%d] (%s)", i, t.Type), RowTransformer: tr})
+	}
+	if len(p.ComputedColumns) > 0 {
+		c, err := newComputeTransformer(p.ComputedColumns, time.Now())
+		if err != nil {
+			return p, err
+		}
+		p.transformers = append(p.transformers, c)
+	}
+	return p, nil
+}
+
+// checkTransforms rejects transforms and computed columns for drivers that never see the
+// rows.
+func checkTransforms(p ExportParams, driver string) error {
+	if len(p.Transforms) == 0 && len(p.ComputedColumns) == 0 {
+		return nil
+	}
+	if !driverCapabilities(driver).ReadsRows {
+		names := driverNames(func(c DriverCapabilities) bool { return c.ReadsRows })
+		return fmt.Errorf("transforms and computed_columns are only supported by the %s and %s drivers, which read the rows",
+			strings.Join(names[:len(names)-1], ", "), names[len(names)-1])
+	}
+	if p.StringType == StringTypeAuto {
+		return fmt.Errorf("string_type %s measures the query result and cannot be combined with transforms or computed_columns", StringTypeAuto)
+	}
+	return nil
+}
+
+// namedTransformer prefixes the errors of a transformer with its place in the transforms.
+type namedTransformer struct {
+	name string
+	RowTransformer
+}
+
+func (t namedTransformer) Schema(in bigquery.Schema) (bigquery.Schema, error) {
+	out, err := t.RowTransformer.Schema(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", t.name, err)
+	}
+	return out, nil
+}
+
+func (t namedTransformer) Transform(ctx context.Context, rows [][]bigquery.Value) ([][]bigquery.Value, error) {
+	out, err := t.RowTransformer.Transform(ctx, rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", t.name, err)
+	}
+	return out, nil
+}
+
+// transformSchema returns the schema of rows of schema after all transformers.
+func transformSchema(transformers []RowTransformer, schema bigquery.Schema) (bigquery.Schema, error) {
+	for _, t := range transformers {
+		out, err := t.Schema(slices.Clone(schema))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) == 0 {
+			return nil, fmt.Errorf("the transforms leave no columns")
+		}
+		schema = out
+	}
+	return schema, nil
+}
+
+// transformRows returns it with the transformers applied to its rows, or it itself when
+// there are none.
+func transformRows(ctx context.Context, it RowIterator, transformers []RowTransformer) (RowIterator, error) {
+	if len(transformers) == 0 {
+		return it, nil
+	}
+	t := &transformIterator{RowIterator: it, ctx: ctx, transformers: transformers}
+	if err := t.resolveSchema(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// transformIterator reads the rows of a RowIterator in batches of transformBatchRows and
+// passes each batch through the transformers.
+type transformIterator struct {
+	RowIterator
+	ctx          context.Context
+	transformers []RowTransformer
+	// schema is that of the transformed rows, once the schema of the result is known
+	schema bigquery.Schema
+	batch  [][]bigquery.Value
+	pos    int
+	done   bool
+}
+
+func (t *transformIterator) resolveSchema() error {
+	if t.schema != nil || len(t.RowIterator.Schema()) == 0 {
+		return nil
+	}
+	s, err := transformSchema(t.transformers, t.RowIterator.Schema())
+	if err != nil {
+		return ConfigError(err)
+	}
+	t.schema = s
+	return nil
+}
+
+func (t *transformIterator) Schema() bigquery.Schema {
+	return t.schema
+}
+
+func (t *transformIterator) Next(dst *[]bigquery.Value) error {
+	for t.pos >= len(t.batch) {
+		if t.done {
+			return iterator.Done
+		}
+		if err := t.fill(); err != nil {
+			return err
+		}
+	}
+	*dst = t.batch[t.pos]
+	t.pos++
+	return nil
+}
+
+// fill reads and transforms the next batch.
+func (t *transformIterator) fill() error {
+	t.batch, t.pos = t.batch[:0], 0
+	for len(t.batch) < transformBatchRows {
+		// A fresh slice per row: the reader may reuse the one it is given
+		var row []bigquery.Value
+		err := t.RowIterator.Next(&row)
+		if err == iterator.Done {
+			t.done = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+		t.batch = append(t.batch, row)
+	}
+	// The schema is known once the first page has been fetched
+	if err := t.resolveSchema(); err != nil {
+		return err
+	}
+	if len(t.batch) == 0 {
+		return nil
+	}
+	if t.schema == nil {
+		return fmt.Errorf("cannot transform rows: the query result has no schema")
+	}
+	for _, tr := range t.transformers {
+		rows, err := tr.Transform(t.ctx, t.batch)
+		if err != nil {
+			return err
+		}
+		t.batch = rows
+	}
+	for _, row := range t.batch {
+		if len(row) != len(t.schema) {
+			return fmt.Errorf("the transforms returned a row of %d values for %d columns", len(row), len(t.schema))
+		}
+	}
+	return nil
+}
+
+// checkBuiltinTransform checks the shape of a built-in transforms entry.
+func checkBuiltinTransform(t config.Transform) error {
+	if len(t.Columns) == 0 {
+		return fmt.Errorf("no columns")
+	}
+	if len(t.Options) > 0 {
+		return fmt.Errorf("options only apply to custom transforms")
+	}
+	return nil
+}
+
+// schemaColumn returns the index of column name in schema, after checking that it can
+// take a value-level transform.
+func schemaColumn(schema bigquery.Schema, name string) (int, error) {
+	i := slices.IndexFunc(schema, func(f *bigquery.FieldSchema) bool { return f.Name == name })
+	if i < 0 {
+		return 0, fmt.Errorf("column %s is not in the result", name)
+	}
+	if f := schema[i]; f.Repeated || f.Type == bigquery.RecordFieldType {
+		return 0, fmt.Errorf("column %s: ARRAY and STRUCT columns are not supported", name)
+	}
+	return i, nil
+}
+
+// renameTransformer renames columns; the values are left alone.
+type renameTransformer struct {
+	names map[string]string
+}
+
+func newRenameTransformer(t config.Transform) (RowTransformer, error) {
+	if err := checkBuiltinTransform(t); err != nil {
+		return nil, err
+	}
+	for from, to := range t.Columns {
+		if strings.TrimSpace(to) == "" {
+			return nil, fmt.Errorf("column %s: empty new name", from)
+		}
+	}
+	return &renameTransformer{names: t.Columns}, nil
+}
+
+func (r *renameTransformer) Schema(in bigquery.Schema) (bigquery.Schema, error) {
+	out := make(bigquery.Schema, len(in))
+	for i, f := range in {
+		out[i] = f
+		if to, ok := r.names[f.Name]; ok {
+			g := *f
+			g.Name = to
+			out[i] = &g
+		}
+	}
+	for from := range r.names {
+		if !slices.ContainsFunc(in, func(f *bigquery.FieldSchema) bool { return f.Name == from }) {
+			return nil, fmt.Errorf("column %s is not in the result", from)
+		}
+	}
+	// Column names are case-insensitive in BigQuery and StarRocks alike
+	for i, f := range out {
+		for _, g := range out[:i] {
+			if strings.EqualFold(f.Name, g.Name) {
+				return nil, fmt.Errorf("two columns would be named %s", f.Name)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (r *renameTransformer) Transform(_ context.Context, rows [][]bigquery.Value) ([][]bigquery.Value, error) {
+	return rows, nil
+}
+
+// castTransformer converts the values of columns to another type: STRING, INT64,
+// FLOAT64 or BOOL.
+type castTransformer struct {
+	types map[string]bigquery.FieldType
+	// cols are the indexes of the cast columns, with their new types
+	cols []int
+	to   []bigquery.FieldType
+	in   bigquery.Schema
+}
+
+func newCastTransformer(t config.Transform) (RowTransformer, error) {
+	if err := checkBuiltinTransform(t); err != nil {
+		return nil, err
+	}
+	c := &castTransformer{types: map[string]bigquery.FieldType{}}
+	for col, typ := range t.Columns {
+		switch strings.ToUpper(typ) {
+		case "STRING":
+			c.types[col] = bigquery.StringFieldType
+		case "INT64", "INTEGER":
+			c.types[col] = bigquery.IntegerFieldType
+		case "FLOAT64", "FLOAT":
+			c.types[col] = bigquery.FloatFieldType
+		case "BOOL", "BOOLEAN":
+			c.types[col] = bigquery.BooleanFieldType
+		default:
+			return nil, fmt.Errorf("column %s: cannot cast to %q; expected STRING, INT64, FLOAT64 or BOOL", col, typ)
+		}
+	}
+	return c, nil
+}
+
+func (c *castTransformer) Schema(in bigquery.Schema) (bigquery.Schema, error) {
+	out := slices.Clone(in)
+	c.cols, c.to, c.in = nil, nil, in
+	for col, typ := range c.types {
+		i, err := schemaColumn(in, col)
+		if err != nil {
+			return nil, err
+		}
+		g := *in[i]
+		g.Type = typ
+		out[i] = &g
+		c.cols, c.to = append(c.cols, i), append(c.to, typ)
+	}
+	return out, nil
+}
+
+func (c *castTransformer) Transform(_ context.Context, rows [][]bigquery.Value) ([][]bigquery.Value, error) {
+	for _, row := range rows {
+		for j, i := range c.cols {
+			v, err := castValue(row[i], c.to[j])
+			if err != nil {
+				return nil, DataError(fmt.Errorf("column %s: %w", c.in[i].Name, err))
+			}
+			row[i] = v
+		}
+	}
+	return rows, nil
+}
+
+func castValue(v bigquery.Value, to bigquery.FieldType) (bigquery.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch to {
+	case bigquery.StringFieldType:
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case int64:
+			return strconv.FormatInt(x, 10), nil
+		case float64:
+			return strconv.FormatFloat(x, 'g', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(x), nil
+		case *big.Rat:
+			s := strings.TrimRight(x.FloatString(38), "0")
+			return strings.TrimSuffix(s, "."), nil
+		case []byte:
+			return base64.StdEncoding.EncodeToString(x), nil
+		case time.Time:
+			return x.UTC().Format(time.RFC3339Nano), nil
+		case civil.Date, civil.Time, civil.DateTime:
+			return fmt.Sprint(x), nil
+		}
+	case bigquery.IntegerFieldType:
+		switch x := v.(type) {
+		case int64:
+			return x, nil
+		case string:
+			n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to INT64", x)
+			}
+			return n, nil
+		case float64:
+			if x != math.Trunc(x) || x < math.MinInt64 || x >= math.MaxInt64 {
+				return nil, fmt.Errorf("cannot cast %g to INT64", x)
+			}
+			return int64(x), nil
+		case bool:
+			if x {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case *big.Rat:
+			if !x.IsInt() || !x.Num().IsInt64() {
+				return nil, fmt.Errorf("cannot cast %s to INT64", x.RatString())
+			}
+			return x.Num().Int64(), nil
+		}
+	case bigquery.FloatFieldType:
+		switch x := v.(type) {
+		case float64:
+			return x, nil
+		case int64:
+			return float64(x), nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to FLOAT64", x)
+			}
+			return f, nil
+		case *big.Rat:
+			f, _ := x.Float64()
+			return f, nil
+		}
+	case bigquery.BooleanFieldType:
+		switch x := v.(type) {
+		case bool:
+			return x, nil
+		case int64:
+			return x != 0, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(x))
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to BOOL", x)
+			}
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot cast a %T value to %s", v, to)
+}
+
+// maskTransformer replaces the characters of STRING values with '*', except for a
+// number of trailing characters; values no longer than that are masked entirely.
+type maskTransformer struct {
+	keep map[string]int
+	cols []int
+	n    []int
+}
+
+func newMaskTransformer(t config.Transform) (RowTransformer, error) {
+	if err := checkBuiltinTransform(t); err != nil {
+		return nil, err
+	}
+	m := &maskTransformer{keep: map[string]int{}}
+	for col, keep := range t.Columns {
+		n := 0
+		if keep != "" {
+			var err error
+			if n, err = strconv.Atoi(keep); err != nil || n < 0 {
+				return nil, fmt.Errorf("column %s: expected the number of trailing characters to leave unmasked, got %q", col, keep)
+			}
+		}
+		m.keep[col] = n
+	}
+	return m, nil
+}
+
+func (m *maskTransformer) Schema(in bigquery.Schema) (bigquery.Schema, error) {
+	m.cols, m.n = nil, nil
+	for col, n := range m.keep {
+		i, err := schemaColumn(in, col)
+		if err != nil {
+			return nil, err
+		}
+		if in[i].Type != bigquery.StringFieldType {
+			return nil, fmt.Errorf("column %s: expected a STRING column, got %s", col, in[i].Type)
+		}
+		m.cols, m.n = append(m.cols, i), append(m.n, n)
+	}
+	return in, nil
+}
+
+func (m *maskTransformer) Transform(_ context.Context, rows [][]bigquery.Value) ([][]bigquery.Value, error) {
+	for _, row := range rows {
+		for j, i := range m.cols {
+			if s, ok := row[i].(string); ok {
+				row[i] = maskString(s, m.n[j])
+			}
+		}
+	}
+	return rows, nil
+}
+
+func maskString(s string, keep int) string {
+	r := []rune(s)
+	if len(r) <= keep {
+		return strings.Repeat("*", len(r))
+	}
+	return strings.Repeat("*", len(r)-keep) + string(r[len(r)-keep:])
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// dropEvenTransformer is a custom transformer dropping the rows whose first column is
+// even, registered like a transformer compiled into the service.
+type dropEvenTransformer struct{}
+
+func (dropEvenTransformer) Schema(in bigquery.Schema) (bigquery.Schema, error) { return in, nil }
+
+func (dropEvenTransformer) Transform(_ context.Context, rows [][]bigquery.Value) ([][]bigquery.Value, error) {
+	var out [][]bigquery.Value
+	for _, r := range rows {
+		if r[0].(int64)%2 != 0 {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func init() {
+	RegisterRowTransformer("test_drop_even", func(config.Transform) (RowTransformer, error) { return dropEvenTransformer{}, nil })
+}
+
+var testTransformSchema = bigquery.Schema{
+	{Name: "id", Type: bigquery.IntegerFieldType},
+	{Name: "phone", Type: bigquery.StringFieldType},
+	{Name: "amount", Type: bigquery.NumericFieldType},
+	{Name: "code", Type: bigquery.StringFieldType},
+}
+
+func readTransformed(t *testing.T, rows [][]bigquery.Value, transforms ...config.Transform) (bigquery.Schema, [][]bigquery.Value, error) {
+	t.Helper()
+	p, err := applyTransforms(ExportParams{Transforms: transforms})
+	if err != nil {
+		t.Fatalf("applyTransforms() error = %v", err)
+	}
+	it, err := transformRows(context.Background(), &fakeRowIterator{schema: testTransformSchema, rows: rows}, p.transformers)
+	if err != nil {
+		return nil, nil, err
+	}
+	var out [][]bigquery.Value
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return it.Schema(), out, nil
+		}
+		if err != nil {
+			return it.Schema(), out, err
+		}
+		out = append(out, row)
+	}
+}
+
+func TestTransformRows(t *testing.T) {
+	rows := func() [][]bigquery.Value {
+		return [][]bigquery.Value{
+			{int64(1), "0901234567", big.NewRat(25, 2), "7"},
+			{int64(2), "12", big.NewRat(3, 1), nil},
+		}
+	}
+	schema, got, err := readTransformed(t, rows(),
+		config.Transform{Type: TransformRename, Columns: map[string]string{"phone": "contact", "code": "site"}},
+		config.Transform{Type: TransformCast, Columns: map[string]string{"amount": "string", "site": "INT64"}},
+		config.Transform{Type: TransformMask, Columns: map[string]string{"contact": "3"}},
+	)
+	if err != nil {
+		t.Fatalf("transformRows() error = %v", err)
+	}
+	var names []string
+	for _, f := range schema {
+		names = append(names, f.Name+":"+string(f.Type))
+	}
+	if got := strings.Join(names, " "); got != "id:INTEGER contact:STRING amount:STRING site:INTEGER" {
+		t.Errorf("schema = %s", got)
+	}
+	if fmt.Sprint(got) != "[[1 *******567 12.5 7] [2 ** 3 <nil>]]" {
+		t.Errorf("rows = %v", got)
+	}
+	if testTransformSchema[1].Name != "phone" {
+		t.Errorf("rename changed the source schema")
+	}
+
+	// Custom transformers may drop rows; batches are refilled until the rows run out
+	var many [][]bigquery.Value
+	for i := range 2*transformBatchRows + 1 {
+		many = append(many, []bigquery.Value{int64(i), "x", nil, nil})
+	}
+	if _, got, err := readTransformed(t, many, config.Transform{Type: "test_drop_even"}); err != nil || len(got) != transformBatchRows {
+		t.Errorf("test_drop_even kept %d rows, error = %v", len(got), err)
+	}
+
+	if _, _, err := readTransformed(t, rows(), config.Transform{Type: TransformCast, Columns: map[string]string{"phone": "bool"}}); FailureClass(err) != FailureData {
+		t.Errorf("cast of a non-boolean error = %v, want a data error", err)
+	}
+	for name, bad := range map[string]config.Transform{
+		"missing column":   {Type: TransformRename, Columns: map[string]string{"age": "years"}},
+		"name collision":   {Type: TransformRename, Columns: map[string]string{"phone": "CODE"}},
+		"mask of a number": {Type: TransformMask, Columns: map[string]string{"id": "2"}},
+	} {
+		if _, _, err := readTransformed(t, rows(), bad); FailureClass(err) != FailureConfig || !strings.Contains(err.Error(), "transforms[0]") {
+			t.Errorf("%s: transformRows() error = %v, want a config error", name, err)
+		}
+	}
+	for name, bad := range map[string]config.Transform{
+		"unknown type":   {Type: "upper"},
+		"no columns":     {Type: TransformMask},
+		"cast to a date": {Type: TransformCast, Columns: map[string]string{"id": "DATE"}},
+		"mask count":     {Type: TransformMask, Columns: map[string]string{"phone": "last4"}},
+		"options":        {Type: TransformRename, Columns: map[string]string{"a": "b"}, Options: map[string]string{"x": "y"}},
+	} {
+		if _, err := applyTransforms(ExportParams{Transforms: []config.Transform{bad}}); err == nil {
+			t.Errorf("%s: applyTransforms() succeeded", name)
+		}
+	}
+}
+
+func TestExportTransforms(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{schema: testTransformSchema, rows: [][]bigquery.Value{{int64(1), "0901234567", nil, "A"}}}
+	transforms := []config.Transform{{Type: TransformMask, Columns: map[string]string{"phone": "4"}}}
+	e := NewExporter(bq, NewParquetWriteDriver(gcs.service(t)), &config.Config{})
+	if _, err := e.Run(context.Background(), ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/t/", Filename: "masked", Transforms: transforms}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	gcs.mu.Lock()
+	data := gcs.objects["t/masked-000000000000.parquet"]
+	gcs.mu.Unlock()
+	tbl, _ := readParquet(t, data)
+	if got := tbl.Column(1).Data().Chunk(0).ValueStr(0); got != "******4567" {
+		t.Errorf("phone = %s", got)
+	}
+
+	gcsExporter := NewExporter(bq, NewGCSDriver(gcs.service(t), nil), &config.Config{})
+	if _, err := gcsExporter.Run(context.Background(), ExportParams{Query: "SELECT 1", QueryLocation: "US", Output: "gs://b/t/", Transforms: transforms}); FailureClass(err) != FailureConfig {
+		t.Errorf("Run() with transforms on GCS_PARQUET error = %v, want a config error", err)
+	}
+}
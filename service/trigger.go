@@ -0,0 +1,91 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"log/slog"
+	"path"
+	"time"
+)
+
+// ObjectEvent is the arrival of an object in Cloud Storage: an object finalize event of
+// a bucket notification or Eventarc trigger.
+type ObjectEvent struct {
+	Bucket     string
+	Name       string
+	Generation string
+	// Time is when the object was written
+	Time time.Time
+}
+
+// TriggerRun is the outcome of one pipeline run by an object event.
+type TriggerRun struct {
+	Pipeline    string `json:"pipeline"`
+	JobID       string `json:"job_id"`
+	Status      string `json:"status"`
+	Rows        int64  `json:"rows_loaded,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	err error
+}
+
+// Err returns the error of a failed run.
+func (r TriggerRun) Err() error { return r.err }
+
+// ObjectTriggers runs the pipelines whose trigger matches the objects landing in Cloud
+// Storage, so a refresh can follow the upstream job that writes them.
+type ObjectTriggers struct {
+	e       *Exporter
+	tenants map[string]config.Tenant
+}
+
+func NewObjectTriggers(e *Exporter, tenants map[string]config.Tenant) *ObjectTriggers {
+	return &ObjectTriggers{e: e, tenants: tenants}
+}
+
+// Handle runs, one after the other, the pipelines visible to the caller in ctx whose
+// trigger matches ev, each as its owning tenant. The runs get the query parameters
+// trigger_bucket, trigger_object and trigger_folder (the object's folder), and the
+// object's write time as logical date: a redelivered event returns the result of the
+// run it already started.
+func (t *ObjectTriggers) Handle(ctx context.Context, ev ObjectEvent) []TriggerRun {
+	runs := []TriggerRun{}
+	for i, name := range t.Matching(ctx, ev) {
+		p, _ := t.e.Pipelines.Get(name)
+		runCtx := withChildRequestID(ctx, i+1)
+		if p.Tenant != "" {
+			runCtx = WithTenant(runCtx, p.Tenant, t.tenants[p.Tenant])
+		}
+		params := ExportParams{}
+		if !ev.Time.IsZero() {
+			params.LogicalDate = ev.Time.UTC().Format(time.RFC3339Nano)
+		}
+		slog.InfoContext(runCtx, "Starting triggered pipeline run", "pipeline", name, "bucket", ev.Bucket, "object", ev.Name, "generation", ev.Generation)
+		res, err := t.e.RunPipeline(runCtx, name, params, map[string]string{
+			"trigger_bucket": ev.Bucket,
+			"trigger_object": ev.Name,
+			"trigger_folder": path.Dir(ev.Name),
+		})
+		run := TriggerRun{Pipeline: name, JobID: logging.RequestID(runCtx), Status: JobSucceeded, Rows: res.Rows, DuplicateOf: res.DuplicateOf, err: err}
+		if err != nil {
+			slog.ErrorContext(runCtx, "Triggered pipeline run failed", "pipeline", name, "error", err)
+			run.Status, run.Error = JobFailed, err.Error()
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// Matching returns the approved pipelines visible to the caller in ctx that ev triggers,
+// by name.
+func (t *ObjectTriggers) Matching(ctx context.Context, ev ObjectEvent) []string {
+	var names []string
+	for _, name := range t.e.Pipelines.Names() {
+		if p, ok := t.e.Pipelines.Get(name); ok && !p.PendingApproval && p.Trigger.Matches(ev.Bucket, ev.Name) && PipelineVisible(ctx, p) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"bq-exporter/logging"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectTriggers(t *testing.T) {
+	cfg := &config.Config{
+		Pipelines: map[string]config.Pipeline{
+			"visits": {
+				Query:         "SELECT * FROM ds.visits WHERE batch = '{{trigger_folder}}'",
+				QueryLocation: "US",
+				Destination:   config.Destination{Output: "gs://b/visits/"},
+				Trigger:       &config.Trigger{Bucket: "landing", Object: "visits/*/_SUCCESS"},
+			},
+			"clinic": {
+				Query:         "SELECT 1",
+				QueryLocation: "US",
+				Tenant:        "a",
+				Trigger:       &config.Trigger{Bucket: "landing", Object: "visits/*/_SUCCESS"},
+			},
+			"labs": {
+				Query:    "SELECT 2",
+				Schedule: "@daily",
+			},
+		},
+		Tenants: map[string]config.Tenant{"a": {OutputPrefix: "gs://exports/a/"}},
+	}
+	bq := &fakeBigQuery{}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), cfg)
+	triggers := NewObjectTriggers(e, cfg.Tenants)
+	ctx := logging.WithRequestID(context.Background(), "event-1")
+	ev := ObjectEvent{Bucket: "landing", Name: "visits/2026-10-13/_SUCCESS", Generation: "1", Time: time.Date(2026, 10, 14, 2, 0, 0, 0, time.UTC)}
+
+	if got := triggers.Matching(ctx, ObjectEvent{Bucket: "landing", Name: "visits/2026-10-13/part-0.csv"}); len(got) != 0 {
+		t.Errorf("Matching(data file) = %v, want none", got)
+	}
+	if got := triggers.Matching(WithTenant(ctx, "a", cfg.Tenants["a"]), ev); len(got) != 1 || got[0] != "clinic" {
+		t.Errorf("Matching() for tenant a = %v, want its own pipeline", got)
+	}
+
+	runs := triggers.Handle(ctx, ev)
+	if len(runs) != 2 || runs[0].Pipeline != "clinic" || runs[1].Pipeline != "visits" || runs[0].Status != JobSucceeded || runs[1].Status != JobSucceeded {
+		t.Fatalf("Handle() = %+v, want clinic and visits run", runs)
+	}
+	if !strings.Contains(bq.queries[len(bq.queries)-1], "batch = 'visits/2026-10-13'") {
+		t.Errorf("query = %s, want the marker's folder", bq.queries[len(bq.queries)-1])
+	}
+	clinic, _ := e.Jobs.Get(context.Background(), runs[0].JobID)
+	if clinic.Tenant != "a" || clinic.LogicalDate != "2026-10-14T02:00:00Z" {
+		t.Errorf("clinic run = %+v, want a run of tenant a for the object's write time", clinic)
+	}
+
+	// A redelivered event returns the earlier results
+	queries := len(bq.queries)
+	again := triggers.Handle(logging.WithRequestID(context.Background(), "event-2"), ev)
+	if len(again) != 2 || again[1].DuplicateOf != runs[1].JobID || len(bq.queries) != queries {
+		t.Errorf("Handle() of a redelivery = %+v, want duplicates of %+v", again, runs)
+	}
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UsageRecord is the usage of one API key in one calendar month (UTC).
+type UsageRecord struct {
+	Month          string `json:"month"` // YYYY-MM
+	Tenant         string `json:"tenant,omitempty"`
+	KeyID          string `json:"key_id,omitempty"`
+	BytesProcessed int64  `json:"bytes_processed"`
+	RowsExported   int64  `json:"rows_exported"`
+	Exports        int64  `json:"exports"`
+}
+
+type usageKey struct {
+	month, tenant, keyID string
+}
+
+// UsageStore accounts bytes scanned and rows exported per API key and month. With a
+// file path, the totals are persisted as JSON after every update and reloaded on start.
+type UsageStore struct {
+	mu      sync.Mutex
+	path    string
+	records map[usageKey]*UsageRecord
+}
+
+func newUsageStore(path string) *UsageStore {
+	return &UsageStore{path: path, records: map[usageKey]*UsageRecord{}}
+}
+
+// NewUsageStore loads the usage file at path, if any ("" keeps usage in memory only).
+func NewUsageStore(path string) (*UsageStore, error) {
+	s := newUsageStore(path)
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	}
+	var recs []UsageRecord
+	if err := json.Unmarshal(data, &recs); err != nil {
+		return nil, ConfigError(fmt.Errorf("failed to parse usage file %s: %w", path, err))
+	}
+	for _, r := range recs {
+		r := r
+		s.records[usageKey{r.Month, r.Tenant, r.KeyID}] = &r
+	}
+	return s, nil
+}
+
+// NewUsageStoreFromEnv persists usage to USAGE_FILE when set.
+func NewUsageStoreFromEnv() (*UsageStore, error) {
+	return NewUsageStore(os.Getenv("USAGE_FILE"))
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// record adds one export's usage for the caller in ctx.
+func (s *UsageStore) record(ctx context.Context, bytes, rows int64) {
+	s.add(ctx, bytes, rows, 1)
+}
+
+// recordQuery accounts the bytes of a query that exports nothing, like the row count of
+// a plan.
+func (s *UsageStore) recordQuery(ctx context.Context, bytes int64) {
+	s.add(ctx, bytes, 0, 0)
+}
+
+func (s *UsageStore) add(ctx context.Context, bytes, rows, exports int64) {
+	k := usageKey{usageMonth(time.Now()), TenantName(ctx), APIKeyID(ctx)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[k]
+	if !ok {
+		r = &UsageRecord{Month: k.month, Tenant: k.tenant, KeyID: k.keyID}
+		s.records[k] = r
+	}
+	r.BytesProcessed += bytes
+	r.RowsExported += rows
+	r.Exports += exports
+	if err := s.saveLocked(); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist usage", "error", err)
+	}
+}
+
+func (s *UsageStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.listLocked(func(*UsageRecord) bool { return true }), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *UsageStore) listLocked(keep func(*UsageRecord) bool) []UsageRecord {
+	out := []UsageRecord{}
+	for _, r := range s.records {
+		if keep(r) {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Month != b.Month {
+			return a.Month > b.Month
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		return a.KeyID < b.KeyID
+	})
+	return out
+}
+
+// List returns the usage visible to the caller in ctx (a tenant sees its own keys, the
+// admin everything), optionally limited to one month (YYYY-MM).
+func (s *UsageStore) List(ctx context.Context, month string) []UsageRecord {
+	tenant, _, isTenant := TenantFrom(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked(func(r *UsageRecord) bool {
+		return (month == "" || r.Month == month) && (!isTenant || r.Tenant == tenant)
+	})
+}
+
+// totals returns this month's usage of a tenant, or of a single key of it when keyID is set.
+func (s *UsageStore) totals(tenant, keyID string) (bytes, rows int64) {
+	month := usageMonth(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, r := range s.records {
+		if k.month == month && k.tenant == tenant && (keyID == "" || k.keyID == keyID) {
+			bytes += r.BytesProcessed
+			rows += r.RowsExported
+		}
+	}
+	return bytes, rows
+}
+
+// checkQuota enforces the tenant and per-key monthly quotas of the caller in ctx before
+// an export starts. Quotas in warn mode only log.
+func (s *UsageStore) checkQuota(ctx context.Context) error {
+	tenant, t, ok := TenantFrom(ctx)
+	if !ok {
+		return nil
+	}
+	checks := []struct {
+		scope string
+		keyID string
+		quota config.Quota
+	}{
+		{"tenant", "", t.Quota},
+		{"key", APIKeyID(ctx), t.KeyQuota},
+	}
+	for _, c := range checks {
+		if c.quota.MonthlyBytes == 0 && c.quota.MonthlyRows == 0 {
+			continue
+		}
+		if c.scope == "key" && c.keyID == "" {
+			continue
+		}
+		bytes, rows := s.totals(tenant, c.keyID)
+		var exceeded string
+		switch {
+		case c.quota.MonthlyBytes > 0 && bytes >= c.quota.MonthlyBytes:
+			exceeded = fmt.Sprintf("%d of %d bytes processed this month", bytes, c.quota.MonthlyBytes)
+		case c.quota.MonthlyRows > 0 && rows >= c.quota.MonthlyRows:
+			exceeded = fmt.Sprintf("%d of %d rows exported this month", rows, c.quota.MonthlyRows)
+		default:
+			continue
+		}
+		if c.quota.Block() {
+			return fmt.Errorf("%w: %s quota of tenant %q reached: %s", ErrQuotaExceeded, c.scope, tenant, exceeded)
+		}
+		slog.WarnContext(ctx, "Usage quota reached", "tenant", tenant, "scope", c.scope, "usage", exceeded)
+	}
+	return nil
+}
+
+// meteredBigQuery sums the bytes processed by the jobs of one export, records their
+// statements for debug responses and reports their activity as progress.
+type meteredBigQuery struct {
+	BigQueryClient
+	bytes atomic.Int64
+}
+
+func (m *meteredBigQuery) RunQuery(ctx context.Context, sqlQuery, location string) (QueryJob, error) {
+	recordStatement(ctx, StatementBigQuery, sqlQuery)
+	job, err := m.BigQueryClient.RunQuery(ctx, sqlQuery, location)
+	progressFrom(ctx).touch()
+	m.bytes.Add(job.BytesProcessed)
+	return job, err
+}
+
+func (m *meteredBigQuery) ReadRows(ctx context.Context, sqlQuery, location string) (RowIterator, error) {
+	recordStatement(ctx, StatementBigQuery, sqlQuery)
+	it, err := m.BigQueryClient.ReadRows(ctx, sqlQuery, location)
+	if err != nil {
+		return it, err
+	}
+	m.bytes.Add(it.Job().BytesProcessed)
+	if p := progressFrom(ctx); p != nil {
+		p.touch()
+		it = &progressRows{RowIterator: it, p: p}
+	}
+	return it, nil
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUsageQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	usage, err := NewUsageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter(&fakeBigQuery{location: "US", bytes: 600}, NewGCSDriver(nil, nil), &config.Config{})
+	e.Usage = usage
+	tenant := config.Tenant{Quota: config.Quota{MonthlyBytes: 1000}}
+	ctx := WithAPIKeyID(WithTenant(context.Background(), "a", tenant), "key1")
+	params := ExportParams{Query: "SELECT 1", Output: "gs://b/out/"}
+
+	for i := 0; i < 2; i++ {
+		res, err := e.Run(ctx, params)
+		if err != nil {
+			t.Fatalf("run %d: Run() error = %v", i, err)
+		}
+		if res.BytesProcessed != 600 {
+			t.Errorf("BytesProcessed = %d, want 600", res.BytesProcessed)
+		}
+	}
+	if _, err := e.Run(ctx, params); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Run() over quota error = %v, want ErrQuotaExceeded", err)
+	}
+
+	tenant.Quota.Enforcement = config.QuotaWarn
+	if _, err := e.Run(WithAPIKeyID(WithTenant(context.Background(), "a", tenant), "key1"), params); err != nil {
+		t.Fatalf("Run() with warn quota error = %v", err)
+	}
+
+	reloaded, err := NewUsageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := reloaded.List(ctx, "")
+	if len(recs) != 1 || recs[0].KeyID != "key1" || recs[0].BytesProcessed != 1800 || recs[0].Exports != 3 {
+		t.Errorf("persisted usage = %+v", recs)
+	}
+}
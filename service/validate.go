@@ -0,0 +1,406 @@
+package service
+
+import (
+	"bq-exporter/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	CheckFail CheckStatus = "fail"
+	CheckSkip CheckStatus = "skip"
+)
+
+type ValidationCheck struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+}
+
+// ValidationReport is the structured result of ValidateConfig. OK is false when any check failed.
+type ValidationReport struct {
+	OK     bool              `json:"ok"`
+	Checks []ValidationCheck `json:"checks"`
+}
+
+func (r *ValidationReport) pass(name, detail string) {
+	r.Checks = append(r.Checks, ValidationCheck{Name: name, Status: CheckPass, Detail: detail})
+}
+
+func (r *ValidationReport) fail(name string, err error) {
+	r.OK = false
+	r.Checks = append(r.Checks, ValidationCheck{Name: name, Status: CheckFail, Detail: err.Error()})
+}
+
+func (r *ValidationReport) skip(name, detail string) {
+	r.Checks = append(r.Checks, ValidationCheck{Name: name, Status: CheckSkip, Detail: detail})
+}
+
+// ValidateConfig checks environment configuration, credentials, BigQuery and destination
+// connectivity, and the job-mode export definition without running any export.
+func ValidateConfig(ctx context.Context) *ValidationReport {
+	r := &ValidationReport{OK: true}
+
+	driver := strings.ToUpper(os.Getenv("EXPORT_DRIVER"))
+	if _, ok := knownDriver(driverName(driver)); ok {
+		r.pass("env.EXPORT_DRIVER", driverName(driver))
+	} else {
+		names := driverNames(nil)
+		r.fail("env.EXPORT_DRIVER", fmt.Errorf("unknown driver %q; expected %s or %s",
+			driver, strings.Join(names[:len(names)-1], ", "), names[len(names)-1]))
+	}
+	if driver == azureBlobDriverName {
+		if os.Getenv("AZURE_STORAGE_ACCOUNT") == "" && os.Getenv("AZURE_STORAGE_ENDPOINT") == "" {
+			r.fail("env.AZURE_STORAGE_ACCOUNT", fmt.Errorf("AZURE_STORAGE_ACCOUNT is required for the %s driver", azureBlobDriverName))
+		}
+		if os.Getenv("GCS_STAGING_BUCKETS") == "" {
+			r.fail("env.GCS_STAGING_BUCKETS", fmt.Errorf("the %s driver stages files in the GCS_STAGING_BUCKETS", azureBlobDriverName))
+		}
+	}
+
+	if port := os.Getenv("PORT"); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			r.fail("env.PORT", fmt.Errorf("invalid port %q", port))
+		} else {
+			r.pass("env.PORT", port)
+		}
+	}
+
+	switch mode := os.Getenv("RUN_MODE"); mode {
+	case "", "service", "job", "validate":
+		r.pass("env.RUN_MODE", mode)
+	default:
+		r.fail("env.RUN_MODE", fmt.Errorf("unknown run mode %q; expected service, job or validate", mode))
+	}
+
+	if v := os.Getenv("STARROCKS_BATCH_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			r.fail("env.STARROCKS_BATCH_SIZE", fmt.Errorf("must be a positive integer, got %q", v))
+		} else {
+			r.pass("env.STARROCKS_BATCH_SIZE", v)
+		}
+	}
+
+	for _, name := range []string{"STARROCKS_STREAM_CHUNK_ROWS", "STARROCKS_HTTP_PORT"} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+				r.fail("env."+name, fmt.Errorf("must be a positive integer, got %q", v))
+			} else {
+				r.pass("env."+name, v)
+			}
+		}
+	}
+	if tz := os.Getenv("SCHEDULER_TIMEZONE"); tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			r.fail("env.SCHEDULER_TIMEZONE", err)
+		} else {
+			r.pass("env.SCHEDULER_TIMEZONE", tz)
+		}
+	}
+	if cfg, err := webhookTLSConfig(os.Getenv("WEBHOOK_CA_FILE"), os.Getenv("WEBHOOK_CLIENT_CERT_FILE"), os.Getenv("WEBHOOK_CLIENT_KEY_FILE")); err != nil {
+		r.fail("env.WEBHOOK_TLS", err)
+	} else if cfg != nil {
+		r.pass("env.WEBHOOK_TLS", "custom CA or client certificate configured")
+	}
+	switch m := os.Getenv("STARROCKS_LOAD_METHOD"); strings.ToLower(m) {
+	case "":
+	case LoadMethodInsert, LoadMethodStream:
+		r.pass("env.STARROCKS_LOAD_METHOD", m)
+	default:
+		r.fail("env.STARROCKS_LOAD_METHOD", fmt.Errorf("unknown load method %q; expected insert or stream", m))
+	}
+
+	// Configuration file
+	var cfg *config.Config
+	if path := os.Getenv("CONFIG_FILE"); path == "" {
+		r.skip("config", "CONFIG_FILE not set")
+	} else if c, err := config.Load(path); err != nil {
+		r.fail("config", err)
+	} else {
+		cfg = c
+		r.pass("config", path)
+		if len(cfg.Pipelines) > 0 {
+			r.pass("config.pipelines", fmt.Sprintf("%d pipeline(s)", len(cfg.Pipelines)))
+		}
+		for name, d := range cfg.Defaults {
+			if _, ok := knownDriver(name); !ok {
+				r.fail("config.defaults", fmt.Errorf("defaults for unknown driver %q", name))
+				continue
+			}
+			if err := checkLabels(ExportParams{Labels: d.Labels}, name); err != nil {
+				r.fail("config.defaults", fmt.Errorf("defaults for %s: %w", name, err))
+			}
+		}
+		if env := os.Getenv("ENVIRONMENT"); env != "" {
+			if err := cfg.UseEnvironment(env); err != nil {
+				r.fail("env.ENVIRONMENT", err)
+			} else {
+				r.pass("env.ENVIRONMENT", env)
+			}
+		}
+	}
+
+	// Credentials and project
+	projectID := os.Getenv("GCP_PROJECT_ID")
+	var clientOpts []option.ClientOption
+	creds, err := CredentialsFromEnv(ctx)
+	if err == nil && creds != nil {
+		clientOpts = append(clientOpts, option.WithCredentials(creds))
+	} else if err == nil {
+		creds, err = google.FindDefaultCredentials(ctx, bigquery.Scope)
+	}
+	if err != nil {
+		r.fail("credentials", err)
+	} else {
+		r.pass("credentials", credentialType(creds))
+		if projectID == "" {
+			projectID = creds.ProjectID
+		}
+	}
+	if projectID == "" {
+		r.fail("project", fmt.Errorf("GCP_PROJECT_ID is not set and could not be detected from credentials"))
+	} else {
+		r.pass("project", projectID)
+	}
+
+	// BigQuery connectivity
+	var bq *BigQueryService
+	if projectID != "" && err == nil {
+		bq, err = NewBigQueryService(ctx, projectID, clientOpts...)
+		if err != nil {
+			r.fail("bigquery.client", err)
+		} else {
+			defer bq.Close()
+			if _, err := bq.DryRun(ctx, "SELECT 1", ""); err != nil {
+				r.fail("bigquery.connectivity", err)
+			} else {
+				r.pass("bigquery.connectivity", "dry-run succeeded")
+			}
+		}
+	} else {
+		r.skip("bigquery.connectivity", "no usable credentials or project")
+	}
+
+	// Destination connectivity
+	if driver == "STARROCKS" {
+		sr, err := NewStarRocksServiceFromEnv()
+		if err != nil {
+			r.fail("starrocks.connectivity", err)
+		} else {
+			sr.Close()
+			r.pass("starrocks.connectivity", sr.fes.String())
+		}
+	} else {
+		r.skip("starrocks.connectivity", "EXPORT_DRIVER is not STARROCKS")
+	}
+	if driver == redisDriverName {
+		if d, err := NewRedisDriverFromEnv(ctx); err != nil {
+			r.fail("redis.connectivity", err)
+		} else {
+			d.Close()
+			r.pass("redis.connectivity", "ping succeeded")
+		}
+	}
+	if driver == spannerDriverName {
+		if db := os.Getenv("SPANNER_DATABASE"); !spannerDatabaseName.MatchString(db) {
+			r.fail("env.SPANNER_DATABASE", fmt.Errorf("SPANNER_DATABASE must be projects/<project>/instances/<instance>/databases/<database>, got %q", db))
+		} else {
+			r.pass("env.SPANNER_DATABASE", db)
+		}
+	}
+	if driver == httpPostDriverName {
+		if httpPost, err := NewHTTPPostDriverFromEnv(); err != nil {
+			r.fail("env.HTTP_POST_URL", err)
+		} else {
+			r.pass("env.HTTP_POST_URL", httpPost.endpoint)
+		}
+	}
+
+	// Job-mode export definition
+	validateJobDefinition(ctx, r, bq, driver, cfg)
+
+	return r
+}
+
+func validateJobDefinition(ctx context.Context, r *ValidationReport, bq *BigQueryService, driver string, cfg *config.Config) {
+	query := os.Getenv("JOB_QUERY")
+	location := os.Getenv("JOB_QUERY_LOCATION")
+	pipelineJob := false
+	if name := os.Getenv("JOB_PIPELINE"); name != "" && query == "" {
+		var p config.Pipeline
+		var ok bool
+		if cfg != nil {
+			p, ok = cfg.Pipelines[name]
+		}
+		if !ok {
+			r.fail("job.pipeline", fmt.Errorf("%w: %s", ErrPipelineNotFound, name))
+			return
+		}
+		rendered, err := p.RenderQuery(ParseParameters(os.Getenv("JOB_PARAMETERS")))
+		if err != nil {
+			r.fail("job.pipeline", err)
+			return
+		}
+		r.pass("job.pipeline", name)
+		query, pipelineJob = rendered, true
+		if location == "" {
+			location = p.QueryLocation
+		}
+	}
+	if t := os.Getenv("JOB_CHANGES_TABLE"); t != "" && query == "" {
+		// The change history query depends on the stored watermark; check the source table
+		query = "SELECT * FROM " + quoteBigQueryTable(t)
+		if !strings.Contains(os.Getenv("WATERMARK_TABLE"), ".") {
+			r.fail("env.WATERMARK_TABLE", fmt.Errorf("WATERMARK_TABLE (dataset.table) is required for JOB_CHANGES_TABLE"))
+		}
+	}
+	if query == "" {
+		if os.Getenv("RUN_MODE") == "job" {
+			r.fail("job.query", fmt.Errorf("JOB_QUERY is empty"))
+		} else {
+			r.skip("job.query", "JOB_QUERY not set")
+		}
+		return
+	}
+	if bq == nil {
+		r.skip("job.query", "BigQuery client unavailable")
+	} else if dry, err := bq.DryRun(ctx, query, location); err != nil {
+		r.fail("job.query", err)
+	} else {
+		r.pass("job.query", fmt.Sprintf("dry-run OK, %d bytes would be processed", dry.TotalBytesProcessed))
+		if location == "" {
+			if dry.Location == "" {
+				r.fail("job.query_location", fmt.Errorf("JOB_QUERY_LOCATION is empty and could not be detected"))
+			} else {
+				r.pass("job.query_location", "detected "+dry.Location)
+			}
+		}
+	}
+	if pipelineJob {
+		// The destination comes from the pipeline definition
+		return
+	}
+
+	if driver == "STARROCKS" {
+		if ddl := strings.TrimSpace(os.Getenv("JOB_CREATE_DDL")); ddl != "" {
+			if !strings.HasPrefix(strings.ToUpper(ddl), "CREATE TABLE") {
+				r.fail("job.create_ddl", fmt.Errorf("JOB_CREATE_DDL must be a CREATE TABLE statement"))
+			} else {
+				r.pass("job.create_ddl", "")
+			}
+		}
+		return
+	}
+
+	if driver == "BIGQUERY" {
+		if _, err := resolveBigQueryTable(os.Getenv("JOB_TABLE"), os.Getenv("JOB_DATABASE")); err != nil {
+			r.fail("job.table", err)
+		} else {
+			r.pass("job.table", os.Getenv("JOB_TABLE"))
+		}
+		return
+	}
+
+	if driver == redisDriverName {
+		var keys []string
+		for k := range strings.SplitSeq(os.Getenv("JOB_KEY_COLUMNS"), ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				keys = append(keys, k)
+			}
+		}
+		if prefix, _, _, err := redisOptions(ExportParams{Table: os.Getenv("JOB_TABLE"), KeyColumns: keys,
+			RedisType: os.Getenv("JOB_REDIS_TYPE"), RedisTTL: os.Getenv("JOB_REDIS_TTL")}); err != nil {
+			r.fail("job.table", err)
+		} else {
+			r.pass("job.table", prefix)
+		}
+		return
+	}
+	if driver == spannerDriverName {
+		if table, err := spannerTable(ExportParams{Table: os.Getenv("JOB_TABLE")}); err != nil {
+			r.fail("job.table", err)
+		} else {
+			r.pass("job.table", table)
+		}
+		return
+	}
+	if driver == firestoreDriverName {
+		var keys []string
+		for k := range strings.SplitSeq(os.Getenv("JOB_KEY_COLUMNS"), ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				keys = append(keys, k)
+			}
+		}
+		if collection, _, _, err := firestoreTarget(ExportParams{Table: os.Getenv("JOB_TABLE"), KeyColumns: keys, WriteMode: os.Getenv("JOB_WRITE_MODE")}); err != nil {
+			r.fail("job.table", err)
+		} else {
+			r.pass("job.table", collection)
+		}
+		return
+	}
+
+	output := os.Getenv("JOB_OUTPUT")
+	if driver == httpPostDriverName {
+		if httpPost, err := NewHTTPPostDriverFromEnv(); err != nil {
+			r.skip("job.output", "HTTP_POST_URL is invalid")
+		} else if target, err := httpPost.target(output); err != nil {
+			r.fail("job.output", err)
+		} else {
+			r.pass("job.output", target)
+		}
+		return
+	}
+	if driver == googleDriveDriverName {
+		if _, _, err := parseDriveURI(output); err != nil {
+			r.fail("job.output", fmt.Errorf("JOB_OUTPUT must be a drive:// URI, got %q", output))
+		} else {
+			r.pass("job.output", output)
+		}
+		return
+	}
+	if driver == azureBlobDriverName {
+		if _, _, err := parseAzureURI(output); err != nil {
+			r.fail("job.output", fmt.Errorf("JOB_OUTPUT must be an az:// URI, got %q", output))
+		} else {
+			r.pass("job.output", output)
+		}
+		return
+	}
+	if !strings.HasPrefix(output, "gs://") {
+		r.fail("job.output", fmt.Errorf("JOB_OUTPUT must be a gs:// URI, got %q", output))
+	} else {
+		r.pass("job.output", output)
+	}
+}
+
+func driverName(driver string) string {
+	if driver == "" {
+		return "GCS_PARQUET"
+	}
+	return driver
+}
+
+func credentialType(creds *google.Credentials) string {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(creds.JSON, &head) == nil && head.Type == "external_account" {
+		return "externalaccount"
+	}
+	if creds.JSON != nil {
+		return "serviceaccount"
+	}
+	return "default"
+}
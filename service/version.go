@@ -0,0 +1,67 @@
+package service
+
+import (
+	"cmp"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version, Commit and BuildTime identify the build, set with
+// -ldflags "-X bq-exporter/service.Version=... -X bq-exporter/service.Commit=... -X bq-exporter/service.BuildTime=...".
+// Unset, Commit and BuildTime come from the VCS information Go embeds in builds of a
+// git checkout.
+var (
+	Version   string
+	Commit    string
+	BuildTime string
+)
+
+// BuildInfo identifies what an instance runs: its build, driver and configuration.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	// Modified is set for builds of a checkout with uncommitted changes
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+	// Driver is the EXPORT_DRIVER of the instance, Drivers those the build supports
+	Driver  string   `json:"driver"`
+	Drivers []string `json:"drivers"`
+	// ConfigFingerprint identifies the configuration file loaded at startup
+	ConfigFingerprint string `json:"config_fingerprint,omitempty"`
+	// Environment is the selected ENVIRONMENT
+	Environment string `json:"environment,omitempty"`
+}
+
+// ReadBuildInfo returns the build information of the running binary, for driver and the
+// configuration with fingerprint.
+func ReadBuildInfo(driver, fingerprint, environment string) BuildInfo {
+	info := BuildInfo{
+		Version:           cmp.Or(Version, "dev"),
+		Commit:            Commit,
+		BuildTime:         BuildTime,
+		GoVersion:         runtime.Version(),
+		Driver:            driver,
+		Drivers:           driverNames(nil),
+		ConfigFingerprint: fingerprint,
+		Environment:       environment,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = cmp.Or(info.Commit, s.Value)
+		case "vcs.time":
+			info.BuildTime = cmp.Or(info.BuildTime, s.Value)
+		case "vcs.modified":
+			info.Modified = s.Value == "true" && Commit == ""
+		}
+	}
+	return info
+}
@@ -0,0 +1,23 @@
+package service
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReadBuildInfo(t *testing.T) {
+	info := ReadBuildInfo("STARROCKS", "9b1d4e07a2c3", "")
+	if info.Version == "" || info.GoVersion == "" || info.Driver != "STARROCKS" || info.ConfigFingerprint != "9b1d4e07a2c3" {
+		t.Errorf("ReadBuildInfo() = %+v", info)
+	}
+	if !slices.Contains(info.Drivers, "STARROCKS") || !slices.Contains(info.Drivers, sqliteDriverName) {
+		t.Errorf("ReadBuildInfo() drivers = %v", info.Drivers)
+	}
+
+	// Values set with -ldflags win over the VCS information of the build
+	defer func(v, c, b string) { Version, Commit, BuildTime = v, c, b }(Version, Commit, BuildTime)
+	Version, Commit, BuildTime = "1.4.0", "0cda665", "2026-10-14T08:00:00Z"
+	if info := ReadBuildInfo("", "", ""); info.Version != "1.4.0" || info.Commit != "0cda665" || info.BuildTime != "2026-10-14T08:00:00Z" || info.Modified {
+		t.Errorf("ReadBuildInfo() with ldflags = %+v", info)
+	}
+}
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bq-exporter/logging"
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// workbookDriverName is the driver workbook exports are recorded with in the job history.
+const workbookDriverName = "XLSX"
+
+// defaultXLSXMaxRows is the row cap of workbooks unless XLSX_MAX_ROWS sets another.
+const defaultXLSXMaxRows = 50000
+
+// xlsxMaxRowsFromEnv reads XLSX_MAX_ROWS, the most rows (over all sheets) a workbook
+// export may hold; Excel's own limit is 1,048,575 per sheet.
+func xlsxMaxRowsFromEnv() int {
+	if n, err := strconv.Atoi(os.Getenv("XLSX_MAX_ROWS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultXLSXMaxRows
+}
+
+// WorkbookSheet is one worksheet of a workbook export and the query filling it.
+type WorkbookSheet struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+// WorkbookSheetResult reports the rows written to one sheet.
+type WorkbookSheetResult struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// WorkbookResult is the outcome of a workbook export.
+type WorkbookResult struct {
+	GCSPath        string                `json:"gcs_path"`
+	Rows           int64                 `json:"rows_loaded"`
+	BytesProcessed int64                 `json:"bytes_processed,omitempty"`
+	Sheets         []WorkbookSheetResult `json:"sheets"`
+	// Deidentification is the audit of a de-identified workbook
+	Deidentification *DeidAudit `json:"deidentification,omitempty"`
+}
+
+// Workbook exports small results as one XLSX file on GCS, with a worksheet per query.
+// template carries the shared settings (query_location, snapshot_time,
+// impersonate_service_account, deid_profile, output, filename, use_timestamp, name). The
+// rows of all sheets are held in memory, so the workbook fails with a data error when they
+// exceed XLSX_MAX_ROWS or Excel's limits, before anything is written. Workbooks are
+// confined and limited like other tenant exports, and recorded in the job history.
+func (e *Exporter) Workbook(ctx context.Context, sheets []WorkbookSheet, template ExportParams) (WorkbookResult, error) {
+	template = applyDefaults(template, e.Defaults)
+	rank, err := priorityRank(template.Priority)
+	if err != nil {
+		return WorkbookResult{}, ConfigError(err)
+	}
+	if err := checkWorkbookSheets(sheets); err != nil {
+		return WorkbookResult{}, ConfigError(err)
+	}
+	if e.GCS == nil {
+		return WorkbookResult{}, ConfigError(fmt.Errorf("workbook exports need a Cloud Storage client"))
+	}
+	if template, err = e.applyDeidProfile(template); err != nil {
+		return WorkbookResult{}, ConfigError(err)
+	}
+	if ctx, err = template.deid.withHMACKey(ctx, e.ReadSecret); err != nil {
+		return WorkbookResult{}, err
+	}
+	tenant, t, isTenant := TenantFrom(ctx)
+	if isTenant {
+		if template, err = applyTenant(template, tenant, t); err != nil {
+			return WorkbookResult{}, err
+		}
+		template = applyTenantRowFilter(ctx, template, t)
+		if err := e.Usage.checkQuota(ctx); err != nil {
+			return WorkbookResult{}, err
+		}
+		release, err := e.slots.acquire(tenant, t.MaxConcurrentExports)
+		if err != nil {
+			return WorkbookResult{}, err
+		}
+		defer release()
+	}
+	uri, err := workbookURI(template)
+	if err != nil {
+		return WorkbookResult{}, ConfigError(err)
+	}
+	// All sheets read the same point in time
+	if template, err = resolveSnapshotTime(template, time.Now()); err != nil {
+		return WorkbookResult{}, err
+	}
+
+	rec, _ := e.Jobs.start(ctx, workbookDriverName, template, "")
+	if logging.RequestID(ctx) == "" {
+		ctx = logging.WithRequestID(ctx, rec.ID)
+	}
+	release, err := e.queue.acquire(ctx, rank, func() { e.Jobs.queued(rec) })
+	if err != nil {
+		e.finish(rec, ExportResult{}, err)
+		return WorkbookResult{}, err
+	}
+	defer release()
+	e.Jobs.running(rec)
+	client, err := e.impersonatedClient(ctx, template)
+	if err != nil {
+		e.finish(rec, ExportResult{}, err)
+		return WorkbookResult{}, err
+	}
+	bq := &meteredBigQuery{BigQueryClient: client}
+	res, err := e.workbook(ctx, bq, sheets, template, uri, t.MaxBytesPerQuery)
+	res.BytesProcessed = bq.bytes.Load()
+	e.Usage.record(ctx, res.BytesProcessed, res.Rows)
+	job := ExportResult{GCSPath: res.GCSPath, Rows: res.Rows, BytesProcessed: res.BytesProcessed, Deidentification: res.Deidentification}
+	if err == nil {
+		err = recordDeidAudit(ctx, bq, template, job)
+	}
+	e.finish(rec, job, err)
+	return res, err
+}
+
+func (e *Exporter) workbook(ctx context.Context, bq BigQueryClient, sheets []WorkbookSheet, template ExportParams, uri string, maxBytes int64) (WorkbookResult, error) {
+	maxRows := e.XLSXMaxRows
+	if maxRows <= 0 {
+		maxRows = defaultXLSXMaxRows
+	}
+	slog.InfoContext(ctx, "Starting workbook export", "gcs_path", uri, "sheets", len(sheets), "max_rows", maxRows)
+	res := WorkbookResult{GCSPath: uri}
+	out := make([]xlsxSheet, len(sheets))
+	for i, s := range sheets {
+		p := template
+		var err error
+		if p.Query, err = rowFilterQuery(s.Query, template); err != nil {
+			return res, fmt.Errorf("sheet %s: %w", s.Name, err)
+		}
+		if p, err = applySnapshotTime(p, time.Now()); err != nil {
+			return res, err
+		}
+		location, err := checkQueryBytes(ctx, bq, p.Query, template.QueryLocation, maxBytes)
+		if err != nil {
+			return res, fmt.Errorf("sheet %s: %w", s.Name, err)
+		}
+		if location, err = ResolveLocation(ctx, bq, p.Query, location); err != nil {
+			return res, err
+		}
+		if p.Query, err = template.deid.deidentify(ctx, bq, p.Query, location); err != nil {
+			return res, fmt.Errorf("sheet %s: %w", s.Name, err)
+		}
+		// One row past the cap tells a full result from one that is too large
+		left := maxRows - int(res.Rows)
+		it, err := bq.ReadRows(ctx, fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", p.Query, left+1), location)
+		if err != nil {
+			return res, fmt.Errorf("sheet %s: %w", s.Name, err)
+		}
+		sheet := xlsxSheet{name: s.Name}
+		for {
+			var row []bigquery.Value
+			err := it.Next(&row)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				it.Close()
+				return res, fmt.Errorf("sheet %s: %w", s.Name, err)
+			}
+			if len(sheet.rows) == left {
+				it.Close()
+				return res, DataError(fmt.Errorf("workbook has more than %d rows (XLSX_MAX_ROWS) by sheet %s; export larger results as CSV or Parquet", maxRows, s.Name))
+			}
+			if len(sheet.rows) == xlsxMaxSheetRows {
+				it.Close()
+				return res, DataError(fmt.Errorf("sheet %s has more than %d rows, Excel's limit; export larger results as CSV or Parquet", s.Name, xlsxMaxSheetRows))
+			}
+			sheet.rows = append(sheet.rows, row)
+		}
+		sheet.schema = it.Schema()
+		it.Close()
+		out[i] = sheet
+		res.Rows += int64(len(sheet.rows))
+		res.Sheets = append(res.Sheets, WorkbookSheetResult{Name: s.Name, Rows: int64(len(sheet.rows))})
+	}
+	if template.deid != nil {
+		audit := template.deid.audit
+		res.Deidentification = &audit
+	}
+
+	var buf bytes.Buffer
+	if err := writeXLSX(&buf, out); err != nil {
+		return res, fmt.Errorf("failed to build workbook: %w", err)
+	}
+	bucket, name, err := parseGCSURI(uri)
+	if err != nil {
+		return res, err
+	}
+	if err := e.GCS.WriteObject(ctx, bucket, name, xlsxContentType, buf.Bytes()); err != nil {
+		return res, err
+	}
+	slog.InfoContext(ctx, "Workbook export completed", "gcs_path", uri, "rows", res.Rows, "bytes", buf.Len())
+	return res, nil
+}
+
+// checkWorkbookSheets validates the sheets against Excel's naming rules.
+func checkWorkbookSheets(sheets []WorkbookSheet) error {
+	if len(sheets) == 0 {
+		return fmt.Errorf("a workbook needs at least one sheet")
+	}
+	seen := map[string]bool{}
+	for i, s := range sheets {
+		switch {
+		case s.Query == "":
+			return fmt.Errorf("sheet %d has no query", i+1)
+		case s.Name == "" || len([]rune(s.Name)) > 31 || strings.ContainsAny(s.Name, `[]:*?/\`) || strings.HasPrefix(s.Name, "'"):
+			return fmt.Errorf("invalid sheet name %q: 1 to 31 characters without [ ] : * ? / \\ or a leading '", s.Name)
+		case seen[strings.ToLower(s.Name)]:
+			return fmt.Errorf("duplicate sheet name %q", s.Name)
+		}
+		seen[strings.ToLower(s.Name)] = true
+	}
+	return nil
+}
+
+// workbookURI is the object a workbook is written to: output itself if it names an
+// .xlsx file, otherwise <filename or name>[-timestamp].xlsx in the output folder.
+func workbookURI(p ExportParams) (string, error) {
+	if !strings.HasPrefix(p.Output, "gs://") {
+		return "", fmt.Errorf("output must be a gs:// URI, got %q", p.Output)
+	}
+	if strings.HasSuffix(p.Output, ".xlsx") {
+		return p.Output, nil
+	}
+	base := cmp.Or(p.Filename, p.Name, "export")
+	if p.UseTimestamp != nil && *p.UseTimestamp {
+		base += "-" + time.Now().Format("20060102-150405")
+	}
+	return strings.TrimSuffix(p.Output, "/") + "/" + base + ".xlsx", nil
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"archive/zip"
+	"bq-exporter/config"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+func TestWriteXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeXLSX(&buf, []xlsxSheet{{
+		name:   "Visits & labs",
+		schema: bigquery.Schema{{Name: "id"}, {Name: "site"}, {Name: "visit_date"}, {Name: "seen_at"}, {Name: "ok"}, {Name: "tags"}},
+		rows: [][]bigquery.Value{
+			{int64(1), " HCMC <1>", civil.Date{Year: 2026, Month: 10, Day: 1}, time.Date(2026, 10, 1, 6, 0, 0, 0, time.UTC), true, []bigquery.Value{"a", "b"}},
+			{int64(2), nil, nil, nil, false, nil},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("writeXLSX() error = %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip file: %v", err)
+	}
+	parts := map[string]string{}
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		data, _ := io.ReadAll(r)
+		parts[f.Name] = string(data)
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("workbook has no %s", name)
+		}
+	}
+	if !strings.Contains(parts["xl/workbook.xml"], `<sheet name="Visits &amp; labs" sheetId="1" r:id="rId1"/>`) {
+		t.Errorf("workbook.xml = %s", parts["xl/workbook.xml"])
+	}
+	sheet := parts["xl/worksheets/sheet1.xml"]
+	for _, want := range []string{
+		`<c r="A1" t="inlineStr" s="4"><is><t xml:space="preserve">id</t></is></c>`,
+		`<c r="A2"><v>1</v></c>`,
+		`<c r="B2" t="inlineStr"><is><t xml:space="preserve"> HCMC &lt;1&gt;</t></is></c>`,
+		`<c r="C2" s="1"><v>46296</v></c>`,
+		`<c r="D2" s="2"><v>46296.25</v></c>`,
+		`<c r="E2" t="b"><v>1</v></c>`,
+		`<c r="F2" t="inlineStr"><is><t xml:space="preserve">[&#34;a&#34;,&#34;b&#34;]</t></is></c>`,
+		`<row r="3"><c r="A3"><v>2</v></c><c r="E3" t="b"><v>0</v></c></row>`,
+	} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("sheet does not contain %s:\n%s", want, sheet)
+		}
+	}
+	numbers := writeXLSXSheetString(t, xlsxSheet{
+		schema: bigquery.Schema{{Name: "n"}, {Name: "big"}, {Name: "amount"}, {Name: "precise"}},
+		rows:   [][]bigquery.Value{{int64(1 << 53), int64(1<<53 + 1), big.NewRat(25, 100), big.NewRat(123456789123456789, 1000000000)}},
+	})
+	for _, want := range []string{
+		`<c r="A2"><v>9007199254740992</v></c>`,
+		`<c r="B2" t="inlineStr"><is><t xml:space="preserve">9007199254740993</t></is></c>`,
+		`<c r="C2"><v>0.25</v></c>`,
+		`<c r="D2" t="inlineStr"><is><t xml:space="preserve">123456789.123456789</t></is></c>`,
+	} {
+		if !strings.Contains(numbers, want) {
+			t.Errorf("sheet does not contain %s:\n%s", want, numbers)
+		}
+	}
+	long := xlsxSheet{name: "Notes", schema: bigquery.Schema{{Name: "note"}}, rows: [][]bigquery.Value{{strings.Repeat("x", xlsxMaxCellChars+1)}}}
+	if err := writeXLSX(io.Discard, []xlsxSheet{long}); FailureClass(err) != FailureData {
+		t.Errorf("writeXLSX() of a cell over Excel's limit error = %v, want a data error", err)
+	}
+
+	if got := xlsxCellRef(27, 5); got != "AB5" {
+		t.Errorf("xlsxCellRef(27, 5) = %s, want AB5", got)
+	}
+}
+
+// writeXLSXSheetString returns the worksheet XML of s.
+func writeXLSXSheetString(t *testing.T, s xlsxSheet) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeXLSXSheet(&buf, s); err != nil {
+		t.Fatalf("writeXLSXSheet() error = %v", err)
+	}
+	return buf.String()
+}
+
+func TestWorkbook(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}},
+		rows:   [][]bigquery.Value{{int64(1)}, {int64(2)}},
+	}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), &config.Config{})
+	e.GCS = gcs.service(t)
+	sheets := []WorkbookSheet{{Name: "Patients", Query: "SELECT id FROM ds.patients"}, {Name: "Visits", Query: "SELECT id FROM ds.visits"}}
+	res, err := e.Workbook(context.Background(), sheets, ExportParams{QueryLocation: "US", Output: "gs://b/site-a/", Name: "monthly"})
+	if err != nil {
+		t.Fatalf("Workbook() error = %v", err)
+	}
+	if res.GCSPath != "gs://b/site-a/monthly.xlsx" || res.Rows != 4 || len(res.Sheets) != 2 || res.Sheets[1].Rows != 2 {
+		t.Errorf("Workbook() = %+v", res)
+	}
+	if !strings.Contains(bq.queries[len(bq.queries)-1], "SELECT * FROM (SELECT id FROM ds.visits) LIMIT 49999") {
+		t.Errorf("sheet query = %s", bq.queries[len(bq.queries)-1])
+	}
+	gcs.mu.Lock()
+	data := gcs.objects["site-a/monthly.xlsx"]
+	gcs.mu.Unlock()
+	if _, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Errorf("written workbook is not a zip file: %v", err)
+	}
+
+	if jobs := e.Jobs.List(context.Background()); len(jobs) != 1 || jobs[0].Driver != workbookDriverName || jobs[0].Status != JobSucceeded || jobs[0].Rows != 4 {
+		t.Errorf("job history = %+v, want the succeeded workbook", jobs)
+	}
+	if _, err := e.Retry(context.Background(), e.Jobs.List(context.Background())[0].ID); !errors.Is(err, ErrJobNotRetryable) {
+		t.Errorf("Retry() of a workbook error = %v, want ErrJobNotRetryable", err)
+	}
+
+	// Tenants are held to their bytes per query
+	bq.bytes = 2 << 30
+	tenant := WithTenant(context.Background(), "a", config.Tenant{OutputPrefix: "gs://b/site-a/", MaxBytesPerQuery: 1 << 30})
+	if _, err := e.Workbook(tenant, sheets, ExportParams{QueryLocation: "US", Name: "tenant"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Workbook() over the tenant's bytes per query error = %v, want ErrQuotaExceeded", err)
+	}
+	bq.bytes = 0
+
+	e.XLSXMaxRows = 3
+	if _, err := e.Workbook(context.Background(), sheets, ExportParams{QueryLocation: "US", Output: "gs://b/site-a/big.xlsx"}); FailureClass(err) != FailureData {
+		t.Errorf("Workbook() over the row cap error = %v, want a data error", err)
+	}
+	gcs.mu.Lock()
+	_, written := gcs.objects["site-a/big.xlsx"]
+	gcs.mu.Unlock()
+	if written {
+		t.Error("a workbook over the row cap was written")
+	}
+
+	for _, bad := range [][]WorkbookSheet{
+		nil,
+		{{Name: "a/b", Query: "SELECT 1"}},
+		{{Name: "A", Query: "SELECT 1"}, {Name: "a", Query: "SELECT 2"}},
+		{{Name: "A"}},
+	} {
+		if _, err := e.Workbook(context.Background(), bad, ExportParams{Output: "gs://b/x.xlsx"}); FailureClass(err) != FailureConfig {
+			t.Errorf("Workbook(%+v) error = %v, want a config error", bad, err)
+		}
+	}
+}
+
+func TestWorkbookDeidProfile(t *testing.T) {
+	gcs := newFakeGCS(t)
+	bq := &fakeBigQuery{
+		schema: bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}, {Name: "name", Type: bigquery.StringFieldType}},
+		rows:   [][]bigquery.Value{{int64(1), "An"}},
+	}
+	cfg := &config.Config{DeidProfiles: map[string]config.DeidProfile{"share": {Columns: map[string]config.DeidRule{"name": {Rule: config.DeidDrop}}}}}
+	e := NewExporter(bq, NewGCSDriver(nil, nil), cfg)
+	e.GCS = gcs.service(t)
+	sheets := []WorkbookSheet{{Name: "Patients", Query: "SELECT id, name FROM ds.patients"}}
+	res, err := e.Workbook(context.Background(), sheets, ExportParams{QueryLocation: "US", Output: "gs://b/share/", DeidProfile: "share"})
+	if err != nil {
+		t.Fatalf("Workbook() error = %v", err)
+	}
+	if res.Deidentification == nil || res.Deidentification.Profile != "share" {
+		t.Errorf("Workbook() deidentification = %+v", res.Deidentification)
+	}
+	if q := bq.queries[len(bq.queries)-1]; !strings.Contains(q, "EXCEPT (`name`)") {
+		t.Errorf("sheet query = %s, want the de-identified query", q)
+	}
+	if _, err := e.Workbook(context.Background(), sheets, ExportParams{QueryLocation: "US", Output: "gs://b/share/", DeidProfile: "other"}); FailureClass(err) != FailureConfig {
+		t.Errorf("Workbook() with an unknown deid_profile error = %v, want a config error", err)
+	}
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+// xlsxContentType is the MIME type of XLSX workbooks.
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// Excel's limits: the rows of a sheet (besides the header row), the characters of a cell,
+// and the integers a number cell holds exactly.
+const (
+	xlsxMaxSheetRows = 1048575
+	xlsxMaxCellChars = 32767
+	xlsxMaxExactInt  = 1 << 53
+)
+
+// xlsxSheet is one worksheet: a header row of the schema's column names, then the rows.
+type xlsxSheet struct {
+	name   string
+	schema bigquery.Schema
+	rows   [][]bigquery.Value
+}
+
+// Cell styles of styles.xml, by index into cellXfs.
+const (
+	xlsxStyleDefault = iota
+	xlsxStyleDate
+	xlsxStyleDateTime
+	xlsxStyleTime
+	xlsxStyleHeader
+)
+
+const xlsxStyles = `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="5">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="14" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="22" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="21" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`</cellXfs></styleSheet>`
+
+// writeXLSX writes sheets as an XLSX workbook. Numbers and booleans are typed cells,
+// dates and times Excel dates in their own number formats, and everything else text
+// (arrays and records as JSON). Numbers a double cannot hold exactly (INT64 beyond 2^53,
+// NUMERIC with more digits) are text, so no digit is lost. The header row is bold and
+// frozen. Text longer than a cell holds fails with a data error.
+func writeXLSX(w io.Writer, sheets []xlsxSheet) error {
+	z := zip.NewWriter(w)
+	part := func(name, content string) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, xml.Header+content)
+		return err
+	}
+
+	var types, rels, list strings.Builder
+	types.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	rels.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i, s := range sheets {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+		fmt.Fprintf(&list, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(s.name), n, n)
+	}
+	types.WriteString(`</Types>`)
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`, len(sheets)+1)
+
+	for _, p := range []struct{ name, content string }{
+		{"[Content_Types].xml", types.String()},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + list.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", rels.String()},
+		{"xl/styles.xml", xlsxStyles},
+	} {
+		if err := part(p.name, p.content); err != nil {
+			return err
+		}
+	}
+	for i, s := range sheets {
+		f, err := z.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := writeXLSXSheet(f, s); err != nil {
+			return fmt.Errorf("sheet %s: %w", s.name, err)
+		}
+	}
+	return z.Close()
+}
+
+func writeXLSXSheet(w io.Writer, s xlsxSheet) error {
+	b := bufio.NewWriter(w)
+	b.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>` +
+		`<sheetData><row r="1">`)
+	for j, f := range s.schema {
+		if err := writeXLSXText(b, xlsxCellRef(j, 1), f.Name, xlsxStyleHeader); err != nil {
+			return err
+		}
+	}
+	b.WriteString(`</row>`)
+	for i, row := range s.rows {
+		r := i + 2
+		fmt.Fprintf(b, `<row r="%d">`, r)
+		for j, v := range row {
+			if err := writeXLSXCell(b, xlsxCellRef(j, r), v); err != nil {
+				return err
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.Flush()
+}
+
+// xlsxEpoch is day 0 of Excel's 1900 date system, as corrected for its 1900 leap year
+// bug (so serials are right from March 1900 on).
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+var xlsxMinDate = time.Date(1900, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func writeXLSXCell(b *bufio.Writer, ref string, v bigquery.Value) error {
+	serial := func(t time.Time, style int) error {
+		if t.Before(xlsxMinDate) {
+			return writeXLSXText(b, ref, t.Format(time.RFC3339Nano), xlsxStyleDefault)
+		}
+		days := float64(t.Sub(xlsxEpoch)) / float64(24*time.Hour)
+		fmt.Fprintf(b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style, strconv.FormatFloat(days, 'f', -1, 64))
+		return nil
+	}
+	switch v := v.(type) {
+	case nil:
+	case int64:
+		if v > xlsxMaxExactInt || v < -xlsxMaxExactInt {
+			return writeXLSXText(b, ref, strconv.FormatInt(v, 10), xlsxStyleDefault)
+		}
+		fmt.Fprintf(b, `<c r="%s"><v>%d</v></c>`, ref, v)
+	case float64:
+		fmt.Fprintf(b, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'g', -1, 64))
+	case *big.Rat:
+		f, _ := v.Float64()
+		n := strconv.FormatFloat(f, 'g', -1, 64)
+		if r, ok := new(big.Rat).SetString(n); !ok || r.Cmp(v) != 0 {
+			return writeXLSXText(b, ref, downloadJSONValue(v).(json.Number).String(), xlsxStyleDefault)
+		}
+		fmt.Fprintf(b, `<c r="%s"><v>%s</v></c>`, ref, n)
+	case bool:
+		n := 0
+		if v {
+			n = 1
+		}
+		fmt.Fprintf(b, `<c r="%s" t="b"><v>%d</v></c>`, ref, n)
+	case string:
+		return writeXLSXText(b, ref, v, xlsxStyleDefault)
+	case civil.Date:
+		return serial(v.In(time.UTC), xlsxStyleDate)
+	case civil.DateTime:
+		return serial(v.In(time.UTC), xlsxStyleDateTime)
+	case time.Time:
+		return serial(v.UTC(), xlsxStyleDateTime)
+	case civil.Time:
+		day := float64(v.Hour*3600+v.Minute*60+v.Second)/86400 + float64(v.Nanosecond)/86400e9
+		fmt.Fprintf(b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, xlsxStyleTime, strconv.FormatFloat(day, 'f', -1, 64))
+	case []byte:
+		return writeXLSXText(b, ref, string(v), xlsxStyleDefault)
+	case []bigquery.Value, map[string]bigquery.Value:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return writeXLSXText(b, ref, string(data), xlsxStyleDefault)
+	default:
+		return writeXLSXText(b, ref, fmt.Sprint(v), xlsxStyleDefault)
+	}
+	return nil
+}
+
+func writeXLSXText(b *bufio.Writer, ref, s string, style int) error {
+	if n := utf8.RuneCountInString(s); n > xlsxMaxCellChars {
+		return DataError(fmt.Errorf("cell %s holds %d characters, more than Excel's %d", ref, n, xlsxMaxCellChars))
+	}
+	fmt.Fprintf(b, `<c r="%s" t="inlineStr"`, ref)
+	if style != xlsxStyleDefault {
+		fmt.Fprintf(b, ` s="%d"`, style)
+	}
+	b.WriteString(`><is><t xml:space="preserve">` + xmlEscape(s) + `</t></is></c>`)
+	return nil
+}
+
+// xlsxCellRef is the A1 reference of the zero-based column col in row.
+func xlsxCellRef(col, row int) string {
+	var name []byte
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = append([]byte{byte('A' + (col-1)%26)}, name...)
+	}
+	return string(name) + strconv.Itoa(row)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}